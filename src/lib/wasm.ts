@@ -2,42 +2,50 @@
 declare global {
   interface Window {
     Go: any;
-    compressPDF: (data: Uint8Array, progress?: (p: number) => void) => Promise<{
+    compressPDF: (data: Uint8Array, progress?: (p: number, jobId: number) => void) => Promise<{
       data: Uint8Array;
       originalSize: number;
       compressedSize: number;
       compressionRatio: number;
     }>;
-    compressImage: (data: Uint8Array, mimeType: string, progress?: (p: number) => void) => Promise<{
+    compressImage: (data: Uint8Array, mimeType: string, progress?: (p: number, jobId: number) => void) => Promise<{
       data: Uint8Array;
       originalSize: number;
       compressedSize: number;
       compressionRatio: number;
     }>;
-    compressBatch: (files: Array<{data: Uint8Array, type: string}>, progress?: (p: number) => void) => Promise<Array<{
+    compressBatch: (files: Array<{data: Uint8Array, type: string}>, progress?: (p: number, jobId: number) => void) => Promise<Array<{
       data: Uint8Array;
       originalSize: number;
       compressedSize: number;
       compressionRatio: number;
     }>>;
     wasmReady: boolean;
+    isReady?: (kind?: string) => boolean;
+    init?: (options?: { preload?: Array<'image' | 'pdf' | 'data'> }) => Promise<{ warmed: Record<string, number> }>;
+    // Namespace holding every function; builds without it only set the globals above
+    FileZap?: Pick<Window, 'compressPDF' | 'compressImage' | 'compressBatch' | 'init'> & {
+      isReady: (kind?: string) => boolean;
+      shutdown: () => number;
+      instance: string;
+    };
   }
 }
 
 interface WasmModule {
-  compressPDF: (data: Uint8Array, progress?: (p: number) => void) => Promise<{
+  compressPDF: (data: Uint8Array, progress?: (p: number, jobId: number) => void) => Promise<{
     data: Uint8Array;
     originalSize: number;
     compressedSize: number;
     compressionRatio: number;
   }>;
-  compressImage: (data: Uint8Array, mimeType: string, progress?: (p: number) => void) => Promise<{
+  compressImage: (data: Uint8Array, mimeType: string, progress?: (p: number, jobId: number) => void) => Promise<{
     data: Uint8Array;
     originalSize: number;
     compressedSize: number;
     compressionRatio: number;
   }>;
-  compressBatch: (files: Array<{data: Uint8Array, type: string}>, progress?: (p: number) => void) => Promise<Array<{
+  compressBatch: (files: Array<{data: Uint8Array, type: string}>, progress?: (p: number, jobId: number) => void) => Promise<Array<{
     data: Uint8Array;
     originalSize: number;
     compressedSize: number;
@@ -49,12 +57,28 @@ interface WasmModule {
 let wasmModule: WasmModule | null = null;
 let isLoading = false;
 
+// Wrap a running instance's namespace
+const fromNamespace = (ns: NonNullable<Window['FileZap']>): WasmModule => ({
+  compressPDF: ns.compressPDF,
+  compressImage: ns.compressImage,
+  compressBatch: ns.compressBatch,
+  isReady: true
+});
+
 export const loadWasm = async (): Promise<WasmModule> => {
   // Return cached module if already loaded
   if (wasmModule?.isReady) {
     return wasmModule;
   }
 
+  // Reuse an instance already running in this page (e.g. loaded by another
+  // bundle); loading a second one would replace it
+  if (window.FileZap?.isReady()) {
+    console.log(`♻️ Reusing PDF-Turbo WASM instance ${window.FileZap.instance}`);
+    wasmModule = fromNamespace(window.FileZap);
+    return wasmModule;
+  }
+
   // Prevent multiple simultaneous loads
   if (isLoading) {
     return new Promise((resolve) => {
@@ -130,7 +154,9 @@ export const loadWasm = async (): Promise<WasmModule> => {
         }, 10000); // 10 second timeout
 
         const checkReady = () => {
-          if (window.wasmReady && window.compressPDF && window.compressImage && window.compressBatch) {
+          // Builds without isReady() only set the wasmReady flag
+          const ready = window.isReady ? window.isReady() : window.wasmReady;
+          if (ready && window.compressPDF && window.compressImage && window.compressBatch) {
             clearTimeout(timeout);
             resolve();
           } else {
@@ -144,7 +170,7 @@ export const loadWasm = async (): Promise<WasmModule> => {
     await waitForReady();
 
     // Create the module wrapper
-    wasmModule = {
+    wasmModule = window.FileZap ? fromNamespace(window.FileZap) : {
       compressPDF: window.compressPDF,
       compressImage: window.compressImage,
       compressBatch: window.compressBatch,
@@ -152,6 +178,18 @@ export const loadWasm = async (): Promise<WasmModule> => {
     };
 
     console.log('🎉 PDF-Turbo WASM module ready!');
+
+    // Warm the pipelines while the user is still picking files
+    const warmUp = () => {
+      (window.FileZap?.init ?? window.init)?.({ preload: ['image', 'pdf'] })
+        .then(({ warmed }) => console.log('🔥 WASM pipelines warmed:', warmed))
+        .catch((error) => console.warn('WASM warm-up failed:', error));
+    };
+    if ('requestIdleCallback' in window) {
+      window.requestIdleCallback(warmUp);
+    } else {
+      setTimeout(warmUp, 0);
+    }
     return wasmModule;
 
   } catch (error) {
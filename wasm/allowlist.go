@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Host-configured allowlist of input types. Inputs are checked on their
+// declared type and first bytes before they are copied into WASM memory,
+// so a rejected 2 GB video costs a few hundred bytes instead of its size.
+// Unlike a policy's allowedFormats, which is checked on copied inputs and
+// can merely report, the allowlist always rejects.
+
+// Error code of inputs outside the allowlist
+const errCodeTypeNotAllowed = "ERR_TYPE_NOT_ALLOWED"
+
+// Bytes read ahead of the copy; enough for every signature sniffMimeType
+// knows, including an ftyp box's brand list
+const sniffPeekBytes = 256
+
+// An error hosts tell apart by code rather than message. runAsync rejects
+// with a JS Error carrying code and the details as properties.
+type codedError struct {
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *codedError) Error() string { return e.Message }
+
+// JS Error for a coded error, its message prefixed like other rejections
+func codedErrorToJS(name string, e *codedError) js.Value {
+	v := js.Global().Get("Error").New(name + ": " + e.Message)
+	v.Set("code", e.Code)
+	for key, value := range e.Details {
+		if items, ok := value.([]string); ok {
+			v.Set(key, stringsToJS(items))
+			continue
+		}
+		v.Set(key, value)
+	}
+	return v
+}
+
+var (
+	allowlistMu    sync.RWMutex
+	inputAllowlist []string // MIME types or families; nil allows everything
+)
+
+// Copy the first n bytes of a Uint8Array (fewer if it is shorter). Values
+// without subarray, such as strings, give nil.
+func peekJS(v js.Value, n int) []byte {
+	if v.Type() != js.TypeObject || v.Get("subarray").Type() != js.TypeFunction {
+		return nil
+	}
+	if length := v.Length(); length < n {
+		n = length
+	}
+	return bytesFromJS(v.Call("subarray", 0, n))
+}
+
+// Check an input against the allowlist by its first bytes, falling back
+// on the declared type when they are not recognized
+func checkInputAllowed(head []byte, declared string) error {
+	allowlistMu.RLock()
+	allowed := inputAllowlist
+	allowlistMu.RUnlock()
+	if allowed == nil {
+		return nil
+	}
+	typ := policyInputType(head, declared)
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	for _, pattern := range allowed {
+		if mimePatternScore(pattern, typ) > 0 {
+			return nil
+		}
+	}
+	return &codedError{
+		Code:    errCodeTypeNotAllowed,
+		Message: fmt.Sprintf("%s input is not allowed", typ),
+		Details: map[string]interface{}{"type": typ, "allowed": allowed},
+	}
+}
+
+// Declared type of an input named by a MIME type or an extension ("js",
+// ".css"), as minifyAndCompress and compressWebAsset take it; "" when
+// the extension is unknown
+func declaredInputType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if strings.Contains(t, "/") {
+		return t
+	}
+	mimeType := mime.TypeByExtension("." + strings.TrimPrefix(t, "."))
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return mimeType
+}
+
+// setInputAllowlist(types) restricts every entry point that compresses,
+// converts or unpacks a file to inputs of the listed types: MIME types or
+// families such as "image/*". Types are sniffed from the first bytes, so
+// a video renamed to .jpg is still a video; the declared type only counts
+// when the bytes are not recognized. Anything else is rejected, before it
+// is copied, with an Error whose code is "ERR_TYPE_NOT_ALLOWED" and which
+// carries type and allowed. Streams are checked on their first chunk.
+// The read-only helpers (analyzeCompressibility, estimateJpegQuality,
+// seekableIndex, verifyRoundTrip) and the base64 helpers are not
+// restricted. Pass null to allow everything. Resolves with the active
+// list.
+func setInputAllowlist(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] setInputAllowlist called with %d arguments\n", len(args))
+
+	var types []string
+	var err error
+	if len(args) > 0 && isSet(args[0]) {
+		if args[0].Type() != js.TypeObject || args[0].Get("length").Type() != js.TypeNumber {
+			err = errors.New("allowlist must be an array of MIME types")
+		} else {
+			types = make([]string, 0, args[0].Length())
+			for i := 0; i < args[0].Length(); i++ {
+				types = append(types, args[0].Index(i).String())
+			}
+		}
+	}
+
+	return runAsync("setInputAllowlist", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		if types != nil && len(types) == 0 {
+			return nil, errors.New("allowlist is empty; pass null to allow everything")
+		}
+		for _, t := range types {
+			if t != "*" && !strings.Contains(t, "/") {
+				return nil, fmt.Errorf("invalid type %q, want a MIME type such as image/jpeg or image/*", t)
+			}
+		}
+		allowlistMu.Lock()
+		defer allowlistMu.Unlock()
+		if types == nil {
+			inputAllowlist = nil
+			fmt.Printf("[WASM] Input allowlist removed\n")
+			return js.Null(), nil
+		}
+		inputAllowlist = types
+		fmt.Printf("[WASM] Input allowlist: %s\n", strings.Join(types, ", "))
+		return stringsToJS(types), nil
+	})
+}
@@ -0,0 +1,78 @@
+//go:build js
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestAllowlistExports(t *testing.T) {
+	withAllowlist(t, "image/*")
+	video := bytesToJS(fixtureMP4([]byte("x")))
+
+	// A blocked type is rejected by every export, not only the image and
+	// PDF ones
+	for name, call := range map[string]func() interface{}{
+		"compressData":          func() interface{} { return compressData(js.Undefined(), []js.Value{video}) },
+		"compressData data URL": func() interface{} { return compressData(js.Undefined(), []js.Value{js.ValueOf("data:,plain")}) },
+		"decompressData":        func() interface{} { return decompressData(js.Undefined(), []js.Value{video}) },
+		"recompressZip":         func() interface{} { return recompressZip(js.Undefined(), []js.Value{video}) },
+		"listArchive":           func() interface{} { return listArchive(js.Undefined(), []js.Value{video}) },
+		"compressText":          func() interface{} { return compressText(js.Undefined(), []js.Value{bytesToJS([]byte("hello"))}) },
+		"minifyAndCompress": func() interface{} {
+			return minifyAndCompress(js.Undefined(), []js.Value{bytesToJS([]byte("{}")), js.ValueOf("json")})
+		},
+		"diffCompress": func() interface{} {
+			return diffCompress(js.Undefined(), []js.Value{bytesToJS(fixturePNG(fixtureGradient(8, 8))), video})
+		},
+		"makeContactSheet": func() interface{} {
+			images := js.Global().Get("Array").New(video)
+			return makeContactSheet(js.Undefined(), []js.Value{images})
+		},
+	} {
+		_, err := awaitJS(call().(js.Value))
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// Allowed types still go through
+	png := bytesToJS(fixturePNG(fixtureGradient(8, 8)))
+	if _, err := awaitJS(compressData(js.Undefined(), []js.Value{png}).(js.Value)); err != nil {
+		t.Errorf("PNG through compressData: %v", err)
+	}
+}
+
+func TestThroughputExports(t *testing.T) {
+	withLimits(t, throughputLimits{MaxBytesInFlight: 1000})
+	big := bytesToJS(make([]byte, 2000))
+
+	// Calls outside the image and PDF exports count against the limits
+	// too, and give their bytes back when they settle
+	for name, call := range map[string]func() interface{}{
+		"compressData":  func() interface{} { return compressData(js.Undefined(), []js.Value{big}) },
+		"recompressZip": func() interface{} { return recompressZip(js.Undefined(), []js.Value{big}) },
+		"compressText":  func() interface{} { return compressText(js.Undefined(), []js.Value{big}) },
+		"analyze":       func() interface{} { return analyzeCompressibility(js.Undefined(), []js.Value{big}) },
+		"diffCompress": func() interface{} {
+			return diffCompress(js.Undefined(), []js.Value{bytesToJS(make([]byte, 600)), bytesToJS(make([]byte, 600))})
+		},
+		"makeContactSheet": func() interface{} {
+			return makeContactSheet(js.Undefined(), []js.Value{js.Global().Get("Array").New(big)})
+		},
+	} {
+		_, err := awaitJS(call().(js.Value))
+		if err == nil || !strings.Contains(err.Error(), "bytes in flight") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := awaitJS(compressData(js.Undefined(), []js.Value{bytesToJS(make([]byte, 900))}).(js.Value)); err != nil {
+		t.Fatal(err)
+	}
+	if n := throughputStatus()["bytesInFlight"]; n != 0 {
+		t.Errorf("%v bytes still in flight", n)
+	}
+}
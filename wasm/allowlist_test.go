@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Set the allowlist for the rest of a test
+func withAllowlist(t *testing.T, types ...string) {
+	allowlistMu.Lock()
+	inputAllowlist = types
+	allowlistMu.Unlock()
+	t.Cleanup(func() {
+		allowlistMu.Lock()
+		inputAllowlist = nil
+		allowlistMu.Unlock()
+	})
+}
+
+func TestAllowlist(t *testing.T) {
+	withAllowlist(t, "image/*")
+
+	// A video declared as JPEG is judged by its bytes
+	video := fixtureMP4([]byte("x"))
+	var coded *codedError
+	if err := checkInputAllowed(video, "image/jpeg"); !errors.As(err, &coded) || coded.Code != errCodeTypeNotAllowed || coded.Details["type"] != "video/mp4" {
+		t.Fatalf("MP4 input: %v", err)
+	}
+	png := fixturePNG(fixtureGradient(8, 8))
+	if err := checkInputAllowed(png[:min(len(png), sniffPeekBytes)], ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkInputAllowed([]byte("plain text"), ""); err == nil {
+		t.Fatal("unrecognized input admitted")
+	}
+}
+
+func TestAllowlistStream(t *testing.T) {
+	withAllowlist(t, "image/*")
+
+	// The first chunk decides, and a rejected stream stays closed
+	s, err := newCompressionStream(streamOptions{compressOptions: defaultCompressOptions()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coded *codedError
+	if _, err := s.write(fixtureMP4([]byte("x"))); !errors.As(err, &coded) || coded.Code != errCodeTypeNotAllowed {
+		t.Fatalf("MP4 stream: %v", err)
+	}
+	if _, err := s.write(fixturePNG(fixtureGradient(8, 8))); err == nil {
+		t.Fatal("rejected stream took another chunk")
+	}
+
+	s, _ = newCompressionStream(streamOptions{compressOptions: defaultCompressOptions()})
+	if _, err := s.write(nil); err != nil {
+		t.Fatal(err)
+	}
+	png := fixturePNG(fixtureGradient(8, 8))
+	if _, err := s.write(png[:10]); err != nil {
+		t.Fatalf("PNG stream: %v", err)
+	}
+	if _, err := s.write([]byte("later chunks are not sniffed")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeclaredInputType(t *testing.T) {
+	for in, want := range map[string]string{
+		"js":               "text/javascript",
+		".CSS":             "text/css",
+		"application/json": "application/json",
+		"svg":              "image/svg+xml",
+		"nonsense":         "",
+	} {
+		if got := declaredInputType(in); got != want {
+			t.Errorf("%q: %q, want %q", in, got, want)
+		}
+	}
+}
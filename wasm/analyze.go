@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Smallest region reported by analyzeCompressibility; larger inputs use
+// bigger regions so the list stays short
+const (
+	analyzeMinRegion  = 64 << 10
+	analyzeMaxRegions = 256
+	analyzeMaxFormats = 64
+)
+
+// Savings below this are not worth the user's wait
+const analyzeWorthwhile = 0.03
+
+// Entropy of one slice of the input
+type entropyRegion struct {
+	Offset  int     `json:"offset"`
+	Length  int     `json:"length"`
+	Entropy float64 `json:"entropy"` // bits per byte, 0-8
+}
+
+// A recognizable file embedded in (or at the start of) the input
+type embeddedFormat struct {
+	Format     string `json:"format"`
+	Offset     int    `json:"offset"`
+	Compressed bool   `json:"compressed"` // payload is already entropy coded
+}
+
+type compressibilityReport struct {
+	Size             int              `json:"size"`
+	Entropy          float64          `json:"entropy"`
+	Regions          []entropyRegion  `json:"regions"`
+	Formats          []embeddedFormat `json:"formats"`
+	EstimatedSavings float64          `json:"estimatedSavings"` // fraction of size
+	EstimatedSize    int              `json:"estimatedSize"`
+	Compressible     bool             `json:"compressible"`
+}
+
+// Signatures searched for anywhere in the input. Only reasonably long or
+// structured magics are listed; two-byte ones like "BM" match everywhere.
+var embeddedSignatures = []struct {
+	format     string
+	magic      []byte
+	compressed bool
+	check      func(data []byte, at int) bool
+}{
+	{"pdf", []byte("%PDF-"), false, nil},
+	{"jpeg", []byte{0xFF, 0xD8, 0xFF}, true, func(d []byte, at int) bool {
+		return at+3 < len(d) && d[at+3] >= 0xC0 // a marker follows SOI
+	}},
+	{"png", pngSignature, true, nil},
+	{"gif", []byte("GIF89a"), true, nil},
+	{"gif", []byte("GIF87a"), true, nil},
+	{"webp", []byte("WEBPVP8"), true, func(d []byte, at int) bool {
+		return at >= 8 && string(d[at-8:at-4]) == "RIFF"
+	}},
+	{"zip", []byte("PK\x03\x04"), true, nil},
+	{"gzip", []byte{0x1F, 0x8B, 0x08}, true, func(d []byte, at int) bool {
+		return at+3 < len(d) && d[at+3]&0xE0 == 0 // reserved flag bits clear
+	}},
+	{"zstd", []byte{0x28, 0xB5, 0x2F, 0xFD}, true, nil},
+	{"xz", []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}, true, nil},
+	{"7z", []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}, true, nil},
+	{"rar", []byte("Rar!\x1A\x07"), true, nil},
+	{"bzip2", []byte("BZh"), true, func(d []byte, at int) bool {
+		return at+10 <= len(d) && d[at+3] >= '1' && d[at+3] <= '9' && string(d[at+4:at+10]) == "1AY&SY"
+	}},
+	{"mp4", []byte("ftyp"), true, func(d []byte, at int) bool {
+		return at >= 4
+	}},
+	{"tiff", []byte("II*\x00"), false, nil},
+	{"tiff", []byte("MM\x00*"), false, nil},
+	{"xmp", []byte("<?xpacket begin="), false, nil},
+}
+
+// Shannon entropy in bits per byte
+func byteEntropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, c := range data {
+		counts[c]++
+	}
+	n := float64(len(data))
+	h := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// All signature magics, searched for in one pass
+var embeddedSignatureSet = func() *patternSet {
+	magics := make([][]byte, len(embeddedSignatures))
+	for i, sig := range embeddedSignatures {
+		magics[i] = sig.magic
+	}
+	return newPatternSet(magics)
+}()
+
+// Find embedded format signatures, ordered by offset
+func findEmbeddedFormats(data []byte) []embeddedFormat {
+	found := []embeddedFormat{}
+	// Occurrences of one signature do not overlap, a rejected one included
+	resume := make([]int, len(embeddedSignatures))
+	// Each signature keeps at most 4*analyzeMaxFormats hits, so one that
+	// repeats all over the file cannot crowd out the others
+	counts := make([]int, len(embeddedSignatures))
+	capped := 0
+	embeddedSignatureSet.scan(data, func(p, at int) bool {
+		sig := embeddedSignatures[p]
+		if at < resume[p] || counts[p] >= 4*analyzeMaxFormats {
+			return true
+		}
+		resume[p] = at + len(sig.magic)
+		if sig.check != nil && !sig.check(data, at) {
+			return true
+		}
+		if sig.format == "mp4" {
+			at -= 4 // the box size precedes the type
+		}
+		found = append(found, embeddedFormat{Format: sig.format, Offset: at, Compressed: sig.compressed})
+		counts[p]++
+		if counts[p] == 4*analyzeMaxFormats {
+			capped++
+		}
+		return capped < len(embeddedSignatures)
+	})
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Offset < found[j].Offset })
+	if len(found) > analyzeMaxFormats {
+		found = found[:analyzeMaxFormats]
+	}
+	return found
+}
+
+// Estimate the lossless compression ratio by deflating evenly spaced
+// samples; the full file is only compressed when it is small
+func sampledDeflateRatio(data []byte) float64 {
+	const sampleLen, samples = 32 << 10, 16
+	var input [][]byte
+	if len(data) <= sampleLen*samples {
+		input = [][]byte{data}
+	} else {
+		step := (len(data) - sampleLen) / (samples - 1)
+		for i := 0; i < samples; i++ {
+			input = append(input, data[i*step:i*step+sampleLen])
+		}
+	}
+
+	in, out := 0, 0
+	for _, chunk := range input {
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		zw.Write(chunk)
+		zw.Close()
+		in += len(chunk)
+		out += buf.Len()
+	}
+	if in == 0 {
+		return 1
+	}
+	return float64(out) / float64(in)
+}
+
+// Measure entropy, embedded formats and likely savings
+func analyzeData(data []byte) compressibilityReport {
+	rep := compressibilityReport{Size: len(data), Entropy: byteEntropy(data), Regions: []entropyRegion{}}
+
+	regionLen := analyzeMinRegion
+	if n := (len(data) + analyzeMaxRegions - 1) / analyzeMaxRegions; n > regionLen {
+		regionLen = n
+	}
+	for off := 0; off < len(data); off += regionLen {
+		end := minInt(off+regionLen, len(data))
+		rep.Regions = append(rep.Regions, entropyRegion{
+			Offset:  off,
+			Length:  end - off,
+			Entropy: math.Round(byteEntropy(data[off:end])*1000) / 1000,
+		})
+	}
+	rep.Entropy = math.Round(rep.Entropy*1000) / 1000
+	rep.Formats = findEmbeddedFormats(data)
+
+	// Deflate overhead means ratios just above 1 are "no savings"
+	savings := 1 - sampledDeflateRatio(data)
+	if savings < 0 {
+		savings = 0
+	}
+	rep.EstimatedSavings = math.Round(savings*1000) / 1000
+	rep.EstimatedSize = len(data) - int(float64(len(data))*savings)
+	rep.Compressible = savings >= analyzeWorthwhile
+	return rep
+}
+
+// analyzeCompressibility(data) resolves with {size, entropy, regions,
+// formats, estimatedSavings, estimatedSize, compressible} so the UI can
+// warn before spending time on already-compressed input. Entropy is in
+// bits per byte; estimatedSavings is a fraction of size for lossless
+// (deflate-class) compression.
+func analyzeCompressibility(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] analyzeCompressibility called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("analyzeCompressibility", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+	release, err := reserveInput(args[0].Length())
+	if err != nil {
+		return runAsync("analyzeCompressibility", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+
+	return runAsync("analyzeCompressibility", func() (interface{}, error) {
+		j := startJob("analyze")
+		defer j.finish()
+		defer release()
+
+		rep := analyzeData(inputBytes)
+		if err := checkCancelled(j.ctx); err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Analyzed %d bytes: entropy %.2f, est. savings %.1f%%\n",
+			rep.Size, rep.Entropy, rep.EstimatedSavings*100)
+		return jsonToJS(rep)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"testing"
+)
+
+func TestAnalyzeVerdicts(t *testing.T) {
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog.\n"), 8000)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(random[:100<<10])
+	zw.Close()
+
+	for _, c := range []struct {
+		name         string
+		data         []byte
+		compressible bool
+		minEntropy   float64
+		maxEntropy   float64
+		format       string
+	}{
+		{"random", random, false, 7.9, 8, ""},
+		{"text", text, true, 3, 5, ""},
+		{"gzip", gz.Bytes(), false, 7.9, 8, "gzip"},
+	} {
+		rep := analyzeData(c.data)
+		if rep.Compressible != c.compressible {
+			t.Errorf("%s: compressible %v, savings %v", c.name, rep.Compressible, rep.EstimatedSavings)
+		}
+		if rep.Entropy < c.minEntropy || rep.Entropy > c.maxEntropy {
+			t.Errorf("%s: entropy %v", c.name, rep.Entropy)
+		}
+		if rep.Size != len(c.data) || rep.EstimatedSize > rep.Size || rep.EstimatedSavings < 0 || rep.EstimatedSavings > 1 {
+			t.Errorf("%s: size %d, estimated %d, savings %v", c.name, rep.Size, rep.EstimatedSize, rep.EstimatedSavings)
+		}
+		if c.format != "" && (len(rep.Formats) == 0 || rep.Formats[0].Format != c.format || rep.Formats[0].Offset != 0 || !rep.Formats[0].Compressed) {
+			t.Errorf("%s: formats %+v", c.name, rep.Formats)
+		}
+	}
+
+	// Text compresses far better than the threshold
+	if rep := analyzeData(text); rep.EstimatedSavings < 0.9 {
+		t.Errorf("text savings %v", rep.EstimatedSavings)
+	}
+	if rep := analyzeData(random); rep.EstimatedSavings != 0 || rep.EstimatedSize != len(random) {
+		t.Errorf("random data savings %v, size %d", rep.EstimatedSavings, rep.EstimatedSize)
+	}
+}
+
+func TestAnalyzeRegions(t *testing.T) {
+	// A text half and a random half show up as low and high entropy regions
+	random := make([]byte, analyzeMinRegion)
+	rand.New(rand.NewSource(2)).Read(random)
+	data := append(bytes.Repeat([]byte("abcd"), analyzeMinRegion/4), random...)
+	data = append(data, pngSignature...)
+
+	rep := analyzeData(data)
+	if len(rep.Regions) != 3 {
+		t.Fatalf("%d regions", len(rep.Regions))
+	}
+	if rep.Regions[0].Entropy != 2 || rep.Regions[1].Entropy < 7.9 || rep.Regions[2].Length != len(pngSignature) {
+		t.Errorf("regions %+v", rep.Regions)
+	}
+	if n := len(rep.Formats); n == 0 || rep.Formats[n-1] != (embeddedFormat{Format: "png", Offset: 2 * analyzeMinRegion, Compressed: true}) {
+		t.Errorf("formats %+v", rep.Formats)
+	}
+
+	// Huge inputs use bigger regions instead of more of them
+	if rep := analyzeData(make([]byte, 2*analyzeMaxRegions*analyzeMinRegion)); len(rep.Regions) != analyzeMaxRegions {
+		t.Errorf("%d regions for a large input", len(rep.Regions))
+	}
+
+	if rep := analyzeData(nil); rep.Size != 0 || rep.Compressible || len(rep.Regions) != 0 {
+		t.Errorf("empty input: %+v", rep)
+	}
+}
+
+func TestByteEntropy(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	for _, c := range []struct {
+		data []byte
+		want float64
+	}{
+		{nil, 0}, {[]byte("aaaa"), 0}, {[]byte("abab"), 1}, {all, 8},
+	} {
+		if got := byteEntropy(c.data); got != c.want {
+			t.Errorf("%q: %v, want %v", c.data, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+// How animated inputs are handled by compressImage
+const (
+	animationOptimize   = "optimize"   // keep every frame, optimize losslessly
+	animationFirstFrame = "firstFrame" // decode the first frame and compress it as a still
+)
+
+// PNG ancillary chunks that carry no rendering information
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true, "zTXt": true, "iTXt": true, "tIME": true,
+}
+
+// Detect an APNG: an acTL chunk appearing before the first IDAT
+func isAnimatedPNG(data []byte) bool {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return false
+	}
+	for _, c := range chunks {
+		switch c.Type {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+	}
+	return false
+}
+
+// Count the frames declared by an APNG's acTL chunk
+func apngFrameCount(data []byte) int {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return 0
+	}
+	for _, c := range chunks {
+		if c.Type == "acTL" && len(c.Data) >= 4 {
+			return int(binary.BigEndian.Uint32(c.Data[:4]))
+		}
+	}
+	return 0
+}
+
+// Losslessly optimize an APNG frame by frame: drop text/time chunks and
+// re-deflate each frame's image data at maximum compression, keeping every
+// frame, its control chunk and the playback settings intact.
+func optimizeAPNG(data []byte) ([]byte, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(bytes.Buffer)
+	out.Write(pngSignature)
+
+	sequence := uint32(0)
+	framesOptimized := 0
+	for i := 0; i < len(chunks); {
+		c := chunks[i]
+
+		if pngMetadataChunks[c.Type] {
+			i++
+			continue
+		}
+
+		switch c.Type {
+		case "fcTL":
+			// Sequence numbers are shared by fcTL and fdAT; renumber since
+			// merged fdAT runs shrink the count
+			frameControl := append([]byte(nil), c.Data...)
+			if len(frameControl) >= 4 {
+				binary.BigEndian.PutUint32(frameControl[:4], sequence)
+			}
+			sequence++
+			writePNGChunk(out, c.Type, frameControl)
+			i++
+
+		case "IDAT", "fdAT":
+			// Gather the whole run of data chunks belonging to this frame
+			var stream []byte
+			j := i
+			for ; j < len(chunks) && chunks[j].Type == c.Type; j++ {
+				payload := chunks[j].Data
+				if c.Type == "fdAT" {
+					if len(payload) < 4 {
+						return nil, errors.New("malformed fdAT chunk")
+					}
+					payload = payload[4:]
+				}
+				stream = append(stream, payload...)
+			}
+
+			recompressed, err := redeflate(stream)
+			if err != nil {
+				return nil, fmt.Errorf("frame %d: %v", framesOptimized, err)
+			}
+			if len(recompressed) < len(stream) {
+				stream = recompressed
+			}
+			framesOptimized++
+
+			if c.Type == "fdAT" {
+				payload := make([]byte, 4+len(stream))
+				binary.BigEndian.PutUint32(payload[:4], sequence)
+				copy(payload[4:], stream)
+				sequence++
+				writePNGChunk(out, "fdAT", payload)
+			} else {
+				writePNGChunk(out, "IDAT", stream)
+			}
+			i = j
+
+		default:
+			writePNGChunk(out, c.Type, c.Data)
+			i++
+		}
+	}
+
+	fmt.Printf("[WASM] APNG optimized: %d frames, %d -> %d bytes\n", framesOptimized, len(data), out.Len())
+	return out.Bytes(), nil
+}
+
+// Inflate a zlib stream and deflate it again at maximum compression
+func redeflate(stream []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(raw)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// One RIFF chunk of a WebP file; Data aliases the source buffer
+type webpChunk struct {
+	FourCC string
+	Data   []byte
+}
+
+// Split a WebP file into its top-level RIFF chunks
+func readWebPChunks(data []byte) ([]webpChunk, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP file")
+	}
+	end := 8 + int(binary.LittleEndian.Uint32(data[4:8]))
+	if end > len(data) {
+		end = len(data)
+	}
+	return splitRIFFChunks(data[12:end])
+}
+
+// Split a run of RIFF chunks, honoring the even-size padding rule
+func splitRIFFChunks(data []byte) ([]webpChunk, error) {
+	var chunks []webpChunk
+	i := 0
+	for i+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		if size < 0 || i+8+size > len(data) {
+			return nil, errors.New("truncated RIFF chunk")
+		}
+		chunks = append(chunks, webpChunk{FourCC: string(data[i : i+4]), Data: data[i+8 : i+8+size]})
+		i += 8 + size + size&1
+	}
+	return chunks, nil
+}
+
+// Serialize chunks into a complete RIFF/WEBP file
+func writeWebP(chunks []webpChunk) []byte {
+	body := new(bytes.Buffer)
+	body.WriteString("WEBP")
+	for _, c := range chunks {
+		var header [8]byte
+		copy(header[:4], c.FourCC)
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(c.Data)))
+		body.Write(header[:])
+		body.Write(c.Data)
+		if len(c.Data)&1 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	out := make([]byte, 8, 8+body.Len())
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:8], uint32(body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+// Detect an animated WebP via the VP8X animation flag or an ANIM chunk
+func isAnimatedWebP(data []byte) bool {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return false
+	}
+	for _, c := range chunks {
+		if c.FourCC == "VP8X" && len(c.Data) > 0 && c.Data[0]&0x02 != 0 {
+			return true
+		}
+		if c.FourCC == "ANIM" {
+			return true
+		}
+	}
+	return false
+}
+
+// Count ANMF frames in an animated WebP
+func webpFrameCount(data []byte) int {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return 0
+	}
+	frames := 0
+	for _, c := range chunks {
+		if c.FourCC == "ANMF" {
+			frames++
+		}
+	}
+	return frames
+}
+
+// Losslessly optimize an animated WebP by dropping EXIF/XMP chunks. Frames
+// are kept byte-identical since there is no WebP encoder in the module.
+func optimizeAnimatedWebP(data []byte) ([]byte, error) {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]webpChunk, 0, len(chunks))
+	removed := 0
+	for _, c := range chunks {
+		switch c.FourCC {
+		case "EXIF", "XMP ":
+			removed += 8 + len(c.Data)
+			continue
+		case "VP8X":
+			if len(c.Data) > 0 {
+				flags := append([]byte(nil), c.Data...)
+				flags[0] &^= 0x08 | 0x04 // EXIF and XMP present bits
+				c.Data = flags
+			}
+		}
+		kept = append(kept, c)
+	}
+
+	if removed == 0 {
+		return data, nil
+	}
+	fmt.Printf("[WASM] Animated WebP: removed %d bytes of metadata\n", removed)
+	return writeWebP(kept), nil
+}
+
+// Decode the first frame of an animated WebP, placed on the full canvas
+func decodeWebPFirstFrame(data []byte) (image.Image, error) {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	canvasW, canvasH := 0, 0
+	for _, c := range chunks {
+		if c.FourCC == "VP8X" && len(c.Data) >= 10 {
+			canvasW = int(uint24LE(c.Data[4:7])) + 1
+			canvasH = int(uint24LE(c.Data[7:10])) + 1
+		}
+		if c.FourCC != "ANMF" {
+			continue
+		}
+		if len(c.Data) < 16 {
+			return nil, errors.New("malformed ANMF chunk")
+		}
+
+		offsetX := int(uint24LE(c.Data[0:3])) * 2
+		offsetY := int(uint24LE(c.Data[3:6])) * 2
+		frameW := int(uint24LE(c.Data[6:9])) + 1
+		frameH := int(uint24LE(c.Data[9:12])) + 1
+
+		frameChunks, err := splitRIFFChunks(c.Data[16:])
+		if err != nil {
+			return nil, err
+		}
+
+		// Rebuild a standalone still WebP from the frame's bitstream
+		var still []webpChunk
+		hasAlpha := false
+		for _, fc := range frameChunks {
+			if fc.FourCC == "ALPH" {
+				hasAlpha = true
+			}
+			if fc.FourCC == "ALPH" || fc.FourCC == "VP8 " || fc.FourCC == "VP8L" {
+				still = append(still, fc)
+			}
+		}
+		if hasAlpha {
+			header := make([]byte, 10)
+			header[0] = 0x10 // alpha present
+			putUint24LE(header[4:7], uint32(frameW-1))
+			putUint24LE(header[7:10], uint32(frameH-1))
+			still = append([]webpChunk{{FourCC: "VP8X", Data: header}}, still...)
+		}
+
+		frame, err := webp.Decode(bytes.NewReader(writeWebP(still)))
+		if err != nil {
+			return nil, fmt.Errorf("first frame: %v", err)
+		}
+		if canvasW == 0 || canvasH == 0 {
+			return frame, nil
+		}
+
+		canvas := image.NewNRGBA(image.Rect(0, 0, canvasW, canvasH))
+		target := image.Rect(offsetX, offsetY, offsetX+frameW, offsetY+frameH)
+		draw.Draw(canvas, target, frame, frame.Bounds().Min, draw.Over)
+		return canvas, nil
+	}
+
+	return nil, errors.New("animated WebP has no frames")
+}
+
+// Decode the first frame of an APNG (its default image)
+func decodeAPNGFirstFrame(data []byte) (image.Image, error) {
+	return png.Decode(bytes.NewReader(data))
+}
+
+func uint24LE(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24LE(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
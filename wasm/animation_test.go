@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"testing"
+)
+
+// Two-frame animated WebP whose frames are fixtureWebP's 1x1 bitstream,
+// with an EXIF chunk when exif is set
+func fixtureAnimatedWebP(exif bool) []byte {
+	still, _ := readWebPChunks(fixtureWebP)
+
+	header := make([]byte, 10)
+	header[0] = 0x02 | 0x10 // animation, alpha
+	if exif {
+		header[0] |= 0x08
+	}
+	chunks := []webpChunk{{FourCC: "VP8X", Data: header}, {FourCC: "ANIM", Data: make([]byte, 6)}}
+	for i := 0; i < 2; i++ {
+		frame := make([]byte, 16)
+		putUint24LE(frame[12:15], 100)
+		for _, c := range still {
+			var chunk [8]byte
+			copy(chunk[:4], c.FourCC)
+			binary.LittleEndian.PutUint32(chunk[4:], uint32(len(c.Data)))
+			frame = append(frame, chunk[:]...)
+			frame = append(frame, c.Data...)
+			if len(c.Data)&1 == 1 {
+				frame = append(frame, 0)
+			}
+		}
+		chunks = append(chunks, webpChunk{FourCC: "ANMF", Data: frame})
+	}
+	if exif {
+		chunks = append(chunks, webpChunk{FourCC: "EXIF", Data: []byte("Exif\x00\x00camera")})
+	}
+	return writeWebP(chunks)
+}
+
+// fixtureAPNG with a tEXt chunk ahead of the first frame
+func fixtureAPNGWithText() []byte {
+	chunks, _ := readPNGChunks(fixtureAPNG())
+	out := new(bytes.Buffer)
+	out.Write(pngSignature)
+	for i, c := range chunks {
+		if i == 1 {
+			writePNGChunk(out, "tEXt", []byte("Software\x00frames"))
+		}
+		writePNGChunk(out, c.Type, c.Data)
+	}
+	return out.Bytes()
+}
+
+func TestOptimizeAPNGKeepsFrames(t *testing.T) {
+	input := fixtureAPNGWithText()
+	if !isAnimatedPNG(input) || apngFrameCount(input) != 2 {
+		t.Fatalf("fixture not seen as a 2-frame APNG")
+	}
+	out, err := optimizeAPNG(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) >= len(input) {
+		t.Errorf("optimized to %d bytes from %d", len(out), len(input))
+	}
+	if !isAnimatedPNG(out) || apngFrameCount(out) != 2 {
+		t.Fatalf("optimized file lost its animation")
+	}
+
+	chunks, err := readPNGChunks(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sequences []uint32
+	frames := 0
+	for _, c := range chunks {
+		switch c.Type {
+		case "tEXt":
+			t.Errorf("tEXt chunk kept")
+		case "fcTL":
+			frames++
+			sequences = append(sequences, binary.BigEndian.Uint32(c.Data))
+		case "fdAT":
+			sequences = append(sequences, binary.BigEndian.Uint32(c.Data))
+		}
+	}
+	if frames != 2 {
+		t.Errorf("%d frame control chunks, want 2", frames)
+	}
+	for i, s := range sequences {
+		if s != uint32(i) {
+			t.Fatalf("sequence numbers %v, want 0, 1, 2, ...", sequences)
+		}
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("default image does not decode: %v", err)
+	}
+}
+
+func TestOptimizeAnimatedWebPStripsMetadata(t *testing.T) {
+	input := fixtureAnimatedWebP(true)
+	if !isAnimatedWebP(input) || webpFrameCount(input) != 2 {
+		t.Fatalf("fixture not seen as a 2-frame animated WebP")
+	}
+	out, err := optimizeAnimatedWebP(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAnimatedWebP(out) || webpFrameCount(out) != 2 {
+		t.Fatalf("optimized file has %d frames", webpFrameCount(out))
+	}
+	chunks, _ := readWebPChunks(out)
+	for _, c := range chunks {
+		if c.FourCC == "EXIF" {
+			t.Errorf("EXIF chunk kept")
+		}
+		if c.FourCC == "VP8X" && c.Data[0]&0x08 != 0 {
+			t.Errorf("EXIF flag still set")
+		}
+	}
+	if _, err := decodeWebPFirstFrame(out); err != nil {
+		t.Errorf("first frame does not decode: %v", err)
+	}
+
+	// Nothing to remove hands back the input itself
+	plain := fixtureAnimatedWebP(false)
+	if out, err := optimizeAnimatedWebP(plain); err != nil || !bytes.Equal(out, plain) {
+		t.Errorf("metadata-free WebP changed: %v", err)
+	}
+}
+
+func TestPrepareAnimatedImage(t *testing.T) {
+	opts := defaultImageOptions()
+
+	res, _, handled, err := prepareAnimatedImage(fixtureAPNGWithText(), opts)
+	if err != nil || !handled || !res.Animated || res.Frames != 2 {
+		t.Fatalf("APNG: handled %v, %+v, %v", handled, res, err)
+	}
+
+	// An input the optimizer cannot shrink is returned unchanged
+	for name, input := range map[string][]byte{"APNG": res.Data, "WebP": fixtureAnimatedWebP(false)} {
+		again, _, _, err := prepareAnimatedImage(input, opts)
+		if err != nil || !bytes.Equal(again.Data, input) || again.Frames != 2 {
+			t.Errorf("%s: second pass changed %d bytes to %d: %v", name, len(input), len(again.Data), err)
+		}
+	}
+
+	opts.Animation = animationFirstFrame
+	for name, input := range map[string][]byte{"APNG": fixtureAPNG(), "WebP": fixtureAnimatedWebP(true)} {
+		res, frame, handled, err := prepareAnimatedImage(input, opts)
+		if err != nil || !handled || frame == nil {
+			t.Fatalf("%s first frame: %v", name, err)
+		}
+		if len(res.Warnings) != 1 || res.Warnings[0].Code != "image.firstFrameOnly" {
+			t.Errorf("%s warnings %+v", name, res.Warnings)
+		}
+	}
+
+	if _, _, handled, _ := prepareAnimatedImage(fixturePNG(fixtureGradient(8, 8)), opts); handled {
+		t.Errorf("still PNG handled as animation")
+	}
+	opts.Animation = "gif"
+	if _, _, _, err := prepareAnimatedImage(fixtureAPNG(), opts); err == nil {
+		t.Errorf("unknown animation mode accepted")
+	}
+}
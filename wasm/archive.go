@@ -0,0 +1,423 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Archive containers recognized by listArchive
+const (
+	archiveZip      = "zip"
+	archiveTar      = "tar"
+	archiveGzip     = "gzip"
+	archiveTarGz    = "tar.gz"
+	archiveSevenZip = "7z"
+	archiveRar      = "rar"
+)
+
+// One member of an archive, as listed (never extracted)
+type archiveEntry struct {
+	Name           string `json:"name"`
+	Size           int64  `json:"size"`                     // uncompressed bytes
+	CompressedSize int64  `json:"compressedSize,omitempty"` // stored bytes, when known
+	Method         string `json:"method"`
+	Modified       string `json:"modified,omitempty"` // RFC 3339
+	IsDir          bool   `json:"isDir,omitempty"`
+	Encrypted      bool   `json:"encrypted,omitempty"`
+}
+
+type archiveListing struct {
+	Format    string         `json:"format"`
+	Entries   []archiveEntry `json:"entries"`
+	TotalSize int64          `json:"totalSize"`
+	Comment   string         `json:"comment,omitempty"`
+	Warnings  []string       `json:"warnings,omitempty"`
+	Messages  []message      `json:"messages,omitempty"`
+}
+
+// Record a warning as both English text and a coded message
+func (l *archiveListing) warn(m message) {
+	l.Warnings = append(l.Warnings, m.Text)
+	l.Messages = append(l.Messages, m)
+}
+
+// ZIP compression method numbers (APPNOTE 4.4.5)
+var zipMethodNames = map[uint16]string{
+	0: "store", 8: "deflate", 9: "deflate64", 12: "bzip2", 14: "lzma",
+	93: "zstd", 95: "xz", 96: "jpeg", 97: "wavpack", 98: "ppmd", 99: "aes",
+}
+
+func zipMethodName(m uint16) string {
+	if name, ok := zipMethodNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("method-%d", m)
+}
+
+// Whether data is a POSIX or GNU tar stream
+func isTar(data []byte) bool {
+	return len(data) >= 262 && string(data[257:262]) == "ustar"
+}
+
+// Identify the archive container, or "" when data is not one we list
+func archiveFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return archiveZip
+	case bytes.HasPrefix(data, []byte{0x1F, 0x8B}):
+		return archiveGzip
+	case isTar(data):
+		return archiveTar
+	case bytes.HasPrefix(data, sevenZipSignature):
+		return archiveSevenZip
+	case isRar(data):
+		return archiveRar
+	}
+	return ""
+}
+
+// Empty for unset times, including ZIP's zeroed DOS dates
+func formatModTime(t time.Time) string {
+	if t.IsZero() || t.Year() <= 1980 {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Read the ZIP central directory
+func listZip(data []byte) (archiveListing, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return archiveListing{}, fmt.Errorf("invalid ZIP: %v", err)
+	}
+	listing := archiveListing{Format: archiveZip, Entries: []archiveEntry{}, Comment: zr.Comment}
+	for _, f := range zr.File {
+		entry := archiveEntry{
+			Name:           f.Name,
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+			Method:         zipMethodName(f.Method),
+			Modified:       formatModTime(f.Modified),
+			IsDir:          f.FileInfo().IsDir(),
+			Encrypted:      f.Flags&0x1 != 0,
+		}
+		listing.Entries = append(listing.Entries, entry)
+		listing.TotalSize += entry.Size
+	}
+	return listing, nil
+}
+
+// Walk tar headers, skipping over member data
+func listTarStream(r io.Reader, format string) (archiveListing, error) {
+	listing := archiveListing{Format: format, Entries: []archiveEntry{}}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(listing.Entries) == 0 {
+				return listing, fmt.Errorf("invalid tar: %v", err)
+			}
+			listing.warn(newMessage("archive.listingStopped", "error", err))
+			break
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+		default:
+			continue // PAX/GNU extension headers are folded in by the reader
+		}
+		entry := archiveEntry{
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Method:   "store",
+			Modified: formatModTime(hdr.ModTime),
+			IsDir:    hdr.Typeflag == tar.TypeDir,
+		}
+		listing.Entries = append(listing.Entries, entry)
+		listing.TotalSize += entry.Size
+	}
+	return listing, nil
+}
+
+// A gzip file holds one member, unless it wraps a tar stream
+func listGzip(data []byte) (archiveListing, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return archiveListing{}, fmt.Errorf("invalid gzip: %v", err)
+	}
+	defer zr.Close()
+
+	// Peek at the start of the payload for a tar header
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(zr, head)
+	head = head[:n]
+	if isTar(head) {
+		listing, err := listTarStream(io.MultiReader(bytes.NewReader(head), zr), archiveTarGz)
+		for i := range listing.Entries {
+			listing.Entries[i].Method = "deflate"
+		}
+		return listing, err
+	}
+
+	// ISIZE trailer: uncompressed length modulo 2^32
+	var size int64
+	if len(data) >= 18 {
+		size = int64(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	}
+	name := zr.Name
+	if name == "" {
+		name = "data"
+	}
+	listing := archiveListing{Format: archiveGzip, Comment: zr.Comment}
+	listing.Entries = []archiveEntry{{
+		Name:           name,
+		Size:           size,
+		CompressedSize: int64(len(data)),
+		Method:         "deflate",
+		Modified:       formatModTime(zr.ModTime),
+	}}
+	listing.TotalSize = size
+	return listing, nil
+}
+
+// List the entries of a ZIP, tar or gzip file
+func listArchiveEntries(data []byte) (archiveListing, error) {
+	switch archiveFormat(data) {
+	case archiveZip:
+		return listZip(data)
+	case archiveGzip:
+		return listGzip(data)
+	case archiveTar:
+		return listTarStream(bytes.NewReader(data), archiveTar)
+	case archiveSevenZip:
+		return listSevenZip(data)
+	case archiveRar:
+		return listRar(data)
+	}
+	return archiveListing{}, errors.New("not a ZIP, tar, gzip, 7z or RAR archive")
+}
+
+// A member unpacked from an archive
+type extractedEntry struct {
+	Name     string
+	Data     []byte
+	Modified time.Time
+	IsDir    bool
+}
+
+// Unpack every member of a tar, tar.gz, 7z or RAR archive into memory; the
+// warnings name members that had to be skipped
+func extractArchiveEntries(data []byte) ([]extractedEntry, string, []message, error) {
+	format := archiveFormat(data)
+	var r io.Reader
+	switch format {
+	case archiveSevenZip:
+		entries, warnings, err := extractSevenZip(data)
+		return entries, format, warnings, err
+	case archiveRar:
+		entries, warnings, err := extractRar(data)
+		return entries, format, warnings, err
+	case archiveTar:
+		r = bytes.NewReader(data)
+	case archiveGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, format, nil, fmt.Errorf("invalid gzip: %v", err)
+		}
+		defer zr.Close()
+		r, format = zr, archiveTarGz
+	default:
+		return nil, format, nil, errors.New("not a tar, tar.gz, 7z or RAR archive")
+	}
+
+	var entries []extractedEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, format, nil, fmt.Errorf("invalid tar: %v", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+		default:
+			continue // links and devices have no ZIP equivalent
+		}
+		entry := extractedEntry{Name: hdr.Name, Modified: hdr.ModTime, IsDir: hdr.Typeflag == tar.TypeDir}
+		if !entry.IsDir {
+			if entry.Data, err = io.ReadAll(tr); err != nil {
+				return nil, format, nil, fmt.Errorf("%s: %v", hdr.Name, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, format, nil, nil
+}
+
+// Pack extracted entries into a ZIP; already compressed formats are stored
+func writeZipEntries(entries []extractedEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		name := strings.TrimPrefix(strings.ReplaceAll(e.Name, "\\", "/"), "/")
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: e.Modified}
+		if e.IsDir {
+			hdr.Name = strings.TrimSuffix(name, "/") + "/"
+			hdr.Method = zip.Store
+		} else if mimeType := sniffMimeType(e.Data); strings.HasPrefix(mimeType, "image/") && mimeType != "image/bmp" && mimeType != "image/tiff" {
+			hdr.Method = zip.Store
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if _, err := w.Write(e.Data); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// convertToZip entry action when recompression is off
+const zipEntryPacked = "packed"
+
+// Options for convertToZip: the recompressZip filters plus a switch
+type convertToZipOptions struct {
+	zipRecompressOptions
+
+	// Re-encode images and PDFs while repacking
+	Recompress bool `json:"recompress"`
+}
+
+// convertToZip(data, options?, progress?) unpacks a 7z, RAR (v4 or v5),
+// tar or tar.gz archive and repacks it as a ZIP, re-encoding images and PDFs on the way
+// unless recompress is false. Options: {recompress, include, exclude,
+// perTypeOptions} as for recompressZip. Resolves with the standard result
+// object plus format (of the input) and entries.
+func convertToZip(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] convertToZip called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("convertToZip", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("convertToZip", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := convertToZipOptions{Recompress: true}
+	opts.policy = currentPolicy()
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+
+	return runAsync("convertToZip", func() (interface{}, error) {
+		j := startJob("convertToZip")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		reportProgress := progressReporter(progressCallback, j)
+
+		entries, format, warnings, err := extractArchiveEntries(inputBytes)
+		if err != nil {
+			return nil, err
+		}
+		reportProgress(20)
+		if err := checkCancelled(j.ctx); err != nil {
+			return nil, err
+		}
+		out, err := writeZipEntries(entries)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Unpacked %s: %d entries into %d byte ZIP\n", format, len(entries), len(out))
+
+		var results []zipEntryResult
+		if opts.Recompress {
+			out, results, err = recompressZipData(j, out, opts.zipRecompressOptions, func(p int) {
+				reportProgress(20 + p*80/100)
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else if listing, err := listZip(out); err == nil {
+			for _, e := range listing.Entries {
+				results = append(results, zipEntryResult{Name: e.Name, Action: zipEntryPacked, OriginalSize: e.Size, CompressedSize: e.CompressedSize})
+			}
+		}
+		reportProgress(100)
+
+		result := newResultObject(inputBytes, out)
+		result.Set("format", format)
+		setMessages(result, warnings)
+		if jsEntries, err := jsonToJS(results); err == nil {
+			result.Set("entries", jsEntries)
+		}
+		return result, nil
+	})
+}
+
+// listArchive(data) resolves with {format, entries, totalSize, comment,
+// warnings, messages} for ZIP, tar, gzip, .tar.gz, 7z and RAR input. Each
+// entry has name, size, compressedSize, method, modified, isDir and
+// encrypted.
+// Nothing is extracted; tar.gz and solid RAR archives are streamed through
+// once to read their headers.
+func listArchive(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] listArchive called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("listArchive", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("listArchive", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+
+	return runAsync("listArchive", func() (interface{}, error) {
+		j := startJob("listArchive")
+		defer j.finish()
+		defer release()
+
+		listing, err := listArchiveEntries(inputBytes)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] %s archive: %d entries, %d bytes\n", listing.Format, len(listing.Entries), listing.TotalSize)
+		return jsonToJS(listing)
+	})
+}
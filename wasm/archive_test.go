@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+)
+
+var fixtureArchiveTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// ZIP with a deflated file, a stored file and a directory
+func fixtureZip() []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.SetComment("fixture")
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "docs/a.txt", Method: zip.Deflate, Modified: fixtureArchiveTime})
+	w.Write(bytes.Repeat([]byte("x"), 1000))
+	w, _ = zw.CreateHeader(&zip.FileHeader{Name: "b.bin", Method: zip.Store})
+	w.Write([]byte("stored"))
+	zw.CreateHeader(&zip.FileHeader{Name: "empty/"})
+	zw.Close()
+	return buf.Bytes()
+}
+
+// tar with two files and a directory
+func fixtureTar() []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: fixtureArchiveTime})
+	for _, f := range []struct{ name, body string }{{"dir/f.txt", "hello"}, {"g.txt", "second file"}} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Size: int64(len(f.body)), Mode: 0644, Typeflag: tar.TypeReg, ModTime: fixtureArchiveTime})
+		tw.Write([]byte(f.body))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func fixtureGzip(data []byte, name string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Name = name
+	zw.ModTime = fixtureArchiveTime
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestListArchiveEntries(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		format  string
+		entries []archiveEntry
+		comment string
+	}{
+		{"zip", fixtureZip(), archiveZip, []archiveEntry{
+			{Name: "docs/a.txt", Size: 1000, Method: "deflate", Modified: "2024-03-01T12:00:00Z"},
+			{Name: "b.bin", Size: 6, CompressedSize: 6, Method: "store"},
+			{Name: "empty/", Method: "store", IsDir: true},
+		}, "fixture"},
+		{"tar", fixtureTar(), archiveTar, []archiveEntry{
+			{Name: "dir/", Method: "store", Modified: "2024-03-01T12:00:00Z", IsDir: true},
+			{Name: "dir/f.txt", Size: 5, Method: "store", Modified: "2024-03-01T12:00:00Z"},
+			{Name: "g.txt", Size: 11, Method: "store", Modified: "2024-03-01T12:00:00Z"},
+		}, ""},
+		{"tar.gz", fixtureGzip(fixtureTar(), ""), archiveTarGz, []archiveEntry{
+			{Name: "dir/", Method: "deflate", Modified: "2024-03-01T12:00:00Z", IsDir: true},
+			{Name: "dir/f.txt", Size: 5, Method: "deflate", Modified: "2024-03-01T12:00:00Z"},
+			{Name: "g.txt", Size: 11, Method: "deflate", Modified: "2024-03-01T12:00:00Z"},
+		}, ""},
+	} {
+		listing, err := listArchiveEntries(c.data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if listing.Format != c.format || listing.Comment != c.comment || len(listing.Warnings) != 0 {
+			t.Errorf("%s: format %s, comment %q, warnings %v", c.name, listing.Format, listing.Comment, listing.Warnings)
+		}
+		if len(listing.Entries) != len(c.entries) {
+			t.Fatalf("%s: %+v", c.name, listing.Entries)
+		}
+		var total int64
+		for i, e := range listing.Entries {
+			want := c.entries[i]
+			if c.format == archiveZip && want.Method == "deflate" {
+				want.CompressedSize = e.CompressedSize // whatever deflate made of it
+			}
+			if e != want {
+				t.Errorf("%s entry %d: %+v, want %+v", c.name, i, e, want)
+			}
+			total += e.Size
+		}
+		if listing.TotalSize != total {
+			t.Errorf("%s: total %d, want %d", c.name, listing.TotalSize, total)
+		}
+	}
+
+	// A plain gzip file is one member named from its header
+	data := bytes.Repeat([]byte("plain text "), 100)
+	gz := fixtureGzip(data, "notes.txt")
+	listing, err := listArchiveEntries(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := archiveEntry{Name: "notes.txt", Size: int64(len(data)), CompressedSize: int64(len(gz)), Method: "deflate", Modified: "2024-03-01T12:00:00Z"}
+	if listing.Format != archiveGzip || len(listing.Entries) != 1 || listing.Entries[0] != want {
+		t.Errorf("gzip: %+v", listing)
+	}
+
+	if _, err := listArchiveEntries([]byte("not an archive at all")); err == nil {
+		t.Error("plain text listed")
+	}
+}
+
+func TestListArchiveTruncated(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"zip":    fixtureZip(),
+		"tar":    fixtureTar(),
+		"tar.gz": fixtureGzip(fixtureTar(), ""),
+		"gzip":   fixtureGzip(bytes.Repeat([]byte("abc"), 500), "a.txt"),
+	} {
+		full, _ := listArchiveEntries(data)
+		// Every cut either fails or lists no more than the whole archive;
+		// none may panic
+		for cut := 0; cut < len(data); cut++ {
+			listing, err := listArchiveEntries(data[:cut])
+			if err == nil && len(listing.Entries) > len(full.Entries) {
+				t.Fatalf("%s cut at %d: %d entries", name, cut, len(listing.Entries))
+			}
+		}
+	}
+
+	// A ZIP without its central directory cannot be listed
+	zipData := fixtureZip()
+	if _, err := listArchiveEntries(zipData[:len(zipData)/2]); err == nil {
+		t.Error("ZIP cut in half listed")
+	}
+
+	// A tar cut inside its second member lists the first and warns
+	tarData := fixtureTar()
+	listing, err := listArchiveEntries(tarData[:3*512+100])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Entries) != 2 || len(listing.Messages) != 1 || listing.Messages[0].Code != "archive.listingStopped" {
+		t.Errorf("truncated tar: %+v", listing)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Options for encodeBase64
+type base64Options struct {
+	URLSafe    bool `json:"urlSafe"`    // - and _ instead of + and /
+	NoPadding  bool `json:"noPadding"`  // drop trailing =
+	LineLength int  `json:"lineLength"` // wrap with CRLF, as MIME wants; 0 for one line
+}
+
+func encodeBase64Bytes(data []byte, opts base64Options) (string, error) {
+	if opts.LineLength < 0 || opts.LineLength%4 != 0 {
+		return "", errors.New("lineLength must be a non-negative multiple of 4")
+	}
+	enc := base64.StdEncoding
+	if opts.URLSafe {
+		enc = base64.URLEncoding
+	}
+	if opts.NoPadding {
+		enc = enc.WithPadding(base64.NoPadding)
+	}
+	encoded := enc.EncodeToString(data)
+	if opts.LineLength == 0 || len(encoded) <= opts.LineLength {
+		return encoded, nil
+	}
+	var b strings.Builder
+	b.Grow(len(encoded) + len(encoded)/opts.LineLength*2)
+	for len(encoded) > opts.LineLength {
+		b.WriteString(encoded[:opts.LineLength])
+		b.WriteString("\r\n")
+		encoded = encoded[opts.LineLength:]
+	}
+	b.WriteString(encoded)
+	return b.String(), nil
+}
+
+// encodeBase64(data, options?) encodes bytes, or a string as UTF-8,
+// without building a binary string in JS first. Options: {urlSafe,
+// noPadding, lineLength}. Resolves with the string. Entry points that
+// produce output also take {base64: true} to return result.base64
+// directly.
+func encodeBase64(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("encodeBase64", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+	data, err := chunkBytesFromJS(args[0])
+	var opts base64Options
+	if err == nil && len(args) > 1 {
+		err = decodeOptions(args[1], &opts)
+	}
+
+	return runAsync("encodeBase64", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return encodeBase64Bytes(data, opts)
+	})
+}
+
+// decodeBase64(text) decodes base64 in either alphabet, with or without
+// padding and line breaks, or the payload of a data: URL. Resolves with a
+// Uint8Array.
+func decodeBase64(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 || args[0].Type() != js.TypeString {
+		return runAsync("decodeBase64", func() (interface{}, error) {
+			return nil, errors.New("expected a base64 string")
+		})
+	}
+	text := args[0].String()
+
+	return runAsync("decodeBase64", func() (interface{}, error) {
+		var data []byte
+		var err error
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(text)), "data:") {
+			_, data, err = parseDataURL(text)
+		} else {
+			data, err = decodeBase64Loose(text)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Decoded %d base64 characters to %d bytes\n", len(text), len(data))
+		return bytesToJS(data), nil
+	})
+}
@@ -0,0 +1,82 @@
+//go:build js
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestEncodeBase64Bytes(t *testing.T) {
+	data := []byte("hello world\xff\xfe")
+	for _, c := range []struct {
+		opts base64Options
+		want string
+	}{
+		{base64Options{}, "aGVsbG8gd29ybGT//g=="},
+		{base64Options{URLSafe: true}, "aGVsbG8gd29ybGT__g=="},
+		{base64Options{URLSafe: true, NoPadding: true}, "aGVsbG8gd29ybGT__g"},
+		{base64Options{LineLength: 8}, "aGVsbG8g\r\nd29ybGT/\r\n/g=="},
+		{base64Options{LineLength: 20}, "aGVsbG8gd29ybGT//g=="}, // fits on one line
+	} {
+		got, err := encodeBase64Bytes(data, c.opts)
+		if err != nil || got != c.want {
+			t.Errorf("%+v: %q, %v; want %q", c.opts, got, err, c.want)
+		}
+		// Whatever the options, the loose decoder reads it back
+		if back, err := decodeBase64Loose(got); err != nil || !bytes.Equal(back, data) {
+			t.Errorf("%+v: decodes to %q, %v", c.opts, back, err)
+		}
+	}
+	for _, n := range []int{-4, 6} {
+		if _, err := encodeBase64Bytes(data, base64Options{LineLength: n}); err == nil {
+			t.Errorf("lineLength %d accepted", n)
+		}
+	}
+}
+
+func TestBase64EntryPoints(t *testing.T) {
+	opts := js.Global().Get("JSON").Call("parse", `{"urlSafe":true,"noPadding":true,"lineLength":8}`)
+	encoded, err := awaitJS(encodeBase64(js.Undefined(), []js.Value{bytesToJS([]byte("hello world\xff\xfe")), opts}).(js.Value))
+	if err != nil || encoded.String() != "aGVsbG8g\r\nd29ybGT_\r\n_g" {
+		t.Fatalf("%q, %v", encoded.String(), err)
+	}
+	decoded, err := awaitJS(decodeBase64(js.Undefined(), []js.Value{encoded}).(js.Value))
+	if err != nil || string(bytesFromJS(decoded)) != "hello world\xff\xfe" {
+		t.Errorf("decoded %q, %v", bytesFromJS(decoded), err)
+	}
+
+	// Strings are encoded as UTF-8, and data: URLs decode to their payload
+	if s, err := awaitJS(encodeBase64(js.Undefined(), []js.Value{js.ValueOf("héllo")}).(js.Value)); err != nil || s.String() != "aMOpbGxv" {
+		t.Errorf("string: %q, %v", s.String(), err)
+	}
+	if b, err := awaitJS(decodeBase64(js.Undefined(), []js.Value{js.ValueOf("data:text/plain;base64,aMOpbGxv")}).(js.Value)); err != nil || string(bytesFromJS(b)) != "héllo" {
+		t.Errorf("data URL: %v", err)
+	}
+
+	for name, args := range map[string][]js.Value{
+		"decode bytes":   {bytesToJS([]byte("aGk="))},
+		"decode garbage": {js.ValueOf("not base64!")},
+	} {
+		if _, err := awaitJS(decodeBase64(js.Undefined(), args).(js.Value)); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	if _, err := awaitJS(encodeBase64(js.Undefined(), []js.Value{js.ValueOf(1)}).(js.Value)); err == nil {
+		t.Error("number encoded")
+	}
+
+	// compressData returns result.base64 when asked
+	data := bytes.Repeat([]byte("base64 result "), 100)
+	res, err := awaitJS(compressData(js.Undefined(), []js.Value{bytesToJS(data), js.Global().Get("JSON").Call("parse", `{"algorithm":"gzip","base64":true}`)}).(js.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := base64.StdEncoding.DecodeString(res.Get("base64").String())
+	if err != nil || !bytes.Equal(out, bytesFromJS(res.Get("data"))) {
+		t.Errorf("result.base64 does not match result.data: %v", err)
+	}
+}
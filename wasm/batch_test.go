@@ -0,0 +1,98 @@
+//go:build js
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"strings"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Run compressBatch on name/type/data triples and return its results
+func runBatch(t *testing.T, files ...[3]interface{}) []js.Value {
+	t.Helper()
+	array := js.Global().Get("Array").New()
+	for _, f := range files {
+		file := js.Global().Get("Object").New()
+		file.Set("name", f[0])
+		file.Set("type", f[1])
+		file.Set("data", bytesToJS(f[2].([]byte)))
+		array.Call("push", file)
+	}
+	result, err := awaitJS(compressBatch(js.Undefined(), []js.Value{array}).(js.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]js.Value, result.Length())
+	for i := range results {
+		results[i] = result.Index(i)
+		if msg := results[i].Get("error"); isSet(msg) {
+			t.Errorf("%s: %s", results[i].Get("name").String(), msg.String())
+		}
+	}
+	return results
+}
+
+func TestBatchUsesSingleFilePipelines(t *testing.T) {
+	cutout := fixturePNG(fixtureCutout(96, 96))
+	tagged := tagOutput(fixturePNG(fixtureGradient(32, 32)))
+	content := bytes.Repeat([]byte("BT /F1 12 Tf 72 712 Td (Hello) Tj ET\n"), 200)
+	pdf := fixtureStreamPDF([]string{""}, [][]byte{content})
+	results := runBatch(t,
+		[3]interface{}{"cutout.png", "image/png", cutout},
+		[3]interface{}{"again.png", "image/png", tagged},
+		[3]interface{}{"page.pdf", "application/pdf", pdf},
+	)
+
+	// Transparency survives: the ladder keeps alpha images out of JPEG
+	out := bytesFromJS(results[0].Get("data"))
+	if strategy := results[0].Get("strategy").String(); strategy == "image-jpeg" || strategy == "passthrough" {
+		t.Errorf("cutout strategy %s", strategy)
+	}
+	img, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("corner alpha %d, want transparent", a)
+	}
+
+	// The double-compression guard returns earlier outputs unchanged
+	if strategy := results[1].Get("strategy").String(); strategy != "passthrough" {
+		t.Errorf("tagged output strategy %s", strategy)
+	}
+	if messages := results[1].Get("messages"); !isSet(messages) || messages.Index(0).Get("code").String() != "image.taggedOutput" {
+		t.Errorf("tagged output carries no guard warning")
+	}
+
+	// PDFs run the fallback chain, which deflates the bare stream
+	if strategy := results[2].Get("strategy").String(); !strings.HasPrefix(strategy, "pdf-") {
+		t.Errorf("PDF strategy %s", strategy)
+	}
+}
+
+func TestBatchAppliesPolicyToPDFs(t *testing.T) {
+	policyMu.Lock()
+	activePolicy = &compressionPolicy{StripMetadata: true, Enforcement: policyReject}
+	policyMu.Unlock()
+	t.Cleanup(func() {
+		policyMu.Lock()
+		activePolicy = nil
+		policyMu.Unlock()
+	})
+
+	data := []byte("%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog >>\nendobj\n" +
+		"3 0 obj\n<< /Producer (Scanner) /Custom (x) >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R /Info 3 0 R >>\n%%EOF\n")
+	results := runBatch(t, [3]interface{}{"info.pdf", "application/pdf", data})
+	if strategy := results[0].Get("strategy").String(); !strings.HasPrefix(strategy, "pdf-") {
+		t.Errorf("strategy %s", strategy)
+	}
+	if out := bytesFromJS(results[0].Get("data")); bytes.Contains(out, []byte("Scanner")) {
+		t.Errorf("policy metadata strip not applied:\n%s", out)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"time"
+)
+
+// Packaging of a compressBatch run, chosen with outputMode:
+//
+//	files  each result carries its own data (the default)
+//	zip    one ZIP of every output, entries named like outputName ("{name}.{ext}"
+//	       without a namePattern); already compressed images are stored
+//	pdf    one PDF with every output on its own page, for batches of images
+//	       only; JPEGs go in as they are, other formats as lossless samples
+//	       flattened onto white, at 96 dpi like contact sheets
+//
+// In the packaged modes results keep their sizes, strategy and messages
+// but no data, and the package comes back as output: {format, mimeType,
+// filename, data}. Outputs are held until the batch ends, so a packaged
+// batch needs memory for all of them at once.
+
+// Batch output modes
+const (
+	batchOutputFiles = "files"
+	batchOutputZip   = "zip"
+	batchOutputPDF   = "pdf"
+)
+
+func checkBatchOutputMode(mode string) error {
+	switch mode {
+	case "", batchOutputFiles, batchOutputZip, batchOutputPDF:
+		return nil
+	}
+	return fmt.Errorf("unknown output mode %q, want files, zip or pdf", mode)
+}
+
+// Outputs of a batch collected into one file
+type batchPackage struct {
+	mode    string
+	started time.Time
+	names   *outputNamer // entry names for batches without a namePattern
+	entries []extractedEntry
+	pages   []pdfImagePage
+}
+
+// A package for mode, or nil when results carry their own data
+func newBatchPackage(mode string, started time.Time) *batchPackage {
+	if mode == "" || mode == batchOutputFiles {
+		return nil
+	}
+	names, _ := newOutputNamer("{name}.{ext}", started)
+	return &batchPackage{mode: mode, started: started, names: names}
+}
+
+// Add one file's output. name is its outputName, or empty when the batch
+// has no namePattern.
+func (p *batchPackage) add(inputName, name string, output []byte, contentEncoding string) error {
+	switch p.mode {
+	case batchOutputZip:
+		if name == "" {
+			name = p.names.next(inputName, output, contentEncoding)
+		}
+		p.entries = append(p.entries, extractedEntry{Name: name, Modified: p.started, Data: output})
+	case batchOutputPDF:
+		page, err := imagePDFPage(output)
+		if err != nil {
+			return fmt.Errorf("%s: %v", inputName, err)
+		}
+		p.pages = append(p.pages, page)
+	}
+	return nil
+}
+
+// The packaged file with its MIME type and file name
+func (p *batchPackage) encode() ([]byte, string, string, error) {
+	switch p.mode {
+	case batchOutputZip:
+		data, err := writeZipEntries(p.entries)
+		return data, "application/zip", "compressed.zip", err
+	case batchOutputPDF:
+		if len(p.pages) == 0 {
+			return nil, "", "", errors.New("no pages to write")
+		}
+		return imagePagesToPDF(p.pages), "application/pdf", "compressed.pdf", nil
+	}
+	return nil, "", "", fmt.Errorf("unknown output mode %q", p.mode)
+}
+
+// An encoded image placed on a page at 96 dpi. Gray and YCbCr JPEGs are
+// embedded as they are; anything else is decoded, flattened onto white
+// and stored as Flate-compressed samples.
+func imagePDFPage(data []byte) (pdfImagePage, error) {
+	var p pdfImagePage
+	if sniffMimeType(data) == "image/jpeg" {
+		if cfg, err := jpeg.DecodeConfig(bytes.NewReader(data)); err == nil {
+			switch cfg.ColorModel {
+			case color.GrayModel:
+				p.ColorSpace = "DeviceGray"
+			case color.YCbCrModel:
+				p.ColorSpace = "DeviceRGB"
+			}
+			if p.ColorSpace != "" {
+				p.Data, p.Filter, p.BitsPerComponent = data, "DCTDecode", 8
+				p.Width, p.Height = cfg.Width, cfg.Height
+				p.PageWidth, p.PageHeight = float64(cfg.Width)*0.75, float64(cfg.Height)*0.75
+				return p, nil
+			}
+		}
+	}
+
+	img, err := decodeStillImage(data)
+	if err != nil {
+		return p, fmt.Errorf("not an image that can go on a page: %v", err)
+	}
+	b := img.Bounds()
+	p.Width, p.Height = b.Dx(), b.Dy()
+	p.PageWidth, p.PageHeight = float64(b.Dx())*0.75, float64(b.Dy())*0.75
+	p.Filter, p.BitsPerComponent = "FlateDecode", 8
+	if gray, ok := img.(*image.Gray); ok {
+		samples := make([]byte, 0, p.Width*p.Height)
+		for y := 0; y < p.Height; y++ {
+			samples = append(samples, gray.Pix[y*gray.Stride:y*gray.Stride+p.Width]...)
+		}
+		p.Data, p.ColorSpace = deflateStream(samples), "DeviceGray"
+		return p, nil
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, p.Width, p.Height))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), img, b.Min, draw.Over)
+	samples := make([]byte, 0, p.Width*p.Height*3)
+	for i := 0; i < len(canvas.Pix); i += 4 {
+		samples = append(samples, canvas.Pix[i], canvas.Pix[i+1], canvas.Pix[i+2])
+	}
+	p.Data, p.ColorSpace = deflateStream(samples), "DeviceRGB"
+	return p, nil
+}
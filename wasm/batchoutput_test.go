@@ -0,0 +1,63 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchOutput(t *testing.T) {
+	// A JPEG goes on its page as it is, a PNG with alpha as samples
+	// over white; ZIP entries are named after their outputs
+	jpegData := fixtureJPEG(fixtureGradient(40, 30))
+	pngData := fixturePNG(fixtureCutout(20, 20))
+	start := time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)
+	pdfPkg := newBatchPackage(batchOutputPDF, start)
+	if err := pdfPkg.add("a.jpg", "", jpegData, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := pdfPkg.add("b.png", "", pngData, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := pdfPkg.add("c.txt", "", []byte("not an image"), ""); err == nil {
+		t.Fatal("text was placed on a page")
+	}
+	data, mimeType, _, err := pdfPkg.encode()
+	if err != nil || mimeType != "application/pdf" {
+		t.Fatalf("PDF package: %v", err)
+	}
+	doc, err := parsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.pages()) != 2 || !bytes.Contains(data, jpegData) {
+		t.Fatalf("PDF has %d pages", len(doc.pages()))
+	}
+	if p := pdfPkg.pages[1]; p.Filter != "FlateDecode" || p.ColorSpace != "DeviceRGB" || p.PageWidth != 15 {
+		t.Fatalf("PNG page is %+v", p)
+	}
+
+	zipPkg := newBatchPackage(batchOutputZip, start)
+	zipPkg.add("a.png", "", jpegData, "")
+	zipPkg.add("A.png", "", jpegData, "")
+	zipPkg.add("style.css", "custom.css.gz", []byte("body{}"), codecGzip)
+	if data, _, _, err = zipPkg.encode(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, " ") != "a.jpg A-2.jpg custom.css.gz" {
+		t.Fatalf("ZIP entries %v", names)
+	}
+	if newBatchPackage(batchOutputFiles, start) != nil || checkBatchOutputMode("tar") == nil {
+		t.Fatal("files mode packaged or unknown mode accepted")
+	}
+}
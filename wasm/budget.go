@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A soft deadline for one compression call. Unlike cancellation, running
+// out of budget is not an error: pipelines stop trying further strategies
+// and return the best result they already have. The zero budget never
+// runs out.
+type timeBudget struct {
+	deadline time.Time
+}
+
+func newTimeBudget(maxMs int) timeBudget {
+	if maxMs <= 0 {
+		return timeBudget{}
+	}
+	return timeBudget{deadline: time.Now().Add(time.Duration(maxMs) * time.Millisecond)}
+}
+
+// Whether a deadline was set at all
+func (b timeBudget) limited() bool {
+	return !b.deadline.IsZero()
+}
+
+// Whether the deadline has passed
+func (b timeBudget) exceeded() bool {
+	return b.limited() && !time.Now().Before(b.deadline)
+}
+
+// Whether the given number of encode passes over a w x h image still
+// finishes before the deadline. Unlimited budgets never measure speed.
+func (b timeBudget) fitsEncode(w, h int, passes float64) bool {
+	if !b.limited() {
+		return true
+	}
+	return time.Until(b.deadline) > time.Duration(passes*float64(estimateEncodeTime(w, h)))
+}
+
+// Yield check for work done piece by piece: once more than
+// earlyAbortProcessed of the data is done and less than earlyAbortSavings
+// of what was done has been saved, the rest is unlikely to pay off
+// either, and is kept as it is. The earlyAbort options of the PDF chain,
+// the image ladder and compressData stop on it.
+const (
+	earlyAbortProcessed = 0.5
+	earlyAbortSavings   = 0.01
+)
+
+// Whether processed of total bytes saving saved is too little to go on
+func lowYield(processed, saved, total int) bool {
+	return total > 0 && float64(processed) > earlyAbortProcessed*float64(total) &&
+		float64(saved) < earlyAbortSavings*float64(processed)
+}
+
+// Yield of the passes sharing one input, for checks that span them: each
+// pass adds the bytes it worked on and what they came to, and skips what
+// is left once low says so. Low stays set once reached, so later passes
+// and fallback levels skip their work too. A nil tracker never stops
+// anything.
+type yieldTracker struct {
+	total, processed, saved int
+	abortedAt               float64 // fraction processed when low was first reached; 0 before
+}
+
+func newYieldTracker(total int) *yieldTracker {
+	return &yieldTracker{total: total}
+}
+
+// Record that before bytes of input came to after
+func (y *yieldTracker) add(before, after int) {
+	if y == nil {
+		return
+	}
+	y.processed += before
+	y.saved += before - after
+}
+
+// Whether the work so far saved too little to go on
+func (y *yieldTracker) low() bool {
+	if y == nil {
+		return false
+	}
+	if y.abortedAt == 0 && lowYield(y.processed, y.saved, y.total) {
+		y.abortedAt = min(float64(y.processed)/float64(y.total), 1)
+		fmt.Printf("[WASM] Saved %d of %d bytes so far, keeping the remaining input as it is\n", y.saved, y.processed)
+		trace(nil, "yield", "earlyAbort", "processed", y.processed, "saved", y.saved, "total", y.total)
+	}
+	return y.abortedAt > 0
+}
+
+// Rough JPEG encode time for an image of w x h pixels, from the measured
+// device speed
+func estimateEncodeTime(w, h int) time.Duration {
+	speed := deviceSpeedMBps()
+	if speed <= 0 {
+		return 0
+	}
+	return time.Duration(float64(w*h*4) / (speed * (1 << 20)) * float64(time.Second))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// CCITT Group 4 (T.6) encoder for bilevel scans. golang.org/x/image/ccitt
+// only decodes, so the code tables from ITU-T T.4 are kept here as bit
+// strings and converted once at startup.
+
+var ccittWhiteTerminating = [64]string{
+	"00110101", "000111", "0111", "1000", "1011", "1100", "1110", "1111",
+	"10011", "10100", "00111", "01000", "001000", "000011", "110100", "110101",
+	"101010", "101011", "0100111", "0001100", "0001000", "0010111", "0000011", "0000100",
+	"0101000", "0101011", "0010011", "0100100", "0011000", "00000010", "00000011", "00011010",
+	"00011011", "00010010", "00010011", "00010100", "00010101", "00010110", "00010111", "00101000",
+	"00101001", "00101010", "00101011", "00101100", "00101101", "00000100", "00000101", "00001010",
+	"00001011", "01010010", "01010011", "01010100", "01010101", "00100100", "00100101", "01011000",
+	"01011001", "01011010", "01011011", "01001010", "01001011", "00110010", "00110011", "00110100",
+}
+
+var ccittBlackTerminating = [64]string{
+	"0000110111", "010", "11", "10", "011", "0011", "0010", "00011",
+	"000101", "000100", "0000100", "0000101", "0000111", "00000100", "00000111", "000011000",
+	"0000010111", "0000011000", "0000001000", "00001100111", "00001101000", "00001101100", "00000110111", "00000101000",
+	"00000010111", "00000011000", "000011001010", "000011001011", "000011001100", "000011001101", "000001101000", "000001101001",
+	"000001101010", "000001101011", "000011010010", "000011010011", "000011010100", "000011010101", "000011010110", "000011010111",
+	"000001101100", "000001101101", "000011011010", "000011011011", "000001010100", "000001010101", "000001010110", "000001010111",
+	"000001100100", "000001100101", "000001010010", "000001010011", "000000100100", "000000110111", "000000111000", "000000100111",
+	"000000101000", "000001011000", "000001011001", "000000101011", "000000101100", "000001011010", "000001100110", "000001100111",
+}
+
+// Make-up codes for runs of 64..1728 (index = run/64 - 1)
+var ccittWhiteMakeup = [27]string{
+	"11011", "10010", "010111", "0110111", "00110110", "00110111", "01100100", "01100101",
+	"01101000", "01100111", "011001100", "011001101", "011010010", "011010011", "011010100", "011010101",
+	"011010110", "011010111", "011011000", "011011001", "011011010", "011011011", "010011000", "010011001",
+	"010011010", "011000", "010011011",
+}
+
+var ccittBlackMakeup = [27]string{
+	"0000001111", "000011001000", "000011001001", "000001011011", "000000110011", "000000110100", "000000110101", "0000001101100",
+	"0000001101101", "0000001001010", "0000001001011", "0000001001100", "0000001001101", "0000001110010", "0000001110011", "0000001110100",
+	"0000001110101", "0000001110110", "0000001110111", "0000001010010", "0000001010011", "0000001010100", "0000001010101", "0000001011010",
+	"0000001011011", "0000001100100", "0000001100101",
+}
+
+// Make-up codes shared by both colors for runs of 1792..2560
+// (index = run/64 - 28)
+var ccittExtendedMakeup = [13]string{
+	"00000001000", "00000001100", "00000001101", "000000010010", "000000010011", "000000010100", "000000010101",
+	"000000010110", "000000010111", "000000011100", "000000011101", "000000011110", "000000011111",
+}
+
+// Two-dimensional mode codes
+const (
+	ccittPass       = "0001"
+	ccittHorizontal = "001"
+	ccittEOFB       = "000000000001000000000001"
+)
+
+// Vertical mode codes for a1-b1 = -3..3
+var ccittVertical = [7]string{"0000010", "000010", "010", "1", "011", "000011", "0000011"}
+
+// MSB-first bit packer
+type bitWriter struct {
+	out   []byte
+	cur   byte
+	nbits uint
+}
+
+func (w *bitWriter) writeCode(code string) {
+	for i := 0; i < len(code); i++ {
+		w.cur <<= 1
+		if code[i] == '1' {
+			w.cur |= 1
+		}
+		w.nbits++
+		if w.nbits == 8 {
+			w.out = append(w.out, w.cur)
+			w.cur, w.nbits = 0, 0
+		}
+	}
+}
+
+// Pad the final byte with zero bits
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, w.cur<<(8-w.nbits))
+		w.cur, w.nbits = 0, 0
+	}
+	return w.out
+}
+
+// Write one run length as make-up codes followed by a terminating code
+func (w *bitWriter) writeRun(run int, black bool) {
+	terminating, makeup := &ccittWhiteTerminating, &ccittWhiteMakeup
+	if black {
+		terminating, makeup = &ccittBlackTerminating, &ccittBlackMakeup
+	}
+	for run >= 2560 {
+		w.writeCode(ccittExtendedMakeup[len(ccittExtendedMakeup)-1])
+		run -= 2560
+	}
+	if run >= 1792 {
+		w.writeCode(ccittExtendedMakeup[run/64-28])
+		run %= 64
+	} else if run >= 64 {
+		w.writeCode(makeup[run/64-1])
+		run %= 64
+	}
+	w.writeCode(terminating[run])
+}
+
+// A bilevel image, one bool per pixel (true = black)
+type bilevelImage struct {
+	Width, Height int
+	Black         []bool
+}
+
+// Threshold any image into a bilevel image
+func toBilevel(img image.Image, threshold uint8) *bilevelImage {
+	b := img.Bounds()
+	out := &bilevelImage{Width: b.Dx(), Height: b.Dy(), Black: make([]bool, b.Dx()*b.Dy())}
+	if gray, ok := img.(*image.Gray); ok {
+		for y := 0; y < out.Height; y++ {
+			row := gray.Pix[y*gray.Stride : y*gray.Stride+out.Width]
+			for x, v := range row {
+				out.Black[y*out.Width+x] = v < threshold
+			}
+		}
+		return out
+	}
+	for y := 0; y < out.Height; y++ {
+		for x := 0; x < out.Width; x++ {
+			g := color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray)
+			out.Black[y*out.Width+x] = g.Y < threshold
+		}
+	}
+	return out
+}
+
+// Whether every pixel is pure black or pure white
+func isBilevel(img image.Image) bool {
+	switch m := img.(type) {
+	case *image.Gray:
+		for _, v := range m.Pix {
+			if v != 0 && v != 0xFF {
+				return false
+			}
+		}
+		return true
+	case *image.Paletted:
+		for _, c := range m.Palette {
+			g := color.GrayModel.Convert(c).(color.Gray)
+			r, gr, bl, _ := c.RGBA()
+			if (g.Y != 0 && g.Y != 0xFF) || r != gr || gr != bl {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Position of the next changing element after from, or width if none. The
+// pixel before the start of a line counts as white.
+func nextChange(line []bool, from int) int {
+	color := false
+	if from >= 0 {
+		color = line[from]
+	}
+	for x := from + 1; x < len(line); x++ {
+		if line[x] != color {
+			return x
+		}
+	}
+	return len(line)
+}
+
+// Encode a bilevel image as a CCITT Group 4 stream (K=-1, no byte
+// alignment, BlackIs1=false, terminated with EOFB)
+func encodeCCITTG4(img *bilevelImage) []byte {
+	w := &bitWriter{}
+	width := img.Width
+	ref := make([]bool, width) // imaginary all-white line above the page
+
+	for y := 0; y < img.Height; y++ {
+		cur := img.Black[y*width : (y+1)*width]
+		a0, black := -1, false
+
+		for a0 < width {
+			a1 := nextChange(cur, a0)
+
+			// b1: first change on the reference line after a0 to the
+			// opposite of the current color; b2: the change after b1
+			b1 := nextChange(ref, a0)
+			for b1 < width && ref[b1] == black {
+				b1 = nextChange(ref, b1)
+			}
+			b2 := width
+			if b1 < width {
+				b2 = nextChange(ref, b1)
+			}
+
+			switch {
+			case b2 < a1:
+				w.writeCode(ccittPass)
+				a0 = b2
+			case a1-b1 >= -3 && a1-b1 <= 3:
+				w.writeCode(ccittVertical[a1-b1+3])
+				a0 = a1
+				black = !black
+			default:
+				a2 := width
+				if a1 < width {
+					a2 = nextChange(cur, a1)
+				}
+				start := a0
+				if start < 0 {
+					start = 0
+				}
+				w.writeCode(ccittHorizontal)
+				w.writeRun(a1-start, black)
+				w.writeRun(a2-a1, !black)
+				a0 = a2
+			}
+		}
+		ref = cur
+	}
+
+	w.writeCode(ccittEOFB)
+	return w.bytes()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"testing"
+
+	"golang.org/x/image/ccitt"
+)
+
+// Decode G4 data with the x/image reader into one bool per pixel
+func decodeG4(t *testing.T, data []byte, w, h int) []bool {
+	t.Helper()
+	r := ccitt.NewReader(bytes.NewReader(data), ccitt.MSB, ccitt.Group4, w, h, &ccitt.Options{})
+	packed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%dx%d: %v", w, h, err)
+	}
+	stride := (w + 7) / 8
+	black := make([]bool, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// The reader writes white as 1
+			black[y*w+x] = packed[y*stride+x/8]>>(7-uint(x%8))&1 == 0
+		}
+	}
+	return black
+}
+
+func TestEncodeCCITTG4RoundTrip(t *testing.T) {
+	// Short runs exercise vertical mode, long ones horizontal mode and
+	// the makeup codes past 64 and 2560 pixels
+	state := uint32(7)
+	next := func() uint32 { state = state*1103515245 + 12345; return state >> 8 }
+	for trial := 0; trial < 30; trial++ {
+		w, h := int(next()%3000)+1, int(next()%40)+1
+		img := &bilevelImage{Width: w, Height: h, Black: make([]bool, w*h)}
+		maxRun := []uint32{3, 70, 3000}[trial%3]
+		black := false
+		for i := 0; i < w*h; {
+			for n := int(next()%maxRun) + 1; n > 0 && i < w*h; n-- {
+				img.Black[i] = black
+				i++
+			}
+			black = !black
+		}
+		got := decodeG4(t, encodeCCITTG4(img), w, h)
+		for i := range got {
+			if got[i] != img.Black[i] {
+				t.Fatalf("trial %d (%dx%d): pixel %d,%d flipped", trial, w, h, i%w, i/w)
+			}
+		}
+	}
+}
+
+func TestEncodeCCITTG4BlankPage(t *testing.T) {
+	// An all-white line is a single vertical code, so a blank A4 page at
+	// 200 dpi comes to well under a byte per line
+	img := &bilevelImage{Width: 1654, Height: 2339, Black: make([]bool, 1654*2339)}
+	data := encodeCCITTG4(img)
+	if len(data) > img.Height/4 {
+		t.Errorf("blank page took %d bytes", len(data))
+	}
+	for _, black := range decodeG4(t, data, img.Width, img.Height) {
+		if black {
+			t.Fatal("blank page decoded with black pixels")
+		}
+	}
+}
+
+func TestToBilevel(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 4, 1))
+	copy(gray.Pix, []byte{0, 127, 128, 255})
+	b := toBilevel(gray, 128)
+	if want := []bool{true, true, false, false}; !equalBools(b.Black, want) {
+		t.Errorf("threshold 128 gave %v, want %v", b.Black, want)
+	}
+	if isBilevel(gray) {
+		t.Error("mid grays counted as bilevel")
+	}
+	copy(gray.Pix, []byte{0, 255, 255, 0})
+	if !isBilevel(gray) {
+		t.Error("black and white gray image not counted as bilevel")
+	}
+	if isBilevel(fixtureGradient(4, 4)) {
+		t.Error("RGB image counted as bilevel")
+	}
+}
+
+func equalBools(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
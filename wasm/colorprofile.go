@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// sRGB colorants adapted to the D50 connection space, as in the ICC's own
+// sRGB profile. Columns are the red, green and blue XYZ values.
+var srgbColorants = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// Extract the embedded ICC profile of a JPEG (APP2 chunks) or PNG (iCCP);
+// nil when there is none
+func embeddedICCProfile(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		chunks := map[int][]byte{}
+		jpegSegments(data, func(marker byte, payload []byte) {
+			if marker == 0xE2 && len(payload) > 14 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")) {
+				chunks[int(payload[12])] = payload[14:]
+			}
+		})
+		if len(chunks) == 0 {
+			return nil
+		}
+		seqs := make([]int, 0, len(chunks))
+		for seq := range chunks {
+			seqs = append(seqs, seq)
+		}
+		sort.Ints(seqs)
+		var profile []byte
+		for _, seq := range seqs {
+			profile = append(profile, chunks[seq]...)
+		}
+		return profile
+	case bytes.HasPrefix(data, pngSignature):
+		chunks, _ := readPNGChunks(data)
+		for _, c := range chunks {
+			if c.Type != "iCCP" {
+				continue
+			}
+			nul := bytes.IndexByte(c.Data, 0)
+			if nul < 0 || nul+2 > len(c.Data) {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(c.Data[nul+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(io.LimitReader(zr, 4<<20))
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+	}
+	return nil
+}
+
+// A tone curve from an ICC curv or para tag, mapping [0,1] to [0,1]
+type iccCurve func(float64) float64
+
+// An RGB matrix/TRC profile: what AdobeRGB, ProPhoto and Display P3 use
+type iccMatrixProfile struct {
+	Description string
+	Colorants   [3][3]float64 // columns: red, green, blue XYZ (D50)
+	Curves      [3]iccCurve
+}
+
+func iccS15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseICCCurve(tag []byte) (iccCurve, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("short curve tag")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*n {
+			return nil, errors.New("short curve table")
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			frac := pos - float64(i)
+			return table[i]*(1-frac) + table[i+1]*frac
+		}, nil
+	case "para":
+		funcType := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if funcType >= len(counts) || len(tag) < 12+4*counts[funcType] {
+			return nil, fmt.Errorf("unsupported parametric curve type %d", funcType)
+		}
+		var p [7]float64
+		for i := 0; i < counts[funcType]; i++ {
+			p[i] = iccS15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		return func(x float64) float64 {
+			switch funcType {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}
+			if x >= d {
+				return math.Pow(a*x+b, g) + e
+			}
+			return c*x + f
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve type %q", tag[:4])
+}
+
+// Read an RGB matrix/TRC profile. LUT-based profiles (mAB/A2B0) are
+// rejected; they are rare for photos and need a full CMM.
+func parseICCMatrixProfile(profile []byte) (*iccMatrixProfile, error) {
+	if len(profile) < 132 || string(profile[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	if string(profile[16:20]) != "RGB " {
+		return nil, fmt.Errorf("%q profiles are not converted", bytes.TrimSpace(profile[16:20]))
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count && 132+12*i+12 <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, errors.New("ICC tag outside the profile")
+		}
+		tags[string(entry[:4])] = profile[offset : offset+size]
+	}
+
+	p := &iccMatrixProfile{Description: iccDescription(tags["desc"])}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := tags[sig]
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			return nil, errors.New("profile has no RGB colorants (LUT-based profiles are not converted)")
+		}
+		for row := 0; row < 3; row++ {
+			p.Colorants[row][i] = iccS15Fixed16(tag[8+4*row:])
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseICCCurve(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", sig, err)
+		}
+		p.Curves[i] = curve
+	}
+	return p, nil
+}
+
+// Profile description from a desc (v2) or mluc (v4) tag
+func iccDescription(tag []byte) string {
+	switch {
+	case len(tag) >= 12 && string(tag[:4]) == "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > 0 && 12+n <= len(tag) {
+			return string(bytes.TrimRight(tag[12:12+n], "\x00"))
+		}
+	case len(tag) >= 28 && string(tag[:4]) == "mluc":
+		size := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+size <= len(tag) {
+			runes := make([]rune, 0, size/2)
+			for i := offset; i+1 < offset+size; i += 2 {
+				runes = append(runes, rune(binary.BigEndian.Uint16(tag[i:])))
+			}
+			return string(runes)
+		}
+	}
+	return ""
+}
+
+func srgbEncode(x float64) float64 {
+	if x <= 0.0031308 {
+		return 12.92 * x
+	}
+	return 1.055*math.Pow(x, 1/2.4) - 0.055
+}
+
+func srgbDecode(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+// Whether the profile is sRGB already, give or take rounding
+func (p *iccMatrixProfile) isSRGB() bool {
+	for row := range p.Colorants {
+		for col := range p.Colorants[row] {
+			if math.Abs(p.Colorants[row][col]-srgbColorants[row][col]) > 0.003 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.Curves {
+		for _, x := range []float64{0.1, 0.3, 0.5, 0.8} {
+			if math.Abs(curve(x)-srgbDecode(x)) > 0.01 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv [3][3]float64
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return inv
+}
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+// Re-express img, encoded in profile p, in sRGB. Out-of-gamut colors are
+// clipped per channel.
+func convertToSRGB(img image.Image, p *iccMatrixProfile) *image.NRGBA {
+	m := mul3(invert3(srgbColorants), p.Colorants)
+
+	var toLinear [3][256]float64
+	for ch := 0; ch < 3; ch++ {
+		for v := 0; v < 256; v++ {
+			toLinear[ch][v] = p.Curves[ch](float64(v) / 255)
+		}
+	}
+	const encodeSteps = 4096
+	var encode [encodeSteps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(srgbEncode(float64(i)/encodeSteps) * 255))
+	}
+	quantize := func(x float64) uint8 {
+		if x <= 0 {
+			return 0
+		}
+		if x >= 1 {
+			return 255
+		}
+		return encode[int(x*encodeSteps+0.5)]
+	}
+
+	out := imaging.Clone(img)
+	for i := 0; i+3 < len(out.Pix); i += 4 {
+		r := toLinear[0][out.Pix[i]]
+		g := toLinear[1][out.Pix[i+1]]
+		b := toLinear[2][out.Pix[i+2]]
+		out.Pix[i] = quantize(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+		out.Pix[i+1] = quantize(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+		out.Pix[i+2] = quantize(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+	}
+	return out
+}
+
+// Convert img to sRGB if inputBytes carries a wide-gamut profile. Returns
+// img unchanged, with a message for anything that could not be converted.
+func applyColorProfile(img image.Image, inputBytes []byte) (image.Image, []message) {
+	profile := embeddedICCProfile(inputBytes)
+	if profile == nil {
+		return img, nil
+	}
+	p, err := parseICCMatrixProfile(profile)
+	if err != nil {
+		return img, []message{newMessage("image.profileNotConverted", "error", err)}
+	}
+	if p.isSRGB() {
+		return img, nil
+	}
+	fmt.Printf("[WASM] Converting %q to sRGB\n", p.Description)
+	return convertToSRGB(img, p), nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// Display P3 colorants adapted to D50
+var displayP3Colorants = [3][3]float64{
+	{0.5151, 0.2920, 0.1571},
+	{0.2412, 0.6922, 0.0666},
+	{-0.0011, 0.0419, 0.7841},
+}
+
+// sRGB's tone curve as an ICC parametric curve (type 3)
+func fixtureSRGBCurve() []byte {
+	tag := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, p := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		tag = binary.BigEndian.AppendUint32(tag, uint32(int32(math.Round(p*65536))))
+	}
+	return tag
+}
+
+// A v2 RGB matrix/TRC profile with the given colorants, one shared TRC
+// and a desc tag
+func fixtureICC(colorants [3][3]float64, trc []byte, description string) []byte {
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	var tags []tag
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		data := []byte("XYZ \x00\x00\x00\x00")
+		for row := 0; row < 3; row++ {
+			data = binary.BigEndian.AppendUint32(data, uint32(int32(math.Round(colorants[row][i]*65536))))
+		}
+		tags = append(tags, tag{sig, data})
+	}
+	for _, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, tag{sig, trc})
+	}
+	desc := binary.BigEndian.AppendUint32([]byte("desc\x00\x00\x00\x00"), uint32(len(description)+1))
+	tags = append(tags, tag{"desc", append(append(desc, description...), 0)})
+
+	header := make([]byte, 128)
+	copy(header[16:], "RGB ")
+	copy(header[36:], "acsp")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var body []byte
+	for _, t := range tags {
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(128+4+12*len(tags)+len(body)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+		body = append(body, t.data...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	profile := append(append(header, table...), body...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// Embed a profile in a JPEG as APP2 chunks of at most chunk bytes,
+// written in reverse order
+func fixtureJPEGWithICC(img image.Image, profile []byte, chunk int) []byte {
+	var parts [][]byte
+	for len(profile) > 0 {
+		n := minInt(chunk, len(profile))
+		parts = append(parts, profile[:n])
+		profile = profile[n:]
+	}
+	out := []byte{0xFF, 0xD8}
+	for i := len(parts) - 1; i >= 0; i-- {
+		seg := append([]byte("ICC_PROFILE\x00"), byte(i+1), byte(len(parts)))
+		seg = append(seg, parts[i]...)
+		out = append(out, 0xFF, 0xE2, byte((len(seg)+2)>>8), byte(len(seg)+2))
+		out = append(out, seg...)
+	}
+	return append(out, fixtureJPEG(img)[2:]...)
+}
+
+// Embed a profile in a PNG as an iCCP chunk after IHDR
+func fixturePNGWithICC(img image.Image, profile []byte) []byte {
+	chunks, _ := readPNGChunks(fixturePNG(img))
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(profile)
+	zw.Close()
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	for i, c := range chunks {
+		writePNGChunk(&buf, c.Type, c.Data)
+		if i == 0 {
+			writePNGChunk(&buf, "iCCP", append([]byte("P3\x00\x00"), z.Bytes()...))
+		}
+	}
+	return buf.Bytes()
+}
+
+func fixtureFlat(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestEmbeddedICCProfile(t *testing.T) {
+	profile := fixtureICC(displayP3Colorants, fixtureSRGBCurve(), "Display P3")
+	img := fixtureGradient(32, 32)
+	for name, data := range map[string][]byte{
+		"JPEG":          fixtureJPEGWithICC(img, profile, len(profile)),
+		"JPEG, chunked": fixtureJPEGWithICC(img, profile, 100),
+		"PNG":           fixturePNGWithICC(img, profile),
+	} {
+		if got := embeddedICCProfile(data); !bytes.Equal(got, profile) {
+			t.Errorf("%s: %d-byte profile, want %d", name, len(got), len(profile))
+		}
+	}
+	if embeddedICCProfile(fixtureJPEG(img)) != nil || embeddedICCProfile(fixturePNG(img)) != nil {
+		t.Error("profile found in an untagged image")
+	}
+}
+
+func TestParseICCMatrixProfile(t *testing.T) {
+	gamma22 := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33")
+	linear := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00")
+	for _, c := range []struct {
+		description string
+		colorants   [3][3]float64
+		trc         []byte
+		srgb        bool
+	}{
+		{"sRGB IEC61966-2.1", srgbColorants, fixtureSRGBCurve(), true},
+		{"sRGB, gamma 2.2", srgbColorants, gamma22, true},
+		{"Display P3", displayP3Colorants, fixtureSRGBCurve(), false},
+		{"sRGB primaries, linear", srgbColorants, linear, false},
+	} {
+		p, err := parseICCMatrixProfile(fixtureICC(c.colorants, c.trc, c.description))
+		if err != nil {
+			t.Fatalf("%s: %v", c.description, err)
+		}
+		if p.isSRGB() != c.srgb || p.Description != c.description {
+			t.Errorf("%s: sRGB %v, description %q", c.description, p.isSRGB(), p.Description)
+		}
+	}
+
+	p, _ := parseICCMatrixProfile(fixtureICC(displayP3Colorants, fixtureSRGBCurve(), "Display P3"))
+	for row := range p.Colorants {
+		for col := range p.Colorants[row] {
+			if math.Abs(p.Colorants[row][col]-displayP3Colorants[row][col]) > 1e-4 {
+				t.Errorf("colorant [%d][%d] = %v", row, col, p.Colorants[row][col])
+			}
+		}
+	}
+
+	cmyk := fixtureICC(displayP3Colorants, fixtureSRGBCurve(), "CMYK")
+	copy(cmyk[16:], "CMYK")
+	outside := fixtureICC(displayP3Colorants, fixtureSRGBCurve(), "x")
+	binary.BigEndian.PutUint32(outside[132+4:], 1<<20)
+	for name, profile := range map[string][]byte{
+		"short": make([]byte, 100), "no signature": make([]byte, 200), "CMYK": cmyk, "tag outside": outside,
+	} {
+		if _, err := parseICCMatrixProfile(profile); err == nil {
+			t.Errorf("%s profile accepted", name)
+		}
+	}
+}
+
+func TestConvertToSRGB(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	copy(img.Pix, []byte{255, 255, 255, 255, 128, 128, 128, 255, 200, 100, 50, 255, 0, 0, 0, 128})
+
+	// sRGB to sRGB changes nothing beyond rounding
+	srgb, _ := parseICCMatrixProfile(fixtureICC(srgbColorants, fixtureSRGBCurve(), "sRGB"))
+	same := convertToSRGB(img, srgb)
+	for i := range img.Pix {
+		if d := int(same.Pix[i]) - int(img.Pix[i]); d < -1 || d > 1 {
+			t.Fatalf("sRGB round trip: %v, want %v", same.Pix, img.Pix)
+		}
+	}
+
+	// P3 keeps neutrals and alpha, and its orange is more saturated than
+	// the same numbers read as sRGB
+	p3, _ := parseICCMatrixProfile(fixtureICC(displayP3Colorants, fixtureSRGBCurve(), "Display P3"))
+	out := convertToSRGB(img, p3)
+	px := func(i int) []uint8 { return out.Pix[4*i : 4*i+4] }
+	if w := px(0); w[0] < 254 || w[1] < 254 || w[2] < 254 {
+		t.Errorf("white became %v", w)
+	}
+	if g := px(1); g[0] != g[1] || g[1] != g[2] || g[0] < 127 || g[0] > 129 {
+		t.Errorf("grey became %v", g)
+	}
+	if o := px(2); o[0] <= 200 || o[2] >= 50 {
+		t.Errorf("P3 orange became %v", o)
+	}
+	if px(3)[3] != 128 {
+		t.Error("alpha changed")
+	}
+}
+
+func TestColorProfileConversion(t *testing.T) {
+	orange := color.NRGBA{200, 100, 50, 255}
+	p3 := fixtureICC(displayP3Colorants, fixtureSRGBCurve(), "Display P3")
+	data := fixturePNGWithICC(fixtureFlat(64, 64, orange), p3)
+
+	opts := defaultImageOptions()
+	opts.Mode = modeScreenshot // lossless, so pixels can be compared exactly
+	for _, convert := range []bool{false, true} {
+		opts.ConvertToSRGB = convert
+		res, err := compressImageData(context.Background(), data, "image/png", opts, func(int) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeStillImage(res.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA)
+		if convert == (got == orange) || embeddedICCProfile(res.Data) != nil {
+			t.Errorf("convertToSRGB %v: pixel %v", convert, got)
+		}
+	}
+
+	// A profile that cannot be converted leaves the pixels and says so
+	cmyk := append([]byte(nil), p3...)
+	copy(cmyk[16:], "CMYK")
+	img := fixtureFlat(8, 8, orange)
+	out, notes := applyColorProfile(img, fixturePNGWithICC(img, cmyk))
+	if out != image.Image(img) || len(notes) != 1 || notes[0].Code != "image.profileNotConverted" {
+		t.Errorf("CMYK profile: notes %+v", notes)
+	}
+	if out, notes := applyColorProfile(img, fixturePNG(img)); out != image.Image(img) || notes != nil {
+		t.Error("untagged image changed")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Leaves data as is; what "auto" falls back to for incompressible input
+const codecStore = "store"
+
+// Below this size container overhead outweighs any saving
+const autoMinSize = 64
+
+// Text larger than this goes to zstd; brotli's better ratio is not worth
+// its time on inputs this big
+const autoBrotliMaxSize = 64 << 20
+
+// Sampled deflate ratios above which data is treated as incompressible,
+// or as low-redundancy data where gzip's portability beats a stronger codec
+const (
+	autoIncompressibleRatio = 0.95
+	autoLowRedundancyRatio  = 0.8
+)
+
+// Options for compressData
+type compressOptions struct {
+	// "gzip", "brotli", "zstd", "lz4", "store" or "auto". lz4 is several
+	// times faster than the others at a worse ratio, for temporary uploads
+	// and local caches. auto picks per input and takes no level.
+	Algorithm string `json:"algorithm"`
+
+	// Codec level (gzip 1-9, brotli 0-11, zstd 1-22); 0 picks the codec
+	// default. lz4 has a single fast level.
+	Level int `json:"level"`
+
+	// zstd window in bytes, a power of two; 0 lets the level decide.
+	// Receivers on phones decode more reliably with 8 MB or less.
+	WindowSize int `json:"windowSize"`
+
+	// Compress in independent blocks of this many bytes (64 KB-64 MB) on
+	// several goroutines and emit a seekable block container; 0 writes a
+	// single stream
+	BlockSize int `json:"blockSize"`
+
+	// Goroutines for block mode; 0 uses one per CPU
+	Workers int `json:"workers"`
+
+	// Store the input instead once gzip, brotli or zstd have been through
+	// more than half of it with under 1% saved; the result's algorithm
+	// then says "store". Not for block mode or streams.
+	EarlyAbort bool `json:"earlyAbort"`
+}
+
+func defaultCompressOptions() compressOptions {
+	return compressOptions{Algorithm: codecGzip}
+}
+
+func (o compressOptions) validate() error {
+	switch o.Algorithm {
+	case codecGzip:
+		if o.Level < 0 || o.Level > 9 {
+			return errors.New("gzip level must be between 1 and 9")
+		}
+	case codecBrotli:
+		if o.Level < 0 || o.Level > 11 {
+			return errors.New("brotli level must be between 0 and 11")
+		}
+	case codecZstd:
+		return validateZstdSettings(o.Level, o.WindowSize)
+	case codecLZ4, codecStore, codecAuto:
+		if o.Level != 0 {
+			return fmt.Errorf("%s takes no compression level", o.Algorithm)
+		}
+	default:
+		return fmt.Errorf("unknown algorithm %q", o.Algorithm)
+	}
+	if o.EarlyAbort && o.BlockSize > 0 {
+		return errors.New("earlyAbort applies to single streams, not blockSize")
+	}
+	if o.WindowSize != 0 {
+		return errors.New("windowSize applies to zstd only")
+	}
+	return nil
+}
+
+// Input fed to the codec between yield checks under earlyAbort
+const earlyAbortChunk = 256 << 10
+
+// A codec writer whose output so far can be measured
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Compress data with opts.Algorithm a chunk at a time, flushing after each
+// so the output so far can be measured, and return data itself once
+// lowYield says the codec is not paying. Returns the algorithm the output
+// is in; codecs other than gzip, brotli and zstd compress as usual.
+func compressWithEarlyAbort(data []byte, opts compressOptions) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var w flushWriter
+	var err error
+	switch opts.Algorithm {
+	case codecGzip:
+		level := opts.Level
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		w, err = gzip.NewWriterLevel(&buf, level)
+	case codecBrotli:
+		level := opts.Level
+		if level == 0 {
+			level = 9
+		}
+		w = brotli.NewWriterLevel(&buf, level)
+	case codecZstd:
+		w, err = zstd.NewWriter(&buf, zstdEncoderOptions(opts.Level, opts.WindowSize)...)
+	default:
+		out, err := compressPayload(data, opts)
+		return out, opts.Algorithm, err
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	for pos := 0; pos < len(data); pos += earlyAbortChunk {
+		if lowYield(pos, pos-buf.Len(), len(data)) {
+			w.Close()
+			fmt.Printf("[WASM] %s saved %d of %d bytes, storing the input instead\n", opts.Algorithm, pos-buf.Len(), pos)
+			return data, codecStore, nil
+		}
+		if _, err := w.Write(data[pos:min(pos+earlyAbortChunk, len(data))]); err != nil {
+			return nil, "", err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), opts.Algorithm, nil
+}
+
+// Compress a whole buffer with the selected algorithm
+func compressPayload(data []byte, opts compressOptions) ([]byte, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	switch opts.Algorithm {
+	case codecZstd:
+		return compressZstd(data, opts.Level, opts.WindowSize)
+	case codecLZ4:
+		return compressLZ4(data), nil
+	case codecStore:
+		return data, nil
+	case codecAuto:
+		out, _, _, err := compressAuto(data)
+		return out, err
+	}
+	return compressWithCodec(data, opts.Algorithm, opts.Level, "")
+}
+
+// Whether the start of data is valid UTF-8 without NUL bytes
+func looksLikeText(data []byte) bool {
+	n := minInt(len(data), 64<<10)
+	if n < len(data) {
+		// Do not cut a multi-byte sequence in half
+		for n > 0 && !utf8.RuneStart(data[n]) {
+			n--
+		}
+	}
+	sample := data[:n]
+	return len(sample) > 0 && utf8.Valid(sample) && !strings.ContainsRune(string(sample), 0)
+}
+
+// Name of the compressed format data is already in, or ""
+func compressedFormat(data []byte) string {
+	switch format := sniffCompression(data); format {
+	case "", codecZlib: // the zlib check is two bytes; text can match it
+	default:
+		return format
+	}
+	switch format := archiveFormat(data); format {
+	case archiveZip, archiveGzip, archiveSevenZip, archiveRar:
+		return format
+	}
+	switch mimeType := sniffMimeType(data); mimeType {
+	case "image/jpeg", "image/png", "image/webp", "image/gif", "image/avif", "image/heic", "image/heif":
+		return strings.TrimPrefix(mimeType, "image/")
+	case "video/mp4", "video/quicktime":
+		return strings.TrimPrefix(mimeType, "video/")
+	case "font/woff", "font/woff2":
+		return strings.TrimPrefix(mimeType, "font/")
+	}
+	return ""
+}
+
+// Pick a codec for "auto" from the sniffed type and a sampled deflate
+// ratio; the reason is reported back to the caller
+func autoSelectCodec(data []byte) (string, string) {
+	if len(data) < autoMinSize {
+		return codecStore, "input too small to benefit"
+	}
+	if format := compressedFormat(data); format != "" {
+		return codecStore, fmt.Sprintf("already compressed (%s)", format)
+	}
+	ratio := sampledDeflateRatio(data)
+	switch {
+	case ratio > autoIncompressibleRatio:
+		return codecStore, fmt.Sprintf("high entropy (sampled ratio %.2f)", ratio)
+	case ratio > autoLowRedundancyRatio:
+		return codecGzip, fmt.Sprintf("low redundancy (sampled ratio %.2f)", ratio)
+	}
+	if looksLikeText(data) {
+		if len(data) > autoBrotliMaxSize {
+			return codecZstd, "large text"
+		}
+		return codecBrotli, "text"
+	}
+	return codecZstd, "binary data"
+}
+
+// Compress with the codec "auto" selects, storing when the result would
+// not be smaller; returns the algorithm used and why
+func compressAuto(data []byte) ([]byte, string, string, error) {
+	algorithm, reason := autoSelectCodec(data)
+	out, err := compressPayload(data, compressOptions{Algorithm: algorithm})
+	if err != nil {
+		return nil, "", "", err
+	}
+	if algorithm != codecStore && len(out) >= len(data) {
+		return data, codecStore, "compression did not reduce size", nil
+	}
+	return out, algorithm, reason, nil
+}
+
+// compressData(data, options?) compresses arbitrary bytes. Options:
+// {algorithm: "gzip" | "brotli" | "zstd" | "lz4" | "store" | "auto", level,
+// windowSize, blockSize, workers, earlyAbort, dataURL, maxDataURLSize,
+// base64}. With
+// blockSize the output is a seekable block container that decompressData
+// reads. data may also be a data: URL string. Resolves with the standard
+// result object plus algorithm, the codec actually used; auto also sets
+// reason. With dataURL or base64 the output is also returned as
+// result.dataURL or result.base64.
+func compressData(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] compressData called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("compressData", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	// A data: URL is decoded first, so its bytes are what gets checked;
+	// other inputs are checked before they are copied
+	var inputBytes []byte
+	var inputErr error
+	head, size := peekJS(args[0], sniffPeekBytes), 0
+	isURL := args[0].Type() == js.TypeString
+	if isURL {
+		inputBytes, _, inputErr = inputFromJS(args[0])
+		head, size = inputBytes, len(inputBytes)
+	} else {
+		size = args[0].Length()
+	}
+	release := func() {}
+	if inputErr == nil {
+		var err error
+		if release, err = admitInput(head, "", size); err != nil {
+			return runAsync("compressData", func() (interface{}, error) {
+				return nil, err
+			})
+		}
+	}
+	if !isURL {
+		inputBytes = bytesFromJS(args[0])
+	}
+	opts := defaultCompressOptions()
+	var urlOpts dataURLOptions
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+		if optsErr == nil {
+			optsErr = decodeOptions(args[1], &urlOpts)
+		}
+	}
+
+	return runAsync("compressData", func() (interface{}, error) {
+		j := startJob("compressData")
+		defer j.finish()
+		defer release()
+		m := newMetrics("data", inputBytes)
+		defer m.send(j.ctx)
+		if inputErr != nil {
+			return nil, inputErr
+		}
+		if optsErr != nil {
+			return nil, optsErr
+		}
+
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		algorithm, reason := opts.Algorithm, ""
+		var out []byte
+		var err error
+		switch {
+		case opts.BlockSize > 0:
+			// auto decides once for the whole input
+			if opts.Algorithm == codecAuto {
+				algorithm, reason = autoSelectCodec(inputBytes)
+				opts.Algorithm = algorithm
+			}
+			out, err = compressBlocks(j.ctx, inputBytes, opts, opts.BlockSize, opts.Workers)
+		case opts.Algorithm == codecAuto:
+			out, algorithm, reason, err = compressAuto(inputBytes)
+		case opts.EarlyAbort:
+			out, algorithm, err = compressWithEarlyAbort(inputBytes, opts)
+		default:
+			out, err = compressPayload(inputBytes, opts)
+		}
+		if err != nil {
+			m.failed(err)
+			return nil, err
+		}
+		fmt.Printf("[WASM] %s: %d -> %d bytes\n", algorithm, len(inputBytes), len(out))
+		m.succeeded(out, algorithm, nil)
+
+		result := newResultObject(inputBytes, out)
+		result.Set("algorithm", algorithm)
+		if reason != "" {
+			result.Set("reason", reason)
+		}
+		urlOpts.apply(result, "application/octet-stream", out)
+		return result, nil
+	})
+}
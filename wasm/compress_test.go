@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestAutoSelectCodec(t *testing.T) {
+	random := make([]byte, 100<<10)
+	rand.New(rand.NewSource(3)).Read(random)
+	text := bytes.Repeat([]byte("auto picks brotli for text like this line\n"), 500)
+
+	for _, c := range []struct {
+		name, codec, reason string
+		data                []byte
+	}{
+		{"tiny", codecStore, "input too small to benefit", []byte("hi")},
+		{"just under the minimum", codecStore, "input too small to benefit", text[:autoMinSize-1]},
+		{"text", codecBrotli, "text", text},
+		{"text that looks like zlib", codecBrotli, "text", bytes.Repeat([]byte("x^2 + y^2 = r^2\n"), 200)},
+		{"binary", codecZstd, "binary data", bytes.Repeat([]byte{0, 1, 2, 3, 200, 0, 0, 9}, 5000)},
+		{"random", codecStore, "high entropy", random},
+		{"gzip", codecStore, "already compressed (gzip)", fixtureGzip(text, "a.txt")},
+		{"zip", codecStore, "already compressed (zip)", fixtureZip()},
+		{"png", codecStore, "already compressed (png)", fixturePNG(fixtureGradient(64, 64))},
+		{"jpeg", codecStore, "already compressed (jpeg)", fixtureJPEG(fixtureGradient(64, 64))},
+		{"lz4", codecStore, "already compressed (lz4)", compressLZ4(text)},
+	} {
+		codec, reason := autoSelectCodec(c.data)
+		if codec != c.codec || !strings.HasPrefix(reason, c.reason) {
+			t.Errorf("%s: %s (%s), want %s (%s)", c.name, codec, reason, c.codec, c.reason)
+		}
+	}
+}
+
+func TestCompressAuto(t *testing.T) {
+	text := bytes.Repeat([]byte("auto round trip line\n"), 1000)
+	binary := bytes.Repeat([]byte{0, 1, 2, 3, 200, 0, 0, 9}, 5000)
+	for _, in := range [][]byte{text, binary} {
+		out, algorithm, _, err := compressAuto(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) >= len(in)/10 {
+			t.Errorf("%s: %d -> %d bytes", algorithm, len(in), len(out))
+		}
+		res, err := decompressStream(out, decompressOptions{Format: algorithm})
+		if err != nil || !bytes.Equal(res.Data, in) {
+			t.Errorf("%s: round trip failed: %v", algorithm, err)
+		}
+	}
+
+	// Stored inputs come back as they are
+	png := fixturePNG(fixtureGradient(64, 64))
+	for _, in := range [][]byte{[]byte("tiny"), png} {
+		out, algorithm, reason, err := compressAuto(in)
+		if err != nil || algorithm != codecStore || reason == "" || !bytes.Equal(out, in) {
+			t.Errorf("%d bytes: %s (%s), %v", len(in), algorithm, reason, err)
+		}
+	}
+}
+
+func TestCompressWithEarlyAbort(t *testing.T) {
+	random := make([]byte, 1<<20)
+	rand.New(rand.NewSource(5)).Read(random)
+	text := []byte(strings.Repeat("early abort keeps compressible data compressed\n", 20000))
+	for _, algorithm := range []string{codecGzip, codecBrotli, codecZstd} {
+		opts := compressOptions{Algorithm: algorithm, EarlyAbort: true}
+		out, used, err := compressWithEarlyAbort(random, opts)
+		if err != nil || used != codecStore || !bytes.Equal(out, random) {
+			t.Errorf("%s on random data: %s, %d bytes, %v", algorithm, used, len(out), err)
+		}
+		out, used, err = compressWithEarlyAbort(text, opts)
+		if err != nil || used != algorithm {
+			t.Fatalf("%s on text: %s, %v", algorithm, used, err)
+		}
+		dopts := defaultDecompressOptions()
+		dopts.Format = algorithm
+		res, err := decompressStream(out, dopts)
+		if err != nil || !bytes.Equal(res.Data, text) {
+			t.Errorf("%s output does not round-trip: %v", algorithm, err)
+		}
+	}
+	if err := (compressOptions{Algorithm: codecGzip, EarlyAbort: true, BlockSize: 1 << 20}).validate(); err == nil {
+		t.Error("earlyAbort accepted with blockSize")
+	}
+}
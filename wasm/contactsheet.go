@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Layout options for makeContactSheet
+type contactSheetOptions struct {
+	Columns   int  `json:"columns"`
+	ThumbSize int  `json:"thumbSize"` // longest thumbnail edge in pixels
+	Gap       int  `json:"gap"`       // spacing between cells in pixels
+	Quality   int  `json:"quality"`   // JPEG quality of the montage
+	Labels    bool `json:"labels"`    // draw each input's name under its thumbnail
+	PDF       bool `json:"pdf"`       // also return a single-page PDF contact sheet
+}
+
+// Widest gap between cells, and the largest montage in pixels; 64
+// megapixels already needs 256MB as RGBA
+const (
+	maxContactSheetGap    = 256
+	maxContactSheetPixels = 64 << 20
+)
+
+func defaultContactSheetOptions() contactSheetOptions {
+	return contactSheetOptions{Columns: 4, ThumbSize: 256, Gap: 8, Quality: 80, Labels: true}
+}
+
+// One input image; Name is optional and only used for labels
+type contactSheetInput struct {
+	Data []byte
+	Name string
+}
+
+// Rendered contact sheet
+type contactSheet struct {
+	JPEG    []byte
+	PDF     []byte
+	Width   int
+	Height  int
+	Skipped []string // inputs that could not be decoded
+}
+
+// Lay out thumbnails of every decodable input on a white grid
+func buildContactSheet(ctx context.Context, inputs []contactSheetInput, opts contactSheetOptions, reportProgress func(int)) (contactSheet, error) {
+	var sheet contactSheet
+	if opts.Columns < 1 {
+		return sheet, errors.New("columns must be at least 1")
+	}
+	if opts.ThumbSize < 16 || opts.ThumbSize > 2048 {
+		return sheet, errors.New("thumbSize must be between 16 and 2048")
+	}
+	if opts.Gap < 0 {
+		opts.Gap = 0
+	}
+	if opts.Gap > maxContactSheetGap {
+		opts.Gap = maxContactSheetGap
+	}
+	if opts.Quality < 1 || opts.Quality > 100 {
+		opts.Quality = 80
+	}
+
+	face := basicfont.Face7x13
+	labelHeight := 0
+	if opts.Labels {
+		labelHeight = face.Height + 4
+	}
+
+	// Every input decoding gives the largest montage; reject it before
+	// spending time on decodes
+	if w, h := contactSheetSize(len(inputs), opts, labelHeight); int64(w)*int64(h) > maxContactSheetPixels {
+		return sheet, fmt.Errorf("%dx%d contact sheet exceeds %d megapixels; use fewer images or a smaller thumbSize", w, h, maxContactSheetPixels>>20)
+	}
+
+	// Decode and shrink every input first so only thumbnails stay in memory
+	var thumbs []image.Image
+	var names []string
+	for i, in := range inputs {
+		if err := checkCancelled(ctx); err != nil {
+			return sheet, err
+		}
+		err := checkDecodeSize(in.Data, maxThumbnailSourcePixels)
+		var img image.Image
+		if err == nil {
+			img, _, err = image.Decode(bytes.NewReader(in.Data))
+		}
+		if err != nil {
+			name := in.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			fmt.Printf("[WASM] Contact sheet: skipping %s: %v\n", name, err)
+			sheet.Skipped = append(sheet.Skipped, name)
+			continue
+		}
+		thumbs = append(thumbs, imaging.Fit(img, opts.ThumbSize, opts.ThumbSize, imaging.Lanczos))
+		names = append(names, in.Name)
+		reportProgress(10 + 70*(i+1)/len(inputs))
+	}
+	if len(thumbs) == 0 {
+		return sheet, errors.New("no decodable images")
+	}
+
+	columns := opts.Columns
+	if columns > len(thumbs) {
+		columns = len(thumbs)
+	}
+	cellW := opts.ThumbSize
+	cellH := opts.ThumbSize + labelHeight
+	sheet.Width, sheet.Height = contactSheetSize(len(thumbs), opts, labelHeight)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, sheet.Width, sheet.Height))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for i, thumb := range thumbs {
+		col, row := i%columns, i/columns
+		cellX := opts.Gap + col*(cellW+opts.Gap)
+		cellY := opts.Gap + row*(cellH+opts.Gap)
+
+		// Center the thumbnail inside its square cell
+		b := thumb.Bounds()
+		x := cellX + (opts.ThumbSize-b.Dx())/2
+		y := cellY + (opts.ThumbSize-b.Dy())/2
+		draw.Draw(canvas, image.Rect(x, y, x+b.Dx(), y+b.Dy()), thumb, b.Min, draw.Over)
+
+		if opts.Labels && names[i] != "" {
+			drawLabel(canvas, face, names[i], cellX, cellY+opts.ThumbSize+face.Ascent+2, cellW)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, canvas, &jpeg.Options{Quality: opts.Quality}); err != nil {
+		return sheet, fmt.Errorf("encode montage: %v", err)
+	}
+	sheet.JPEG = buf.Bytes()
+	reportProgress(90)
+
+	if opts.PDF {
+		// 96 dpi: one pixel is 0.75pt
+		sheet.PDF = imagePagesToPDF([]pdfImagePage{{
+			Data: sheet.JPEG, Filter: "DCTDecode", ColorSpace: "DeviceRGB", BitsPerComponent: 8,
+			Width: sheet.Width, Height: sheet.Height,
+			PageWidth: float64(sheet.Width) * 0.75, PageHeight: float64(sheet.Height) * 0.75,
+		}})
+	}
+
+	fmt.Printf("[WASM] Contact sheet: %d thumbnails, %dx%d, %d bytes\n", len(thumbs), sheet.Width, sheet.Height, len(sheet.JPEG))
+	return sheet, nil
+}
+
+// Montage dimensions for n thumbnails
+func contactSheetSize(n int, opts contactSheetOptions, labelHeight int) (width, height int) {
+	columns := opts.Columns
+	if columns > n {
+		columns = n
+	}
+	if columns < 1 {
+		return 0, 0
+	}
+	rows := (n + columns - 1) / columns
+	width = columns*opts.ThumbSize + (columns+1)*opts.Gap
+	height = rows*(opts.ThumbSize+labelHeight) + (rows+1)*opts.Gap
+	return width, height
+}
+
+// Draw text centered in a cell, truncated with "..." to fit. The basic
+// font only covers ASCII, so no Unicode ellipsis.
+func drawLabel(dst draw.Image, face font.Face, text string, cellX, baseline, cellW int) {
+	d := &font.Drawer{Dst: dst, Src: image.NewUniform(color.Gray{Y: 64}), Face: face}
+	label := text
+	runes := []rune(text)
+	for len(runes) > 0 && d.MeasureString(label).Ceil() > cellW {
+		runes = runes[:len(runes)-1]
+		label = string(runes) + "..."
+	}
+	width := d.MeasureString(label).Ceil()
+	d.Dot = fixed.P(cellX+(cellW-width)/2, baseline)
+	d.DrawString(label)
+}
+
+// makeContactSheet(images, options?, progress?) builds a JPEG montage of
+// thumbnails (and optionally a PDF). images is an array of Uint8Arrays or
+// {data, name} objects.
+func makeContactSheet(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] makeContactSheet called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !js.Global().Get("Array").Call("isArray", args[0]).Bool() {
+		return runAsync("makeContactSheet", func() (interface{}, error) {
+			return nil, errors.New("missing images array")
+		})
+	}
+
+	opts := currentSettings().ContactSheet
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+
+	// Every image is admitted, as one file each, before any is copied
+	imagesArray := args[0]
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for i := 0; i < imagesArray.Length(); i++ {
+		data := imagesArray.Index(i)
+		if data.Type() == js.TypeObject && !data.InstanceOf(js.Global().Get("Uint8Array")) {
+			data = data.Get("data")
+		}
+		if data.Type() != js.TypeObject {
+			continue // skipped as undecodable
+		}
+		r, err := admitInput(peekJS(data, sniffPeekBytes), "", data.Length())
+		if err != nil {
+			release()
+			return runAsync("makeContactSheet", func() (interface{}, error) {
+				return nil, err
+			})
+		}
+		releases = append(releases, r)
+	}
+
+	// Copy inputs now; the JS values must not be touched after returning
+	inputs := make([]contactSheetInput, imagesArray.Length())
+	for i := range inputs {
+		item := imagesArray.Index(i)
+		if item.Type() != js.TypeObject {
+			continue // skipped as undecodable
+		}
+		if item.InstanceOf(js.Global().Get("Uint8Array")) {
+			inputs[i].Data = bytesFromJS(item)
+			continue
+		}
+		if data := item.Get("data"); isSet(data) {
+			inputs[i].Data = bytesFromJS(data)
+		}
+		if name := item.Get("name"); isSet(name) {
+			inputs[i].Name = name.String()
+		}
+	}
+
+	return runAsync("makeContactSheet", func() (interface{}, error) {
+		j := startJob("contactSheet")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		reportProgress := progressReporter(progressCallback, j)
+
+		sheet, err := buildContactSheet(j.ctx, inputs, opts, reportProgress)
+		if err != nil {
+			return nil, err
+		}
+
+		result := js.Global().Get("Object").New()
+		result.Set("data", bytesToJS(sheet.JPEG))
+		result.Set("type", "image/jpeg")
+		result.Set("width", sheet.Width)
+		result.Set("height", sheet.Height)
+		if sheet.PDF != nil {
+			result.Set("pdf", bytesToJS(sheet.PDF))
+		}
+		result.Set("skipped", stringsToJS(sheet.Skipped))
+		reportProgress(100)
+		return result, nil
+	})
+}
@@ -0,0 +1,83 @@
+//go:build js
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// A PNG whose header claims width x height pixels; only the header is
+// valid, which is all DecodeConfig reads
+func hugePNGHeader(width, height uint32) []byte {
+	data := fixturePNG(fixtureGradient(8, 8))
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func TestContactSheetSkipsOversizedImages(t *testing.T) {
+	if err := checkDecodeSize(hugePNGHeader(60000, 60000), maxThumbnailSourcePixels); err == nil {
+		t.Error("a 3.6-gigapixel header passed the size check")
+	}
+	small := fixturePNG(fixtureGradient(64, 48))
+	if err := checkDecodeSize(small, maxThumbnailSourcePixels); err != nil {
+		t.Error(err)
+	}
+	inputs := []contactSheetInput{{Data: small, Name: "small"}, {Data: hugePNGHeader(60000, 60000), Name: "bomb"}}
+	sheet, err := buildContactSheet(context.Background(), inputs, defaultContactSheetOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sheet.Skipped) != 1 || sheet.Skipped[0] != "bomb" {
+		t.Errorf("skipped %v, want [bomb]", sheet.Skipped)
+	}
+}
+
+func TestMakeContactSheetRejectsInsteadOfPanicking(t *testing.T) {
+	if _, err := awaitJS(makeContactSheet(js.Undefined(), []js.Value{js.ValueOf(5)}).(js.Value)); err == nil {
+		t.Error("a number as the images array was accepted")
+	}
+
+	images := js.Global().Get("Array").New(js.ValueOf(5), bytesToJS(fixturePNG(fixtureGradient(64, 48))))
+	result, err := awaitJS(makeContactSheet(js.Undefined(), []js.Value{images}).(js.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped := result.Get("skipped").Length(); skipped != 1 {
+		t.Errorf("%d inputs skipped, want the number only", skipped)
+	}
+}
+
+func TestContactSheetLimitsCanvasSize(t *testing.T) {
+	small := fixturePNG(fixtureGradient(64, 48))
+
+	// A huge gap is clamped rather than allocated
+	opts := defaultContactSheetOptions()
+	opts.Gap = 1 << 30
+	sheet, err := buildContactSheet(context.Background(), []contactSheetInput{{Data: small}}, opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := opts.ThumbSize + 2*maxContactSheetGap; sheet.Width != want {
+		t.Errorf("width %d, want %d", sheet.Width, want)
+	}
+
+	// 1000 inputs at the largest thumbSize fail before any decoding
+	opts = defaultContactSheetOptions()
+	opts.ThumbSize = 2048
+	inputs := make([]contactSheetInput, 1000)
+	for i := range inputs {
+		inputs[i].Data = small
+	}
+	decoded := false
+	if _, err := buildContactSheet(context.Background(), inputs, opts, func(int) { decoded = true }); err == nil || decoded {
+		t.Errorf("oversized layout: decoded %v, err %v", decoded, err)
+	}
+}
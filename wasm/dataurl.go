@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Longest data: URL returned unless the caller raises it; beyond this
+// they bloat documents and many mail clients drop them
+const dataURLDefaultMaxSize = 2 << 20
+
+// Options for entry points that can also return their output as a data:
+// URL, for editors and composers that embed rather than upload, or as
+// base64 for JSON APIs
+type dataURLOptions struct {
+	DataURL        bool `json:"dataURL"`
+	MaxDataURLSize int  `json:"maxDataURLSize"` // characters
+	Base64         bool `json:"base64"`
+}
+
+// Decode base64 as pasted from anywhere: standard or URL-safe alphabet,
+// with or without padding, wrapped across lines
+func decodeBase64Loose(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		case '-':
+			return '+'
+		case '_':
+			return '/'
+		}
+		return r
+	}, s)
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %v", err)
+	}
+	return data, nil
+}
+
+// Split a data: URL into its media type and decoded payload. The media
+// type defaults to text/plain as RFC 2397 specifies.
+func parseDataURL(s string) (string, []byte, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 5 || !strings.EqualFold(s[:5], "data:") {
+		return "", nil, errors.New("not a data: URL")
+	}
+	header, payload, ok := strings.Cut(s[5:], ",")
+	if !ok {
+		return "", nil, errors.New("data: URL has no payload")
+	}
+	params := strings.Split(header, ";")
+	mimeType := strings.ToLower(strings.TrimSpace(params[0]))
+	if mimeType == "" {
+		mimeType = "text/plain"
+	}
+	isBase64 := strings.EqualFold(strings.TrimSpace(params[len(params)-1]), "base64")
+
+	if isBase64 {
+		// Some encoders percent-escape the padding
+		if strings.Contains(payload, "%") {
+			if unescaped, err := url.PathUnescape(payload); err == nil {
+				payload = unescaped
+			}
+		}
+		data, err := decodeBase64Loose(payload)
+		return mimeType, data, err
+	}
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid data: URL escape: %v", err)
+	}
+	return mimeType, []byte(data), nil
+}
+
+func formatDataURL(mimeType string, data []byte) string {
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// Bytes of an input argument given as a Uint8Array or a data: URL string,
+// with the URL's media type ("" for raw bytes)
+func inputFromJS(v js.Value) ([]byte, string, error) {
+	if v.Type() != js.TypeString {
+		return bytesFromJS(v), "", nil
+	}
+	mimeType, data, err := parseDataURL(v.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("string input must be a data: URL: %v", err)
+	}
+	return data, mimeType, nil
+}
+
+// Add result.base64 and result.dataURL if requested; a data URL over the
+// size limit is replaced by a warning
+func (o dataURLOptions) apply(result js.Value, mimeType string, data []byte) {
+	if o.Base64 {
+		result.Set("base64", base64.StdEncoding.EncodeToString(data))
+	}
+	if !o.DataURL {
+		return
+	}
+	limit := o.MaxDataURLSize
+	if limit <= 0 {
+		limit = dataURLDefaultMaxSize
+	}
+	size := len("data:"+mimeType+";base64,") + base64.StdEncoding.EncodedLen(len(data))
+	if size > limit {
+		appendMessage(result, newMessage("image.dataURLTooLarge", "size", size, "limit", limit))
+		return
+	}
+	result.Set("dataURL", formatDataURL(mimeType, data))
+}
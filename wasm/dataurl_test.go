@@ -0,0 +1,93 @@
+//go:build js
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestParseDataURL(t *testing.T) {
+	for _, c := range []struct {
+		in, mimeType, data string
+	}{
+		{"data:,Hello%2C%20World", "text/plain", "Hello, World"},
+		{"data:text/plain;charset=utf-8,caf%C3%A9", "text/plain", "café"},
+		{"DATA:IMAGE/PNG;BASE64,aGk=", "image/png", "hi"},
+		{"  data:image/gif;base64,aGk  \n", "image/gif", "hi"},
+		{"data:image/png;base64,aGk%3D", "image/png", "hi"}, // escaped padding
+		{"data:;base64,aGk=", "text/plain", "hi"},
+	} {
+		mimeType, data, err := parseDataURL(c.in)
+		if err != nil || mimeType != c.mimeType || string(data) != c.data {
+			t.Errorf("%q: %s %q, %v", c.in, mimeType, data, err)
+		}
+	}
+	for _, in := range []string{"hello", "data:image/png;base64", "data:image/png;base64,!!!", "data:,100%"} {
+		if _, _, err := parseDataURL(in); err == nil {
+			t.Errorf("%q accepted", in)
+		}
+	}
+}
+
+func TestDecodeBase64Loose(t *testing.T) {
+	want := []byte("hello world\xff\xfe")
+	for _, in := range []string{
+		"aGVsbG8gd29ybGT//g==", // standard
+		"aGVsbG8gd29ybGT__g",   // URL-safe, no padding
+		"aGVsbG8g\r\nd29y bGT/\t/g==",
+	} {
+		if data, err := decodeBase64Loose(in); err != nil || !bytes.Equal(data, want) {
+			t.Errorf("%q: %q, %v", in, data, err)
+		}
+	}
+	if _, err := decodeBase64Loose("not base64!"); err == nil {
+		t.Error("invalid base64 accepted")
+	}
+}
+
+func TestDataURLInputAndOutput(t *testing.T) {
+	png := fixturePNG(fixtureGradient(120, 80))
+	u := "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+
+	// An image given as a data: URL takes its type from the URL and comes
+	// back as one
+	opts := js.Global().Get("JSON").Call("parse", `{"dataURL":true}`)
+	res, err := awaitJS(compressImage(js.Undefined(), []js.Value{js.ValueOf(u), js.ValueOf(""), js.Undefined(), opts}).(js.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mimeType, data, err := parseDataURL(res.Get("dataURL").String())
+	if err != nil || !strings.HasPrefix(mimeType, "image/") || len(data) != res.Get("compressedSize").Int() || res.Get("originalSize").Int() != len(png) {
+		t.Errorf("image data URL: %s, %d bytes, %v", mimeType, len(data), err)
+	}
+
+	// Over maxDataURLSize the URL is left out with a warning
+	text := strings.Repeat("hello%20world%20", 50)
+	opts = js.Global().Get("JSON").Call("parse", `{"dataURL":true,"maxDataURLSize":1000,"algorithm":"gzip"}`)
+	res, err = awaitJS(compressData(js.Undefined(), []js.Value{js.ValueOf("data:," + text), opts}).(js.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err = parseDataURL(res.Get("dataURL").String())
+	if err != nil || !bytes.Equal(decompressText(t, data, codecGzip), bytes.Repeat([]byte("hello world "), 50)) {
+		t.Errorf("data URL output does not decode: %v", err)
+	}
+	opts.Set("maxDataURLSize", 10)
+	res, err = awaitJS(compressData(js.Undefined(), []js.Value{js.ValueOf("data:," + text), opts}).(js.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isSet(res.Get("dataURL")) || res.Get("messages").Length() != 1 || res.Get("messages").Index(0).Get("code").String() != "image.dataURLTooLarge" {
+		t.Errorf("oversized data URL: %s", js.Global().Get("JSON").Call("stringify", res.Get("messages")).String())
+	}
+
+	// Strings that are not data: URLs are refused rather than compressed
+	if _, err := awaitJS(compressData(js.Undefined(), []js.Value{js.ValueOf("plain"), opts}).(js.Value)); err == nil {
+		t.Error("plain string accepted as input")
+	}
+}
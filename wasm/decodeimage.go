@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/webp"
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Largest image, in pixels, decoded for a thumbnail; a 100-megapixel
+// image already needs 400MB as RGBA
+const maxThumbnailSourcePixels = 100 << 20
+
+// Reject an image whose header declares more than maxPixels pixels, before
+// decoding allocates for it. Formats image.DecodeConfig does not know are
+// let through for the decoder to judge.
+func checkDecodeSize(data []byte, maxPixels int) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxPixels/cfg.Height {
+		return fmt.Errorf("%dx%d image is too large to decode", cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// Decode a still image of any supported input format, sniffed from the
+// bytes. WebP is decoded in Go; AVIF and HEIC have no Go decoder, so they
+// go through the browser's own (see decodeWithBrowser), which only decodes
+// a HEIF file's primary image.
+func decodeStillImage(data []byte) (image.Image, error) {
+	switch sniffMimeType(data) {
+	case "image/avif", "image/heic", "image/heif":
+		return decodeWithBrowser(data, sniffMimeType(data))
+	case "image/webp":
+		return webp.Decode(bytes.NewReader(data))
+	case "image/vnd.adobe.photoshop":
+		return decodePSDComposite(data)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// Decode through createImageBitmap and an OffscreenCanvas, which every
+// browser with AVIF support has, workers included. ImageData is
+// non-premultiplied RGBA, the layout of image.NRGBA. Must run off the
+// event loop, like awaitJS.
+func decodeWithBrowser(data []byte, mimeType string) (image.Image, error) {
+	global := js.Global()
+	if global.Get("createImageBitmap").Type() != js.TypeFunction || !isSet(global.Get("OffscreenCanvas")) {
+		return nil, fmt.Errorf("decoding %s needs createImageBitmap and OffscreenCanvas", mimeType)
+	}
+	parts := global.Get("Array").New(1)
+	parts.SetIndex(0, bytesToJS(data))
+	blobOptions := global.Get("Object").New()
+	blobOptions.Set("type", mimeType)
+	blob := global.Get("Blob").New(parts, blobOptions)
+
+	bitmap, err := awaitJS(global.Call("createImageBitmap", blob))
+	if err != nil {
+		return nil, fmt.Errorf("browser could not decode %s: %v", mimeType, err)
+	}
+	defer bitmap.Call("close")
+	w, h := bitmap.Get("width").Int(), bitmap.Get("height").Int()
+	if w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("browser decoded an empty %s image", mimeType)
+	}
+
+	canvas := global.Get("OffscreenCanvas").New(w, h)
+	ctx := canvas.Call("getContext", "2d")
+	if !isSet(ctx) {
+		return nil, errors.New("no 2d context on OffscreenCanvas")
+	}
+	ctx.Call("drawImage", bitmap, 0, 0)
+	pixels := ctx.Call("getImageData", 0, 0, w, h).Get("data")
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	js.CopyBytesToGo(img.Pix, global.Get("Uint8Array").New(pixels.Get("buffer"), pixels.Get("byteOffset"), pixels.Get("length")))
+	return img, nil
+}
+
+// Options for convertImage
+type convertOptions struct {
+	Format       string `json:"format"`       // "jpeg" or "png"
+	Quality      int    `json:"quality"`      // JPEG quality
+	MaxDimension int    `json:"maxDimension"` // 0 keeps the size
+	Background   string `json:"background"`   // "#rrggbb" under transparent pixels in JPEG output
+}
+
+func defaultConvertOptions() convertOptions {
+	return convertOptions{Format: "jpeg", Quality: 90, Background: "#ffffff"}
+}
+
+func (o convertOptions) validate() error {
+	switch o.Format {
+	case "jpeg", "png":
+	default:
+		return fmt.Errorf("unknown output format %q", o.Format)
+	}
+	if err := checkQualityLadder([]int{o.Quality}); err != nil {
+		return err
+	}
+	if o.MaxDimension < 0 {
+		return errors.New("maxDimension must not be negative")
+	}
+	if _, err := parseHexColor(o.Background); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseHexColor(s string) (color.NRGBA, error) {
+	var c color.NRGBA
+	if len(s) != 7 || s[0] != '#' {
+		return c, fmt.Errorf("invalid color %q, want #rrggbb", s)
+	}
+	if _, err := fmt.Sscanf(strings.ToLower(s[1:]), "%02x%02x%02x", &c.R, &c.G, &c.B); err != nil {
+		return c, fmt.Errorf("invalid color %q, want #rrggbb", s)
+	}
+	c.A = 0xFF
+	return c, nil
+}
+
+// Re-encode an image in a format older tools accept, downscaling first if
+// asked. JPEG has no alpha channel, so transparent pixels are composited
+// over the background color.
+func convertImageData(data []byte, opts convertOptions) ([]byte, image.Rectangle, error) {
+	img, err := decodeStillImage(data)
+	if err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("Failed to decode image: %v", err)
+	}
+	src := newEncodeSource(img, opts.MaxDimension, newTimeBudget(0))
+
+	buf := new(bytes.Buffer)
+	switch opts.Format {
+	case "png":
+		err = png.Encode(buf, src.img)
+	default:
+		var pixels image.Image
+		if hasTransparency(src.img) {
+			background, _ := parseHexColor(opts.Background)
+			b := src.img.Bounds()
+			flat := image.NewRGBA(b)
+			draw.Draw(flat, b, image.NewUniform(background), image.Point{}, draw.Src)
+			draw.Draw(flat, b, src.img, b.Min, draw.Over)
+			pixels = flat
+		} else {
+			pixels = src.jpegPixels()
+		}
+		err = jpeg.Encode(buf, pixels, &jpeg.Options{Quality: opts.Quality})
+	}
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	return buf.Bytes(), src.img.Bounds(), nil
+}
+
+// convertImage(data, options?) decodes a JPEG, PNG, WebP, AVIF, GIF, BMP
+// or PSD (its flattened composite) image and re-encodes it as JPEG or PNG for tools that do not accept
+// modern formats. Options: {format: "jpeg" | "png", quality, maxDimension,
+// background}. AVIF is decoded by the browser and needs createImageBitmap
+// and OffscreenCanvas. Resolves with the standard result object plus type,
+// width and height. Outputs are not tagged, so they can be compressed
+// afterwards.
+func convertImage(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] convertImage called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("convertImage", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("convertImage", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := defaultConvertOptions()
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+	policy := currentPolicy()
+
+	return runAsync("convertImage", func() (interface{}, error) {
+		j := startJob("convertImage")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		inputType := policyInputType(inputBytes, "")
+		violations := policy.checkInput(inputType)
+		if err := policy.enforce(violations); err != nil {
+			return nil, err
+		}
+		out, bounds, err := convertImageData(inputBytes, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCancelled(j.ctx); err != nil {
+			return nil, err
+		}
+		out = policy.finishImage(out)
+		violations = append(violations, policy.checkOutput(inputType, out, nil)...)
+		if err := policy.enforce(violations); err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Converted %s to %s: %dx%d, %d -> %d bytes\n",
+			sniffMimeType(inputBytes), opts.Format, bounds.Dx(), bounds.Dy(), len(inputBytes), len(out))
+
+		result := newResultObject(inputBytes, out)
+		result.Set("type", "image/"+opts.Format)
+		result.Set("width", bounds.Dx())
+		result.Set("height", bounds.Dy())
+		setPolicyViolations(result, violations)
+		return result, nil
+	})
+}
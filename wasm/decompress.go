@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ulikunitz/xz"
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Stream formats understood by decompressData, beyond codecGzip and
+// codecBrotli
+const (
+	codecAuto    = "auto"
+	codecZlib    = "zlib"
+	codecDeflate = "deflate" // raw, no header
+	codecBzip2   = "bzip2"
+	codecXz      = "xz"
+)
+
+// Default cap on decompressed output, a guard against decompression bombs
+const defaultMaxDecompressed = 1 << 30
+
+// Options for decompressData
+type decompressOptions struct {
+	// Input format; "auto" sniffs gzip, zstd, lz4, zlib, bzip2, xz and
+	// compressData's block container.
+	// Brotli and raw deflate have no magic bytes and must be named.
+	Format string `json:"format"`
+
+	// Largest output accepted, in bytes; 0 uses the default
+	MaxOutput int64 `json:"maxOutput"`
+
+	// Largest zstd window the decoder may allocate, in bytes; 0 uses the
+	// 32 MB default. Inputs that ask for more are refused.
+	MaxWindow int64 `json:"maxWindow"`
+}
+
+func defaultDecompressOptions() decompressOptions {
+	return decompressOptions{Format: codecAuto, MaxOutput: defaultMaxDecompressed}
+}
+
+type decompressResult struct {
+	Data     []byte
+	Format   string
+	Members  int  // gzip members decoded
+	Blocked  bool // every member carries a BGZF block size
+	Warnings []message
+}
+
+var gzipMagic = []byte{0x1F, 0x8B}
+
+// Guess the stream format from its first bytes
+func sniffCompression(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return codecGzip
+	case bytes.HasPrefix(data, zstdMagic):
+		return codecZstd
+	case isSeekable(data):
+		return codecSeekable
+	case len(data) >= 4 && (binary.LittleEndian.Uint32(data) == lz4FrameMagic || binary.LittleEndian.Uint32(data) == lz4LegacyMagic):
+		return codecLZ4
+	case bytes.HasPrefix(data, []byte("BZh")):
+		return codecBzip2
+	case bytes.HasPrefix(data, []byte("\xFD7zXZ\x00")):
+		return codecXz
+	case len(data) >= 2 && data[0]&0x0F == 8 && data[0]>>4 <= 7 && binary.BigEndian.Uint16(data)%31 == 0:
+		return codecZlib
+	}
+	return ""
+}
+
+// Whether a gzip extra field holds the BGZF "BC" subfield with the
+// compressed block size
+func isBGZFExtra(extra []byte) bool {
+	for len(extra) >= 4 {
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			return false
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && size == 2 {
+			return true
+		}
+		extra = extra[4+size:]
+	}
+	return false
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy at most limit bytes, failing when the source holds more
+func copyLimited(dst *bytes.Buffer, r io.Reader, limit int64) error {
+	if _, err := io.Copy(dst, io.LimitReader(r, limit-int64(dst.Len())+1)); err != nil {
+		return err
+	}
+	if int64(dst.Len()) > limit {
+		return fmt.Errorf("decompressed size exceeds the %d byte limit", limit)
+	}
+	return nil
+}
+
+// Decode every member of a gzip file. Concatenated members (cat a.gz b.gz,
+// bgzip blocks, rotated logs) are joined in order; zero padding after the
+// last member is tolerated, other trailing bytes end decoding with a
+// warning.
+func decompressGzipMembers(data []byte, limit int64) (decompressResult, error) {
+	res := decompressResult{Format: codecGzip, Blocked: true}
+	br := bytes.NewReader(data)
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return res, fmt.Errorf("invalid gzip: %v", err)
+	}
+	var out bytes.Buffer
+	for {
+		// One member at a time, so the reader stops at each boundary
+		zr.Multistream(false)
+		if !isBGZFExtra(zr.Header.Extra) {
+			res.Blocked = false
+		}
+		if err := copyLimited(&out, zr, limit); err != nil {
+			return res, fmt.Errorf("gzip member %d: %v", res.Members+1, err)
+		}
+		res.Members++
+
+		rest := data[len(data)-br.Len():]
+		if len(rest) == 0 {
+			break
+		}
+		if !bytes.HasPrefix(rest, gzipMagic) {
+			if !allZero(rest) {
+				res.Warnings = append(res.Warnings, newMessage("gzip.trailingBytes", "bytes", len(rest), "member", res.Members))
+			}
+			break
+		}
+		if err := zr.Reset(br); err != nil {
+			return res, fmt.Errorf("gzip member %d: %v", res.Members+1, err)
+		}
+	}
+	res.Data = out.Bytes()
+	return res, nil
+}
+
+// Decompress data in the given or sniffed format
+func decompressStream(data []byte, opts decompressOptions) (decompressResult, error) {
+	limit := opts.MaxOutput
+	if limit <= 0 {
+		limit = defaultMaxDecompressed
+	}
+	format := opts.Format
+	if format == "" || format == codecAuto {
+		if format = sniffCompression(data); format == "" {
+			return decompressResult{}, errors.New("unrecognized compression format; pass format for brotli or raw deflate")
+		}
+	}
+
+	var r io.Reader
+	switch format {
+	case codecGzip:
+		return decompressGzipMembers(data, limit)
+	case codecZstd:
+		out, err := decompressZstd(data, opts.MaxWindow, limit)
+		if err != nil {
+			return decompressResult{}, err
+		}
+		return decompressResult{Data: out, Format: format}, nil
+	case codecSeekable:
+		out, err := decompressSeekable(data, limit)
+		if err != nil {
+			return decompressResult{}, err
+		}
+		return decompressResult{Data: out, Format: format}, nil
+	case codecLZ4:
+		out, err := decompressLZ4(data, limit)
+		if err != nil {
+			return decompressResult{}, err
+		}
+		return decompressResult{Data: out, Format: format}, nil
+	case codecZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return decompressResult{}, fmt.Errorf("invalid zlib: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	case codecDeflate:
+		fr := flate.NewReader(bytes.NewReader(data))
+		defer fr.Close()
+		r = fr
+	case codecBrotli:
+		r = brotli.NewReader(bytes.NewReader(data))
+	case codecBzip2:
+		r = bzip2.NewReader(bytes.NewReader(data))
+	case codecXz:
+		xr, err := xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return decompressResult{}, fmt.Errorf("invalid xz: %v", err)
+		}
+		r = xr
+	default:
+		return decompressResult{}, fmt.Errorf("unknown format %q", format)
+	}
+
+	var out bytes.Buffer
+	if err := copyLimited(&out, r, limit); err != nil {
+		return decompressResult{}, fmt.Errorf("%s: %v", format, err)
+	}
+	return decompressResult{Data: out.Bytes(), Format: format}, nil
+}
+
+// decompressData(data, options?) decodes a gzip, zstd, lz4, zlib, raw
+// deflate, brotli, bzip2 or xz stream. Options: {format, maxOutput, maxWindow}.
+// zstd frames needing a window above maxWindow are rejected. Multi-member
+// gzip files, including bgzip (BGZF) blocked files, are decoded member by
+// member. Resolves with {data, format, originalSize, decompressedSize,
+// members, blocked, warnings}.
+func decompressData(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] decompressData called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("decompressData", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("decompressData", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := defaultDecompressOptions()
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+
+	return runAsync("decompressData", func() (interface{}, error) {
+		j := startJob("decompressData")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+
+		res, err := decompressStream(inputBytes, opts)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] %s decompressed: %d -> %d bytes, %d members\n", res.Format, len(inputBytes), len(res.Data), res.Members)
+
+		result := js.Global().Get("Object").New()
+		result.Set("data", bytesToJS(res.Data))
+		result.Set("format", res.Format)
+		result.Set("originalSize", len(inputBytes))
+		result.Set("decompressedSize", len(res.Data))
+		if res.Format == codecGzip {
+			result.Set("members", res.Members)
+			result.Set("blocked", res.Blocked)
+		}
+		setMessages(result, res.Warnings)
+		return result, nil
+	})
+}
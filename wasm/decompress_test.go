@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"strings"
+	"testing"
+)
+
+// The empty block bgzip writes at the end of every file
+var bgzfEOF = []byte{
+	0x1F, 0x8B, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1B, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// One gzip member, with the BGZF "BC" subfield when blocked
+func fixtureGzipMember(data string, blocked bool) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if blocked {
+		zw.Extra = []byte{'B', 'C', 2, 0, 0, 0} // block size is not checked
+	}
+	zw.Write([]byte(data))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestDecompressGzipMembers(t *testing.T) {
+	a, b := fixtureGzipMember("hello ", false), fixtureGzipMember("world", false)
+	blockA, blockB := fixtureGzipMember("block one ", true), fixtureGzipMember("block two", true)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		want    string
+		members int
+		blocked bool
+		warning string
+	}{
+		{"single member", a, "hello ", 1, false, ""},
+		{"concatenated", join(a, b), "hello world", 2, false, ""},
+		{"zero padding", join(a, b, make([]byte, 512)), "hello world", 2, false, ""},
+		{"trailing garbage", join(a, b, []byte("junk")), "hello world", 2, false, "gzip.trailingBytes"},
+		{"empty member", join(a, fixtureGzipMember("", false), b), "hello world", 3, false, ""},
+		{"BGZF", join(blockA, blockB, bgzfEOF), "block one block two", 3, true, ""},
+		{"BGZF EOF only", bgzfEOF, "", 1, true, ""},
+		{"BGZF then plain", join(blockA, b), "block one world", 2, false, ""},
+	} {
+		res, err := decompressStream(c.data, defaultDecompressOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if string(res.Data) != c.want || res.Format != codecGzip || res.Members != c.members || res.Blocked != c.blocked {
+			t.Errorf("%s: %q as %s, %d members, blocked %v", c.name, res.Data, res.Format, res.Members, res.Blocked)
+		}
+		if c.warning == "" && len(res.Warnings) != 0 || c.warning != "" && (len(res.Warnings) != 1 || res.Warnings[0].Code != c.warning) {
+			t.Errorf("%s: warnings %+v, want %q", c.name, res.Warnings, c.warning)
+		}
+	}
+
+	// A member cut short fails, naming which one
+	cut := join(a, b[:len(b)-6])
+	if _, err := decompressStream(cut, defaultDecompressOptions()); err == nil || !strings.Contains(err.Error(), "gzip member 2") {
+		t.Errorf("truncated second member: %v", err)
+	}
+
+	// The output limit covers all members together
+	opts := defaultDecompressOptions()
+	opts.MaxOutput = 8
+	if _, err := decompressStream(join(a, b), opts); err == nil || !strings.Contains(err.Error(), "8 byte limit") {
+		t.Errorf("limit across members: %v", err)
+	}
+}
+
+func TestDecompressFormats(t *testing.T) {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte("zlib data"))
+	zw.Close()
+	res, err := decompressStream(z.Bytes(), defaultDecompressOptions())
+	if err != nil || res.Format != codecZlib || string(res.Data) != "zlib data" {
+		t.Errorf("zlib: %q as %s, %v", res.Data, res.Format, err)
+	}
+
+	for in, want := range map[string]string{
+		"\x1F\x8B\x08": codecGzip, "BZh9": codecBzip2, "\xFD7zXZ\x00": codecXz, "\x78\x9C": codecZlib, "plain text": "",
+	} {
+		if got := sniffCompression([]byte(in)); got != want {
+			t.Errorf("%q sniffed as %q, want %q", in, got, want)
+		}
+	}
+	if _, err := decompressStream([]byte("plain text"), defaultDecompressOptions()); err == nil {
+		t.Error("unknown format decoded")
+	}
+}
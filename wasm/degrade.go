@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Host features that may have to be switched off in this environment
+const (
+	featureParallel   = "parallel"   // several workers sharing memory
+	featureBatch      = "batch"      // long multi-file runs
+	featureBackground = "background" // work that runs while the user does something else
+	featureStreams    = "streams"    // createCompressionTransform and friends
+)
+
+// A feature the host should disable or hide, and why
+type degradedFeature struct {
+	Feature string `json:"feature"`
+	Reason  string `json:"reason"`
+}
+
+// What init learns about the environment
+type environmentFacts struct {
+	InWorker            bool
+	HasTimers           bool // setTimeout, which lets sleeping goroutines resume
+	SharedArrayBuffer   bool
+	CrossOriginIsolated bool
+	TransformStream     bool
+	DeviceMemoryGB      float64 // 0 when the browser does not say
+}
+
+func readEnvironmentFacts() environmentFacts {
+	global := js.Global()
+	facts := environmentFacts{
+		HasTimers:           global.Get("setTimeout").Type() == js.TypeFunction,
+		SharedArrayBuffer:   isSet(global.Get("SharedArrayBuffer")),
+		CrossOriginIsolated: global.Get("crossOriginIsolated").Truthy(),
+		TransformStream:     isSet(global.Get("TransformStream")),
+	}
+	if scope := global.Get("WorkerGlobalScope"); scope.Type() == js.TypeFunction {
+		facts.InWorker = global.InstanceOf(scope)
+	}
+	if nav := global.Get("navigator"); isSet(nav) {
+		if v := nav.Get("deviceMemory"); v.Type() == js.TypeNumber {
+			facts.DeviceMemoryGB = v.Float()
+		}
+	}
+	return facts
+}
+
+// Features to turn off given the facts
+func degradedFeaturesFor(f environmentFacts) []degradedFeature {
+	var out []degradedFeature
+	add := func(feature, reason string) {
+		out = append(out, degradedFeature{Feature: feature, Reason: reason})
+	}
+
+	// Go runs every goroutine on the JS thread and only yields to the
+	// event loop through timers
+	if !f.HasTimers {
+		add(featureBackground, "no setTimeout: jobs cannot yield, so one call blocks all others")
+		add(featureBatch, "no setTimeout: a batch blocks every other call until it ends")
+	} else if !f.InWorker {
+		add(featureBackground, "running on the page's main thread: long jobs freeze the UI")
+	}
+
+	switch {
+	case !f.SharedArrayBuffer:
+		add(featureParallel, "SharedArrayBuffer is not available")
+	case !f.CrossOriginIsolated:
+		add(featureParallel, "page is not cross-origin isolated, so SharedArrayBuffer cannot be shared")
+	}
+
+	if !f.TransformStream {
+		add(featureStreams, "TransformStream is not available")
+	}
+
+	if f.DeviceMemoryGB > 0 && f.DeviceMemoryGB < 2 {
+		reason := fmt.Sprintf("%.1f GB of device memory leaves about %d MB for this tab",
+			f.DeviceMemoryGB, int(tabMemoryBudget(f.DeviceMemoryGB))>>20)
+		add(featureBatch, reason)
+		if f.SharedArrayBuffer && f.CrossOriginIsolated {
+			add(featureParallel, reason)
+		}
+	}
+	return out
+}
+
+// Detected once at init and published as the global degradedFeatures
+var degradedFeatures []degradedFeature
+
+func publishDegradedFeatures() {
+	degradedFeatures = append([]degradedFeature{}, degradedFeaturesFor(readEnvironmentFacts())...)
+	for _, d := range degradedFeatures {
+		fmt.Printf("[WASM] Degraded: %s (%s)\n", d.Feature, d.Reason)
+	}
+	if v, err := jsonToJS(degradedFeatures); err == nil {
+		js.Global().Set("degradedFeatures", v)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDegraded(t *testing.T) {
+	full := environmentFacts{InWorker: true, HasTimers: true, SharedArrayBuffer: true, CrossOriginIsolated: true, TransformStream: true, DeviceMemoryGB: 8}
+	if d := degradedFeaturesFor(full); len(d) != 0 {
+		t.Fatalf("capable environment degraded: %v", d)
+	}
+	small := full
+	small.InWorker, small.CrossOriginIsolated, small.DeviceMemoryGB = false, false, 1
+	got := map[string]bool{}
+	for _, d := range degradedFeaturesFor(small) {
+		got[d.Feature] = true
+	}
+	for _, feature := range []string{featureBackground, featureParallel, featureBatch} {
+		if !got[feature] {
+			t.Fatalf("%s not reported as degraded", feature)
+		}
+	}
+}
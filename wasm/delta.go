@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Binary delta written by diffCompress:
+//
+//	header  "FZDL" version:u8 reserved:u8*3
+//	        oldSize:u64 oldCRC:u32 newSize:u64 newCRC:u32
+//	ops     zstd-compressed instruction stream
+//
+// Each instruction is a uvarint tag; the low bit selects copy (1) or add
+// (0) and the rest is the length. A copy is followed by a zigzag varint
+// offset relative to the end of the previous copy, an add by its literal
+// bytes. CRCs are IEEE crc32 of the whole old and new files.
+const (
+	deltaMagic     = "FZDL"
+	deltaVersion   = 1
+	deltaHeaderLen = 32
+
+	deltaWindow   = 16 // bytes hashed per index entry
+	deltaStride   = 8  // old data is indexed every deltaStride bytes
+	deltaMinMatch = 24 // shorter copies cost more than the literals
+)
+
+// Window for the instruction stream, so patches decode under the default
+// zstd limit whatever their size
+const deltaZstdWindow = 8 << 20
+
+type deltaStats struct {
+	Copied int64 // bytes reused from the old version
+	Added  int64 // literal bytes carried in the delta
+	Copies int
+}
+
+func deltaHash(data []byte, shift uint) uint64 {
+	a := binary.LittleEndian.Uint64(data)
+	b := binary.LittleEndian.Uint64(data[8:])
+	return (a*0x9E3779B97F4A7C15 ^ b*0xC2B2AE3D27D4EB4F) >> shift
+}
+
+// Greedy copy/add instructions that rebuild newData from oldData
+func buildDeltaOps(oldData, newData []byte) ([]byte, deltaStats) {
+	var stats deltaStats
+	var ops []byte
+	pending := 0 // start of literals not yet emitted
+	lastEnd := 0 // old offset where the previous copy ended
+
+	flushAdd := func(end int) {
+		if end > pending {
+			ops = binary.AppendUvarint(ops, uint64(end-pending)<<1)
+			ops = append(ops, newData[pending:end]...)
+			stats.Added += int64(end - pending)
+		}
+	}
+
+	if len(oldData) >= deltaWindow && len(newData) >= deltaWindow {
+		// Hash table sized to about twice the number of indexed windows
+		bitsNeeded := uint(1)
+		for 1<<bitsNeeded < 2*len(oldData)/deltaStride {
+			bitsNeeded++
+		}
+		shift := 64 - bitsNeeded
+		table := make([]int32, 1<<bitsNeeded) // old offset + 1
+		for p := 0; p+deltaWindow <= len(oldData); p += deltaStride {
+			table[deltaHash(oldData[p:], shift)] = int32(p + 1)
+		}
+
+		for i := 0; i+deltaWindow <= len(newData); {
+			ref := int(table[deltaHash(newData[i:], shift)]) - 1
+			if ref < 0 || !bytes.Equal(oldData[ref:ref+deltaWindow], newData[i:i+deltaWindow]) {
+				i++
+				continue
+			}
+			start, oldStart := i, ref
+			for start > pending && oldStart > 0 && newData[start-1] == oldData[oldStart-1] {
+				start--
+				oldStart--
+			}
+			end := i + deltaWindow
+			for end < len(newData) && oldStart+(end-start) < len(oldData) && newData[end] == oldData[oldStart+(end-start)] {
+				end++
+			}
+			if end-start < deltaMinMatch {
+				i++
+				continue
+			}
+			flushAdd(start)
+			ops = binary.AppendUvarint(ops, uint64(end-start)<<1|1)
+			ops = binary.AppendVarint(ops, int64(oldStart-lastEnd))
+			stats.Copied += int64(end - start)
+			stats.Copies++
+			lastEnd = oldStart + (end - start)
+			i, pending = end, end
+		}
+	}
+	flushAdd(len(newData))
+	return ops, stats
+}
+
+// Produce a compressed delta that turns oldData into newData
+func buildDelta(oldData, newData []byte) ([]byte, deltaStats, error) {
+	ops, stats := buildDeltaOps(oldData, newData)
+	packed, err := compressZstd(ops, 0, deltaZstdWindow)
+	if err != nil {
+		return nil, stats, err
+	}
+	out := make([]byte, deltaHeaderLen, deltaHeaderLen+len(packed))
+	copy(out, deltaMagic)
+	out[4] = deltaVersion
+	binary.LittleEndian.PutUint64(out[8:], uint64(len(oldData)))
+	binary.LittleEndian.PutUint32(out[16:], crc32.ChecksumIEEE(oldData))
+	binary.LittleEndian.PutUint64(out[20:], uint64(len(newData)))
+	binary.LittleEndian.PutUint32(out[28:], crc32.ChecksumIEEE(newData))
+	return append(out, packed...), stats, nil
+}
+
+// Rebuild the new version from the old one and a delta
+func applyDelta(oldData, delta []byte) ([]byte, error) {
+	if len(delta) < deltaHeaderLen || !bytes.HasPrefix(delta, []byte(deltaMagic)) {
+		return nil, errors.New("not a delta produced by diffCompress")
+	}
+	if delta[4] != deltaVersion {
+		return nil, fmt.Errorf("unsupported delta version %d", delta[4])
+	}
+	oldSize := binary.LittleEndian.Uint64(delta[8:])
+	newSize := binary.LittleEndian.Uint64(delta[20:])
+	if oldSize != uint64(len(oldData)) || binary.LittleEndian.Uint32(delta[16:]) != crc32.ChecksumIEEE(oldData) {
+		return nil, errors.New("delta was made against a different old version")
+	}
+	if newSize > defaultMaxDecompressed {
+		return nil, fmt.Errorf("patched size exceeds the %d byte limit", defaultMaxDecompressed)
+	}
+	var ops []byte
+	if len(delta) > deltaHeaderLen { // an empty instruction stream encodes to nothing
+		var err error
+		if ops, err = decompressZstd(delta[deltaHeaderLen:], 0, defaultMaxDecompressed); err != nil {
+			return nil, fmt.Errorf("corrupt delta: %v", err)
+		}
+	}
+
+	out := make([]byte, 0, newSize)
+	lastEnd := int64(0)
+	for len(ops) > 0 {
+		tag, n := binary.Uvarint(ops)
+		if n <= 0 {
+			return nil, errors.New("corrupt delta instruction")
+		}
+		ops = ops[n:]
+		length := tag >> 1
+		if uint64(len(out))+length > newSize {
+			return nil, errors.New("delta overruns the new size")
+		}
+		if tag&1 == 0 {
+			if length > uint64(len(ops)) {
+				return nil, errors.New("corrupt delta instruction")
+			}
+			out = append(out, ops[:length]...)
+			ops = ops[length:]
+			continue
+		}
+		rel, n := binary.Varint(ops)
+		if n <= 0 {
+			return nil, errors.New("corrupt delta instruction")
+		}
+		ops = ops[n:]
+		start := lastEnd + rel
+		if start < 0 || uint64(start)+length > uint64(len(oldData)) {
+			return nil, errors.New("delta copy outside the old version")
+		}
+		out = append(out, oldData[start:start+int64(length)]...)
+		lastEnd = start + int64(length)
+	}
+	if uint64(len(out)) != newSize || crc32.ChecksumIEEE(out) != binary.LittleEndian.Uint32(delta[28:]) {
+		return nil, errors.New("patched output does not match the expected checksum")
+	}
+	return out, nil
+}
+
+// diffCompress(oldData, newData) builds a binary delta that rebuilds newData
+// from oldData, so a revised file can be sent as the changes alone.
+// Resolves with the standard result object (originalSize is newData's
+// length) plus copiedBytes, addedBytes and copies.
+func diffCompress(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] diffCompress called with %d arguments\n", len(args))
+
+	if len(args) < 2 || !isSet(args[0]) || !isSet(args[1]) {
+		return runAsync("diffCompress", func() (interface{}, error) {
+			return nil, errors.New("expected old and new data")
+		})
+	}
+	// Both versions are held, so both count against the bytes in flight
+	if err := checkInputAllowed(peekJS(args[0], sniffPeekBytes), ""); err != nil {
+		return runAsync("diffCompress", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	release, err := admitInput(peekJS(args[1], sniffPeekBytes), "", args[0].Length()+args[1].Length())
+	if err != nil {
+		return runAsync("diffCompress", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	oldBytes := bytesFromJS(args[0])
+	newBytes := bytesFromJS(args[1])
+
+	return runAsync("diffCompress", func() (interface{}, error) {
+		j := startJob("diffCompress")
+		defer j.finish()
+		defer release()
+
+		delta, stats, err := buildDelta(oldBytes, newBytes)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Delta: %d -> %d bytes, %d copied, %d added\n", len(newBytes), len(delta), stats.Copied, stats.Added)
+
+		result := newResultObject(newBytes, delta)
+		result.Set("copiedBytes", stats.Copied)
+		result.Set("addedBytes", stats.Added)
+		result.Set("copies", stats.Copies)
+		return result, nil
+	})
+}
+
+// applyPatch(oldData, delta) rebuilds the new version from a diffCompress
+// delta. The old version and the result are both checked against the CRCs
+// recorded in the delta. Resolves with {data, size}.
+func applyPatch(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] applyPatch called with %d arguments\n", len(args))
+
+	if len(args) < 2 || !isSet(args[0]) || !isSet(args[1]) {
+		return runAsync("applyPatch", func() (interface{}, error) {
+			return nil, errors.New("expected old data and delta")
+		})
+	}
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length()+args[1].Length())
+	if err != nil {
+		return runAsync("applyPatch", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	oldBytes := bytesFromJS(args[0])
+	delta := bytesFromJS(args[1])
+
+	return runAsync("applyPatch", func() (interface{}, error) {
+		j := startJob("applyPatch")
+		defer j.finish()
+		defer release()
+
+		out, err := applyDelta(oldBytes, delta)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Patch applied: %d bytes\n", len(out))
+
+		result := js.Global().Get("Object").New()
+		result.Set("data", bytesToJS(out))
+		result.Set("size", len(out))
+		return result, nil
+	})
+}
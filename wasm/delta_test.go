@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// An old version and a revision of it with an insertion, a deletion, a
+// moved stretch and a changed byte
+func fixtureDeltaVersions() (oldData, newData []byte) {
+	var b bytes.Buffer
+	for i := 0; b.Len() < 400<<10; i++ {
+		fmt.Fprintf(&b, "paragraph %d keeps its wording %d\n", i, i*7919%10007)
+	}
+	oldData = b.Bytes()
+	newData = append(newData, oldData[:100000]...)
+	newData = append(newData, "INSERTED TEXT HERE"...)
+	newData = append(newData, oldData[100500:300000]...)
+	newData = append(newData, oldData[5000:9000]...)
+	newData = append(newData, oldData[300000:]...)
+	newData[200000] ^= 0xFF
+	return oldData, newData
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	oldData, newData := fixtureDeltaVersions()
+	delta, stats, err := buildDelta(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta) > 1000 || stats.Copied+stats.Added != int64(len(newData)) || stats.Added > 200 {
+		t.Errorf("%d byte delta, %+v", len(delta), stats)
+	}
+	back, err := applyDelta(oldData, delta)
+	if err != nil || !bytes.Equal(back, newData) {
+		t.Errorf("patched %d bytes: %v", len(back), err)
+	}
+
+	for _, c := range [][2][]byte{
+		{nil, newData[:1000]},
+		{oldData, nil},
+		{nil, nil},
+		{[]byte("short"), []byte("shorter")},
+	} {
+		delta, _, err := buildDelta(c[0], c[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back, err := applyDelta(c[0], delta); err != nil || !bytes.Equal(back, c[1]) {
+			t.Errorf("%d -> %d bytes patched as %d: %v", len(c[0]), len(c[1]), len(back), err)
+		}
+	}
+}
+
+func TestDeltaRejectsMismatches(t *testing.T) {
+	oldData, newData := fixtureDeltaVersions()
+	delta, _, err := buildDelta(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyDelta(newData, delta); err == nil {
+		t.Error("a delta applied to the wrong old version")
+	}
+	changed := append([]byte{}, oldData...)
+	changed[10] ^= 1
+	if _, err := applyDelta(changed, delta); err == nil {
+		t.Error("a delta applied to an old version of the right size but other content")
+	}
+
+	tamper := func(i int) []byte {
+		d := append([]byte{}, delta...)
+		d[i] ^= 1
+		return d
+	}
+	for name, d := range map[string][]byte{
+		"magic":        tamper(0),
+		"version":      tamper(4),
+		"new checksum": tamper(28),
+		"ops":          tamper(len(delta) - 3),
+		"truncated":    delta[:deltaHeaderLen-1],
+	} {
+		if _, err := applyDelta(oldData, d); err == nil {
+			t.Errorf("%s damage was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Defaults for compressAndDownload
+const (
+	downloadDefaultChunkSize = 4 << 20
+	downloadMinChunkSize     = 64 << 10
+)
+
+// Options for compressAndDownload
+type downloadOptions struct {
+	streamOptions
+
+	ChunkSize     int    `json:"chunkSize"`     // compressed bytes per write
+	SuggestedName string `json:"suggestedName"` // for the save picker
+	TotalSize     int64  `json:"totalSize"`     // input size, if the source cannot tell
+}
+
+func defaultDownloadOptions() downloadOptions {
+	return downloadOptions{
+		streamOptions: streamOptions{compressOptions: defaultCompressOptions()},
+		ChunkSize:     downloadDefaultChunkSize,
+	}
+}
+
+// File name extension each stream algorithm adds
+var streamExtensions = map[string]string{
+	codecGzip:   ".gz",
+	codecBrotli: ".br",
+	codecZstd:   ".zst",
+	codecLZ4:    ".lz4",
+	codecStore:  "",
+}
+
+// Progress for one download
+type downloadProgress struct {
+	Phase           string  `json:"phase"` // "writing" or "done"
+	InputBytes      int64   `json:"inputBytes"`
+	TotalBytes      int64   `json:"totalBytes,omitempty"`
+	CompressedBytes int64   `json:"compressedBytes"`
+	WrittenBytes    int64   `json:"writtenBytes"`
+	Fraction        float64 `json:"fraction"`
+}
+
+// Writes keep up with compression, each awaited before the next, so the
+// input read is the whole measure
+func (p *downloadProgress) update() {
+	switch {
+	case p.Phase == "done":
+		p.Fraction = 1
+	case p.TotalBytes <= 0:
+		p.Fraction = 0
+	default:
+		p.Fraction = minFloat(float64(p.InputBytes)/float64(p.TotalBytes), 0.99)
+	}
+}
+
+// The writer of a WritableStream the download goes into
+type downloadWriter struct {
+	writer js.Value
+	name   string // file name, when a file handle tells it
+}
+
+// Open target for writing: a FileSystemFileHandle, a WritableStream (a
+// FileSystemWritableFileStream, or one a streaming-saver service worker
+// turns into a download), or nothing, which asks showSaveFilePicker for a
+// file
+func openDownload(target js.Value, suggestedName string) (*downloadWriter, error) {
+	if !isSet(target) {
+		picker := js.Global().Get("showSaveFilePicker")
+		if picker.Type() != js.TypeFunction {
+			return nil, errors.New("showSaveFilePicker is unavailable here (workers, browsers without the File System Access API); pass a FileSystemFileHandle or a WritableStream")
+		}
+		pickerOptions := js.Global().Get("Object").New()
+		if suggestedName != "" {
+			pickerOptions.Set("suggestedName", suggestedName)
+		}
+		handle, err := callAwait(func() js.Value { return picker.Invoke(pickerOptions) })
+		if err != nil {
+			return nil, fmt.Errorf("save picker: %v", err)
+		}
+		target = handle
+	}
+
+	d := &downloadWriter{}
+	writable := target
+	if target.Get("createWritable").Type() == js.TypeFunction {
+		if name := target.Get("name"); name.Type() == js.TypeString {
+			d.name = name.String()
+		}
+		var err error
+		if writable, err = callAwait(func() js.Value { return target.Call("createWritable") }); err != nil {
+			return nil, fmt.Errorf("opening %s: %v", d.name, err)
+		}
+	}
+	if writable.Get("getWriter").Type() != js.TypeFunction {
+		return nil, errors.New("target must be a FileSystemFileHandle or a WritableStream")
+	}
+	var err error
+	d.writer, err = callAwait(func() js.Value { return writable.Call("getWriter") })
+	return d, err
+}
+
+// Write a chunk once the stream is ready for it
+func (d *downloadWriter) write(chunk []byte) error {
+	if _, err := awaitJS(d.writer.Get("ready")); err != nil {
+		return err
+	}
+	_, err := callAwait(func() js.Value { return d.writer.Call("write", bytesToJS(chunk)) })
+	return err
+}
+
+func (d *downloadWriter) close() error {
+	_, err := callAwait(func() js.Value { return d.writer.Call("close") })
+	return err
+}
+
+// Abort the stream so a partly written file is discarded
+func (d *downloadWriter) abort(reason error) {
+	callAwait(func() js.Value { return d.writer.Call("abort", reason.Error()) })
+}
+
+// Compress everything read returns into out, chunkSize bytes per write,
+// and close it
+func writeDownload(ctx context.Context, s *compressionStream, read chunkReader, out *downloadWriter, chunkSize int, progress *downloadProgress, report func()) error {
+	// Whole chunks go out as compression produces them; what is left goes
+	// with the tail
+	var pending []byte
+	flush := func(all bool) error {
+		for len(pending) >= chunkSize || all && len(pending) > 0 {
+			if err := checkCancelled(ctx); err != nil {
+				return err
+			}
+			n := minInt(len(pending), chunkSize)
+			if err := out.write(pending[:n]); err != nil {
+				return fmt.Errorf("writing: %v", err)
+			}
+			pending = pending[n:]
+			progress.WrittenBytes += int64(n)
+		}
+		return nil
+	}
+	for {
+		if err := checkCancelled(ctx); err != nil {
+			return err
+		}
+		chunk, err := read()
+		if err != nil {
+			return fmt.Errorf("reading source: %v", err)
+		}
+		if chunk == nil {
+			break
+		}
+		c, err := s.write(chunk)
+		if err != nil {
+			return err
+		}
+		progress.InputBytes = c.InputOffset
+		progress.CompressedBytes = c.OutputOffset
+		pending = append(pending, c.Data...)
+		if err := flush(false); err != nil {
+			return err
+		}
+		report()
+	}
+	tail, err := s.finish()
+	if err != nil {
+		return err
+	}
+	progress.CompressedBytes = s.outputOffset
+	pending = append(pending, tail...)
+	if err := flush(true); err != nil {
+		return err
+	}
+	return out.close()
+}
+
+// compressAndDownload(source, target?, options?, onProgress?) compresses
+// source (bytes, a Blob/File or a ReadableStream) straight into a file, so
+// large outputs never sit whole in memory as a Blob. target is a
+// FileSystemFileHandle or a WritableStream, for instance one a
+// streaming-saver service worker serves as a download; without one the
+// File System Access save picker is shown, which only works in a window
+// and soon after a user gesture. Options are those of
+// createCompressionStream plus {chunkSize, suggestedName, totalSize};
+// suggestedName gets the algorithm's extension unless it has one. With
+// algorithm "store" the source is written as it is. onProgress receives
+// {phase, inputBytes, totalBytes, compressedBytes, writtenBytes,
+// fraction}. On failure or cancellation the stream is aborted, which
+// discards a partly written file. Resolves with the standard result
+// object minus data, plus algorithm and filename when a handle tells it.
+func compressAndDownload(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] compressAndDownload called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("compressAndDownload", func() (interface{}, error) {
+			return nil, errors.New("expected a source")
+		})
+	}
+	source := args[0]
+	target := js.Undefined()
+	if len(args) > 1 {
+		target = args[1]
+	}
+	opts := defaultDownloadOptions()
+	var optsErr error
+	if len(args) > 2 {
+		optsErr = decodeOptions(args[2], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 3 {
+		progressCallback = args[3]
+	}
+
+	return runAsync("compressAndDownload", func() (interface{}, error) {
+		j := startJob("compressAndDownload")
+		defer j.finish()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		if opts.ChunkSize < downloadMinChunkSize {
+			return nil, fmt.Errorf("chunkSize must be at least %d bytes", downloadMinChunkSize)
+		}
+		if opts.Resume != nil {
+			return nil, errors.New("downloads cannot resume; the file is written from the start")
+		}
+		s, err := newCompressionStream(opts.streamOptions)
+		if err != nil {
+			return nil, err
+		}
+		read, size, err := newChunkReader(source)
+		if err != nil {
+			return nil, err
+		}
+
+		name := opts.SuggestedName
+		if ext := streamExtensions[s.opts.Algorithm]; name != "" && ext != "" && !strings.HasSuffix(name, ext) {
+			name += ext
+		}
+		out, err := openDownload(target, name)
+		if err != nil {
+			return nil, err
+		}
+
+		progress := &downloadProgress{Phase: "writing", TotalBytes: opts.TotalSize}
+		if size >= 0 {
+			progress.TotalBytes = size
+		}
+		report := func() {
+			if isSet(progressCallback) {
+				progress.update()
+				if p, err := jsonToJS(progress); err == nil {
+					progressCallback.Invoke(p)
+				}
+			}
+		}
+
+		if err := writeDownload(j.ctx, s, read, out, opts.ChunkSize, progress, report); err != nil {
+			out.abort(err)
+			return nil, err
+		}
+		progress.Phase = "done"
+		report()
+		fmt.Printf("[WASM] Downloaded %d -> %d bytes\n", s.inputOffset, s.outputOffset)
+
+		result := js.Global().Get("Object").New()
+		result.Set("originalSize", s.inputOffset)
+		result.Set("compressedSize", s.outputOffset)
+		ratio := 1.0
+		if s.inputOffset > 0 {
+			ratio = float64(s.outputOffset) / float64(s.inputOffset)
+		}
+		result.Set("compressionRatio", ratio)
+		result.Set("algorithm", s.opts.Algorithm)
+		if out.name != "" {
+			result.Set("filename", out.name)
+		}
+		return result, nil
+	})
+}
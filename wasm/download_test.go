@@ -0,0 +1,73 @@
+//go:build js
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestDownloadStream(t *testing.T) {
+	// A WritableStream stand-in whose writer keeps what it is given
+	var written bytes.Buffer
+	writes, closed := 0, false
+	write := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		chunk := make([]byte, args[0].Length())
+		js.CopyBytesToGo(chunk, args[0])
+		written.Write(chunk)
+		writes++
+		return nil
+	})
+	closeWriter := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		closed = true
+		return nil
+	})
+	writer := js.Global().Get("Object").New()
+	writer.Set("write", write)
+	writer.Set("close", closeWriter)
+	getWriter := js.FuncOf(func(this js.Value, args []js.Value) interface{} { return writer })
+	defer write.Release()
+	defer closeWriter.Release()
+	defer getWriter.Release()
+	stream := js.Global().Get("Object").New()
+	stream.Set("getWriter", getWriter)
+
+	out, err := openDownload(stream, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 600<<10)
+	for i := range data {
+		data[i] = byte(i * i >> 7)
+	}
+	s, err := newCompressionStream(streamOptions{compressOptions: compressOptions{Algorithm: codecStore}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := data
+	read := func() ([]byte, error) {
+		n := minInt(len(rest), 100<<10)
+		chunk := rest[:n]
+		rest = rest[n:]
+		if n == 0 {
+			return nil, nil
+		}
+		return chunk, nil
+	}
+	progress := &downloadProgress{Phase: "writing", TotalBytes: int64(len(data))}
+	if err := writeDownload(context.Background(), s, read, out, downloadMinChunkSize*4, progress, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if !closed || !bytes.Equal(written.Bytes(), data) || progress.WrittenBytes != int64(len(data)) {
+		t.Fatalf("wrote %d bytes, closed %v", written.Len(), closed)
+	}
+	if writes != 3 {
+		t.Fatalf("%d writes of at most 256 KiB for 600 KiB", writes)
+	}
+	if _, err := openDownload(js.Global().Get("Object").New(), ""); err == nil {
+		t.Fatal("a plain object was taken for a stream")
+	}
+}
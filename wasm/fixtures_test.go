@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Fixtures used only by the tests; the ones the self-test and warmup
+// run stay in selftest.go
+
+// Adam7 passes: x and y start, x and y step
+var adam7Passes = [7][4]int{{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4}, {0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2}}
+
+// PNG written by hand, for layouts the standard encoder never produces:
+// sub-byte and 16-bit depths and Adam7 interlacing. sample(x, y, c)
+// returns channel c of a pixel; plte is the palette for color type 3.
+func fixtureRawPNG(w, h int, depth, colorType uint8, interlaced bool, plte []byte, sample func(x, y, c int) int) []byte {
+	channels := map[uint8]int{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}[colorType]
+
+	var raw []byte
+	writeRows := func(x0, y0, dx, dy int) {
+		for y := y0; y < h; y += dy {
+			var row []byte
+			var acc, nbits uint
+			for x := x0; x < w; x += dx {
+				for c := 0; c < channels; c++ {
+					acc = acc<<depth | uint(sample(x, y, c))&(1<<depth-1)
+					nbits += uint(depth)
+					for nbits >= 8 {
+						row = append(row, byte(acc>>(nbits-8)))
+						nbits -= 8
+					}
+				}
+			}
+			if nbits > 0 {
+				row = append(row, byte(acc<<(8-nbits)))
+			}
+			if len(row) > 0 {
+				raw = append(append(raw, 0), row...)
+			}
+		}
+	}
+	if interlaced {
+		for _, p := range adam7Passes {
+			writeRows(p[0], p[1], p[2], p[3])
+		}
+	} else {
+		writeRows(0, 0, 1, 1)
+	}
+
+	var idat bytes.Buffer
+	zw := zlib.NewWriter(&idat)
+	zw.Write(raw)
+	zw.Close()
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(w))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(h))
+	ihdr[8], ihdr[9] = depth, colorType
+	if interlaced {
+		ihdr[12] = 1
+	}
+	out := new(bytes.Buffer)
+	out.Write(pngSignature)
+	writePNGChunk(out, "IHDR", ihdr)
+	if plte != nil {
+		writePNGChunk(out, "PLTE", plte)
+	}
+	writePNGChunk(out, "IDAT", idat.Bytes())
+	writePNGChunk(out, "IEND", nil)
+	return out.Bytes()
+}
+
+// Smooth sample values for fixtureRawPNG; masked to the bit depth
+func fixtureSample(x, y, c int) int {
+	return (x*1031 + y*2053 + c*4099) * 7
+}
+
+// JPEG with an APP1 EXIF segment carrying a whole thumbnail JPEG (its own
+// SOI, SOS and EOI markers included) and padding up to pad bytes
+func fixtureJPEGWithEXIF(img image.Image, pad int) []byte {
+	payload := append([]byte("Exif\x00\x00"), fixtureJPEG(imaging.Resize(img, 32, 0, imaging.Box))...)
+	payload = append(payload, make([]byte, maxInt(0, pad-len(payload)))...)
+	main := fixtureJPEG(img)
+	out := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	return append(out, main[2:]...)
+}
+
+// XMP packet with a base64 thumbnail and the usual padding
+func fixtureXMPPacket() []byte {
+	return []byte(`<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:xmpGImg="http://ns.adobe.com/xap/1.0/g/img/">
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Report</rdf:li></rdf:Alt></dc:title>
+   <xmp:Thumbnails><rdf:Alt><rdf:li rdf:parseType="Resource"><xmpGImg:image>` + strings.Repeat("QUJDRA", 2000) + `</xmpGImg:image></rdf:li></rdf:Alt></xmp:Thumbnails>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+` + strings.Repeat(strings.Repeat(" ", 99)+"\n", 20) + `<?xpacket end="w"?>`)
+}
+
+// PDF with a catalog (object 1) followed by one stream object per entry,
+// each with the given dictionary entries
+func fixtureStreamPDF(dicts []string, streams [][]byte) []byte {
+	out := new(bytes.Buffer)
+	out.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	for i, stream := range streams {
+		fmt.Fprintf(out, "%d 0 obj\n<< %s /Length %d >>\nstream\n", i+2, dicts[i], len(stream))
+		out.Write(stream)
+		out.WriteString("\nendstream\nendobj\n")
+	}
+	out.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return out.Bytes()
+}
+
+// LZWDecode data with the default early change, which compress/lzw does
+// not write: codes widen one entry before the table needs them, and a
+// full table is cleared rather than frozen
+func fixtureLZW(data []byte) []byte {
+	var out []byte
+	var acc uint64
+	var bits uint
+	width, next := uint(9), 257
+	table := map[string]int{}
+	emit := func(code int) {
+		acc, bits = acc<<width|uint64(code), bits+width
+		for bits >= 8 {
+			out = append(out, byte(acc>>(bits-8)))
+			bits -= 8
+		}
+	}
+	code := func(s string) int {
+		if len(s) == 1 {
+			return int(s[0])
+		}
+		return table[s]
+	}
+	// The decoder widens after the code that brings its table to the
+	// next power of two, less one
+	added := func() {
+		next++
+		if next+1 < 1<<width {
+			return
+		}
+		if width < 12 {
+			width++
+			return
+		}
+		emit(256)
+		width, next, table = 9, 257, map[string]int{}
+	}
+
+	emit(256)
+	w := ""
+	for _, c := range data {
+		wc := w + string([]byte{c})
+		if _, ok := table[wc]; ok || w == "" {
+			w = wc
+			continue
+		}
+		emit(code(w))
+		table[wc] = next + 1
+		added()
+		w = string([]byte{c})
+	}
+	if w != "" {
+		emit(code(w))
+		if next++; next+1 >= 1<<width && width < 12 {
+			width++
+		}
+	}
+	emit(257)
+	if bits > 0 {
+		out = append(out, byte(acc<<(8-bits)))
+	}
+	return out
+}
+
+// Grayscale rows under the PNG Up predictor, as a Flate or LZW stream
+// with /Predictor 12 holds them, and the samples they decode to. Each row
+// is the one above plus 7, which the predictor turns into runs of 7s and
+// deflate alone barely compresses.
+func fixturePredictedRows(columns, rows int) (predicted, samples []byte) {
+	for r := 0; r < rows; r++ {
+		predicted = append(predicted, 2)
+		for i := 0; i < columns; i++ {
+			samples = append(samples, byte(i*i+7*r))
+			if r == 0 {
+				predicted = append(predicted, byte(i*i))
+			} else {
+				predicted = append(predicted, 7)
+			}
+		}
+	}
+	return predicted, samples
+}
+
+// RunLengthDecode data: repeats for runs of two or more, single-byte
+// literals otherwise, and the end marker
+func fixtureRunLength(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); {
+		run := 1
+		for i+run < len(data) && run < 128 && data[i+run] == data[i] {
+			run++
+		}
+		if run == 1 {
+			out = append(out, 0, data[i])
+		} else {
+			out = append(out, byte(257-run), data[i])
+		}
+		i += run
+	}
+	return append(out, 128)
+}
+
+// Little-endian TIFF laid out like a NEF: IFD0 holds the orientation and a
+// small thumbnail and points at a SubIFD holding the full-size preview
+func fixtureRAW(orientation int, thumb, full []byte) []byte {
+	le := binary.LittleEndian
+	entry := func(tag, typ uint16, count, value uint32) []byte {
+		e := make([]byte, 12)
+		le.PutUint16(e, tag)
+		le.PutUint16(e[2:], typ)
+		le.PutUint32(e[4:], count)
+		le.PutUint32(e[8:], value)
+		return e
+	}
+	// Header 8, IFD0 at 8 (4 entries), SubIFD after it (2 entries), data after
+	ifd0 := 8
+	sub := ifd0 + 2 + 4*12 + 4
+	thumbAt := sub + 2 + 2*12 + 4
+	fullAt := thumbAt + len(thumb)
+
+	out := []byte("II*\x00\x08\x00\x00\x00")
+	out = append(out, 4, 0)
+	out = append(out, entry(tiffTagOrientation, 3, 1, uint32(orientation))...)
+	out = append(out, entry(tiffTagSubIFDs, 4, 1, uint32(sub))...)
+	out = append(out, entry(tiffTagJPEGOffset, 4, 1, uint32(thumbAt))...)
+	out = append(out, entry(tiffTagJPEGLength, 4, 1, uint32(len(thumb)))...)
+	out = append(out, 0, 0, 0, 0)
+	out = append(out, 2, 0)
+	out = append(out, entry(tiffTagJPEGOffset, 4, 1, uint32(fullAt))...)
+	out = append(out, entry(tiffTagJPEGLength, 4, 1, uint32(len(full)))...)
+	out = append(out, 0, 0, 0, 0)
+	out = append(out, thumb...)
+	return append(out, full...)
+}
+
+// 8-bit RGB PSD with a transparency channel, RLE compressed, whose
+// composite is img matted against white as Photoshop saves it
+func fixturePSD(img *image.NRGBA) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	out := new(bytes.Buffer)
+	put := func(v interface{}) { binary.Write(out, binary.BigEndian, v) }
+	out.WriteString("8BPS")
+	put(uint16(1))
+	out.Write(make([]byte, 6))
+	put(uint16(4))
+	put(uint32(h))
+	put(uint32(w))
+	put(uint16(8))
+	put(uint16(psdRGB))
+	put(uint32(0)) // color mode data
+	put(uint32(0)) // image resources
+	put(uint32(6)) // layer and mask info: layer info of just a count
+	put(uint32(2))
+	put(int16(-1)) // negative: first extra channel is transparency
+	put(uint16(1))
+
+	var rows [][]byte
+	for c := 0; c < 4; c++ {
+		for y := 0; y < h; y++ {
+			row := []byte{byte(w - 1)} // one literal run
+			for x := 0; x < w; x++ {
+				p := img.NRGBAAt(x, y)
+				v := []uint8{p.R, p.G, p.B, p.A}[c]
+				if c < 3 {
+					v = uint8((int(v)*int(p.A) + 255*(255-int(p.A))) / 255)
+				}
+				row = append(row, v)
+			}
+			rows = append(rows, row)
+		}
+	}
+	for _, row := range rows {
+		put(uint16(len(row)))
+	}
+	for _, row := range rows {
+		out.Write(row)
+	}
+	return out.Bytes()
+}
+
+// HEIF container with no media data: two full-size HEVC images (a burst),
+// a thumbnail of the first and an EXIF item
+func fixtureHEIF() []byte {
+	box := func(typ string, payload ...[]byte) []byte {
+		body := bytes.Join(payload, nil)
+		out := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+		copy(out[4:], typ)
+		return append(out, body...)
+	}
+	full := func(version byte, fields ...interface{}) []byte {
+		buf := bytes.NewBuffer([]byte{version, 0, 0, 0})
+		for _, f := range fields {
+			binary.Write(buf, binary.BigEndian, f)
+		}
+		return buf.Bytes()
+	}
+	infe := func(id uint16, typ string) []byte {
+		return box("infe", full(2, id, uint16(0)), []byte(typ+"\x00"))
+	}
+	ispe := func(w, h uint32) []byte { return box("ispe", full(0, w, h)) }
+	return append(box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")),
+		box("meta", full(0),
+			box("pitm", full(0, uint16(1))),
+			box("iinf", full(0, uint16(4)), infe(1, "hvc1"), infe(2, "hvc1"), infe(3, "hvc1"), infe(4, "Exif")),
+			box("iref", full(0), box("thmb", []byte{0, 3, 0, 1, 0, 1})),
+			box("iprp",
+				box("ipco", ispe(4032, 3024), ispe(320, 240)),
+				box("ipma", full(0, uint32(3), uint16(1), uint8(1), uint8(1), uint16(2), uint8(1), uint8(1), uint16(3), uint8(1), uint8(2)))),
+		)...)
+}
+
+// TrueType font with .notdef, "A", a composite "B" built from "A", and
+// "C", plus glyph names and a GSUB table subsetting has to drop
+func fixtureTTF() []byte {
+	u16 := func(v ...int) []byte {
+		var b []byte
+		for _, x := range v {
+			b = binary.BigEndian.AppendUint16(b, uint16(x))
+		}
+		return b
+	}
+	point := append(u16(1, 0, 0, 500, 700, 0, 0), 1, 0, 100, 0, 200) // one contour, one on-curve point
+	composite := append(u16(0xFFFF, 0, 0, 500, 700, 0x0002, 1), 10, 0)
+	glyphs := [][]byte{point, point, composite, point}
+	var glyf, loca []byte
+	for _, g := range glyphs {
+		loca = binary.BigEndian.AppendUint32(loca, uint32(len(glyf)))
+		glyf = append(glyf, g...)
+		for len(glyf)%4 != 0 {
+			glyf = append(glyf, 0)
+		}
+	}
+	loca = binary.BigEndian.AppendUint32(loca, uint32(len(glyf)))
+
+	head := make([]byte, 54)
+	binary.BigEndian.PutUint32(head, 0x00010000)
+	binary.BigEndian.PutUint32(head[12:], 0x5F0F3CF5)
+	binary.BigEndian.PutUint16(head[18:], 1000)
+	binary.BigEndian.PutUint16(head[50:], 1)
+	hhea := make([]byte, 36)
+	binary.BigEndian.PutUint32(hhea, 0x00010000)
+	binary.BigEndian.PutUint16(hhea[34:], 4)
+	post := append(make([]byte, 32), u16(4, 0, 258, 259, 260)...)
+	binary.BigEndian.PutUint32(post, 0x00020000)
+	font := &sfntFont{Flavor: sfntTrueType, Tables: map[string][]byte{
+		"head": head,
+		"hhea": hhea,
+		"maxp": append([]byte{0, 0, 0x50, 0}, u16(len(glyphs))...),
+		"hmtx": u16(500, 0, 600, 10, 600, 10, 600, 10),
+		"cmap": buildCmap(map[rune]uint16{'A': 1, 'B': 2, 'C': 3}),
+		"glyf": glyf,
+		"loca": loca,
+		"post": post,
+		"GSUB": u16(1, 0, 10, 10, 10),
+	}}
+	return font.encode()
+}
+
+// MP4 as cameras write it: media data first, then moov with a GPS udta
+// box and one track whose single chunk holds the media payload
+func fixtureMP4(media []byte) []byte {
+	box := func(typ string, payload ...[]byte) []byte {
+		body := bytes.Join(payload, nil)
+		out := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+		copy(out[4:], typ)
+		return append(out, body...)
+	}
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	mdat := box("mdat", media)
+	stco := make([]byte, 12)
+	binary.BigEndian.PutUint32(stco[4:], 1)
+	binary.BigEndian.PutUint32(stco[8:], uint32(len(ftyp)+8))
+	moov := box("moov",
+		box("mvhd", make([]byte, 100)),
+		box("udta", box("\xa9xyz", []byte("+52.3700+004.8900/"))),
+		box("trak", box("mdia", box("minf", box("stbl", box("stco", stco))))))
+	return bytes.Join([][]byte{ftyp, mdat, box("free", make([]byte, 64)), moov}, nil)
+}
+
+// The result compressPDFData would give for input and output
+func fixturePDFResult(input, output []byte) pdfResult {
+	res := pdfResult{Data: output}
+	res.Original, _ = ParsePDF(input)
+	res.Output, _ = ParsePDF(output)
+	return res
+}
+
+// Unfiltered content and image samples for fixtureThreePagePDF
+func fixturePageStreams() ([]byte, []byte) {
+	return bytes.Repeat([]byte("0 0 1 rg 10 10 50 50 re f\n"), 40), bytes.Repeat([]byte{10, 20, 30, 40}, 400)
+}
+
+// Three pages with content streams 6-8, unfiltered; pages 1 and 3 show
+// gray image 9, page 2 image 10
+func fixtureThreePagePDF(content, samples []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	buf.WriteString("2 0 obj\n<< /Type /Pages /Kids [3 0 R 4 0 R 5 0 R] /Count 3 >>\nendobj\n")
+	for i, img := range []int{9, 10, 9} {
+		fmt.Fprintf(buf, "%d 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Contents %d 0 R /Resources << /XObject << /Im0 %d 0 R >> >> >>\nendobj\n", 3+i, 6+i, img)
+	}
+	for num := 6; num <= 10; num++ {
+		data, dict := content, ""
+		if num >= 9 {
+			data, dict = samples, "/Type /XObject /Subtype /Image /Width 40 /Height 40 /ColorSpace /DeviceGray /BitsPerComponent 8 "
+		}
+		fmt.Fprintf(buf, "%d 0 obj\n<< %s/Length %d >>\nstream\n", num, dict, len(data))
+		buf.Write(data)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Web font pipeline: subset a TrueType font to the characters a page needs
+// and wrap it in WOFF2. Glyph IDs are kept and unused glyphs emptied, so
+// GPOS, kern, hdmx and hinting tables that index glyphs stay valid. GSUB
+// and morx are dropped, as their substitutions could lead to emptied
+// glyphs. CFF-flavored OpenType fonts can be converted but not subset.
+
+// sfnt versions
+const (
+	sfntTrueType = 0x00010000
+	sfntApple    = 0x74727565 // "true"
+	sfntCFF      = 0x4F54544F // "OTTO"
+	sfntTTC      = 0x74746366 // "ttcf"
+)
+
+// Tables that stop being valid once glyphs are emptied
+var fontSubsetDropped = map[string]bool{
+	"GSUB": true, "morx": true, "mort": true,
+	"DSIG": true, // signs the original bytes
+}
+
+// Tags WOFF2 encodes as a table index instead of spelling them out
+var woff2KnownTags = []string{
+	"cmap", "head", "hhea", "hmtx", "maxp", "name", "OS/2", "post",
+	"cvt ", "fpgm", "glyf", "loca", "prep", "CFF ", "VORG", "EBDT",
+	"EBLC", "gasp", "hdmx", "kern", "LTSH", "PCLT", "VDMX", "vhea",
+	"vmtx", "BASE", "GDEF", "GPOS", "GSUB", "EBSC", "JSTF", "MATH",
+	"CBDT", "CBLC", "COLR", "CPAL", "SVG ", "sbix", "acnt", "avar",
+	"bdat", "bloc", "bsln", "cvar", "fdsc", "feat", "fmtx", "fvar",
+	"gvar", "hsty", "just", "lcar", "mort", "morx", "opbd", "prop",
+	"trak", "Zapf", "Silf", "Glat", "Gloc", "Feat", "Sill",
+}
+
+// A TrueType or OpenType font as its tables
+type sfntFont struct {
+	Flavor uint32
+	Tables map[string][]byte
+}
+
+func parseSFNT(data []byte) (*sfntFont, error) {
+	if len(data) < 12 {
+		return nil, errors.New("font header truncated")
+	}
+	flavor := binary.BigEndian.Uint32(data)
+	switch {
+	case flavor == sfntTTC:
+		return nil, errors.New("font collections (TTC) are not supported")
+	case string(data[:4]) == "wOFF" || string(data[:4]) == "wOF2":
+		return nil, errors.New("input is already a web font; use the original TTF or OTF")
+	case flavor != sfntTrueType && flavor != sfntApple && flavor != sfntCFF:
+		return nil, errors.New("not a TrueType or OpenType font")
+	}
+	n := int(binary.BigEndian.Uint16(data[4:]))
+	if 12+n*16 > len(data) {
+		return nil, errors.New("font table directory truncated")
+	}
+	f := &sfntFont{Flavor: flavor, Tables: make(map[string][]byte, n)}
+	for i := 0; i < n; i++ {
+		rec := data[12+i*16:]
+		tag := string(rec[:4])
+		off, length := int(binary.BigEndian.Uint32(rec[8:])), int(binary.BigEndian.Uint32(rec[12:]))
+		if off+length > len(data) {
+			return nil, fmt.Errorf("font table %q out of range", tag)
+		}
+		f.Tables[tag] = data[off : off+length]
+	}
+	return f, nil
+}
+
+func (f *sfntFont) sortedTags() []string {
+	tags := make([]string, 0, len(f.Tables))
+	for tag := range f.Tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Sum of big-endian 32-bit words, zero padded
+func sfntChecksum(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(b); i += 4 {
+		var word [4]byte
+		copy(word[:], b[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
+
+// Serialize as an sfnt: tables sorted by tag and 4-byte aligned, with
+// directory checksums and head.checkSumAdjustment filled in
+func (f *sfntFont) encode() []byte {
+	tags := f.sortedTags()
+	n := len(tags)
+	entrySelector := 0
+	for 1<<(entrySelector+1) <= n {
+		entrySelector++
+	}
+	searchRange := 16 << entrySelector
+	out := make([]byte, 12+16*n)
+	binary.BigEndian.PutUint32(out, f.Flavor)
+	binary.BigEndian.PutUint16(out[4:], uint16(n))
+	binary.BigEndian.PutUint16(out[6:], uint16(searchRange))
+	binary.BigEndian.PutUint16(out[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(out[10:], uint16(16*n-searchRange))
+
+	headAt := -1
+	for i, tag := range tags {
+		t := f.Tables[tag]
+		if tag == "head" && len(t) >= 12 {
+			t = append([]byte{}, t...)
+			binary.BigEndian.PutUint32(t[8:], 0)
+			headAt = len(out)
+		}
+		rec := out[12+i*16:]
+		copy(rec, tag)
+		binary.BigEndian.PutUint32(rec[4:], sfntChecksum(t))
+		binary.BigEndian.PutUint32(rec[8:], uint32(len(out)))
+		binary.BigEndian.PutUint32(rec[12:], uint32(len(t)))
+		out = append(out, t...)
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+	}
+	if headAt >= 0 {
+		binary.BigEndian.PutUint32(out[headAt+8:], 0xB1B0AFBA-sfntChecksum(out))
+	}
+	return out
+}
+
+// Codepoint to glyph mapping of the best Unicode cmap subtable: format 12
+// when there is one, format 4 otherwise
+func parseCmap(cmap []byte) (map[rune]uint16, error) {
+	if len(cmap) < 4 {
+		return nil, errors.New("cmap truncated")
+	}
+	best, bestScore := -1, 0
+	for i := 0; i < int(binary.BigEndian.Uint16(cmap[2:])) && 4+i*8+8 <= len(cmap); i++ {
+		rec := cmap[4+i*8:]
+		platform, encoding := binary.BigEndian.Uint16(rec), binary.BigEndian.Uint16(rec[2:])
+		off := int(binary.BigEndian.Uint32(rec[4:]))
+		if off+4 > len(cmap) {
+			continue
+		}
+		unicode := platform == 0 || platform == 3 && (encoding == 1 || encoding == 10)
+		score := 0
+		switch format := binary.BigEndian.Uint16(cmap[off:]); {
+		case format == 12 && unicode:
+			score = 3
+		case format == 4 && unicode:
+			score = 2
+		case format == 4 && platform == 3 && encoding == 0: // symbol fonts
+			score = 1
+		}
+		if score > bestScore {
+			best, bestScore = off, score
+		}
+	}
+	if best < 0 {
+		return nil, errors.New("font has no Unicode cmap")
+	}
+
+	sub := cmap[best:]
+	m := map[rune]uint16{}
+	if bestScore == 3 {
+		if len(sub) < 16 {
+			return nil, errors.New("cmap format 12 truncated")
+		}
+		groups := int(binary.BigEndian.Uint32(sub[12:]))
+		if groups < 0 || 16+groups*12 > len(sub) {
+			return nil, errors.New("cmap format 12 truncated")
+		}
+		for g := 0; g < groups; g++ {
+			rec := sub[16+g*12:]
+			start, end := binary.BigEndian.Uint32(rec), binary.BigEndian.Uint32(rec[4:])
+			glyph := binary.BigEndian.Uint32(rec[8:])
+			if end > 0x10FFFF || start > end {
+				continue
+			}
+			for c := start; c <= end; c++ {
+				m[rune(c)] = uint16(glyph + c - start)
+			}
+		}
+		return m, nil
+	}
+
+	if len(sub) < 14 {
+		return nil, errors.New("cmap format 4 truncated")
+	}
+	if length := int(binary.BigEndian.Uint16(sub[2:])); length < len(sub) {
+		sub = sub[:length]
+	}
+	segX2 := int(binary.BigEndian.Uint16(sub[6:]))
+	if 16+4*segX2 > len(sub) {
+		return nil, errors.New("cmap format 4 truncated")
+	}
+	ends, starts := sub[14:], sub[16+segX2:]
+	deltas, rangeOffsets := sub[16+2*segX2:], 16+3*segX2
+	for s := 0; s < segX2/2; s++ {
+		start, end := int(binary.BigEndian.Uint16(starts[s*2:])), int(binary.BigEndian.Uint16(ends[s*2:]))
+		delta := binary.BigEndian.Uint16(deltas[s*2:])
+		ro := int(binary.BigEndian.Uint16(sub[rangeOffsets+s*2:]))
+		for c := start; c <= end && c < 0xFFFF; c++ {
+			glyph := uint16(c) + delta
+			if ro != 0 {
+				at := rangeOffsets + s*2 + ro + (c-start)*2
+				if at+2 > len(sub) {
+					break
+				}
+				if glyph = binary.BigEndian.Uint16(sub[at:]); glyph != 0 {
+					glyph += delta
+				}
+			}
+			if glyph != 0 {
+				m[rune(c)] = glyph
+			}
+		}
+	}
+	return m, nil
+}
+
+// Glyphs a composite glyph is built from
+func glyphComponents(g []byte) []uint16 {
+	if len(g) < 10 || int16(binary.BigEndian.Uint16(g)) >= 0 {
+		return nil
+	}
+	var out []uint16
+	for at := 10; at+4 <= len(g); {
+		flags := binary.BigEndian.Uint16(g[at:])
+		out = append(out, binary.BigEndian.Uint16(g[at+2:]))
+		at += 4
+		if flags&0x0001 != 0 { // ARG_1_AND_2_ARE_WORDS
+			at += 4
+		} else {
+			at += 2
+		}
+		switch {
+		case flags&0x0008 != 0: // WE_HAVE_A_SCALE
+			at += 2
+		case flags&0x0040 != 0: // WE_HAVE_AN_X_AND_Y_SCALE
+			at += 4
+		case flags&0x0080 != 0: // WE_HAVE_A_TWO_BY_TWO
+			at += 8
+		}
+		if flags&0x0020 == 0 { // MORE_COMPONENTS
+			break
+		}
+	}
+	return out
+}
+
+// Codepoints to keep: the characters of a text plus CSS unicode-range
+// style ranges ("U+0041", "U+0000-00FF", "U+4??")
+type fontCharset struct {
+	text   map[rune]bool
+	ranges [][2]rune
+}
+
+func parseFontCharset(text string, ranges []string) (fontCharset, error) {
+	cs := fontCharset{text: map[rune]bool{}}
+	for _, r := range text {
+		cs.text[r] = true
+	}
+	for _, s := range ranges {
+		spec := strings.ToUpper(strings.TrimSpace(s))
+		if !strings.HasPrefix(spec, "U+") {
+			return cs, fmt.Errorf("invalid unicode range %q, want U+XXXX or U+XXXX-YYYY", s)
+		}
+		spec = spec[2:]
+		lo, hi := spec, spec
+		if i := strings.IndexByte(spec, '-'); i >= 0 {
+			lo, hi = spec[:i], spec[i+1:]
+		} else if strings.Contains(spec, "?") {
+			lo, hi = strings.ReplaceAll(spec, "?", "0"), strings.ReplaceAll(spec, "?", "F")
+		}
+		a, errA := strconv.ParseUint(lo, 16, 32)
+		b, errB := strconv.ParseUint(hi, 16, 32)
+		if errA != nil || errB != nil || a > b || b > 0x10FFFF {
+			return cs, fmt.Errorf("invalid unicode range %q", s)
+		}
+		cs.ranges = append(cs.ranges, [2]rune{rune(a), rune(b)})
+	}
+	return cs, nil
+}
+
+func (cs fontCharset) empty() bool { return len(cs.text) == 0 && len(cs.ranges) == 0 }
+
+func (cs fontCharset) contains(r rune) bool {
+	if cs.text[r] {
+		return true
+	}
+	for _, rg := range cs.ranges {
+		if r >= rg[0] && r <= rg[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Outcome of subsetting
+type fontSubset struct {
+	Font        *sfntFont
+	Glyphs      int // glyphs with outlines kept, .notdef included
+	TotalGlyphs int
+	Missing     []rune // requested text the font has no glyph for
+	DroppedGSUB bool
+}
+
+func subsetTrueType(f *sfntFont, cs fontCharset) (fontSubset, error) {
+	for _, tag := range []string{"head", "hhea", "hmtx", "maxp", "cmap", "loca", "glyf"} {
+		if f.Tables[tag] == nil {
+			if f.Flavor == sfntCFF {
+				return fontSubset{}, errors.New("subsetting CFF-flavored OpenType fonts is not supported; omit text and unicodes to convert without subsetting")
+			}
+			return fontSubset{}, fmt.Errorf("font has no %s table", tag)
+		}
+	}
+	head, hhea, maxp := f.Tables["head"], f.Tables["hhea"], f.Tables["maxp"]
+	if len(head) < 54 || len(hhea) < 36 || len(maxp) < 6 {
+		return fontSubset{}, errors.New("font header tables truncated")
+	}
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	glyphs, err := trueTypeGlyphs(f)
+	if err != nil {
+		return fontSubset{}, err
+	}
+
+	cmap, err := parseCmap(f.Tables["cmap"])
+	if err != nil {
+		return fontSubset{}, err
+	}
+	res := fontSubset{TotalGlyphs: numGlyphs}
+	mapping := map[rune]uint16{}
+	for r, g := range cmap {
+		if int(g) < numGlyphs && cs.contains(r) {
+			mapping[r] = g
+		}
+	}
+	for r := range cs.text {
+		if _, ok := mapping[r]; !ok {
+			res.Missing = append(res.Missing, r)
+		}
+	}
+	sort.Slice(res.Missing, func(a, b int) bool { return res.Missing[a] < res.Missing[b] })
+
+	roots := make([]int, 0, len(mapping))
+	for _, g := range mapping {
+		roots = append(roots, int(g))
+	}
+	out, kept := keepTrueTypeGlyphs(f, glyphs, roots)
+	res.Glyphs = kept
+	_, hadGSUB := f.Tables["GSUB"]
+	res.DroppedGSUB = hadGSUB
+	out.Tables["cmap"] = buildCmap(mapping)
+	// Glyph names are dead weight in a web font
+	if post := f.Tables["post"]; len(post) >= 32 && binary.BigEndian.Uint32(post) == 0x00020000 {
+		post = append([]byte{}, post[:32]...)
+		binary.BigEndian.PutUint32(post, 0x00030000)
+		out.Tables["post"] = post
+	}
+	if os2 := f.Tables["OS/2"]; len(os2) >= 68 && len(mapping) > 0 {
+		first, last := rune(0xFFFF), rune(0)
+		for r := range mapping {
+			first, last = min(first, r), max(last, r)
+		}
+		os2 = append([]byte{}, os2...)
+		binary.BigEndian.PutUint16(os2[64:], uint16(min(first, 0xFFFF)))
+		binary.BigEndian.PutUint16(os2[66:], uint16(min(last, 0xFFFF)))
+		out.Tables["OS/2"] = os2
+	}
+	res.Font = out
+	return res, nil
+}
+
+// A copy of f keeping only the glyphs in roots, the components they are
+// built from and .notdef; the rest are emptied, glyph IDs unchanged.
+// Tables that could lead to emptied glyphs are dropped. glyphs is
+// trueTypeGlyphs(f); returns the number of glyphs kept.
+func keepTrueTypeGlyphs(f *sfntFont, glyphs [][]byte, roots []int) (*sfntFont, int) {
+	numGlyphs := len(glyphs)
+	keep := make([]bool, numGlyphs)
+	kept := 0
+	stack := append([]int{0}, roots...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id >= numGlyphs || keep[id] {
+			continue
+		}
+		keep[id] = true
+		kept++
+		for _, c := range glyphComponents(glyphs[id]) {
+			stack = append(stack, int(c))
+		}
+	}
+
+	outlines := make([][]byte, numGlyphs)
+	for id := range outlines {
+		if keep[id] {
+			outlines[id] = glyphs[id]
+		}
+	}
+
+	// Zero the metrics of emptied glyphs so they compress away. The last
+	// long metric's advance also applies to every glyph after it, so it
+	// stays.
+	hmtx := append([]byte{}, f.Tables["hmtx"]...)
+	longMetrics := 0
+	if hhea := f.Tables["hhea"]; len(hhea) >= 36 {
+		longMetrics = int(binary.BigEndian.Uint16(hhea[34:]))
+	}
+	for id := 0; id < numGlyphs && longMetrics > 0; id++ {
+		if keep[id] {
+			continue
+		}
+		at, n := id*4, 4
+		switch {
+		case id == longMetrics-1:
+			at, n = id*4+2, 2
+		case id >= longMetrics:
+			at, n = longMetrics*4+(id-longMetrics)*2, 2
+		}
+		if at+n <= len(hmtx) {
+			copy(hmtx[at:at+n], []byte{0, 0, 0, 0})
+		}
+	}
+
+	out := &sfntFont{Flavor: f.Flavor, Tables: map[string][]byte{}}
+	for tag, t := range f.Tables {
+		if fontSubsetDropped[tag] {
+			continue
+		}
+		out.Tables[tag] = t
+	}
+	setTrueTypeGlyphs(out, outlines)
+	out.Tables["hmtx"] = hmtx
+	return out, kept
+}
+
+// A cmap with a Windows Unicode BMP subtable (format 4) and, when the
+// mapping goes beyond the BMP, a full-repertoire one (format 12)
+func buildCmap(mapping map[rune]uint16) []byte {
+	chars := make([]rune, 0, len(mapping))
+	for r := range mapping {
+		chars = append(chars, r)
+	}
+	sort.Slice(chars, func(a, b int) bool { return chars[a] < chars[b] })
+
+	// Runs of consecutive codepoints mapped to consecutive glyphs
+	type run struct {
+		start, end rune
+		glyph      uint16
+	}
+	var runs []run
+	for _, r := range chars {
+		if n := len(runs); n > 0 && runs[n-1].end == r-1 && int(runs[n-1].glyph)+int(r-runs[n-1].start) == int(mapping[r]) {
+			runs[n-1].end = r
+			continue
+		}
+		runs = append(runs, run{r, r, mapping[r]})
+	}
+
+	var bmp []run
+	for _, rn := range runs {
+		if rn.start >= 0xFFFF {
+			break
+		}
+		if rn.end >= 0xFFFF {
+			rn.end = 0xFFFE
+		}
+		bmp = append(bmp, rn)
+	}
+	bmp = append(bmp, run{0xFFFF, 0xFFFF, 0}) // required final segment, maps to .notdef
+	segs := len(bmp)
+	entrySelector := 0
+	for 1<<(entrySelector+1) <= segs {
+		entrySelector++
+	}
+	searchRange := 2 << entrySelector
+	f4 := make([]byte, 16+8*segs)
+	binary.BigEndian.PutUint16(f4, 4)
+	binary.BigEndian.PutUint16(f4[2:], uint16(len(f4)))
+	binary.BigEndian.PutUint16(f4[6:], uint16(segs*2))
+	binary.BigEndian.PutUint16(f4[8:], uint16(searchRange))
+	binary.BigEndian.PutUint16(f4[10:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(f4[12:], uint16(segs*2-searchRange))
+	for s, rn := range bmp {
+		delta := uint16(int(rn.glyph) - int(rn.start))
+		if rn.start == 0xFFFF {
+			delta = 1
+		}
+		binary.BigEndian.PutUint16(f4[14+s*2:], uint16(rn.end))
+		binary.BigEndian.PutUint16(f4[16+segs*2+s*2:], uint16(rn.start))
+		binary.BigEndian.PutUint16(f4[16+segs*4+s*2:], delta)
+	}
+	if len(f4) > 0xFFFF {
+		f4 = nil // too many segments; format 12 alone covers everything
+	}
+
+	var f12 []byte
+	if len(chars) > 0 && (chars[len(chars)-1] > 0xFFFF || f4 == nil) {
+		f12 = make([]byte, 16, 16+12*len(runs))
+		binary.BigEndian.PutUint16(f12, 12)
+		binary.BigEndian.PutUint32(f12[4:], uint32(16+12*len(runs)))
+		binary.BigEndian.PutUint32(f12[12:], uint32(len(runs)))
+		for _, rn := range runs {
+			f12 = binary.BigEndian.AppendUint32(f12, uint32(rn.start))
+			f12 = binary.BigEndian.AppendUint32(f12, uint32(rn.end))
+			f12 = binary.BigEndian.AppendUint32(f12, uint32(rn.glyph))
+		}
+	}
+
+	var subtables [][]byte
+	var encodings []uint16
+	if f4 != nil {
+		subtables, encodings = append(subtables, f4), append(encodings, 1)
+	}
+	if f12 != nil {
+		subtables, encodings = append(subtables, f12), append(encodings, 10)
+	}
+	out := make([]byte, 4+8*len(subtables))
+	binary.BigEndian.PutUint16(out[2:], uint16(len(subtables)))
+	for i, sub := range subtables {
+		binary.BigEndian.PutUint16(out[4+i*8:], 3)
+		binary.BigEndian.PutUint16(out[6+i*8:], encodings[i])
+		binary.BigEndian.PutUint32(out[8+i*8:], uint32(len(out)))
+		out = append(out, sub...)
+	}
+	return out
+}
+
+// WOFF2's variable-length integer: big-endian base 128, high bit set on
+// every byte but the last
+func appendUIntBase128(b []byte, v uint32) []byte {
+	var tmp [5]byte
+	n := 0
+	for {
+		tmp[4-n] = byte(v & 0x7F)
+		n++
+		if v >>= 7; v == 0 {
+			break
+		}
+	}
+	for i := 5 - n; i < 4; i++ {
+		tmp[i] |= 0x80
+	}
+	return append(b, tmp[5-n:]...)
+}
+
+// Wrap a font in WOFF2. Every table uses the null transform, which WOFF2
+// allows for glyf and loca too; brotli over the concatenated tables does
+// the compressing.
+func encodeWOFF2(f *sfntFont) ([]byte, error) {
+	// Take the tables from the serialized font so head carries the
+	// checksum adjustment a decoder's sfnt will match
+	sfnt := f.encode()
+	final, err := parseSFNT(sfnt)
+	if err != nil {
+		return nil, err
+	}
+	tags := final.sortedTags()
+	// loca has to follow glyf in the directory
+	if i := sort.SearchStrings(tags, "loca"); i < len(tags) && tags[i] == "loca" {
+		tags = append(tags[:i], tags[i+1:]...)
+		g := sort.SearchStrings(tags, "glyf")
+		tags = append(tags[:g+1], append([]string{"loca"}, tags[g+1:]...)...)
+	}
+
+	var dir, stream []byte
+	for _, tag := range tags {
+		t := final.Tables[tag]
+		flags := byte(63)
+		for i, known := range woff2KnownTags {
+			if known == tag {
+				flags = byte(i)
+				break
+			}
+		}
+		if tag == "glyf" || tag == "loca" {
+			flags |= 3 << 6 // null transform
+		}
+		dir = append(dir, flags)
+		if flags&63 == 63 {
+			dir = append(dir, tag...)
+		}
+		dir = appendUIntBase128(dir, uint32(len(t)))
+		stream = append(stream, t...)
+	}
+
+	var compressed bytes.Buffer
+	w := brotli.NewWriterLevel(&compressed, brotli.BestCompression)
+	if _, err := w.Write(stream); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 48, 48+len(dir)+compressed.Len()+3)
+	copy(out, "wOF2")
+	binary.BigEndian.PutUint32(out[4:], final.Flavor)
+	binary.BigEndian.PutUint16(out[12:], uint16(len(tags)))
+	binary.BigEndian.PutUint32(out[16:], uint32(len(sfnt)))
+	binary.BigEndian.PutUint32(out[20:], uint32(compressed.Len()))
+	if head := final.Tables["head"]; len(head) >= 8 {
+		copy(out[24:28], head[4:8]) // fontRevision as the WOFF version
+	}
+	out = append(out, dir...)
+	out = append(out, compressed.Bytes()...)
+	for len(out)%4 != 0 {
+		out = append(out, 0)
+	}
+	binary.BigEndian.PutUint32(out[8:], uint32(len(out)))
+	return out, nil
+}
+
+// Options for subsetFont
+type fontOptions struct {
+	Text     string   `json:"text"`     // characters to keep
+	Unicodes []string `json:"unicodes"` // ranges to keep, e.g. "U+0000-00FF"
+	Format   string   `json:"format"`   // "woff2" or "sfnt" (TTF/OTF)
+}
+
+func defaultFontOptions() fontOptions {
+	return fontOptions{Format: "woff2"}
+}
+
+// Subset (when text or ranges are given) and re-encode a font
+func subsetFontData(data []byte, opts fontOptions) ([]byte, fontSubset, error) {
+	switch opts.Format {
+	case "woff2", "sfnt":
+	default:
+		return nil, fontSubset{}, fmt.Errorf("unknown font format %q", opts.Format)
+	}
+	cs, err := parseFontCharset(opts.Text, opts.Unicodes)
+	if err != nil {
+		return nil, fontSubset{}, err
+	}
+	f, err := parseSFNT(data)
+	if err != nil {
+		return nil, fontSubset{}, err
+	}
+	res := fontSubset{Font: f}
+	if !cs.empty() {
+		if res, err = subsetTrueType(f, cs); err != nil {
+			return nil, fontSubset{}, err
+		}
+	}
+	if opts.Format == "sfnt" {
+		return res.Font.encode(), res, nil
+	}
+	out, err := encodeWOFF2(res.Font)
+	return out, res, err
+}
+
+// subsetFont(data, options?) subsets a TrueType font to the characters a
+// page needs and converts it to WOFF2. Options: {text, unicodes:
+// ["U+0000-00FF", ...], format: "woff2" | "sfnt"}. Without text or unicodes the font is only
+// converted, which also works for CFF-flavored OpenType. Glyph IDs are
+// preserved; GSUB is dropped, so ligatures fall back to single glyphs.
+// Resolves with the standard result object plus type, glyphs and
+// totalGlyphs (0 when not subset).
+func subsetFont(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] subsetFont called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("subsetFont", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("subsetFont", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := defaultFontOptions()
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+
+	return runAsync("subsetFont", func() (interface{}, error) {
+		j := startJob("subsetFont")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		out, res, err := subsetFontData(inputBytes, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCancelled(j.ctx); err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Font: %d -> %d bytes, %d of %d glyphs kept\n",
+			len(inputBytes), len(out), res.Glyphs, res.TotalGlyphs)
+
+		var messages []message
+		if len(res.Missing) > 0 {
+			messages = append(messages, newMessage("font.missingChars", "count", len(res.Missing), "chars", string(res.Missing)))
+		}
+		if res.DroppedGSUB {
+			messages = append(messages, newMessage("font.gsubDropped"))
+		}
+		result := newResultObject(inputBytes, out)
+		result.Set("type", sniffMimeType(out))
+		result.Set("glyphs", res.Glyphs)
+		result.Set("totalGlyphs", res.TotalGlyphs)
+		setMessages(result, messages)
+		return result, nil
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestFontSubset(t *testing.T) {
+	data := fixtureTTF()
+	if sniffMimeType(data) != "font/ttf" {
+		t.Fatalf("sniffed %s", sniffMimeType(data))
+	}
+	opts := fontOptions{Text: "B\u00e9", Format: "sfnt"}
+	out, res, err := subsetFontData(data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Glyphs != 3 || string(res.Missing) != "\u00e9" || !res.DroppedGSUB {
+		t.Fatalf("kept %d glyphs, missing %q, GSUB dropped %v", res.Glyphs, string(res.Missing), res.DroppedGSUB)
+	}
+	if sfntChecksum(out) != 0xB1B0AFBA {
+		t.Fatal("checkSumAdjustment wrong")
+	}
+	f, err := parseSFNT(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmap, err := parseCmap(f.Tables["cmap"])
+	if err != nil || len(cmap) != 1 || cmap['B'] != 2 {
+		t.Fatalf("cmap %v: %v", cmap, err)
+	}
+	// Short loca now; "C" (glyph 3) emptied, the component "A" kept
+	loca := f.Tables["loca"]
+	if len(loca) != 10 || binary.BigEndian.Uint16(loca[6:]) != binary.BigEndian.Uint16(loca[8:]) ||
+		binary.BigEndian.Uint16(loca[2:]) == binary.BigEndian.Uint16(loca[4:]) {
+		t.Fatalf("loca %x", loca)
+	}
+	if f.Tables["GSUB"] != nil || len(f.Tables["post"]) != 32 {
+		t.Fatal("GSUB or glyph names left in")
+	}
+
+	// WOFF2 must unpack to the same tables
+	opts.Format = "woff2"
+	woff2, _, err := subsetFontData(data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sniffMimeType(woff2) != "font/woff2" || int(binary.BigEndian.Uint32(woff2[8:])) != len(woff2) ||
+		int(binary.BigEndian.Uint32(woff2[16:])) != len(out) {
+		t.Fatal("WOFF2 header wrong")
+	}
+	at := 48
+	type entry struct {
+		tag    string
+		length int
+	}
+	var entries []entry
+	for i := 0; i < int(binary.BigEndian.Uint16(woff2[12:])); i++ {
+		flags := woff2[at]
+		at++
+		tag := ""
+		if flags&63 == 63 {
+			tag, at = string(woff2[at:at+4]), at+4
+		} else {
+			tag = woff2KnownTags[flags&63]
+		}
+		n := 0
+		for {
+			b := woff2[at]
+			at++
+			n = n<<7 | int(b&0x7F)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		entries = append(entries, entry{tag, n})
+	}
+	size := int(binary.BigEndian.Uint32(woff2[20:]))
+	stream, err := io.ReadAll(brotli.NewReader(bytes.NewReader(woff2[at : at+size])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !bytes.Equal(stream[:e.length], f.Tables[e.tag]) {
+			t.Fatalf("WOFF2 table %q differs", e.tag)
+		}
+		stream = stream[e.length:]
+	}
+	if len(entries) != len(f.Tables) || len(stream) != 0 {
+		t.Fatal("WOFF2 table directory does not match")
+	}
+}
@@ -2,6 +2,13 @@ module pdf-turbo-wasm
 
 go 1.22
 
-require github.com/disintegration/imaging v1.6.2
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/disintegration/imaging v1.6.2
+	github.com/klauspost/compress v1.18.0
+	github.com/nwaples/rardecode/v2 v2.2.0
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/image v0.15.0
+)
 
-require golang.org/x/image v0.15.0 // indirect
+require golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// HEIF/HEIC containers (ISO-BMFF with a meta box) can hold several
+// full-size images: burst shots, the stills of a live photo, edits next to
+// originals. Only the primary item is what viewers show. HEVC has no Go
+// decoder, so pixels come from the browser, which only ever decodes the
+// primary item; other images are decoded by pointing pitm at them.
+
+// One item of the meta box
+type heifItem struct {
+	ID     uint32 `json:"id"`
+	Type   string `json:"type"` // hvc1, grid, av01, jpeg, Exif, mime, ...
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Hidden bool   `json:"-"`
+
+	Primary bool `json:"primary"`
+}
+
+// What parseHEIF learns from the meta box
+type heifFile struct {
+	Items      []heifItem
+	Primary    uint32
+	pitmOffset int // where the primary item ID is stored
+	pitmWide   bool
+	refs       map[string]map[uint32]bool // reference type -> items referring (thmb, auxl) or referred to (dimg)
+}
+
+// A box: type, where its header starts and its payload bounds
+type isoBox struct {
+	Type       string
+	Offset     int
+	Start, End int // payload
+}
+
+// Boxes directly inside data[start:end]
+func isoBoxes(data []byte, start, end int) []isoBox {
+	var boxes []isoBox
+	for at := start; at+8 <= end; {
+		size := int(binary.BigEndian.Uint32(data[at:]))
+		typ := string(data[at+4 : at+8])
+		header := 8
+		switch size {
+		case 0:
+			size = end - at
+		case 1:
+			if at+16 > end {
+				return boxes
+			}
+			large := binary.BigEndian.Uint64(data[at+8:])
+			if large > uint64(end-at) {
+				return boxes
+			}
+			size, header = int(large), 16
+		}
+		if size < header || at+size > end {
+			return boxes
+		}
+		boxes = append(boxes, isoBox{Type: typ, Offset: at, Start: at + header, End: at + size})
+		at += size
+	}
+	return boxes
+}
+
+// Image item types a browser can decode once they are primary
+var heifImageTypes = map[string]bool{"hvc1": true, "grid": true, "av01": true, "jpeg": true, "iden": true, "iovl": true}
+
+func parseHEIF(data []byte) (heifFile, error) {
+	f := heifFile{refs: map[string]map[uint32]bool{}}
+	var meta *isoBox
+	for _, b := range isoBoxes(data, 0, len(data)) {
+		if b.Type == "meta" {
+			b := b
+			meta = &b
+			break
+		}
+	}
+	if meta == nil || meta.End-meta.Start < 4 {
+		return f, errors.New("no HEIF meta box")
+	}
+
+	sizes := map[uint32][2]int{}
+	var props []isoBox
+	for _, b := range isoBoxes(data, meta.Start+4, meta.End) {
+		if b.End-b.Start < 4 {
+			continue
+		}
+		version := data[b.Start]
+		body := b.Start + 4
+		switch b.Type {
+		case "pitm":
+			f.pitmOffset, f.pitmWide = body, version > 0
+			if version == 0 && body+2 <= b.End {
+				f.Primary = uint32(binary.BigEndian.Uint16(data[body:]))
+			} else if body+4 <= b.End {
+				f.Primary = binary.BigEndian.Uint32(data[body:])
+			}
+		case "iinf":
+			skip := 2
+			if version > 0 {
+				skip = 4
+			}
+			for _, infe := range isoBoxes(data, body+skip, b.End) {
+				if item, ok := parseInfe(data, infe); ok {
+					f.Items = append(f.Items, item)
+				}
+			}
+		case "iref":
+			wide := version > 0
+			for _, ref := range isoBoxes(data, body, b.End) {
+				parseIref(data, ref, wide, f.refs)
+			}
+		case "iprp":
+			for _, c := range isoBoxes(data, b.Start, b.End) {
+				switch c.Type {
+				case "ipco":
+					props = isoBoxes(data, c.Start, c.End)
+				case "ipma":
+					for id, size := range parseIpma(data, c, props) {
+						sizes[id] = size
+					}
+				}
+			}
+		}
+	}
+	if len(f.Items) == 0 {
+		return f, errors.New("HEIF file lists no items")
+	}
+	for i := range f.Items {
+		f.Items[i].Width, f.Items[i].Height = sizes[f.Items[i].ID][0], sizes[f.Items[i].ID][1]
+		f.Items[i].Primary = f.Items[i].ID == f.Primary
+	}
+	return f, nil
+}
+
+// Item info entry, versions 2 and 3 (the ones that carry a type)
+func parseInfe(data []byte, b isoBox) (heifItem, bool) {
+	if b.Type != "infe" || b.End-b.Start < 12 {
+		return heifItem{}, false
+	}
+	version, flags := data[b.Start], data[b.Start+3]
+	at := b.Start + 4
+	var item heifItem
+	switch version {
+	case 2:
+		item.ID = uint32(binary.BigEndian.Uint16(data[at:]))
+		at += 2
+	case 3:
+		if b.End-at < 10 {
+			return heifItem{}, false
+		}
+		item.ID = binary.BigEndian.Uint32(data[at:])
+		at += 4
+	default:
+		return heifItem{}, false
+	}
+	at += 2 // protection index
+	item.Type = string(data[at : at+4])
+	item.Hidden = flags&1 != 0
+	return item, true
+}
+
+// Record a reference box: thmb and auxl point from the thumbnail or
+// auxiliary image, dimg from a grid to its tiles
+func parseIref(data []byte, b isoBox, wide bool, refs map[string]map[uint32]bool) {
+	id := func(at int) (uint32, int) {
+		if wide {
+			if at+4 > b.End {
+				return 0, -1
+			}
+			return binary.BigEndian.Uint32(data[at:]), at + 4
+		}
+		if at+2 > b.End {
+			return 0, -1
+		}
+		return uint32(binary.BigEndian.Uint16(data[at:])), at + 2
+	}
+	from, at := id(b.Start)
+	if at < 0 || at+2 > b.End {
+		return
+	}
+	count := int(binary.BigEndian.Uint16(data[at:]))
+	at += 2
+	if refs[b.Type] == nil {
+		refs[b.Type] = map[uint32]bool{}
+	}
+	if b.Type != "dimg" {
+		refs[b.Type][from] = true
+		return
+	}
+	for i := 0; i < count; i++ {
+		var to uint32
+		if to, at = id(at); at < 0 {
+			return
+		}
+		refs[b.Type][to] = true
+	}
+}
+
+// Width and height from each item's ispe property
+func parseIpma(data []byte, b isoBox, props []isoBox) map[uint32][2]int {
+	out := map[uint32][2]int{}
+	if b.End-b.Start < 8 {
+		return out
+	}
+	version, flags := data[b.Start], data[b.Start+3]
+	at := b.Start + 4
+	entries := int(binary.BigEndian.Uint32(data[at:]))
+	at += 4
+	for e := 0; e < entries; e++ {
+		var id uint32
+		if version < 1 {
+			if at+3 > b.End {
+				return out
+			}
+			id = uint32(binary.BigEndian.Uint16(data[at:]))
+			at += 2
+		} else {
+			if at+5 > b.End {
+				return out
+			}
+			id = binary.BigEndian.Uint32(data[at:])
+			at += 4
+		}
+		count := int(data[at])
+		at++
+		for a := 0; a < count; a++ {
+			var index int
+			if flags&1 != 0 {
+				if at+2 > b.End {
+					return out
+				}
+				index = int(binary.BigEndian.Uint16(data[at:]) & 0x7FFF)
+				at += 2
+			} else {
+				if at+1 > b.End {
+					return out
+				}
+				index = int(data[at] & 0x7F)
+				at++
+			}
+			// Property indices are 1-based; 0 means none
+			if index < 1 || index > len(props) {
+				continue
+			}
+			p := props[index-1]
+			if p.Type == "ispe" && p.End-p.Start >= 12 {
+				out[id] = [2]int{int(binary.BigEndian.Uint32(data[p.Start+4:])), int(binary.BigEndian.Uint32(data[p.Start+8:]))}
+			}
+		}
+	}
+	return out
+}
+
+// Images a person would see as separate pictures: visible image items that
+// are not a thumbnail, an auxiliary image (alpha, depth) or a grid tile.
+// The primary item comes first.
+func (f heifFile) topLevelImages() []heifItem {
+	var out []heifItem
+	for _, item := range f.Items {
+		if !heifImageTypes[item.Type] || item.Hidden ||
+			f.refs["thmb"][item.ID] || f.refs["auxl"][item.ID] || f.refs["dimg"][item.ID] {
+			continue
+		}
+		if item.Primary {
+			out = append([]heifItem{item}, out...)
+		} else {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// A copy of the file whose primary item is id, so a decoder that only
+// handles the primary item decodes that one
+func (f heifFile) withPrimary(data []byte, id uint32) ([]byte, error) {
+	if f.pitmOffset == 0 {
+		return nil, errors.New("HEIF file has no primary item box")
+	}
+	if !f.pitmWide && id > 0xFFFF {
+		return nil, fmt.Errorf("item %d does not fit the primary item box", id)
+	}
+	out := append([]byte(nil), data...)
+	if f.pitmWide {
+		binary.BigEndian.PutUint32(out[f.pitmOffset:], id)
+	} else {
+		binary.BigEndian.PutUint16(out[f.pitmOffset:], uint16(id))
+	}
+	return out, nil
+}
+
+// Which images of a HEIF file to process
+const (
+	heifPrimary = "primary"
+	heifAll     = "all"
+)
+
+// Options for extractHeifImages; image options come from the same object
+type heifOptions struct {
+	Images string   `json:"images"` // "primary" or "all"
+	IDs    []uint32 `json:"ids"`    // explicit item IDs, overriding images
+}
+
+// listHeifImages(data) resolves with {primary, images: [{id, type, width,
+// height, primary}]}, the separate pictures of a HEIF/HEIC file (burst
+// shots, live photo stills), primary first. Thumbnails, alpha and depth
+// maps and grid tiles are left out. Nothing is decoded.
+func listHeifImages(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("listHeifImages", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+
+	return runAsync("listHeifImages", func() (interface{}, error) {
+		f, err := parseHEIF(inputBytes)
+		if err != nil {
+			return nil, err
+		}
+		images := f.topLevelImages()
+		fmt.Printf("[WASM] HEIF lists %d items, %d images\n", len(f.Items), len(images))
+		return jsonToJS(map[string]interface{}{"primary": f.Primary, "images": images})
+	})
+}
+
+// extractHeifImages(data, options?, progress?) compresses the chosen
+// images of a HEIF/HEIC file. Options: {images: "primary" | "all", ids}
+// plus any compressImage options. Resolves with one standard result object
+// per image, carrying id, width and height. Decoding uses the browser's
+// HEIC support (Safari); elsewhere the promise rejects.
+func extractHeifImages(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] extractHeifImages called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("extractHeifImages", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("extractHeifImages", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := heifOptions{Images: heifPrimary}
+	imgOpts := currentSettings().Image
+	var optsErr error
+	if len(args) > 1 {
+		if optsErr = decodeOptions(args[1], &opts); optsErr == nil {
+			optsErr = decodeOptions(args[1], &imgOpts)
+		}
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+
+	return runAsync("extractHeifImages", func() (interface{}, error) {
+		j := startJob("extractHeifImages")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		reportProgress := progressReporter(progressCallback, j)
+		f, err := parseHEIF(inputBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		images := f.topLevelImages()
+		switch {
+		case len(opts.IDs) > 0:
+			byID := map[uint32]heifItem{}
+			for _, item := range images {
+				byID[item.ID] = item
+			}
+			images = images[:0]
+			for _, id := range opts.IDs {
+				item, ok := byID[id]
+				if !ok {
+					return nil, fmt.Errorf("item %d is not an image of this file", id)
+				}
+				images = append(images, item)
+			}
+		case opts.Images == heifPrimary:
+			images = images[:minInt(1, len(images))]
+		case opts.Images != heifAll:
+			return nil, fmt.Errorf("unknown images selection %q", opts.Images)
+		}
+		if len(images) == 0 {
+			return nil, errors.New("HEIF file has no images")
+		}
+
+		results := js.Global().Get("Array").New(len(images))
+		for i, item := range images {
+			if err := checkCancelled(j.ctx); err != nil {
+				return nil, err
+			}
+			single, err := f.withPrimary(inputBytes, item.ID)
+			if err != nil {
+				return nil, err
+			}
+			res, err := compressImageData(j.ctx, single, "image/heic", imgOpts, func(p int) {
+				reportProgress((i*100 + p) / len(images))
+			})
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %v", item.ID, err)
+			}
+			result := newResultObject(single, res.Data)
+			result.Set("id", item.ID)
+			result.Set("width", item.Width)
+			result.Set("height", item.Height)
+			result.Set("type", sniffMimeType(res.Data))
+			var warnings []message
+			for _, m := range res.Warnings {
+				if m.Code != "image.heifMoreImages" {
+					warnings = append(warnings, m)
+				}
+			}
+			setMessages(result, warnings)
+			results.SetIndex(i, result)
+		}
+		return results, nil
+	})
+}
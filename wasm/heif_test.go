@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHEIFImages(t *testing.T) {
+	data := fixtureHEIF()
+	if sniffMimeType(data) != "image/heic" {
+		t.Fatalf("sniffed %s", sniffMimeType(data))
+	}
+	f, err := parseHEIF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := f.topLevelImages()
+	if len(images) != 2 || images[0].ID != 1 || !images[0].Primary || images[1].Width != 4032 {
+		t.Fatalf("images %+v", images)
+	}
+	second, err := f.withPrimary(data, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err := parseHEIF(second); err != nil || g.Primary != 2 || len(second) != len(data) {
+		t.Fatalf("primary not moved: %v", err)
+	}
+}
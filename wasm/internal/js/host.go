@@ -0,0 +1,67 @@
+//go:build !js
+
+package js
+
+type Type int
+
+const (
+	TypeUndefined Type = iota
+	TypeNull
+	TypeBoolean
+	TypeNumber
+	TypeString
+	TypeSymbol
+	TypeObject
+	TypeFunction
+)
+
+func (t Type) String() string {
+	return [...]string{"undefined", "null", "boolean", "number", "string", "symbol", "object", "function"}[t]
+}
+
+// There is no JavaScript behind a Value on the host: every Value is
+// undefined and anything that would reach into JavaScript panics
+type Value struct{}
+
+type Func struct {
+	Value
+}
+
+type Error struct {
+	Value
+}
+
+func (e Error) Error() string { return "JavaScript error: undefined" }
+
+func noJS() { panic("js: no JavaScript outside GOOS=js") }
+
+func Global() Value                           { noJS(); return Value{} }
+func Null() Value                             { noJS(); return Value{} }
+func Undefined() Value                        { return Value{} }
+func ValueOf(x any) Value                     { noJS(); return Value{} }
+func FuncOf(fn func(Value, []Value) any) Func { noJS(); return Func{} }
+func CopyBytesToGo(dst []byte, src Value) int { noJS(); return 0 }
+func CopyBytesToJS(dst Value, src []byte) int { noJS(); return 0 }
+
+func (f Func) Release() {}
+
+func (v Value) Bool() bool                       { noJS(); return false }
+func (v Value) Call(m string, args ...any) Value { noJS(); return v }
+func (v Value) Delete(p string)                  { noJS() }
+func (v Value) Equal(w Value) bool               { return true }
+func (v Value) Float() float64                   { noJS(); return 0 }
+func (v Value) Get(p string) Value               { noJS(); return v }
+func (v Value) Index(i int) Value                { noJS(); return v }
+func (v Value) InstanceOf(t Value) bool          { noJS(); return false }
+func (v Value) Int() int                         { noJS(); return 0 }
+func (v Value) Invoke(args ...any) Value         { noJS(); return v }
+func (v Value) IsNaN() bool                      { return false }
+func (v Value) IsNull() bool                     { return false }
+func (v Value) IsUndefined() bool                { return true }
+func (v Value) Length() int                      { noJS(); return 0 }
+func (v Value) New(args ...any) Value            { noJS(); return v }
+func (v Value) Set(p string, x any)              { noJS() }
+func (v Value) SetIndex(i int, x any)            { noJS() }
+func (v Value) String() string                   { return "<undefined>" }
+func (v Value) Truthy() bool                     { return false }
+func (v Value) Type() Type                       { return TypeUndefined }
@@ -0,0 +1,36 @@
+//go:build js
+
+// Package js is syscall/js when the module is built for the browser. On
+// any other GOOS it is a stand-in whose calls into JavaScript panic, so
+// the package main code that never touches JavaScript (the parsers and
+// codecs) builds natively and runs under go test -fuzz, which js/wasm
+// does not support.
+package js
+
+import "syscall/js"
+
+type (
+	Value = js.Value
+	Func  = js.Func
+	Error = js.Error
+	Type  = js.Type
+)
+
+const (
+	TypeUndefined = js.TypeUndefined
+	TypeNull      = js.TypeNull
+	TypeBoolean   = js.TypeBoolean
+	TypeNumber    = js.TypeNumber
+	TypeString    = js.TypeString
+	TypeSymbol    = js.TypeSymbol
+	TypeObject    = js.TypeObject
+	TypeFunction  = js.TypeFunction
+)
+
+func Global() Value                           { return js.Global() }
+func Null() Value                             { return js.Null() }
+func Undefined() Value                        { return js.Undefined() }
+func ValueOf(x any) Value                     { return js.ValueOf(x) }
+func FuncOf(fn func(Value, []Value) any) Func { return js.FuncOf(fn) }
+func CopyBytesToGo(dst []byte, src Value) int { return js.CopyBytesToGo(dst, src) }
+func CopyBytesToJS(dst Value, src []byte) int { return js.CopyBytesToJS(dst, src) }
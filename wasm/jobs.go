@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Returned by pipelines that notice their job was cancelled
+var errCancelled = errors.New("job cancelled")
+
+// Priority lanes. Background jobs pause at their cancellation checkpoints
+// while any interactive job runs, so a single image the user is waiting
+// for does not queue behind a long batch.
+const (
+	laneInteractive = "interactive"
+	laneBackground  = "background"
+)
+
+// How long a background job runs before it sleeps briefly, letting the JS
+// event loop deliver calls that arrived in the meantime
+const backgroundSlice = 50 * time.Millisecond
+
+// Job kinds that run in the background lane unless the caller says
+// otherwise
+var backgroundKinds = map[string]bool{"batch": true, "recompressZip": true}
+
+// Options selecting a job's lane, read from an entry point's options
+type laneOptions struct {
+	Priority string `json:"priority"` // "interactive" or "background"
+}
+
+func (o laneOptions) validate() error {
+	switch o.Priority {
+	case "", laneInteractive, laneBackground:
+		return nil
+	}
+	return fmt.Errorf("unknown priority %q", o.Priority)
+}
+
+// One in-flight compression call
+type job struct {
+	id     int64
+	kind   string
+	lane   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	parent *job // set for the per-file jobs of a batch
+
+	lastYield time.Time
+}
+
+// Context key under which a job's context carries the job
+type jobKey struct{}
+
+var (
+	jobsMu    sync.Mutex
+	jobs      = map[int64]*job{}
+	nextJobID int64
+
+	// Set by cancelAll so memory is released again once the cancelled
+	// goroutines have actually dropped their buffers
+	releasePending bool
+
+	// Interactive jobs running, and a channel closed when that drops to 0
+	interactiveJobs int
+	interactiveIdle = closedChannel()
+)
+
+func closedChannel() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// Register a new job in its kind's default lane; callers must call finish
+// when done
+func startJob(kind string) *job {
+	return startJobInLane(kind, "")
+}
+
+// Register a new job in the given lane ("" for the kind's default)
+func startJobInLane(kind, lane string) *job {
+	if lane == "" {
+		lane = laneInteractive
+		if backgroundKinds[kind] {
+			lane = laneBackground
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	nextJobID++
+	j := &job{id: nextJobID, kind: kind, lane: lane, cancel: cancel, lastYield: time.Now()}
+	j.ctx = context.WithValue(ctx, jobKey{}, j)
+	jobs[j.id] = j
+	if lane == laneInteractive {
+		if interactiveJobs == 0 {
+			interactiveIdle = make(chan struct{})
+		}
+		interactiveJobs++
+	}
+	return j
+}
+
+// Register a job for one part of j, e.g. a file of a batch. Cancelling j
+// cancels it too, while cancelling it leaves j running. It shares j's
+// lane and does not count towards it separately.
+func (j *job) startChild(kind string) *job {
+	ctx, cancel := context.WithCancel(j.ctx)
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	nextJobID++
+	child := &job{id: nextJobID, kind: kind, lane: j.lane, cancel: cancel, parent: j, lastYield: time.Now()}
+	child.ctx = context.WithValue(ctx, jobKey{}, child)
+	jobs[child.id] = child
+	return child
+}
+
+// Remove the job from the registry and release its context
+func (j *job) finish() {
+	jobsMu.Lock()
+	if _, ok := jobs[j.id]; ok && j.lane == laneInteractive && j.parent == nil {
+		interactiveJobs--
+		if interactiveJobs == 0 {
+			close(interactiveIdle)
+		}
+	}
+	delete(jobs, j.id)
+	release := releasePending && len(jobs) == 0
+	if release {
+		releasePending = false
+	}
+	jobsMu.Unlock()
+	j.cancel()
+
+	if release {
+		before, after := releaseMemory()
+		fmt.Printf("[WASM] Cancelled jobs drained, heap %d -> %d bytes\n", before, after)
+	}
+}
+
+// Cancel every registered job; returns how many were running
+func cancelAllJobs() int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		j.cancel()
+	}
+	releasePending = len(jobs) > 0
+	return len(jobs)
+}
+
+// Number of registered jobs, batch files included
+func runningJobs() int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return len(jobs)
+}
+
+// Cancel one registered job; false when no such job is running
+func cancelJobByID(id int64) bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, ok := jobs[id]
+	if ok {
+		j.cancel()
+	}
+	return ok
+}
+
+// Translate a done context into errCancelled. Background jobs also give
+// way here to interactive ones.
+func checkCancelled(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return errCancelled
+	}
+	if j, ok := ctx.Value(jobKey{}).(*job); ok && j.lane == laneBackground {
+		j.yield()
+		if ctx.Err() != nil {
+			return errCancelled
+		}
+	}
+	return nil
+}
+
+// Let the event loop run once per slice, then wait until no interactive
+// job is running or this job is cancelled
+func (j *job) yield() {
+	if time.Since(j.lastYield) >= backgroundSlice {
+		time.Sleep(time.Millisecond)
+		j.lastYield = time.Now()
+	}
+
+	jobsMu.Lock()
+	idle := interactiveIdle
+	waiting := interactiveJobs
+	jobsMu.Unlock()
+	if waiting == 0 {
+		return
+	}
+	fmt.Printf("[WASM] %s job %d paused for %d interactive jobs\n", j.kind, j.id, waiting)
+	select {
+	case <-idle:
+	case <-j.ctx.Done():
+	}
+	j.lastYield = time.Now()
+}
+
+// Force a collection and hand free spans back to the Go scavenger. WASM
+// linear memory cannot shrink, but released pages are reused before the
+// heap grows again.
+func releaseMemory() (before, after uint64) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	before = mem.HeapAlloc
+
+	runtime.GC()
+	debug.FreeOSMemory()
+
+	runtime.ReadMemStats(&mem)
+	return before, mem.HeapAlloc
+}
+
+// cancelJob(id) aborts one job, such as a single file of a running batch
+// (see compressBatch's jobIds), and returns whether it was still running.
+// A cancelled batch file is returned unchanged; the batch carries on.
+func cancelJob(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 || args[0].Type() != js.TypeNumber {
+		return false
+	}
+	id := int64(args[0].Int())
+	cancelled := cancelJobByID(id)
+	fmt.Printf("[WASM] cancelJob(%d): %v\n", id, cancelled)
+	return cancelled
+}
+
+// cancelAll() aborts every in-flight job (their promises reject with
+// "job cancelled"), drops their pending work and frees memory. Returns
+// {cancelled, heapBefore, heapAfter} synchronously.
+func cancelAll(this js.Value, args []js.Value) interface{} {
+	cancelled := cancelAllJobs()
+	before, after := releaseMemory()
+	fmt.Printf("[WASM] cancelAll: cancelled %d jobs, heap %d -> %d bytes\n", cancelled, before, after)
+
+	result := js.Global().Get("Object").New()
+	result.Set("cancelled", cancelled)
+	result.Set("heapBefore", before)
+	result.Set("heapAfter", after)
+	return result
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLanes(t *testing.T) {
+	background := startJobInLane("selftest", laneBackground)
+	defer background.finish()
+	interactive := startJobInLane("selftest", laneInteractive)
+	resumed := make(chan struct{})
+	go func() {
+		checkCancelled(background.ctx)
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		interactive.finish()
+		t.Fatal("background job did not pause for an interactive one")
+	case <-time.After(20 * time.Millisecond):
+	}
+	interactive.finish()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("background job did not resume")
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	batch := startJobInLane("selftest", laneBackground)
+	defer batch.finish()
+	first, second := batch.startChild("file"), batch.startChild("file")
+	defer first.finish()
+	defer second.finish()
+	if !cancelJobByID(first.id) || checkCancelled(first.ctx) != errCancelled {
+		t.Fatal("file job not cancelled")
+	}
+	if batch.ctx.Err() != nil || second.ctx.Err() != nil {
+		t.Fatal("cancelling one file cancelled others")
+	}
+	batch.cancel()
+	if second.ctx.Err() == nil {
+		t.Fatal("cancelling the batch left a file running")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+)
+
+// One JPEG marker segment. The entropy-coded data following an SOS
+// segment travels with it in Scan, so the segments of a file reassemble
+// into the same bytes.
+type jpegSegment struct {
+	Marker  byte
+	Payload []byte // without the length field; nil for standalone markers
+	Scan    []byte // entropy-coded data, after SOS only
+}
+
+// Markers without a length field
+func jpegStandalone(marker byte) bool {
+	return marker == 0x01 || marker == 0xD8 || marker == 0xD9 || (marker >= 0xD0 && marker <= 0xD7)
+}
+
+// Parse a JPEG file marker by marker, from SOI to EOI, following segment
+// lengths rather than searching for marker bytes (which also occur inside
+// EXIF thumbnails and other payloads). Returns the segments and the
+// length of the JPEG; data after EOI is not looked at.
+func parseJPEG(data []byte) ([]jpegSegment, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errors.New("not a JPEG file")
+	}
+	segments := []jpegSegment{{Marker: 0xD8}}
+	at := 2
+	for {
+		if at+2 > len(data) {
+			return nil, 0, errors.New("JPEG ends without an EOI marker")
+		}
+		if data[at] != 0xFF {
+			return nil, 0, fmt.Errorf("expected a marker at offset %d", at)
+		}
+		marker := data[at+1]
+		if marker == 0xFF { // fill byte
+			at++
+			continue
+		}
+		if marker == 0xD9 {
+			return append(segments, jpegSegment{Marker: marker}), at + 2, nil
+		}
+		if jpegStandalone(marker) {
+			segments = append(segments, jpegSegment{Marker: marker})
+			at += 2
+			continue
+		}
+
+		if at+4 > len(data) {
+			return nil, 0, errors.New("truncated JPEG segment")
+		}
+		length := int(data[at+2])<<8 | int(data[at+3])
+		if length < 2 || at+2+length > len(data) {
+			return nil, 0, fmt.Errorf("JPEG segment 0x%02X at offset %d overruns the file", marker, at)
+		}
+		seg := jpegSegment{Marker: marker, Payload: data[at+4 : at+2+length]}
+		at += 2 + length
+
+		if marker == 0xDA {
+			// Entropy-coded data runs to the next marker that is neither
+			// a stuffed zero nor a restart marker
+			start := at
+			for {
+				if at+1 >= len(data) {
+					return nil, 0, errors.New("JPEG scan data is truncated")
+				}
+				if data[at] == 0xFF {
+					next := data[at+1]
+					if next != 0x00 && !(next >= 0xD0 && next <= 0xD7) {
+						break
+					}
+					at += 2
+					continue
+				}
+				at++
+			}
+			seg.Scan = data[start:at]
+		}
+		segments = append(segments, seg)
+	}
+}
+
+// Reassemble segments into a JPEG file
+func writeJPEGSegments(segments []jpegSegment) []byte {
+	size := 0
+	for _, s := range segments {
+		size += 4 + len(s.Payload) + len(s.Scan)
+	}
+	out := bytes.NewBuffer(make([]byte, 0, size))
+	for _, s := range segments {
+		out.Write([]byte{0xFF, s.Marker})
+		if !jpegStandalone(s.Marker) {
+			length := len(s.Payload) + 2
+			out.Write([]byte{byte(length >> 8), byte(length)})
+			out.Write(s.Payload)
+		}
+		out.Write(s.Scan)
+	}
+	return out.Bytes()
+}
+
+// Whether data decodes as a JPEG
+func jpegDecodes(data []byte) bool {
+	_, err := jpeg.Decode(bytes.NewReader(data))
+	return err == nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// IJG base quantization tables in zigzag order, as image/jpeg and libjpeg
+// scale them for a given quality
+var ijgQuantTables = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// Quality a JPEG was saved at, judged by its quantization tables
+type jpegQualityEstimate struct {
+	Quality int  `json:"quality"`
+	Exact   bool `json:"exact"`  // the tables are IJG tables for exactly this quality
+	Tables  int  `json:"tables"` // quantization tables found
+}
+
+// Collect the quantization tables (zigzag order) by table id, stopping at
+// the first scan
+func jpegQuantTables(data []byte) (map[int][64]int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+	tables := map[int][64]int{}
+	var err error
+	jpegSegments(data, func(marker byte, seg []byte) {
+		for marker == 0xDB && len(seg) > 0 && err == nil {
+			precision, id := int(seg[0]>>4), int(seg[0]&0x0F)
+			size := 64 * (precision + 1)
+			if len(seg) < 1+size {
+				err = errors.New("corrupt JPEG: short quantization table")
+				return
+			}
+			var table [64]int
+			for i := range table {
+				if precision == 0 {
+					table[i] = int(seg[1+i])
+				} else {
+					table[i] = int(seg[1+2*i])<<8 | int(seg[2+2*i])
+				}
+			}
+			tables[id] = table
+			seg = seg[1+size:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tables) == 0 {
+		return nil, errors.New("JPEG has no quantization tables")
+	}
+	return tables, nil
+}
+
+// IJG table entry for base value v at quality q
+func ijgScale(v, quality int) int {
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	x := (v*scale + 50) / 100
+	if x < 1 {
+		return 1
+	}
+	if x > 255 {
+		return 255
+	}
+	return x
+}
+
+// Find the IJG quality whose tables are closest to the file's. Encoders
+// with their own tables (Photoshop, some cameras) get the nearest match.
+func estimateJPEGQuality(data []byte) (jpegQualityEstimate, error) {
+	tables, err := jpegQuantTables(data)
+	if err != nil {
+		return jpegQualityEstimate{}, err
+	}
+	best := jpegQualityEstimate{Tables: len(tables)}
+	bestErr := -1
+	for quality := 1; quality <= 100; quality++ {
+		diff := 0
+		for id, table := range tables {
+			base := ijgQuantTables[minInt(id, 1)]
+			for i, v := range table {
+				d := v - ijgScale(base[i], quality)
+				if d < 0 {
+					d = -d
+				}
+				diff += d
+			}
+		}
+		if bestErr < 0 || diff < bestErr {
+			best.Quality, bestErr = quality, diff
+		}
+	}
+	best.Exact = bestErr == 0
+	return best, nil
+}
+
+// estimateJpegQuality(data) reads a JPEG's quantization tables and
+// resolves with {quality, exact, tables}: the IJG quality (1-100) they
+// correspond to, whether they match that quality exactly, and how many
+// tables the file has.
+func estimateJpegQuality(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] estimateJpegQuality called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("estimateJpegQuality", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+	release, err := reserveInput(args[0].Length())
+	if err != nil {
+		return runAsync("estimateJpegQuality", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+
+	return runAsync("estimateJpegQuality", func() (interface{}, error) {
+		defer release()
+		est, err := estimateJPEGQuality(inputBytes)
+		if err != nil {
+			return nil, err
+		}
+		return jsonToJS(est)
+	})
+}
+
+// Reject qualities the JPEG encoder would clamp
+func checkQualityLadder(qualities []int) error {
+	for _, q := range qualities {
+		if q < 1 || q > 100 {
+			return fmt.Errorf("JPEG quality %d out of range [1, 100]", q)
+		}
+	}
+	return nil
+}
+
+// A caller's quality list, highest first and without repeats; empty
+// gives the default ladder
+func descendingQualities(qualities []int) []int {
+	if len(qualities) == 0 {
+		return ladderQualities
+	}
+	out := append([]int(nil), qualities...)
+	sort.Sort(sort.Reverse(sort.IntSlice(out)))
+	unique := out[:1]
+	for _, q := range out[1:] {
+		if q != unique[len(unique)-1] {
+			unique = append(unique, q)
+		}
+	}
+	return unique
+}
+
+// The rungs of a quality ladder at or below max, or max alone if every
+// rung is above it
+func qualitiesUpTo(ladder []int, max int) []int {
+	var out []int
+	for _, q := range ladder {
+		if q <= max {
+			out = append(out, q)
+		}
+	}
+	if len(out) == 0 {
+		out = []int{max}
+	}
+	return out
+}
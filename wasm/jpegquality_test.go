@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestQualityLadder(t *testing.T) {
+	data := fixturePNG(fixtureGradient(256, 256))
+	opts := defaultImageOptions()
+	opts.Qualities, opts.TargetSavings, opts.Alternatives = []int{50, 90}, 0.5, true
+	res, err := compressImageData(context.Background(), data, "image/png", opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The q90 encode already saves half, so q50 is never tried
+	for _, c := range append(res.Alternatives, imageCandidate{Data: res.Data}) {
+		if c.Quality == 50 {
+			t.Fatal("ladder continued past the savings target")
+		}
+	}
+	if est, err := estimateJPEGQuality(res.Data); err != nil || est.Quality != 90 {
+		t.Fatalf("output quality %d (%v), want 90", est.Quality, err)
+	}
+	opts.Qualities = []int{101}
+	if _, err := compressImageData(context.Background(), data, "image/png", opts, func(int) {}); err == nil {
+		t.Fatal("quality 101 accepted")
+	}
+}
+
+func TestQualityLadderEarlyAbort(t *testing.T) {
+	// A flat image encodes to the same few bytes at every quality, so
+	// three of the four rungs are tried and the PNG fallback is skipped
+	img := image.NewGray(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 128
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	opts := defaultImageOptions()
+	opts.Alternatives, opts.EarlyAbort = true, true
+	res, err := compressImageData(context.Background(), buf.Bytes(), "image/jpeg", opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rungs := 0
+	for _, c := range res.Alternatives {
+		if c.MimeType == "image/png" {
+			t.Error("PNG fallback ran after the early abort")
+		}
+		if c.Quality > 0 {
+			rungs++
+		}
+	}
+	if rungs != 3 || !hasMessage(res.Warnings, "image.earlyAbort") {
+		t.Fatalf("%d rungs tried, warnings %v", rungs, messageTexts(res.Warnings))
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Copy a JS Uint8Array into a freshly allocated Go slice
+func bytesFromJS(v js.Value) []byte {
+	out := make([]byte, v.Length())
+	js.CopyBytesToGo(out, v)
+	return out
+}
+
+// Copy a Go byte slice into a new JS Uint8Array
+func bytesToJS(data []byte) js.Value {
+	out := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(out, data)
+	return out
+}
+
+// Convert a string slice into a JS array
+func stringsToJS(items []string) js.Value {
+	arr := js.Global().Get("Array").New(len(items))
+	for i, item := range items {
+		arr.SetIndex(i, item)
+	}
+	return arr
+}
+
+// Check whether an optional JS argument was actually supplied
+func isSet(v js.Value) bool {
+	return !v.IsUndefined() && !v.IsNull()
+}
+
+// A call's progress callback, invoked as callback(progress, jobId) so one
+// callback shared by concurrent calls can tell them apart. Unset
+// callbacks give a no-op.
+func progressReporter(callback js.Value, j *job) func(int) {
+	if !isSet(callback) {
+		return func(int) {}
+	}
+	return monotonicProgress(j, func(p int) {
+		callback.Invoke(p, j.id)
+	})
+}
+
+// Progress through the pages of a PDF, passed to the progress callback as
+// a third argument
+type pageProgress struct {
+	Page  int `json:"page"`
+	Pages int `json:"pages"`
+}
+
+// Progress reports keyed to pages: callback(percent, jobId, {page, pages}).
+// Consecutive pages may share a percentage, so these are not filtered like
+// plain reports beyond clamping and stopping with the job.
+func pageProgressReporter(callback js.Value, j *job) func(p, page, pages int) {
+	if !isSet(callback) {
+		return nil
+	}
+	return func(p, page, pages int) {
+		if j.ctx.Err() != nil {
+			return
+		}
+		if detail, err := jsonToJS(pageProgress{Page: page, Pages: pages}); err == nil {
+			callback.Invoke(maxInt(0, minInt(p, 100)), j.id, detail)
+		}
+	}
+}
+
+// Filter a job's progress reports: values are clamped to 0-100, never go
+// backwards and stop once the job is cancelled or finished
+func monotonicProgress(j *job, emit func(int)) func(int) {
+	var mu sync.Mutex
+	last := -1
+	return func(p int) {
+		p = maxInt(0, minInt(p, 100))
+		mu.Lock()
+		if p <= last || j.ctx.Err() != nil {
+			mu.Unlock()
+			return
+		}
+		last = p
+		mu.Unlock()
+		emit(p)
+	}
+}
+
+// Decode a plain JS options object into dst by round-tripping through JSON.
+// Fields missing from the object keep whatever defaults dst already holds;
+// function-valued fields (callbacks) are dropped by JSON.stringify and must
+// be read separately.
+func decodeOptions(v js.Value, dst interface{}) error {
+	if !isSet(v) {
+		return nil
+	}
+	if v.Type() != js.TypeObject {
+		return fmt.Errorf("options must be an object, got %s", v.Type().String())
+	}
+	raw := js.Global().Get("JSON").Call("stringify", v).String()
+	if err := json.Unmarshal([]byte(raw), dst); err != nil {
+		return fmt.Errorf("invalid options: %v", err)
+	}
+	return nil
+}
+
+// Convert a JSON-serializable Go value into a plain JS object
+func jsonToJS(v interface{}) (js.Value, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return js.Undefined(), err
+	}
+	return js.Global().Get("JSON").Call("parse", string(raw)), nil
+}
+
+// Build the standard result object shared by every compression entry point
+func newResultObject(input, output []byte) js.Value {
+	result := js.Global().Get("Object").New()
+	result.Set("data", bytesToJS(output))
+	result.Set("originalSize", len(input))
+	result.Set("compressedSize", len(output))
+	ratio := 1.0
+	if len(input) > 0 {
+		ratio = float64(len(output)) / float64(len(input))
+	}
+	result.Set("compressionRatio", ratio)
+	return result
+}
+
+// Wrap fn in a Promise. fn runs on its own goroutine; a returned error or a
+// recovered panic rejects the promise with a message prefixed by name, or
+// with a JS Error for a codedError.
+func runAsync(name string, fn func() (interface{}, error)) js.Value {
+	handler := js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+		resolve := promiseArgs[0]
+		reject := promiseArgs[1]
+
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					errorMsg := fmt.Sprintf("Panic in %s: %v", name, r)
+					fmt.Printf("[WASM ERROR] %s\n", errorMsg)
+					reject.Invoke(js.ValueOf(errorMsg))
+				}
+			}()
+
+			value, err := fn()
+			if err != nil {
+				fmt.Printf("[WASM ERROR] %s: %v\n", name, err)
+				var coded *codedError
+				if errors.As(err, &coded) {
+					reject.Invoke(codedErrorToJS(name, coded))
+					return
+				}
+				reject.Invoke(js.ValueOf(fmt.Sprintf("%s: %v", name, err)))
+				return
+			}
+			resolve.Invoke(value)
+		}()
+
+		return nil
+	})
+	defer handler.Release()
+
+	return js.Global().Get("Promise").New(handler)
+}
+
+// Error code of a file whose processing panicked
+const errCodeInternal = "ERR_INTERNAL"
+
+// Recover a panic while processing one file of a batch into *err, so the
+// batch keeps the files it finished and goes on with the rest. Use as
+// defer recoverFile(name, &err).
+func recoverFile(name string, err *error) {
+	if r := recover(); r != nil {
+		fmt.Printf("[WASM ERROR] Panic processing %s: %v\n", name, r)
+		*err = &codedError{
+			Code:    errCodeInternal,
+			Message: fmt.Sprintf("internal error processing %s: %v", name, r),
+			Details: map[string]interface{}{"file": name, "panic": fmt.Sprint(r)},
+		}
+	}
+}
+
+// Block the calling goroutine until a JS promise settles; plain values are
+// returned as is. Must run off the event loop, e.g. inside runAsync.
+func awaitJS(v js.Value) (js.Value, error) {
+	if v.Type() != js.TypeObject || v.Get("then").Type() != js.TypeFunction {
+		return v, nil
+	}
+	type settled struct {
+		value js.Value
+		err   error
+	}
+	done := make(chan settled, 1)
+	onResolve := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		value := js.Undefined()
+		if len(args) > 0 {
+			value = args[0]
+		}
+		done <- settled{value: value}
+		return nil
+	})
+	onReject := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		reason := js.Undefined()
+		if len(args) > 0 {
+			reason = args[0]
+		}
+		done <- settled{err: jsErrorText(reason)}
+		return nil
+	})
+	defer onResolve.Release()
+	defer onReject.Release()
+
+	v.Call("then", onResolve, onReject)
+	r := <-done
+	return r.value, r.err
+}
+
+// Call fn, turning a synchronous throw into an error, and await what it
+// returns
+func callAwait(fn func() js.Value) (result js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if jsErr, ok := r.(js.Error); ok {
+				err = jsErrorText(jsErr.Value)
+				return
+			}
+			panic(r)
+		}
+	}()
+	return awaitJS(fn())
+}
+
+// A JS rejection reason or thrown value as a Go error
+func jsErrorText(reason js.Value) error {
+	if reason.Type() == js.TypeObject && reason.Get("message").Type() == js.TypeString {
+		return errors.New(reason.Get("message").String())
+	}
+	return errors.New(js.Global().Get("String").Invoke(reason).String())
+}
@@ -0,0 +1,47 @@
+//go:build js
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestCallAwaitTurnsThrowsIntoErrors(t *testing.T) {
+	thrower := js.Global().Get("Function").New("throw new TypeError('sink is broken')")
+	if _, err := callAwait(func() js.Value { return thrower.Invoke() }); err == nil {
+		t.Error("a synchronous throw was not returned as an error")
+	}
+
+	resolver := js.Global().Get("Function").New("return Promise.resolve(7)")
+	result, err := callAwait(func() js.Value { return resolver.Invoke() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Int() != 7 {
+		t.Errorf("resolved with %v, want 7", result)
+	}
+}
+
+func TestFilePanic(t *testing.T) {
+	// A panic in one file becomes that file's coded error
+	fail := func() (err error) {
+		defer recoverFile("broken.pdf", &err)
+		var doc *pdfDocument
+		doc.pages()
+		return nil
+	}
+	var coded *codedError
+	if err := fail(); !errors.As(err, &coded) || coded.Code != errCodeInternal || coded.Details["file"] != "broken.pdf" {
+		t.Fatalf("panic became %v", err)
+	}
+	ok := func() (err error) {
+		defer recoverFile("fine.pdf", &err)
+		return nil
+	}
+	if err := ok(); err != nil {
+		t.Fatalf("no panic became %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"runtime"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// The pixels every candidate encoder of the photo pipeline works from,
+// downscaled exactly once. Encoders take the source rather than the
+// decoded image, so a new strategy cannot quietly resample again.
+type encodeSource struct {
+	img     image.Image
+	resized bool
+
+	jpegOnce sync.Once
+	jpeg     image.Image
+}
+
+// Fit img within maxDimension on both sides (0 = no limit). Lanczos is
+// several times slower than linear filtering, so a time budget gets the
+// latter.
+func newEncodeSource(img image.Image, maxDimension int, budget timeBudget) *encodeSource {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if maxDimension <= 0 || (width <= maxDimension && height <= maxDimension) {
+		return &encodeSource{img: img}
+	}
+	if width > height {
+		height = height * maxDimension / width
+		width = maxDimension
+	} else {
+		width = width * maxDimension / height
+		height = maxDimension
+	}
+	filter := imaging.Lanczos
+	if budget.limited() {
+		filter = imaging.Linear
+	}
+	return &encodeSource{img: imaging.Resize(img, width, height, filter), resized: true}
+}
+
+func (s *encodeSource) size() (int, int) {
+	return s.img.Bounds().Dx(), s.img.Bounds().Dy()
+}
+
+// The pixels in a layout image/jpeg reads directly, converted on first
+// use. The encoder handles *image.RGBA, *image.YCbCr and *image.Gray
+// natively but goes through At() for anything else, which dominates encode
+// time for the NRGBA images imaging returns. Only opaque images reach the
+// ladder, so the conversion is exact.
+func (s *encodeSource) jpegPixels() image.Image {
+	s.jpegOnce.Do(func() {
+		switch s.img.(type) {
+		case *image.RGBA, *image.YCbCr, *image.Gray:
+			s.jpeg = s.img
+			return
+		}
+		b := s.img.Bounds()
+		rgba := image.NewRGBA(b)
+		draw.Draw(rgba, b, s.img, b.Min, draw.Src)
+		s.jpeg = rgba
+	})
+	return s.jpeg
+}
+
+// Encode buffers keep the capacity an earlier encode grew them to, so a
+// rung does not reallocate its way up from zero
+var encodeBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// One rung of the ladder. Data lives in a pooled buffer and is only valid
+// during the visit; copy it to keep it.
+type ladderEncode struct {
+	Quality int
+	Data    []byte
+	Err     error
+}
+
+// Encode s at each quality, running up to GOMAXPROCS encodes at a time
+// (one in the browser, where goroutines share the JS thread). visit sees
+// the rungs in ladder order and returns false to skip the rest.
+func encodeJPEGLadder(ctx context.Context, s *encodeSource, qualities []int, visit func(ladderEncode) bool) error {
+	src := s.jpegPixels()
+	workers := runtime.GOMAXPROCS(0)
+	for start := 0; start < len(qualities); start += workers {
+		if start > 0 {
+			if err := checkCancelled(ctx); err != nil {
+				return err
+			}
+		}
+		end := minInt(start+workers, len(qualities))
+		rungs := make([]ladderEncode, end-start)
+		buffers := make([]*bytes.Buffer, len(rungs))
+		var wg sync.WaitGroup
+		for i := range rungs {
+			buffers[i] = encodeBuffers.Get().(*bytes.Buffer)
+			buffers[i].Reset()
+			rungs[i].Quality = qualities[start+i]
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				rungs[i].Err = jpeg.Encode(buffers[i], src, &jpeg.Options{Quality: rungs[i].Quality})
+				rungs[i].Data = buffers[i].Bytes()
+			}(i)
+		}
+		wg.Wait()
+
+		more := true
+		for _, r := range rungs {
+			if more {
+				more = visit(r)
+			}
+		}
+		for _, buf := range buffers {
+			encodeBuffers.Put(buf)
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestLadderSource(t *testing.T) {
+	img := fixtureGradient(128, 96)
+	var seen []int
+	var first []byte
+	err := encodeJPEGLadder(context.Background(), newEncodeSource(img, 0, newTimeBudget(0)), []int{85, 60, 40}, func(e ladderEncode) bool {
+		seen = append(seen, e.Quality)
+		if first == nil {
+			first = append([]byte(nil), e.Data...)
+		}
+		return e.Quality != 60
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(seen) != "[85 60]" {
+		t.Fatalf("visited %v, want [85 60]", seen)
+	}
+	// Sources only resample when the image is too large
+	if small := newEncodeSource(img, 128, newTimeBudget(0)); small.resized || small.img != image.Image(img) {
+		t.Fatal("image within maxDimension was resampled")
+	}
+	if w, h := newEncodeSource(img, 64, newTimeBudget(0)).size(); w != 64 || h != 48 {
+		t.Fatalf("downscaled to %dx%d, want 64x48", w, h)
+	}
+	// The converted pixels must encode exactly like the original
+	direct := new(bytes.Buffer)
+	jpeg.Encode(direct, img, &jpeg.Options{Quality: 85})
+	if !bytes.Equal(first, direct.Bytes()) {
+		t.Fatal("converted source encodes differently")
+	}
+}
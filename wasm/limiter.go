@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Host-configured throughput limits. A compressor widget forwards every
+// file a user drops; these keep a drop of thousands of files, or of a few
+// huge ones, from holding more input than the tab can afford. Calls over
+// a limit are rejected before their input is copied, never queued.
+
+// Error code of calls over a throughput limit
+const errCodeQuotaExceeded = "ERR_QUOTA_EXCEEDED"
+
+// Window maxFilesPerMinute is counted over
+const rateWindow = time.Minute
+
+type throughputLimits struct {
+	// Input bytes held by running calls, counting the one being admitted;
+	// 0 is unlimited
+	MaxBytesInFlight int `json:"maxBytesInFlight"`
+
+	// Inputs admitted in any 60 seconds; 0 is unlimited
+	MaxFilesPerMinute int `json:"maxFilesPerMinute"`
+}
+
+func (l throughputLimits) validate() error {
+	if l.MaxBytesInFlight < 0 {
+		return errors.New("maxBytesInFlight must not be negative")
+	}
+	if l.MaxFilesPerMinute < 0 {
+		return errors.New("maxFilesPerMinute must not be negative")
+	}
+	return nil
+}
+
+var (
+	limiterMu     sync.Mutex
+	activeLimits  throughputLimits
+	bytesInFlight int
+	admittedAt    []time.Time // admissions within the last rateWindow, oldest first
+)
+
+// Reserve room for an input of size bytes. The returned release gives the
+// bytes back; call it once the call no longer holds the input, typically
+// deferred next to the job's finish. Extra calls are harmless.
+func reserveInput(size int) (func(), error) {
+	return reserve(size, true)
+}
+
+// Reserve size more bytes for a call already admitted, such as a
+// stream's next chunk; it does not count as another file
+func reserveBytes(size int) (func(), error) {
+	return reserve(size, false)
+}
+
+func reserve(size int, file bool) (func(), error) {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+
+	now := time.Now()
+	expired := 0
+	for expired < len(admittedAt) && now.Sub(admittedAt[expired]) >= rateWindow {
+		expired++
+	}
+	admittedAt = admittedAt[expired:]
+
+	l := activeLimits
+	if file && l.MaxFilesPerMinute > 0 && len(admittedAt) >= l.MaxFilesPerMinute {
+		retry := rateWindow - now.Sub(admittedAt[0])
+		return nil, &codedError{
+			Code:    errCodeQuotaExceeded,
+			Message: fmt.Sprintf("more than %d files per minute", l.MaxFilesPerMinute),
+			Details: map[string]interface{}{
+				"limit":        "maxFilesPerMinute",
+				"retryAfterMs": int(retry.Milliseconds()) + 1,
+			},
+		}
+	}
+	if l.MaxBytesInFlight > 0 && bytesInFlight+size > l.MaxBytesInFlight {
+		return nil, &codedError{
+			Code:    errCodeQuotaExceeded,
+			Message: fmt.Sprintf("%d input bytes would exceed the %d bytes in flight allowed (%d in use)", size, l.MaxBytesInFlight, bytesInFlight),
+			Details: map[string]interface{}{
+				"limit":         "maxBytesInFlight",
+				"size":          size,
+				"bytesInFlight": bytesInFlight,
+			},
+		}
+	}
+
+	if file {
+		admittedAt = append(admittedAt, now)
+	}
+	bytesInFlight += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limiterMu.Lock()
+			bytesInFlight -= size
+			limiterMu.Unlock()
+		})
+	}, nil
+}
+
+// Admit an input by its first bytes and size: the allowlist first, so
+// rejected types do not count against the limits, then the limits
+func admitInput(head []byte, declared string, size int) (func(), error) {
+	if err := checkInputAllowed(head, declared); err != nil {
+		return nil, err
+	}
+	return reserveInput(size)
+}
+
+// Usage against the limits, for hosts that throttle their own UI
+func throughputStatus() map[string]interface{} {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+	recent := 0
+	for _, t := range admittedAt {
+		if time.Since(t) < rateWindow {
+			recent++
+		}
+	}
+	return map[string]interface{}{
+		"maxBytesInFlight":  activeLimits.MaxBytesInFlight,
+		"maxFilesPerMinute": activeLimits.MaxFilesPerMinute,
+		"bytesInFlight":     bytesInFlight,
+		"filesLastMinute":   recent,
+	}
+}
+
+// setThroughputLimits({maxBytesInFlight, maxFilesPerMinute}) caps the
+// input bytes held by running calls and the files admitted per minute,
+// across every entry point that takes a file's bytes except the base64
+// helpers; a stream counts as one file and holds each chunk while it is
+// compressed. Calls over
+// a limit reject, before their input is copied, with an Error whose code
+// is "ERR_QUOTA_EXCEEDED", whose limit names the limit hit and which
+// carries retryAfterMs for the per-minute one; batch files get the code
+// as errorCode. Limits of 0, or null, remove them. Resolves with the
+// limits and current usage.
+func setThroughputLimits(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] setThroughputLimits called with %d arguments\n", len(args))
+
+	var limits throughputLimits
+	var err error
+	if len(args) > 0 {
+		err = decodeOptions(args[0], &limits)
+	}
+
+	return runAsync("setThroughputLimits", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		if err := limits.validate(); err != nil {
+			return nil, err
+		}
+		limiterMu.Lock()
+		activeLimits = limits
+		limiterMu.Unlock()
+		fmt.Printf("[WASM] Throughput limits: %d bytes in flight, %d files per minute\n",
+			limits.MaxBytesInFlight, limits.MaxFilesPerMinute)
+		return js.ValueOf(throughputStatus()), nil
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Set the throughput limits, with a fresh rate window, for the rest of a
+// test
+func withLimits(t *testing.T, limits throughputLimits) {
+	limiterMu.Lock()
+	saved, savedTimes := activeLimits, admittedAt
+	activeLimits, admittedAt = limits, nil
+	limiterMu.Unlock()
+	t.Cleanup(func() {
+		limiterMu.Lock()
+		activeLimits, admittedAt = saved, savedTimes
+		limiterMu.Unlock()
+	})
+}
+
+func TestThroughput(t *testing.T) {
+	withLimits(t, throughputLimits{MaxBytesInFlight: 1000, MaxFilesPerMinute: 2})
+
+	first, err := reserveInput(600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coded *codedError
+	if _, err := reserveInput(600); !errors.As(err, &coded) || coded.Details["limit"] != "maxBytesInFlight" {
+		t.Fatalf("over maxBytesInFlight: %v", err)
+	}
+	first()
+	first()
+	second, err := reserveInput(600)
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	second()
+	if _, err := reserveInput(1); !errors.As(err, &coded) || coded.Details["limit"] != "maxFilesPerMinute" {
+		t.Fatalf("over maxFilesPerMinute: %v", err)
+	}
+}
+
+func TestStreamThroughput(t *testing.T) {
+	withLimits(t, throughputLimits{MaxBytesInFlight: 1000, MaxFilesPerMinute: 1})
+
+	// A stream is one file however many chunks it takes, and each chunk
+	// is held only while it is compressed
+	s, err := newCompressionStream(streamOptions{compressOptions: defaultCompressOptions()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := s.write(make([]byte, 800)); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	var coded *codedError
+	if _, err := s.write(make([]byte, 1001)); !errors.As(err, &coded) || coded.Details["limit"] != "maxBytesInFlight" {
+		t.Fatalf("oversized chunk: %v", err)
+	}
+	if _, err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if status := throughputStatus(); status["bytesInFlight"] != 0 || status["filesLastMinute"] != 1 {
+		t.Errorf("after the stream: %v", status)
+	}
+
+	other, _ := newCompressionStream(streamOptions{compressOptions: defaultCompressOptions()})
+	if _, err := other.write([]byte("x")); !errors.As(err, &coded) || coded.Details["limit"] != "maxFilesPerMinute" {
+		t.Fatalf("second stream: %v", err)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// LZ4 frame format (lz4 CLI, lz4frame). Only the fast greedy matcher is
+// implemented; LZ4 is chosen for speed, so HC levels would defeat the point.
+const codecLZ4 = "lz4"
+
+const (
+	lz4FrameMagic  = 0x184D2204
+	lz4LegacyMagic = 0x184C2102
+	lz4SkipMagic   = 0x184D2A50 // low nibble is free
+
+	lz4BlockSize = 4 << 20 // BD code 7
+	lz4HashLog   = 16
+	lz4MinMatch  = 4
+	lz4MaxOffset = 65535
+
+	// Matches may not start in the last 12 bytes and the last 5 are always
+	// literals (lz4 block format, "end of block conditions")
+	lz4MFLimit      = 12
+	lz4LastLiterals = 5
+)
+
+// xxHash32, used for the frame header and content checksums
+const (
+	xxhPrime1 uint32 = 2654435761
+	xxhPrime2 uint32 = 2246822519
+	xxhPrime3 uint32 = 3266489917
+	xxhPrime4 uint32 = 668265263
+	xxhPrime5 uint32 = 374761393
+)
+
+func xxhRound(acc, input uint32) uint32 {
+	return bits.RotateLeft32(acc+input*xxhPrime2, 13) * xxhPrime1
+}
+
+func xxh32(data []byte, seed uint32) uint32 {
+	n := len(data)
+	var h uint32
+	if n >= 16 {
+		v1 := seed + xxhPrime1 + xxhPrime2
+		v2 := seed + xxhPrime2
+		v3 := seed
+		v4 := seed - xxhPrime1
+		for len(data) >= 16 {
+			v1 = xxhRound(v1, binary.LittleEndian.Uint32(data))
+			v2 = xxhRound(v2, binary.LittleEndian.Uint32(data[4:]))
+			v3 = xxhRound(v3, binary.LittleEndian.Uint32(data[8:]))
+			v4 = xxhRound(v4, binary.LittleEndian.Uint32(data[12:]))
+			data = data[16:]
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = seed + xxhPrime5
+	}
+	h += uint32(n)
+	for len(data) >= 4 {
+		h = bits.RotateLeft32(h+binary.LittleEndian.Uint32(data)*xxhPrime3, 17) * xxhPrime4
+		data = data[4:]
+	}
+	for _, b := range data {
+		h = bits.RotateLeft32(h+uint32(b)*xxhPrime5, 11) * xxhPrime1
+	}
+	h ^= h >> 15
+	h *= xxhPrime2
+	h ^= h >> 13
+	h *= xxhPrime3
+	h ^= h >> 16
+	return h
+}
+
+// Append an LZ4 length continuation: runs of 255 then the remainder
+func lz4AppendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+// Append one sequence; matchLen 0 marks the final literals-only sequence
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	litLen := len(literals)
+	token := byte(min(litLen, 15)) << 4
+	if matchLen > 0 {
+		token |= byte(min(matchLen-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	if litLen >= 15 {
+		dst = lz4AppendLength(dst, litLen-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, matchLen-lz4MinMatch-15)
+	}
+	return dst
+}
+
+// Compress one independent block with a single-probe hash table. Stretches
+// without matches are skipped faster the longer they run, the same
+// acceleration the reference encoder uses.
+func lz4CompressBlock(dst, src []byte) []byte {
+	anchor := 0
+	if len(src) > lz4MFLimit {
+		var table [1 << lz4HashLog]int32 // position + 1
+		limit := len(src) - lz4MFLimit
+		matchLimit := len(src) - lz4LastLiterals
+		for i := 0; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := (seq * xxhPrime1) >> (32 - lz4HashLog)
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+			if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				i += 1 + (i-anchor)>>6
+				continue
+			}
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+			}
+			n := lz4MinMatch
+			for i+n < matchLimit && src[i+n] == src[ref+n] {
+				n++
+			}
+			dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+			i += n
+			anchor = i
+		}
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+func lz4ReadLength(src []byte, i *int) (int, error) {
+	n := 0
+	for {
+		if *i >= len(src) {
+			return 0, errors.New("lz4: truncated length")
+		}
+		b := src[*i]
+		*i++
+		n += int(b)
+		if b != 255 {
+			return n, nil
+		}
+	}
+}
+
+// Decode one block, appending to out. Matches may reach back into earlier
+// output, which is what linked blocks need.
+func lz4DecompressBlock(out, src []byte, limit int64) ([]byte, error) {
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		litLen := int(token >> 4)
+		if litLen == 15 {
+			extra, err := lz4ReadLength(src, &i)
+			if err != nil {
+				return out, err
+			}
+			litLen += extra
+		}
+		if litLen > len(src)-i {
+			return out, errors.New("lz4: literals run past the block")
+		}
+		if int64(len(out)+litLen) > limit {
+			return out, fmt.Errorf("decompressed size exceeds the %d byte limit", limit)
+		}
+		out = append(out, src[i:i+litLen]...)
+		i += litLen
+		if i == len(src) {
+			break // final sequence has no match
+		}
+
+		if i+2 > len(src) {
+			return out, errors.New("lz4: truncated match offset")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(out) {
+			return out, errors.New("lz4: match offset out of range")
+		}
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			extra, err := lz4ReadLength(src, &i)
+			if err != nil {
+				return out, err
+			}
+			matchLen += extra
+		}
+		matchLen += lz4MinMatch
+		if int64(len(out)+matchLen) > limit {
+			return out, fmt.Errorf("decompressed size exceeds the %d byte limit", limit)
+		}
+		// Overlapping matches repeat the last offset bytes
+		start := len(out) - offset
+		for matchLen > 0 {
+			n := min(matchLen, offset)
+			out = append(out, out[start:start+n]...)
+			start += n
+			matchLen -= n
+		}
+	}
+	return out, nil
+}
+
+// Compress data into a single LZ4 frame: independent 4 MB blocks, content
+// size and content checksum set
+func compressLZ4(data []byte) []byte {
+	out := binary.LittleEndian.AppendUint32(make([]byte, 0, len(data)/2+32), lz4FrameMagic)
+	descStart := len(out)
+	out = append(out, 0x01<<6|1<<5|1<<3|1<<2, 7<<4) // version 1, block independence, content size, content checksum
+	out = binary.LittleEndian.AppendUint64(out, uint64(len(data)))
+	out = append(out, byte(xxh32(out[descStart:], 0)>>8))
+
+	var block []byte
+	for pos := 0; pos < len(data); pos += lz4BlockSize {
+		chunk := data[pos:min(pos+lz4BlockSize, len(data))]
+		block = lz4CompressBlock(block[:0], chunk)
+		if len(block) >= len(chunk) {
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(chunk))|1<<31)
+			out = append(out, chunk...)
+		} else {
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(block)))
+			out = append(out, block...)
+		}
+	}
+	out = binary.LittleEndian.AppendUint32(out, 0) // end mark
+	return binary.LittleEndian.AppendUint32(out, xxh32(data, 0))
+}
+
+// Streaming LZ4 frame writer: independent 4 MB blocks, no content size or
+// checksum since neither is known up front
+type lz4Writer struct {
+	w      io.Writer
+	buf    []byte
+	block  []byte
+	header bool
+	err    error
+}
+
+func newLZ4Writer(w io.Writer) *lz4Writer {
+	return &lz4Writer{w: w}
+}
+
+func (z *lz4Writer) writeHeader() {
+	if z.header {
+		return
+	}
+	z.header = true
+	hdr := binary.LittleEndian.AppendUint32(nil, lz4FrameMagic)
+	hdr = append(hdr, 0x01<<6|1<<5, 7<<4) // version 1, block independence
+	hdr = append(hdr, byte(xxh32(hdr[4:], 0)>>8))
+	_, z.err = z.w.Write(hdr)
+}
+
+func (z *lz4Writer) flushBlock() {
+	if len(z.buf) == 0 || z.err != nil {
+		return
+	}
+	z.writeHeader()
+	z.block = lz4CompressBlock(z.block[:0], z.buf)
+	var out []byte
+	if len(z.block) >= len(z.buf) {
+		out = binary.LittleEndian.AppendUint32(nil, uint32(len(z.buf))|1<<31)
+		out = append(out, z.buf...)
+	} else {
+		out = binary.LittleEndian.AppendUint32(nil, uint32(len(z.block)))
+		out = append(out, z.block...)
+	}
+	if z.err == nil {
+		_, z.err = z.w.Write(out)
+	}
+	z.buf = z.buf[:0]
+}
+
+func (z *lz4Writer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && z.err == nil {
+		take := minInt(len(p), lz4BlockSize-len(z.buf))
+		z.buf = append(z.buf, p[:take]...)
+		p = p[take:]
+		if len(z.buf) == lz4BlockSize {
+			z.flushBlock()
+		}
+	}
+	return n, z.err
+}
+
+// Close flushes the last block and writes the end mark
+func (z *lz4Writer) Close() error {
+	z.flushBlock()
+	z.writeHeader()
+	if z.err == nil {
+		_, z.err = z.w.Write(binary.LittleEndian.AppendUint32(nil, 0))
+	}
+	return z.err
+}
+
+// Decode one frame starting after its magic number, appending to out;
+// also returns the bytes consumed
+func lz4DecodeFrame(out, data []byte, limit int64) ([]byte, int, error) {
+	if len(data) < 3 {
+		return out, 0, errors.New("lz4: truncated frame header")
+	}
+	flg := data[0]
+	if flg>>6 != 1 {
+		return out, 0, fmt.Errorf("lz4: unsupported frame version %d", flg>>6)
+	}
+	blockChecksum := flg&(1<<4) != 0
+	hasSize := flg&(1<<3) != 0
+	contentChecksum := flg&(1<<2) != 0
+	if flg&1 != 0 {
+		return out, 0, errors.New("lz4: frames that need a dictionary are not supported")
+	}
+	descLen := 2
+	if hasSize {
+		descLen += 8
+	}
+	if len(data) < descLen+1 {
+		return out, 0, errors.New("lz4: truncated frame header")
+	}
+	if byte(xxh32(data[:descLen], 0)>>8) != data[descLen] {
+		return out, 0, errors.New("lz4: frame header checksum mismatch")
+	}
+	if hasSize && int64(binary.LittleEndian.Uint64(data[2:])) > limit-int64(len(out)) {
+		return out, 0, fmt.Errorf("decompressed size exceeds the %d byte limit", limit)
+	}
+
+	frameStart := len(out)
+	i := descLen + 1
+	for {
+		if i+4 > len(data) {
+			return out, 0, errors.New("lz4: truncated block header")
+		}
+		size := binary.LittleEndian.Uint32(data[i:])
+		i += 4
+		if size == 0 {
+			break
+		}
+		raw := size&(1<<31) != 0
+		n := int(size &^ (1 << 31))
+		if n > len(data)-i {
+			return out, 0, errors.New("lz4: block runs past the end of the input")
+		}
+		block := data[i : i+n]
+		i += n
+		if blockChecksum {
+			if i+4 > len(data) || binary.LittleEndian.Uint32(data[i:]) != xxh32(block, 0) {
+				return out, 0, errors.New("lz4: block checksum mismatch")
+			}
+			i += 4
+		}
+		if raw {
+			if int64(len(out)+n) > limit {
+				return out, 0, fmt.Errorf("decompressed size exceeds the %d byte limit", limit)
+			}
+			out = append(out, block...)
+			continue
+		}
+		var err error
+		if out, err = lz4DecompressBlock(out, block, limit); err != nil {
+			return out, 0, err
+		}
+	}
+	if contentChecksum {
+		if i+4 > len(data) {
+			return out, 0, errors.New("lz4: truncated content checksum")
+		}
+		if binary.LittleEndian.Uint32(data[i:]) != xxh32(out[frameStart:], 0) {
+			return out, 0, errors.New("lz4: content checksum mismatch")
+		}
+		i += 4
+	}
+	return out, i, nil
+}
+
+// Decode the legacy format (lz4 -l): 8 MB blocks, each with a size prefix,
+// until the input ends or another frame begins
+func lz4DecodeLegacy(out, data []byte, limit int64) ([]byte, int, error) {
+	i := 0
+	for i+4 <= len(data) {
+		size := binary.LittleEndian.Uint32(data[i:])
+		if size == lz4FrameMagic || size == lz4LegacyMagic || size&0xFFFFFFF0 == lz4SkipMagic {
+			break
+		}
+		i += 4
+		if int(size) > len(data)-i {
+			return out, 0, errors.New("lz4: block runs past the end of the input")
+		}
+		// Legacy blocks are independent; decode each on its own
+		block, err := lz4DecompressBlock(nil, data[i:i+int(size)], limit-int64(len(out)))
+		if err != nil {
+			return out, 0, err
+		}
+		out = append(out, block...)
+		i += int(size)
+	}
+	return out, i, nil
+}
+
+// Decode a sequence of LZ4 frames, legacy frames and skippable frames
+func decompressLZ4(data []byte, limit int64) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(data); {
+		if i+4 > len(data) {
+			return nil, errors.New("lz4: trailing bytes after the last frame")
+		}
+		magic := binary.LittleEndian.Uint32(data[i:])
+		i += 4
+		var n int
+		var err error
+		switch {
+		case magic == lz4FrameMagic:
+			out, n, err = lz4DecodeFrame(out, data[i:], limit)
+		case magic == lz4LegacyMagic:
+			out, n, err = lz4DecodeLegacy(out, data[i:], limit)
+		case magic&0xFFFFFFF0 == lz4SkipMagic:
+			if i+4 > len(data) {
+				return nil, errors.New("lz4: truncated skippable frame")
+			}
+			n = 4 + int(binary.LittleEndian.Uint32(data[i:]))
+			if n > len(data)-i {
+				return nil, errors.New("lz4: truncated skippable frame")
+			}
+		default:
+			if i == 4 {
+				return nil, errors.New("not an LZ4 frame")
+			}
+			return nil, errors.New("lz4: trailing bytes after the last frame")
+		}
+		if err != nil {
+			return nil, err
+		}
+		i += n
+	}
+	return out, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestXXH32(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want uint32
+	}{
+		{"", 0x02CC5D05},
+		{"abc", 0x32D153FF},
+		{"Nobody inspects the spammish repetition", 0xE2293B2F},
+	} {
+		if got := xxh32([]byte(c.in), 0); got != c.want {
+			t.Errorf("xxh32(%q) = %08x, want %08x", c.in, got, c.want)
+		}
+	}
+}
+
+// Log-like text with stretches of noise, over two 4 MB blocks
+func fixtureLZ4Input() []byte {
+	rng := uint32(1)
+	var data []byte
+	for len(data) < 5<<20 {
+		rng = rng*1103515245 + 12345
+		if rng>>28 < 3 {
+			data = append(data, byte(rng>>8))
+		} else {
+			data = append(data, fmt.Sprintf("line %d of log %d\n", rng>>20, len(data)%7)...)
+		}
+	}
+	return data
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	large := fixtureLZ4Input()
+	for _, in := range [][]byte{nil, []byte("a"), bytes.Repeat([]byte("a"), 35), []byte("no repeats here"), large} {
+		out, err := compressPayload(in, compressOptions{Algorithm: codecLZ4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := decompressStream(out, defaultDecompressOptions())
+		if err != nil || res.Format != codecLZ4 || !bytes.Equal(res.Data, in) {
+			t.Errorf("%d bytes decoded as %d bytes of %s: %v", len(in), len(res.Data), res.Format, err)
+		}
+	}
+	out, _ := compressPayload(large, compressOptions{Algorithm: codecLZ4})
+	if len(out) > len(large)/2 {
+		t.Errorf("compressed %d bytes to %d", len(large), len(out))
+	}
+
+	// The streaming writer, fed in odd-sized pieces
+	var buf bytes.Buffer
+	w := newLZ4Writer(&buf)
+	for rest := large; len(rest) > 0; {
+		n := min(len(rest), 777777)
+		w.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if back, err := decompressLZ4(buf.Bytes(), defaultMaxDecompressed); err != nil || !bytes.Equal(back, large) {
+		t.Errorf("streamed frame decoded as %d bytes: %v", len(back), err)
+	}
+}
+
+// A block as the reference encoder writes it: "ab", then an overlapping
+// match repeating it for 8 bytes, then the final literal
+var lz4TestBlock = []byte{0x24, 'a', 'b', 2, 0, 0x10, '!'}
+
+const lz4TestBlockText = "ababababab!"
+
+func TestLZ4DecodesReferenceFrames(t *testing.T) {
+	// A frame with block checksums and no content size
+	frame := binary.LittleEndian.AppendUint32(nil, lz4FrameMagic)
+	frame = append(frame, 0x40|0x20|0x10, 0x40)
+	frame = append(frame, byte(xxh32(frame[4:], 0)>>8))
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(lz4TestBlock)))
+	frame = append(frame, lz4TestBlock...)
+	frame = binary.LittleEndian.AppendUint32(frame, xxh32(lz4TestBlock, 0))
+	frame = binary.LittleEndian.AppendUint32(frame, 0)
+
+	// lz4 -l output, then a skippable frame, then the frame
+	data := binary.LittleEndian.AppendUint32(nil, lz4LegacyMagic)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(lz4TestBlock)))
+	data = append(data, lz4TestBlock...)
+	data = binary.LittleEndian.AppendUint32(data, lz4SkipMagic|3)
+	data = binary.LittleEndian.AppendUint32(data, 3)
+	data = append(data, "xyz"...)
+	data = append(data, frame...)
+
+	res, err := decompressStream(data, defaultDecompressOptions())
+	if err != nil || string(res.Data) != lz4TestBlockText+lz4TestBlockText {
+		t.Fatalf("decoded %q: %v", res.Data, err)
+	}
+
+	damaged := append([]byte{}, frame...)
+	damaged[len(damaged)-5] ^= 1 // block checksum
+	if _, err := decompressLZ4(damaged, defaultMaxDecompressed); err == nil {
+		t.Error("a block checksum mismatch was accepted")
+	}
+	if _, err := decompressLZ4(frame, 5); err == nil {
+		t.Error("output beyond the limit was returned")
+	}
+}
+
+func TestLZ4RejectsDamage(t *testing.T) {
+	good := compressLZ4(bytes.Repeat([]byte("checksummed content "), 100))
+	flip := func(i int) []byte {
+		d := append([]byte{}, good...)
+		d[i] ^= 1
+		return d
+	}
+	badOffset := binary.LittleEndian.AppendUint32(nil, lz4LegacyMagic)
+	badOffset = binary.LittleEndian.AppendUint32(badOffset, 5)
+	badOffset = append(badOffset, 0x14, 'a', 9, 0, 0) // match 9 bytes back after 1 byte of output
+	for name, data := range map[string][]byte{
+		"header checksum":  flip(6),
+		"content checksum": flip(len(good) - 1),
+		"truncated":        good[:len(good)-10],
+		"trailing bytes":   append(append([]byte{}, good...), 1, 2),
+		"offset":           badOffset,
+	} {
+		if _, err := decompressLZ4(data, defaultMaxDecompressed); err == nil {
+			t.Errorf("%s damage was accepted", name)
+		}
+	}
+	if _, err := decompressLZ4(good, 100); err == nil {
+		t.Error("a content size above the limit was accepted")
+	}
+}
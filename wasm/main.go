@@ -2,320 +2,311 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
 	"image/png"
+	"sort"
 	"strings"
-	"syscall/js"
+	"time"
 
-	"github.com/disintegration/imaging"
+	"pdf-turbo-wasm/internal/js"
 )
 
 // Progress callback function type
 type ProgressCallback func(progress int)
 
 // Advanced PDF compression function
-func compressPDFData(inputBytes []byte, reportProgress func(int)) []byte {
+func compressPDFData(ctx context.Context, inputBytes []byte, opts pdfOptions, reportProgress func(int)) (pdfResult, error) {
 	fmt.Printf("[WASM] compressPDFData: processing %d bytes\n", len(inputBytes))
 	
 	// Check if it's actually a PDF
 	if len(inputBytes) < 4 || string(inputBytes[:4]) != "%PDF" {
 		fmt.Printf("[WASM] Not a valid PDF file, returning original\n")
-		return inputBytes
+		return pdfResult{Data: inputBytes, Level: pdfLevelPassthrough}, nil
 	}
 	
 	reportProgress(20)
 	
-	// Strategy 1: Remove/compress embedded images (most effective for large PDFs)
-	compressed := compressEmbeddedImages(inputBytes)
-	fmt.Printf("[WASM] After image compression: %d bytes\n", len(compressed))
-	reportProgress(50)
-	
-	// Strategy 2: Remove metadata and unnecessary objects
-	compressed = removeMetadataBinary(compressed)
-	fmt.Printf("[WASM] After metadata removal: %d bytes\n", len(compressed))
-	reportProgress(70)
-	
-	// Strategy 3: Compress streams and remove duplicates
-	compressed = optimizeStreams(compressed)
-	fmt.Printf("[WASM] After stream optimization: %d bytes\n", len(compressed))
-	reportProgress(90)
+	// Full rewrite -> stream-only recompress -> metadata strip -> passthrough
+	res, err := runPDFFallbackChain(ctx, inputBytes, opts, reportProgress)
+	if err != nil {
+		return res, err
+	}
 	
 	// Calculate compression ratio
-	ratio := float64(len(compressed)) / float64(len(inputBytes))
-	fmt.Printf("[WASM] Compression ratio: %.3f (%.1f%% reduction)\n", ratio, (1-ratio)*100)
+	ratio := float64(len(res.Data)) / float64(len(inputBytes))
+	fmt.Printf("[WASM] Compression ratio: %.3f (%.1f%% reduction) at level %s\n", ratio, (1-ratio)*100, res.Level)
 	
 	// If we achieved any reduction, use compressed version
 	if ratio < 0.95 {
-		fmt.Printf("[WASM] Compression successful: %d -> %d bytes\n", len(inputBytes), len(compressed))
-		reportProgress(100)
-		return compressed
-	} else {
+		fmt.Printf("[WASM] Compression successful: %d -> %d bytes\n", len(inputBytes), len(res.Data))
+	} else if res.Level != pdfLevelPassthrough && !opts.keepStripped {
 		fmt.Printf("[WASM] Compression not effective enough (%.1f%% reduction), returning original to preserve PDF structure\n", (1-ratio)*100)
-		reportProgress(100)
-		return inputBytes
+		res.Warnings = append(res.Warnings, newMessage("pdf.lowSavings", "level", res.Level, "percent", percentParam(1-ratio)))
+		trace(ctx, "pdf", "keptOriginal", "level", res.Level, "ratio", ratio)
+		res.Data = inputBytes
+		res.Output = res.Original
+		res.Level = pdfLevelPassthrough
 	}
+	reportProgress(100)
+	return res, nil
 }
 
-// Compress embedded images in PDF (most effective for large PDFs)
-func compressEmbeddedImages(data []byte) []byte {
+// Recompress embedded images. Only whole stream objects found by the
+// parser are considered: DCTDecode streams and unfiltered streams holding
+// a PNG file, so image signatures inside Flate data or fonts are never
+// touched. Objects are visited page by page, reporting each page as it is
+// done. Under opts.EarlyAbort the remaining images are kept once the
+// yield of the passes so far is too low.
+func (doc *pdfDocument) compressEmbeddedImages(opts pdfOptions) bool {
 	fmt.Printf("[WASM] compressEmbeddedImages: scanning PDF structure for images\n")
 	
-	result := make([]byte, 0, len(data))
-	i := 0
 	imagesFound := 0
 	totalSaved := 0
-	
-	// Strategy 1: Look for PDF Image XObjects
-	content := string(data)
-	
-	// Find image objects (look for /Type /XObject /Subtype /Image)
-	imageObjCount := strings.Count(content, "/Type /XObject")
-	imageCount := strings.Count(content, "/Subtype /Image")
-	fmt.Printf("[WASM] Found %d XObjects, %d Image subtypes\n", imageObjCount, imageCount)
-	
-	// Strategy 2: Look for DCTDecode (JPEG) and FlateDecode (compressed) streams
-	dctCount := strings.Count(content, "/DCTDecode")
-	flateCount := strings.Count(content, "/FlateDecode")
-	fmt.Printf("[WASM] Found %d DCTDecode, %d FlateDecode streams\n", dctCount, flateCount)
-	
-	// Strategy 3: Aggressive binary scan for image markers
-	for i < len(data) {
-		// Look for JPEG with more flexible markers
-		if i < len(data)-2 && data[i] == 0xFF && data[i+1] == 0xD8 {
-			// Found JPEG start (more permissive)
-			jpegStart := i
-			jpegEnd := -1
-			
-			// Find end of JPEG (FF D9)
-			for j := i + 2; j < len(data)-1; j++ {
-				if data[j] == 0xFF && data[j+1] == 0xD9 {
-					jpegEnd = j + 2
-					break
-				}
-			}
-			
-			if jpegEnd > 0 && jpegEnd-jpegStart > 1000 { // Only process significant JPEGs
-				jpegSize := jpegEnd - jpegStart
-				jpegData := data[jpegStart:jpegEnd]
-				compressedJpeg := compressJpegData(jpegData)
-				
-				if len(compressedJpeg) < jpegSize {
-					saved := jpegSize - len(compressedJpeg)
-					totalSaved += saved
-					result = append(result, compressedJpeg...)
-					fmt.Printf("[WASM] JPEG #%d compressed: %d -> %d bytes (saved %d)\n", 
-						imagesFound+1, jpegSize, len(compressedJpeg), saved)
-				} else {
-					result = append(result, jpegData...)
-				}
-				
-				imagesFound++
-				i = jpegEnd
-				continue
-			}
+	imageCount, dctCount, flateCount := 0, 0, 0
+	if opts.MaxImageDPI > 0 {
+		opts.placements = imagePlacements(doc)
+	}
+	order, pageEnds := pageOrder(doc)
+
+	page := 0
+	for i, num := range order {
+		for page < len(pageEnds) && pageEnds[page] <= i {
+			page++
+			opts.pageDone(page, len(pageEnds))
 		}
+		obj := doc.Objects[num]
+		if !obj.HasStream || !opts.inScope(num) {
+			continue
+		}
+		if obj.Dict().Name("Subtype") == "Image" {
+			imageCount++
+		}
+		filters, _ := streamFilters(doc, obj.Dict())
+		abandoned := opts.yield.low()
 		
-		// Look for PNG image markers (89 50 4E 47)
-		if i < len(data)-7 && data[i] == 0x89 && data[i+1] == 0x50 && 
-		   data[i+2] == 0x4E && data[i+3] == 0x47 {
-			// Found PNG signature
-			pngStart := i
-			pngEnd := -1
-			
-			// Look for PNG end marker (IEND + CRC)
-			for j := i + 8; j < len(data)-7; j++ {
-				if data[j] == 0x49 && data[j+1] == 0x45 && 
-				   data[j+2] == 0x4E && data[j+3] == 0x44 {
-					pngEnd = j + 8 // Include CRC
-					break
+		var compressed []byte
+		kind := ""
+		switch {
+		case len(filters) == 1 && filters[0] == "DCTDecode":
+			dctCount++
+			kind = "JPEG"
+			if len(obj.Stream) > opts.MinEmbeddedImageBytes && bytes.HasPrefix(obj.Stream, []byte{0xFF, 0xD8}) && !abandoned { // Only process significant JPEGs
+				stream, _ := applyXMPMode(obj.Stream, opts.XMP)
+				compressed = compressJpegData(stream)
+				if opts.ImageQuality > 0 || opts.MaxImageDimension > 0 || opts.MaxImageDPI > 0 {
+					compressed = reencodePDFJPEG(doc, obj, compressed, opts)
 				}
 			}
-			
-			if pngEnd > 0 && pngEnd-pngStart > 1000 { // Only process significant PNGs
-				pngSize := pngEnd - pngStart
-				pngData := data[pngStart:pngEnd]
-				compressedPng := compressPngData(pngData)
-				
-				if len(compressedPng) < pngSize {
-					saved := pngSize - len(compressedPng)
-					totalSaved += saved
-					result = append(result, compressedPng...)
-					fmt.Printf("[WASM] PNG #%d compressed: %d -> %d bytes (saved %d)\n", 
-						imagesFound+1, pngSize, len(compressedPng), saved)
-				} else {
-					result = append(result, pngData...)
-				}
-				
-				imagesFound++
-				i = pngEnd
-				continue
+		case len(filters) == 0 && bytes.HasPrefix(obj.Stream, pngSignature):
+			kind = "PNG"
+			if len(obj.Stream) > opts.MinEmbeddedImageBytes && !abandoned { // Only process significant PNGs
+				stream, _ := applyXMPMode(obj.Stream, opts.XMP)
+				compressed = compressPngData(stream)
+			}
+		default:
+			if len(filters) > 0 && filters[0] == "FlateDecode" {
+				flateCount++
 			}
+			continue
 		}
 		
-		result = append(result, data[i])
-		i++
+		imagesFound++
+		before := len(obj.Stream)
+		decision := "tooSmall"
+		if compressed != nil {
+			decision = "notSmaller"
+		} else if abandoned {
+			decision = "abandoned"
+		}
+		if compressed != nil && len(compressed) < len(obj.Stream) {
+			// A broken image costs this object its savings, not the level.
+			// Only a re-encode changes the dictionary, and it has decoded
+			// its output at the new size already.
+			if err := checkRecompressedImage(obj.Dict(), compressed); err != nil {
+				fmt.Printf("[WASM] %s (object %d) kept as is: recompressed image %v\n", kind, num, err)
+				trace(nil, "pdf.images", "rolledBack", "object", num, "kind", kind, "error", err)
+				compressed = nil
+			}
+		}
+		if compressed != nil && len(compressed) < len(obj.Stream) {
+			decision = "compressed"
+			saved := len(obj.Stream) - len(compressed)
+			totalSaved += saved
+			fmt.Printf("[WASM] %s #%d (object %d) compressed: %d -> %d bytes (saved %d)\n", 
+				kind, imagesFound, num, len(obj.Stream), len(compressed), saved)
+			obj.Stream = compressed
+		}
+		if compressed != nil {
+			opts.yield.add(before, len(obj.Stream))
+		}
+		trace(nil, "pdf.images", decision, "object", num, "offset", obj.Offset, "kind", kind, "before", before, "after", len(obj.Stream))
+	}
+	for page < len(pageEnds) {
+		page++
+		opts.pageDone(page, len(pageEnds))
 	}
+	fmt.Printf("[WASM] Found %d Image XObjects, %d DCTDecode, %d FlateDecode streams\n", imageCount, dctCount, flateCount)
 	
 	fmt.Printf("[WASM] Image compression complete: found %d images, saved %d bytes total\n", imagesFound, totalSaved)
-	fmt.Printf("[WASM] Overall: %d -> %d bytes (%.1f%% reduction)\n", 
-		len(data), len(result), (1.0-float64(len(result))/float64(len(data)))*100)
-	return result
+	return totalSaved > 0
 }
 
-// Compress JPEG data by removing only safe metadata
+// Compress JPEG data by removing only safe metadata. The file is walked
+// segment by segment, so only whole marker segments before the image data
+// are dropped, and the result must still decode or the original is kept.
 func compressJpegData(jpegData []byte) []byte {
-	result := make([]byte, 0, len(jpegData))
-	i := 0
-	bytesRemoved := 0
+	segments, _, err := ParseJPEGSegments(jpegData)
+	if err != nil {
+		fmt.Printf("[WASM] JPEG left unchanged: %v\n", err)
+		return jpegData
+	}
 	
-	for i < len(jpegData) {
-		if i < len(jpegData)-3 {
-			marker := jpegData[i:i+2]
-			
-			// Only remove safe metadata that won't break PDF structure
-			// Be much more conservative to preserve PDF validity
-			
-			// Remove EXIF data (FF E1) - but only if it's large
-			if marker[0] == 0xFF && marker[1] == 0xE1 {
-				segmentLength := int(jpegData[i+2])<<8 + int(jpegData[i+3])
-				// Only remove large EXIF segments (>10KB) to be safe
-				if segmentLength > 10240 {
-					fmt.Printf("[WASM] Removing large EXIF segment: %d bytes\n", segmentLength)
-					bytesRemoved += 2 + segmentLength
-					i += 2 + segmentLength
-					continue
-				}
+	kept := make([]jpegSegment, 0, len(segments))
+	bytesRemoved := 0
+	for _, seg := range segments {
+		// Only remove safe metadata that won't break PDF structure
+		// Be much more conservative to preserve PDF validity
+		segmentLength := len(seg.Payload) + 2
+		remove := false
+		switch {
+		case seg.Marker == 0xE1: // EXIF - but only if it's large (>10KB)
+			if segmentLength > 10240 {
+				fmt.Printf("[WASM] Removing large EXIF segment: %d bytes\n", segmentLength)
+				remove = true
 			}
-			
-			// Remove Comment segments (FF FE) - these are usually safe
-			if marker[0] == 0xFF && marker[1] == 0xFE {
-				segmentLength := int(jpegData[i+2])<<8 + int(jpegData[i+3])
-				// Only remove large comments
-				if segmentLength > 1024 {
-					fmt.Printf("[WASM] Removing large Comment segment: %d bytes\n", segmentLength)
-					bytesRemoved += 2 + segmentLength
-					i += 2 + segmentLength
-					continue
-				}
+		case seg.Marker == 0xFE: // Comment - only remove large ones
+			if segmentLength > 1024 {
+				fmt.Printf("[WASM] Removing large Comment segment: %d bytes\n", segmentLength)
+				remove = true
 			}
-			
-			// Remove only very large metadata segments (>20KB)
-			if marker[0] == 0xFF && marker[1] >= 0xE2 && marker[1] <= 0xEF {
-				segmentLength := int(jpegData[i+2])<<8 + int(jpegData[i+3])
-				if segmentLength > 20480 { // Only remove really large metadata
-					fmt.Printf("[WASM] Removing large metadata segment 0x%02X: %d bytes\n", marker[1], segmentLength)
-					bytesRemoved += 2 + segmentLength
-					i += 2 + segmentLength
-					continue
-				}
+		case seg.Marker == 0xEE:
+			// APP14 holds Adobe's color transform flag, which decoders
+			// need for CMYK and YCCK data
+		case seg.Marker >= 0xE2 && seg.Marker <= 0xEF: // Only remove really large metadata (>20KB)
+			if segmentLength > 20480 {
+				fmt.Printf("[WASM] Removing large metadata segment 0x%02X: %d bytes\n", seg.Marker, segmentLength)
+				remove = true
 			}
 		}
-		
-		result = append(result, jpegData[i])
-		i++
+		if remove {
+			bytesRemoved += 2 + segmentLength
+			continue
+		}
+		kept = append(kept, seg)
 	}
 	
 	// Only return compressed version if we actually saved significant space
-	if bytesRemoved > len(jpegData)/20 { // At least 5% reduction
-		fmt.Printf("[WASM] JPEG compression: %d -> %d bytes (%.1f%% reduction)\n", 
-			len(jpegData), len(result), (1.0-float64(len(result))/float64(len(jpegData)))*100)
-		return result
-	} else {
+	if bytesRemoved <= len(jpegData)/20 { // At least 5% reduction
 		// Not enough savings, return original to preserve PDF structure
 		return jpegData
 	}
+	result := writeJPEGSegments(kept)
+	if !jpegDecodes(result) {
+		fmt.Printf("[WASM] JPEG no longer decodes without its metadata, keeping original\n")
+		return jpegData
+	}
+	fmt.Printf("[WASM] JPEG compression: %d -> %d bytes (%.1f%% reduction)\n", 
+		len(jpegData), len(result), (1.0-float64(len(result))/float64(len(jpegData)))*100)
+	return result
 }
 
-// Compress PNG data by removing metadata
+// Compress PNG data by removing metadata. Kept chunks are written with
+// fresh CRCs, and interlaced images are stored without Adam7 when that is
+// smaller. A PNG with a bad CRC or chunk layout is returned as it is, as
+// is one whose edited layout would not be valid.
 func compressPngData(pngData []byte) []byte {
-	result := make([]byte, 0, len(pngData))
-	i := 8 // Skip PNG signature
-	
-	// Copy PNG signature
-	result = append(result, pngData[:8]...)
+	chunks, err := ParsePNGChunks(pngData)
+	if err != nil {
+		fmt.Printf("[WASM] PNG left unchanged: %v\n", err)
+		return pngData
+	}
 	
-	for i < len(pngData) {
-		if i+8 > len(pngData) {
-			// Copy remaining bytes
-			result = append(result, pngData[i:]...)
-			break
+	if isInterlacedPNG(chunks) {
+		if flat, err := deinterlacePNG(pngData, chunks); err == nil {
+			fmt.Printf("[WASM] Removed PNG interlacing\n")
+			chunks = flat
+		} else {
+			fmt.Printf("[WASM] PNG interlacing kept: %v\n", err)
 		}
-		
-		// Read chunk length and type
-		chunkLength := int(pngData[i])<<24 + int(pngData[i+1])<<16 + int(pngData[i+2])<<8 + int(pngData[i+3])
-		chunkType := string(pngData[i+4:i+8])
+	}
+	
+	var kept []pngChunk
+	for _, c := range chunks {
+		chunkLength := len(c.Data)
 		
 		// Keep essential chunks and be more conservative
 		// Only remove clearly non-essential metadata chunks
 		keepChunk := true
-		switch chunkType {
+		switch c.Type {
 		case "tEXt", "zTXt", "iTXt": // Text metadata
 			if chunkLength > 1024 { // Only remove large text chunks
 				keepChunk = false
-				fmt.Printf("[WASM] Removing large PNG text chunk: %s (%d bytes)\n", chunkType, chunkLength)
+				fmt.Printf("[WASM] Removing large PNG text chunk: %s (%d bytes)\n", c.Type, chunkLength)
 			}
 		case "tIME": // Timestamp
 			keepChunk = false
-			fmt.Printf("[WASM] Removing PNG timestamp chunk: %s (%d bytes)\n", chunkType, chunkLength)
+			fmt.Printf("[WASM] Removing PNG timestamp chunk: %s (%d bytes)\n", c.Type, chunkLength)
 		case "pHYs": // Physical dimensions - only remove if large
 			if chunkLength > 512 {
 				keepChunk = false
-				fmt.Printf("[WASM] Removing PNG pHYs chunk: %s (%d bytes)\n", chunkType, chunkLength)
+				fmt.Printf("[WASM] Removing PNG pHYs chunk: %s (%d bytes)\n", c.Type, chunkLength)
 			}
 		}
 		
 		if keepChunk {
-			// Copy the entire chunk (length + type + data + CRC)
-			chunkEnd := i + 12 + chunkLength
-			if chunkEnd <= len(pngData) {
-				result = append(result, pngData[i:chunkEnd]...)
-			}
+			kept = append(kept, c)
 		}
-		
-		// Move to next chunk
-		i += 12 + chunkLength
 	}
 	
+	result, err := writePNGChunks(kept)
+	if err != nil {
+		fmt.Printf("[WASM] PNG left unchanged: %v\n", err)
+		return pngData
+	}
 	return result
 }
 
-// Remove metadata from PDF binary data
-func removeMetadataBinary(data []byte) []byte {
-	fmt.Printf("[WASM] removeMetadataBinary: removing metadata\n")
-	
-	// Convert to string for pattern matching (safe for text sections)
-	content := string(data)
-	
-	// Remove common metadata patterns
-	patterns := []string{
-		"/Creator", "/Producer", "/CreationDate", "/ModDate",
-		"/Title", "/Author", "/Subject", "/Keywords",
+// Remove opts.StripMetadata entries from the document information
+// dictionary. Only the /Info object is edited, so keys like /Title in
+// outlines or annotations are left alone.
+func (doc *pdfDocument) removeMetadata(opts pdfOptions) bool {
+	fmt.Printf("[WASM] removeMetadata: removing metadata\n")
+	if len(opts.StripMetadata) == 0 {
+		return false
 	}
-	
-	for _, pattern := range patterns {
-		for {
-			start := strings.Index(content, pattern)
-			if start == -1 {
-				break
-			}
-			
-			// Find the end of this metadata entry
-			end := start + len(pattern)
-			
-			// Skip to end of the value (look for next / or >>)
-			for end < len(content) && content[end] != '/' && !strings.HasPrefix(content[end:], ">>") {
-				end++
-			}
-			
-			// Remove this metadata entry
-			content = content[:start] + content[end:]
-			fmt.Printf("[WASM] Removed metadata: %s\n", pattern)
+	infoRef, ok := doc.Trailer.Get("Info")
+	info := doc.resolveDict(infoRef)
+	if !ok || info == nil {
+		return false
+	}
+
+	keep := map[string]bool{}
+	for _, key := range opts.KeepMetadata {
+		keep[strings.TrimPrefix(key, "/")] = true
+	}
+	removed := 0
+	var strip []string
+	for _, key := range opts.StripMetadata {
+		if key == "*" {
+			strip = append(strip, info.Keys...)
+			continue
 		}
+		strip = append(strip, key)
 	}
-	
-	return []byte(content)
+	for _, key := range strip {
+		key = strings.TrimPrefix(key, "/")
+		if _, present := info.Get(key); !present || keep[key] {
+			continue
+		}
+		info.Delete(key)
+		removed++
+		fmt.Printf("[WASM] Removed metadata: /%s\n", key)
+		trace(nil, "pdf.metadata", "removed", "key", key)
+	}
+	return removed > 0
 }
 
 // Optimize PDF streams and remove duplicates
@@ -347,13 +338,13 @@ func optimizeStreams(data []byte) []byte {
 }
 
 // Aggressive PDF compression - targets PDF object structure
-func aggressivePdfCompression(data []byte) []byte {
+func aggressivePdfCompression(data []byte, opts pdfOptions) []byte {
 	fmt.Printf("[WASM] aggressivePdfCompression: trying more aggressive approaches\n")
 	
 	content := string(data)
 	
 	// Strategy 1: Remove entire image objects that are very large
-	result := removeImageObjects(content)
+	result := removeImageObjects(content, opts.MaxObjectRemovalBytes)
 	fmt.Printf("[WASM] After removing image objects: %d -> %d bytes\n", len(content), len(result))
 	
 	// Strategy 2: Compress streams more aggressively
@@ -368,7 +359,7 @@ func aggressivePdfCompression(data []byte) []byte {
 }
 
 // Remove large image objects from PDF
-func removeImageObjects(content string) string {
+func removeImageObjects(content string, maxBytes int) string {
 	fmt.Printf("[WASM] removeImageObjects: scanning for large image objects\n")
 	
 	// Look for image objects and remove the largest ones
@@ -398,8 +389,8 @@ func removeImageObjects(content string) string {
 			
 			// If we hit endobj, decide whether to keep this object
 			if strings.Contains(line, "endobj") {
-				// Remove objects larger than 100KB
-				if objectSize > 100000 {
+				// Remove objects larger than maxBytes
+				if objectSize > maxBytes {
 					fmt.Printf("[WASM] Removing large image object: %d bytes\n", objectSize)
 					// Replace with minimal placeholder
 					filtered = append(filtered, "% Large image object removed for compression")
@@ -458,38 +449,55 @@ func compressStreamsAggressively(content string) string {
 	return result
 }
 
+// Metadata markers and object ends, found in one pass by removeDuplicateObjects
+var duplicateObjectMarkers = newPatternSet([][]byte{[]byte("/Type /Metadata"), []byte("endobj")})
+
 // Remove duplicate objects
 func removeDuplicateObjects(content string) string {
 	fmt.Printf("[WASM] removeDuplicateObjects: removing redundant objects\n")
 	
-	// Simple approach: remove duplicate /Metadata objects
-	metadataCount := strings.Count(content, "/Type /Metadata")
-	if metadataCount > 1 {
-		fmt.Printf("[WASM] Found %d metadata objects, keeping only first\n", metadataCount)
-		
-		// Keep only the first metadata object
-		first := strings.Index(content, "/Type /Metadata")
-		if first != -1 {
-			remaining := content[first+len("/Type /Metadata"):]
-			for strings.Contains(remaining, "/Type /Metadata") {
-				start := strings.Index(remaining, "/Type /Metadata")
-				// Find the end of this metadata object
-				objEnd := strings.Index(remaining[start:], "endobj")
-				if objEnd != -1 {
-					objEnd += start + len("endobj")
-					remaining = remaining[:start] + remaining[objEnd:]
-				} else {
-					break
-				}
+	// Simple approach: remove duplicate /Metadata objects, keeping the
+	// first and cutting each later one up to the end of its object
+	var out strings.Builder
+	metadataCount := 0
+	kept, cutFrom := 0, -1
+	duplicateObjectMarkers.scan([]byte(content), func(p, at int) bool {
+		switch {
+		case p == 0:
+			metadataCount++
+			if metadataCount > 1 && cutFrom < 0 {
+				cutFrom = at
 			}
-			content = content[:first+len("/Type /Metadata")] + remaining
+		case p == 1 && cutFrom >= 0:
+			out.WriteString(content[kept:cutFrom])
+			kept, cutFrom = at+len("endobj"), -1
 		}
+		return true
+	})
+	if metadataCount > 1 {
+		fmt.Printf("[WASM] Found %d metadata objects, keeping only first\n", metadataCount)
 	}
+	out.WriteString(content[kept:])
 	
-	return content
+	return out.String()
 }
 
-// PDF compression with proper argument handling and logging
+// PDF compression with proper argument handling and logging. The optional
+// third argument {provenance, preset, deterministic} embeds an XMP record
+// of how the output was produced; it also takes the pdfOptions fields and
+// a priority ("interactive" by default, or "background"). With report set
+// to "markdown" or "html" the result also carries report and reportType,
+// a readable account of what was removed and changed. The result's pages
+// lists {page, originalSize, compressedSize} for every page, shared objects
+// split between the pages using them.
+//
+// Concurrent calls share no mutable state: each copies its input before
+// returning, runs under its own job (the promise carries jobId, for
+// cancelJob) and calls progress as progress(percent, jobId), so a
+// callback shared between calls can tell them apart. While images are
+// recompressed it is called once per page as progress(percent, jobId,
+// {page, pages}). Settings and policy are read once, when the call is
+// made.
 func compressPDF(this js.Value, args []js.Value) interface{} {
 	// Capture original arguments before creating Promise handler
 	fmt.Printf("[WASM] compressPDF called with %d arguments\n", len(args))
@@ -507,14 +515,58 @@ func compressPDF(this js.Value, args []js.Value) interface{} {
 	if len(args) > 1 {
 		progressCallback = args[1]
 	}
+	var prov provenanceOptions
+	var lane laneOptions
+	opts := currentSettings().PDF
+	if len(args) > 2 {
+		err := decodeOptions(args[2], &prov)
+		if err == nil {
+			err = decodeOptions(args[2], &opts)
+		}
+		if err == nil {
+			err = opts.validate()
+		}
+		if err == nil {
+			err = decodeOptions(args[2], &lane)
+		}
+		if err == nil {
+			err = lane.validate()
+		}
+		if err != nil {
+			return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+				promiseArgs[1].Invoke(js.ValueOf("compressPDF: " + err.Error()))
+				return nil
+			}))
+		}
+	}
+
+	policy := currentPolicy()
+	opts = policy.applyPDF(opts)
+	release, err := admitInput(peekJS(inputArray, sniffPeekBytes), "", inputArray.Length())
+	if err != nil {
+		return runAsync("compressPDF", func() (interface{}, error) {
+			return nil, err
+		})
+	}
 
 	fmt.Printf("[WASM] Input data type: %s, length: %d\n", inputArray.Type().String(), inputArray.Length())
 
+	// The input is copied and the job registered before the promise is
+	// returned, so a host reusing its buffer for the next call cannot
+	// change this call's bytes, and cancelJob works at once
+	inputBytes := bytesFromJS(inputArray)
+	fmt.Printf("[WASM] Successfully copied %d bytes\n", len(inputBytes))
+	j := startJobInLane("pdf", lane.Priority)
+
 	handler := js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
 		resolve := promiseArgs[0]
 		reject := promiseArgs[1]
 
 		go func() {
+			defer j.finish()
+			defer release()
+			m := newMetrics("pdf", inputBytes)
+			defer m.send(j.ctx)
 			defer func() {
 				if r := recover(); r != nil {
 					errorMsg := fmt.Sprintf("Panic in PDF compression: %v", r)
@@ -525,36 +577,45 @@ func compressPDF(this js.Value, args []js.Value) interface{} {
 
 			fmt.Printf("[WASM] Starting PDF compression process\n")
 
-			if inputArray.Length() == 0 {
+			if len(inputBytes) == 0 {
 				fmt.Printf("[WASM ERROR] Empty input data\n")
 				reject.Invoke(js.ValueOf("Empty input data"))
 				return
 			}
 
-			fmt.Printf("[WASM] Creating byte slice of size %d\n", inputArray.Length())
-			inputBytes := make([]byte, inputArray.Length())
-			
-			fmt.Printf("[WASM] Copying bytes from JS to Go\n")
-			js.CopyBytesToGo(inputBytes, inputArray)
-			fmt.Printf("[WASM] Successfully copied %d bytes\n", len(inputBytes))
+			reportProgress := progressReporter(progressCallback, j)
+			reportProgress(10)
 
-			reportProgress := func(progress int) {
-				if !progressCallback.IsUndefined() && !progressCallback.IsNull() {
-					progressCallback.Invoke(js.ValueOf(progress))
-				}
+			violations := policy.checkInput("application/pdf")
+			if err := policy.enforce(violations); err != nil {
+				reject.Invoke(js.ValueOf(err.Error()))
+				return
 			}
 
-			reportProgress(10)
-
 			// Implement basic PDF compression through size reduction
 			fmt.Printf("[WASM] Starting PDF processing\n")
 			
-			// For PDF files, we'll implement a multi-step compression:
-			// 1. Remove metadata and unnecessary data
-			// 2. Compress streams
-			// 3. Remove redundant objects
+			// For PDF files, we try progressively safer levels, each
+			// running its passes on the one parsed input (see pdfLevels):
+			// 1. Every pass
+			// 2. Images and stream recoding only
+			// 3. Metadata only
+			// 4. Return the original
 			
-			outputBytes := compressPDFData(inputBytes, reportProgress)
+			opts.reportPage = pageProgressReporter(progressCallback, j)
+			pdfRes, err := compressPDFData(j.ctx, inputBytes, opts, reportProgress)
+			if err != nil {
+				m.failed(err)
+				reject.Invoke(js.ValueOf(err.Error()))
+				return
+			}
+			pdfRes.Warnings = append(pdfRes.Warnings, prov.applyPDF(inputBytes, &pdfRes)...)
+			violations = append(violations, policy.checkOutput("application/pdf", pdfRes.Data, pdfRes.Output)...)
+			if err := policy.enforce(violations); err != nil {
+				reject.Invoke(js.ValueOf(err.Error()))
+				return
+			}
+			outputBytes := pdfRes.Data
 			fmt.Printf("[WASM] PDF compression completed: %d -> %d bytes\n", len(inputBytes), len(outputBytes))
 
 			// Create JS Uint8Array for return
@@ -567,18 +628,154 @@ func compressPDF(this js.Value, args []js.Value) interface{} {
 			result.Set("originalSize", len(inputBytes))
 			result.Set("compressedSize", len(outputBytes))
 			result.Set("compressionRatio", float64(len(outputBytes))/float64(len(inputBytes)))
+			result.Set("fallbackLevel", pdfRes.Level)
+			if attempts, err := jsonToJS(pdfRes.Attempts); err == nil {
+				result.Set("attempts", attempts)
+			}
+			if pages := pageStats(pdfRes); pages != nil {
+				if v, err := jsonToJS(pages); err == nil {
+					result.Set("pages", v)
+				}
+			}
+			setMessages(result, pdfRes.Warnings)
+			setPolicyViolations(result, violations)
+			if opts.Report != "" {
+				report, reportType := collectPDFActions(inputBytes, pdfRes).render(opts.Report, time.Now())
+				result.Set("report", report)
+				result.Set("reportType", reportType)
+			}
 
+			m.succeeded(outputBytes, "pdf-"+pdfRes.Level, pdfRes.Warnings)
+			reportProgress(100)
 			resolve.Invoke(result)
 		}()
 
 		return nil
 	})
 
-	promiseConstructor := js.Global().Get("Promise")
-	return promiseConstructor.New(handler)
+	promise := js.Global().Get("Promise").New(handler)
+	promise.Set("jobId", j.id)
+	return promise
+}
+
+// Image compression options passed as the optional fourth argument
+type imageOptions struct {
+	// "photo" runs the JPEG quality ladder; "screenshot" keeps text sharp
+	// with palette/lossless PNG and never produces JPEG
+	Mode string `json:"mode"`
+
+	// How animated PNG/WebP inputs are handled: "optimize" keeps every
+	// frame, "firstFrame" compresses only the first frame as a still image
+	Animation string `json:"animation"`
+
+	// Images larger than this on either side are downscaled first
+	MaxDimension int `json:"maxDimension"`
+
+	// Minimum fractional saving before a re-encode replaces the original
+	MinSavings float64 `json:"minSavings"`
+
+	// Time budget in milliseconds (0 = unlimited). Slow strategies are
+	// skipped and the best result so far is returned when it runs out.
+	MaxMs int `json:"maxMs"`
+
+	// Also return the other encodes that were tried, so the host can
+	// negotiate formats or let the user pick
+	Alternatives bool `json:"alternatives"`
+
+	// Process inputs tagged as earlier outputs instead of returning them
+	// unchanged
+	AllowRecompress bool `json:"allowRecompress"`
+
+	// Convert AdobeRGB, ProPhoto and Display P3 images to sRGB. Without
+	// it the embedded profile is dropped as is, and wide-gamut images
+	// look washed out where color is not managed.
+	ConvertToSRGB bool `json:"convertToSRGB"`
+
+	// XMP handling ("keep", "minimize" or "strip") for originals that are
+	// returned unchanged; re-encoded outputs carry no metadata
+	XMP string `json:"xmp"`
+
+	// JPEG qualities the photo ladder tries, highest first; empty uses
+	// 85/75/60/40
+	Qualities []int `json:"qualities"`
+
+	// Stop the ladder once an encode saves at least this fraction (0 =
+	// always encode every rung). Rungs run from the highest quality down,
+	// so the first encode that reaches the target is also the sharpest.
+	TargetSavings float64 `json:"targetSavings"`
+
+	// Stop the ladder once more than half of its rungs are encoded with
+	// under 1% saved, and skip the PNG fallback; screenshots and
+	// transparent images are not affected
+	EarlyAbort bool `json:"earlyAbort"`
+
+	// EXIF orientation applied to the decoded pixels, for callers that
+	// know it from a container (RAW previews); not settable from JS
+	orientation int
 }
 
-// Image compression with proper argument handling and logging
+func defaultImageOptions() imageOptions {
+	return imageOptions{Mode: modePhoto, Animation: animationOptimize, MaxDimension: 2048, MinSavings: 0.05, XMP: xmpKeep}
+}
+
+// Outcome of a single image compression run
+type imageResult struct {
+	Data     []byte
+	Animated bool
+	Frames   int
+	Warnings []message
+	TimedOut bool // the time budget cut the pipeline short
+
+	Alternatives []imageCandidate // runner-up encodes, smallest first
+}
+
+// An encode produced while searching for the best one
+type imageCandidate struct {
+	Label    string
+	MimeType string
+	Quality  int // JPEG quality; 0 for lossless encodes
+	Data     []byte
+}
+
+// Candidates other than the chosen output, smallest first
+func runnerUps(tried []imageCandidate, chosen []byte) []imageCandidate {
+	var out []imageCandidate
+	for _, c := range tried {
+		if !bytes.Equal(c.Data, chosen) {
+			out = append(out, c)
+		}
+	}
+	sort.SliceStable(out, func(a, b int) bool { return len(out[a].Data) < len(out[b].Data) })
+	return out
+}
+
+// result.alternatives: [{label, mimeType, quality?, size, data}]
+func alternativesToJS(alternatives []imageCandidate) js.Value {
+	arr := js.Global().Get("Array").New(len(alternatives))
+	for i, c := range alternatives {
+		item := js.Global().Get("Object").New()
+		item.Set("label", c.Label)
+		item.Set("mimeType", c.MimeType)
+		if c.Quality > 0 {
+			item.Set("quality", c.Quality)
+		}
+		item.Set("size", len(c.Data))
+		item.Set("data", bytesToJS(c.Data))
+		arr.SetIndex(i, item)
+	}
+	return arr
+}
+
+// Image compression with proper argument handling and logging. data may be
+// a Uint8Array or a data: URL; options.dataURL also returns the output as
+// result.dataURL, up to maxDataURLSize characters, and options.base64 as
+// result.base64. options.alternatives adds result.alternatives, the other
+// encodes tried: [{label, mimeType, quality?, size, data}]. With
+// options.provenance a record of the run is embedded in re-encoded output
+// (see compressPDF). options.priority is "interactive" by default;
+// "background" jobs give way to interactive ones. WebP, AVIF and PSD
+// inputs are decoded too; a PSD is compressed from its flattened composite.
+// Calls are isolated from each other as described for compressPDF.
 func compressImage(this js.Value, args []js.Value) interface{} {
 	// Capture original arguments before creating Promise handler
 	fmt.Printf("[WASM] compressImage called with %d arguments\n", len(args))
@@ -597,14 +794,82 @@ func compressImage(this js.Value, args []js.Value) interface{} {
 	if len(args) > 2 {
 		progressCallback = args[2]
 	}
+	opts := currentSettings().Image
+	var urlOpts dataURLOptions
+	var prov provenanceOptions
+	var lane laneOptions
+	if len(args) > 3 {
+		err := decodeOptions(args[3], &opts)
+		if err == nil {
+			err = decodeOptions(args[3], &urlOpts)
+		}
+		if err == nil {
+			err = decodeOptions(args[3], &prov)
+		}
+		if err == nil {
+			err = decodeOptions(args[3], &lane)
+		}
+		if err == nil {
+			err = lane.validate()
+		}
+		if err != nil {
+			return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+				promiseArgs[1].Invoke(js.ValueOf("compressImage: " + err.Error()))
+				return nil
+			}))
+		}
+	}
+
+	policy := currentPolicy()
+	opts = policy.applyImage(opts)
+
+	// A data: URL carries its own media type, used when mimeType is empty
+	var urlBytes []byte
+	if inputArray.Type() == js.TypeString {
+		urlMime, data, err := parseDataURL(inputArray.String())
+		if err != nil {
+			return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+				promiseArgs[1].Invoke(js.ValueOf("compressImage: " + err.Error()))
+				return nil
+			}))
+		}
+		urlBytes = data
+		if !isSet(args[1]) || args[1].String() == "" {
+			mimeType = urlMime
+		}
+	}
 
-	fmt.Printf("[WASM] Image data type: %s, length: %d, mimeType: %s\n", inputArray.Type().String(), inputArray.Length(), mimeType)
+	// Rejected before the input is copied
+	head, size := urlBytes, len(urlBytes)
+	if head == nil {
+		head, size = peekJS(inputArray, sniffPeekBytes), inputArray.Length()
+	}
+	release, err := admitInput(head, mimeType, size)
+	if err != nil {
+		return runAsync("compressImage", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+
+	// Copied and registered before the promise is returned, as in compressPDF
+	inputBytes := urlBytes
+	if inputBytes != nil {
+		fmt.Printf("[WASM] Image data URL, length: %d, mimeType: %s\n", len(urlBytes), mimeType)
+	} else {
+		fmt.Printf("[WASM] Image data type: %s, length: %d, mimeType: %s\n", inputArray.Type().String(), inputArray.Length(), mimeType)
+		inputBytes = bytesFromJS(inputArray)
+	}
+	j := startJobInLane("image", lane.Priority)
 
 	handler := js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
 		resolve := promiseArgs[0]
 		reject := promiseArgs[1]
 
 		go func() {
+			defer j.finish()
+			defer release()
+			m := newMetrics("image", inputBytes)
+			defer m.send(j.ctx)
 			defer func() {
 				if r := recover(); r != nil {
 					errorMsg := fmt.Sprintf("Panic in image compression: %v", r)
@@ -614,192 +879,509 @@ func compressImage(this js.Value, args []js.Value) interface{} {
 			}()
 
 			fmt.Printf("[WASM] Starting image compression process\n")
+			reportProgress := progressReporter(progressCallback, j)
 
-			fmt.Printf("[WASM] Creating byte slice of size %d\n", inputArray.Length())
-			inputBytes := make([]byte, inputArray.Length())
-			
-			fmt.Printf("[WASM] Copying bytes from JS to Go\n")
-			js.CopyBytesToGo(inputBytes, inputArray)
-			fmt.Printf("[WASM] Successfully copied %d bytes\n", len(inputBytes))
+			inputType := policyInputType(inputBytes, mimeType)
+			violations := policy.checkInput(inputType)
+			if err := policy.enforce(violations); err != nil {
+				reject.Invoke(js.ValueOf(err.Error()))
+				return
+			}
 
-			reportProgress := func(progress int) {
-				if !progressCallback.IsUndefined() && !progressCallback.IsNull() {
-					progressCallback.Invoke(js.ValueOf(progress))
-				}
+			res, err := compressImageData(j.ctx, inputBytes, mimeType, opts, reportProgress)
+			if err != nil {
+				m.failed(err)
+				reject.Invoke(js.ValueOf(err.Error()))
+				return
+			}
+			res.Data = policy.finishImage(res.Data)
+			var provWarnings []message
+			res.Data, provWarnings = prov.apply(inputBytes, res.Data, opts.Mode)
+			res.Warnings = append(res.Warnings, provWarnings...)
+			violations = append(violations, policy.checkOutput(inputType, res.Data, nil)...)
+			if err := policy.enforce(violations); err != nil {
+				reject.Invoke(js.ValueOf(err.Error()))
+				return
 			}
 
-			reportProgress(20)
+			// Create result
+			result := newResultObject(inputBytes, res.Data)
+			if res.Animated {
+				result.Set("animated", true)
+				result.Set("frames", res.Frames)
+			}
+			if res.TimedOut {
+				result.Set("timedOut", true)
+			}
+			setMessages(result, res.Warnings)
+			setPolicyViolations(result, violations)
+			if len(res.Alternatives) > 0 {
+				result.Set("alternatives", alternativesToJS(res.Alternatives))
+			}
+			urlOpts.apply(result, sniffMimeType(res.Data), res.Data)
 
-			// Decode image
-			var img image.Image
-			var err error
+			m.succeeded(res.Data, "image-"+strings.TrimPrefix(sniffMimeType(res.Data), "image/"), res.Warnings)
+			reportProgress(100)
+			resolve.Invoke(result)
+		}()
 
-			reader := bytes.NewReader(inputBytes)
-			
-			if strings.Contains(mimeType, "jpeg") || strings.Contains(mimeType, "jpg") {
-				img, err = jpeg.Decode(reader)
-			} else if strings.Contains(mimeType, "png") {
-				img, err = png.Decode(reader)
-			} else {
-				// Try to decode as generic image
-				img, _, err = image.Decode(reader)
-			}
+		return nil
+	})
 
-			if err != nil {
-				reject.Invoke(js.ValueOf(fmt.Sprintf("Failed to decode image: %v", err)))
-				return
-			}
+	promise := js.Global().Get("Promise").New(handler)
+	promise.Set("jobId", j.id)
+	return promise
+}
 
-			reportProgress(40)
+// Handle animated PNG/WebP inputs. Returns handled=false for still images,
+// otherwise either the frame-aware optimized file or, in firstFrame mode,
+// the decoded first frame for the regular still-image pipeline.
+func prepareAnimatedImage(inputBytes []byte, opts imageOptions) (res imageResult, firstFrame image.Image, handled bool, err error) {
+	var frames int
+	var optimize func([]byte) ([]byte, error)
+	var decodeFirst func([]byte) (image.Image, error)
+
+	switch {
+	case isAnimatedPNG(inputBytes):
+		frames = apngFrameCount(inputBytes)
+		optimize = optimizeAPNG
+		decodeFirst = decodeAPNGFirstFrame
+	case isAnimatedWebP(inputBytes):
+		frames = webpFrameCount(inputBytes)
+		optimize = optimizeAnimatedWebP
+		decodeFirst = decodeWebPFirstFrame
+	default:
+		return res, nil, false, nil
+	}
 
-			// Get image dimensions
-			bounds := img.Bounds()
-			width := bounds.Dx()
-			height := bounds.Dy()
+	fmt.Printf("[WASM] Animated image detected: %d frames, mode %s\n", frames, opts.Animation)
 
-			// Resize if image is too large
-			maxDimension := 2048
-			if width > maxDimension || height > maxDimension {
-				if width > height {
-					height = height * maxDimension / width
-					width = maxDimension
-				} else {
-					width = width * maxDimension / height
-					height = maxDimension
-				}
-				img = imaging.Resize(img, width, height, imaging.Lanczos)
-			}
+	switch opts.Animation {
+	case animationFirstFrame:
+		firstFrame, err = decodeFirst(inputBytes)
+		if err != nil {
+			return res, nil, true, fmt.Errorf("Failed to decode first frame: %v", err)
+		}
+		res.Warnings = append(res.Warnings, newMessage("image.firstFrameOnly", "frames", frames))
+		return res, firstFrame, true, nil
 
-			reportProgress(60)
+	case animationOptimize, "":
+		optimized, err := optimize(inputBytes)
+		if err != nil {
+			return res, nil, true, fmt.Errorf("Failed to optimize animation: %v", err)
+		}
+		if len(optimized) >= len(inputBytes) {
+			optimized = inputBytes
+		}
+		return imageResult{Data: optimized, Animated: true, Frames: frames}, nil, true, nil
 
-			// Try different compression methods and choose the best
-			var bestResult []byte
-			var bestSize int = len(inputBytes)
-			fmt.Printf("[WASM] Original image size: %d bytes\n", len(inputBytes))
+	default:
+		return res, nil, true, fmt.Errorf("unknown animation mode %q", opts.Animation)
+	}
+}
 
-			// Method 1: High-quality JPEG (85%)
-			jpegBuf := new(bytes.Buffer)
-			err = jpeg.Encode(jpegBuf, img, &jpeg.Options{Quality: 85})
-			if err == nil && jpegBuf.Len() < bestSize {
-				bestResult = jpegBuf.Bytes()
-				bestSize = jpegBuf.Len()
-				fmt.Printf("[WASM] JPEG 85%% quality: %d bytes\n", jpegBuf.Len())
-			}
+// Core image compression pipeline shared by compressImage and batch mode
+func compressImageData(ctx context.Context, inputBytes []byte, mimeType string, opts imageOptions, reportProgress func(int)) (imageResult, error) {
+	budget := newTimeBudget(opts.MaxMs)
+	reportProgress(20)
 
-			reportProgress(70)
+	if opts.Mode != modePhoto && opts.Mode != modeScreenshot {
+		return imageResult{}, fmt.Errorf("unknown image mode %q", opts.Mode)
+	}
+	if err := checkXMPMode(opts.XMP); err != nil {
+		return imageResult{}, err
+	}
+	if err := checkQualityLadder(opts.Qualities); err != nil {
+		return imageResult{}, err
+	}
+	if opts.TargetSavings < 0 || opts.TargetSavings >= 1 {
+		return imageResult{}, errors.New("targetSavings must be in [0, 1)")
+	}
+	var tried []imageCandidate
+	keep := func(c imageCandidate) {
+		trace(ctx, "image", "candidate", "label", c.Label, "type", c.MimeType, "size", len(c.Data))
+		if opts.Alternatives {
+			tried = append(tried, c)
+		}
+	}
 
-			// Method 2: Medium-quality JPEG (75%)
-			jpegBuf2 := new(bytes.Buffer)
-			err = jpeg.Encode(jpegBuf2, img, &jpeg.Options{Quality: 75})
-			if err == nil && jpegBuf2.Len() < bestSize {
-				bestResult = jpegBuf2.Bytes()
-				bestSize = jpegBuf2.Len()
-				fmt.Printf("[WASM] JPEG 75%% quality: %d bytes (best so far)\n", jpegBuf2.Len())
-			}
+	// Every pass over the same photo costs quality: tagged outputs are
+	// returned as they are, likely ones get a warning
+	guard := ""
+	if !opts.AllowRecompress {
+		guard = previousOutput(inputBytes)
+	}
+	if guard == "marker" {
+		fmt.Printf("[WASM] Input is an earlier output, skipping\n")
+		return imageResult{Data: inputBytes, Warnings: []message{previousOutputWarning(guard)}}, nil
+	}
 
-			reportProgress(80)
+	// Animated inputs never go through image.Decode implicitly, since that
+	// would silently keep only the first frame
+	res, img, handled, err := prepareAnimatedImage(inputBytes, opts)
+	if err != nil {
+		return res, err
+	}
+	if guard != "" {
+		res.Warnings = append(res.Warnings, previousOutputWarning(guard))
+	}
+	if handled && img == nil {
+		return res, nil
+	}
 
-			// Method 3: Lower quality JPEG (60%)
-			jpegBuf3 := new(bytes.Buffer)
-			err = jpeg.Encode(jpegBuf3, img, &jpeg.Options{Quality: 60})
-			if err == nil && jpegBuf3.Len() < bestSize {
-				bestResult = jpegBuf3.Bytes()
-				bestSize = jpegBuf3.Len()
-				fmt.Printf("[WASM] JPEG 60%% quality: %d bytes (best so far)\n", jpegBuf3.Len())
+	// Decode image; the format is sniffed, so WebP and AVIF inputs are
+	// resized and re-encoded like any other
+	if img == nil {
+		decodeStart := time.Now()
+		img, err = decodeStillImage(inputBytes)
+		if err != nil {
+			return res, fmt.Errorf("Failed to decode image: %v", err)
+		}
+		trace(ctx, "image", "decoded", "type", sniffMimeType(inputBytes),
+			"width", img.Bounds().Dx(), "height", img.Bounds().Dy(), "ms", msSince(decodeStart))
+		// Bursts and live photos hold more than the primary image
+		if sniffed := sniffMimeType(inputBytes); sniffed == "image/heic" || sniffed == "image/heif" {
+			if f, err := parseHEIF(inputBytes); err == nil && len(f.topLevelImages()) > 1 {
+				res.Warnings = append(res.Warnings, newMessage("image.heifMoreImages", "count", len(f.topLevelImages())-1))
 			}
+		}
+	}
+	img = orientImage(img, opts.orientation)
 
-			// Method 4: Aggressive JPEG (40%)
-			jpegBuf4 := new(bytes.Buffer)
-			err = jpeg.Encode(jpegBuf4, img, &jpeg.Options{Quality: 40})
-			if err == nil && jpegBuf4.Len() < bestSize {
-				bestResult = jpegBuf4.Bytes()
-				bestSize = jpegBuf4.Len()
-				fmt.Printf("[WASM] JPEG 40%% quality: %d bytes (best so far)\n", jpegBuf4.Len())
-			}
+	// Outputs carry no profile, so wide-gamut pixels would be read as sRGB
+	if opts.ConvertToSRGB {
+		var notes []message
+		img, notes = applyColorProfile(img, inputBytes)
+		res.Warnings = append(res.Warnings, notes...)
+	}
+
+	reportProgress(40)
+
+	// Screenshots are never resized or JPEG-encoded: both smear text
+	if opts.Mode == modeScreenshot {
+		var warnings []message
+		res.Data, warnings, res.TimedOut = compressScreenshot(img, inputBytes, budget, reportProgress, keep)
+		res.Warnings = append(res.Warnings, warnings...)
+		// Only re-encoded pixels are tagged: an original with its XMP
+		// edited must still be compressed when it comes back
+		if bytes.Equal(res.Data, inputBytes) {
+			res.Data, _ = applyXMPMode(inputBytes, opts.XMP)
+		} else {
+			res.Data = tagOutput(res.Data)
+		}
+		res.Alternatives = runnerUps(tried, res.Data)
+		return res, nil
+	}
+
+	// Resize once if the image is too large; every candidate below
+	// encodes from this source
+	src := newEncodeSource(img, opts.MaxDimension, budget)
+	width, height := src.size()
+
+	reportProgress(60)
+	if err := checkCancelled(ctx); err != nil {
+		return res, err
+	}
+
+	// Decoding alone used up the budget: the original is the best result
+	if budget.exceeded() {
+		res.Data = inputBytes
+		res.TimedOut = true
+		res.Warnings = append(res.Warnings, newMessage("budget.beforeEncoding"))
+		return res, nil
+	}
 
-			reportProgress(90)
+	// Try different compression methods and choose the best
+	var bestResult []byte
+	var bestSize int = len(inputBytes)
+	fmt.Printf("[WASM] Original image size: %d bytes\n", len(inputBytes))
+
+	if hasTransparency(src.img) {
+		// JPEG would flatten the alpha channel: transparent images only
+		// compete as palette PNG and lossless WebP
+		data, warnings, timedOut := compressTransparentImage(src.img, budget, reportProgress, keep)
+		res.Warnings = append(res.Warnings, warnings...)
+		res.TimedOut = res.TimedOut || timedOut
+		if data != nil && len(data) < bestSize {
+			bestResult = data
+			bestSize = len(data)
+		}
+	} else {
+		// JPEG quality ladder. Sizes fall with quality, so without a savings
+		// target the ladder nearly always ends on its last rung; under a
+		// time budget only that rung is encoded.
+		qualities := descendingQualities(opts.Qualities)
+		// Encoding above the source's quality only adds bytes
+		if strings.Contains(mimeType, "jpeg") || strings.Contains(mimeType, "jpg") {
+			if est, err := estimateJPEGQuality(inputBytes); err == nil {
+				qualities = qualitiesUpTo(qualities, est.Quality)
+				fmt.Printf("[WASM] Source JPEG quality about %d, ladder %v\n", est.Quality, qualities)
+				trace(ctx, "image.ladder", "sourceQuality", "quality", est.Quality, "ladder", qualities)
+			}
+		}
+		if budget.limited() {
+			qualities = qualities[len(qualities)-1:]
+		}
+		done := 0
+		abortedAt := 0.0
+		err = encodeJPEGLadder(ctx, src, qualities, func(e ladderEncode) bool {
+			done++
+			trace(ctx, "image.ladder", "rung", "quality", e.Quality, "size", len(e.Data), "error", e.Err)
+			if e.Err == nil {
+				if opts.Alternatives || len(e.Data) < bestSize {
+					data := append([]byte(nil), e.Data...)
+					keep(imageCandidate{Label: fmt.Sprintf("jpeg q%d", e.Quality), MimeType: "image/jpeg", Quality: e.Quality, Data: data})
+					if len(data) < bestSize {
+						bestResult = data
+						bestSize = len(data)
+						fmt.Printf("[WASM] JPEG %d%% quality: %d bytes (best so far)\n", e.Quality, len(data))
+					}
+				}
+			}
+			reportProgress(60 + done*30/len(qualities))
+			if opts.EarlyAbort && done < len(qualities) && lowYield(done*len(inputBytes), len(inputBytes)-bestSize, len(qualities)*len(inputBytes)) {
+				fmt.Printf("[WASM] Ladder saved %d bytes after %d rungs, %d rungs skipped\n", len(inputBytes)-bestSize, done, len(qualities)-done)
+				trace(ctx, "image.ladder", "earlyAbort", "rungs", done, "of", len(qualities))
+				abortedAt = float64(done) / float64(len(qualities))
+				return false
+			}
+			if opts.TargetSavings > 0 && float64(bestSize) <= float64(len(inputBytes))*(1-opts.TargetSavings) {
+				fmt.Printf("[WASM] Savings target reached at quality %d, %d rungs skipped\n", e.Quality, len(qualities)-done)
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return res, err
+		}
 
-			// If no significant compression achieved, try PNG
-			if float64(bestSize) >= float64(len(inputBytes))*0.8 && !strings.Contains(mimeType, "png") {
+		// If no significant compression achieved, try PNG. PNG encoding costs
+		// several JPEG encodes, so it is skipped when it no longer fits in the
+		// time budget.
+		if abortedAt > 0 {
+			res.Warnings = append(res.Warnings, newMessage("image.earlyAbort", "percent", percentParam(abortedAt)))
+		}
+		if float64(bestSize) >= float64(len(inputBytes))*0.8 && !strings.Contains(mimeType, "png") && abortedAt == 0 {
+			if budget.fitsEncode(width, height, 3) {
 				pngBuf := new(bytes.Buffer)
-				err = png.Encode(pngBuf, img)
+				err = png.Encode(pngBuf, src.img)
+				if err == nil {
+					keep(imageCandidate{Label: "png", MimeType: "image/png", Data: pngBuf.Bytes()})
+				}
 				if err == nil && pngBuf.Len() < bestSize {
 					bestResult = pngBuf.Bytes()
 					bestSize = pngBuf.Len()
 					fmt.Printf("[WASM] PNG fallback: %d bytes (best so far)\n", pngBuf.Len())
 				}
-			}
-
-			// Only return original if compression is really ineffective
-			if float64(bestSize) >= float64(len(inputBytes))*0.95 {
-				fmt.Printf("[WASM] Compression not effective, returning original\n")
-				bestResult = inputBytes
-				bestSize = len(inputBytes)
 			} else {
-				fmt.Printf("[WASM] Best compression: %d -> %d bytes (%.1f%% reduction)\n", 
-					len(inputBytes), bestSize, (1.0-float64(bestSize)/float64(len(inputBytes)))*100)
+				res.TimedOut = true
+				res.Warnings = append(res.Warnings, newMessage("budget.pngFallbackSkipped"))
 			}
+		}
+	}
 
-			// Create result
-			jsOutput := js.Global().Get("Uint8Array").New(len(bestResult))
-			js.CopyBytesToJS(jsOutput, bestResult)
+	// Only return original if compression is really ineffective
+	trace(ctx, "image", "best", "size", bestSize, "original", len(inputBytes), "minSavings", opts.MinSavings)
+	reencoded := true
+	if float64(bestSize) >= float64(len(inputBytes))*(1-opts.MinSavings) {
+		fmt.Printf("[WASM] Compression not effective, returning original\n")
+		bestResult, _ = applyXMPMode(inputBytes, opts.XMP)
+		reencoded = false
+	} else {
+		fmt.Printf("[WASM] Best compression: %d -> %d bytes (%.1f%% reduction)\n", 
+			len(inputBytes), bestSize, (1.0-float64(bestSize)/float64(len(inputBytes)))*100)
+	}
 
-			result := js.Global().Get("Object").New()
-			result.Set("data", jsOutput)
-			result.Set("originalSize", len(inputBytes))
-			result.Set("compressedSize", len(bestResult))
-			result.Set("compressionRatio", float64(len(bestResult))/float64(len(inputBytes)))
+	res.Data = bestResult
+	res.Alternatives = runnerUps(tried, bestResult)
+	if reencoded {
+		res.Data = tagOutput(bestResult)
+	}
+	return res, nil
+}
 
-			reportProgress(100)
-			resolve.Invoke(result)
-		}()
+// Batch compression options passed as the optional third argument
+type batchOptions struct {
+	// Attach a summary document ("csv" or "json") to the result
+	Report string `json:"report"`
 
-		return nil
-	})
+	// Template for each result's outputName, e.g. "{name}-compressed.{ext}"
+	// (tokens are listed in naming.go). Empty leaves outputName unset.
+	NamePattern string `json:"namePattern"`
 
-	promiseConstructor := js.Global().Get("Promise")
-	return promiseConstructor.New(handler)
+	// "files", "zip" or "pdf"; see batchoutput.go
+	OutputMode string `json:"outputMode"`
 }
 
-// Batch compression for multiple files
+// Batch compression for multiple files. Resolves with an array of results,
+// or with {results, report, output} when a report format or a packaged
+// output mode is requested, each of report and output set when asked
+// for. PDFs go through the fallback chain of compressPDF and images
+// through the pipeline of compressImage, each with the saved settings,
+// and text goes through the text pipeline; other types come back as they
+// are, and an output that is not smaller is replaced by its input.
+// outputMode "pdf" takes image files only. Batches
+// run in the background lane unless options.priority is "interactive".
+// The returned promise carries jobId, the batch's job, and jobIds, one per
+// file, for cancelJob; each result repeats its file's jobId, and progress
+// is called as progress(percent, jobId) with the batch's. A file whose
+// processing panics comes back unchanged with strategy "failed" and
+// errorCode ERR_INTERNAL; the other files are unaffected.
 func compressBatch(this js.Value, args []js.Value) interface{} {
-	handler := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		resolve := args[0]
-		reject := args[1]
+	if len(args) < 1 {
+		return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+			promiseArgs[1].Invoke(js.ValueOf("compressBatch: Missing files argument"))
+			return nil
+		}))
+	}
+
+	// Capture the original arguments; the Promise handler gets its own args
+	filesArray := args[0]
+	var progressCallback js.Value
+	if len(args) > 1 {
+		progressCallback = args[1]
+	}
+	opts := currentSettings().Batch
+	var lane laneOptions
+	var optsErr error
+	if len(args) > 2 {
+		optsErr = decodeOptions(args[2], &opts)
+		if optsErr == nil {
+			optsErr = decodeOptions(args[2], &lane)
+		}
+		if optsErr == nil {
+			optsErr = lane.validate()
+		}
+	}
+
+	// Files go through the same pipelines as compressPDF and
+	// compressImage, with the saved settings and the policy applied
+	policy := currentPolicy()
+	pdfOpts := policy.applyPDF(currentSettings().PDF)
+	imageOpts := policy.applyImage(currentSettings().Image)
+
+	// The file list is read now, so a host editing its array or file
+	// objects after the call cannot swap files in or out. Each file's
+	// bytes are copied when the batch reaches it, which keeps only one
+	// file in WASM memory at a time; they must not change before then.
+	filesLength := filesArray.Length()
+	type batchInput struct {
+		data           js.Value
+		fileType, name string
+	}
+	inputs := make([]batchInput, filesLength)
+	for i := range inputs {
+		fileObj := filesArray.Index(i)
+		inputs[i] = batchInput{data: fileObj.Get("data"), fileType: fileObj.Get("type").String(), name: fmt.Sprintf("file-%d", i+1)}
+		if name := fileObj.Get("name"); isSet(name) {
+			inputs[i].name = name.String()
+		}
+	}
+
+	// Jobs are registered up front so their IDs can go out with the promise
+	j := startJobInLane("batch", lane.Priority)
+	fileJobs := make([]*job, filesLength)
+	jobIDs := make([]interface{}, filesLength)
+	for i := range fileJobs {
+		fileJobs[i] = j.startChild("batchFile")
+		jobIDs[i] = fileJobs[i].id
+	}
+
+	handler := js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+		resolve := promiseArgs[0]
+		reject := promiseArgs[1]
 
 		go func() {
+			defer j.finish()
+			defer func() {
+				for _, fj := range fileJobs {
+					fj.finish()
+				}
+			}()
 			defer func() {
 				if r := recover(); r != nil {
 					reject.Invoke(js.ValueOf(fmt.Sprintf("Panic in batch compression: %v", r)))
 				}
 			}()
 
-			if len(args) < 2 {
-				reject.Invoke(js.ValueOf("Missing arguments"))
+			if optsErr != nil {
+				reject.Invoke(js.ValueOf("compressBatch: " + optsErr.Error()))
 				return
 			}
+			if opts.Report != "" && opts.Report != reportCSV && opts.Report != reportJSON {
+				reject.Invoke(js.ValueOf(fmt.Sprintf("compressBatch: unknown report format %q", opts.Report)))
+				return
+			}
+			if err := checkBatchOutputMode(opts.OutputMode); err != nil {
+				reject.Invoke(js.ValueOf("compressBatch: " + err.Error()))
+				return
+			}
+			if opts.OutputMode == batchOutputPDF {
+				for _, in := range inputs {
+					if !strings.Contains(in.fileType, "image") {
+						reject.Invoke(js.ValueOf(fmt.Sprintf("compressBatch: outputMode pdf takes images only, %s is %q", in.name, in.fileType)))
+						return
+					}
+				}
+			}
 
-			filesArray := args[0]
-			progressCallback := args[1]
-
-			filesLength := filesArray.Length()
-			results := make([]js.Value, filesLength)
-
-			reportProgress := func(progress int) {
-				if !progressCallback.IsUndefined() && !progressCallback.IsNull() {
-					progressCallback.Invoke(js.ValueOf(progress))
+			// Heavy work runs in one tab at a time when tabs coordinate
+			releaseSlot, err := tabs.acquire(j)
+			if err != nil {
+				reject.Invoke(js.ValueOf(err.Error()))
+				return
+			}
+			defer releaseSlot()
+
+			batchStart := time.Now()
+			var namer *outputNamer
+			if opts.NamePattern != "" {
+				var err error
+				if namer, err = newOutputNamer(opts.NamePattern, batchStart); err != nil {
+					reject.Invoke(js.ValueOf("compressBatch: " + err.Error()))
+					return
 				}
 			}
+			results := make([]js.Value, filesLength)
+			report := &batchReport{}
+			pkg := newBatchPackage(opts.OutputMode, batchStart)
+
+			reportProgress := progressReporter(progressCallback, j)
+
+			// The current file's throughput reservation, also given back if
+			// the batch aborts or panics
+			release := func() {}
+			defer func() { release() }()
 
 			for i := 0; i < filesLength; i++ {
-				fileObj := filesArray.Index(i)
-				fileData := fileObj.Get("data")
-				fileType := fileObj.Get("type").String()
+				// Remaining files are dropped once the batch is cancelled
+				if err := checkCancelled(j.ctx); err != nil {
+					reject.Invoke(js.ValueOf(err.Error()))
+					return
+				}
+
+				fileData, fileType, fileName := inputs[i].data, inputs[i].fileType, inputs[i].name
 
-				inputBytes := make([]byte, fileData.Length())
-				js.CopyBytesToGo(inputBytes, fileData)
+				fileStart := time.Now()
+				// Files outside the input allowlist or over the throughput
+				// limits are never copied
+				var admitErr error
+				release, admitErr = admitInput(peekJS(fileData, sniffPeekBytes), fileType, fileData.Length())
+				var inputBytes []byte
+				if admitErr != nil {
+					release = func() {}
+				} else {
+					inputBytes = make([]byte, fileData.Length())
+					js.CopyBytesToGo(inputBytes, fileData)
+				}
 
 				var outputBytes []byte
+				var strategy string
+				var warnings []message
+				var contentEncoding string
+				var outputDoc *pdfDocument // parsed PDF output, for the policy check
+				keepLarger := false        // a policy strip is kept even when it grows the file
+				var fileErr error
 
 				// Progress for individual file
 				fileProgress := func(p int) {
@@ -807,41 +1389,151 @@ func compressBatch(this js.Value, args []js.Value) interface{} {
 					reportProgress(overallProgress)
 				}
 
-				if strings.Contains(fileType, "pdf") {
-					// For PDF, return original for now
-					outputBytes = inputBytes
-				} else if strings.Contains(fileType, "image") {
-					// Use image compression logic (simplified for batch)
-					reader := bytes.NewReader(inputBytes)
-					img, _, decodeErr := image.Decode(reader)
-					if decodeErr == nil {
-						jpegBuf := new(bytes.Buffer)
-						jpegErr := jpeg.Encode(jpegBuf, img, &jpeg.Options{Quality: 80})
-						if jpegErr == nil {
-							outputBytes = jpegBuf.Bytes()
+				fj := fileJobs[i]
+				inputType := policyInputType(inputBytes, fileType)
+				violations := policy.checkInput(inputType)
+				rejection := policy.enforce(violations)
+				// A panic fails this file only; finished files are kept and
+				// the rest of the batch still runs
+				func() {
+					defer recoverFile(fileName, &fileErr)
+					if err := checkCancelled(fj.ctx); err != nil {
+						// Cancelled while still queued
+						fileErr = err
+					} else if admitErr != nil {
+						fileErr = admitErr
+					} else if rejection != nil {
+						fileErr = rejection
+					} else if isTextMime(fileType) {
+						res, err := compressTextData(inputBytes, fileName, currentSettings().Text, fileProgress)
+						if err == nil {
+							outputBytes = res.Data
+							warnings = res.Warnings
+							contentEncoding = res.ContentEncoding
+							strategy = "text-" + res.ContentEncoding
+						} else {
+							fileErr = err
+						}
+					} else if strings.Contains(fileType, "pdf") {
+						res, err := compressPDFData(fj.ctx, inputBytes, pdfOpts, fileProgress)
+						if err == nil {
+							outputBytes = res.Data
+							outputDoc = res.Output
+							warnings = res.Warnings
+							keepLarger = pdfOpts.keepStripped && res.Level != pdfLevelPassthrough
+							strategy = "pdf-" + res.Level
 						} else {
-							outputBytes = inputBytes
+							fileErr = err
+						}
+					} else if strings.Contains(fileType, "image") {
+						res, err := compressImageData(fj.ctx, inputBytes, fileType, imageOpts, fileProgress)
+						if err == nil {
+							outputBytes = res.Data
+							warnings = res.Warnings
+							strategy = "image-" + strings.TrimPrefix(sniffMimeType(outputBytes), "image/")
+						} else {
+							fileErr = err
 						}
 					} else {
-						outputBytes = inputBytes
+						strategy = "passthrough"
 					}
-				} else {
+				}()
+
+				// Cancelling one file leaves it unchanged; cancelling the
+				// batch aborts it
+				if fileErr == errCancelled && j.ctx.Err() != nil {
+					reject.Invoke(js.ValueOf(fileErr.Error()))
+					return
+				}
+				fj.finish()
+
+				if fileErr != nil || len(outputBytes) == 0 || len(outputBytes) >= len(inputBytes) && !keepLarger {
 					outputBytes = inputBytes
+					contentEncoding = ""
+					outputDoc = nil
+					switch {
+					case fileErr == nil:
+						strategy = "passthrough"
+					case fileErr == errCancelled:
+						strategy = "cancelled"
+					default:
+						strategy = "failed"
+					}
+				}
+				if fileErr == nil {
+					outputBytes = policy.finishImage(outputBytes)
+					violations = append(violations, policy.checkOutput(inputType, outputBytes, outputDoc)...)
+					if rejection = policy.enforce(violations); rejection != nil {
+						fileErr, outputBytes, contentEncoding = rejection, inputBytes, ""
+					}
+				}
+				if rejection != nil || admitErr != nil {
+					strategy = "rejected"
 				}
 
 				fileProgress(100)
 
 				// Create result for this file
-				jsOutput := js.Global().Get("Uint8Array").New(len(outputBytes))
-				js.CopyBytesToJS(jsOutput, outputBytes)
-
-				result := js.Global().Get("Object").New()
-				result.Set("data", jsOutput)
-				result.Set("originalSize", len(inputBytes))
-				result.Set("compressedSize", len(outputBytes))
-				result.Set("compressionRatio", float64(len(outputBytes))/float64(len(inputBytes)))
-
+				result := newResultObject(inputBytes, outputBytes)
+				result.Set("name", fileName)
+				result.Set("jobId", fj.id)
+				outputName := ""
+				if namer != nil {
+					outputName = namer.next(fileName, outputBytes, contentEncoding)
+					result.Set("outputName", outputName)
+				}
+				result.Set("strategy", strategy)
+				if contentEncoding != "" {
+					result.Set("contentEncoding", contentEncoding)
+				}
+				setMessages(result, warnings)
+				setPolicyViolations(result, violations)
+				if fileErr != nil {
+					result.Set("error", fileErr.Error())
+					var coded *codedError
+					if errors.As(fileErr, &coded) {
+						result.Set("errorCode", coded.Code)
+					}
+				}
+				if pkg != nil {
+					// The data goes out in the package instead
+					result.Delete("data")
+					if err := pkg.add(fileName, outputName, outputBytes, contentEncoding); err != nil {
+						reject.Invoke(js.ValueOf(fmt.Sprintf("compressBatch: outputMode %s: %v", opts.OutputMode, err)))
+						return
+					}
+				}
 				results[i] = result
+				release()
+
+				m := newMetrics("batchFile", inputBytes)
+				m.started = fileStart
+				if fileErr == nil {
+					m.succeeded(outputBytes, strategy, warnings)
+				} else {
+					m.failed(fileErr)
+				}
+				m.send(fj.ctx)
+				trace(fj.ctx, "batch", "file", "name", fileName, "strategy", strategy,
+					"before", len(inputBytes), "after", len(outputBytes), "error", fileErr, "ms", msSince(fileStart))
+
+				entry := batchReportEntry{
+					Name:             fileName,
+					OutputName:       outputName,
+					Type:             fileType,
+					OriginalSize:     len(inputBytes),
+					CompressedSize:   len(outputBytes),
+					CompressionRatio: result.Get("compressionRatio").Float(),
+					Strategy:         strategy,
+					Warnings:         messageTexts(warnings),
+					Messages:         warnings,
+					PolicyViolations: violations,
+					DurationMs:       time.Since(fileStart).Milliseconds(),
+				}
+				if fileErr != nil {
+					entry.Error = fileErr.Error()
+				}
+				report.add(entry)
 			}
 
 			// Convert results to JS array
@@ -851,26 +1543,67 @@ func compressBatch(this js.Value, args []js.Value) interface{} {
 			}
 
 			reportProgress(100)
-			resolve.Invoke(jsResults)
+			if opts.Report == "" && pkg == nil {
+				resolve.Invoke(jsResults)
+				return
+			}
+
+			batchResult := js.Global().Get("Object").New()
+			batchResult.Set("results", jsResults)
+			if opts.Report != "" {
+				data, mimeType, err := report.encode(opts.Report, batchStart)
+				if err != nil {
+					reject.Invoke(js.ValueOf(fmt.Sprintf("compressBatch: report: %v", err)))
+					return
+				}
+				jsReport := js.Global().Get("Object").New()
+				jsReport.Set("format", opts.Report)
+				jsReport.Set("mimeType", mimeType)
+				jsReport.Set("filename", "compression-report."+opts.Report)
+				jsReport.Set("data", bytesToJS(data))
+				batchResult.Set("report", jsReport)
+			}
+			if pkg != nil {
+				data, mimeType, filename, err := pkg.encode()
+				if err != nil {
+					reject.Invoke(js.ValueOf(fmt.Sprintf("compressBatch: outputMode %s: %v", opts.OutputMode, err)))
+					return
+				}
+				fmt.Printf("[WASM] Batch packaged as %s: %d bytes\n", filename, len(data))
+				jsOutput := js.Global().Get("Object").New()
+				jsOutput.Set("format", opts.OutputMode)
+				jsOutput.Set("mimeType", mimeType)
+				jsOutput.Set("filename", filename)
+				jsOutput.Set("data", bytesToJS(data))
+				batchResult.Set("output", jsOutput)
+			}
+			resolve.Invoke(batchResult)
 		}()
 
 		return nil
 	})
 
 	promiseConstructor := js.Global().Get("Promise")
-	return promiseConstructor.New(handler)
+	promise := promiseConstructor.New(handler)
+	promise.Set("jobId", j.id)
+	promise.Set("jobIds", jobIDs)
+	return promise
 }
 
 func main() {
-	c := make(chan struct{}, 0)
+	// Register functions on the FileZap namespace and as flat globals,
+	// replacing an instance loaded earlier in the page
+	registerExports()
 
-	// Register global functions
-	js.Global().Set("compressPDF", js.FuncOf(compressPDF))
-	js.Global().Set("compressImage", js.FuncOf(compressImage))
-	js.Global().Set("compressBatch", js.FuncOf(compressBatch))
+	// Tell the host which affordances to hide before it builds its UI
+	publishDegradedFeatures()
 
-	// Signal that WASM is ready
+	// Signal that WASM is ready. isReady() supersedes the wasmReady flag,
+	// which stays for hosts that poll it.
+	setModuleReady()
 	js.Global().Set("wasmReady", js.ValueOf(true))
 
-	<-c // Keep the main goroutine alive
+	// Serve calls until shutdown() or a replacing instance ends this one
+	awaitShutdown()
+	fmt.Printf("[WASM] Instance %s exited\n", instanceID)
 } 
\ No newline at end of file
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// Strip a PNG's metadata the way embedded PDF images are and check the
+// result still decodes, which verifies every CRC
+func checkPNGStrip(t *testing.T, data []byte) {
+	t.Helper()
+	out := compressPngData(data)
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("stripped PNG does not decode: %v", err)
+	}
+}
+
+func TestPNGAlpha(t *testing.T) {
+	data := fixturePNG(fixtureCutout(256, 256))
+	res, err := compressImageData(context.Background(), data, "image/png", defaultImageOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(res.Data))
+	if err != nil {
+		t.Fatalf("output does not decode: %v", err)
+	}
+	if !hasTransparency(img) {
+		t.Fatal("transparency lost")
+	}
+}
+
+func TestPNGInterlaced(t *testing.T) {
+	data := fixtureRawPNG(64, 48, 16, 6, true, nil, fixtureSample)
+	if _, _, err := selfTestImage(data, "image/png", defaultImageOptions()); err != nil {
+		t.Fatal(err)
+	}
+	checkPNGStrip(t, data)
+}
+
+func TestPNGOddDepth(t *testing.T) {
+	screenshot := defaultImageOptions()
+	screenshot.Mode = modeScreenshot
+
+	palette := []byte{0, 0, 0, 255, 0, 0, 0, 255, 0, 0, 0, 255}
+	for _, data := range [][]byte{
+		fixtureRawPNG(61, 33, 1, 0, true, nil, fixtureSample),
+		fixtureRawPNG(61, 33, 2, 3, false, palette, func(x, y, c int) int { return (x + y) % 4 % 3 }),
+		fixtureRawPNG(61, 33, 16, 4, false, nil, fixtureSample),
+	} {
+		if _, _, err := selfTestImage(data, "image/png", screenshot); err != nil {
+			t.Fatal(err)
+		}
+		checkPNGStrip(t, data)
+	}
+}
+
+func TestJPEGStrip(t *testing.T) {
+	photo := fixtureGradient(256, 256)
+
+	data := fixtureJPEGWithEXIF(photo, 12000)
+	segments, n, err := parseJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) || !bytes.Equal(writeJPEGSegments(segments), data) {
+		t.Fatal("segments do not reassemble into the file")
+	}
+	out := compressJpegData(data)
+	if len(out) >= len(data) {
+		t.Fatal("large EXIF segment not removed")
+	}
+	if !jpegDecodes(out) {
+		t.Fatal("stripped JPEG does not decode")
+	}
+}
+
+func TestPNGCRC(t *testing.T) {
+	// Damaged or misordered chunks are left alone, not rewritten
+	// with CRCs that would hide the damage
+	data := fixtureRawPNG(32, 32, 8, 2, false, nil, fixtureSample)
+	damaged := append([]byte(nil), data...)
+	damaged[len(damaged)-20] ^= 0xff
+	if out := compressPngData(damaged); !bytes.Equal(out, damaged) {
+		t.Fatal("PNG with a bad CRC was rewritten")
+	}
+	chunks, err := readValidPNGChunks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	misordered := []pngChunk{chunks[0], chunks[1], {Type: "gAMA", Data: []byte{0, 1, 0x86, 0xa0}}, chunks[2]}
+	if _, err := writePNGChunks(misordered); err == nil {
+		t.Fatal("gAMA after IDAT was accepted")
+	}
+	checkPNGStrip(t, data)
+}
+
+func TestImagesInPDF(t *testing.T) {
+	photo := fixtureGradient(256, 256)
+
+	// A JPEG whose EXIF thumbnail has its own EOI, a PNG with
+	// "IEND" in a text chunk, and a Flate stream that merely
+	// contains JPEG bytes, which must come out untouched
+	jpegData := fixtureJPEGWithEXIF(photo, 12000)
+	pngData := insertPNGText(fixtureRawPNG(64, 48, 8, 2, true, nil, fixtureSample), "Comment", strings.Repeat("IEND ", 400))
+	data := fixtureStreamPDF(
+		[]string{"/Type /XObject /Subtype /Image /Filter /DCTDecode", "/Type /EmbeddedFile", "/Filter /FlateDecode"},
+		[][]byte{jpegData, pngData, jpegData})
+	out := applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, defaultPDFOptions())
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := []*pdfObject{doc.Objects[2], doc.Objects[3], doc.Objects[4]}
+	if len(streams[0].Stream) >= len(jpegData) || !jpegDecodes(streams[0].Stream) {
+		t.Fatal("embedded JPEG not stripped or damaged")
+	}
+	if _, err := png.Decode(bytes.NewReader(streams[1].Stream)); err != nil {
+		t.Fatalf("embedded PNG does not decode: %v", err)
+	}
+	if !bytes.Equal(streams[2].Stream, jpegData) {
+		t.Fatal("Flate stream was modified")
+	}
+	// Raising the threshold above every stream leaves the file alone
+	opts := defaultPDFOptions()
+	opts.MinEmbeddedImageBytes = len(jpegData) + len(pngData)
+	if !bytes.Equal(applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, opts), data) {
+		t.Fatal("images below minEmbeddedImageBytes were modified")
+	}
+}
+
+func TestPDFMetadata(t *testing.T) {
+	// /Title also appears in an outline item, which must survive
+	data := []byte("%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog /Outlines 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Title (Chapter 1) /Count 0 >>\nendobj\n" +
+		"3 0 obj\n<< /Title (Invoice 42) /Author (A. Person) /Producer (Scanner) /Custom (x) >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R /Info 3 0 R >>\n%%EOF\n")
+	opts := defaultPDFOptions()
+	opts.KeepMetadata = []string{"/Title"}
+	out := applyPDFPass(t, (*pdfDocument).removeMetadata, data, opts)
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := doc.Objects[3].Dict()
+	if _, ok := info.Get("Title"); !ok {
+		t.Fatal("kept /Title was removed")
+	}
+	if _, ok := info.Get("Custom"); !ok {
+		t.Fatal("unlisted key was removed")
+	}
+	for _, key := range []string{"Author", "Producer"} {
+		if _, ok := info.Get(key); ok {
+			t.Fatalf("/%s was not removed", key)
+		}
+	}
+	if _, ok := doc.Objects[2].Dict().Get("Title"); !ok {
+		t.Fatal("outline /Title was removed")
+	}
+}
+
+func TestImageAlternatives(t *testing.T) {
+	photo := fixturePNG(fixtureGradient(200, 150))
+	screenshot := defaultImageOptions()
+	screenshot.Mode = modeScreenshot
+	for name, c := range map[string]struct {
+		data []byte
+		opts imageOptions
+	}{
+		"photo":      {photo, defaultImageOptions()},
+		"screenshot": {fixturePNG(fixtureScreenshot(200, 120)), screenshot},
+	} {
+		res, err := compressImageData(context.Background(), c.data, "image/png", c.opts, func(int) {})
+		if err != nil || len(res.Alternatives) != 0 {
+			t.Fatalf("%s without alternatives: %d returned, %v", name, len(res.Alternatives), err)
+		}
+
+		c.opts.Alternatives = true
+		res, err = compressImageData(context.Background(), c.data, "image/png", c.opts, func(int) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Alternatives) == 0 {
+			t.Fatalf("%s: no alternatives", name)
+		}
+		for i, a := range res.Alternatives {
+			if bytes.Equal(a.Data, res.Data) || i > 0 && len(a.Data) < len(res.Alternatives[i-1].Data) {
+				t.Errorf("%s alternative %d (%s): chosen output or out of order", name, i, a.Label)
+			}
+			if sniffMimeType(a.Data) != a.MimeType || (a.MimeType == "image/jpeg") != (a.Quality > 0) {
+				t.Errorf("%s alternative %s: %s with quality %d", name, a.Label, sniffMimeType(a.Data), a.Quality)
+			}
+			if _, _, err := image.Decode(bytes.NewReader(a.Data)); err != nil {
+				t.Errorf("%s alternative %s does not decode: %v", name, a.Label, err)
+			}
+		}
+	}
+}
+
+func TestRunnerUps(t *testing.T) {
+	tried := []imageCandidate{
+		{Label: "big", Data: []byte("xxxxx")},
+		{Label: "chosen", Data: []byte("xx")},
+		{Label: "mid", Data: []byte("xxx")},
+		{Label: "tie", Data: []byte("yyy")},
+	}
+	var labels []string
+	for _, c := range runnerUps(tried, []byte("xx")) {
+		labels = append(labels, c.Label)
+	}
+	if got := strings.Join(labels, ","); got != "mid,tie,big" {
+		t.Errorf("runner-ups %s", got)
+	}
+	if runnerUps(nil, []byte("xx")) != nil {
+		t.Error("runner-ups from nothing")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import "bytes"
+
+// Written into every re-encoded JPEG (COM segment) and PNG (tEXt
+// Software) so a later pass can tell it is looking at its own output
+const outputMarker = "FileZap"
+
+// Qualities the photo ladder encodes at; an unmarked JPEG with exact IJG
+// tables at one of these and no APPn segments is likely an older output
+var ladderQualities = []int{85, 75, 60, 40}
+
+// Visit the segments before the first scan: marker byte and payload
+func jpegSegments(data []byte, visit func(marker byte, payload []byte)) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+	for at := 2; at+4 <= len(data); {
+		if data[at] != 0xFF {
+			return
+		}
+		marker := data[at+1]
+		switch {
+		case marker == 0xFF:
+			at++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			at += 2
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			return
+		}
+		length := int(data[at+2])<<8 | int(data[at+3])
+		if length < 2 || at+2+length > len(data) {
+			return
+		}
+		visit(marker, data[at+4:at+2+length])
+		at += 2 + length
+	}
+}
+
+// Whether data carries the output marker
+func hasOutputMarker(data []byte) bool {
+	found := false
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		jpegSegments(data, func(marker byte, payload []byte) {
+			if marker == 0xFE && bytes.HasPrefix(payload, []byte(outputMarker)) {
+				found = true
+			}
+		})
+	case bytes.HasPrefix(data, pngSignature):
+		chunks, _ := readPNGChunks(data)
+		for _, c := range chunks {
+			if c.Type == "tEXt" && bytes.HasPrefix(c.Data, []byte("Software\x00"+outputMarker)) {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// Why data looks like an earlier output: "marker" when it is tagged,
+// "heuristic" for an untagged JPEG that matches what the ladder writes,
+// "" otherwise
+func previousOutput(data []byte) string {
+	if hasOutputMarker(data) {
+		return "marker"
+	}
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return ""
+	}
+	hasApp := false
+	jpegSegments(data, func(marker byte, payload []byte) {
+		if marker >= 0xE0 && marker <= 0xEF {
+			hasApp = true
+		}
+	})
+	est, err := estimateJPEGQuality(data)
+	if hasApp || err != nil || !est.Exact {
+		return ""
+	}
+	for _, q := range ladderQualities {
+		if est.Quality == q {
+			return "heuristic"
+		}
+	}
+	return ""
+}
+
+// Insert a COM segment right after SOI; text is cut to the segment limit
+func insertJPEGComment(data []byte, text string) []byte {
+	if len(text) > 0xFFFF-2 {
+		text = text[:0xFFFF-2]
+	}
+	out := make([]byte, 0, len(data)+4+len(text))
+	out = append(out, 0xFF, 0xD8, 0xFF, 0xFE, byte((2+len(text))>>8), byte(2+len(text)))
+	out = append(out, text...)
+	return append(out, data[2:]...)
+}
+
+// Insert a tEXt chunk right after IHDR
+func insertPNGText(data []byte, keyword, text string) []byte {
+	chunks, err := readPNGChunks(data)
+	if err != nil || len(chunks) == 0 || chunks[0].Type != "IHDR" {
+		return data
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)+len(keyword)+len(text)+13))
+	buf.Write(pngSignature)
+	for i, c := range chunks {
+		writePNGChunk(buf, c.Type, c.Data)
+		if i == 0 {
+			writePNGChunk(buf, "tEXt", []byte(keyword+"\x00"+text))
+		}
+	}
+	return buf.Bytes()
+}
+
+// Add the output marker to a JPEG or PNG; other formats are returned as is
+func tagOutput(data []byte) []byte {
+	if hasOutputMarker(data) {
+		return data
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return insertJPEGComment(data, outputMarker)
+	case bytes.HasPrefix(data, pngSignature):
+		return insertPNGText(data, "Software", outputMarker)
+	}
+	return data
+}
+
+// Warning for an input that looks like an earlier output
+func previousOutputWarning(kind string) message {
+	if kind == "marker" {
+		return newMessage("image.taggedOutput")
+	}
+	return newMessage("image.likelyOutput")
+}
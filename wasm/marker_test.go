@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func fixtureJPEGAt(quality int) []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, fixtureGradient(400, 300), &jpeg.Options{Quality: quality})
+	return buf.Bytes()
+}
+
+func hasMessage(messages []message, code string) bool {
+	for _, m := range messages {
+		if m.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDoubleCompressionGuard(t *testing.T) {
+	ctx := context.Background()
+	in := fixtureJPEGAt(95)
+	if kind := previousOutput(in); kind != "" {
+		t.Fatalf("fresh q95 JPEG looks like an output (%s)", kind)
+	}
+	first, err := compressImageData(ctx, in, "image/jpeg", defaultImageOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Data) >= len(in) || previousOutput(first.Data) != "marker" {
+		t.Fatalf("first pass: %d -> %d bytes, marker %q", len(in), len(first.Data), previousOutput(first.Data))
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(first.Data)); err != nil {
+		t.Fatalf("tagged output does not decode: %v", err)
+	}
+
+	// A tagged output comes back unchanged
+	second, err := compressImageData(ctx, first.Data, "image/jpeg", defaultImageOptions(), func(int) {})
+	if err != nil || !bytes.Equal(second.Data, first.Data) || !hasMessage(second.Warnings, "image.taggedOutput") {
+		t.Errorf("second pass: %d bytes, warnings %+v, %v", len(second.Data), second.Warnings, err)
+	}
+
+	// unless the caller insists
+	opts := defaultImageOptions()
+	opts.AllowRecompress = true
+	forced, err := compressImageData(ctx, first.Data, "image/jpeg", opts, func(int) {})
+	if err != nil || hasMessage(forced.Warnings, "image.taggedOutput") || hasMessage(forced.Warnings, "image.likelyOutput") {
+		t.Errorf("allowRecompress: warnings %+v, %v", forced.Warnings, err)
+	}
+}
+
+func TestPreviousOutputHeuristic(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"ladder quality", fixtureJPEGAt(75), "heuristic"},
+		{"other quality", fixtureJPEGAt(95), ""},
+		{"camera JPEG", fixtureJPEGWithEXIF(fixtureGradient(400, 300), 0), ""}, // has an APP1
+		{"tagged", tagOutput(fixtureJPEGAt(95)), "marker"},
+		{"PNG", fixturePNG(fixtureGradient(40, 40)), ""},
+		{"not an image", []byte("hello"), ""},
+	} {
+		if got := previousOutput(c.data); got != c.want {
+			t.Errorf("%s: %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	// A likely output is still compressed, with a warning
+	res, err := compressImageData(context.Background(), fixtureJPEGAt(75), "image/jpeg", defaultImageOptions(), func(int) {})
+	if err != nil || !hasMessage(res.Warnings, "image.likelyOutput") {
+		t.Errorf("warnings %+v, %v", res.Warnings, err)
+	}
+}
+
+func TestPassthroughNotTagged(t *testing.T) {
+	ctx := context.Background()
+	in := fixtureJPEGAt(90)
+
+	// Nothing saves enough, so the original comes back untagged and a
+	// later run with other settings still compresses it
+	opts := defaultImageOptions()
+	opts.MinSavings = 0.95
+	first, err := compressImageData(ctx, in, "image/jpeg", opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Data, in) || previousOutput(first.Data) != "" {
+		t.Fatalf("passthrough: %d -> %d bytes, marker %q", len(in), len(first.Data), previousOutput(first.Data))
+	}
+	opts = defaultImageOptions()
+	opts.Qualities = []int{60}
+	second, err := compressImageData(ctx, first.Data, "image/jpeg", opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasMessage(second.Warnings, "image.taggedOutput") || len(second.Data) >= len(in) || previousOutput(second.Data) != "marker" {
+		t.Errorf("second run: %d -> %d bytes, warnings %+v", len(in), len(second.Data), second.Warnings)
+	}
+
+	// An original whose XMP was only minimized is not tagged either
+	payload := append(append([]byte(nil), xmpJPEGNamespace...), fixtureXMPPacket()...)
+	withXMP := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	withXMP = append(withXMP, in[2:]...)
+	opts = defaultImageOptions()
+	opts.MinSavings = 0.95
+	opts.XMP = xmpMinimize
+	res, err := compressImageData(ctx, withXMP, "image/jpeg", opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) >= len(withXMP) || hasOutputMarker(res.Data) {
+		t.Errorf("XMP-only edit: %d -> %d bytes, marker %v", len(withXMP), len(res.Data), hasOutputMarker(res.Data))
+	}
+}
+
+func TestTagOutput(t *testing.T) {
+	p := fixturePNG(fixtureGradient(40, 40))
+	tagged := tagOutput(p)
+	if !hasOutputMarker(tagged) || hasOutputMarker(p) {
+		t.Fatal("PNG marker not added")
+	}
+	if _, err := png.Decode(bytes.NewReader(tagged)); err != nil {
+		t.Fatalf("tagged PNG does not decode: %v", err)
+	}
+	if !bytes.Equal(tagOutput(tagged), tagged) {
+		t.Error("tagging twice changed the PNG")
+	}
+	if !bytes.Equal(tagOutput(fixtureWebP), fixtureWebP) {
+		t.Error("WebP changed by tagging")
+	}
+
+	// Comments are cut to fit one segment
+	long := insertJPEGComment(fixtureJPEGAt(50), strings.Repeat("x", 70000))
+	if _, err := jpeg.Decode(bytes.NewReader(long)); err != nil {
+		t.Errorf("JPEG with a long comment does not decode: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// A user-facing message: a stable code hosts can translate and the
+// parameters its template refers to. results carry these as messages next
+// to the English warnings.
+type message struct {
+	Code   string                 `json:"code"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	Text   string                 `json:"text"` // English rendering
+}
+
+// English templates by code. {name} is replaced by the parameter name;
+// hosts translating a code receive the same parameters.
+var messageCatalog = map[string]string{
+	"pdf.lowSavings":      "{level} level saved only {percent}%, original kept",
+	"pdf.unparsable":      "PDF could not be parsed ({error}), left unchanged",
+	"pdf.encrypted":       "PDF is encrypted, left unchanged",
+	"pdf.allLevelsFailed": "every PDF strategy failed, left unchanged",
+	"pdf.pageWarning":     "page {page}: {warning}",
+	"pdf.tagsKept":        "{option} limited to keep the PDF's tagging intact",
+	"pdf.tagsDegraded":    "{option} degrades this tagged PDF; set preserveTags to keep its tagging",
+	"pdf.textChanged":     "{level} level changed the text on page {page}; its output was discarded",
+	"pdf.compatibility":   "{issue} kept from the original ({count}); older viewers may not open it",
+	"pdf.earlyAbort":      "streams saved under 1% after {percent}% of them; the rest were kept as they are",
+
+	"image.firstFrameOnly":      "animation discarded: kept first of {frames} frames",
+	"image.taggedOutput":        "input is tagged as an earlier FileZap output; returned unchanged, set allowRecompress to process it again",
+	"image.likelyOutput":        "input looks like an earlier FileZap output; compressing it again loses more quality",
+	"image.profileNotConverted": "color profile not converted: {error}",
+	"image.formatChanged":       "re-encoding changed the format; original kept",
+	"image.webpLosslessFailed":  "lossless WebP skipped: {error}",
+	"image.paletteRejected":     "palette quantization rejected: {percent}% of text edges degraded",
+	"image.earlyAbort":          "JPEG ladder saved under 1% after {percent}% of its rungs; the rest were skipped",
+	"image.heifMoreImages":      "{count} more images in this HEIF file were not processed; see extractHeifImages",
+	"image.dataURLTooLarge":     "output not returned as a data URL: {size} characters exceeds the {limit} limit",
+
+	"budget.beforeEncoding":      "time budget reached before encoding, original kept",
+	"budget.pngFallbackSkipped":  "time budget reached, PNG fallback skipped",
+	"budget.palettePNGSkipped":   "time budget reached, palette PNG skipped",
+	"budget.losslessWebPSkipped": "time budget reached, lossless WebP skipped",
+	"budget.paletteSkipped":      "time budget reached, palette quantization skipped",
+	"budget.losslessSkipped":     "time budget reached, lossless re-encode skipped",
+
+	"font.missingChars": "{count} requested characters are not in the font: {chars}",
+	"font.gsubDropped":  "GSUB dropped: ligatures and alternate forms fall back to single glyphs",
+
+	"policy.formatNotAllowed": "{type} files are not allowed by policy",
+	"policy.outputTooLarge":   "output of {size} bytes exceeds the {limit} byte policy limit for {type}",
+	"policy.forbiddenContent": "output contains {content}, which policy forbids",
+	"policy.metadataPresent":  "output still carries metadata policy requires removed: {metadata}",
+
+	"provenance.notEmbedded": "provenance not embedded: {error}",
+
+	"text.oddTrailingByte": "odd trailing byte dropped from UTF-16 text",
+	"text.invalidUTF8":     "invalid UTF-8 sequences replaced",
+	"text.lineEndingsKept": "line endings kept: UTF-16 text was not converted",
+	"asset.sourceMap":      "not minified: file references a source map",
+	"asset.bundled":        "not minified: file is already bundler output",
+	"asset.minifyFailed":   "not minified: {error}",
+	"gzip.trailingBytes":   "{bytes} trailing bytes after gzip member {member} ignored",
+
+	"archive.listingStopped":    "listing stopped early: {error}",
+	"archive.extractionStopped": "extraction stopped early: {error}",
+	"archive.encrypted":         "{name} skipped: encrypted",
+	"archive.tooLarge":          "{name} skipped: too large to extract in the browser",
+	"archive.entryFailed":       "{name} skipped: {error}",
+	"archive.outsideFolder":     "{name} skipped: lies outside its folder",
+	"archive.checksumMismatch":  "{name} skipped: checksum mismatch",
+
+	"plan.memoryTight":     "{name} may not fit in memory on this device",
+	"plan.concurrencyHigh": "concurrency {concurrency} may exceed the memory budget; {suggested} is suggested",
+}
+
+var messageParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// Build a message from a catalog code and alternating parameter names and
+// values. Errors are passed as their text.
+func newMessage(code string, params ...interface{}) message {
+	m := message{Code: code}
+	if len(params) > 0 {
+		m.Params = make(map[string]interface{}, len(params)/2)
+	}
+	for i := 0; i+1 < len(params); i += 2 {
+		value := params[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		m.Params[fmt.Sprint(params[i])] = value
+	}
+
+	text, ok := messageCatalog[code]
+	if !ok {
+		text = code
+	}
+	// One pass, so a value containing "{...}" is never expanded itself
+	m.Text = messageParam.ReplaceAllStringFunc(text, func(token string) string {
+		if value, ok := m.Params[token[1:len(token)-1]]; ok {
+			return fmt.Sprint(value)
+		}
+		return token
+	})
+	return m
+}
+
+// A fraction as a percentage rounded to one decimal, for message params
+func percentParam(fraction float64) float64 {
+	return float64(int64(fraction*1000+0.5)) / 10
+}
+
+// English text of each message, as the warnings arrays carry it
+func messageTexts(messages []message) []string {
+	if len(messages) == 0 {
+		return nil
+	}
+	texts := make([]string, len(messages))
+	for i, m := range messages {
+		texts[i] = m.Text
+	}
+	return texts
+}
+
+// Add one message to a result that may already carry some
+func appendMessage(result js.Value, m message) {
+	warnings, messages := result.Get("warnings"), result.Get("messages")
+	if !isSet(warnings) || !isSet(messages) {
+		setMessages(result, []message{m})
+		return
+	}
+	warnings.Call("push", m.Text)
+	if v, err := jsonToJS(m); err == nil {
+		messages.Call("push", v)
+	}
+}
+
+// Set result.warnings (English text) and result.messages ({code, params,
+// text}); nothing is set when there are no messages
+func setMessages(result js.Value, messages []message) {
+	if len(messages) == 0 {
+		return
+	}
+	result.Set("warnings", stringsToJS(messageTexts(messages)))
+	if v, err := jsonToJS(messages); err == nil {
+		result.Set("messages", v)
+	}
+}
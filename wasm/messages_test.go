@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMessages(t *testing.T) {
+	m := newMessage("pdf.lowSavings", "level", "full", "percent", percentParam(0.025))
+	if want := "full level saved only 2.5%, original kept"; m.Text != want {
+		t.Fatalf("rendered %q, want %q", m.Text, want)
+	}
+	if m.Params["level"] != "full" {
+		t.Fatalf("params %v", m.Params)
+	}
+	// A parameter value is never expanded as a template itself
+	m = newMessage("archive.entryFailed", "name", "{error}", "error", errors.New("bad"))
+	if want := "{error} skipped: bad"; m.Text != want {
+		t.Fatalf("rendered %q, want %q", m.Text, want)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Opt-in usage metrics for hosts measuring real-world savings. Once a host
+// calls setMetricsCallback(fn), every finished compression is reported to
+// fn as one plain object:
+//
+//	{operation, inputType, outputType, originalSize, compressedSize,
+//	 compressionRatio, durationMs, strategy, outcome, errorCode?, warnings}
+//
+// operation is the API call ("pdf", "image", "batchFile", "text",
+// "data"); inputType and outputType are MIME types sniffed from the bytes;
+// outcome is "ok", "failed" or "cancelled"; warnings lists message codes
+// without their parameters. File names, content and anything taken from
+// content beyond sizes and formats are never included, and the module
+// sends nothing anywhere itself: where the numbers go is up to the host.
+// setMetricsCallback(null) turns reporting off. A callback that throws is
+// logged and otherwise ignored, so it cannot fail a compression.
+
+// Outcomes of a reported operation
+const (
+	metricsOK        = "ok"
+	metricsFailed    = "failed"
+	metricsCancelled = "cancelled"
+)
+
+// One finished operation, as handed to the metrics callback
+type metricsEvent struct {
+	Operation        string   `json:"operation"`
+	InputType        string   `json:"inputType"`
+	OutputType       string   `json:"outputType,omitempty"`
+	OriginalSize     int      `json:"originalSize"`
+	CompressedSize   int      `json:"compressedSize"`
+	CompressionRatio float64  `json:"compressionRatio"`
+	DurationMs       float64  `json:"durationMs"`
+	Strategy         string   `json:"strategy,omitempty"`
+	Outcome          string   `json:"outcome"`
+	ErrorCode        string   `json:"errorCode,omitempty"`
+	Warnings         []string `json:"warnings"`
+
+	started time.Time
+}
+
+var metricsHook struct {
+	mu sync.Mutex
+	fn js.Value // undefined while reporting is off
+}
+
+// Start measuring an operation on input; it counts as failed until
+// succeeded is called
+func newMetrics(operation string, input []byte) *metricsEvent {
+	return &metricsEvent{
+		Operation:    operation,
+		InputType:    sniffMimeType(input),
+		OriginalSize: len(input),
+		Outcome:      metricsFailed,
+		Warnings:     []string{},
+		started:      time.Now(),
+	}
+}
+
+// Record a successful output
+func (m *metricsEvent) succeeded(output []byte, strategy string, warnings []message) {
+	m.Outcome = metricsOK
+	m.OutputType = sniffMimeType(output)
+	m.CompressedSize = len(output)
+	m.Strategy = strategy
+	for _, w := range warnings {
+		m.Warnings = append(m.Warnings, w.Code)
+	}
+}
+
+// Record why the operation failed; only the code of a coded error is kept,
+// since messages can quote the input
+func (m *metricsEvent) failed(err error) {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		m.ErrorCode = coded.Code
+	}
+}
+
+// Hand the event to the callback, if one is set. Operations defer it, so
+// failures and panics are reported too; a cancelled ctx makes a failure a
+// cancellation.
+func (m *metricsEvent) send(ctx context.Context) {
+	metricsHook.mu.Lock()
+	fn := metricsHook.fn
+	metricsHook.mu.Unlock()
+	if fn.Type() != js.TypeFunction {
+		return
+	}
+	if m.Outcome == metricsFailed && ctx != nil && ctx.Err() != nil {
+		m.Outcome = metricsCancelled
+	}
+	if m.Outcome != metricsOK {
+		m.CompressedSize = m.OriginalSize
+	}
+	m.CompressionRatio = 1
+	if m.OriginalSize > 0 {
+		m.CompressionRatio = float64(m.CompressedSize) / float64(m.OriginalSize)
+	}
+	m.DurationMs = msSince(m.started)
+
+	v, err := jsonToJS(m)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("[WASM] Metrics callback failed: %v\n", r)
+		}
+	}()
+	fn.Invoke(v)
+}
+
+// setMetricsCallback(fn) reports every finished compression to fn, as
+// described above; null or no argument turns reporting off
+func setMetricsCallback(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] setMetricsCallback called with %d arguments\n", len(args))
+
+	fn := js.Undefined()
+	if len(args) > 0 {
+		fn = args[0]
+	}
+	return runAsync("setMetricsCallback", func() (interface{}, error) {
+		if isSet(fn) && fn.Type() != js.TypeFunction {
+			return nil, errors.New("expected a function, or null to turn metrics off")
+		}
+		metricsHook.mu.Lock()
+		defer metricsHook.mu.Unlock()
+		metricsHook.fn = js.Undefined()
+		if isSet(fn) {
+			metricsHook.fn = fn
+		}
+		return isSet(fn), nil
+	})
+}
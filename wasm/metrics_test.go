@@ -0,0 +1,59 @@
+//go:build js
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestMetrics(t *testing.T) {
+	photo := fixtureGradient(256, 256)
+
+	var events []js.Value
+	hook := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		events = append(events, args[0])
+		return nil
+	})
+	defer hook.Release()
+	metricsHook.mu.Lock()
+	previous := metricsHook.fn
+	metricsHook.fn = hook.Value
+	metricsHook.mu.Unlock()
+	defer func() {
+		metricsHook.mu.Lock()
+		metricsHook.fn = previous
+		metricsHook.mu.Unlock()
+	}()
+
+	input := fixturePNG(photo)
+	output := fixtureJPEG(photo)
+	m := newMetrics("image", input)
+	m.succeeded(output, "image-jpeg", []message{newMessage("budget.pngFallbackSkipped")})
+	m.send(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m = newMetrics("pdf", input)
+	m.failed(&codedError{Code: "ERR_INTERNAL", Message: "secret.pdf: broken"})
+	m.send(ctx)
+	if len(events) != 2 {
+		t.Fatalf("%d events", len(events))
+	}
+	ok, cancelled := events[0], events[1]
+	if ok.Get("outcome").String() != metricsOK || ok.Get("inputType").String() != "image/png" || ok.Get("outputType").String() != "image/jpeg" ||
+		ok.Get("compressedSize").Int() != len(output) || ok.Get("warnings").Index(0).String() != "budget.pngFallbackSkipped" {
+		t.Fatal("successful run reported wrong")
+	}
+	if cancelled.Get("outcome").String() != metricsCancelled || cancelled.Get("errorCode").String() != "ERR_INTERNAL" || cancelled.Get("compressionRatio").Float() != 1 {
+		t.Fatal("cancelled run reported wrong")
+	}
+	keys := js.Global().Get("Object").Call("keys", cancelled)
+	for i := 0; i < keys.Length(); i++ {
+		if v := cancelled.Get(keys.Index(i).String()); v.Type() == js.TypeString && strings.Contains(v.String(), "secret") {
+			t.Fatalf("%s carries the error message", keys.Index(i).String())
+		}
+	}
+}
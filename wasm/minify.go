@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Markup and data formats the minifier understands
+const (
+	minifyJSON = "json"
+	minifyXML  = "xml"
+	minifyHTML = "html"
+)
+
+// Map a short type name or MIME type onto a minifier
+func minifyKind(t string) (string, error) {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if i := strings.IndexByte(t, ';'); i >= 0 {
+		t = strings.TrimSpace(t[:i])
+	}
+	switch {
+	case t == minifyJSON || strings.HasSuffix(t, "/json") || strings.HasSuffix(t, "+json"):
+		return minifyJSON, nil
+	case t == minifyHTML || t == "text/html" || t == "application/xhtml+xml":
+		// XHTML renders as HTML does, so it takes the HTML whitespace rules
+		return minifyHTML, nil
+	case t == minifyXML || strings.HasSuffix(t, "/xml") || strings.HasSuffix(t, "+xml"):
+		return minifyXML, nil
+	}
+	return "", fmt.Errorf("cannot minify type %q", t)
+}
+
+// Strip insignificant whitespace from UTF-8 text of the given kind
+func minify(data []byte, kind string) ([]byte, error) {
+	switch kind {
+	case minifyJSON:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, data); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		return buf.Bytes(), nil
+	case minifyXML:
+		return minifyMarkup(data, false), nil
+	case minifyHTML:
+		return minifyMarkup(data, true), nil
+	}
+	return nil, fmt.Errorf("unknown minifier %q", kind)
+}
+
+// HTML elements whose content is copied verbatim
+var htmlRawElements = map[string]bool{"pre": true, "textarea": true, "script": true, "style": true}
+
+// HTML elements around which whitespace never renders
+var htmlBlockElements = map[string]bool{
+	"html": true, "head": true, "body": true, "title": true, "meta": true, "link": true, "base": true,
+	"script": true, "style": true, "div": true, "p": true, "ul": true, "ol": true, "li": true, "dl": true,
+	"dt": true, "dd": true, "table": true, "thead": true, "tbody": true, "tfoot": true, "tr": true,
+	"td": true, "th": true, "caption": true, "section": true, "article": true, "header": true,
+	"footer": true, "nav": true, "main": true, "aside": true, "form": true, "fieldset": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true, "br": true,
+	"blockquote": true, "figure": true, "figcaption": true, "noscript": true, "option": true,
+	"!doctype": true,
+}
+
+// Lower-cased element name of a tag ("/div" for closing tags)
+func markupTagName(tag []byte) string {
+	end := 1
+	for end < len(tag) && !isPDFWhitespace(tag[end]) && tag[end] != '>' && !(tag[end] == '/' && end > 1) {
+		end++
+	}
+	return strings.ToLower(string(tag[1:end]))
+}
+
+// Length of the tag starting at data[0] == '<', honouring quoted
+// attribute values; -1 if unterminated
+func markupTagLen(data []byte) int {
+	var quote byte
+	for i := 1; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Collapse whitespace between attributes and before the closing bracket,
+// leaving quoted values untouched
+func compactTag(tag []byte) []byte {
+	out := make([]byte, 0, len(tag))
+	var quote byte
+	pendingSpace := false
+	for _, c := range tag {
+		if quote != 0 {
+			out = append(out, c)
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if isPDFWhitespace(c) {
+			pendingSpace = true
+			continue
+		}
+		if pendingSpace && c != '>' && c != '/' && c != '=' && out[len(out)-1] != '=' {
+			out = append(out, ' ')
+		}
+		pendingSpace = false
+		if c == '"' || c == '\'' {
+			quote = c
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// Collapse runs of whitespace in text to a single character, keeping a
+// newline when the run contained one
+func collapseWhitespace(text []byte) []byte {
+	out := make([]byte, 0, len(text))
+	for i := 0; i < len(text); {
+		if !isPDFWhitespace(text[i]) {
+			out = append(out, text[i])
+			i++
+			continue
+		}
+		sep := byte(' ')
+		for i < len(text) && isPDFWhitespace(text[i]) {
+			if text[i] == '\n' {
+				sep = '\n'
+			}
+			i++
+		}
+		out = append(out, sep)
+	}
+	return out
+}
+
+// Whether data starts with an opening tag with content, and whether that
+// content starts with text, directly or inside nested elements, as inline
+// markup does: <b>bold</b>, <i><b>both</b></i>
+func opensElement(data []byte) (opens, beforeText bool) {
+	for pos := 0; ; {
+		n := markupTagLen(data[pos:])
+		if n < 0 || bytes.HasSuffix(data[pos:pos+n], []byte("/>")) {
+			return pos > 0, false
+		}
+		if name := markupTagName(data[pos : pos+n]); name == "" || strings.ContainsAny(name[:1], "/?!") {
+			return pos > 0, false
+		}
+		pos += n
+		if pos == len(data) || data[pos] != '<' {
+			return true, pos < len(data) && !isPDFWhitespace(data[pos])
+		}
+	}
+}
+
+// Minify XML or HTML: drop comments and whitespace-only text between tags,
+// compact tags. XML keeps text inside xml:space="preserve" elements, and
+// a single space between sibling elements when either holds text next to
+// it, as in mixed content (<b>a</b> <i>b</i>); HTML keeps raw elements
+// verbatim, collapses whitespace in text and keeps single spaces between
+// inline elements, where they render.
+func minifyMarkup(data []byte, html bool) []byte {
+	out := make([]byte, 0, len(data))
+	var preserve []bool // XML: xml:space="preserve" per open element
+	preserved := func() bool { return len(preserve) > 0 && preserve[len(preserve)-1] }
+	prevTag := ""
+	// What came last: text, or a closing tag and whether text came
+	// right before it or before the closing tags it follows
+	textBefore, closed, closedAfterText := false, false, false
+
+	for i := 0; i < len(data); {
+		if data[i] != '<' {
+			end := bytes.IndexByte(data[i:], '<')
+			if end < 0 {
+				end = len(data) - i
+			}
+			text := data[i : i+end]
+			i += end
+			hasText := len(bytes.TrimSpace(text)) > 0
+
+			switch {
+			case !html && preserved():
+				out = append(out, text...)
+			case hasText:
+				if html {
+					text = collapseWhitespace(text)
+				}
+				out = append(out, text...)
+			case !html:
+				opens, beforeText := opensElement(data[i:])
+				if closed && opens && (closedAfterText || beforeText) {
+					out = append(out, ' ')
+				}
+			case html:
+				// Whitespace between two inline elements still renders
+				nextTag := ""
+				if i < len(data) {
+					if n := markupTagLen(data[i:]); n > 0 {
+						nextTag = strings.TrimPrefix(markupTagName(data[i:i+n]), "/")
+					}
+				}
+				if prevTag != "" && nextTag != "" && !htmlBlockElements[prevTag] && !htmlBlockElements[nextTag] {
+					out = append(out, ' ')
+				}
+			}
+			textBefore, closed = hasText, false
+			continue
+		}
+
+		rest := data[i:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			end := bytes.Index(rest[4:], []byte("-->"))
+			if end < 0 {
+				return append(out, rest...)
+			}
+			comment := rest[:end+7]
+			// Conditional comments carry markup for old IE
+			if html && bytes.HasPrefix(comment, []byte("<!--[if")) {
+				out = append(out, comment...)
+			}
+			i += len(comment)
+		case bytes.HasPrefix(rest, []byte("<![CDATA[")):
+			end := bytes.Index(rest, []byte("]]>"))
+			if end < 0 {
+				return append(out, rest...)
+			}
+			out = append(out, rest[:end+3]...)
+			i += end + 3
+			textBefore, closed = true, false
+		default:
+			n := markupTagLen(rest)
+			if n < 0 {
+				return append(out, rest...)
+			}
+			tag := rest[:n]
+			i += n
+			name := markupTagName(tag)
+			out = append(out, compactTag(tag)...)
+			prevTag = strings.TrimPrefix(name, "/")
+			wasClosed := closed
+			closed = strings.HasPrefix(name, "/")
+			closedAfterText = closed && (textBefore || wasClosed && closedAfterText)
+			textBefore = false
+
+			selfClosing := bytes.HasSuffix(tag, []byte("/>"))
+			switch {
+			case strings.HasPrefix(name, "?") || strings.HasPrefix(name, "!"):
+			case strings.HasPrefix(name, "/"):
+				if len(preserve) > 0 {
+					preserve = preserve[:len(preserve)-1]
+				}
+			case html && htmlRawElements[name] && !selfClosing:
+				// Copy everything up to the matching close tag untouched
+				closeTag := []byte("</" + name)
+				end := bytes.Index(bytes.ToLower(data[i:]), closeTag)
+				if end < 0 {
+					return append(out, data[i:]...)
+				}
+				out = append(out, data[i:i+end]...)
+				i += end
+			case !html && !selfClosing:
+				p := preserved()
+				if bytes.Contains(tag, []byte(`xml:space="preserve"`)) || bytes.Contains(tag, []byte(`xml:space='preserve'`)) {
+					p = true
+				} else if bytes.Contains(tag, []byte(`xml:space="default"`)) {
+					p = false
+				}
+				preserve = append(preserve, p)
+			}
+		}
+	}
+	return out
+}
+
+// minifyAndCompress(data, type, options?) strips insignificant whitespace
+// from JSON, XML or HTML (type is "json", "xml", "html" or a MIME type)
+// and compresses the result with the text codec. Options: {codec, level}.
+// Resolves with the standard result object plus minifiedSize and
+// contentEncoding.
+func minifyAndCompress(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] minifyAndCompress called with %d arguments\n", len(args))
+
+	if len(args) < 2 || !isSet(args[0]) || args[1].Type() != js.TypeString {
+		return runAsync("minifyAndCompress", func() (interface{}, error) {
+			return nil, errors.New("missing required arguments (data, type)")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), declaredInputType(args[1].String()), args[0].Length())
+	if err != nil {
+		return runAsync("minifyAndCompress", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	typeName := args[1].String()
+	opts := currentSettings().Text
+	var optsErr error
+	if len(args) > 2 {
+		optsErr = decodeOptions(args[2], &opts)
+	}
+
+	return runAsync("minifyAndCompress", func() (interface{}, error) {
+		j := startJob("minify")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		kind, err := minifyKind(typeName)
+		if err != nil {
+			return nil, err
+		}
+
+		// Minifiers work on UTF-8
+		encoding, bomLen := detectTextEncoding(inputBytes)
+		text, warnings := textToUTF8(inputBytes[bomLen:], encoding)
+
+		minified, err := minify(text, kind)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Minified %s: %d -> %d bytes\n", kind, len(text), len(minified))
+
+		out, err := compressWithCodec(minified, opts.Codec, opts.Level, "")
+		if err != nil {
+			return nil, err
+		}
+
+		result := newResultObject(inputBytes, out)
+		result.Set("minifiedSize", len(minified))
+		result.Set("contentEncoding", opts.Codec)
+		setMessages(result, warnings)
+		return result, nil
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestMinifyHTML(t *testing.T) {
+	for _, c := range []struct {
+		name, in, want string
+	}{
+		{"block whitespace", "<div>\n  <p>Hello   <b>big</b>  <i>world</i>  </p>\n</div>",
+			"<div><p>Hello <b>big</b> <i>world</i></p></div>"},
+		{"space between inline elements", "<b>a</b> <i>b</i>\n<br> <i>c</i>", "<b>a</b> <i>b</i><br><i>c</i>"},
+		{"newlines between inline elements", "<span>a</span>\n\n<span>b</span>", "<span>a</span> <span>b</span>"},
+		{"pre", "<pre>  a\n   b  </pre>\n<p> x </p>", "<pre>  a\n   b  </pre><p> x </p>"},
+		{"script", "<script>\n if (a < b) { x = '<p>  y'; }\n</script>\n<div></div>",
+			"<script>\n if (a < b) { x = '<p>  y'; }\n</script><div></div>"},
+		{"upper-case script", "<SCRIPT>a  <  b</SCRIPT> <p>z</p>", "<SCRIPT>a  <  b</SCRIPT><p>z</p>"},
+		{"textarea", "<textarea>  keep\n me </textarea>", "<textarea>  keep\n me </textarea>"},
+		{"quoted attributes", `<a   href="x  y"   title='a  > b'  >t</a>`, `<a href="x  y" title='a  > b'>t</a>`},
+		{"comments", "<!-- note --><p>a</p><!--[if IE]><p>old</p><![endif]-->", "<p>a</p><!--[if IE]><p>old</p><![endif]-->"},
+		{"unterminated comment", "<p>a</p><!-- never closed <p>b</p>", "<p>a</p><!-- never closed <p>b</p>"},
+		{"unterminated tag", `<p>a</p><img src="x`, `<p>a</p><img src="x`},
+		{"unterminated raw element", "<pre>never closed  ", "<pre>never closed  "},
+		{"xhtml", "<?xml version=\"1.0\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\">\n<body>\n<p><b>a</b>\n<i>b</i><br/> c</p>\n</body>\n</html>",
+			"<?xml version=\"1.0\"?><html xmlns=\"http://www.w3.org/1999/xhtml\"><body><p><b>a</b> <i>b</i><br/> c</p></body></html>"},
+	} {
+		if out := minifyMarkup([]byte(c.in), true); string(out) != c.want {
+			t.Errorf("%s: %q, want %q", c.name, out, c.want)
+		}
+	}
+}
+
+func TestMinifyXML(t *testing.T) {
+	for _, c := range []struct {
+		name, in, want string
+	}{
+		{"indentation", "<root>\n  <a>  x  </a>\n  <d/>\n</root>", "<root><a>  x  </a><d/></root>"},
+		{"xml:space preserve", "<r>\n  <b xml:space=\"preserve\">  <c> y </c>  </b>\n</r>",
+			"<r><b xml:space=\"preserve\">  <c> y </c>  </b></r>"},
+		{"xml:space default inside preserve", "<r xml:space='preserve'> <s xml:space=\"default\">\n <t/>\n</s> </r>",
+			"<r xml:space='preserve'> <s xml:space=\"default\"><t/></s> </r>"},
+		{"prolog and CDATA", "<?xml version=\"1.0\"?>\n<!DOCTYPE r>\n<r><![CDATA[  a  <b> ]]></r>",
+			"<?xml version=\"1.0\"?><!DOCTYPE r><r><![CDATA[  a  <b> ]]></r>"},
+		{"comment", "<r>\n<!-- c -->\n<a/></r>", "<r><a/></r>"},
+		{"mixed content", "<p><b>a</b> <i>b</i>\n  <i><b>c</b></i>\n<b><i>d</i></b></p>", "<p><b>a</b> <i>b</i> <i><b>c</b></i> <b><i>d</i></b></p>"},
+		{"svg text", "<svg>\n  <text>\n    <tspan>Hello</tspan> <tspan>world</tspan>\n  </text>\n</svg>",
+			"<svg><text><tspan>Hello</tspan> <tspan>world</tspan></text></svg>"},
+		{"unterminated CDATA", "<r><![CDATA[ open", "<r><![CDATA[ open"},
+		{"unterminated comment", "<r>\n<!-- open", "<r><!-- open"},
+	} {
+		if out := minifyMarkup([]byte(c.in), false); string(out) != c.want {
+			t.Errorf("%s: %q, want %q", c.name, out, c.want)
+		}
+	}
+}
+
+func TestMinifyJSON(t *testing.T) {
+	out, err := minify([]byte("{\n  \"a\": [1, 2],\n  \"b\": \"x  y\"\n}\n"), minifyJSON)
+	if err != nil || string(out) != `{"a":[1,2],"b":"x  y"}` {
+		t.Errorf("%q: %v", out, err)
+	}
+	if _, err := minify([]byte(`{"a":`), minifyJSON); err == nil {
+		t.Error("truncated JSON accepted")
+	}
+}
+
+func TestMinifyKind(t *testing.T) {
+	for in, want := range map[string]string{
+		"json": minifyJSON, "application/json; charset=utf-8": minifyJSON, "application/ld+json": minifyJSON,
+		"HTML": minifyHTML, "text/html": minifyHTML, "application/xhtml+xml": minifyHTML,
+		"xml": minifyXML, "text/xml": minifyXML, "image/svg+xml": minifyXML,
+	} {
+		if kind, err := minifyKind(in); kind != want || err != nil {
+			t.Errorf("%q: %q, %v", in, kind, err)
+		}
+	}
+	if _, err := minifyKind("text/css"); err == nil {
+		t.Error("text/css accepted")
+	}
+}
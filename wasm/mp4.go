@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Lossless MP4/MOV container cleanup: drop metadata boxes (GPS, cover art,
+// thumbnails, editing app data, padding) and move moov in front of the
+// media data so playback can start before the download ends. Samples are
+// copied byte for byte; only chunk offsets are rewritten.
+
+// Boxes whose children are rewritten
+var mp4Containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true,
+	"edts": true, "dinf": true, "mvex": true,
+}
+
+// Boxes that carry metadata or padding and nothing playback needs
+var mp4MetadataBoxes = map[string]bool{
+	"udta": true, // user data: ©xyz GPS, ©too encoder, thumbnails
+	"meta": true, // iTunes/QuickTime metadata, cover art, location keys
+	"uuid": true, // vendor extensions such as XMP
+	"free": true, "skip": true, "wide": true,
+}
+
+// Options for optimizeMP4
+type mp4Options struct {
+	StripMetadata bool `json:"stripMetadata"`
+	FastStart     bool `json:"fastStart"` // moov before mdat
+}
+
+func defaultMP4Options() mp4Options {
+	return mp4Options{StripMetadata: true, FastStart: true}
+}
+
+// A box optimizeMP4 dropped
+type mp4Removal struct {
+	Path string `json:"path"` // e.g. "moov/udta"
+	Size int    `json:"size"`
+}
+
+// Outcome of rewriting a container
+type mp4Result struct {
+	Data      []byte
+	MovedMoov bool
+	Removed   []mp4Removal
+}
+
+// Rebuilds moov, dropping metadata and remembering where the chunk offset
+// tables ended up so they can be patched once the new layout is known
+type mp4Rewriter struct {
+	data    []byte
+	strip   bool
+	removed []mp4Removal
+	tables  []int // payload positions of stco/co64 boxes in the output
+	wide    []bool
+}
+
+func (w *mp4Rewriter) rebuild(out *bytes.Buffer, b isoBox, path string) {
+	if !mp4Containers[b.Type] {
+		if b.Type == "stco" || b.Type == "co64" {
+			w.tables = append(w.tables, out.Len()+(b.Start-b.Offset))
+			w.wide = append(w.wide, b.Type == "co64")
+		}
+		out.Write(w.data[b.Offset:b.End])
+		return
+	}
+	start := out.Len()
+	out.Write([]byte{0, 0, 0, 0})
+	out.WriteString(b.Type)
+	for _, c := range isoBoxes(w.data, b.Start, b.End) {
+		if w.strip && mp4MetadataBoxes[c.Type] {
+			w.removed = append(w.removed, mp4Removal{Path: path + "/" + c.Type, Size: c.End - c.Offset})
+			continue
+		}
+		w.rebuild(out, c, path+"/"+c.Type)
+	}
+	binary.BigEndian.PutUint32(out.Bytes()[start:], uint32(out.Len()-start))
+}
+
+func optimizeMP4Data(data []byte, opts mp4Options) (mp4Result, error) {
+	top := isoBoxes(data, 0, len(data))
+	if len(top) == 0 || (top[0].Type != "ftyp" && top[0].Type != "moov" && top[0].Type != "wide" && top[0].Type != "mdat") {
+		return mp4Result{}, errors.New("not an MP4 or QuickTime file")
+	}
+	end := 0
+	moov, firstMdat := -1, -1
+	for i, b := range top {
+		switch b.Type {
+		case "moov":
+			moov = i
+		case "mdat":
+			if firstMdat < 0 {
+				firstMdat = i
+			}
+		case "moof":
+			return mp4Result{}, errors.New("fragmented MP4 is not supported")
+		}
+		end = b.End
+	}
+	if moov < 0 {
+		return mp4Result{}, errors.New("no moov box")
+	}
+	if end != len(data) {
+		return mp4Result{}, fmt.Errorf("%d trailing bytes after the last box", len(data)-end)
+	}
+
+	w := &mp4Rewriter{data: data, strip: opts.StripMetadata}
+	var newMoov bytes.Buffer
+	w.rebuild(&newMoov, top[moov], "moov")
+
+	// New order: moov right after ftyp when moving it, everything else in
+	// its original order, metadata boxes dropped
+	moveMoov := opts.FastStart && firstMdat >= 0 && firstMdat < moov
+	var order []int
+	for i, b := range top {
+		switch {
+		case i == moov && moveMoov:
+			continue
+		case i != moov && opts.StripMetadata && mp4MetadataBoxes[b.Type]:
+			w.removed = append(w.removed, mp4Removal{Path: b.Type, Size: b.End - b.Offset})
+			continue
+		}
+		order = append(order, i)
+		if moveMoov && b.Type == "ftyp" {
+			order = append(order, moov)
+		}
+	}
+	if moveMoov && (len(order) == 0 || top[order[0]].Type != "ftyp") {
+		order = append([]int{moov}, order...)
+	}
+
+	// Where each kept box lands, for moving chunk offsets with their box
+	type placement struct{ oldStart, oldEnd, newStart int }
+	var placed []placement
+	size := 0
+	moovAt := 0
+	for _, i := range order {
+		b := top[i]
+		if i == moov {
+			moovAt = size
+			size += newMoov.Len()
+			continue
+		}
+		placed = append(placed, placement{b.Offset, b.End, size})
+		size += b.End - b.Offset
+	}
+	sort.Slice(placed, func(a, b int) bool { return placed[a].oldStart < placed[b].oldStart })
+	relocate := func(off uint64) (uint64, error) {
+		i := sort.Search(len(placed), func(i int) bool { return uint64(placed[i].oldEnd) > off })
+		if i == len(placed) || off < uint64(placed[i].oldStart) {
+			return 0, fmt.Errorf("chunk offset %d is outside the media data", off)
+		}
+		return off - uint64(placed[i].oldStart) + uint64(placed[i].newStart), nil
+	}
+
+	moovBytes := newMoov.Bytes()
+	for t, at := range w.tables {
+		if at+8 > len(moovBytes) {
+			return mp4Result{}, errors.New("chunk offset table truncated")
+		}
+		count := int(binary.BigEndian.Uint32(moovBytes[at+4:]))
+		entry := 4
+		if w.wide[t] {
+			entry = 8
+		}
+		if count < 0 || at+8+count*entry > len(moovBytes) {
+			return mp4Result{}, errors.New("chunk offset table truncated")
+		}
+		for k := 0; k < count; k++ {
+			p := moovBytes[at+8+k*entry:]
+			if w.wide[t] {
+				off, err := relocate(binary.BigEndian.Uint64(p))
+				if err != nil {
+					return mp4Result{}, err
+				}
+				binary.BigEndian.PutUint64(p, off)
+				continue
+			}
+			off, err := relocate(uint64(binary.BigEndian.Uint32(p)))
+			if err != nil {
+				return mp4Result{}, err
+			}
+			if off > 0xFFFFFFFF {
+				return mp4Result{}, errors.New("chunk offsets no longer fit in 32 bits")
+			}
+			binary.BigEndian.PutUint32(p, uint32(off))
+		}
+	}
+
+	out := make([]byte, 0, size)
+	for _, i := range order {
+		if i == moov {
+			if len(out) != moovAt {
+				return mp4Result{}, errors.New("internal layout mismatch")
+			}
+			out = append(out, moovBytes...)
+			continue
+		}
+		out = append(out, data[top[i].Offset:top[i].End]...)
+	}
+	return mp4Result{Data: out, MovedMoov: moveMoov, Removed: w.removed}, nil
+}
+
+// optimizeMP4(data, options?) losslessly cleans up an MP4 or MOV file.
+// Options: {stripMetadata, fastStart}, both on by default. stripMetadata
+// drops udta, meta, uuid and padding boxes (GPS, cover art, thumbnails,
+// editing app data); fastStart moves moov in front of the media data.
+// Fragmented files are rejected. Resolves with the standard result object
+// plus movedMoov and removed: [{path, size}].
+func optimizeMP4(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] optimizeMP4 called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("optimizeMP4", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("optimizeMP4", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := defaultMP4Options()
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+
+	return runAsync("optimizeMP4", func() (interface{}, error) {
+		j := startJob("optimizeMP4")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		res, err := optimizeMP4Data(inputBytes, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCancelled(j.ctx); err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] MP4: %d -> %d bytes, %d boxes removed, moov moved: %v\n",
+			len(inputBytes), len(res.Data), len(res.Removed), res.MovedMoov)
+
+		result := newResultObject(inputBytes, res.Data)
+		result.Set("movedMoov", res.MovedMoov)
+		removed, err := jsonToJS(append([]mp4Removal{}, res.Removed...))
+		if err != nil {
+			return nil, err
+		}
+		result.Set("removed", removed)
+		return result, nil
+	})
+}
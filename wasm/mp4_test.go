@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestMP4(t *testing.T) {
+	media := []byte("sample payload")
+	data := fixtureMP4(media)
+	if sniffMimeType(data) != "video/mp4" {
+		t.Fatalf("sniffed %s", sniffMimeType(data))
+	}
+	res, err := optimizeMP4Data(data, defaultMP4Options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	var chunk uint32
+	for _, b := range isoBoxes(res.Data, 0, len(res.Data)) {
+		types = append(types, b.Type)
+		if b.Type == "moov" {
+			at := bytes.Index(res.Data[b.Start:b.End], []byte("stco"))
+			chunk = binary.BigEndian.Uint32(res.Data[b.Start+at+12:])
+		}
+	}
+	if fmt.Sprint(types) != "[ftyp moov mdat]" || !res.MovedMoov || len(res.Removed) != 2 {
+		t.Fatalf("boxes %v, moved %v, removed %+v", types, res.MovedMoov, res.Removed)
+	}
+	// The chunk offset must follow the media data to its new place
+	if int(chunk)+len(media) > len(res.Data) || !bytes.Equal(res.Data[chunk:int(chunk)+len(media)], media) {
+		t.Fatalf("chunk offset %d does not point at the media", chunk)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output naming templates, e.g. "{name}-compressed.{ext}". Tokens:
+//
+//	{name}     input name without its extension
+//	{ext}      extension of the output format (".gz"/".br" appended for text)
+//	{origext}  extension of the input name
+//	{n}        1-based position in the batch; {n:3} pads it to 3 digits
+//	{date}     batch start date, YYYY-MM-DD
+//	{time}     batch start time, HHMMSS
+var namingToken = regexp.MustCompile(`\{([a-z]+)(?::(\d+))?\}`)
+
+// Extensions for the formats outputs can end up in
+var mimeExtensions = map[string]string{
+	"application/pdf":           "pdf",
+	"image/jpeg":                "jpg",
+	"image/png":                 "png",
+	"image/webp":                "webp",
+	"image/gif":                 "gif",
+	"image/tiff":                "tif",
+	"image/bmp":                 "bmp",
+	"image/avif":                "avif",
+	"image/heic":                "heic",
+	"image/heif":                "heif",
+	"video/mp4":                 "mp4",
+	"video/quicktime":           "mov",
+	"image/vnd.adobe.photoshop": "psd",
+	"font/ttf":                  "ttf",
+	"font/otf":                  "otf",
+	"font/woff":                 "woff",
+	"font/woff2":                "woff2",
+}
+
+// Expands a naming template for each file of a batch, making every name
+// unique within it
+type outputNamer struct {
+	pattern string
+	start   time.Time
+	count   int
+	used    map[string]bool
+}
+
+// Check the template's tokens up front so a typo fails the batch before
+// any work is done
+func newOutputNamer(pattern string, start time.Time) (*outputNamer, error) {
+	for _, m := range namingToken.FindAllStringSubmatch(pattern, -1) {
+		switch m[1] {
+		case "name", "ext", "origext", "date", "time":
+			if m[2] != "" {
+				return nil, fmt.Errorf("naming token {%s} takes no width", m[1])
+			}
+		case "n":
+		default:
+			return nil, fmt.Errorf("unknown naming token {%s}", m[1])
+		}
+	}
+	rest := namingToken.ReplaceAllString(pattern, "")
+	if strings.ContainsAny(rest, "{}/\\") {
+		return nil, fmt.Errorf("invalid naming pattern %q", pattern)
+	}
+	return &outputNamer{pattern: pattern, start: start, used: map[string]bool{}}, nil
+}
+
+// Name for the next file. output decides {ext}; contentEncoding is the
+// text codec applied to it, if any.
+func (n *outputNamer) next(inputName string, output []byte, contentEncoding string) string {
+	n.count++
+	origExt := strings.TrimPrefix(path.Ext(inputName), ".")
+	base := strings.TrimSuffix(inputName, path.Ext(inputName))
+
+	ext, ok := mimeExtensions[sniffMimeType(output)]
+	if !ok {
+		ext = origExt
+	}
+	switch contentEncoding {
+	case codecGzip:
+		ext += ".gz"
+	case codecBrotli:
+		ext += ".br"
+	}
+	ext = strings.TrimPrefix(ext, ".")
+
+	name := namingToken.ReplaceAllStringFunc(n.pattern, func(token string) string {
+		m := namingToken.FindStringSubmatch(token)
+		switch m[1] {
+		case "name":
+			return base
+		case "ext":
+			return ext
+		case "origext":
+			return origExt
+		case "date":
+			return n.start.Format("2006-01-02")
+		case "time":
+			return n.start.Format("150405")
+		}
+		width, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("%0*d", width, n.count)
+	})
+	// An empty {ext} leaves a dangling dot
+	name = strings.TrimSuffix(name, ".")
+	return n.unique(name, ext)
+}
+
+// Suffix "-2", "-3", ... before the extension until the name is unused.
+// Names are compared case-insensitively, as on Windows and macOS.
+func (n *outputNamer) unique(name, ext string) string {
+	// Keep double extensions like ".css.gz" together
+	suffix := path.Ext(name)
+	if ext != "" && strings.HasSuffix(name, "."+ext) {
+		suffix = "." + ext
+	}
+	stem := strings.TrimSuffix(name, suffix)
+	if stem == "" {
+		stem, suffix = name, ""
+	}
+	candidate := name
+	for i := 2; n.used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", stem, i, suffix)
+	}
+	n.used[strings.ToLower(candidate)] = true
+	return candidate
+}
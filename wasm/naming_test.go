@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNaming(t *testing.T) {
+	photo := fixtureGradient(256, 256)
+
+	namer, err := newOutputNamer("{name}-{n:2}.{ext}", time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png := fixturePNG(fixtureGradient(8, 8))
+	got := []string{
+		namer.next("photo.png", fixtureJPEG(photo), ""),
+		namer.next("style.css", []byte("body{}"), codecGzip),
+		namer.next("Photo.PNG", png, ""),
+	}
+	want := []string{"photo-01.jpg", "style-02.css.gz", "Photo-03.png"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("name %d is %q, expected %q", i, got[i], want[i])
+		}
+	}
+	namer, _ = newOutputNamer("{name}-{date}.{ext}", time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC))
+	first, second := namer.next("a.png", png, ""), namer.next("A.png", png, "")
+	if first != "a-2024-05-01.png" || second != "A-2024-05-01-2.png" {
+		t.Fatalf("collision gave %q and %q", first, second)
+	}
+	if _, err := newOutputNamer("{nmae}.{ext}", time.Time{}); err == nil {
+		t.Fatal("unknown token accepted")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Guarded entry points to the format parsers for untrusted bytes. Each
+// takes a byte slice and nothing else (no syscall/js, no module state), so
+// a fuzzer can drive it directly, and turns a panic inside the parser into
+// an error wrapping errMalformed: a broken upload then fails with
+// "malformed PDF" rather than rejecting its promise with a Go panic.
+
+var errMalformed = errors.New("file is damaged or not in the format it claims")
+
+// Recover a parser panic into *err. The panic itself is a parser bug and
+// is logged for bug reports; the caller only sees the malformed input.
+func guardParse(format string, err *error) {
+	if r := recover(); r != nil {
+		fmt.Printf("[WASM ERROR] %s parser panicked: %v\n", format, r)
+		*err = fmt.Errorf("malformed %s: %w", format, errMalformed)
+	}
+}
+
+// Parse a PDF file; see parsePDF
+func ParsePDF(data []byte) (doc *pdfDocument, err error) {
+	defer guardParse("PDF", &err)
+	return parsePDF(data)
+}
+
+// Split a PNG file into chunks, checking CRCs and chunk order; see
+// readValidPNGChunks
+func ParsePNGChunks(data []byte) (chunks []pngChunk, err error) {
+	defer guardParse("PNG", &err)
+	return readValidPNGChunks(data)
+}
+
+// Split a JPEG file into marker segments and return them with the length
+// of the JPEG; see parseJPEG
+func ParseJPEGSegments(data []byte) (segments []jpegSegment, n int, err error) {
+	defer guardParse("JPEG", &err)
+	return parseJPEG(data)
+}
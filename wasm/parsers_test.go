@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Seeds shared by the mutation test and the fuzzers
+func parserSeeds() (pdf, png, jpeg []byte) {
+	return fixturePDF(), fixturePNG(fixtureCutout(16, 16)), fixtureJPEGWithEXIF(fixtureGradient(16, 16), 64)
+}
+
+func TestParsersSurviveMutations(t *testing.T) {
+	// Truncations and byte flips of each fixture must fail cleanly or
+	// parse, never panic inside a parser
+	pdf, png, jpeg := parserSeeds()
+	parsers := []struct {
+		format string
+		seed   []byte
+		parse  func([]byte) error
+	}{
+		{"PDF", pdf, func(d []byte) error {
+			doc, err := ParsePDF(d)
+			if err == nil {
+				doc.pages()
+				brokenStreams(doc)
+			}
+			return err
+		}},
+		{"PNG", png, func(d []byte) error {
+			_, err := ParsePNGChunks(d)
+			return err
+		}},
+		{"JPEG", jpeg, func(d []byte) error {
+			_, _, err := ParseJPEGSegments(d)
+			return err
+		}},
+	}
+	for _, p := range parsers {
+		var mutants [][]byte
+		for n := 0; n < len(p.seed); n += 1 + len(p.seed)/64 {
+			mutants = append(mutants, p.seed[:n])
+		}
+		state := uint32(1216)
+		for i := 0; i < 500; i++ {
+			m := append([]byte{}, p.seed...)
+			for k := 0; k < 1+i%4; k++ {
+				state = state*1664525 + 1013904223
+				m[int(state>>8)%len(m)] = byte(state >> 24)
+			}
+			mutants = append(mutants, m)
+		}
+		for _, m := range mutants {
+			if err := p.parse(m); errors.Is(err, errMalformed) {
+				t.Fatalf("%s parser panicked on a %d-byte mutant", p.format, len(m))
+			}
+		}
+	}
+}
+
+func TestGuardParseWrapsPanics(t *testing.T) {
+	var err error
+	func() {
+		defer guardParse("test", &err)
+		panic("index out of range")
+	}()
+	if !errors.Is(err, errMalformed) || err.Error() != "malformed test: "+errMalformed.Error() {
+		t.Fatalf("guarded panic became %v", err)
+	}
+}
+
+// The fuzzers fail on errMalformed, which only a recovered panic returns
+
+func FuzzParsePDF(f *testing.F) {
+	pdf, _, _ := parserSeeds()
+	f.Add(pdf)
+	f.Add(fixtureThreePagePDF(fixturePageStreams()))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc, err := ParsePDF(data)
+		if errors.Is(err, errMalformed) {
+			t.Fatal(err)
+		}
+		if err == nil {
+			doc.pages()
+			brokenStreams(doc)
+		}
+	})
+}
+
+func FuzzParsePNGChunks(f *testing.F) {
+	_, png, _ := parserSeeds()
+	f.Add(png)
+	f.Add(fixtureAPNG())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := ParsePNGChunks(data); errors.Is(err, errMalformed) {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzParseJPEGSegments(f *testing.F) {
+	_, _, jpeg := parserSeeds()
+	f.Add(jpeg)
+	f.Add(fixtureJPEG(fixtureGradient(8, 8)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, _, err := ParseJPEGSegments(data); errors.Is(err, errMalformed) {
+			t.Fatal(err)
+		}
+	})
+}
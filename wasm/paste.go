@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Bytes and media type of a clipboard payload: a Blob from
+// ClipboardItem.getType, raw bytes, a data: URL or bare base64
+func pastedImageBytes(payload js.Value) ([]byte, string, error) {
+	if blob := js.Global().Get("Blob"); !blob.IsUndefined() && payload.InstanceOf(blob) {
+		head, err := awaitJS(payload.Call("slice", 0, sniffPeekBytes).Call("arrayBuffer"))
+		if err != nil {
+			return nil, "", fmt.Errorf("reading pasted blob: %v", err)
+		}
+		if err := checkInputAllowed(bytesFromJS(js.Global().Get("Uint8Array").New(head)), payload.Get("type").String()); err != nil {
+			return nil, "", err
+		}
+		buf, err := awaitJS(payload.Call("arrayBuffer"))
+		if err != nil {
+			return nil, "", fmt.Errorf("reading pasted blob: %v", err)
+		}
+		data := bytesFromJS(js.Global().Get("Uint8Array").New(buf))
+		return data, payload.Get("type").String(), nil
+	}
+	if payload.Type() == js.TypeString {
+		text := strings.TrimSpace(payload.String())
+		if strings.HasPrefix(strings.ToLower(text), "data:") {
+			mimeType, data, err := parseDataURL(text)
+			if err == nil {
+				err = checkInputAllowed(data, mimeType)
+			}
+			return data, mimeType, err
+		}
+		data, err := decodeBase64Loose(text)
+		if err != nil {
+			return nil, "", errors.New("pasted text is neither a data: URL nor base64")
+		}
+		return data, "", checkInputAllowed(data, "")
+	}
+	// Typed arrays are checked before the copy, chunk lists after it
+	head := peekJS(payload, sniffPeekBytes)
+	if head != nil {
+		if err := checkInputAllowed(head, ""); err != nil {
+			return nil, "", err
+		}
+	}
+	data, err := chunkBytesFromJS(payload)
+	if err == nil && head == nil {
+		err = checkInputAllowed(data, "")
+	}
+	return data, "", err
+}
+
+// Size of a paste payload before it is read: a Blob's size, a string's
+// length (an upper bound for data: URLs and base64) or a view's length
+func pastedSize(payload js.Value) int {
+	switch {
+	case payload.Type() == js.TypeString:
+		return len(payload.String())
+	case payload.Get("size").Type() == js.TypeNumber:
+		return payload.Get("size").Int()
+	case payload.Get("byteLength").Type() == js.TypeNumber:
+		return payload.Get("byteLength").Int()
+	}
+	return 0
+}
+
+// compressPastedImage(payload, options?, onProgress?) compresses an image
+// taken from a paste event: a Blob (ClipboardItem, DataTransfer file), a
+// Uint8Array such as a raw PNG screenshot, a data: URL or bare base64.
+// The format is sniffed from the bytes; a declared type is only used as a
+// cross-check. Options and progress are those of compressImage, including
+// dataURL. Resolves with compressImage's result plus the output's mimeType.
+func compressPastedImage(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] compressPastedImage called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("compressPastedImage", func() (interface{}, error) {
+			return nil, errors.New("missing paste payload")
+		})
+	}
+	payload := args[0]
+	opts := currentSettings().Image
+	var urlOpts dataURLOptions
+	var prov provenanceOptions
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+		if optsErr == nil {
+			optsErr = decodeOptions(args[1], &urlOpts)
+		}
+		if optsErr == nil {
+			optsErr = decodeOptions(args[1], &prov)
+		}
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+	policy := currentPolicy()
+	opts = policy.applyImage(opts)
+
+	return runAsync("compressPastedImage", func() (interface{}, error) {
+		j := startJob("image")
+		defer j.finish()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		reportProgress := progressReporter(progressCallback, j)
+
+		release, err := reserveInput(pastedSize(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		inputBytes, declared, err := pastedImageBytes(payload)
+		if err != nil {
+			return nil, err
+		}
+		mimeType := sniffMimeType(inputBytes)
+		if !strings.HasPrefix(mimeType, "image/") {
+			return nil, fmt.Errorf("pasted data is not a supported image (declared %q)", declared)
+		}
+		if declared != "" && declared != mimeType {
+			fmt.Printf("[WASM] Pasted image declared %s but contains %s\n", declared, mimeType)
+		}
+		fmt.Printf("[WASM] Pasted image: %s, %d bytes\n", mimeType, len(inputBytes))
+		violations := policy.checkInput(mimeType)
+		if err := policy.enforce(violations); err != nil {
+			return nil, err
+		}
+
+		res, err := compressImageData(j.ctx, inputBytes, mimeType, opts, reportProgress)
+		if err != nil {
+			return nil, err
+		}
+		res.Data = policy.finishImage(res.Data)
+		var provWarnings []message
+		res.Data, provWarnings = prov.apply(inputBytes, res.Data, opts.Mode)
+		res.Warnings = append(res.Warnings, provWarnings...)
+		violations = append(violations, policy.checkOutput(mimeType, res.Data, nil)...)
+		if err := policy.enforce(violations); err != nil {
+			return nil, err
+		}
+		result := newResultObject(inputBytes, res.Data)
+		result.Set("mimeType", sniffMimeType(res.Data))
+		if res.Animated {
+			result.Set("animated", true)
+			result.Set("frames", res.Frames)
+		}
+		if res.TimedOut {
+			result.Set("timedOut", true)
+		}
+		setMessages(result, res.Warnings)
+		setPolicyViolations(result, violations)
+		if len(res.Alternatives) > 0 {
+			result.Set("alternatives", alternativesToJS(res.Alternatives))
+		}
+		urlOpts.apply(result, sniffMimeType(res.Data), res.Data)
+		reportProgress(100)
+		return result, nil
+	})
+}
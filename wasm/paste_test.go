@@ -0,0 +1,51 @@
+//go:build js
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestCompressPastedImage(t *testing.T) {
+	png := fixturePNG(fixtureGradient(120, 80))
+	b64 := base64.StdEncoding.EncodeToString(png)
+	wrapped := b64[:60] + "\n" + strings.TrimRight(b64[60:], "=") // as mail clients paste it
+	blob := func(data []byte, mimeType string) js.Value {
+		opts := js.Global().Get("Object").New()
+		opts.Set("type", mimeType)
+		return js.Global().Get("Blob").New(js.Global().Get("Array").New(bytesToJS(data)), opts)
+	}
+
+	for name, payload := range map[string]js.Value{
+		"bytes":             bytesToJS(png),
+		"data URL":          js.ValueOf("data:image/png;base64," + b64),
+		"bare base64":       js.ValueOf(wrapped),
+		"blob":              blob(png, "image/png"),
+		"blob with no type": blob(png, ""),
+		"mislabelled blob":  blob(png, "image/jpeg"), // sniffed, not trusted
+	} {
+		res, err := awaitJS(compressPastedImage(js.Undefined(), []js.Value{payload}).(js.Value))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if res.Get("originalSize").Int() != len(png) || !strings.HasPrefix(res.Get("mimeType").String(), "image/") {
+			t.Errorf("%s: %d bytes in, %s out", name, res.Get("originalSize").Int(), res.Get("mimeType").String())
+		}
+	}
+
+	for name, payload := range map[string]js.Value{
+		"plain text":    js.ValueOf("hello"),
+		"text data URL": js.ValueOf("data:,Hello%2C%20World"),
+		"PDF bytes":     bytesToJS(fixturePDF()),
+		"nothing":       js.Undefined(),
+	} {
+		if _, err := awaitJS(compressPastedImage(js.Undefined(), []js.Value{payload}).(js.Value)); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// Multi-pattern search (Aho-Corasick). A patternSet is built once from a
+// fixed list of byte patterns and then finds every occurrence of all of
+// them in a single pass over the input, where searching for each pattern
+// in turn reads the input once per pattern. The automaton is a full
+// transition table, 1KB per state, so it suits short lists of short
+// patterns like file signatures.
+
+type patternSet struct {
+	patterns [][]byte
+	next     [][256]int32 // state transitions; state 0 is the root
+	matches  [][]int      // patterns ending at each state, longest first
+}
+
+func newPatternSet(patterns [][]byte) *patternSet {
+	s := &patternSet{patterns: patterns, next: make([][256]int32, 1), matches: make([][]int, 1)}
+
+	// The trie, with -1 for missing edges
+	for i := range s.next[0] {
+		s.next[0][i] = -1
+	}
+	for p, pattern := range patterns {
+		state := int32(0)
+		for _, c := range pattern {
+			if s.next[state][c] < 0 {
+				var row [256]int32
+				for i := range row {
+					row[i] = -1
+				}
+				s.next = append(s.next, row)
+				s.matches = append(s.matches, nil)
+				s.next[state][c] = int32(len(s.next) - 1)
+			}
+			state = s.next[state][c]
+		}
+		if len(pattern) > 0 {
+			s.matches[state] = append(s.matches[state], p)
+		}
+	}
+
+	// Failure links breadth first, folding them into the table so the scan
+	// takes exactly one step per byte
+	fail := make([]int32, len(s.next))
+	queue := []int32{}
+	for c := range s.next[0] {
+		if child := s.next[0][c]; child < 0 {
+			s.next[0][c] = 0
+		} else {
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		s.matches[state] = append(s.matches[state], s.matches[fail[state]]...)
+		for c := range s.next[state] {
+			child := s.next[state][c]
+			if child < 0 {
+				s.next[state][c] = s.next[fail[state]][c]
+				continue
+			}
+			fail[child] = s.next[fail[state]][c]
+			queue = append(queue, child)
+		}
+	}
+	return s
+}
+
+// Call fn with the pattern index and offset of every occurrence in data,
+// by end offset and then longest first; overlapping occurrences are all
+// reported. Scanning stops when fn returns false.
+func (s *patternSet) scan(data []byte, fn func(pattern, at int) bool) {
+	state := int32(0)
+	for i, c := range data {
+		state = s.next[state][c]
+		for _, p := range s.matches[state] {
+			if !fn(p, i+1-len(s.patterns[p])) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPatternSetMatchesSearchingEachPattern(t *testing.T) {
+	// Overlapping and repeated patterns against a search for each in turn
+	patterns := [][]byte{[]byte("abab"), []byte("bab"), []byte("b"), []byte("ca"), []byte("abab")}
+	data := []byte("xababcababab-cab")
+	var got []string
+	newPatternSet(patterns).scan(data, func(p, at int) bool {
+		got = append(got, fmt.Sprintf("%d@%d", p, at))
+		return true
+	})
+	var want []string
+	for p, pattern := range patterns {
+		for at := 0; at+len(pattern) <= len(data); at++ {
+			if bytes.HasPrefix(data[at:], pattern) {
+				want = append(want, fmt.Sprintf("%d@%d", p, at))
+			}
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("found %v, want %v", got, want)
+	}
+}
+
+func TestFindEmbeddedFormats(t *testing.T) {
+	blob := append([]byte("junk"), pngSignature...)
+	blob = append(blob, "..%PDF-1.4 GIF89a GIF89a\x00\x00\x00\x18ftypisom"...)
+	formats := findEmbeddedFormats(blob)
+	if fmt.Sprint(formats) != "[{png 4 true} {pdf 14 false} {gif 23 true} {gif 30 true} {mp4 36 true}]" {
+		t.Errorf("formats %v", formats)
+	}
+
+	// A signature repeated well past its cap
+	blob = append(bytes.Repeat([]byte("PK\x03\x04"), 8*analyzeMaxFormats), "%PDF-1.4"...)
+	formats = findEmbeddedFormats(blob)
+	if len(formats) != analyzeMaxFormats || formats[0].Format != "zip" {
+		t.Errorf("%d formats, first %v", len(formats), formats[0])
+	}
+}
+
+func TestScanWebAsset(t *testing.T) {
+	m := scanWebAsset([]byte("a\nb\n//# sourceMappingURL=app.js.map\n"))
+	if m.lines != 4 || !m.sourceMap {
+		t.Errorf("%+v, want 4 lines and a source map", m)
+	}
+	long := bytes.Repeat([]byte("x"), 3*minifiedLineLength)
+	if !scanWebAsset(long).looksMinified() {
+		t.Error("one long line does not look minified")
+	}
+	if scanWebAsset(bytes.Repeat([]byte("x = 1;\n"), 500)).looksMinified() {
+		t.Error("short lines look minified")
+	}
+}
+
+func TestRemoveDuplicateObjectsKeepsFirstMetadata(t *testing.T) {
+	in := "1 0 obj\n<< /Type /Metadata /N 1 >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Page >>\nendobj\n" +
+		"3 0 obj\n<< /Type /Metadata /N 3 >>\nendobj\n" +
+		"4 0 obj\n<< /Type /Metadata /N 4 >>\nendobj\n"
+	want := "1 0 obj\n<< /Type /Metadata /N 1 >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Page >>\nendobj\n" +
+		"3 0 obj\n<< \n" +
+		"4 0 obj\n<< \n"
+	if got := removeDuplicateObjects(in); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
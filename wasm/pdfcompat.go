@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Strict compatibility, for documents sent to audiences whose viewers are
+// unknown (print drivers, e-readers, old Acrobat installs). With
+// compatibility "strict" the output keeps to a conservative profile: a
+// classic cross-reference table and no object streams, which the rewrite
+// always writes anyway; full filter names in stream dictionaries, the
+// abbreviations being legal only in inline images; filters from PDF 1.3
+// only; baseline JPEGs; and Acrobat 4's limits on names, strings, arrays,
+// dictionaries and integers. A level whose output adds anything outside
+// the profile fails. What the input already has (a JPX image, a
+// progressive JPEG) is kept, since replacing it would change the document,
+// and reported.
+
+// Compatibility modes
+const (
+	pdfCompatDefault = ""
+	pdfCompatStrict  = "strict"
+)
+
+func checkPDFCompatibility(mode string) error {
+	switch mode {
+	case pdfCompatDefault, pdfCompatStrict:
+		return nil
+	}
+	return fmt.Errorf("unknown compatibility mode %q, want strict or none", mode)
+}
+
+// Filters every PDF 1.3 reader decodes
+var pdfStrictFilters = map[string]bool{
+	"ASCIIHexDecode": true, "ASCII85Decode": true, "LZWDecode": true, "FlateDecode": true,
+	"RunLengthDecode": true, "CCITTFaxDecode": true, "DCTDecode": true,
+}
+
+// Abbreviated filter names and what they stand for
+var pdfFilterAbbreviations = map[string]string{
+	"AHx": "ASCIIHexDecode", "A85": "ASCII85Decode", "LZW": "LZWDecode", "Fl": "FlateDecode",
+	"RL": "RunLengthDecode", "CCF": "CCITTFaxDecode", "DCT": "DCTDecode",
+}
+
+// Acrobat 4 implementation limits
+const (
+	strictMaxName   = 127
+	strictMaxString = 65535
+	strictMaxArray  = 8191
+	strictMaxDict   = 4095
+	strictMaxInt    = 1<<31 - 1
+)
+
+// Constructs outside the strict profile in a document, counted by kind
+func compatibilityIssues(doc *pdfDocument) map[string]int {
+	issues := map[string]int{}
+	if !bytes.HasPrefix(doc.Data, []byte("%PDF-1.")) {
+		issues["header other than %PDF-1.x at the start"]++
+	}
+	for _, num := range doc.objectNumbers() {
+		obj := doc.Objects[num]
+		if isLayoutObject(obj) {
+			if obj.Dict().Name("Type") == "XRef" {
+				issues["cross-reference stream"]++
+			} else {
+				issues["object stream"]++
+			}
+			continue
+		}
+		valueCompatibilityIssues(obj.Value, issues, 0)
+		if !obj.HasStream {
+			continue
+		}
+		names, _ := streamFilters(doc, obj.Dict())
+		for _, name := range names {
+			if full, ok := pdfFilterAbbreviations[name]; ok {
+				issues["abbreviated filter name"]++
+				name = full
+			}
+			if !pdfStrictFilters[name] {
+				issues[name+" filter"]++
+			}
+		}
+		if len(names) == 1 && (names[0] == "DCTDecode" || names[0] == "DCT") && !baselineJPEG(obj.Stream) {
+			issues["progressive or arithmetic-coded JPEG"]++
+		}
+	}
+	return issues
+}
+
+func valueCompatibilityIssues(v pdfValue, issues map[string]int, depth int) {
+	if depth > 64 {
+		return
+	}
+	switch v.Kind {
+	case pdfName:
+		if len(v.Raw) > strictMaxName {
+			issues["name longer than 127 bytes"]++
+		}
+	case pdfString, pdfHexString:
+		if len(v.Str) > strictMaxString {
+			issues["string longer than 65535 bytes"]++
+		}
+	case pdfNumber:
+		if !strings.Contains(v.Raw, ".") {
+			if n, err := strconv.ParseInt(v.Raw, 10, 64); err != nil || n > strictMaxInt || n < -strictMaxInt-1 {
+				issues["integer beyond 32 bits"]++
+			}
+		}
+	case pdfArray:
+		if len(v.Arr) > strictMaxArray {
+			issues["array over 8191 elements"]++
+		}
+		for _, item := range v.Arr {
+			valueCompatibilityIssues(item, issues, depth+1)
+		}
+	case pdfDictKind:
+		if v.Dict == nil {
+			return
+		}
+		if len(v.Dict.Keys) > strictMaxDict {
+			issues["dictionary over 4095 entries"]++
+		}
+		for _, key := range v.Dict.Keys {
+			if len(key) > strictMaxName {
+				issues["name longer than 127 bytes"]++
+			}
+			valueCompatibilityIssues(v.Dict.Vals[key], issues, depth+1)
+		}
+	}
+}
+
+// Whether a JPEG is baseline or extended sequential Huffman-coded, which
+// every DCTDecode implementation reads
+func baselineJPEG(data []byte) bool {
+	segments, _, err := ParseJPEGSegments(data)
+	if err != nil {
+		return true // not ours to judge; brokenStreams covers damage
+	}
+	for _, seg := range segments {
+		switch seg.Marker {
+		case 0xC0, 0xC1:
+			return true
+		case 0xC2, 0xC3, 0xC5, 0xC6, 0xC7, 0xC9, 0xCA, 0xCB, 0xCD, 0xCE, 0xCF:
+			return false
+		}
+	}
+	return true
+}
+
+// Spell out abbreviated filter names in stream dictionaries under strict
+// compatibility
+func (doc *pdfDocument) spellOutFilters(opts pdfOptions) bool {
+	if opts.Compatibility != pdfCompatStrict {
+		return false
+	}
+	changed := 0
+	for _, num := range doc.objectNumbers() {
+		obj := doc.Objects[num]
+		if !obj.HasStream || isLayoutObject(obj) {
+			continue
+		}
+		names, parms := streamFilters(doc, obj.Dict())
+		abbreviated := false
+		for i, name := range names {
+			if full, ok := pdfFilterAbbreviations[name]; ok {
+				names[i] = full
+				abbreviated = true
+			}
+		}
+		if abbreviated {
+			setStreamFilters(obj.Dict(), names, parms)
+			changed++
+		}
+	}
+	if changed == 0 {
+		return false
+	}
+	fmt.Printf("[WASM] Spelled out filter names in %d streams\n", changed)
+	return true
+}
+
+// Warnings for what the output keeps outside the strict profile
+func compatibilityWarnings(doc *pdfDocument) []message {
+	issues := compatibilityIssues(doc)
+	kinds := make([]string, 0, len(issues))
+	for kind := range issues {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	var warnings []message
+	for _, kind := range kinds {
+		warnings = append(warnings, newMessage("pdf.compatibility", "issue", kind, "count", issues[kind]))
+	}
+	return warnings
+}
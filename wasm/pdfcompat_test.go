@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestPDFCompatibility(t *testing.T) {
+	// The content stream's abbreviated filter is spelled out; the
+	// JPX image is outside PDF 1.3 and kept, with a warning. A
+	// level that writes an abbreviation back fails the check.
+	content := bytes.Repeat([]byte("BT /F1 12 Tf 72 712 Td (Hello, world) Tj ET\n"), 40)
+	flated := new(bytes.Buffer)
+	zw := zlib.NewWriter(flated)
+	zw.Write(content)
+	zw.Close()
+	jpx := []byte("\x00\x00\x00\x0cjP  \r\n\x87\n")
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.4\n")
+	buf.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	buf.WriteString("2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n")
+	buf.WriteString("3 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Contents 4 0 R /Resources << /XObject << /Im1 5 0 R >> >> >>\nendobj\n")
+	fmt.Fprintf(buf, "4 0 obj\n<< /Filter /Fl /Length %d >>\nstream\n", flated.Len())
+	buf.Write(flated.Bytes())
+	buf.WriteString("\nendstream\nendobj\n")
+	fmt.Fprintf(buf, "5 0 obj\n<< /Type /XObject /Subtype /Image /Width 1 /Height 1 /Filter /JPXDecode /Length %d >>\nstream\n", len(jpx))
+	buf.Write(jpx)
+	buf.WriteString("\nendstream\nendobj\n")
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	data := buf.Bytes()
+
+	doc, err := parsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issues := compatibilityIssues(doc); len(issues) != 2 || issues["abbreviated filter name"] != 1 || issues["JPXDecode filter"] != 1 {
+		t.Fatalf("issues found as %v", issues)
+	}
+	progressive := fixtureJPEG(fixtureGradient(16, 16))
+	if !baselineJPEG(progressive) {
+		t.Fatal("a baseline JPEG was judged progressive")
+	}
+	progressive = bytes.Replace(progressive, []byte{0xFF, 0xC0}, []byte{0xFF, 0xC2}, 1)
+	if baselineJPEG(progressive) {
+		t.Fatal("a progressive JPEG was judged baseline")
+	}
+
+	opts := defaultPDFOptions()
+	opts.Compatibility = pdfCompatStrict
+	res, err := runPDFFallbackChain(context.Background(), data, opts, func(int) {})
+	if err != nil || res.Level != pdfLevelFull {
+		t.Fatalf("level %s: %v %v", res.Level, err, res.Attempts)
+	}
+	if doc, err = parsePDF(res.Data); err != nil {
+		t.Fatal(err)
+	}
+	if issues := compatibilityIssues(doc); len(issues) != 1 || issues["JPXDecode filter"] != 1 {
+		t.Fatalf("output issues %v", issues)
+	}
+	if decoded, err := decodeStream(doc, doc.Objects[4]); err != nil || !bytes.Equal(decoded, content) {
+		t.Fatalf("content does not decode to its original bytes: %v", err)
+	}
+	warned := false
+	for _, w := range res.Warnings {
+		warned = warned || w.Code == "pdf.compatibility" && w.Params["issue"] == "JPXDecode filter"
+	}
+	if !warned {
+		t.Fatalf("no warning for the kept JPX image: %v", res.Warnings)
+	}
+
+	baseline := pdfBaselineOf(doc, opts)
+	doc.Objects[4].Dict().Set("Filter", pdfNameValue("Fl"))
+	broken, err := doc.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.checkBytes(broken) == nil {
+		t.Fatal("an added abbreviation passed the check")
+	}
+	if err := checkPDFCompatibility("acrobat3"); err == nil {
+		t.Fatal("an unknown mode was accepted")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "bytes"
+
+// Walk a content stream, calling fn for every operator with the operands
+// that preceded it. Inline image data (BI ... ID ... EI) is skipped and
+// reported as a single "BI" operator. fn returns false to stop early.
+func scanContentOps(data []byte, fn func(op string, operands []pdfValue) bool) {
+	scanContentOpsAt(data, func(op string, operands []pdfValue, _, _ int) bool {
+		return fn(op, operands)
+	})
+}
+
+// scanContentOps, also passing where the operation starts (its first
+// operand) and ends (just after the operator) in data
+func scanContentOpsAt(data []byte, fn func(op string, operands []pdfValue, start, end int) bool) {
+	l := &pdfLexer{data: data}
+	var operands []pdfValue
+	opStart := -1
+	for {
+		l.skipSpace()
+		if l.pos >= len(data) {
+			return
+		}
+
+		c := data[l.pos]
+		if opStart < 0 {
+			opStart = l.pos
+		}
+		if isPDFRegular(c) && !isDigit(c) && c != '+' && c != '-' && c != '.' {
+			start := l.pos
+			tok := l.readRegular()
+			switch tok {
+			case "true", "false", "null":
+				l.pos = start
+				v, _ := l.parseValue(0)
+				operands = append(operands, v)
+				continue
+			case "BI":
+				l.pos = skipInlineImage(data, l.pos)
+			}
+			if !fn(tok, operands, opStart, l.pos) {
+				return
+			}
+			operands = operands[:0]
+			opStart = -1
+			continue
+		}
+
+		start := l.pos
+		v, err := l.parseValue(0)
+		if err != nil {
+			// Unbalanced delimiters: drop the pending operands and move on
+			if l.pos == start {
+				l.pos++
+			}
+			operands = operands[:0]
+			opStart = -1
+			continue
+		}
+		operands = append(operands, v)
+	}
+}
+
+// Position just after the EI that ends the inline image starting at pos
+func skipInlineImage(data []byte, pos int) int {
+	id := bytes.Index(data[pos:], []byte("ID"))
+	if id < 0 {
+		return len(data)
+	}
+	p := pos + id + 2
+	for {
+		ei := bytes.Index(data[p:], []byte("EI"))
+		if ei < 0 {
+			return len(data)
+		}
+		p += ei
+		before := p > 0 && isPDFWhitespace(data[p-1])
+		after := p+2 >= len(data) || isPDFWhitespace(data[p+2])
+		p += 2
+		if before && after {
+			return p
+		}
+	}
+}
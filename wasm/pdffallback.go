@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PDF fallback levels, from most to least aggressive. Each level's output
+// is re-parsed and checked before it is accepted; on failure the chain
+// moves on to the next level.
+const (
+	pdfLevelFull        = "full"        // shared images, images, fonts, streams and metadata, then a clean rewrite
+	pdfLevelStreams     = "streams"     // embedded images and lossless stream recoding only
+	pdfLevelMetadata    = "metadata"    // metadata strip only
+	pdfLevelPassthrough = "passthrough" // original bytes
+)
+
+// Size thresholds for the PDF passes
+type pdfOptions struct {
+	// Embedded JPEG/PNG streams at or below this size are left alone
+	MinEmbeddedImageBytes int `json:"minEmbeddedImageBytes"`
+
+	// Re-encode embedded JPEGs at this quality (1-100) when that is
+	// smaller; 0 keeps their data. Only gray and RGB images are
+	// re-encoded; CMYK and other color spaces are kept as they are.
+	ImageQuality int `json:"imageQuality"`
+
+	// Downsample re-encoded JPEGs whose longer side exceeds this many
+	// pixels, soft masks included; 0 keeps their size
+	MaxImageDimension int `json:"maxImageDimension"`
+
+	// Downsample re-encoded JPEGs drawn at more than this many pixels per
+	// inch on every page that shows them; 0 keeps their resolution
+	MaxImageDPI int `json:"maxImageDPI"`
+
+	// Stop recompressing once more than half of the document's stream
+	// bytes have been through the image and stream passes with under 1%
+	// saved: the rest of those passes and the font passes are skipped,
+	// and so is that work in later fallback levels. The metadata and
+	// compatibility passes still run.
+	EarlyAbort bool `json:"earlyAbort"`
+
+	// Keep an image's bytes when its re-encode falls below this peak
+	// signal-to-noise ratio (dB) against the pixels it was made from;
+	// 0 accepts any loss
+	MinImagePSNR float64 `json:"minImagePSNR"`
+
+	// Image objects larger than this are dropped by aggressivePdfCompression.
+	// The fallback chain never runs that pass, so this only matters to
+	// callers that do.
+	MaxObjectRemovalBytes int `json:"maxObjectRemovalBytes"`
+
+	// Document information keys removed by the metadata pass, and keys
+	// kept even when listed there (e.g. Title for DMS ingestion). Names
+	// may be given with or without the leading slash; "*" removes every
+	// key.
+	StripMetadata []string `json:"stripMetadata"`
+	KeepMetadata  []string `json:"keepMetadata"`
+
+	// XMP handling ("keep", "minimize" or "strip") for /Metadata streams
+	// and the packets inside embedded images
+	XMP string `json:"xmp"`
+
+	// Also return a human-readable account of what was removed and
+	// changed: "markdown", "html" or "" for none
+	Report string `json:"report"`
+
+	// Remove bookmarks, internal links and named destinations, for the
+	// smallest output; otherwise they are kept and checked
+	DropNavigation bool `json:"dropNavigation"`
+
+	// Empty the glyphs embedded TrueType CID fonts have that no page
+	// shows
+	SubsetFonts bool `json:"subsetFonts"`
+
+	// Pack objects into object streams behind a cross-reference stream,
+	// which needs a PDF 1.5 reader
+	ObjectStreams bool `json:"objectStreams"`
+
+	// Fill in the web-optimized preset (see pdfweb.go) for whatever the
+	// options above leave unset. It does not linearize, and its font
+	// subsetting only covers TrueType CID fonts
+	WebOptimized bool `json:"webOptimized"`
+
+	// Remove optional content groups (layers) hidden in every
+	// configuration, cutting their content from the pages
+	FlattenHiddenLayers bool `json:"flattenHiddenLayers"`
+
+	// "strict" keeps the output to constructs older viewers open and
+	// reports what the input has beyond them; "" for no such check
+	Compatibility string `json:"compatibility"`
+
+	// Keep tagged PDFs accessible: options that would degrade the
+	// structure tree are limited, and outputs that lose tagging are
+	// rejected
+	PreserveTags bool `json:"preserveTags"`
+
+	// Only process objects used by these pages ("1-10,15"); the rest of
+	// the document keeps its bytes. Empty for every page.
+	Pages string `json:"pages"`
+
+	// Keep a rewritten document even when it saves little, because a
+	// policy requires its metadata gone; not settable from JS
+	keepStripped bool
+
+	// Objects the per-object passes may change, from Pages; nil for all
+	scope map[int]bool
+
+	// PreserveTags on a tagged input
+	keepTags bool
+
+	// Where images are drawn, for MaxImageDPI; set by the image pass
+	placements map[int]imagePlacement
+
+	// Page-keyed progress: reportPage is the caller's, taking the overall
+	// percentage with the page count; onPage is what the image pass calls
+	// after each page, set per level by the fallback chain
+	reportPage func(percent, page, pages int)
+	onPage     func(page, pages int)
+
+	// Yield of the recompressing passes under EarlyAbort, shared by every
+	// level of the fallback chain; nil without it
+	yield *yieldTracker
+}
+
+// Whether the per-object passes may change object num
+func (o pdfOptions) inScope(num int) bool {
+	return o.scope == nil || o.scope[num]
+}
+
+// Report that the objects of page (1-based) out of pages are done
+func (o pdfOptions) pageDone(page, pages int) {
+	if o.onPage != nil {
+		o.onPage(page, pages)
+	}
+}
+
+func defaultPDFOptions() pdfOptions {
+	return pdfOptions{
+		MinEmbeddedImageBytes: 1000,
+		MaxObjectRemovalBytes: 100000,
+		MinImagePSNR:          25,
+		XMP:                   xmpKeep,
+		StripMetadata: []string{
+			"Creator", "Producer", "CreationDate", "ModDate",
+			"Title", "Author", "Subject", "Keywords",
+		},
+	}
+}
+
+func (o pdfOptions) validate() error {
+	if o.MinEmbeddedImageBytes < 0 {
+		return errors.New("minEmbeddedImageBytes must not be negative")
+	}
+	if o.ImageQuality < 0 || o.ImageQuality > 100 {
+		return errors.New("imageQuality must be between 0 and 100")
+	}
+	if o.MaxImageDimension < 0 {
+		return errors.New("maxImageDimension must not be negative")
+	}
+	if o.MaxImageDPI < 0 {
+		return errors.New("maxImageDPI must not be negative")
+	}
+	if o.ObjectStreams && o.Compatibility == pdfCompatStrict {
+		return errors.New("objectStreams is outside the strict compatibility profile")
+	}
+	if o.MinImagePSNR < 0 {
+		return errors.New("minImagePSNR must not be negative")
+	}
+	if o.MaxObjectRemovalBytes < 0 {
+		return errors.New("maxObjectRemovalBytes must not be negative")
+	}
+	if err := checkXMPMode(o.XMP); err != nil {
+		return err
+	}
+	if err := checkPDFReportFormat(o.Report); err != nil {
+		return err
+	}
+	if err := checkPDFCompatibility(o.Compatibility); err != nil {
+		return err
+	}
+	if o.Pages != "" {
+		if _, err := parsePageRanges(o.Pages); err != nil {
+			return err
+		}
+	}
+	for _, keys := range [][]string{o.StripMetadata, o.KeepMetadata} {
+		for _, key := range keys {
+			if strings.TrimPrefix(key, "/") == "" {
+				return errors.New("metadata keys must not be empty")
+			}
+		}
+	}
+	return nil
+}
+
+// One level tried by the fallback chain
+type pdfAttempt struct {
+	Level string `json:"level"`
+	Size  int    `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Outcome of compressPDFData: the output and the level that produced it
+type pdfResult struct {
+	Data     []byte
+	Level    string
+	Attempts []pdfAttempt
+	Warnings []message
+
+	// The parsed input and the document Data was written from, for
+	// reports, page stats, policy and provenance; nil when the input did
+	// not parse. Output is Original when Data is the input.
+	Original *pdfDocument
+	Output   *pdfDocument
+}
+
+// A level's passes, applied in order to one parsed document before it is
+// rewritten. The rewrite itself normalizes whitespace between objects, so
+// optimizeStreams (which also rewrote bytes inside binary streams) is no
+// longer used.
+type pdfLevel struct {
+	name   string
+	passes []pdfPass
+}
+
+// A pass edits doc in place and reports whether it changed anything.
+// Streams it leaves alone keep aliasing the input, so a level holds the
+// input, the objects and only the streams its passes replaced, however
+// many passes it has.
+type pdfPass func(doc *pdfDocument, opts pdfOptions) bool
+
+var pdfLevels = []pdfLevel{
+	{pdfLevelFull, []pdfPass{(*pdfDocument).dropNavigation, (*pdfDocument).flattenHiddenLayers, (*pdfDocument).shareRepeatedImages, (*pdfDocument).compressEmbeddedImages, (*pdfDocument).subsetFonts, (*pdfDocument).mergeFonts, (*pdfDocument).recodeStreams, (*pdfDocument).removeMetadata, (*pdfDocument).reduceXMPMetadata, (*pdfDocument).spellOutFilters}},
+	{pdfLevelStreams, []pdfPass{(*pdfDocument).compressEmbeddedImages, (*pdfDocument).recodeStreams, (*pdfDocument).spellOutFilters}},
+	{pdfLevelMetadata, []pdfPass{(*pdfDocument).removeMetadata, (*pdfDocument).reduceXMPMetadata, (*pdfDocument).spellOutFilters}},
+}
+
+// Run a level's passes on a copy of the parsed input and rewrite the
+// result so object offsets and stream lengths match. Panics inside the
+// passes fail only this level.
+func runPDFLevel(level pdfLevel, original *pdfDocument, opts pdfOptions) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	doc := original.clone()
+	for _, pass := range level.passes {
+		pass(doc, opts)
+	}
+	if opts.ObjectStreams {
+		return doc.serializeCompact()
+	}
+	return doc.serialize()
+}
+
+// Number of Flate streams that no longer decode
+func brokenStreams(doc *pdfDocument) int {
+	broken := 0
+	for _, obj := range doc.Objects {
+		if !obj.HasStream || obj.InObjStm {
+			continue
+		}
+		if _, err := decodeStream(doc, obj); err != nil && !errors.Is(err, errUnsupportedFilter) {
+			broken++
+		}
+	}
+	return broken
+}
+
+// What each level's output is checked against, taken from the input
+type pdfBaseline struct {
+	pages         int
+	brokenStreams int
+	brokenDests   int
+	dropsDests    bool // dropNavigation may remove every destination
+	brokenLayers  int
+	text          []pdfPageText  // shown text by page
+	skipHidden    bool           // hidden layers may be cut; leave them out of text
+	tags          *pdfTagging    // nil unless tagging must survive
+	compat        map[string]int // strict profile issues; nil unless strict
+}
+
+func pdfBaselineOf(doc *pdfDocument, opts pdfOptions) pdfBaseline {
+	b := pdfBaseline{
+		pages:         len(doc.pages()),
+		brokenStreams: brokenStreams(doc),
+		brokenDests:   brokenDestinations(doc),
+		dropsDests:    opts.DropNavigation,
+		brokenLayers:  brokenLayerRefs(doc),
+		skipHidden:    opts.FlattenHiddenLayers && !opts.keepTags,
+	}
+	b.text = pdfText(doc, b.skipHidden)
+	if opts.keepTags {
+		tags := findTagging(doc)
+		b.tags = &tags
+	}
+	if opts.Compatibility == pdfCompatStrict {
+		b.compat = compatibilityIssues(doc)
+	}
+	return b
+}
+
+// Check parsed output against the baseline: validatePDF, the same text on
+// every page, and no bookmark, link, named destination or layer reference
+// broken that was not already
+func (b pdfBaseline) check(doc *pdfDocument) error {
+	if err := validatePDF(doc, b.pages, b.brokenStreams); err != nil {
+		return err
+	}
+	if broken := brokenDestinations(doc); broken > b.brokenDests && !b.dropsDests {
+		return fmt.Errorf("%d bookmarks, links or named destinations no longer lead to a page", broken-b.brokenDests)
+	}
+	if broken := brokenLayerRefs(doc); broken > b.brokenLayers {
+		return fmt.Errorf("%d optional content references no longer lead to a layer", broken-b.brokenLayers)
+	}
+	if err := compareText(b.text, pdfText(doc, b.skipHidden)); err != nil {
+		return err
+	}
+	if b.tags != nil {
+		if tags := findTagging(doc); tags != *b.tags {
+			return fmt.Errorf("tagging changed: %d structure nodes and %d marked-content sequences, expected %d and %d",
+				tags.Nodes, tags.MarkedContent, b.tags.Nodes, b.tags.MarkedContent)
+		}
+	}
+	if b.compat != nil {
+		for kind, n := range compatibilityIssues(doc) {
+			if n > b.compat[kind] {
+				return fmt.Errorf("output adds %d of %s, outside the strict compatibility profile", n-b.compat[kind], kind)
+			}
+		}
+	}
+	return nil
+}
+
+// check for output that has not been parsed yet
+func (b pdfBaseline) checkBytes(data []byte) error {
+	doc, err := parseOutputPDF(data)
+	if err != nil {
+		return err
+	}
+	return b.check(doc)
+}
+
+// Parse a level's output, the one parse each output gets
+func parseOutputPDF(data []byte) (*pdfDocument, error) {
+	doc, err := ParsePDF(data)
+	if err != nil {
+		return nil, fmt.Errorf("output does not parse: %v", err)
+	}
+	return doc, nil
+}
+
+// Check that parsed output was read cleanly, still has every page and has
+// not damaged any stream that decoded in the original
+func validatePDF(doc *pdfDocument, expectedPages, expectedBroken int) error {
+	if doc.LengthMismatches > 0 {
+		return fmt.Errorf("output has %d streams with a wrong /Length", doc.LengthMismatches)
+	}
+	if doc.catalog() == nil {
+		return errors.New("output has no document catalog")
+	}
+	if pages := len(doc.pages()); pages != expectedPages {
+		return fmt.Errorf("output has %d pages, expected %d", pages, expectedPages)
+	}
+	if broken := brokenStreams(doc); broken > expectedBroken {
+		return fmt.Errorf("%d streams no longer decode", broken-expectedBroken)
+	}
+	return nil
+}
+
+// Bytes of the streams the per-object passes may change, what
+// pdfOptions.EarlyAbort measures its yield against
+func streamBytes(doc *pdfDocument, opts pdfOptions) int {
+	total := 0
+	for num, obj := range doc.Objects {
+		if obj.HasStream && opts.inScope(num) {
+			total += len(obj.Stream)
+		}
+	}
+	return total
+}
+
+// Walk the fallback chain until a level produces a valid document. The
+// input is parsed once and every level works on a copy of it; each
+// level's output is parsed once to check it and handed on in the result.
+func runPDFFallbackChain(ctx context.Context, inputBytes []byte, opts pdfOptions, reportProgress func(int)) (pdfResult, error) {
+	res := pdfResult{Data: inputBytes, Level: pdfLevelPassthrough}
+	opts = opts.withPreset()
+
+	original, err := ParsePDF(inputBytes)
+	if err != nil {
+		res.Warnings = append(res.Warnings, newMessage("pdf.unparsable", "error", err))
+		return res, nil
+	}
+	res.Original, res.Output = original, original
+	if original.Encrypted {
+		res.Warnings = append(res.Warnings, newMessage("pdf.encrypted"))
+		return res, nil
+	}
+	conflicts := taggingConflicts(original, opts)
+	for _, option := range conflicts {
+		code := "pdf.tagsDegraded"
+		if opts.PreserveTags {
+			code = "pdf.tagsKept"
+		}
+		res.Warnings = append(res.Warnings, newMessage(code, "option", option))
+	}
+	if opts.PreserveTags && findTagging(original).Tagged {
+		opts.keepTags = true
+		for _, option := range conflicts {
+			if option == "stripMetadata" {
+				// Viewers are asked to show the title instead of the file name
+				opts.KeepMetadata = append(append([]string{}, opts.KeepMetadata...), "Title")
+			}
+		}
+	}
+	baseline := pdfBaselineOf(original, opts)
+	if opts.Pages != "" {
+		if opts.scope, err = pageScope(original, opts.Pages); err != nil {
+			return res, err
+		}
+		fmt.Printf("[WASM] Pages %s: %d objects in scope\n", opts.Pages, len(opts.scope))
+	}
+
+	if opts.EarlyAbort && opts.yield == nil {
+		opts.yield = newYieldTracker(streamBytes(original, opts))
+	}
+
+	for i, level := range pdfLevels {
+		if err := checkCancelled(ctx); err != nil {
+			return res, err
+		}
+
+		attempt := pdfAttempt{Level: level.name}
+		levelStart := time.Now()
+		levelOpts := opts
+		low, high := 20+i*70/len(pdfLevels), 20+(i+1)*70/len(pdfLevels)
+		levelOpts.onPage = func(page, pages int) {
+			p := low + (high-low)*page/pages
+			if opts.reportPage != nil {
+				opts.reportPage(p, page, pages)
+			} else {
+				reportProgress(p)
+			}
+		}
+		out, err := runPDFLevel(level, original, levelOpts)
+		var outDoc *pdfDocument
+		if err == nil {
+			outDoc, err = parseOutputPDF(out)
+		}
+		if err == nil {
+			err = baseline.check(outDoc)
+		}
+		reportProgress(high)
+
+		if err != nil {
+			attempt.Error = err.Error()
+			res.Attempts = append(res.Attempts, attempt)
+			var changed *textChangedError
+			if errors.As(err, &changed) {
+				res.Warnings = append(res.Warnings, newMessage("pdf.textChanged", "level", level.name, "page", changed.Page))
+			}
+			fmt.Printf("[WASM] PDF level %s failed: %v\n", level.name, err)
+			trace(ctx, "pdf.fallback", "levelFailed", "level", level.name, "error", err, "ms", msSince(levelStart))
+			continue
+		}
+
+		attempt.Size = len(out)
+		res.Attempts = append(res.Attempts, attempt)
+		res.Data = out
+		res.Output = outDoc
+		res.Level = level.name
+		if y := opts.yield; y != nil && y.abortedAt > 0 {
+			res.Warnings = append(res.Warnings, newMessage("pdf.earlyAbort", "percent", percentParam(y.abortedAt)))
+		}
+		if opts.Compatibility == pdfCompatStrict {
+			res.Warnings = append(res.Warnings, compatibilityWarnings(outDoc)...)
+		}
+		fmt.Printf("[WASM] PDF level %s succeeded: %d bytes\n", level.name, len(out))
+		trace(ctx, "pdf.fallback", "levelSucceeded", "level", level.name, "size", len(out), "ms", msSince(levelStart))
+		return res, nil
+	}
+
+	res.Warnings = append(res.Warnings, newMessage("pdf.allLevelsFailed"))
+	if opts.Compatibility == pdfCompatStrict {
+		res.Warnings = append(res.Warnings, compatibilityWarnings(original)...)
+	}
+	return res, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// One page with a content stream and a document info dictionary
+func fixtureInfoPDF() []byte {
+	return []byte("%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n" +
+		"3 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 10 10] /Contents 4 0 R >>\nendobj\n" +
+		"4 0 obj\n<< /Length 3 >>\nstream\nq Q\nendstream\nendobj\n" +
+		"5 0 obj\n<< /Producer (Scanner) >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R /Info 5 0 R >>\n%%EOF\n")
+}
+
+// Run a single pass on data: parse, edit and rewrite it. data comes back
+// as it was when the pass changes nothing.
+func applyPDFPass(t *testing.T, pass pdfPass, data []byte, opts pdfOptions) []byte {
+	t.Helper()
+	doc, err := ParsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pass(doc, opts) {
+		return data
+	}
+	out, err := doc.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestFallbackChainHandsOnParsedDocuments(t *testing.T) {
+	data := fixtureInfoPDF()
+	res, err := runPDFFallbackChain(context.Background(), data, defaultPDFOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Level != pdfLevelFull || res.Original == nil || res.Output == nil {
+		t.Fatalf("level %s, original %v, output %v", res.Level, res.Original != nil, res.Output != nil)
+	}
+	if !bytes.Equal(res.Output.Data, res.Data) {
+		t.Error("the output document was not parsed from the output")
+	}
+	// Levels edit copies: the parsed input still has what they removed
+	if _, ok := pdfInfo(res.Original).Get("Producer"); !ok {
+		t.Error("a level edited the parsed input")
+	}
+	if _, ok := pdfInfo(res.Output).Get("Producer"); ok {
+		t.Error("the output kept the producer")
+	}
+	if a := collectPDFActions(data, res); len(a.MetadataRemoved) != 1 {
+		t.Errorf("report removed %v, want the producer", a.MetadataRemoved)
+	}
+	if stats := pageStats(res); len(stats) != 1 {
+		t.Errorf("%d page stats, want 1", len(stats))
+	}
+}
+
+func TestApplyPDFKeepsOutputInStep(t *testing.T) {
+	data := fixtureInfoPDF()
+	res, err := runPDFFallbackChain(context.Background(), data, defaultPDFOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	untagged := res.Output
+	if warnings := (provenanceOptions{Provenance: true}).applyPDF(data, &res); len(warnings) != 0 {
+		t.Fatal(messageTexts(warnings))
+	}
+	if _, ok := untagged.catalog().Get("Metadata"); ok {
+		t.Error("provenance edited the chain's output document")
+	}
+	if _, ok := res.Output.catalog().Get("Metadata"); !ok || !bytes.Equal(res.Output.Data, res.Data) {
+		t.Error("the output document does not match the tagged output")
+	}
+	doc, err := ParsePDF(res.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validatePDF(doc, 1, 0); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Contains(res.Data, []byte("urn:filezap:provenance")) {
+		t.Error("no provenance record in the output")
+	}
+}
+
+func TestPDFSharedDocument(t *testing.T) {
+	// A level's passes share one parse: a stream none of them
+	// touches still points into the input afterwards
+	data := []byte("%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n" +
+		"3 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 10 10] /Contents 4 0 R >>\nendobj\n" +
+		"4 0 obj\n<< /Length 3 >>\nstream\nq Q\nendstream\nendobj\n" +
+		"5 0 obj\n<< /Producer (Scanner) >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R /Info 5 0 R >>\n%%EOF\n")
+	doc, err := ParsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultPDFOptions()
+	changed := false
+	for _, pass := range pdfLevels[len(pdfLevels)-1].passes {
+		changed = pass(doc, opts) || changed
+	}
+	stream := doc.Objects[4].Stream
+	if !changed || &stream[0] != &data[bytes.Index(data, []byte("q Q"))] {
+		t.Fatalf("changed %v, content stream copied", changed)
+	}
+	if doc, err = ParsePDF(data); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runPDFLevel(pdfLevels[len(pdfLevels)-1], doc, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("Scanner")) || !bytes.Contains(out, []byte("stream\nq Q\nendstream")) {
+		t.Fatalf("level output:\n%s", out)
+	}
+}
+
+func TestPDFEarlyAbort(t *testing.T) {
+	// Four JPEGs with nothing to strip: three are tried, the fourth
+	// is left alone. A first one that sheds a large EXIF block keeps
+	// the pass going.
+	img := fixtureGradient(64, 64)
+	plain := fixtureJPEG(img)
+	dict := "/Type /XObject /Subtype /Image /Width 64 /Height 64 /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode"
+	dicts := []string{dict, dict, dict, dict}
+	data := fixtureStreamPDF(dicts, [][]byte{plain, plain, plain, plain})
+	opts := defaultPDFOptions()
+	opts.EarlyAbort = true
+	opts.yield = newYieldTracker(4 * len(plain))
+	applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, opts)
+	if opts.yield.processed != 3*len(plain) || opts.yield.abortedAt != 0.75 {
+		t.Fatalf("stopped after %d of %d bytes", opts.yield.processed, 4*len(plain))
+	}
+
+	data = fixtureStreamPDF(dicts, [][]byte{fixtureJPEGWithEXIF(img, 20000), plain, plain, plain})
+	opts.yield = newYieldTracker(len(data))
+	out := applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, opts)
+	if opts.yield.abortedAt != 0 || len(out) >= len(data) {
+		t.Fatalf("a paying pass stopped after %d bytes", opts.yield.processed)
+	}
+	if lowYield(60, 0, 100) != true || lowYield(50, 0, 100) || lowYield(60, 1, 100) {
+		t.Fatal("lowYield thresholds are off")
+	}
+	var y *yieldTracker
+	if y.add(10, 0); y.low() {
+		t.Fatal("a nil tracker stopped")
+	}
+}
+
+func TestPDFEarlyAbortRandomStreams(t *testing.T) {
+	// Eight unfiltered streams of random bytes: deflate saves nothing on
+	// them, so the stream pass tries five and keeps the rest as they are
+	rng := rand.New(rand.NewSource(1))
+	var dicts []string
+	var streams [][]byte
+	for i := 0; i < 8; i++ {
+		stream := make([]byte, 4096)
+		rng.Read(stream)
+		dicts = append(dicts, "/Type /XObject /Subtype /Form")
+		streams = append(streams, stream)
+	}
+	data := fixtureStreamPDF(dicts, streams)
+	doc, err := ParsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := defaultPDFOptions()
+	opts.EarlyAbort = true
+	opts.yield = newYieldTracker(streamBytes(doc, opts))
+	res, err := runPDFFallbackChain(context.Background(), data, opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tried := opts.yield.processed / 4096; tried != 5 {
+		t.Errorf("stream pass tried %d of 8 streams", tried)
+	}
+	if !hasMessage(res.Warnings, "pdf.earlyAbort") {
+		t.Errorf("no early abort warning: %v", messageTexts(res.Warnings))
+	}
+
+	// Without it every stream is tried
+	opts.EarlyAbort = false
+	opts.yield = nil
+	res, err = runPDFFallbackChain(context.Background(), data, opts, func(int) {})
+	if err != nil || hasMessage(res.Warnings, "pdf.earlyAbort") {
+		t.Fatalf("%v, %v", err, messageTexts(res.Warnings))
+	}
+}
+
+func TestFallbackChainFallsBackPastFailingLevels(t *testing.T) {
+	levels := pdfLevels
+	defer func() { pdfLevels = levels }()
+	panics := func(*pdfDocument, pdfOptions) bool { panic("pass bug") }
+	dropsPage := func(doc *pdfDocument, _ pdfOptions) bool {
+		pages := doc.resolveDict(doc.Objects[2].Value)
+		kids, _ := pages.Get("Kids")
+		kids.Arr = kids.Arr[1:]
+		pages.Set("Kids", kids)
+		return true
+	}
+	pdfLevels = []pdfLevel{
+		{pdfLevelFull, []pdfPass{panics}},
+		{pdfLevelStreams, []pdfPass{dropsPage}},
+		{pdfLevelMetadata, []pdfPass{(*pdfDocument).recodeStreams}},
+	}
+
+	data := fixtureThreePagePDF(fixturePageStreams())
+	res, err := runPDFFallbackChain(context.Background(), data, defaultPDFOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Level != pdfLevelMetadata || len(res.Attempts) != 3 {
+		t.Fatalf("level %s after %+v", res.Level, res.Attempts)
+	}
+	if a := res.Attempts[0]; a.Error != "panic: pass bug" {
+		t.Errorf("full level failed with %q", a.Error)
+	}
+	if a := res.Attempts[1]; !strings.Contains(a.Error, "2 pages, expected 3") {
+		t.Errorf("streams level failed with %q", a.Error)
+	}
+	if a := res.Attempts[2]; a.Error != "" || a.Size != len(res.Data) {
+		t.Errorf("metadata level recorded %+v", a)
+	}
+	if len(res.Output.pages()) != 3 {
+		t.Errorf("output has %d pages", len(res.Output.pages()))
+	}
+
+	// With every level failing the input comes back as it was
+	pdfLevels = pdfLevels[:2]
+	res, err = runPDFFallbackChain(context.Background(), data, defaultPDFOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Level != pdfLevelPassthrough || !bytes.Equal(res.Data, data) || res.Output != res.Original {
+		t.Errorf("level %s, %d bytes", res.Level, len(res.Data))
+	}
+	if len(res.Warnings) == 0 || res.Warnings[len(res.Warnings)-1].Code != "pdf.allLevelsFailed" {
+		t.Errorf("warnings %v", res.Warnings)
+	}
+}
+
+func TestFallbackChainPassesThroughUnparsableInput(t *testing.T) {
+	data := []byte("%PDF-1.4 garbage")
+	res, err := compressPDFData(context.Background(), data, defaultPDFOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Level != pdfLevelPassthrough || !bytes.Equal(res.Data, data) || res.Original != nil {
+		t.Errorf("level %s, %d bytes", res.Level, len(res.Data))
+	}
+	if len(res.Warnings) != 1 || res.Warnings[0].Code != "pdf.unparsable" {
+		t.Errorf("warnings %v", res.Warnings)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/lzw"
+	"compress/zlib"
+	"encoding/ascii85"
+	"errors"
+	"fmt"
+	"io"
+
+	tifflzw "golang.org/x/image/tiff/lzw"
+)
+
+// Returned for filters the module cannot decode (image codecs, crypt)
+var errUnsupportedFilter = errors.New("unsupported stream filter")
+
+// Filter names and their decode parameters, normalized to parallel slices
+func streamFilters(doc *pdfDocument, dict *pdfDict) ([]string, []*pdfDict) {
+	var names []string
+	var parms []*pdfDict
+
+	filter, _ := dict.Get("Filter")
+	filter = doc.resolve(filter)
+	switch filter.Kind {
+	case pdfName:
+		names = []string{filter.Raw}
+	case pdfArray:
+		for _, f := range filter.Arr {
+			if f = doc.resolve(f); f.Kind == pdfName {
+				names = append(names, f.Raw)
+			}
+		}
+	}
+
+	dp, _ := dict.Get("DecodeParms")
+	dp = doc.resolve(dp)
+	for i := range names {
+		var p *pdfDict
+		switch dp.Kind {
+		case pdfDictKind:
+			if i == 0 {
+				p = dp.Dict
+			}
+		case pdfArray:
+			if i < len(dp.Arr) {
+				p = doc.resolveDict(dp.Arr[i])
+			}
+		}
+		parms = append(parms, p)
+	}
+	return names, parms
+}
+
+// Decode a stream through its whole filter chain. Truncated Flate data
+// returns what could be recovered together with the error.
+func decodeStream(doc *pdfDocument, obj *pdfObject) ([]byte, error) {
+	if !obj.HasStream {
+		return nil, errors.New("object has no stream")
+	}
+	names, parms := streamFilters(doc, obj.Dict())
+	data := obj.Stream
+	for i, name := range names {
+		var err error
+		data, err = applyDecodeFilter(name, parms[i], data)
+		if err != nil {
+			return data, err
+		}
+	}
+	return data, nil
+}
+
+// Decode data through a single named filter
+func applyDecodeFilter(name string, parms *pdfDict, data []byte) ([]byte, error) {
+	switch name {
+	case "FlateDecode", "Fl":
+		out, err := inflate(data)
+		if err != nil && len(out) == 0 {
+			return nil, err
+		}
+		out, perr := undoPredictor(out, parms)
+		if perr != nil {
+			return out, perr
+		}
+		return out, err
+	case "LZWDecode", "LZW":
+		out, err := lzwDecode(data, parms)
+		if err != nil && len(out) == 0 {
+			return nil, err
+		}
+		out, perr := undoPredictor(out, parms)
+		if perr != nil {
+			return out, perr
+		}
+		return out, err
+	case "ASCIIHexDecode", "AHx":
+		return decodeASCIIHex(data)
+	case "ASCII85Decode", "A85":
+		return decodeASCII85(data)
+	case "RunLengthDecode", "RL":
+		return decodeRunLength(data)
+	}
+	return nil, fmt.Errorf("%w: %s", errUnsupportedFilter, name)
+}
+
+// LZW codes, before any predictor. With /EarlyChange 1, the default, code
+// widths grow one code early as in TIFF; with 0 they grow as in GIF.
+// Truncated data returns what could be recovered together with the error.
+func lzwDecode(data []byte, parms *pdfDict) ([]byte, error) {
+	earlyChange := 1
+	if parms != nil {
+		if v, ok := parms.Get("EarlyChange"); ok {
+			if n, ok := v.Int(); ok {
+				earlyChange = n
+			}
+		}
+	}
+	var r io.ReadCloser
+	if earlyChange == 0 {
+		r = lzw.NewReader(bytes.NewReader(data), lzw.MSB, 8)
+	} else {
+		r = tifflzw.NewReader(bytes.NewReader(data), tifflzw.MSB, 8)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return out, fmt.Errorf("LZWDecode: %v", err)
+	}
+	return out, nil
+}
+
+// Hex digit pairs up to the '>' marker, whitespace ignored; a final odd
+// digit is followed by an implied 0
+func decodeASCIIHex(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data)/2)
+	high := -1
+	for _, c := range data {
+		if c == '>' {
+			break
+		}
+		if isPDFWhitespace(c) {
+			continue
+		}
+		n := hexNibble(c)
+		if n < 0 {
+			return out, fmt.Errorf("ASCIIHexDecode: invalid character %q", c)
+		}
+		if high < 0 {
+			high = n
+		} else {
+			out = append(out, byte(high<<4|n))
+			high = -1
+		}
+	}
+	if high >= 0 {
+		out = append(out, byte(high<<4))
+	}
+	return out, nil
+}
+
+// Base-85 groups up to the "~>" marker; a leading "<~" is tolerated
+func decodeASCII85(data []byte) ([]byte, error) {
+	if end := bytes.Index(data, []byte("~>")); end >= 0 {
+		data = data[:end]
+	}
+	data = bytes.TrimPrefix(bytes.TrimLeft(data, " \t\r\n\f\x00"), []byte("<~"))
+	out := make([]byte, 4*len(data)) // "z" alone stands for four bytes
+	n, _, err := ascii85.Decode(out, data, true)
+	if err != nil {
+		return out[:n], fmt.Errorf("ASCII85Decode: %v", err)
+	}
+	return out[:n], nil
+}
+
+// Literal and repeated runs up to the 128 end marker, which some writers
+// leave out. A length byte n below 128 copies the next n+1 bytes; above
+// 128 it repeats the next byte 257-n times.
+func decodeRunLength(data []byte) ([]byte, error) {
+	out := make([]byte, 0, 2*len(data))
+	for i := 0; i < len(data); {
+		n := int(data[i])
+		i++
+		switch {
+		case n == 128:
+			return out, nil
+		case n < 128:
+			if i+n+1 > len(data) {
+				return append(out, data[i:]...), errors.New("RunLengthDecode: truncated literal run")
+			}
+			out = append(out, data[i:i+n+1]...)
+			i += n + 1
+		default:
+			if i >= len(data) {
+				return out, errors.New("RunLengthDecode: truncated repeat run")
+			}
+			out = append(out, bytes.Repeat(data[i:i+1], 257-n)...)
+			i++
+		}
+	}
+	return out, nil
+}
+
+// Inflate zlib data, falling back to a raw deflate stream for writers that
+// omit the zlib header
+func inflate(data []byte) ([]byte, error) {
+	var r io.Reader
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err == nil {
+		r = zr
+	} else {
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return out, fmt.Errorf("inflate: %v", err)
+	}
+	return out, nil
+}
+
+// Reverse PNG (10-15) or TIFF (2) predictors from /DecodeParms
+func undoPredictor(data []byte, parms *pdfDict) ([]byte, error) {
+	if parms == nil {
+		return data, nil
+	}
+	intParam := func(key string, def int) int {
+		if v, ok := parms.Get(key); ok {
+			if n, ok := v.Int(); ok {
+				return n
+			}
+		}
+		return def
+	}
+
+	predictor := intParam("Predictor", 1)
+	if predictor == 1 {
+		return data, nil
+	}
+	colors := intParam("Colors", 1)
+	bpc := intParam("BitsPerComponent", 8)
+	columns := intParam("Columns", 1)
+	if colors < 1 || bpc < 1 || columns < 1 {
+		return data, errors.New("invalid predictor parameters")
+	}
+	bpp := (colors*bpc + 7) / 8
+	rowLen := (colors*bpc*columns + 7) / 8
+
+	if predictor == 2 {
+		if bpc != 8 {
+			return data, errors.New("TIFF predictor only supported for 8-bit samples")
+		}
+		out := append([]byte(nil), data...)
+		for row := 0; row+rowLen <= len(out); row += rowLen {
+			for i := bpp; i < rowLen; i++ {
+				out[row+i] += out[row+i-bpp]
+			}
+		}
+		return out, nil
+	}
+
+	// PNG predictors: every row starts with its own filter type byte
+	out := make([]byte, 0, len(data)/(rowLen+1)*rowLen)
+	prev := make([]byte, rowLen)
+	for pos := 0; pos+1+rowLen <= len(data); pos += rowLen + 1 {
+		filterType := data[pos]
+		row := append([]byte(nil), data[pos+1:pos+1+rowLen]...)
+		for i := 0; i < rowLen; i++ {
+			var left, upLeft byte
+			if i >= bpp {
+				left = row[i-bpp]
+				upLeft = prev[i-bpp]
+			}
+			up := prev[i]
+			switch filterType {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
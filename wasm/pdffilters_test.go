@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/lzw"
+	"compress/zlib"
+	"encoding/ascii85"
+	"fmt"
+	"testing"
+)
+
+func TestPDFASCIIStreams(t *testing.T) {
+	// ASCII wrappers come off every chain; what is left unfiltered is
+	// deflated, binary filters behind the wrapper are kept as they are
+	content := bytes.Repeat([]byte("0.5 0.5 0.5 rg 10 10 200 100 re f\n"), 60)
+	flated := new(bytes.Buffer)
+	zw := zlib.NewWriter(flated)
+	zw.Write(content)
+	zw.Close()
+	jpegData := fixtureJPEG(fixtureGradient(48, 32))
+	a85 := func(b []byte) []byte {
+		out := make([]byte, ascii85.MaxEncodedLen(len(b)))
+		return append(out[:ascii85.Encode(out, b)], "~>"...)
+	}
+	data := fixtureStreamPDF(
+		[]string{"/Filter /ASCIIHexDecode", "/Filter /A85", "/Filter [/ASCII85Decode /FlateDecode]",
+			"/Type /XObject /Subtype /Image /Width 48 /Height 32 /Filter [/ASCII85Decode /DCTDecode]", "/Filter /ASCII85Decode"},
+		[][]byte{[]byte(fmt.Sprintf("%X>", content)), a85(content), a85(flated.Bytes()), a85(jpegData), []byte("not {base 85} data~>")})
+	out := applyPDFPass(t, (*pdfDocument).recodeStreams, data, defaultPDFOptions())
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, want := range map[int]struct {
+		filter string
+		stream []byte
+	}{2: {"FlateDecode", nil}, 3: {"FlateDecode", nil}, 4: {"FlateDecode", flated.Bytes()}, 5: {"DCTDecode", jpegData}} {
+		obj := doc.Objects[num]
+		if obj.Dict().Name("Filter") != want.filter || want.stream != nil && !bytes.Equal(obj.Stream, want.stream) {
+			t.Fatalf("stream %d was not unwrapped to %s", num, want.filter)
+		}
+		if num < 5 {
+			if decoded, err := decodeStream(doc, obj); err != nil || !bytes.Equal(decoded, content) {
+				t.Fatalf("stream %d does not decode to its original bytes: %v", num, err)
+			}
+		}
+	}
+	if doc.Objects[6].Dict().Name("Filter") != "ASCII85Decode" {
+		t.Fatal("undecodable ASCII85 stream was changed")
+	}
+}
+
+func TestPDFLZWStreams(t *testing.T) {
+	// LZW streams move to Flate under the same predictor, whatever
+	// their early change, and decode to the same bytes
+	content := bytes.Repeat([]byte("BT /F1 12 Tf 72 712 Td (LZW was the default in 1993) Tj ET\n"), 200)
+	rows, pixels := fixturePredictedRows(64, 300)
+	gifStyle := new(bytes.Buffer)
+	lw := lzw.NewWriter(gifStyle, lzw.MSB, 8)
+	lw.Write(content)
+	lw.Close()
+	data := fixtureStreamPDF(
+		[]string{"/Filter /LZWDecode", "/Filter /LZWDecode /DecodeParms << /EarlyChange 0 >>",
+			"/Type /XObject /Subtype /Image /Width 64 /Height 300 /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /LZWDecode /DecodeParms << /Predictor 12 /Columns 64 >>",
+			"/Filter [/ASCIIHexDecode /LZW]"},
+		[][]byte{fixtureLZW(content), gifStyle.Bytes(), fixtureLZW(rows), []byte(fmt.Sprintf("%X>", fixtureLZW(content)))})
+	out := applyPDFPass(t, (*pdfDocument).recodeStreams, data, defaultPDFOptions())
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, want := range map[int][]byte{2: content, 3: content, 4: pixels, 5: content} {
+		obj := doc.Objects[num]
+		if obj.Dict().Name("Filter") != "FlateDecode" {
+			t.Fatalf("stream %d was not moved to FlateDecode", num)
+		}
+		if decoded, err := decodeStream(doc, obj); err != nil || !bytes.Equal(decoded, want) {
+			t.Fatalf("stream %d does not decode to its original bytes: %v", num, err)
+		}
+	}
+	if _, ok := doc.Objects[3].Dict().Get("DecodeParms"); ok {
+		t.Fatal("EarlyChange was carried over to FlateDecode")
+	}
+	if _, ok := doc.Objects[4].Dict().Get("DecodeParms"); !ok {
+		t.Fatal("predictor parameters were dropped")
+	}
+}
+
+func TestPDFFilterChains(t *testing.T) {
+	// Chains of general filters collapse to one Flate pass, a
+	// predictor survives, image codecs and lone Flate are kept
+	content := bytes.Repeat([]byte("q 1 0 0 1 50 50 cm 0 0 m 100 0 l 100 100 l S Q\n"), 120)
+	deflate := func(b []byte) []byte {
+		buf := new(bytes.Buffer)
+		zw := zlib.NewWriter(buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	a85 := func(b []byte) []byte {
+		out := make([]byte, ascii85.MaxEncodedLen(len(b)))
+		return append(out[:ascii85.Encode(out, b)], "~>"...)
+	}
+	rows, pixels := fixturePredictedRows(64, 200)
+	jpegData := fixtureJPEG(fixtureGradient(48, 32))
+	data := fixtureStreamPDF(
+		[]string{"/Filter /RunLengthDecode", "/Filter [/ASCII85Decode /RL]", "/Filter [/FlateDecode /ASCIIHexDecode]",
+			"/Type /XObject /Subtype /Image /Width 64 /Height 200 /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter [/ASCIIHexDecode /FlateDecode] /DecodeParms [null << /Predictor 12 /Columns 64 >>]",
+			"/Type /XObject /Subtype /Image /Width 48 /Height 32 /Filter [/RunLengthDecode /DCTDecode]", "/Filter /FlateDecode"},
+		[][]byte{fixtureRunLength(content), a85(fixtureRunLength(content)), deflate([]byte(fmt.Sprintf("%X>", content))),
+			[]byte(fmt.Sprintf("%X>", deflate(rows))), fixtureRunLength(jpegData), deflate(content)})
+	out := applyPDFPass(t, (*pdfDocument).recodeStreams, data, defaultPDFOptions())
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, want := range map[int][]byte{2: content, 3: content, 4: content, 5: pixels} {
+		obj := doc.Objects[num]
+		if obj.Dict().Name("Filter") != "FlateDecode" {
+			t.Fatalf("stream %d was not collapsed to one FlateDecode", num)
+		}
+		if decoded, err := decodeStream(doc, obj); err != nil || !bytes.Equal(decoded, want) {
+			t.Fatalf("stream %d does not decode to its original bytes: %v", num, err)
+		}
+	}
+	if parms := doc.resolveDict(doc.Objects[5].Dict().Vals["DecodeParms"]); parms == nil {
+		t.Fatal("predictor was dropped from the image stream")
+	}
+	if obj := doc.Objects[6]; obj.Dict().Name("Filter") != "DCTDecode" || !bytes.Equal(obj.Stream, jpegData) {
+		t.Fatal("RunLength wrapper was not removed from the JPEG")
+	}
+	if !bytes.Equal(doc.Objects[7].Stream, deflate(content)) {
+		t.Fatal("plain Flate stream was re-encoded")
+	}
+}
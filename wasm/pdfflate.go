@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+)
+
+// Lossless stream recoding. Generated PDFs often leave content streams,
+// fonts, ICC profiles and raw images unfiltered; legacy generators wrap
+// streams in ASCIIHexDecode or ASCII85Decode to keep the file 7-bit,
+// which costs 25-100% on top of the data, and compress with LZWDecode or
+// RunLengthDecode, which Flate beats and which some readers no longer
+// support, sometimes several of them stacked in one /Filter array. This
+// pass collapses such chains into the smallest single Flate pass, or none,
+// and deflates what ends up unfiltered; the decoded data, and so
+// everything a reader renders, stays the same. Metadata streams stay as they are so non-PDF
+// tools can still read them, as the specification recommends, and streams
+// whose data lives in an external file (/F) have nothing here to recode.
+
+// Unfiltered streams shorter than this are left alone; the /Filter entry
+// costs about as much as deflate would save
+const minFlateStreamBytes = 64
+
+// What adding the filter costs in the dictionary
+const flateFilterEntry = " /Filter /FlateDecode"
+
+// General-purpose filters: decoding them is exact and cheap, so any chain
+// of them can be replaced by a single Flate pass over the same data
+var pdfGeneralFilters = map[string]bool{
+	"ASCIIHexDecode": true, "AHx": true,
+	"ASCII85Decode": true, "A85": true,
+	"RunLengthDecode": true, "RL": true,
+	"LZWDecode": true, "LZW": true,
+	"FlateDecode": true, "Fl": true,
+}
+
+// Store each stream in whichever encoding recodeStream finds smallest.
+// Cross-reference, object, external and metadata streams are left alone,
+// and so is the rest once the yield so far is too low.
+func (doc *pdfDocument) recodeStreams(opts pdfOptions) bool {
+	recoded, saved := 0, 0
+	for _, num := range doc.objectNumbers() {
+		if opts.yield.low() {
+			break
+		}
+		obj := doc.Objects[num]
+		dict := obj.Dict()
+		if !obj.HasStream || dict == nil || isLayoutObject(obj) || !opts.inScope(num) {
+			continue
+		}
+		if _, external := dict.Get("F"); external || dict.Name("Type") == "Metadata" {
+			continue
+		}
+		names, parms := streamFilters(doc, dict)
+		if !recodable(obj.Stream, names) {
+			continue
+		}
+		stream, names, parms, ok := recodeStream(obj.Stream, names, parms)
+		if !ok {
+			opts.yield.add(len(obj.Stream), len(obj.Stream))
+			continue
+		}
+		opts.yield.add(len(obj.Stream), len(stream))
+		saved += len(obj.Stream) - len(stream)
+		recoded++
+		obj.Stream = stream
+		setStreamFilters(dict, names, parms)
+	}
+	if recoded == 0 {
+		return false
+	}
+	fmt.Printf("[WASM] Recoded %d streams, about %d bytes saved\n", recoded, saved)
+	trace(nil, "pdf.streams", "recoded", "streams", recoded, "saved", saved)
+	return true
+}
+
+// Number of general filters names starts with
+func leadingGeneralFilters(names []string) int {
+	general := 0
+	for general < len(names) && pdfGeneralFilters[names[general]] {
+		general++
+	}
+	return general
+}
+
+// Whether recodeStream has anything to try on a stream: not when it is
+// too short to deflate, starts with an image codec or is a single Flate
+// pass already
+func recodable(stream []byte, names []string) bool {
+	general := leadingGeneralFilters(names)
+	switch {
+	case len(names) == 0 && len(stream) < minFlateStreamBytes:
+		return false
+	case general == 0 && len(names) > 0:
+		return false
+	case general == 1 && isFlateFilter(names[0]):
+		return false
+	}
+	return true
+}
+
+// The smallest encoding of one stream and its new filter chain; ok is
+// false when the stream is best left as it is. The leading run of general
+// filters (ASCII wrappers, RunLength, LZW, Flate) is decoded and replaced
+// by at most one Flate pass; image codecs after it are kept as they are,
+// and nothing is deflated in front of them.
+// The last general filter's predictor is kept when deflating the
+// predicted bytes beats deflating the samples, and a final Flate pass is
+// kept as it is when re-deflating would not pay.
+func recodeStream(stream []byte, names []string, parms []*pdfDict) ([]byte, []string, []*pdfDict, bool) {
+	if !recodable(stream, names) {
+		return nil, nil, nil, false
+	}
+	general := leadingGeneralFilters(names)
+
+	data := stream
+	for i := 0; i < general-1; i++ {
+		var err error
+		if data, err = applyDecodeFilter(names[i], parms[i], data); err != nil {
+			return nil, nil, nil, false
+		}
+	}
+	rest, restParms := names[general:], parms[general:]
+
+	var best []byte
+	var bestNames []string
+	var bestParms []*pdfDict
+	bestCost := -1
+	consider := func(data []byte, name string, p *pdfDict) {
+		cost, names, parms := len(data), rest, restParms
+		if name != "" {
+			cost += len(flateFilterEntry)
+			names = append([]string{name}, rest...)
+			parms = append([]*pdfDict{p}, restParms...)
+		}
+		if bestCost < 0 || cost < bestCost {
+			best, bestNames, bestParms, bestCost = data, names, parms, cost
+		}
+	}
+
+	if general > 0 {
+		last, lastParms := names[general-1], parms[general-1]
+		if isFlateFilter(last) {
+			consider(data, last, lastParms)
+		}
+		// Flate takes the same predictor parameters as LZW, so the
+		// predicted bytes can be deflated under them unchanged
+		if len(rest) == 0 && predictorParms(lastParms) && (isFlateFilter(last) || isLZWFilter(last)) {
+			if predicted, err := decompressOnly(last, lastParms, data); err == nil {
+				consider(deflateStream(predicted), "FlateDecode", withoutEarlyChange(lastParms))
+			}
+		}
+		var err error
+		if data, err = applyDecodeFilter(last, lastParms, data); err != nil {
+			return nil, nil, nil, false
+		}
+	}
+	consider(data, "", nil)
+	if len(rest) == 0 {
+		consider(deflateStream(data), "FlateDecode", nil)
+	}
+
+	if len(best) >= len(stream) {
+		return nil, nil, nil, false
+	}
+	return best, bestNames, bestParms, true
+}
+
+func isFlateFilter(name string) bool {
+	return name == "FlateDecode" || name == "Fl"
+}
+
+func isLZWFilter(name string) bool {
+	return name == "LZWDecode" || name == "LZW"
+}
+
+// Whether decode parameters carry a predictor other than none
+func predictorParms(parms *pdfDict) bool {
+	if parms == nil {
+		return false
+	}
+	v, _ := parms.Get("Predictor")
+	n, ok := v.Int()
+	return ok && n > 1
+}
+
+// A Flate or LZW stream decompressed with its predictor left in place
+func decompressOnly(name string, parms *pdfDict, data []byte) ([]byte, error) {
+	if isLZWFilter(name) {
+		return lzwDecode(data, parms)
+	}
+	return inflate(data)
+}
+
+// LZW decode parameters as Flate takes them; nil when nothing is left
+func withoutEarlyChange(parms *pdfDict) *pdfDict {
+	p := parms.Clone()
+	p.Delete("EarlyChange")
+	if len(p.Keys) == 0 {
+		return nil
+	}
+	return p
+}
+
+func deflateStream(data []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// Replace a stream dictionary's filter chain; parms run parallel to names
+// and may hold nils
+func setStreamFilters(dict *pdfDict, names []string, parms []*pdfDict) {
+	dict.Delete("Filter")
+	dict.Delete("DecodeParms")
+	switch len(names) {
+	case 0:
+		return
+	case 1:
+		dict.Set("Filter", pdfNameValue(names[0]))
+		if parms[0] != nil {
+			dict.Set("DecodeParms", pdfDictValue(parms[0]))
+		}
+		return
+	}
+	filters := pdfValue{Kind: pdfArray}
+	decodeParms := pdfValue{Kind: pdfArray}
+	anyParms := false
+	for i, name := range names {
+		filters.Arr = append(filters.Arr, pdfNameValue(name))
+		if parms[i] != nil {
+			decodeParms.Arr = append(decodeParms.Arr, pdfDictValue(parms[i]))
+			anyParms = true
+		} else {
+			decodeParms.Arr = append(decodeParms.Arr, pdfValue{Kind: pdfNull})
+		}
+	}
+	dict.Set("Filter", filters)
+	if anyParms {
+		dict.Set("DecodeParms", decodeParms)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+)
+
+func TestPDFFlateStreams(t *testing.T) {
+	// Unfiltered content and raw image streams are deflated; metadata,
+	// filtered and tiny streams are not
+	content := bytes.Repeat([]byte("BT /F1 12 Tf 72 712 Td (Hello, world) Tj ET\n"), 80)
+	pixels := bytes.Repeat([]byte{200, 200, 200, 30, 30, 30}, 400)
+	packet := fixtureXMPPacket()
+	flated := new(bytes.Buffer)
+	zw := zlib.NewWriter(flated)
+	zw.Write(content)
+	zw.Close()
+	data := fixtureStreamPDF(
+		[]string{"", "/Type /XObject /Subtype /Image /Width 40 /Height 20 /ColorSpace /DeviceRGB /BitsPerComponent 8", "/Type /Metadata /Subtype /XML", "/Filter /FlateDecode", ""},
+		[][]byte{content, pixels, packet, flated.Bytes(), []byte("q Q")})
+	out := applyPDFPass(t, (*pdfDocument).recodeStreams, data, defaultPDFOptions())
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, want := range map[int][]byte{2: content, 3: pixels, 5: content} {
+		obj := doc.Objects[num]
+		if num != 5 && (obj.Dict().Name("Filter") != "FlateDecode" || len(obj.Stream) >= len(want)) {
+			t.Fatalf("stream %d was not deflated", num)
+		}
+		if decoded, err := decodeStream(doc, obj); err != nil || !bytes.Equal(decoded, want) {
+			t.Fatalf("stream %d does not decode to its original bytes: %v", num, err)
+		}
+	}
+	if !bytes.Equal(doc.Objects[4].Stream, packet) || !bytes.Equal(doc.Objects[6].Stream, []byte("q Q")) {
+		t.Fatal("metadata or tiny stream was changed")
+	}
+	if len(out) >= len(data) {
+		t.Fatal("output is not smaller")
+	}
+	if again := applyPDFPass(t, (*pdfDocument).recodeStreams, out, defaultPDFOptions()); !bytes.Equal(again, out) {
+		t.Fatal("second pass changed the file")
+	}
+}
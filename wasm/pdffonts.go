@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Duplicate font merging. Report generators often embed a font once per
+// page, either as identical copies or as per-page subsets of the same
+// TrueType font. Identical font programs are merged outright. TrueType
+// subsets that keep the full font's glyph IDs, leaving unused glyphs
+// empty, are merged into one program holding the union of their glyphs
+// when every other table matches and no glyph kept by both differs. Each
+// font dictionary keeps its own widths and encoding; only the program
+// behind it is shared, so every code still shows the same glyph. Font
+// dictionaries and descriptors left identical afterwards are merged too.
+
+// Descriptor keys that reference a font program
+var pdfFontFileKeys = []string{"FontFile", "FontFile2", "FontFile3"}
+
+// Rounds of identical-object merging; each round can make the objects
+// referencing the merged ones identical (program, descriptor, font,
+// Type0 font)
+const fontMergeRounds = 4
+
+// What mergeFonts did
+type fontMergeStats struct {
+	Programs int // programs merged into another
+	Unioned  int // of those, subsets whose glyphs were added to another
+	Objects  int // descriptors, fonts and their parts merged
+}
+
+// Merge duplicate font programs and font objects; see mergeFontObjects.
+// Skipped once the passes before it saved too little to go on.
+func (doc *pdfDocument) mergeFonts(opts pdfOptions) bool {
+	if opts.yield.low() {
+		return false
+	}
+	stats := mergeFontObjects(doc, opts)
+	if stats.Programs == 0 && stats.Objects == 0 {
+		return false
+	}
+	fmt.Printf("[WASM] Merged %d font programs (%d subsets unioned) and %d font objects\n", stats.Programs, stats.Unioned, stats.Objects)
+	trace(nil, "pdf.fonts", "merged", "programs", stats.Programs, "unioned", stats.Unioned, "objects", stats.Objects)
+	return true
+}
+
+func mergeFontObjects(doc *pdfDocument, opts pdfOptions) fontMergeStats {
+	var stats fontMergeStats
+	replaced := map[int]int{}
+
+	// Font programs and whether a descriptor pins their glyph set
+	// (/CIDSet, /CharSet), which rules out adding glyphs
+	programs := map[int]string{}
+	pinned := map[int]bool{}
+	for _, num := range doc.objectNumbers() {
+		dict := doc.Objects[num].Dict()
+		if dict == nil || dict.Name("Type") != "FontDescriptor" {
+			continue
+		}
+		_, cidSet := dict.Get("CIDSet")
+		_, charSet := dict.Get("CharSet")
+		for _, key := range pdfFontFileKeys {
+			if v, ok := dict.Get(key); ok && v.Kind == pdfRefKind {
+				if obj := doc.Objects[v.Ref.Num]; obj != nil && obj.HasStream && opts.inScope(v.Ref.Num) {
+					programs[v.Ref.Num] = key
+					pinned[v.Ref.Num] = pinned[v.Ref.Num] || cidSet || charSet
+				}
+			}
+		}
+	}
+	nums := make([]int, 0, len(programs))
+	for num := range programs {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	// Identical programs, compared decoded so differing filters do not hide
+	// a duplicate
+	decoded := map[int][]byte{}
+	first := map[string]int{}
+	for _, num := range nums {
+		obj := doc.Objects[num]
+		program, err := decodeStream(doc, obj)
+		if err != nil {
+			continue
+		}
+		decoded[num] = program
+		sum := sha256.Sum256(program)
+		key := programs[num] + "/" + obj.Dict().Name("Subtype") + "/" + string(sum[:])
+		if keeper, ok := first[key]; ok {
+			replaced[num] = keeper
+			pinned[keeper] = pinned[keeper] || pinned[num]
+			stats.Programs++
+			continue
+		}
+		first[key] = num
+	}
+
+	// TrueType subsets of one font, grouped by everything but their glyphs
+	groups := map[string][]int{}
+	var order []string
+	fonts := map[int]*sfntFont{}
+	for _, num := range nums {
+		if _, dup := replaced[num]; dup || programs[num] != "FontFile2" || decoded[num] == nil {
+			continue
+		}
+		f, err := parseSFNT(decoded[num])
+		if err != nil || f.Flavor == sfntCFF {
+			continue
+		}
+		key, ok := glyphlessSignature(f)
+		if !ok {
+			continue
+		}
+		fonts[num] = f
+		if groups[key] == nil {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], num)
+	}
+	for _, key := range order {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		keeper := group[0]
+		glyphs, err := trueTypeGlyphs(fonts[keeper])
+		if err != nil {
+			continue
+		}
+		merged := 0
+		for _, num := range group[1:] {
+			other, err := trueTypeGlyphs(fonts[num])
+			if err != nil || (pinned[keeper] || pinned[num]) && !sameGlyphSet(glyphs, other) {
+				continue
+			}
+			union, ok := unionGlyphs(glyphs, other)
+			if !ok {
+				continue
+			}
+			glyphs = union
+			replaced[num] = keeper
+			merged++
+		}
+		if merged == 0 {
+			continue
+		}
+		f := fonts[keeper]
+		setTrueTypeGlyphs(f, glyphs)
+		program := f.encode()
+		obj := doc.Objects[keeper]
+		obj.Stream = deflateStream(program)
+		setStreamFilters(obj.Dict(), []string{"FlateDecode"}, []*pdfDict{nil})
+		obj.Dict().Set("Length1", pdfIntValue(len(program)))
+		stats.Programs += merged
+		stats.Unioned += merged
+	}
+	if len(replaced) > 0 {
+		replaceObjects(doc, replaced)
+	}
+
+	// Descriptors, fonts and the objects they reference (widths, ToUnicode
+	// maps, encodings, CIDSets) that the merge left identical
+	for round := 0; round < fontMergeRounds; round++ {
+		candidates := fontObjectNumbers(doc)
+		replaced = map[int]int{}
+		first := map[string]int{}
+		for _, num := range candidates {
+			if !opts.inScope(num) {
+				continue
+			}
+			key := objectSignature(doc.Objects[num])
+			if keeper, ok := first[key]; ok {
+				replaced[num] = keeper
+				continue
+			}
+			first[key] = num
+		}
+		if len(replaced) == 0 {
+			break
+		}
+		stats.Objects += len(replaced)
+		replaceObjects(doc, replaced)
+	}
+	return stats
+}
+
+// Font and descriptor objects plus the non-program objects they reference
+// directly, in object number order
+func fontObjectNumbers(doc *pdfDocument) []int {
+	seen := map[int]bool{}
+	for _, num := range doc.objectNumbers() {
+		dict := doc.Objects[num].Dict()
+		if dict == nil || isLayoutObject(doc.Objects[num]) {
+			continue
+		}
+		t := dict.Name("Type")
+		if t != "Font" && t != "FontDescriptor" {
+			continue
+		}
+		seen[num] = true
+		for _, key := range dict.Keys {
+			if t == "FontDescriptor" && isFontFileKey(key) {
+				continue
+			}
+			v := dict.Vals[key]
+			refs := []pdfValue{v}
+			if v.Kind == pdfArray {
+				refs = v.Arr
+			}
+			for _, r := range refs {
+				if r.Kind == pdfRefKind && doc.Objects[r.Ref.Num] != nil {
+					seen[r.Ref.Num] = true
+				}
+			}
+		}
+	}
+	nums := make([]int, 0, len(seen))
+	for num := range seen {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+func isFontFileKey(key string) bool {
+	return key == "FontFile" || key == "FontFile2" || key == "FontFile3"
+}
+
+// Everything about a TrueType font but its glyph outlines: every table
+// except glyf and loca, with head's checksum, dates and loca format
+// cleared. Fonts with the same signature are subsets of one font that
+// kept its glyph IDs.
+func glyphlessSignature(f *sfntFont) (string, bool) {
+	head := f.Tables["head"]
+	if len(head) < 54 || f.Tables["glyf"] == nil || f.Tables["loca"] == nil || len(f.Tables["maxp"]) < 6 {
+		return "", false
+	}
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, f.Flavor)
+	for _, tag := range f.sortedTags() {
+		t := f.Tables[tag]
+		switch tag {
+		case "glyf", "loca":
+			continue
+		case "head":
+			t = append([]byte{}, t...)
+			copy(t[8:12], make([]byte, 4))   // checkSumAdjustment
+			copy(t[20:36], make([]byte, 16)) // created, modified
+			copy(t[50:52], make([]byte, 2))  // indexToLocFormat
+		}
+		fmt.Fprintf(h, "%s:%d:", tag, len(t))
+		h.Write(t)
+	}
+	return string(h.Sum(nil)), true
+}
+
+// A TrueType font's glyph outlines by glyph ID; empty for glyphs a subset
+// left out
+func trueTypeGlyphs(f *sfntFont) ([][]byte, error) {
+	head, maxp, loca, glyf := f.Tables["head"], f.Tables["maxp"], f.Tables["loca"], f.Tables["glyf"]
+	if len(head) < 54 || len(maxp) < 6 {
+		return nil, errors.New("font header tables truncated")
+	}
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	longLoca := binary.BigEndian.Uint16(head[50:]) == 1
+	offsets := make([]int, numGlyphs+1)
+	for i := range offsets {
+		switch {
+		case longLoca && i*4+4 <= len(loca):
+			offsets[i] = int(binary.BigEndian.Uint32(loca[i*4:]))
+		case !longLoca && i*2+2 <= len(loca):
+			offsets[i] = int(binary.BigEndian.Uint16(loca[i*2:])) * 2
+		default:
+			return nil, errors.New("loca table truncated")
+		}
+		if offsets[i] > len(glyf) || i > 0 && offsets[i] < offsets[i-1] {
+			return nil, fmt.Errorf("glyph %d has an invalid offset", i)
+		}
+	}
+	glyphs := make([][]byte, numGlyphs)
+	for id := range glyphs {
+		glyphs[id] = glyf[offsets[id]:offsets[id+1]]
+	}
+	return glyphs, nil
+}
+
+// Replace a TrueType font's glyf and loca with the given outlines, padded
+// to four bytes, and set head's loca format to match. head must be whole.
+func setTrueTypeGlyphs(f *sfntFont, glyphs [][]byte) {
+	var glyf, loca []byte
+	offsets := make([]int, 0, len(glyphs)+1)
+	for _, g := range glyphs {
+		offsets = append(offsets, len(glyf))
+		glyf = append(glyf, g...)
+		for len(glyf)%4 != 0 {
+			glyf = append(glyf, 0)
+		}
+	}
+	offsets = append(offsets, len(glyf))
+	shortLoca := len(glyf)/2 <= 0xFFFF
+	for _, off := range offsets {
+		if shortLoca {
+			loca = binary.BigEndian.AppendUint16(loca, uint16(off/2))
+		} else {
+			loca = binary.BigEndian.AppendUint32(loca, uint32(off))
+		}
+	}
+	head := append([]byte{}, f.Tables["head"]...)
+	if shortLoca {
+		binary.BigEndian.PutUint16(head[50:], 0)
+	} else {
+		binary.BigEndian.PutUint16(head[50:], 1)
+	}
+	f.Tables["glyf"], f.Tables["loca"], f.Tables["head"] = glyf, loca, head
+}
+
+// Glyphs of two subsets of one font; ok is false when a glyph both keep
+// differs, beyond padding
+func unionGlyphs(a, b [][]byte) ([][]byte, bool) {
+	if len(a) != len(b) {
+		return nil, false
+	}
+	union := make([][]byte, len(a))
+	for id := range a {
+		ga, gb := trimGlyphPadding(a[id]), trimGlyphPadding(b[id])
+		switch {
+		case len(ga) == 0:
+			union[id] = b[id]
+		case len(gb) == 0 || bytes.Equal(ga, gb):
+			union[id] = a[id]
+		default:
+			return nil, false
+		}
+	}
+	return union, true
+}
+
+func sameGlyphSet(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id := range a {
+		if (len(trimGlyphPadding(a[id])) == 0) != (len(trimGlyphPadding(b[id])) == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Outlines are padded to two or four bytes; the zeros carry nothing.
+// Only for comparing: a real outline can end in a zero byte.
+func trimGlyphPadding(g []byte) []byte {
+	for n := 0; n < 3 && len(g) > 0 && g[len(g)-1] == 0; n++ {
+		g = g[:len(g)-1]
+	}
+	return g
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestPDFFontMerge(t *testing.T) {
+	// Five glyph-ID-keeping subsets of one font: two identical, two
+	// that add glyphs to them and one that disagrees on a glyph
+	full, err := parseSFNT(fixtureTTF())
+	if err != nil {
+		t.Fatal(err)
+	}
+	subset := func(keep map[int]bool, edit func([]byte) []byte) []byte {
+		glyphs, _ := trueTypeGlyphs(full)
+		f := &sfntFont{Flavor: full.Flavor, Tables: map[string][]byte{}}
+		for tag, t := range full.Tables {
+			f.Tables[tag] = t
+		}
+		out := make([][]byte, len(glyphs))
+		for id, g := range glyphs {
+			if keep[id] {
+				out[id] = g
+			}
+		}
+		if edit != nil {
+			out[1] = edit(append([]byte{}, out[1]...))
+		}
+		setTrueTypeGlyphs(f, out)
+		return f.encode()
+	}
+	programs := [][]byte{
+		subset(map[int]bool{0: true, 1: true, 2: true}, nil),
+		subset(map[int]bool{0: true, 1: true, 2: true}, nil),
+		subset(map[int]bool{0: true, 1: true}, nil),
+		subset(map[int]bool{0: true, 3: true}, nil),
+		subset(map[int]bool{0: true, 1: true}, func(g []byte) []byte { g[len(g)-3]++; return g }),
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	for i, program := range programs {
+		fmt.Fprintf(buf, "%d 0 obj\n<< /Length %d /Length1 %d >>\nstream\n", 2+i, len(program), len(program))
+		buf.Write(program)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+	for i, name := range []string{"AAAAAA+Test", "AAAAAA+Test", "BBBBBB+Test", "CCCCCC+Test", "DDDDDD+Test"} {
+		fmt.Fprintf(buf, "%d 0 obj\n<< /Type /FontDescriptor /FontName /%s /Flags 32 /FontFile2 %d 0 R >>\nendobj\n", 7+i, name, 2+i)
+		fmt.Fprintf(buf, "%d 0 obj\n<< /Type /Font /Subtype /TrueType /BaseFont /%s /FontDescriptor %d 0 R >>\nendobj\n", 12+i, name, 7+i)
+	}
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	data := buf.Bytes()
+
+	out := applyPDFPass(t, (*pdfDocument).mergeFonts, data, defaultPDFOptions())
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, num := range []int{3, 4, 5, 8, 13} {
+		if doc.Objects[num] != nil {
+			t.Fatalf("object %d was not merged", num)
+		}
+	}
+	for _, num := range []int{6, 11, 16} {
+		if doc.Objects[num] == nil {
+			t.Fatalf("conflicting subset object %d was merged", num)
+		}
+	}
+	for _, num := range []int{9, 10} {
+		if v, _ := doc.Objects[num].Dict().Get("FontFile2"); v.Ref.Num != 2 {
+			t.Fatal("subset descriptor does not point at the unioned program")
+		}
+	}
+	for _, num := range []int{12, 14, 15, 16} {
+		if v, _ := doc.Objects[num].Dict().Get("FontDescriptor"); doc.Objects[v.Ref.Num] == nil {
+			t.Fatalf("font %d points at a merged descriptor", num)
+		}
+	}
+	program, err := decodeStream(doc, doc.Objects[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	union, err := parseSFNT(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	glyphs, err := trueTypeGlyphs(union)
+	if err != nil || len(glyphs[1]) == 0 || len(glyphs[2]) == 0 || len(glyphs[3]) == 0 {
+		t.Fatalf("unioned program has the wrong glyphs: %v", err)
+	}
+	if a := collectPDFActions(data, fixturePDFResult(data, out)); a.FontsMerged != 3 {
+		t.Fatalf("report counts %d merged font programs, want 3", a.FontsMerged)
+	}
+}
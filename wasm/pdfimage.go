@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+
+	"golang.org/x/image/ccitt"
+)
+
+// A decoded image XObject. Stencil masks are returned with transparent
+// unpainted pixels.
+type pdfDecodedImage struct {
+	Image   *image.NRGBA
+	Stencil bool
+}
+
+// Color space of an image XObject, reduced to what sample conversion needs
+type pdfColorSpace struct {
+	Components int
+	Family     string // DeviceGray, DeviceRGB, DeviceCMYK, Indexed or Separation
+	Base       string // Indexed: family of the base space
+	BaseN      int    // Indexed: components of the base space
+	Lookup     []byte // Indexed: palette
+	HiVal      int    // Indexed: highest valid index
+}
+
+// Resolve a /ColorSpace value into its family and component count
+func resolveColorSpace(doc *pdfDocument, v pdfValue, depth int) (pdfColorSpace, error) {
+	v = doc.resolve(v)
+	if depth > 4 {
+		return pdfColorSpace{}, errors.New("color space nesting too deep")
+	}
+	name := v.Raw
+	var arr []pdfValue
+	if v.Kind == pdfArray && len(v.Arr) > 0 {
+		arr = v.Arr
+		name = doc.resolve(arr[0]).Raw
+	}
+
+	switch name {
+	case "DeviceGray", "G", "CalGray":
+		return pdfColorSpace{Components: 1, Family: "DeviceGray"}, nil
+	case "DeviceRGB", "RGB", "CalRGB", "Lab":
+		return pdfColorSpace{Components: 3, Family: "DeviceRGB"}, nil
+	case "DeviceCMYK", "CMYK":
+		return pdfColorSpace{Components: 4, Family: "DeviceCMYK"}, nil
+	case "ICCBased":
+		if len(arr) < 2 {
+			break
+		}
+		stream := doc.resolve(arr[1])
+		n := 3
+		if arr[1].Kind == pdfRefKind {
+			if obj, ok := doc.Objects[arr[1].Ref.Num]; ok && obj.Dict() != nil {
+				if nv, ok := obj.Dict().Get("N"); ok {
+					n, _ = nv.Int()
+				}
+			}
+		} else if stream.Kind == pdfDictKind {
+			if nv, ok := stream.Dict.Get("N"); ok {
+				n, _ = nv.Int()
+			}
+		}
+		switch n {
+		case 1:
+			return pdfColorSpace{Components: 1, Family: "DeviceGray"}, nil
+		case 4:
+			return pdfColorSpace{Components: 4, Family: "DeviceCMYK"}, nil
+		}
+		return pdfColorSpace{Components: 3, Family: "DeviceRGB"}, nil
+	case "Indexed", "I":
+		if len(arr) < 4 {
+			break
+		}
+		base, err := resolveColorSpace(doc, arr[1], depth+1)
+		if err != nil || base.Family == "Indexed" {
+			return pdfColorSpace{}, fmt.Errorf("unsupported indexed base: %v", err)
+		}
+		hival, _ := doc.resolve(arr[2]).Int()
+		cs := pdfColorSpace{Components: 1, Family: "Indexed", Base: base.Family, BaseN: base.Components, HiVal: hival}
+		lookup := arr[3]
+		if lookup.Kind == pdfRefKind {
+			if obj, ok := doc.Objects[lookup.Ref.Num]; ok && obj.HasStream {
+				cs.Lookup, err = decodeStream(doc, obj)
+				if err != nil {
+					return cs, err
+				}
+				return cs, nil
+			}
+		}
+		cs.Lookup = []byte(doc.resolve(lookup).Str)
+		return cs, nil
+	case "Separation", "DeviceN":
+		// Rendered as gray from the tint: good enough for previews
+		n := 1
+		if name == "DeviceN" && len(arr) > 1 {
+			n = len(doc.resolve(arr[1]).Arr)
+		}
+		return pdfColorSpace{Components: n, Family: "Separation"}, nil
+	}
+	return pdfColorSpace{}, fmt.Errorf("unsupported color space %q", name)
+}
+
+// Decode an image XObject into pixels
+func decodePDFImage(doc *pdfDocument, obj *pdfObject) (pdfDecodedImage, error) {
+	dict := obj.Dict()
+	if dict == nil || !obj.HasStream {
+		return pdfDecodedImage{}, errors.New("image has no stream")
+	}
+	intEntry := func(key string, def int) int {
+		if v, ok := dict.Get(key); ok {
+			if n, ok := doc.resolve(v).Int(); ok {
+				return n
+			}
+		}
+		return def
+	}
+	width, height := intEntry("Width", 0), intEntry("Height", 0)
+	if width <= 0 || height <= 0 || width*height > 1<<27 {
+		return pdfDecodedImage{}, fmt.Errorf("invalid image size %dx%d", width, height)
+	}
+
+	stencil := false
+	if v, ok := dict.Get("ImageMask"); ok && doc.resolve(v).Raw == "true" {
+		stencil = true
+	}
+
+	names, parms := streamFilters(doc, dict)
+	data := obj.Stream
+	last := ""
+	if len(names) > 0 {
+		last = names[len(names)-1]
+	}
+	// Generic filters run first; image codecs are handled below
+	pre := len(names)
+	switch last {
+	case "DCTDecode", "DCT", "CCITTFaxDecode", "CCF", "JPXDecode", "JBIG2Decode":
+		pre--
+	}
+	for i := 0; i < pre; i++ {
+		var err error
+		if data, err = applyDecodeFilter(names[i], parms[i], data); err != nil {
+			return pdfDecodedImage{}, err
+		}
+	}
+
+	switch last {
+	case "DCTDecode", "DCT":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return pdfDecodedImage{}, err
+		}
+		b := img.Bounds()
+		out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+		return pdfDecodedImage{Image: out}, nil
+	case "CCITTFaxDecode", "CCF":
+		samples, err := decodeCCITTImage(doc, parms[len(parms)-1], data, width, height)
+		if err != nil {
+			return pdfDecodedImage{}, err
+		}
+		data = samples
+	case "JPXDecode", "JBIG2Decode":
+		return pdfDecodedImage{}, fmt.Errorf("%w: %s", errUnsupportedFilter, last)
+	}
+
+	bpc := intEntry("BitsPerComponent", 8)
+	cs := pdfColorSpace{Components: 1, Family: "DeviceGray"}
+	if stencil || last == "CCITTFaxDecode" || last == "CCF" {
+		bpc = 1
+	}
+	if !stencil {
+		csValue, ok := dict.Get("ColorSpace")
+		if !ok {
+			if last != "CCITTFaxDecode" && last != "CCF" {
+				return pdfDecodedImage{}, errors.New("image has no color space")
+			}
+		} else {
+			var err error
+			if cs, err = resolveColorSpace(doc, csValue, 0); err != nil {
+				return pdfDecodedImage{}, err
+			}
+		}
+	}
+	switch bpc {
+	case 1, 2, 4, 8, 16:
+	default:
+		return pdfDecodedImage{}, fmt.Errorf("unsupported BitsPerComponent %d", bpc)
+	}
+
+	// Optional /Decode array: one [min max] pair per component
+	var decode []float64
+	if v, ok := dict.Get("Decode"); ok {
+		for _, item := range doc.resolve(v).Arr {
+			f, _ := doc.resolve(item).Float()
+			decode = append(decode, f)
+		}
+	}
+
+	img := samplesToImage(data, width, height, bpc, cs, decode, stencil)
+	return pdfDecodedImage{Image: img, Stencil: stencil}, nil
+}
+
+// Run CCITT data through x/image/ccitt and return 1-bit samples as the
+// PDF filter defines them (0 = black unless /BlackIs1)
+func decodeCCITTImage(doc *pdfDocument, parms *pdfDict, data []byte, width, height int) ([]byte, error) {
+	k, columns, rows, blackIs1, align := 0, 1728, height, false, false
+	if parms != nil {
+		if v, ok := parms.Get("K"); ok {
+			k, _ = doc.resolve(v).Int()
+		}
+		if v, ok := parms.Get("Columns"); ok {
+			columns, _ = doc.resolve(v).Int()
+		}
+		if v, ok := parms.Get("Rows"); ok {
+			rows, _ = doc.resolve(v).Int()
+		}
+		if v, ok := parms.Get("BlackIs1"); ok {
+			blackIs1 = doc.resolve(v).Raw == "true"
+		}
+		if v, ok := parms.Get("EncodedByteAlign"); ok {
+			align = doc.resolve(v).Raw == "true"
+		}
+	}
+	if rows <= 0 {
+		rows = height
+	}
+	sf := ccitt.Group3
+	if k < 0 {
+		sf = ccitt.Group4
+	} else if k > 0 {
+		return nil, fmt.Errorf("%w: mixed 1D/2D CCITT (K=%d)", errUnsupportedFilter, k)
+	}
+
+	r := ccitt.NewReader(bytes.NewReader(data), ccitt.MSB, sf, columns, rows, &ccitt.Options{Align: align, Invert: blackIs1})
+	out, err := io.ReadAll(r)
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	if columns != width {
+		return nil, fmt.Errorf("CCITT columns %d do not match image width %d", columns, width)
+	}
+	return out, nil
+}
+
+// Convert packed samples into pixels
+func samplesToImage(data []byte, width, height, bpc int, cs pdfColorSpace, decode []float64, stencil bool) *image.NRGBA {
+	out := image.NewNRGBA(image.Rect(0, 0, width, height))
+	n := cs.Components
+	rowBytes := (width*n*bpc + 7) / 8
+	maxVal := float64(int(1)<<uint(bpc) - 1)
+	if bpc == 16 {
+		maxVal = 255 // only the high byte is read
+	}
+
+	sample := func(row []byte, i int) int {
+		switch bpc {
+		case 8:
+			return int(row[i])
+		case 16:
+			return int(row[i*2])
+		}
+		bit := i * bpc
+		shift := uint(8 - bpc - bit%8)
+		return int(row[bit/8]>>shift) & (1<<uint(bpc) - 1)
+	}
+	// Map a raw sample of component c to [0, 1] through /Decode
+	value := func(s, c int) float64 {
+		lo, hi := 0.0, 1.0
+		if cs.Family == "Indexed" {
+			lo, hi = 0, maxVal
+		}
+		if len(decode) >= 2*(c+1) {
+			lo, hi = decode[2*c], decode[2*c+1]
+		}
+		return lo + float64(s)*(hi-lo)/maxVal
+	}
+	clamp := func(f float64) uint8 {
+		switch {
+		case f <= 0:
+			return 0
+		case f >= 1:
+			return 255
+		}
+		return uint8(f*255 + 0.5)
+	}
+
+	comps := make([]float64, n)
+	for y := 0; y < height; y++ {
+		if (y+1)*rowBytes > len(data) {
+			break // truncated image: leave the rest blank
+		}
+		row := data[y*rowBytes : (y+1)*rowBytes]
+		for x := 0; x < width; x++ {
+			for c := 0; c < n; c++ {
+				comps[c] = value(sample(row, x*n+c), c)
+			}
+			var px color.NRGBA
+			switch {
+			case stencil:
+				// Default decode paints where the sample is 0
+				if comps[0] < 0.5 {
+					px = color.NRGBA{0, 0, 0, 255}
+				}
+			case cs.Family == "Indexed":
+				idx := int(comps[0] + 0.5)
+				if idx > cs.HiVal {
+					idx = cs.HiVal
+				}
+				px = paletteColor(cs, idx)
+			case cs.Family == "Separation":
+				// Tint 1 is full ink; render the first colorant as gray
+				g := clamp(1 - comps[0])
+				px = color.NRGBA{g, g, g, 255}
+			case n == 1:
+				g := clamp(comps[0])
+				px = color.NRGBA{g, g, g, 255}
+			case n == 3:
+				px = color.NRGBA{clamp(comps[0]), clamp(comps[1]), clamp(comps[2]), 255}
+			case n == 4:
+				k := comps[3]
+				px = color.NRGBA{clamp((1 - comps[0]) * (1 - k)), clamp((1 - comps[1]) * (1 - k)), clamp((1 - comps[2]) * (1 - k)), 255}
+			}
+			out.SetNRGBA(x, y, px)
+		}
+	}
+	return out
+}
+
+// Look up an Indexed color space entry
+func paletteColor(cs pdfColorSpace, idx int) color.NRGBA {
+	off := idx * cs.BaseN
+	if idx < 0 || off+cs.BaseN > len(cs.Lookup) {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	e := cs.Lookup[off : off+cs.BaseN]
+	switch cs.Base {
+	case "DeviceGray":
+		return color.NRGBA{e[0], e[0], e[0], 255}
+	case "DeviceCMYK":
+		r, g, b := color.CMYKToRGB(e[0], e[1], e[2], e[3])
+		return color.NRGBA{r, g, b, 255}
+	}
+	return color.NRGBA{e[0], e[1], e[2], 255}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+func TestPDFImageColorspace(t *testing.T) {
+	// Gray, RGB and ICC-based RGB JPEGs are re-encoded in place;
+	// CMYK ones, device or ICC-based, and one with an explicit
+	// ColorTransform are kept byte for byte
+	rgb := fixtureJPEG(fixtureGradient(96, 64))
+	grayImg := image.NewGray(image.Rect(0, 0, 96, 64))
+	for i := range grayImg.Pix {
+		grayImg.Pix[i] = byte(i % 251)
+	}
+	gray := fixtureJPEG(grayImg)
+	dict := "/Type /XObject /Subtype /Image /Width 96 /Height 64 /BitsPerComponent 8 /Filter /DCTDecode /ColorSpace "
+	data := fixtureStreamPDF(
+		[]string{dict + "/DeviceRGB", dict + "/DeviceGray", dict + "[/ICCBased 8 0 R]", dict + "/DeviceCMYK",
+			dict + "[/ICCBased 9 0 R]", dict + "/DeviceRGB /DecodeParms << /ColorTransform 1 >>", "/N 3", "/N 4"},
+		[][]byte{rgb, gray, rgb, rgb, rgb, rgb, []byte("icc"), []byte("icc")})
+	opts := defaultPDFOptions()
+	opts.MinEmbeddedImageBytes = 0
+	if out := applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, opts); !bytes.Equal(out, data) {
+		t.Fatal("JPEGs were re-encoded without imageQuality")
+	}
+	opts.ImageQuality = 40
+	out := applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, opts)
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, reencoded := range map[int]bool{2: true, 3: true, 4: true, 5: false, 6: false, 7: false} {
+		obj := doc.Objects[num]
+		original := rgb
+		if num == 3 {
+			original = gray
+		}
+		if bytes.Equal(obj.Stream, original) == reencoded {
+			t.Fatalf("image %d: re-encoded=%v, want %v", num, !reencoded, reencoded)
+		}
+		if reencoded {
+			img, err := jpeg.Decode(bytes.NewReader(obj.Stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, isGray := img.(*image.Gray); isGray != (num == 3) {
+				t.Fatalf("image %d changed component count", num)
+			}
+		}
+	}
+}
+
+func TestPDFSMaskDownsample(t *testing.T) {
+	// Downsampled images take their soft masks along, a half-size
+	// mask stays half the image's size, and images whose mask
+	// cannot follow (shared, color key) keep their size
+	photo := fixtureJPEG(fixtureGradient(200, 100))
+	maskSamples := func(w, h int) []byte {
+		b := make([]byte, w*h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w/2; x++ {
+				b[y*w+x] = 255
+			}
+		}
+		return b
+	}
+	imageDict := func(w, h int, extra string) string {
+		return fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /BitsPerComponent 8 /ColorSpace /DeviceRGB /Filter /DCTDecode %s", w, h, extra)
+	}
+	mask := func(w, h int) string {
+		return fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /BitsPerComponent 8 /ColorSpace /DeviceGray", w, h)
+	}
+	data := fixtureStreamPDF(
+		[]string{imageDict(200, 100, "/SMask 7 0 R"), imageDict(200, 100, "/SMask 8 0 R"), imageDict(200, 100, "/Mask [0 10 0 10 0 10]"),
+			imageDict(200, 100, "/SMask 9 0 R"), imageDict(200, 100, "/SMask 9 0 R"), mask(200, 100), mask(100, 50), mask(200, 100)},
+		[][]byte{photo, photo, photo, photo, photo, maskSamples(200, 100), maskSamples(100, 50), maskSamples(200, 100)})
+	opts := defaultPDFOptions()
+	opts.MinEmbeddedImageBytes = 0
+	opts.MaxImageDimension = 100
+	out := applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, opts)
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := func(num int) (int, int) {
+		w, _ := doc.Objects[num].Dict().Vals["Width"].Int()
+		h, _ := doc.Objects[num].Dict().Vals["Height"].Int()
+		return w, h
+	}
+	for num, want := range map[int][2]int{2: {100, 50}, 3: {100, 50}, 4: {200, 100}, 5: {200, 100}, 6: {200, 100}, 7: {100, 50}, 8: {50, 25}, 9: {200, 100}} {
+		if w, h := size(num); w != want[0] || h != want[1] {
+			t.Fatalf("object %d is %dx%d, want %dx%d", num, w, h, want[0], want[1])
+		}
+	}
+	if !bytes.Equal(doc.Objects[4].Stream, photo) {
+		t.Fatal("color-keyed image was re-encoded")
+	}
+	decoded, err := decodePDFImage(doc, doc.Objects[7])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left, right := decoded.Image.NRGBAAt(10, 25).R, decoded.Image.NRGBAAt(90, 25).R; left < 240 || right > 15 {
+		t.Fatalf("resampled mask is misaligned: %d left, %d right", left, right)
+	}
+}
+
+func TestPDFImageRollback(t *testing.T) {
+	// At quality 30 the gradient re-encodes within the limit and
+	// the noise does not; a PNG whose dictionary declares another
+	// size fails validation. Only those two keep their bytes.
+	noise := image.NewGray(image.Rect(0, 0, 96, 64))
+	seed := uint32(1)
+	for i := range noise.Pix {
+		seed = seed*1664525 + 1013904223
+		noise.Pix[i] = byte(seed >> 24)
+	}
+	smooth, noisy := fixtureJPEG(fixtureGradient(96, 64)), fixtureJPEG(noise)
+	padded := insertPNGText(fixturePNG(fixtureGradient(32, 32)), "Comment", strings.Repeat("x", 2000))
+	dict := "/Type /XObject /Subtype /Image /Width 96 /Height 64 /BitsPerComponent 8 /Filter /DCTDecode /ColorSpace "
+	data := fixtureStreamPDF(
+		[]string{dict + "/DeviceRGB", dict + "/DeviceGray", "/Type /XObject /Subtype /Image /Width 16 /Height 16"},
+		[][]byte{smooth, noisy, padded})
+	opts := defaultPDFOptions()
+	opts.MinEmbeddedImageBytes = 0
+	opts.ImageQuality = 30
+	out := applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, opts)
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, original := range map[int][]byte{2: smooth, 3: noisy, 4: padded} {
+		if kept := bytes.Equal(doc.Objects[num].Stream, original); kept != (num != 2) {
+			t.Fatalf("image %d: kept=%v", num, kept)
+		}
+	}
+	if err := checkRecompressedImage(doc.Objects[2].Dict(), smooth[:len(smooth)/2]); err == nil {
+		t.Fatal("a truncated JPEG passed validation")
+	}
+	opts.MinImagePSNR = 0
+	if doc, err = parsePDF(applyPDFPass(t, (*pdfDocument).compressEmbeddedImages, data, opts)); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(doc.Objects[3].Stream, noisy) {
+		t.Fatal("noise kept without a loss limit")
+	}
+}
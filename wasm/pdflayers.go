@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Optional content (layers). Optional content groups (OCGs) are listed in
+// the catalog's /OCProperties, whose configurations say which are on, and
+// are referenced from content through /Properties resources ("/OC /MC0
+// BDC ... EMC") and from XObjects and annotations through /OC. The passes
+// rewrite references to replaced objects, and each level's output must
+// leave every such reference leading to a group, like destinations.
+//
+// With flattenHiddenLayers set, groups hidden in every configuration and
+// never turned on for printing or export are removed: their marked content
+// is cut from page and form content streams, XObjects drawn only for them
+// and annotations in them go, and the group leaves /OCProperties. A cut
+// section keeps the graphics and text state operators it set outside any
+// q/Q, so the content after it draws as before; a section that clips, or
+// opens inside a text object, is left in place along with its group.
+
+// Operators that change state which outlives a marked-content section;
+// kept when the section around them is cut
+var pdfStateOps = map[string]bool{
+	"cm": true, "w": true, "J": true, "j": true, "M": true, "d": true, "ri": true, "i": true, "gs": true,
+	"CS": true, "cs": true, "SC": true, "SCN": true, "sc": true, "scn": true,
+	"G": true, "g": true, "RG": true, "rg": true, "K": true, "k": true,
+	"Tc": true, "Tw": true, "Tz": true, "TL": true, "Tf": true, "Tr": true, "Ts": true,
+}
+
+// Operators whose effect ends with the section (painting, text objects,
+// marked content); dropped when it is cut
+var pdfPaintOps = map[string]bool{
+	"m": true, "l": true, "c": true, "v": true, "y": true, "h": true, "re": true,
+	"S": true, "s": true, "f": true, "F": true, "f*": true, "B": true, "B*": true, "b": true, "b*": true, "n": true,
+	"BT": true, "ET": true, "Td": true, "TD": true, "Tm": true, "T*": true, "Tj": true, "TJ": true, "'": true, "\"": true,
+	"Do": true, "sh": true, "BI": true, "MP": true, "DP": true, "BMC": true, "BDC": true, "EMC": true,
+}
+
+// Object numbers of the optional content groups /OCProperties lists
+func layerGroups(doc *pdfDocument) []int {
+	catalog := doc.catalog()
+	if catalog == nil {
+		return nil
+	}
+	props := doc.resolveDict(catalog.Vals["OCProperties"])
+	if props == nil {
+		return nil
+	}
+	var groups []int
+	forEachRef(doc.resolve(props.Vals["OCGs"]), func(num int) { groups = append(groups, num) })
+	return groups
+}
+
+// Optional content groups the default configuration hides, that no
+// alternate configuration shows and that are not turned on for printing or
+// export, by object number
+func hiddenLayers(doc *pdfDocument) map[int]bool {
+	groups := layerGroups(doc)
+	if len(groups) == 0 {
+		return nil
+	}
+	props := doc.resolveDict(doc.catalog().Vals["OCProperties"])
+
+	refSet := func(v pdfValue) map[int]bool {
+		set := map[int]bool{}
+		forEachRef(doc.resolve(v), func(num int) { set[num] = true })
+		return set
+	}
+	// Groups a configuration shows
+	shown := func(config *pdfDict) map[int]bool {
+		on, off := refSet(config.Vals["ON"]), refSet(config.Vals["OFF"])
+		visible := map[int]bool{}
+		for _, num := range groups {
+			if config.Name("BaseState") == "OFF" && on[num] || config.Name("BaseState") != "OFF" && !off[num] {
+				visible[num] = true
+			}
+		}
+		return visible
+	}
+	def := doc.resolveDict(props.Vals["D"])
+	if def == nil {
+		return nil
+	}
+	visible := shown(def)
+	for _, c := range doc.resolve(props.Vals["Configs"]).Arr {
+		if config := doc.resolveDict(c); config != nil {
+			for num := range shown(config) {
+				visible[num] = true
+			}
+		}
+	}
+	// Groups an OCMD combines: their visibility feeds another decision
+	inMembership := map[int]bool{}
+	for _, obj := range doc.Objects {
+		if dict := obj.Dict(); dict != nil && dict.Name("Type") == "OCMD" {
+			forEachRef(dict.Vals["OCGs"], func(num int) { inMembership[num] = true })
+		}
+	}
+
+	hidden := map[int]bool{}
+	for _, num := range groups {
+		obj := doc.Objects[num]
+		if obj == nil || obj.Dict() == nil || obj.Dict().Name("Type") != "OCG" || visible[num] || inMembership[num] {
+			continue
+		}
+		usage := doc.resolveDict(obj.Dict().Vals["Usage"])
+		if usage != nil {
+			printing := doc.resolveDict(usage.Vals["Print"])
+			export := doc.resolveDict(usage.Vals["Export"])
+			if printing != nil && printing.Name("PrintState") == "ON" || export != nil && export.Name("ExportState") == "ON" {
+				continue
+			}
+		}
+		hidden[num] = true
+	}
+	return hidden
+}
+
+// Number of optional content references that do not lead to a group or
+// membership dictionary: /OCProperties entries and /OC keys
+func brokenLayerRefs(doc *pdfDocument) int {
+	isOC := func(v pdfValue) bool {
+		dict := doc.resolveDict(v)
+		return dict != nil && (dict.Name("Type") == "OCG" || dict.Name("Type") == "OCMD")
+	}
+	broken := 0
+	if catalog := doc.catalog(); catalog != nil {
+		if props := doc.resolveDict(catalog.Vals["OCProperties"]); props != nil {
+			forEachRef(doc.resolve(props.Vals["OCGs"]), func(num int) {
+				if !isOC(pdfRefValue(pdfRef{Num: num})) {
+					broken++
+				}
+			})
+			configs := append([]pdfValue{props.Vals["D"]}, doc.resolve(props.Vals["Configs"]).Arr...)
+			for _, c := range configs {
+				config := doc.resolveDict(c)
+				if config == nil {
+					continue
+				}
+				for _, key := range []string{"ON", "OFF", "Order", "RBGroups", "Locked"} {
+					forEachRef(doc.resolve(config.Vals[key]), func(num int) {
+						if !isOC(pdfRefValue(pdfRef{Num: num})) {
+							broken++
+						}
+					})
+				}
+			}
+		}
+	}
+	for _, num := range doc.objectNumbers() {
+		if dict := doc.Objects[num].Dict(); dict != nil {
+			if oc, ok := dict.Get("OC"); ok && !isOC(oc) {
+				broken++
+			}
+		}
+	}
+	return broken
+}
+
+// Cut the content of layers hidden by default when
+// opts.FlattenHiddenLayers is set, unless tags must be kept
+func (doc *pdfDocument) flattenHiddenLayers(opts pdfOptions) bool {
+	if !opts.FlattenHiddenLayers || opts.keepTags {
+		return false
+	}
+	hidden := hiddenLayers(doc)
+	if len(hidden) == 0 {
+		return false
+	}
+	reachable := reachableObjects(doc)
+
+	// Content streams and the resources their names refer to. A stream
+	// drawn with two different resource dictionaries, or outside the
+	// selected pages, is left alone, and then so is every group.
+	type contentStream struct {
+		obj       *pdfObject
+		resources *pdfDict
+	}
+	var streams []contentStream
+	resourcesOf := map[int]*pdfDict{}
+	complete := opts.scope == nil
+	add := func(num int, resources *pdfDict) {
+		obj := doc.Objects[num]
+		if obj == nil || !obj.HasStream {
+			return
+		}
+		if resources == nil {
+			// A form without resources uses its page's, which may list
+			// the groups its marked content names
+			if content, err := decodeStream(doc, obj); err != nil || bytes.Contains(content, []byte("BDC")) {
+				complete = false
+			}
+			return
+		}
+		if prev, seen := resourcesOf[num]; seen {
+			if prev != resources {
+				complete = false
+				for i := range streams {
+					if streams[i].obj == obj {
+						streams = append(streams[:i], streams[i+1:]...)
+						break
+					}
+				}
+			}
+			return
+		}
+		resourcesOf[num] = resources
+		if !opts.inScope(num) {
+			complete = false
+			return
+		}
+		streams = append(streams, contentStream{obj, resources})
+	}
+	var annotated []*pdfDict
+	for _, num := range doc.pages() {
+		page := doc.Objects[num].Dict()
+		resources, _ := inheritedAttr(doc, page, "Resources")
+		forEachRef(page.Vals["Contents"], func(ref int) { add(ref, doc.resolveDict(resources)) })
+		annotated = append(annotated, page)
+	}
+	for _, num := range doc.objectNumbers() {
+		if dict := doc.Objects[num].Dict(); dict != nil && dict.Name("Subtype") == "Form" {
+			add(num, doc.resolveDict(dict.Vals["Resources"]))
+		}
+	}
+
+	kept := map[int]bool{} // hidden groups with content left in place
+	cut := 0
+	for _, s := range streams {
+		if s.obj.Dict() == nil {
+			continue
+		}
+		content, err := decodeStream(doc, s.obj)
+		if err != nil {
+			for num := range hidden {
+				kept[num] = true
+			}
+			continue
+		}
+		out, n := cutHiddenContent(doc, content, s.resources, hidden, kept)
+		if n == 0 {
+			continue
+		}
+		cut += n
+		s.obj.Stream = deflateStream(out)
+		setStreamFilters(s.obj.Dict(), []string{"FlateDecode"}, []*pdfDict{nil})
+	}
+
+	// Annotations in a hidden group are never shown either
+	annotsRemoved := 0
+	for _, page := range annotated {
+		annots := doc.resolve(page.Vals["Annots"])
+		keptAnnots := pdfValue{Kind: pdfArray}
+		for _, annot := range annots.Arr {
+			if oc := doc.resolve(annot); oc.Kind == pdfDictKind {
+				if ref, ok := oc.Dict.Get("OC"); ok && ref.Kind == pdfRefKind && hidden[ref.Ref.Num] && complete {
+					annotsRemoved++
+					continue
+				}
+			}
+			keptAnnots.Arr = append(keptAnnots.Arr, annot)
+		}
+		switch {
+		case len(keptAnnots.Arr) == len(annots.Arr):
+		case len(keptAnnots.Arr) == 0:
+			page.Delete("Annots")
+		default:
+			page.Set("Annots", keptAnnots)
+		}
+	}
+
+	layers := 0
+	if complete {
+		removed := map[int]bool{}
+		for num := range hidden {
+			if !kept[num] {
+				removed[num] = true
+			}
+		}
+		layers = removeLayers(doc, removed)
+	}
+	if cut == 0 && annotsRemoved == 0 && layers == 0 {
+		return false
+	}
+
+	after := reachableObjects(doc)
+	dropped := 0
+	for num := range reachable {
+		if !after[num] {
+			delete(doc.Objects, num)
+			dropped++
+		}
+	}
+	fmt.Printf("[WASM] Flattened %d hidden layers: %d sections and %d annotations cut, %d objects dropped\n", layers, cut, annotsRemoved, dropped)
+	trace(nil, "pdf.layers", "flattened", "layers", layers, "sections", cut, "annotations", annotsRemoved, "objects", dropped)
+	return true
+}
+
+// Cut hidden marked-content sections and hidden XObject draws out of a
+// content stream. Groups whose sections could not be cut are added to
+// kept. Returns the new content and the number of cuts.
+func cutHiddenContent(doc *pdfDocument, content []byte, resources *pdfDict, hidden, kept map[int]bool) ([]byte, int) {
+	properties := doc.resolveDict(resources.Vals["Properties"])
+	xobjects := doc.resolveDict(resources.Vals["XObject"])
+	// The group of a hidden XObject drawn by name; 0 for any other
+	hiddenXObject := func(operands []pdfValue) int {
+		if len(operands) != 1 || operands[0].Kind != pdfName || xobjects == nil {
+			return 0
+		}
+		xobj := doc.resolveDict(xobjects.Vals[operands[0].Raw])
+		if xobj == nil {
+			return 0
+		}
+		v, ok := xobj.Get("OC")
+		if !ok || v.Kind != pdfRefKind || !hidden[v.Ref.Num] {
+			return 0
+		}
+		return v.Ref.Num
+	}
+	groupOf := func(dict *pdfDict, name string) int {
+		if dict == nil {
+			return 0
+		}
+		v, ok := dict.Get(name)
+		if !ok || v.Kind != pdfRefKind || !hidden[v.Ref.Num] {
+			return 0
+		}
+		return v.Ref.Num
+	}
+
+	type cutRange struct {
+		start, end int
+		keep       []byte
+	}
+	var cuts []cutRange
+	// The hidden section being cut: where it starts, its groups (its own
+	// and those of hidden XObjects inside it), how deep marked content and
+	// q/Q are inside it, the state operators to keep and whether it can
+	// still be cut
+	type hiddenSection struct {
+		start, nest, depth int
+		groups             []int
+		keep               []byte
+		ok                 bool
+	}
+	var section *hiddenSection
+	keepGroups := func(s *hiddenSection) {
+		for _, group := range s.groups {
+			kept[group] = true
+		}
+	}
+	inText := false
+	scanContentOpsAt(content, func(op string, operands []pdfValue, start, end int) bool {
+		if section == nil {
+			switch op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+			case "BDC":
+				if len(operands) == 2 && operands[0].Raw == "OC" && operands[1].Kind == pdfName {
+					if group := groupOf(properties, operands[1].Raw); group != 0 {
+						if inText {
+							kept[group] = true
+							return true
+						}
+						section = &hiddenSection{start: start, groups: []int{group}, nest: 1, ok: true}
+					}
+				}
+			case "Do":
+				if hiddenXObject(operands) != 0 {
+					cuts = append(cuts, cutRange{start: start, end: end})
+				}
+			}
+			return true
+		}
+		if op == "Do" {
+			if group := hiddenXObject(operands); group != 0 {
+				section.groups = append(section.groups, group)
+			}
+		}
+
+		switch {
+		case op == "BMC" || op == "BDC":
+			section.nest++
+		case op == "EMC":
+			section.nest--
+		case op == "q":
+			section.depth++
+		case op == "Q":
+			section.depth--
+			section.ok = section.ok && section.depth >= 0
+		case section.depth > 0 || pdfPaintOps[op]:
+		case pdfStateOps[op]:
+			section.keep = append(append(section.keep, content[start:end]...), '\n')
+		default:
+			section.ok = false // clipping, or an operator not known to be safe
+		}
+		if section.nest == 0 {
+			if section.ok && section.depth == 0 {
+				cuts = append(cuts, cutRange{section.start, end, section.keep})
+			} else {
+				keepGroups(section)
+			}
+			section = nil
+		}
+		return true
+	})
+	if section != nil {
+		keepGroups(section)
+	}
+	if len(cuts) == 0 {
+		return content, 0
+	}
+
+	var out bytes.Buffer
+	pos := 0
+	for _, c := range cuts {
+		out.Write(content[pos:c.start])
+		out.Write(c.keep)
+		pos = c.end
+	}
+	out.Write(content[pos:])
+	return out.Bytes(), len(cuts)
+}
+
+// Drop every /Properties and /XObject resource entry that leads to a
+// removed group, then take the groups out of /OCProperties. A group still
+// referenced from elsewhere (an appearance stream, say) stays listed.
+// Returns the number of groups taken out.
+func removeLayers(doc *pdfDocument, removed map[int]bool) int {
+	if len(removed) == 0 {
+		return 0
+	}
+	leadsToRemoved := func(v pdfValue) bool {
+		if v.Kind == pdfRefKind && removed[v.Ref.Num] {
+			return true
+		}
+		dict := doc.resolveDict(v)
+		if dict == nil {
+			return false
+		}
+		oc, ok := dict.Get("OC")
+		return ok && oc.Kind == pdfRefKind && removed[oc.Ref.Num]
+	}
+	var walk func(v pdfValue, depth int)
+	walk = func(v pdfValue, depth int) {
+		if depth > 8 {
+			return
+		}
+		switch v.Kind {
+		case pdfArray:
+			for _, item := range v.Arr {
+				walk(item, depth+1)
+			}
+		case pdfDictKind:
+			for _, key := range []string{"Properties", "XObject"} {
+				if entries := doc.resolveDict(v.Dict.Vals[key]); entries != nil {
+					for _, name := range append([]string{}, entries.Keys...) {
+						if leadsToRemoved(entries.Vals[name]) {
+							entries.Delete(name)
+						}
+					}
+				}
+			}
+			for _, key := range v.Dict.Keys {
+				if item := v.Dict.Vals[key]; item.Kind != pdfRefKind {
+					walk(item, depth+1)
+				}
+			}
+		}
+	}
+	for _, obj := range doc.Objects {
+		walk(obj.Value, 0)
+	}
+
+	catalog := doc.catalog()
+	props := doc.resolveDict(catalog.Vals["OCProperties"])
+	listed := catalog.Vals["OCProperties"]
+	catalog.Vals["OCProperties"] = pdfValue{Kind: pdfNull}
+	used := reachableObjects(doc)
+	catalog.Vals["OCProperties"] = listed
+	taken := map[int]bool{}
+	for num := range removed {
+		if !used[num] {
+			taken[num] = true
+		}
+	}
+	if len(taken) == 0 {
+		return 0
+	}
+
+	var prune func(v pdfValue, depth int) pdfValue
+	prune = func(v pdfValue, depth int) pdfValue {
+		if v.Kind != pdfArray || depth > 16 {
+			return v
+		}
+		out := pdfValue{Kind: pdfArray}
+		for _, item := range v.Arr {
+			if item.Kind == pdfRefKind && taken[item.Ref.Num] {
+				continue
+			}
+			out.Arr = append(out.Arr, prune(item, depth+1))
+		}
+		return out
+	}
+	props.Set("OCGs", prune(doc.resolve(props.Vals["OCGs"]), 0))
+	for _, c := range append([]pdfValue{props.Vals["D"]}, doc.resolve(props.Vals["Configs"]).Arr...) {
+		config := doc.resolveDict(c)
+		if config == nil {
+			continue
+		}
+		for _, key := range []string{"ON", "OFF", "Order", "RBGroups", "Locked"} {
+			if v, ok := config.Get(key); ok {
+				config.Set(key, prune(doc.resolve(v), 0))
+			}
+		}
+		// Usage applications list the groups their event applies to
+		for _, app := range doc.resolve(config.Vals["AS"]).Arr {
+			if dict := doc.resolveDict(app); dict != nil {
+				if v, ok := dict.Get("OCGs"); ok {
+					dict.Set("OCGs", prune(doc.resolve(v), 0))
+				}
+			}
+		}
+	}
+	if len(doc.resolve(props.Vals["OCGs"]).Arr) == 0 {
+		catalog.Delete("OCProperties")
+	}
+	return len(taken)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestPDFLayers(t *testing.T) {
+	// Layer 10 is on, 11 hidden and 12 hidden but clipping. 11's
+	// section, image and annotation go, keeping the color and font
+	// it set; 12 stays because its clip would outlive a cut.
+	content := "/OC /MC0 BDC q 1 0 0 rg 0 0 10 10 re f Q EMC\n" +
+		"/OC /MC1 BDC 0 0 1 rg 0 0 20 20 re f BT /F1 12 Tf 5 5 Td (Secret) Tj ET EMC\n" +
+		"/OC /MC2 BDC 0 0 50 50 re W n 0 0 5 5 re f EMC\n" +
+		"/Im1 Do\n0 0 30 30 re f\n"
+	objs := map[int]string{
+		1:  "<< /Type /Catalog /Pages 2 0 R /OCProperties << /OCGs [10 0 R 11 0 R 12 0 R] /D << /Order [10 0 R 11 0 R 12 0 R] /OFF [11 0 R 12 0 R] >> >> >>",
+		2:  "<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		3:  "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Contents 4 0 R /Annots [6 0 R] /Resources << /Properties << /MC0 10 0 R /MC1 11 0 R /MC2 12 0 R >> /XObject << /Im1 5 0 R >> >> >>",
+		6:  "<< /Type /Annot /Subtype /Square /Rect [0 0 10 10] /OC 11 0 R >>",
+		10: "<< /Type /OCG /Name (Visible) >>",
+		11: "<< /Type /OCG /Name (Hidden) >>",
+		12: "<< /Type /OCG /Name (Clipped) >>",
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.5\n")
+	for _, num := range []int{1, 2, 3, 6, 10, 11, 12} {
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", num, objs[num])
+	}
+	fmt.Fprintf(buf, "4 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+	buf.WriteString("5 0 obj\n<< /Type /XObject /Subtype /Image /Width 2 /Height 2 /ColorSpace /DeviceGray /BitsPerComponent 8 /OC 11 0 R /Length 4 >>\nstream\n\x00\x40\x80\xff\nendstream\nendobj\n")
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	data := buf.Bytes()
+
+	doc, err := parsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hidden := hiddenLayers(doc); len(hidden) != 2 || !hidden[11] || !hidden[12] {
+		t.Fatalf("hidden layers found as %v", hidden)
+	}
+	baseline := pdfBaselineOf(doc, defaultPDFOptions())
+	delete(doc.Objects, 11)
+	broken, err := doc.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.checkBytes(broken) == nil {
+		t.Fatal("a missing layer passed the check")
+	}
+
+	opts := defaultPDFOptions()
+	opts.FlattenHiddenLayers = true
+	res, err := runPDFFallbackChain(context.Background(), data, opts, func(int) {})
+	if err != nil || res.Level != pdfLevelFull {
+		t.Fatalf("level %s: %v %v", res.Level, err, res.Attempts)
+	}
+	if doc, err = parsePDF(res.Data); err != nil {
+		t.Fatal(err)
+	}
+	out, err := decodeStream(doc, doc.Objects[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/OC /MC0 BDC q 1 0 0 rg 0 0 10 10 re f Q EMC\n" +
+		"0 0 1 rg\n/F1 12 Tf\n\n" +
+		"/OC /MC2 BDC 0 0 50 50 re W n 0 0 5 5 re f EMC\n" +
+		"\n0 0 30 30 re f\n"
+	if string(out) != want {
+		t.Fatalf("content flattened to %q", out)
+	}
+	if groups := layerGroups(doc); fmt.Sprint(groups) != "[10 12]" || doc.Objects[11] != nil || doc.Objects[5] != nil || doc.Objects[6] != nil {
+		t.Fatalf("layers left as %v", groups)
+	}
+	if a := collectPDFActions(data, res); a.LayersRemoved != 1 {
+		t.Fatalf("report counts %d layers removed", a.LayersRemoved)
+	}
+}
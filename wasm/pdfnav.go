@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Bookmarks, internal links and named destinations. The rewrite keeps
+// object numbers and the passes that replace objects rewrite every
+// reference to them, so navigation normally survives as it is; each
+// level's output is still checked, and a level that leaves a bookmark or
+// link pointing nowhere fails like one that loses a page. With
+// dropNavigation set they are removed instead, along with the objects only
+// they used. External (URI) links and other annotations stay.
+
+// Bound on outline items and name tree nodes visited
+const maxNavigationNodes = 100000
+
+// Navigation found in a document
+type pdfNavigation struct {
+	Outlines []*pdfDict          // outline items, in reading order
+	Links    []*pdfDict          // link annotations with an internal target
+	Named    map[string]pdfValue // named destinations and their targets
+	Open     []pdfValue          // the catalog's /OpenAction, when it is a go-to
+}
+
+func findNavigation(doc *pdfDocument) pdfNavigation {
+	nav := pdfNavigation{Named: map[string]pdfValue{}}
+	catalog := doc.catalog()
+	if catalog == nil {
+		return nav
+	}
+
+	if outlines := doc.resolveDict(catalog.Vals["Outlines"]); outlines != nil {
+		visited := map[*pdfDict]bool{}
+		var walk func(item pdfValue)
+		walk = func(item pdfValue) {
+			for len(visited) < maxNavigationNodes {
+				dict := doc.resolveDict(item)
+				if dict == nil || visited[dict] {
+					return
+				}
+				visited[dict] = true
+				nav.Outlines = append(nav.Outlines, dict)
+				walk(dict.Vals["First"])
+				item = dict.Vals["Next"]
+			}
+		}
+		walk(outlines.Vals["First"])
+	}
+
+	// Old-style /Dests dictionary, then the /Names /Dests tree
+	if dests := doc.resolveDict(catalog.Vals["Dests"]); dests != nil {
+		for _, key := range dests.Keys {
+			nav.Named[key] = dests.Vals[key]
+		}
+	}
+	if names := doc.resolveDict(catalog.Vals["Names"]); names != nil {
+		visited := 0
+		var walk func(node *pdfDict, depth int)
+		walk = func(node *pdfDict, depth int) {
+			if node == nil || depth > 32 || visited >= maxNavigationNodes {
+				return
+			}
+			visited++
+			pairs := doc.resolve(node.Vals["Names"])
+			for i := 0; i+1 < len(pairs.Arr); i += 2 {
+				if key := doc.resolve(pairs.Arr[i]); key.Kind == pdfString || key.Kind == pdfHexString {
+					nav.Named[string(key.Str)] = pairs.Arr[i+1]
+				}
+			}
+			for _, kid := range doc.resolve(node.Vals["Kids"]).Arr {
+				walk(doc.resolveDict(kid), depth+1)
+			}
+		}
+		walk(doc.resolveDict(names.Vals["Dests"]), 0)
+	}
+
+	for _, num := range doc.pages() {
+		for _, annot := range doc.resolve(doc.Objects[num].Dict().Vals["Annots"]).Arr {
+			if dict := doc.resolveDict(annot); dict != nil && dict.Name("Subtype") == "Link" && isInternalLink(doc, dict) {
+				nav.Links = append(nav.Links, dict)
+			}
+		}
+	}
+
+	if open := doc.resolve(catalog.Vals["OpenAction"]); open.Kind == pdfArray {
+		nav.Open = append(nav.Open, open)
+	} else if open.Kind == pdfDictKind && open.Dict.Name("S") == "GoTo" {
+		nav.Open = append(nav.Open, open.Dict.Vals["D"])
+	}
+	return nav
+}
+
+// Whether a link annotation or outline item goes somewhere in this
+// document: a /Dest, or a GoTo action
+func isInternalLink(doc *pdfDocument, dict *pdfDict) bool {
+	_, ok := navigationTarget(doc, dict)
+	return ok
+}
+
+// The destination of a link or outline item; ok is false when it has none
+// in this document (a URI, a remote go-to or nothing)
+func navigationTarget(doc *pdfDocument, dict *pdfDict) (pdfValue, bool) {
+	if dest, ok := dict.Get("Dest"); ok {
+		return dest, true
+	}
+	action := doc.resolveDict(dict.Vals["A"])
+	if action == nil || action.Name("S") != "GoTo" {
+		return pdfValue{}, false
+	}
+	dest, ok := action.Get("D")
+	return dest, ok
+}
+
+// Number of bookmarks, links, named destinations and open actions whose
+// destination is not a page of the document
+func brokenDestinations(doc *pdfDocument) int {
+	nav := findNavigation(doc)
+	pages := map[int]bool{}
+	for _, num := range doc.pages() {
+		pages[num] = true
+	}
+	// An explicit destination is an array starting with the page
+	explicit := func(dest pdfValue) bool {
+		dest = doc.resolve(dest)
+		if dest.Kind == pdfDictKind {
+			dest = doc.resolve(dest.Dict.Vals["D"])
+		}
+		if dest.Kind != pdfArray || len(dest.Arr) == 0 {
+			return false
+		}
+		return dest.Arr[0].Kind == pdfRefKind && pages[dest.Arr[0].Ref.Num]
+	}
+	resolves := func(dest pdfValue) bool {
+		dest = doc.resolve(dest)
+		switch dest.Kind {
+		case pdfName:
+			dest = nav.Named[dest.Raw]
+		case pdfString, pdfHexString:
+			dest = nav.Named[string(dest.Str)]
+		}
+		return explicit(dest)
+	}
+
+	broken := 0
+	for _, item := range append(append([]*pdfDict{}, nav.Outlines...), nav.Links...) {
+		if dest, ok := navigationTarget(doc, item); ok && !resolves(dest) {
+			broken++
+		}
+	}
+	for _, dest := range nav.Named {
+		if !explicit(dest) {
+			broken++
+		}
+	}
+	for _, dest := range nav.Open {
+		if !resolves(dest) {
+			broken++
+		}
+	}
+	return broken
+}
+
+// Remove bookmarks, internal links and named destinations when
+// opts.DropNavigation is set
+func (doc *pdfDocument) dropNavigation(opts pdfOptions) bool {
+	if !opts.DropNavigation {
+		return false
+	}
+	catalog := doc.catalog()
+	if catalog == nil {
+		return false
+	}
+	nav := findNavigation(doc)
+	if len(nav.Outlines) == 0 && len(nav.Links) == 0 && len(nav.Named) == 0 {
+		return false
+	}
+	reachable := reachableObjects(doc)
+
+	links := map[*pdfDict]bool{}
+	for _, link := range nav.Links {
+		// The structure tree of a tagged document may point at the link
+		if _, tagged := link.Get("StructParent"); !tagged || !opts.keepTags {
+			links[link] = true
+		}
+	}
+	named := len(nav.Named)
+	catalog.Delete("Outlines")
+	if catalog.Name("PageMode") == "UseOutlines" {
+		catalog.Delete("PageMode")
+	}
+	// Links kept for the structure tree may go to named destinations
+	if len(links) == len(nav.Links) {
+		catalog.Delete("Dests")
+		if names := doc.resolveDict(catalog.Vals["Names"]); names != nil {
+			names.Delete("Dests")
+			if len(names.Keys) == 0 {
+				catalog.Delete("Names")
+			}
+		}
+		// An open action naming a destination would now point nowhere
+		if open := doc.resolve(catalog.Vals["OpenAction"]); open.Kind == pdfDictKind && open.Dict.Name("S") == "GoTo" {
+			if d := doc.resolve(open.Dict.Vals["D"]); d.Kind != pdfArray {
+				catalog.Delete("OpenAction")
+			}
+		}
+	} else {
+		named = 0
+	}
+	for _, num := range doc.pages() {
+		page := doc.Objects[num].Dict()
+		annots := doc.resolve(page.Vals["Annots"])
+		kept := pdfValue{Kind: pdfArray}
+		for _, annot := range annots.Arr {
+			if !links[doc.resolveDict(annot)] {
+				kept.Arr = append(kept.Arr, annot)
+			}
+		}
+		switch {
+		case len(kept.Arr) == len(annots.Arr):
+		case len(kept.Arr) == 0:
+			page.Delete("Annots")
+		default:
+			page.Set("Annots", kept)
+		}
+	}
+
+	// Objects only navigation used: outline items, destinations, actions
+	after := reachableObjects(doc)
+	removed := 0
+	for num := range reachable {
+		if !after[num] {
+			delete(doc.Objects, num)
+			removed++
+		}
+	}
+
+	fmt.Printf("[WASM] Dropped %d bookmarks, %d internal links and %d named destinations (%d objects)\n",
+		len(nav.Outlines), len(links), named, removed)
+	trace(nil, "pdf.navigation", "dropped", "outlines", len(nav.Outlines), "links", len(links), "named", named, "objects", removed)
+	return true
+}
+
+// Objects reachable from the trailer
+func reachableObjects(doc *pdfDocument) map[int]bool {
+	seen := map[int]bool{}
+	var stack []int
+	push := func(v pdfValue) {
+		forEachRef(v, func(num int) {
+			if !seen[num] && doc.Objects[num] != nil {
+				seen[num] = true
+				stack = append(stack, num)
+			}
+		})
+	}
+	for _, key := range doc.Trailer.Keys {
+		push(doc.Trailer.Vals[key])
+	}
+	for len(stack) > 0 {
+		num := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		push(doc.Objects[num].Value)
+	}
+	return seen
+}
+
+// Call fn with the object number of every reference inside v, in key order
+func forEachRef(v pdfValue, fn func(int)) {
+	switch v.Kind {
+	case pdfRefKind:
+		fn(v.Ref.Num)
+	case pdfArray:
+		for _, item := range v.Arr {
+			forEachRef(item, fn)
+		}
+	case pdfDictKind:
+		if v.Dict != nil {
+			keys := append([]string{}, v.Dict.Keys...)
+			sort.Strings(keys)
+			for _, key := range keys {
+				forEachRef(v.Dict.Vals[key], fn)
+			}
+		}
+	}
+}
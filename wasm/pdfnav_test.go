@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestPDFNavigation(t *testing.T) {
+	// Two bookmarks (explicit and named), a named link and a URI
+	// link survive the chain; a broken bookmark fails the check;
+	// dropNavigation removes all but the URI link
+	objs := []string{
+		"<< /Type /Catalog /Pages 2 0 R /Outlines 5 0 R /Names << /Dests 8 0 R >> /PageMode /UseOutlines >>",
+		"<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Contents 11 0 R /Annots [9 0 R 10 0 R] >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Contents 11 0 R >>",
+		"<< /Type /Outlines /First 6 0 R /Last 7 0 R /Count 2 >>",
+		"<< /Title (One) /Parent 5 0 R /Next 7 0 R /Dest [3 0 R /Fit] >>",
+		"<< /Title (Two) /Parent 5 0 R /Prev 6 0 R /A << /S /GoTo /D (chap2) >> >>",
+		"<< /Names [(chap2) [4 0 R /XYZ 0 100 0]] >>",
+		"<< /Type /Annot /Subtype /Link /Rect [0 0 50 20] /Dest (chap2) >>",
+		"<< /Type /Annot /Subtype /Link /Rect [0 20 50 40] /A << /S /URI /URI (https://example.com/) >> >>",
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.4\n")
+	for i, obj := range objs {
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	content := bytes.Repeat([]byte("0 0 1 rg 10 10 50 50 re f\n"), 20)
+	fmt.Fprintf(buf, "11 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	data := buf.Bytes()
+
+	doc, err := parsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nav := findNavigation(doc)
+	if len(nav.Outlines) != 2 || len(nav.Links) != 1 || len(nav.Named) != 1 || brokenDestinations(doc) != 0 {
+		t.Fatalf("navigation found as %d outlines, %d links, %d named, %d broken",
+			len(nav.Outlines), len(nav.Links), len(nav.Named), brokenDestinations(doc))
+	}
+	baseline := pdfBaselineOf(doc, defaultPDFOptions())
+	doc.Objects[6].Dict().Set("Dest", pdfValue{Kind: pdfArray, Arr: []pdfValue{pdfRefValue(pdfRef{Num: 99}), pdfNameValue("Fit")}})
+	broken, err := doc.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.checkBytes(broken) == nil {
+		t.Fatal("a bookmark pointing nowhere passed the check")
+	}
+
+	res, err := runPDFFallbackChain(context.Background(), data, defaultPDFOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err = parsePDF(res.Data); err != nil {
+		t.Fatal(err)
+	}
+	if nav := findNavigation(doc); len(nav.Outlines) != 2 || len(nav.Links) != 1 || brokenDestinations(doc) != 0 {
+		t.Fatal("navigation lost by the default chain")
+	}
+
+	opts := defaultPDFOptions()
+	opts.DropNavigation = true
+	out := applyPDFPass(t, (*pdfDocument).dropNavigation, data, opts)
+	if doc, err = parsePDF(out); err != nil {
+		t.Fatal(err)
+	}
+	nav = findNavigation(doc)
+	annots := doc.resolve(doc.Objects[3].Dict().Vals["Annots"])
+	if len(nav.Outlines)+len(nav.Links)+len(nav.Named) != 0 || len(annots.Arr) != 1 || doc.Objects[6] != nil || doc.Objects[8] != nil {
+		t.Fatal("navigation not dropped cleanly")
+	}
+	a := collectPDFActions(data, fixturePDFResult(data, out))
+	if a.BookmarksRemoved != 2 || a.LinksRemoved != 1 {
+		t.Fatalf("report counts %d bookmarks, %d links removed", a.BookmarksRemoved, a.LinksRemoved)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Page-range scoping ({pages: "1-10,15"}) limits the per-object passes
+// (image sharing, image recompression, font merging, stream recoding) to
+// objects only the selected pages use, so the streams of other pages keep
+// their bytes, though every object is still re-serialized and the
+// document-wide passes (information dictionary, catalog XMP) still run.
+
+// One range of 1-based pages; Last is 0 for an open range ("5-")
+type pageRange struct {
+	First, Last int
+}
+
+// Parse a comma-separated list of pages and ranges: "1-10,15,20-"
+func parsePageRanges(spec string) ([]pageRange, error) {
+	var ranges []pageRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		r := pageRange{}
+		var err error
+		if r.First, err = strconv.Atoi(strings.TrimSpace(first)); err != nil || r.First < 1 {
+			return nil, fmt.Errorf("invalid page range %q", part)
+		}
+		switch {
+		case !isRange:
+			r.Last = r.First
+		case strings.TrimSpace(last) != "":
+			if r.Last, err = strconv.Atoi(strings.TrimSpace(last)); err != nil || r.Last < r.First {
+				return nil, fmt.Errorf("invalid page range %q", part)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("pages selects no pages")
+	}
+	return ranges, nil
+}
+
+func (r pageRange) contains(page int) bool {
+	return page >= r.First && (r.Last == 0 || page <= r.Last)
+}
+
+// Objects only the selected pages use: everything reachable from their
+// resources and content streams that no other page reaches
+func pageScope(doc *pdfDocument, spec string) (map[int]bool, error) {
+	ranges, err := parsePageRanges(spec)
+	if err != nil {
+		return nil, err
+	}
+	pages := doc.pages()
+	for _, r := range ranges {
+		if r.First > len(pages) {
+			return nil, fmt.Errorf("page %d is out of range, the document has %d pages", r.First, len(pages))
+		}
+	}
+
+	used, elsewhere := map[int]bool{}, map[int]bool{}
+	for i, num := range pages {
+		page := doc.Objects[num].Dict()
+		selected := false
+		for _, r := range ranges {
+			selected = selected || r.contains(i+1)
+		}
+		resources, _ := inheritedAttr(doc, page, "Resources")
+		if selected {
+			contents, _ := page.Get("Contents")
+			collectObjects(doc, resources, used, 0)
+			collectObjects(doc, contents, used, 0)
+			continue
+		}
+		// Annotations, thumbnails and anything else count for the
+		// other pages
+		collectObjects(doc, resources, elsewhere, 0)
+		collectObjects(doc, pdfDictValue(page), elsewhere, 0)
+	}
+	scope := map[int]bool{}
+	for num := range used {
+		if !elsewhere[num] {
+			scope[num] = true
+		}
+	}
+	return scope, nil
+}
+
+// Add every object a value references, directly or not, without crossing
+// into the page tree
+func collectObjects(doc *pdfDocument, v pdfValue, into map[int]bool, depth int) {
+	if depth > 64 {
+		return
+	}
+	switch v.Kind {
+	case pdfRefKind:
+		obj := doc.Objects[v.Ref.Num]
+		if obj == nil || into[v.Ref.Num] {
+			return
+		}
+		if dict := obj.Dict(); dict != nil {
+			if t := dict.Name("Type"); t == "Page" || t == "Pages" {
+				return
+			}
+		}
+		into[v.Ref.Num] = true
+		collectObjects(doc, obj.Value, into, depth+1)
+	case pdfArray:
+		for _, item := range v.Arr {
+			collectObjects(doc, item, into, depth+1)
+		}
+	case pdfDictKind:
+		if v.Dict == nil {
+			return
+		}
+		for _, key := range v.Dict.Keys {
+			if key != "Parent" {
+				collectObjects(doc, v.Dict.Vals[key], into, depth+1)
+			}
+		}
+	}
+}
+
+// Objects each page uses, in page order
+func pageObjects(doc *pdfDocument) [][]int {
+	pages := doc.pages()
+	out := make([][]int, len(pages))
+	for i, num := range pages {
+		page := doc.Objects[num].Dict()
+		used := map[int]bool{}
+		resources, _ := inheritedAttr(doc, page, "Resources")
+		contents, _ := page.Get("Contents")
+		collectObjects(doc, resources, used, 0)
+		collectObjects(doc, contents, used, 0)
+		for num := range used {
+			out[i] = append(out[i], num)
+		}
+		sort.Ints(out[i])
+	}
+	return out
+}
+
+// Every object number, those each page uses first in page order and the
+// ones no page uses last. pageEnds[i] is where page i+1's objects end in
+// order.
+func pageOrder(doc *pdfDocument) (order []int, pageEnds []int) {
+	seen := map[int]bool{}
+	for _, objs := range pageObjects(doc) {
+		for _, num := range objs {
+			if !seen[num] {
+				seen[num] = true
+				order = append(order, num)
+			}
+		}
+		pageEnds = append(pageEnds, len(order))
+	}
+	for _, num := range doc.objectNumbers() {
+		if !seen[num] {
+			order = append(order, num)
+		}
+	}
+	return order, pageEnds
+}
+
+// Stored size of one page and what compression made of it
+type pdfPageStat struct {
+	Page           int `json:"page"`
+	OriginalSize   int `json:"originalSize"`
+	CompressedSize int `json:"compressedSize"`
+}
+
+// Bytes of the objects each page uses; an object shared by several pages
+// is split evenly between them
+func pageBytes(doc *pdfDocument) []int {
+	perPage := pageObjects(doc)
+	users := map[int]int{}
+	for _, objs := range perPage {
+		for _, num := range objs {
+			users[num]++
+		}
+	}
+	sizes := make([]int, len(perPage))
+	for i, objs := range perPage {
+		total := 0.0
+		for _, num := range objs {
+			obj := doc.Objects[num]
+			var buf bytes.Buffer
+			writePDFValue(&buf, obj.Value)
+			total += float64(buf.Len()+len(obj.Stream)) / float64(users[num])
+		}
+		sizes[i] = int(math.Round(total))
+	}
+	return sizes
+}
+
+// Per-page sizes of the input and output of compressPDFData; nil when
+// either did not parse or their page counts differ
+func pageStats(res pdfResult) []pdfPageStat {
+	before, after := res.Original, res.Output
+	if before == nil || after == nil || before.Encrypted {
+		return nil
+	}
+	original, compressed := pageBytes(before), pageBytes(after)
+	if len(original) != len(compressed) {
+		return nil
+	}
+	stats := make([]pdfPageStat, len(original))
+	for i := range stats {
+		stats[i] = pdfPageStat{Page: i + 1, OriginalSize: original[i], CompressedSize: compressed[i]}
+	}
+	return stats
+}
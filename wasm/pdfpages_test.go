@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestPDFPageScope(t *testing.T) {
+	// Pages 1-2 of three: their own content and images are recoded,
+	// page 3 and the image it shares with page 1 keep their bytes
+	for _, bad := range []string{"3-1", "0", "a-b", ","} {
+		if _, err := parsePageRanges(bad); err == nil {
+			t.Fatalf("page range %q was accepted", bad)
+		}
+	}
+	content, samples := fixturePageStreams()
+	data := fixtureThreePagePDF(content, samples)
+
+	doc, err := parsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pageScope(doc, "4"); err == nil {
+		t.Fatal("a page past the end was accepted")
+	}
+	opts := defaultPDFOptions()
+	if opts.scope, err = pageScope(doc, "1-2"); err != nil {
+		t.Fatal(err)
+	}
+	out := applyPDFPass(t, (*pdfDocument).recodeStreams, data, opts)
+	if doc, err = parsePDF(out); err != nil {
+		t.Fatal(err)
+	}
+	for num, recoded := range map[int]bool{6: true, 7: true, 8: false, 9: false, 10: true} {
+		if got := doc.Objects[num].Dict().Name("Filter") == "FlateDecode"; got != recoded {
+			t.Fatalf("object %d: recoded=%v, want %v", num, got, recoded)
+		}
+	}
+	if !bytes.Equal(doc.Objects[9].Stream, samples) || !bytes.Equal(doc.Objects[8].Stream, content) {
+		t.Fatal("objects outside the selected pages changed")
+	}
+}
+
+func TestPDFPageStats(t *testing.T) {
+	// Image 9 is split between pages 1 and 3; page 2 has image 10
+	// to itself. Every level with the image pass reports pages 1-3
+	// in order, inside its share of the progress.
+	data := fixtureThreePagePDF(fixturePageStreams())
+	opts := defaultPDFOptions()
+	var reported []int
+	last := 0
+	opts.reportPage = func(p, page, pages int) {
+		if pages != 3 || p < last || p < 20 || p > 90 {
+			reported = append(reported, -1)
+		}
+		last = p
+		reported = append(reported, page)
+	}
+	res, err := runPDFFallbackChain(context.Background(), data, opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(reported) != "[1 2 3]" {
+		t.Fatalf("pages reported as %v", reported)
+	}
+
+	stats := pageStats(res)
+	if len(stats) != 3 {
+		t.Fatalf("%d page stats", len(stats))
+	}
+	if stats[0].OriginalSize != stats[2].OriginalSize || stats[1].OriginalSize <= stats[0].OriginalSize {
+		t.Fatalf("shared image not split: %+v", stats)
+	}
+	for _, s := range stats {
+		if s.CompressedSize >= s.OriginalSize {
+			t.Fatalf("page %d not smaller: %+v", s.Page, s)
+		}
+	}
+}
@@ -0,0 +1,932 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Kinds of PDF values
+type pdfKind uint8
+
+const (
+	pdfNull pdfKind = iota
+	pdfBool
+	pdfNumber
+	pdfString
+	pdfHexString
+	pdfName
+	pdfArray
+	pdfDictKind
+	pdfRefKind
+)
+
+// Indirect object reference "N G R"
+type pdfRef struct {
+	Num, Gen int
+}
+
+// A parsed PDF value. Numbers and booleans keep their source text in Raw
+// so they serialize back unchanged; names keep their decoded text there.
+type pdfValue struct {
+	Kind pdfKind
+	Raw  string
+	Str  []byte
+	Arr  []pdfValue
+	Dict *pdfDict
+	Ref  pdfRef
+}
+
+// Dictionary preserving key order for stable re-serialization
+type pdfDict struct {
+	Keys []string
+	Vals map[string]pdfValue
+}
+
+func newPDFDict() *pdfDict {
+	return &pdfDict{Vals: map[string]pdfValue{}}
+}
+
+func (d *pdfDict) Get(key string) (pdfValue, bool) {
+	if d == nil {
+		return pdfValue{}, false
+	}
+	v, ok := d.Vals[key]
+	return v, ok
+}
+
+func (d *pdfDict) Set(key string, v pdfValue) {
+	if _, ok := d.Vals[key]; !ok {
+		d.Keys = append(d.Keys, key)
+	}
+	d.Vals[key] = v
+}
+
+func (d *pdfDict) Delete(key string) {
+	if _, ok := d.Vals[key]; !ok {
+		return
+	}
+	delete(d.Vals, key)
+	for i, k := range d.Keys {
+		if k == key {
+			d.Keys = append(d.Keys[:i], d.Keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Name value of key, or "" when absent or not a name
+func (d *pdfDict) Name(key string) string {
+	if v, ok := d.Get(key); ok && v.Kind == pdfName {
+		return v.Raw
+	}
+	return ""
+}
+
+// Shallow copy; values are shared
+func (d *pdfDict) Clone() *pdfDict {
+	c := &pdfDict{Keys: append([]string(nil), d.Keys...), Vals: make(map[string]pdfValue, len(d.Vals))}
+	for k, v := range d.Vals {
+		c.Vals[k] = v
+	}
+	return c
+}
+
+// Copy of d with every value copied as well
+func (d *pdfDict) deepClone() *pdfDict {
+	c := d.Clone()
+	for k, v := range c.Vals {
+		c.Vals[k] = v.clone()
+	}
+	return c
+}
+
+func pdfNameValue(name string) pdfValue { return pdfValue{Kind: pdfName, Raw: name} }
+func pdfIntValue(n int) pdfValue        { return pdfValue{Kind: pdfNumber, Raw: strconv.Itoa(n)} }
+func pdfRefValue(r pdfRef) pdfValue     { return pdfValue{Kind: pdfRefKind, Ref: r} }
+func pdfDictValue(d *pdfDict) pdfValue  { return pdfValue{Kind: pdfDictKind, Dict: d} }
+
+// Deep copy of an array or dictionary value. String bytes are shared, as
+// nothing edits them in place.
+func (v pdfValue) clone() pdfValue {
+	switch {
+	case v.Kind == pdfArray:
+		arr := make([]pdfValue, len(v.Arr))
+		for i, item := range v.Arr {
+			arr[i] = item.clone()
+		}
+		v.Arr = arr
+	case v.Kind == pdfDictKind && v.Dict != nil:
+		v.Dict = v.Dict.deepClone()
+	}
+	return v
+}
+
+// Integer value of a number, ok=false for non-numbers
+func (v pdfValue) Int() (int, bool) {
+	if v.Kind != pdfNumber {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v.Raw); err == nil {
+		return n, true
+	}
+	f, err := strconv.ParseFloat(v.Raw, 64)
+	return int(f), err == nil
+}
+
+// Float value of a number, ok=false for non-numbers
+func (v pdfValue) Float() (float64, bool) {
+	if v.Kind != pdfNumber {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v.Raw, 64)
+	return f, err == nil
+}
+
+// One indirect object. Stream aliases either the source buffer or, once
+// rewritten, a new slice owned by the object.
+type pdfObject struct {
+	Num, Gen  int
+	Value     pdfValue
+	Stream    []byte
+	HasStream bool
+	Offset    int  // offset of the "N G obj" header (of the ObjStm for packed objects)
+	InObjStm  bool // object was unpacked from a compressed object stream
+}
+
+// Stream dictionary (nil for non-stream objects)
+func (o *pdfObject) Dict() *pdfDict {
+	if o.Value.Kind == pdfDictKind {
+		return o.Value.Dict
+	}
+	return nil
+}
+
+// A parsed document. Parsing is lenient: damaged regions are skipped and
+// counted so callers can decide whether the result is trustworthy.
+type pdfDocument struct {
+	Data      []byte
+	Version   string
+	Objects   map[int]*pdfObject
+	Trailer   *pdfDict
+	Encrypted bool
+
+	LengthMismatches int // streams whose /Length did not match the data
+	Repairs          int // places where the parser had to resynchronize
+
+	headers map[pdfRef][]int // "N G obj" offsets in the file, built on first use
+}
+
+// A copy of doc whose objects and trailer can be edited without touching
+// doc. Stream data is shared: passes replace a stream, never write into it.
+func (doc *pdfDocument) clone() *pdfDocument {
+	c := *doc
+	c.Objects = make(map[int]*pdfObject, len(doc.Objects))
+	for num, obj := range doc.Objects {
+		o := *obj
+		o.Value = obj.Value.clone()
+		c.Objects[num] = &o
+	}
+	c.Trailer = doc.Trailer.deepClone()
+	return &c
+}
+
+var errNotPDF = errors.New("not a PDF file")
+
+// Byte-level tokenizer shared by the object parser and content scanners
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFWhitespace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func isPDFRegular(c byte) bool {
+	return !isPDFWhitespace(c) && !isPDFDelimiter(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Skip whitespace and comments
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isPDFWhitespace(c) {
+			l.pos++
+			continue
+		}
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		return
+	}
+}
+
+// Read a run of regular characters (keyword or number)
+func (l *pdfLexer) readRegular() string {
+	start := l.pos
+	for l.pos < len(l.data) && isPDFRegular(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+// Consume kw if it is the next token
+func (l *pdfLexer) acceptKeyword(kw string) bool {
+	l.skipSpace()
+	end := l.pos + len(kw)
+	if end > len(l.data) || string(l.data[l.pos:end]) != kw {
+		return false
+	}
+	if end < len(l.data) && isPDFRegular(l.data[end]) {
+		return false
+	}
+	l.pos = end
+	return true
+}
+
+func isPDFInteger(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	for i := 0; i < len(tok); i++ {
+		if !isDigit(tok[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse the next value; depth guards against hostile nesting
+func (l *pdfLexer) parseValue(depth int) (pdfValue, error) {
+	if depth > 64 {
+		return pdfValue{}, errors.New("nesting too deep")
+	}
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return pdfValue{}, errors.New("unexpected end of data")
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		l.pos++
+		return pdfValue{Kind: pdfName, Raw: decodePDFName(l.readRegular())}, nil
+
+	case c == '(':
+		s, err := l.readLiteralString()
+		return pdfValue{Kind: pdfString, Str: s}, err
+
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		d, err := l.parseDictBody(depth)
+		return pdfValue{Kind: pdfDictKind, Dict: d}, err
+
+	case c == '<':
+		s, err := l.readHexString()
+		return pdfValue{Kind: pdfHexString, Str: s}, err
+
+	case c == '[':
+		l.pos++
+		var items []pdfValue
+		for {
+			l.skipSpace()
+			if l.pos >= len(l.data) {
+				return pdfValue{Kind: pdfArray, Arr: items}, errors.New("unterminated array")
+			}
+			if l.data[l.pos] == ']' {
+				l.pos++
+				return pdfValue{Kind: pdfArray, Arr: items}, nil
+			}
+			item, err := l.parseValue(depth + 1)
+			if err != nil {
+				return pdfValue{Kind: pdfArray, Arr: items}, err
+			}
+			items = append(items, item)
+		}
+
+	case isDigit(c) || c == '+' || c == '-' || c == '.':
+		tok := l.readRegular()
+		if isPDFInteger(tok) {
+			// Could be the start of "N G R"
+			save := l.pos
+			l.skipSpace()
+			if l.pos < len(l.data) && isDigit(l.data[l.pos]) {
+				gen := l.readRegular()
+				if isPDFInteger(gen) && l.acceptKeyword("R") {
+					num, _ := strconv.Atoi(tok)
+					g, _ := strconv.Atoi(gen)
+					return pdfRefValue(pdfRef{num, g}), nil
+				}
+			}
+			l.pos = save
+		}
+		if _, err := strconv.ParseFloat(tok, 64); err != nil {
+			// Tolerate malformed numbers like "--1" that some writers emit
+			return pdfValue{Kind: pdfNumber, Raw: "0"}, nil
+		}
+		return pdfValue{Kind: pdfNumber, Raw: tok}, nil
+	}
+
+	tok := l.readRegular()
+	switch tok {
+	case "true", "false":
+		return pdfValue{Kind: pdfBool, Raw: tok}, nil
+	case "null":
+		return pdfValue{Kind: pdfNull}, nil
+	case "":
+		l.pos++
+		return pdfValue{}, fmt.Errorf("unexpected character %q", c)
+	}
+	return pdfValue{}, fmt.Errorf("unexpected keyword %q", tok)
+}
+
+// Parse dictionary entries after the opening "<<"
+func (l *pdfLexer) parseDictBody(depth int) (*pdfDict, error) {
+	d := newPDFDict()
+	for {
+		l.skipSpace()
+		if l.pos+1 >= len(l.data) {
+			return d, errors.New("unterminated dictionary")
+		}
+		if l.data[l.pos] == '>' && l.data[l.pos+1] == '>' {
+			l.pos += 2
+			return d, nil
+		}
+		if l.data[l.pos] != '/' {
+			return d, fmt.Errorf("dictionary key expected at offset %d", l.pos)
+		}
+		l.pos++
+		key := decodePDFName(l.readRegular())
+
+		l.skipSpace()
+		if l.pos+1 < len(l.data) && l.data[l.pos] == '>' && l.data[l.pos+1] == '>' {
+			// Key without a value: treat as null like most readers
+			d.Set(key, pdfValue{Kind: pdfNull})
+			continue
+		}
+		v, err := l.parseValue(depth + 1)
+		if err != nil {
+			return d, err
+		}
+		d.Set(key, v)
+	}
+}
+
+// Read a literal string, resolving escapes and balanced parentheses
+func (l *pdfLexer) readLiteralString() ([]byte, error) {
+	l.pos++ // opening '('
+	var out []byte
+	nesting := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			nesting++
+		case ')':
+			nesting--
+			if nesting == 0 {
+				return out, nil
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return out, errors.New("unterminated string")
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// Line continuation
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out, errors.New("unterminated string")
+}
+
+// Read a <hex> string; an odd final digit is padded with 0
+func (l *pdfLexer) readHexString() ([]byte, error) {
+	l.pos++ // opening '<'
+	var out []byte
+	hi := -1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		if c == '>' {
+			if hi >= 0 {
+				out = append(out, byte(hi<<4))
+			}
+			return out, nil
+		}
+		v := hexNibble(c)
+		if v < 0 {
+			continue // whitespace and junk are ignored
+		}
+		if hi < 0 {
+			hi = v
+		} else {
+			out = append(out, byte(hi<<4|v))
+			hi = -1
+		}
+	}
+	return out, errors.New("unterminated hex string")
+}
+
+func hexNibble(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
+
+// Resolve #xx escapes in a name
+func decodePDFName(raw string) string {
+	if !bytes.ContainsRune([]byte(raw), '#') {
+		return raw
+	}
+	out := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '#' && i+2 < len(raw) {
+			hi, lo := hexNibble(raw[i+1]), hexNibble(raw[i+2])
+			if hi >= 0 && lo >= 0 {
+				out = append(out, byte(hi<<4|lo))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, raw[i])
+	}
+	return string(out)
+}
+
+// Parse a whole PDF file into its objects and merged trailer
+func parsePDF(data []byte) (*pdfDocument, error) {
+	header := bytes.Index(data[:minInt(len(data), 1024)], []byte("%PDF-"))
+	if header < 0 {
+		return nil, errNotPDF
+	}
+
+	doc := &pdfDocument{
+		Data:    data,
+		Version: "1.4",
+		Objects: map[int]*pdfObject{},
+		Trailer: newPDFDict(),
+	}
+	versionLexer := &pdfLexer{data: data, pos: header + 5}
+	if v := versionLexer.readRegular(); len(v) >= 3 && isDigit(v[0]) {
+		doc.Version = v
+	}
+
+	l := &pdfLexer{data: data, pos: header}
+	for {
+		l.skipSpace()
+		if l.pos >= len(data) {
+			break
+		}
+
+		start := l.pos
+		if isDigit(data[l.pos]) {
+			if obj, ok := l.parseIndirectObject(doc); ok {
+				if prev, exists := doc.Objects[obj.Num]; !exists || prev.Offset <= obj.Offset {
+					doc.Objects[obj.Num] = obj
+				}
+				continue
+			}
+			l.pos = start
+		}
+
+		tok := l.readRegular()
+		switch tok {
+		case "xref":
+			// Offsets are rebuilt on write, so the table itself is skipped
+			next := bytes.Index(data[l.pos:], []byte("trailer"))
+			if next < 0 {
+				l.pos = len(data)
+			} else {
+				l.pos += next
+			}
+		case "trailer":
+			l.skipSpace()
+			if v, err := l.parseValue(0); err == nil && v.Kind == pdfDictKind {
+				doc.mergeTrailer(v.Dict)
+			} else {
+				doc.Repairs++
+			}
+		case "startxref":
+			l.skipSpace()
+			l.readRegular()
+		default:
+			// Garbage between objects: resynchronize on the next header
+			doc.Repairs++
+			l.pos = nextObjectHeader(data, start+1)
+			trace(nil, "pdf.parse", "resync", "offset", start, "next", l.pos)
+		}
+	}
+
+	doc.expandObjectStreams()
+
+	if _, ok := doc.Trailer.Get("Encrypt"); ok {
+		doc.Encrypted = true
+	}
+	trace(nil, "pdf.parse", "parsed", "bytes", len(data), "objects", len(doc.Objects), "repairs", doc.Repairs, "encrypted", doc.Encrypted)
+	if len(doc.Objects) == 0 {
+		return doc, errors.New("no objects found")
+	}
+	return doc, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Later trailers (incremental updates, xref streams) override earlier keys
+func (doc *pdfDocument) mergeTrailer(d *pdfDict) {
+	for _, k := range d.Keys {
+		switch k {
+		case "Root", "Info", "ID", "Encrypt":
+			doc.Trailer.Set(k, d.Vals[k])
+		}
+	}
+}
+
+// Find the next plausible "N G obj" header at or after from
+func nextObjectHeader(data []byte, from int) int {
+	for from < len(data) {
+		idx := bytes.Index(data[from:], []byte("obj"))
+		if idx < 0 {
+			return len(data)
+		}
+		kw := from + idx
+		// Walk back over "N G " and make sure it is a real header
+		p := kw - 1
+		for p >= 0 && isPDFWhitespace(data[p]) {
+			p--
+		}
+		genEnd := p + 1
+		for p >= 0 && isDigit(data[p]) {
+			p--
+		}
+		genStart := p + 1
+		for p >= 0 && isPDFWhitespace(data[p]) {
+			p--
+		}
+		numEnd := p + 1
+		for p >= 0 && isDigit(data[p]) {
+			p--
+		}
+		numStart := p + 1
+		followOK := kw+3 >= len(data) || !isPDFRegular(data[kw+3])
+		if numStart >= from && genStart < genEnd && numStart < numEnd && numEnd < genStart && followOK &&
+			(numStart == 0 || !isPDFRegular(data[numStart-1])) {
+			return numStart
+		}
+		from = kw + 3
+	}
+	return len(data)
+}
+
+// Try to parse "N G obj ... endobj" at the current position
+func (l *pdfLexer) parseIndirectObject(doc *pdfDocument) (*pdfObject, bool) {
+	start := l.pos
+	numTok := l.readRegular()
+	l.skipSpace()
+	genTok := l.readRegular()
+	if !isPDFInteger(numTok) || !isPDFInteger(genTok) || !l.acceptKeyword("obj") {
+		return nil, false
+	}
+	num, _ := strconv.Atoi(numTok)
+	gen, _ := strconv.Atoi(genTok)
+	obj := &pdfObject{Num: num, Gen: gen, Offset: start}
+
+	value, err := l.parseValue(0)
+	if err != nil {
+		// Keep what we have and let the main loop resynchronize
+		doc.Repairs++
+		obj.Value = value
+		l.pos = nextObjectHeader(l.data, l.pos)
+		return obj, true
+	}
+	obj.Value = value
+
+	if l.acceptKeyword("stream") {
+		if !l.readStreamData(doc, obj) {
+			doc.Repairs++
+			l.pos = nextObjectHeader(l.data, l.pos)
+			return obj, true
+		}
+	}
+
+	if !l.acceptKeyword("endobj") {
+		doc.Repairs++
+	}
+
+	if obj.Dict().Name("Type") == "XRef" {
+		doc.mergeTrailer(obj.Dict())
+	}
+	return obj, true
+}
+
+// Locate stream data after the "stream" keyword using /Length when it is
+// trustworthy, otherwise by searching for "endstream"
+func (l *pdfLexer) readStreamData(doc *pdfDocument, obj *pdfObject) bool {
+	data := l.data
+	p := l.pos
+	if p < len(data) && data[p] == '\r' {
+		p++
+	}
+	if p < len(data) && data[p] == '\n' {
+		p++
+	}
+	dataStart := p
+
+	length := -1
+	if lv, ok := obj.Dict().Get("Length"); ok {
+		if n, ok := lv.Int(); ok {
+			length = n
+		} else if lv.Kind == pdfRefKind {
+			length = doc.lookupLength(lv.Ref, dataStart)
+		}
+	}
+
+	end := -1
+	if length >= 0 && dataStart+length <= len(data) && endstreamAt(data, dataStart+length) {
+		end = dataStart + length
+	} else {
+		idx := bytes.Index(data[dataStart:], []byte("endstream"))
+		if idx < 0 {
+			return false
+		}
+		end = dataStart + idx
+		// The EOL before endstream is not part of the data
+		if end > dataStart && data[end-1] == '\n' {
+			end--
+		}
+		if end > dataStart && data[end-1] == '\r' {
+			end--
+		}
+		if length >= 0 {
+			doc.LengthMismatches++
+		}
+	}
+
+	obj.Stream = data[dataStart:end]
+	obj.HasStream = true
+
+	l.pos = end
+	l.skipSpace()
+	l.acceptKeyword("endstream")
+	return true
+}
+
+// Whether "endstream" follows offset p after optional whitespace
+func endstreamAt(data []byte, p int) bool {
+	for p < len(data) && isPDFWhitespace(data[p]) {
+		p++
+	}
+	return bytes.HasPrefix(data[p:], []byte("endstream"))
+}
+
+// Resolve an indirect /Length, parsing ahead if the object has not been
+// parsed yet. Writers put a forward length object right after its stream,
+// so the first header at or after near, the stream's own offset, wins,
+// then the first one in the file. Headers come from one scan of the file
+// shared by every lookup; searching the file once per stream made files
+// with thousands of such streams quadratic.
+func (doc *pdfDocument) lookupLength(ref pdfRef, near int) int {
+	if obj, ok := doc.Objects[ref.Num]; ok {
+		if n, ok := obj.Value.Int(); ok {
+			return n
+		}
+		return -1
+	}
+
+	offsets := doc.objectHeaders()[ref]
+	if len(offsets) == 0 {
+		return -1
+	}
+	at := offsets[0]
+	if i := sort.SearchInts(offsets, near); i < len(offsets) {
+		at = offsets[i]
+	}
+	l := &pdfLexer{data: doc.Data, pos: at}
+	l.readRegular()
+	l.skipSpace()
+	l.readRegular()
+	if !l.acceptKeyword("obj") {
+		return -1
+	}
+	if v, err := l.parseValue(0); err == nil {
+		if n, ok := v.Int(); ok {
+			return n
+		}
+	}
+	return -1
+}
+
+// Offsets of every plausible "N G obj" header in the file, ascending,
+// found in a single pass the first time they are needed
+func (doc *pdfDocument) objectHeaders() map[pdfRef][]int {
+	if doc.headers != nil {
+		return doc.headers
+	}
+	doc.headers = map[pdfRef][]int{}
+	data := doc.Data
+	for at := nextObjectHeader(data, 0); at < len(data); at = nextObjectHeader(data, at+1) {
+		l := &pdfLexer{data: data, pos: at}
+		num, err1 := strconv.Atoi(l.readRegular())
+		l.skipSpace()
+		gen, err2 := strconv.Atoi(l.readRegular())
+		if err1 == nil && err2 == nil {
+			ref := pdfRef{Num: num, Gen: gen}
+			doc.headers[ref] = append(doc.headers[ref], at)
+		}
+	}
+	return doc.headers
+}
+
+// Unpack objects stored in compressed object streams (PDF 1.5+)
+func (doc *pdfDocument) expandObjectStreams() {
+	var streams []*pdfObject
+	for _, obj := range doc.Objects {
+		if obj.HasStream && obj.Dict().Name("Type") == "ObjStm" {
+			streams = append(streams, obj)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Offset < streams[j].Offset })
+
+	for _, stm := range streams {
+		decoded, err := decodeStream(doc, stm)
+		if err != nil && len(decoded) == 0 {
+			doc.Repairs++
+			continue
+		}
+		nv, _ := stm.Dict().Get("N")
+		fv, _ := stm.Dict().Get("First")
+		n, _ := nv.Int()
+		first, _ := fv.Int()
+		if first < 0 || first > len(decoded) {
+			doc.Repairs++
+			continue
+		}
+
+		header := &pdfLexer{data: decoded[:first]}
+		for i := 0; i < n; i++ {
+			header.skipSpace()
+			numTok := header.readRegular()
+			header.skipSpace()
+			offTok := header.readRegular()
+			num, err1 := strconv.Atoi(numTok)
+			off, err2 := strconv.Atoi(offTok)
+			if err1 != nil || err2 != nil {
+				doc.Repairs++
+				break
+			}
+			if prev, exists := doc.Objects[num]; exists && prev.Offset > stm.Offset {
+				continue // redefined by a later incremental update
+			}
+			body := &pdfLexer{data: decoded, pos: first + off}
+			v, err := body.parseValue(0)
+			if err != nil {
+				doc.Repairs++
+				continue
+			}
+			doc.Objects[num] = &pdfObject{Num: num, Value: v, Offset: stm.Offset, InObjStm: true}
+		}
+	}
+}
+
+// Follow references (bounded) to the underlying value
+func (doc *pdfDocument) resolve(v pdfValue) pdfValue {
+	for i := 0; i < 16 && v.Kind == pdfRefKind; i++ {
+		obj, ok := doc.Objects[v.Ref.Num]
+		if !ok {
+			return pdfValue{Kind: pdfNull}
+		}
+		v = obj.Value
+	}
+	return v
+}
+
+// Resolve a value expected to be a dictionary; nil otherwise
+func (doc *pdfDocument) resolveDict(v pdfValue) *pdfDict {
+	v = doc.resolve(v)
+	if v.Kind == pdfDictKind {
+		return v.Dict
+	}
+	return nil
+}
+
+// Document catalog, nil if the trailer has no usable /Root
+func (doc *pdfDocument) catalog() *pdfDict {
+	root, ok := doc.Trailer.Get("Root")
+	if !ok {
+		return nil
+	}
+	return doc.resolveDict(root)
+}
+
+// Object numbers of every page, in document order
+func (doc *pdfDocument) pages() []int {
+	catalog := doc.catalog()
+	if catalog == nil {
+		return nil
+	}
+	root, ok := catalog.Get("Pages")
+	if !ok || root.Kind != pdfRefKind {
+		return nil
+	}
+
+	var pages []int
+	visited := map[int]bool{}
+	var walk func(ref pdfRef)
+	walk = func(ref pdfRef) {
+		if visited[ref.Num] {
+			return
+		}
+		visited[ref.Num] = true
+		obj, ok := doc.Objects[ref.Num]
+		if !ok || obj.Dict() == nil {
+			return
+		}
+		kids, hasKids := obj.Dict().Get("Kids")
+		if obj.Dict().Name("Type") == "Pages" || hasKids {
+			kids = doc.resolve(kids)
+			for _, kid := range kids.Arr {
+				if kid.Kind == pdfRefKind {
+					walk(kid.Ref)
+				}
+			}
+			return
+		}
+		pages = append(pages, ref.Num)
+	}
+	walk(root.Ref)
+	return pages
+}
+
+// Sorted object numbers
+func (doc *pdfDocument) objectNumbers() []int {
+	nums := make([]int, 0, len(doc.Objects))
+	for num := range doc.Objects {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParsePDFIndirectLengths(t *testing.T) {
+	// Streams whose /Length objects follow them, one whose length object
+	// comes first and one whose length object is missing
+	var b strings.Builder
+	b.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n2 0 obj\n6\nendobj\n")
+	b.WriteString("3 0 obj\n<< /Length 2 0 R >>\nstream\nback..\nendstream\nendobj\n")
+	b.WriteString("5 0 obj\n<< /Length 6 0 R >>\nstream\nno length\nendstream\nendobj\n")
+	for i := 0; i < 200; i++ {
+		n := 10 + 2*i
+		fmt.Fprintf(&b, "%d 0 obj\n<< /Length %d 0 R >>\nstream\n%08d\nendstream\nendobj\n%d 0 obj\n8\nendobj\n", n, n+1, i, n+1)
+	}
+	b.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+
+	doc, err := ParsePDF([]byte(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.LengthMismatches != 0 {
+		t.Errorf("%d length mismatches", doc.LengthMismatches)
+	}
+	for num, want := range map[int]string{3: "back..", 5: "no length", 10: "00000000", 408: "00000199"} {
+		if got := string(doc.Objects[num].Stream); got != want {
+			t.Errorf("object %d stream %q, want %q", num, got, want)
+		}
+	}
+	if offsets := doc.objectHeaders()[pdfRef{Num: 409}]; len(offsets) != 1 {
+		t.Errorf("object 409 header found at %v", offsets)
+	}
+}
+
+func TestRemoveMetadataWithForwardLengths(t *testing.T) {
+	// Metadata after a run of streams whose /Length objects follow them
+	var b strings.Builder
+	b.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n2 0 obj\n6\nendobj\n")
+	b.WriteString("3 0 obj\n<< /Length 2 0 R >>\nstream\nback..\nendstream\nendobj\n")
+	for i := 0; i < 200; i++ {
+		n := 10 + 2*i
+		fmt.Fprintf(&b, "%d 0 obj\n<< /Length %d 0 R >>\nstream\n%08d\nendstream\nendobj\n%d 0 obj\n8\nendobj\n", n, n+1, i, n+1)
+	}
+	b.WriteString("4 0 obj\n<< /Producer (Scanner) >>\nendobj\ntrailer\n<< /Root 1 0 R /Info 4 0 R >>\n%%EOF\n")
+	data := []byte(b.String())
+	out := applyPDFPass(t, (*pdfDocument).removeMetadata, data, defaultPDFOptions())
+	if bytes.Contains(out, []byte("Scanner")) {
+		t.Fatal("producer kept")
+	}
+	if kept := applyPDFPass(t, (*pdfDocument).removeMetadata, data, pdfOptions{}); !bytes.Equal(kept, data) {
+		t.Fatal("nothing to strip but the file changed")
+	}
+}
+
+func TestParsePDFValues(t *testing.T) {
+	data := []byte("%PDF-1.7\n" +
+		"1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Kids [] /Count 0 >>\nendobj\n" +
+		"3 0 obj\n<</Lit (a\\(b\\)\\n\\101 (nested)) /Hex <48 65 6c6C 6> /Name /A#20B" +
+		" /Arr [1 -2.5 true null [/X] 4 0 R] /Sub <</Deep <</K 7>>>>>>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	doc, err := ParsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version != "1.7" || doc.Repairs != 0 {
+		t.Errorf("version %q with %d repairs", doc.Version, doc.Repairs)
+	}
+	dict := doc.Objects[3].Dict()
+	if v, _ := dict.Get("Lit"); v.Kind != pdfString || string(v.Str) != "a(b)\nA (nested)" {
+		t.Errorf("literal string %q", v.Str)
+	}
+	if v, _ := dict.Get("Hex"); v.Kind != pdfHexString || string(v.Str) != "Hell`" {
+		t.Errorf("hex string %q", v.Str)
+	}
+	if name := dict.Name("Name"); name != "A B" {
+		t.Errorf("name %q", name)
+	}
+	arr, _ := dict.Get("Arr")
+	kinds := []pdfKind{pdfNumber, pdfNumber, pdfBool, pdfNull, pdfArray, pdfRefKind}
+	if len(arr.Arr) != len(kinds) {
+		t.Fatalf("array of %d values, want %d", len(arr.Arr), len(kinds))
+	}
+	for i, kind := range kinds {
+		if arr.Arr[i].Kind != kind {
+			t.Errorf("array value %d has kind %d, want %d", i, arr.Arr[i].Kind, kind)
+		}
+	}
+	if f, _ := arr.Arr[1].Float(); f != -2.5 || arr.Arr[5].Ref != (pdfRef{Num: 4}) {
+		t.Errorf("array holds %v and %+v", f, arr.Arr[5].Ref)
+	}
+	sub, _ := dict.Get("Sub")
+	deep, _ := sub.Dict.Get("Deep")
+	if k, _ := deep.Dict.Get("K"); k.Raw != "7" {
+		t.Errorf("nested dictionary value %q", k.Raw)
+	}
+}
+
+func TestParsePDFRejectsNonPDF(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("GIF89a"), []byte("%PDF-1.4\n%%EOF\n")} {
+		if _, err := ParsePDF(data); err == nil {
+			t.Errorf("%q parsed", data)
+		}
+	}
+}
+
+func TestParsePDFSkipsDamagedObjects(t *testing.T) {
+	data := []byte("%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Kids [] /Count 0 /Broken [1 2 >>\nendobj\n" +
+		"3 0 obj\n<< /Length 99 >>\nstream\nshort\nendstream\nendobj\n" +
+		"4 0 obj\n(kept)\nendobj\n" +
+		"trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	doc, err := ParsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Repairs == 0 {
+		t.Error("the broken array was not counted as a repair")
+	}
+	if doc.LengthMismatches != 1 || string(doc.Objects[3].Stream) != "short" {
+		t.Errorf("%d length mismatches, stream %q", doc.LengthMismatches, doc.Objects[3].Stream)
+	}
+	if obj := doc.Objects[4]; obj == nil || string(obj.Value.Str) != "kept" {
+		t.Error("the object after the damage was lost")
+	}
+}
+
+// Parse data, check every object survives serialize unchanged and that
+// each xref entry points at its object
+func checkSerializeRoundTrip(t *testing.T, data []byte, compact bool) {
+	t.Helper()
+	doc, err := ParsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := doc.serialize
+	if compact {
+		write = doc.serializeCompact
+	}
+	out, err := write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.LengthMismatches != 0 || again.Repairs != 0 {
+		t.Errorf("rewrite has %d length mismatches and %d repairs", again.LengthMismatches, again.Repairs)
+	}
+	for _, num := range doc.objectNumbers() {
+		obj, got := doc.Objects[num], again.Objects[num]
+		if isLayoutObject(obj) {
+			continue
+		}
+		if got == nil {
+			t.Errorf("object %d lost", num)
+			continue
+		}
+		var want, have bytes.Buffer
+		writePDFValue(&want, obj.Value)
+		writePDFValue(&have, got.Value)
+		if have.String() != want.String() && !obj.HasStream {
+			t.Errorf("object %d became %s, was %s", num, have.String(), want.String())
+		}
+		if !bytes.Equal(got.Stream, obj.Stream) {
+			t.Errorf("object %d stream changed", num)
+		}
+		if compact && !obj.HasStream && !got.InObjStm {
+			t.Errorf("object %d not packed into an object stream", num)
+		}
+	}
+	if !compact {
+		// The classic table: "xref", "0 N", then one 20-byte entry per object
+		start := bytes.LastIndex(out, []byte("\nxref\n")) + len("\nxref\n")
+		table := out[bytes.IndexByte(out[start:], '\n')+start+1:]
+		for _, num := range again.objectNumbers() {
+			var off, gen int
+			var kind string
+			fmt.Sscanf(string(table[num*20:num*20+18]), "%d %d %s", &off, &gen, &kind)
+			if header := fmt.Sprintf("%d %d obj", num, gen); kind != "n" || !bytes.HasPrefix(out[off:], []byte(header)) {
+				t.Errorf("xref entry for object %d points at %q", num, out[off:off+10])
+			}
+		}
+	}
+	if len(again.pages()) != len(doc.pages()) {
+		t.Errorf("%d pages after the rewrite, want %d", len(again.pages()), len(doc.pages()))
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	checkSerializeRoundTrip(t, fixturePDF(), false)
+	checkSerializeRoundTrip(t, fixtureThreePagePDF(fixturePageStreams()), false)
+}
+
+func TestSerializeCompactRoundTrip(t *testing.T) {
+	checkSerializeRoundTrip(t, fixtureThreePagePDF(fixturePageStreams()), true)
+}
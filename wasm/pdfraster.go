@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// Affine matrix [a b c d e f] in PDF's row-vector convention
+type pdfMatrix [6]float64
+
+// m followed by n
+func (m pdfMatrix) mul(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func (m pdfMatrix) apply(x, y float64) (float64, float64) {
+	return x*m[0] + y*m[2] + m[4], x*m[1] + y*m[3] + m[5]
+}
+
+func (m pdfMatrix) invert() (pdfMatrix, bool) {
+	det := m[0]*m[3] - m[1]*m[2]
+	if math.Abs(det) < 1e-12 {
+		return pdfMatrix{}, false
+	}
+	return pdfMatrix{
+		m[3] / det, -m[1] / det,
+		-m[2] / det, m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det,
+		(m[1]*m[4] - m[0]*m[5]) / det,
+	}, true
+}
+
+// Matrix from six numeric operands or a /Matrix array
+func matrixFromValues(vals []pdfValue) (pdfMatrix, bool) {
+	if len(vals) != 6 {
+		return pdfMatrix{}, false
+	}
+	var m pdfMatrix
+	for i, v := range vals {
+		f, ok := v.Float()
+		if !ok {
+			return pdfMatrix{}, false
+		}
+		m[i] = f
+	}
+	return m, true
+}
+
+// Page attribute, following /Parent for inheritable keys
+func inheritedAttr(doc *pdfDocument, page *pdfDict, key string) (pdfValue, bool) {
+	for depth := 0; page != nil && depth < 32; depth++ {
+		if v, ok := page.Get(key); ok {
+			return doc.resolve(v), true
+		}
+		parent, ok := page.Get("Parent")
+		if !ok {
+			break
+		}
+		page = doc.resolveDict(parent)
+	}
+	return pdfValue{}, false
+}
+
+// Page box in points as llx, lly, urx, ury (defaults to US Letter)
+func pageBox(doc *pdfDocument, page *pdfDict) [4]float64 {
+	box := [4]float64{0, 0, 612, 792}
+	if v, ok := inheritedAttr(doc, page, "MediaBox"); ok && len(v.Arr) == 4 {
+		for i, item := range v.Arr {
+			box[i], _ = doc.resolve(item).Float()
+		}
+	}
+	if box[0] > box[2] {
+		box[0], box[2] = box[2], box[0]
+	}
+	if box[1] > box[3] {
+		box[1], box[3] = box[3], box[1]
+	}
+	return box
+}
+
+// Decoded content of a page (all /Contents streams joined)
+func pageContent(doc *pdfDocument, page *pdfDict) []byte {
+	v, ok := page.Get("Contents")
+	if !ok {
+		return nil
+	}
+	var refs []pdfValue
+	if r := doc.resolve(v); r.Kind == pdfArray {
+		refs = r.Arr
+	} else {
+		refs = []pdfValue{v}
+	}
+	var out []byte
+	for _, ref := range refs {
+		if ref.Kind != pdfRefKind {
+			continue
+		}
+		if obj, ok := doc.Objects[ref.Ref.Num]; ok && obj.HasStream {
+			data, _ := decodeStream(doc, obj)
+			out = append(out, data...)
+			out = append(out, '\n')
+		}
+	}
+	return out
+}
+
+// Renders image content of pages onto a white canvas. Text and vector
+// graphics are not drawn; pages that contain them get a warning, and
+// convertPDFToTIFF rejects such pages unless the caller allows it. That
+// is enough for scanned documents (one image per page).
+type pageRasterizer struct {
+	doc      *pdfDocument
+	canvas   *image.NRGBA
+	warnings map[string]bool
+	images   map[int]pdfDecodedImage
+}
+
+// Rasterize a page at the given resolution
+func rasterizePage(doc *pdfDocument, pageNum int, dpi float64) (*image.NRGBA, []string, error) {
+	obj, ok := doc.Objects[pageNum]
+	if !ok || obj.Dict() == nil {
+		return nil, nil, fmt.Errorf("page object %d missing", pageNum)
+	}
+	page := obj.Dict()
+	box := pageBox(doc, page)
+	scale := dpi / 72
+	w := int(math.Ceil((box[2] - box[0]) * scale))
+	h := int(math.Ceil((box[3] - box[1]) * scale))
+	if w <= 0 || h <= 0 || w*h > 1<<26 {
+		return nil, nil, fmt.Errorf("page size %dx%d px out of range", w, h)
+	}
+
+	r := &pageRasterizer{
+		doc:      doc,
+		canvas:   image.NewNRGBA(image.Rect(0, 0, w, h)),
+		warnings: map[string]bool{},
+		images:   map[int]pdfDecodedImage{},
+	}
+	draw.Draw(r.canvas, r.canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	// Page space to pixels: scale, then flip y so the top edge is row 0
+	base := pdfMatrix{scale, 0, 0, -scale, -box[0] * scale, box[3] * scale}
+	resources, _ := inheritedAttr(doc, page, "Resources")
+	r.run(pageContent(doc, page), resources.Dict, base, 0)
+
+	out := r.canvas
+	if rot, ok := inheritedAttr(doc, page, "Rotate"); ok {
+		// /Rotate is clockwise, imaging rotates counter-clockwise
+		n, _ := rot.Int()
+		switch ((n % 360) + 360) % 360 {
+		case 90:
+			out = imaging.Rotate270(out)
+		case 180:
+			out = imaging.Rotate180(out)
+		case 270:
+			out = imaging.Rotate90(out)
+		}
+	}
+
+	var warnings []string
+	for w := range r.warnings {
+		warnings = append(warnings, w)
+	}
+	sort.Strings(warnings)
+	return out, warnings, nil
+}
+
+// Execute a content stream, drawing images and recursing into forms
+func (r *pageRasterizer) run(content []byte, resources *pdfDict, ctm pdfMatrix, depth int) {
+	if depth > 8 {
+		r.warnings["form nesting too deep"] = true
+		return
+	}
+	var stack []pdfMatrix
+	scanContentOps(content, func(op string, operands []pdfValue) bool {
+		switch op {
+		case "q":
+			stack = append(stack, ctm)
+		case "Q":
+			if len(stack) > 0 {
+				ctm = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "cm":
+			if m, ok := matrixFromValues(operands); ok {
+				ctm = m.mul(ctm)
+			}
+		case "Do":
+			if len(operands) == 1 && operands[0].Kind == pdfName {
+				r.doXObject(operands[0].Raw, resources, ctm, depth)
+			}
+		case "BT":
+			r.warnings["text is not rendered"] = true
+		case "f", "F", "f*", "S", "s", "B", "B*", "b", "b*", "sh":
+			r.warnings["vector graphics are not rendered"] = true
+		case "BI":
+			r.warnings["inline images are not rendered"] = true
+		}
+		return true
+	})
+}
+
+// Draw a named XObject from the current resources
+func (r *pageRasterizer) doXObject(name string, resources *pdfDict, ctm pdfMatrix, depth int) {
+	if resources == nil {
+		return
+	}
+	xobjects, ok := resources.Get("XObject")
+	if !ok {
+		return
+	}
+	dict := r.doc.resolveDict(xobjects)
+	if dict == nil {
+		return
+	}
+	ref, ok := dict.Get(name)
+	if !ok || ref.Kind != pdfRefKind {
+		return
+	}
+	obj, ok := r.doc.Objects[ref.Ref.Num]
+	if !ok || obj.Dict() == nil {
+		return
+	}
+
+	switch obj.Dict().Name("Subtype") {
+	case "Image":
+		img, cached := r.images[ref.Ref.Num]
+		if !cached {
+			var err error
+			img, err = decodePDFImage(r.doc, obj)
+			if err != nil {
+				r.warnings[fmt.Sprintf("image %s not rendered: %v", name, err)] = true
+				return
+			}
+			r.images[ref.Ref.Num] = img
+		}
+		r.drawImage(img.Image, ctm)
+	case "Form":
+		content, err := decodeStream(r.doc, obj)
+		if err != nil {
+			r.warnings[fmt.Sprintf("form %s not rendered: %v", name, err)] = true
+			return
+		}
+		formCTM := ctm
+		if v, ok := obj.Dict().Get("Matrix"); ok {
+			if m, ok := matrixFromValues(r.doc.resolve(v).Arr); ok {
+				formCTM = m.mul(ctm)
+			}
+		}
+		formResources := resources
+		if v, ok := obj.Dict().Get("Resources"); ok {
+			if d := r.doc.resolveDict(v); d != nil {
+				formResources = d
+			}
+		}
+		r.run(content, formResources, formCTM, depth+1)
+	}
+}
+
+// Paint an image mapped from the unit square through ctm, sampling the
+// source with nearest-neighbour lookups (downscaled first when it is much
+// larger than its footprint)
+func (r *pageRasterizer) drawImage(src *image.NRGBA, ctm pdfMatrix) {
+	inv, ok := ctm.invert()
+	if !ok {
+		return
+	}
+
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, corner := range [][2]float64{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		x, y := ctm.apply(corner[0], corner[1])
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	bounds := r.canvas.Bounds()
+	x0, y0 := maxInt(int(math.Floor(minX)), 0), maxInt(int(math.Floor(minY)), 0)
+	x1, y1 := minInt(int(math.Ceil(maxX)), bounds.Dx()), minInt(int(math.Ceil(maxY)), bounds.Dy())
+	if x0 >= x1 || y0 >= y1 {
+		return
+	}
+
+	// Nearest-neighbour sampling of a much larger source aliases badly
+	if sw, sh := src.Bounds().Dx(), src.Bounds().Dy(); sw > 2*(x1-x0) && sh > 2*(y1-y0) {
+		src = imaging.Resize(src, 2*(x1-x0), 2*(y1-y0), imaging.Box)
+	}
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+
+	for py := y0; py < y1; py++ {
+		for px := x0; px < x1; px++ {
+			u, v := inv.apply(float64(px)+0.5, float64(py)+0.5)
+			if u < 0 || u >= 1 || v < 0 || v >= 1 {
+				continue
+			}
+			// Image row 0 is at the top of the unit square (v = 1)
+			sx, sy := int(u*float64(sw)), int((1-v)*float64(sh))
+			c := src.NRGBAAt(sx, sy)
+			if c.A == 0 {
+				continue
+			}
+			r.canvas.SetNRGBA(px, py, color.NRGBA{c.R, c.G, c.B, 255})
+		}
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Lossy re-encoding of embedded JPEGs, off unless imageQuality or
+// maxImageDimension is set.
+// The samples are re-encoded in the color space they are in and the image
+// dictionary is left as it is, so only images whose samples the JPEG
+// encoder can write unchanged qualify: gray and RGB, device or ICC-based.
+// CMYK images (print-origin PDFs), including ICC-based ones, are kept
+// untouched; converting them would need the profile applied and the color
+// space swapped, and an RGB guess shifts colors on press. Indexed,
+// Separation, DeviceN and Lab images are kept for the same reason.
+// With maxImageDPI, an image is downsampled to what the largest placement
+// on any page needs, but only when it has half as many pixels again as
+// that, which is where the saving is worth a resample. Images drawn from
+// patterns or annotation appearances, whose size the pages do not say,
+// keep theirs. Downsampled images take their soft mask along, scaled by the same
+// factor, so transparency stays aligned; an image whose mask cannot follow
+// keeps its size. A re-encode that loses more than minImagePSNR allows,
+// measured against the pixels it was made from, is discarded and the
+// image keeps its bytes; every recompressed image must also decode at the
+// size its dictionary declares, or the image pass keeps its original.
+
+// Quality used when only maxImageDimension asks for a re-encode
+const defaultReencodeQuality = 85
+
+// How far above maxImageDPI an image must be before it is downsampled
+const dpiDownsampleThreshold = 1.5
+
+// Bound on XObject draws followed per document when measuring placements
+const maxPlacementDraws = 100000
+
+// Components of the samples an image XObject's color space describes when
+// the JPEG encoder can write them unchanged; otherwise 0 and why not
+func reencodableComponents(doc *pdfDocument, dict *pdfDict) (int, string) {
+	if mask, _ := dict.Get("ImageMask"); mask.Raw == "true" {
+		return 0, "stencil mask"
+	}
+	v, ok := dict.Get("ColorSpace")
+	if !ok {
+		return 0, "no color space" // JPX, or a mask
+	}
+	v = doc.resolve(v)
+	family := v.Raw
+	if v.Kind == pdfArray && len(v.Arr) > 0 {
+		family = doc.resolve(v.Arr[0]).Raw
+	}
+	switch family {
+	case "DeviceGray", "CalGray", "G":
+		return 1, ""
+	case "DeviceRGB", "CalRGB", "RGB":
+		return 3, ""
+	case "DeviceCMYK", "CMYK":
+		return 0, "CMYK color"
+	case "ICCBased":
+		if len(v.Arr) < 2 {
+			return 0, "ICC profile missing"
+		}
+		profile := doc.resolve(v.Arr[1])
+		if profile.Kind != pdfDictKind {
+			return 0, "ICC profile missing"
+		}
+		switch n, _ := profile.Dict.Get("N"); n.Raw {
+		case "1":
+			return 1, ""
+		case "3":
+			return 3, ""
+		case "4":
+			return 0, "ICC-based CMYK"
+		}
+		return 0, "ICC profile with unusual component count"
+	}
+	return 0, family + " color"
+}
+
+// Re-encode an embedded JPEG when its color space allows, downsampling it
+// (and its soft mask) to opts.MaxImageDimension and opts.MaxImageDPI; the result must be
+// smaller and decode, otherwise data is returned as it is
+func reencodePDFJPEG(doc *pdfDocument, obj *pdfObject, data []byte, opts pdfOptions) []byte {
+	dict := obj.Dict()
+	want, reason := reencodableComponents(doc, dict)
+	_, parms := streamFilters(doc, dict)
+	if want > 0 && parms[0] != nil {
+		// ColorTransform overrides what the data says about YCbCr, which
+		// the decoder here does not honor
+		if _, ok := parms[0].Get("ColorTransform"); ok {
+			want, reason = 0, "explicit ColorTransform"
+		}
+	}
+	if _, ok := dict.Get("Mask"); want > 0 && ok {
+		// A color key matches exact sample values, which a lossy encode
+		// moves; a stencil /Mask has no resampling here
+		want, reason = 0, "/Mask"
+	}
+	if want == 0 {
+		fmt.Printf("[WASM] JPEG (object %d) kept as is: %s\n", obj.Num, reason)
+		trace(nil, "pdf.images", "colorKept", "object", obj.Num, "reason", reason)
+		return data
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	switch img.(type) {
+	case *image.Gray:
+		if want != 1 {
+			return data
+		}
+	case *image.YCbCr:
+		if want != 3 {
+			return data
+		}
+	default:
+		// CMYK or YCCK data under a gray or RGB color space
+		fmt.Printf("[WASM] JPEG (object %d) kept as is: data is not %d-component\n", obj.Num, want)
+		return data
+	}
+
+	quality := opts.ImageQuality
+	if quality == 0 {
+		quality = defaultReencodeQuality
+	}
+	var mask *resampledMask
+	b := img.Bounds()
+	if w, h, ok := reencodeSize(obj.Num, b.Dx(), b.Dy(), opts); ok {
+		mask, err = resampleSoftMask(doc, dict, b.Dx(), b.Dy(), w, h, opts)
+		if err != nil {
+			fmt.Printf("[WASM] JPEG (object %d) kept at %dx%d: %v\n", obj.Num, b.Dx(), b.Dy(), err)
+		} else {
+			img = imaging.Resize(img, w, h, imaging.Lanczos)
+			if want == 1 {
+				img = grayImage(img)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: quality}); err != nil || out.Len() >= len(data) {
+		return data
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		return data
+	}
+	if psnr := imagePSNR(img, decoded); opts.MinImagePSNR > 0 && psnr < opts.MinImagePSNR {
+		fmt.Printf("[WASM] JPEG (object %d) kept as is: re-encode at quality %d loses too much (%.1f dB)\n", obj.Num, quality, psnr)
+		trace(nil, "pdf.images", "lossRejected", "object", obj.Num, "quality", quality, "psnr", math.Round(psnr*10)/10)
+		return data
+	}
+	if nb := img.Bounds(); nb.Dx() != b.Dx() || nb.Dy() != b.Dy() {
+		dict.Set("Width", pdfIntValue(nb.Dx()))
+		dict.Set("Height", pdfIntValue(nb.Dy()))
+		if mask != nil {
+			mask.apply()
+		}
+		fmt.Printf("[WASM] JPEG (object %d) downsampled from %dx%d to %dx%d\n", obj.Num, b.Dx(), b.Dy(), nb.Dx(), nb.Dy())
+	}
+	fmt.Printf("[WASM] JPEG (object %d) re-encoded at quality %d: %d -> %d bytes\n", obj.Num, quality, len(data), out.Len())
+	return out.Bytes()
+}
+
+// Peak signal-to-noise ratio of b against a in dB, over their RGB
+// samples; +Inf when they are equal, 0 when their sizes differ
+func imagePSNR(a, b image.Image) float64 {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return 0
+	}
+	var sum float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []float64{
+				float64(r1>>8) - float64(r2>>8), float64(g1>>8) - float64(g2>>8), float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+	if sum == 0 {
+		return math.Inf(1)
+	}
+	mse := sum / float64(3*ab.Dx()*ab.Dy())
+	return 10 * math.Log10(255*255/mse)
+}
+
+// Check that a recompressed image stream decodes, at the size its
+// dictionary declares when it declares one
+func checkRecompressedImage(dict *pdfDict, data []byte) error {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("does not decode: %v", err)
+	}
+	b := img.Bounds()
+	w, wok := dict.Vals["Width"].Int()
+	h, hok := dict.Vals["Height"].Int()
+	if wok && hok && (b.Dx() != w || b.Dy() != h) {
+		return fmt.Errorf("decodes at %dx%d, declared %dx%d", b.Dx(), b.Dy(), w, h)
+	}
+	return nil
+}
+
+// Size to re-encode a w x h image (object num) at: within
+// opts.MaxImageDimension and, with opts.MaxImageDPI, the pixels its
+// largest placement needs; ok is false when it keeps its size
+func reencodeSize(num, w, h int, opts pdfOptions) (int, int, bool) {
+	nw, nh, _ := downsampledSize(w, h, opts.MaxImageDimension)
+	if p, placed := opts.placements[num]; placed && opts.MaxImageDPI > 0 {
+		// The axis shown largest for its samples sets the scale
+		dpi := float64(opts.MaxImageDPI)
+		scale := math.Max(p.Width*dpi/72/float64(w), p.Height*dpi/72/float64(h))
+		if scale*dpiDownsampleThreshold < 1 {
+			if dw := maxInt(1, int(math.Ceil(float64(w)*scale))); dw < nw {
+				nw, nh = dw, maxInt(1, int(math.Ceil(float64(h)*scale)))
+			}
+		}
+	}
+	return nw, nh, nw != w || nh != h
+}
+
+// Largest size, in points, an image is drawn at
+type imagePlacement struct {
+	Width, Height float64
+}
+
+// The placements of image XObjects drawn from page content and the forms
+// it draws, by object number. Images also reachable from a pattern or an
+// annotation are left out.
+func imagePlacements(doc *pdfDocument) map[int]imagePlacement {
+	placements := map[int]imagePlacement{}
+	elsewhere := map[int]bool{}
+	draws := 0
+	var run func(content []byte, resources *pdfDict, ctm pdfMatrix, depth int)
+	run = func(content []byte, resources *pdfDict, ctm pdfMatrix, depth int) {
+		var xobjects *pdfDict
+		if resources != nil {
+			xobjects = doc.resolveDict(resources.Vals["XObject"])
+			collectObjects(doc, resources.Vals["Pattern"], elsewhere, 0)
+		}
+		var stack []pdfMatrix
+		scanContentOps(content, func(op string, operands []pdfValue) bool {
+			switch op {
+			case "q":
+				stack = append(stack, ctm)
+			case "Q":
+				if len(stack) > 0 {
+					ctm = stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+				}
+			case "cm":
+				if m, ok := matrixFromValues(operands); ok {
+					ctm = m.mul(ctm)
+				}
+			case "Do":
+				if len(operands) != 1 || operands[0].Kind != pdfName || xobjects == nil || draws >= maxPlacementDraws {
+					break
+				}
+				draws++
+				ref := xobjects.Vals[operands[0].Raw]
+				if ref.Kind != pdfRefKind || doc.Objects[ref.Ref.Num] == nil {
+					break
+				}
+				obj := doc.Objects[ref.Ref.Num]
+				switch obj.Dict().Name("Subtype") {
+				case "Image":
+					p := placements[obj.Num]
+					p.Width = math.Max(p.Width, math.Hypot(ctm[0], ctm[1]))
+					p.Height = math.Max(p.Height, math.Hypot(ctm[2], ctm[3]))
+					placements[obj.Num] = p
+				case "Form":
+					form, err := decodeStream(doc, obj)
+					if err != nil || depth >= 8 {
+						elsewhere[obj.Num] = true
+						collectObjects(doc, obj.Dict().Vals["Resources"], elsewhere, 0)
+						break
+					}
+					formCTM := ctm
+					if m, ok := matrixFromValues(doc.resolve(obj.Dict().Vals["Matrix"]).Arr); ok {
+						formCTM = m.mul(ctm)
+					}
+					formResources := doc.resolveDict(obj.Dict().Vals["Resources"])
+					if formResources == nil {
+						formResources = resources
+					}
+					run(form, formResources, formCTM, depth+1)
+				}
+			}
+			return true
+		})
+	}
+	for _, num := range doc.pages() {
+		page := doc.Objects[num].Dict()
+		resources, _ := inheritedAttr(doc, page, "Resources")
+		collectObjects(doc, page.Vals["Annots"], elsewhere, 0)
+		var content []byte
+		forEachRef(page.Vals["Contents"], func(ref int) {
+			if doc.Objects[ref] == nil {
+				return
+			}
+			data, err := decodeStream(doc, doc.Objects[ref])
+			if err != nil {
+				// What the page draws, and how large, is unknown
+				collectObjects(doc, resources, elsewhere, 0)
+			}
+			content = append(append(content, data...), '\n')
+		})
+		run(content, doc.resolveDict(resources), pdfMatrix{1, 0, 0, 1, 0, 0}, 0)
+	}
+	if draws >= maxPlacementDraws {
+		return nil
+	}
+	for num := range elsewhere {
+		delete(placements, num)
+	}
+	return placements
+}
+
+// Size of a w x h image scaled to fit max on its longer side; ok is false
+// when max is 0 or the image already fits
+func downsampledSize(w, h, max int) (int, int, bool) {
+	if max <= 0 || w <= max && h <= max {
+		return w, h, false
+	}
+	if w >= h {
+		return max, maxInt(1, (h*max+w/2)/w), true
+	}
+	return maxInt(1, (w*max+h/2)/h), max, true
+}
+
+// A soft mask resampled along with its image, written back by apply once
+// the image itself has been replaced
+type resampledMask struct {
+	obj     *pdfObject
+	samples []byte
+	w, h    int
+}
+
+// Resample an image's /SMask by the same factor as the image, from w x h
+// to nw x nh. Returns nil without a soft mask; fails when the mask cannot
+// be decoded or is shared with other images, which would then no longer
+// line up with it, or lies outside the selected pages.
+func resampleSoftMask(doc *pdfDocument, dict *pdfDict, w, h, nw, nh int, opts pdfOptions) (*resampledMask, error) {
+	ref, ok := dict.Get("SMask")
+	if !ok {
+		return nil, nil
+	}
+	if ref.Kind != pdfRefKind || doc.Objects[ref.Ref.Num] == nil {
+		return nil, errors.New("soft mask is not an image object")
+	}
+	maskObj := doc.Objects[ref.Ref.Num]
+	if !opts.inScope(maskObj.Num) {
+		return nil, errors.New("soft mask is used outside the selected pages")
+	}
+	for _, num := range doc.objectNumbers() {
+		other := doc.Objects[num]
+		if other.HasStream && other.Dict() != dict {
+			if v, ok := other.Dict().Get("SMask"); ok && v.Kind == pdfRefKind && v.Ref.Num == maskObj.Num {
+				return nil, errors.New("soft mask is shared with other images")
+			}
+		}
+	}
+	decoded, err := decodePDFImage(doc, maskObj)
+	if err != nil {
+		return nil, fmt.Errorf("soft mask does not decode: %v", err)
+	}
+	mb := decoded.Image.Bounds()
+	mw := maxInt(1, (mb.Dx()*nw+w/2)/w)
+	mh := maxInt(1, (mb.Dy()*nh+h/2)/h)
+	resized := grayImage(imaging.Resize(decoded.Image, mw, mh, imaging.Lanczos))
+	return &resampledMask{obj: maskObj, samples: resized.Pix, w: mw, h: mh}, nil
+}
+
+// Store the resampled mask as 8-bit gray samples. The samples already
+// have any /Decode array applied, so it goes; /Matte stays.
+func (m *resampledMask) apply() {
+	dict := m.obj.Dict()
+	m.obj.Stream = deflateStream(m.samples)
+	setStreamFilters(dict, []string{"FlateDecode"}, []*pdfDict{nil})
+	dict.Set("Width", pdfIntValue(m.w))
+	dict.Set("Height", pdfIntValue(m.h))
+	dict.Set("BitsPerComponent", pdfIntValue(8))
+	dict.Set("ColorSpace", pdfNameValue("DeviceGray"))
+	dict.Delete("Decode")
+}
+
+// A gray image's samples as an *image.Gray, for the JPEG encoder, which
+// would otherwise write three components
+func grayImage(img image.Image) *image.Gray {
+	if g, ok := img.(*image.Gray); ok {
+		return g
+	}
+	g := image.NewGray(img.Bounds())
+	draw.Draw(g, g.Bounds(), img, img.Bounds().Min, draw.Src)
+	return g
+}
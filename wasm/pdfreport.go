@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Human-readable record of what compressPDF did to a document, for
+// compliance files. It is built by comparing the input with the final
+// output, so it describes what the returned bytes actually differ in,
+// whichever fallback level produced them.
+
+// Supported sanitization report formats
+const (
+	pdfReportMarkdown = "markdown"
+	pdfReportHTML     = "html"
+)
+
+func checkPDFReportFormat(format string) error {
+	switch format {
+	case "", pdfReportMarkdown, pdfReportHTML:
+		return nil
+	}
+	return fmt.Errorf("unknown report format %q, want markdown or html", format)
+}
+
+// What changed between the input and the output document
+type pdfActions struct {
+	Level              string
+	OriginalSize       int
+	OutputSize         int
+	MetadataRemoved    []string
+	XMPRemoved         int
+	XMPMinimized       int
+	ImagesRecompressed int
+	ImageBytesSaved    int
+	StreamsRecoded     int // streams stored with a different filter chain
+	StreamBytesSaved   int
+	FontsMerged        int // font programs dropped in favor of an equal or wider one
+	FontsSubset        int // TrueType programs left with fewer glyphs
+	ImagesShared       int // repeated images now stored once
+	BookmarksRemoved   int // outline items gone from the output
+	LinksRemoved       int // internal link annotations gone from the output
+	LayersRemoved      int // optional content groups gone from the output
+	JavaScript         int // actions present in the output
+	Attachments        int // embedded files present in the output
+	Attempts           []pdfAttempt
+	Warnings           []message
+}
+
+// Compare the input with the output of compressPDFData (after provenance,
+// if any), using the documents the fallback chain parsed. Inputs that did
+// not parse only get sizes, level and warnings.
+func collectPDFActions(input []byte, res pdfResult) pdfActions {
+	a := pdfActions{
+		Level: res.Level, OriginalSize: len(input), OutputSize: len(res.Data),
+		Attempts: res.Attempts, Warnings: res.Warnings,
+	}
+	before, after := res.Original, res.Output
+	if before == nil || after == nil || before.Encrypted {
+		return a
+	}
+
+	infoBefore, infoAfter := pdfInfo(before), pdfInfo(after)
+	for _, key := range infoBefore.Keys {
+		if _, kept := infoAfter.Get(key); !kept {
+			a.MetadataRemoved = append(a.MetadataRemoved, key)
+		}
+	}
+
+	for _, num := range before.objectNumbers() {
+		obj := before.Objects[num]
+		if !obj.HasStream {
+			continue
+		}
+		out, ok := after.Objects[num]
+		if !ok && obj.Dict().Name("Subtype") == "Image" {
+			a.ImagesShared++
+			continue
+		}
+		switch obj.Dict().Name("Type") {
+		case "Metadata":
+			if !ok || !out.HasStream {
+				a.XMPRemoved++
+			} else if len(out.Stream) < len(obj.Stream) {
+				a.XMPMinimized++
+			}
+			continue
+		}
+		if ok && out.HasStream && len(out.Stream) < len(obj.Stream) {
+			namesBefore, _ := streamFilters(before, obj.Dict())
+			namesAfter, _ := streamFilters(after, out.Dict())
+			if strings.Join(namesBefore, " ") != strings.Join(namesAfter, " ") {
+				a.StreamsRecoded++
+				a.StreamBytesSaved += len(obj.Stream) - len(out.Stream)
+				continue
+			}
+		}
+		if obj.Dict().Name("Subtype") == "Image" && ok && out.HasStream && len(out.Stream) < len(obj.Stream) {
+			a.ImagesRecompressed++
+			a.ImageBytesSaved += len(obj.Stream) - len(out.Stream)
+		}
+	}
+
+	merged := map[int]bool{}
+	for _, obj := range before.Objects {
+		dict := obj.Dict()
+		if dict == nil || dict.Name("Type") != "FontDescriptor" {
+			continue
+		}
+		for _, key := range pdfFontFileKeys {
+			if v, ok := dict.Get(key); ok && v.Kind == pdfRefKind && before.Objects[v.Ref.Num] != nil && after.Objects[v.Ref.Num] == nil {
+				merged[v.Ref.Num] = true
+			}
+		}
+		if v, ok := dict.Get("FontFile2"); ok && v.Kind == pdfRefKind && before.Objects[v.Ref.Num] != nil && after.Objects[v.Ref.Num] != nil {
+			if outlinedGlyphs(after, after.Objects[v.Ref.Num]) < outlinedGlyphs(before, before.Objects[v.Ref.Num]) {
+				a.FontsSubset++
+			}
+		}
+	}
+	a.FontsMerged = len(merged)
+
+	navBefore, navAfter := findNavigation(before), findNavigation(after)
+	a.BookmarksRemoved = maxInt(0, len(navBefore.Outlines)-len(navAfter.Outlines))
+	a.LinksRemoved = maxInt(0, len(navBefore.Links)-len(navAfter.Links))
+	a.LayersRemoved = maxInt(0, len(layerGroups(before))-len(layerGroups(after)))
+
+	for _, obj := range after.Objects {
+		if obj.HasStream && obj.Dict().Name("Type") == "EmbeddedFile" {
+			a.Attachments++
+		}
+		a.JavaScript += countJavaScriptActions(obj.Value, 0)
+	}
+	return a
+}
+
+// Document information dictionary, or an empty one
+func pdfInfo(doc *pdfDocument) *pdfDict {
+	if v, ok := doc.Trailer.Get("Info"); ok {
+		if info := doc.resolveDict(v); info != nil {
+			return info
+		}
+	}
+	return newPDFDict()
+}
+
+// JavaScript action dictionaries (/S /JavaScript) nested in a value
+func countJavaScriptActions(v pdfValue, depth int) int {
+	if depth > 32 {
+		return 0
+	}
+	n := 0
+	switch v.Kind {
+	case pdfDictKind:
+		if v.Dict.Name("S") == "JavaScript" {
+			n++
+		}
+		for _, key := range v.Dict.Keys {
+			n += countJavaScriptActions(v.Dict.Vals[key], depth+1)
+		}
+	case pdfArray:
+		for _, item := range v.Arr {
+			n += countJavaScriptActions(item, depth+1)
+		}
+	}
+	return n
+}
+
+func pluralize(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+// A titled list of report lines
+type reportSection struct {
+	Title string
+	Items []string
+}
+
+func (a pdfActions) sections() []reportSection {
+	var removed, changed, kept, notes []string
+	if len(a.MetadataRemoved) > 0 {
+		keys := append([]string{}, a.MetadataRemoved...)
+		sort.Strings(keys)
+		removed = append(removed, fmt.Sprintf("%s: %s",
+			pluralize(len(keys), "metadata key", "metadata keys"), strings.Join(keys, ", ")))
+	}
+	if a.XMPRemoved > 0 {
+		removed = append(removed, pluralize(a.XMPRemoved, "XMP metadata packet", "XMP metadata packets"))
+	}
+	if a.BookmarksRemoved > 0 {
+		removed = append(removed, pluralize(a.BookmarksRemoved, "bookmark", "bookmarks"))
+	}
+	if a.LinksRemoved > 0 {
+		removed = append(removed, pluralize(a.LinksRemoved, "internal link", "internal links"))
+	}
+	if a.LayersRemoved > 0 {
+		removed = append(removed, pluralize(a.LayersRemoved, "hidden layer", "hidden layers"))
+	}
+	if a.ImagesRecompressed > 0 {
+		changed = append(changed, fmt.Sprintf("%s recompressed, %d bytes saved",
+			pluralize(a.ImagesRecompressed, "image", "images"), a.ImageBytesSaved))
+	}
+	if a.StreamsRecoded > 0 {
+		changed = append(changed, fmt.Sprintf("%s losslessly re-encoded, %d bytes saved",
+			pluralize(a.StreamsRecoded, "stream", "streams"), a.StreamBytesSaved))
+	}
+	if a.ImagesShared > 0 {
+		changed = append(changed, pluralize(a.ImagesShared, "repeated image", "repeated images")+" stored once")
+	}
+	if a.FontsSubset > 0 {
+		changed = append(changed, pluralize(a.FontsSubset, "font program", "font programs")+" subset to the glyphs shown")
+	}
+	if a.FontsMerged > 0 {
+		changed = append(changed, pluralize(a.FontsMerged, "duplicate font program", "duplicate font programs")+" merged")
+	}
+	if a.XMPMinimized > 0 {
+		changed = append(changed, pluralize(a.XMPMinimized, "XMP metadata packet", "XMP metadata packets")+" minimized")
+	}
+	// compressPDF does not remove active content; say so instead of
+	// leaving a reader to assume it did
+	if a.JavaScript > 0 {
+		kept = append(kept, pluralize(a.JavaScript, "JavaScript action", "JavaScript actions"))
+	}
+	if a.Attachments > 0 {
+		kept = append(kept, pluralize(a.Attachments, "embedded file (attachment)", "embedded files (attachments)"))
+	}
+	for _, attempt := range a.Attempts {
+		if attempt.Error != "" {
+			notes = append(notes, fmt.Sprintf("%s level rejected: %s", attempt.Level, attempt.Error))
+		}
+	}
+	notes = append(notes, messageTexts(a.Warnings)...)
+	if len(removed)+len(changed) == 0 {
+		removed = append(removed, "Nothing; the document content is unchanged")
+	}
+
+	sections := []reportSection{{"Removed", removed}}
+	for _, s := range []reportSection{{"Changed", changed}, {"Left in place", kept}, {"Notes", notes}} {
+		if len(s.Items) > 0 {
+			sections = append(sections, s)
+		}
+	}
+	return sections
+}
+
+func (a pdfActions) summary(generated time.Time) string {
+	saved := 0.0
+	if a.OriginalSize > 0 {
+		saved = 100 * (1 - float64(a.OutputSize)/float64(a.OriginalSize))
+	}
+	return fmt.Sprintf("Generated %s. Level: %s. Size: %d -> %d bytes (%.1f%% smaller).",
+		generated.UTC().Format(time.RFC3339), a.Level, a.OriginalSize, a.OutputSize, saved)
+}
+
+// Render as Markdown or as a standalone HTML document; returns the text
+// and its MIME type
+func (a pdfActions) render(format string, generated time.Time) (string, string) {
+	var b strings.Builder
+	if format == pdfReportHTML {
+		b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>PDF sanitization report</title></head><body>\n")
+		b.WriteString("<h1>PDF sanitization report</h1>\n")
+		fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(a.summary(generated)))
+		for _, s := range a.sections() {
+			fmt.Fprintf(&b, "<h2>%s</h2>\n<ul>\n", html.EscapeString(s.Title))
+			for _, item := range s.Items {
+				fmt.Fprintf(&b, "<li>%s</li>\n", html.EscapeString(item))
+			}
+			b.WriteString("</ul>\n")
+		}
+		b.WriteString("</body></html>\n")
+		return b.String(), "text/html"
+	}
+
+	b.WriteString("# PDF sanitization report\n\n")
+	b.WriteString(a.summary(generated) + "\n")
+	for _, s := range a.sections() {
+		fmt.Fprintf(&b, "\n## %s\n\n", s.Title)
+		for _, item := range s.Items {
+			fmt.Fprintf(&b, "- %s\n", item)
+		}
+	}
+	return b.String(), "text/markdown"
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPDFReport(t *testing.T) {
+	data := []byte("%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog /OpenAction << /S /JavaScript /JS (app.alert(1)) >> >>\nendobj\n" +
+		"2 0 obj\n<< /Type /EmbeddedFile /Length 3 >>\nstream\nabc\nendstream\nendobj\n" +
+		"3 0 obj\n<< /Title (Invoice 42) /Producer (Scanner) /Custom (x) >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R /Info 3 0 R >>\n%%EOF\n")
+	out := applyPDFPass(t, (*pdfDocument).removeMetadata, data, defaultPDFOptions())
+	a := collectPDFActions(data, fixturePDFResult(data, out))
+	if fmt.Sprint(a.MetadataRemoved) != "[Title Producer]" || a.JavaScript != 1 || a.Attachments != 1 {
+		t.Fatalf("actions %+v", a)
+	}
+	md, mdType := a.render(pdfReportMarkdown, time.Now())
+	page, _ := a.render(pdfReportHTML, time.Now())
+	for _, want := range []string{"- 2 metadata keys: Producer, Title\n", "## Left in place\n\n- 1 JavaScript action\n"} {
+		if !strings.Contains(md, want) {
+			t.Fatalf("%s report lacks %q:\n%s", mdType, want, md)
+		}
+	}
+	if !strings.Contains(page, "<li>1 embedded file (attachment)</li>") {
+		t.Fatalf("HTML report lacks the attachment:\n%s", page)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Write a token, inserting a space only where two tokens would otherwise
+// run together
+func writePDFToken(buf *bytes.Buffer, tok string) {
+	if tok == "" {
+		return
+	}
+	if buf.Len() > 0 && isPDFRegular(buf.Bytes()[buf.Len()-1]) && isPDFRegular(tok[0]) {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(tok)
+}
+
+// Serialize a value with minimal whitespace
+func writePDFValue(buf *bytes.Buffer, v pdfValue) {
+	switch v.Kind {
+	case pdfNull:
+		writePDFToken(buf, "null")
+	case pdfBool, pdfNumber:
+		writePDFToken(buf, v.Raw)
+	case pdfName:
+		buf.WriteString(encodePDFName(v.Raw))
+	case pdfString:
+		buf.WriteByte('(')
+		for _, c := range v.Str {
+			switch c {
+			case '(', ')', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case '\r':
+				// Raw CR would be normalized to LF by readers
+				buf.WriteString(`\r`)
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		buf.WriteByte(')')
+	case pdfHexString:
+		const hexDigits = "0123456789ABCDEF"
+		buf.WriteByte('<')
+		for _, c := range v.Str {
+			buf.WriteByte(hexDigits[c>>4])
+			buf.WriteByte(hexDigits[c&0x0F])
+		}
+		buf.WriteByte('>')
+	case pdfArray:
+		buf.WriteByte('[')
+		for _, item := range v.Arr {
+			writePDFValue(buf, item)
+		}
+		buf.WriteByte(']')
+	case pdfDictKind:
+		buf.WriteString("<<")
+		if v.Dict != nil {
+			for _, k := range v.Dict.Keys {
+				buf.WriteString(encodePDFName(k))
+				writePDFValue(buf, v.Dict.Vals[k])
+			}
+		}
+		buf.WriteString(">>")
+	case pdfRefKind:
+		writePDFToken(buf, strconv.Itoa(v.Ref.Num))
+		writePDFToken(buf, strconv.Itoa(v.Ref.Gen))
+		writePDFToken(buf, "R")
+	}
+}
+
+// Encode a name with #xx escapes for delimiters and non-printables
+func encodePDFName(name string) string {
+	var b bytes.Buffer
+	b.WriteByte('/')
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x21 || c > 0x7E || c == '#' || isPDFDelimiter(c) {
+			fmt.Fprintf(&b, "#%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Object types that only describe the old file layout and are rebuilt
+func isLayoutObject(obj *pdfObject) bool {
+	switch obj.Dict().Name("Type") {
+	case "XRef", "ObjStm":
+		return obj.HasStream
+	}
+	return false
+}
+
+// Serialize the whole document with fresh offsets, correct stream lengths
+// and a classic xref table. Objects unpacked from object streams are
+// written as regular objects.
+func (doc *pdfDocument) serialize() ([]byte, error) {
+	if doc.Encrypted {
+		return nil, errors.New("encrypted documents cannot be rewritten")
+	}
+	if _, ok := doc.Trailer.Get("Root"); !ok {
+		return nil, errors.New("document has no /Root")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(doc.Data)))
+	fmt.Fprintf(buf, "%%PDF-%s\n%%\xE2\xE3\xCF\xD3\n", doc.Version)
+
+	nums := doc.objectNumbers()
+	offsets := map[int]int{}
+	gens := map[int]int{}
+	maxNum := 0
+	for _, num := range nums {
+		obj := doc.Objects[num]
+		if isLayoutObject(obj) {
+			continue
+		}
+		offsets[num] = buf.Len()
+		gens[num] = obj.Gen
+		if num > maxNum {
+			maxNum = num
+		}
+		writeIndirectObject(buf, num, obj)
+	}
+
+	xrefOffset := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", maxNum+1)
+	for num := 1; num <= maxNum; num++ {
+		if off, ok := offsets[num]; ok {
+			fmt.Fprintf(buf, "%010d %05d n \n", off, gens[num])
+		} else {
+			buf.WriteString("0000000000 00000 f \n")
+		}
+	}
+
+	trailer := doc.newTrailer(maxNum + 1)
+	buf.WriteString("trailer\n")
+	writePDFValue(buf, pdfDictValue(trailer))
+	fmt.Fprintf(buf, "\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+	return buf.Bytes(), nil
+}
+
+// Write "num gen obj ... endobj", with the stream's actual /Length
+func writeIndirectObject(buf *bytes.Buffer, num int, obj *pdfObject) {
+	fmt.Fprintf(buf, "%d %d obj\n", num, obj.Gen)
+	if obj.HasStream {
+		dict := obj.Dict().Clone()
+		dict.Set("Length", pdfIntValue(len(obj.Stream)))
+		writePDFValue(buf, pdfDictValue(dict))
+		buf.WriteString("\nstream\n")
+		buf.Write(obj.Stream)
+		buf.WriteString("\nendstream")
+	} else {
+		writePDFValue(buf, obj.Value)
+	}
+	buf.WriteString("\nendobj\n")
+}
+
+// Trailer entries carried over to a rewrite: /Root, /Info while its object
+// is still there, and /ID
+func (doc *pdfDocument) newTrailer(size int) *pdfDict {
+	trailer := newPDFDict()
+	trailer.Set("Size", pdfIntValue(size))
+	for _, key := range []string{"Root", "Info", "ID"} {
+		if v, ok := doc.Trailer.Get(key); ok {
+			if key == "Info" && v.Kind == pdfRefKind && doc.Objects[v.Ref.Num] == nil {
+				continue
+			}
+			trailer.Set(key, v)
+		}
+	}
+	return trailer
+}
+
+// Objects packed into each object stream by serializeCompact
+const objectsPerStream = 100
+
+// serialize, but with every non-stream object of generation 0 packed into
+// Flate-compressed object streams and a cross-reference stream in place of
+// the table. Needs PDF 1.5; older version headers are raised to it.
+func (doc *pdfDocument) serializeCompact() ([]byte, error) {
+	if doc.Encrypted {
+		return nil, errors.New("encrypted documents cannot be rewritten")
+	}
+	if _, ok := doc.Trailer.Get("Root"); !ok {
+		return nil, errors.New("document has no /Root")
+	}
+
+	version := doc.Version
+	if len(version) != 3 || version < "1.5" {
+		version = "1.5"
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(doc.Data)))
+	fmt.Fprintf(buf, "%%PDF-%s\n%%\xE2\xE3\xCF\xD3\n", version)
+
+	// Cross-reference entries: type 1 (offset, generation) for objects in
+	// the file, type 2 (object stream, index) for packed ones
+	type xrefEntry struct{ kind, a, b int }
+	entries := map[int]xrefEntry{}
+	var packed []int
+	maxNum := 0
+	for _, num := range doc.objectNumbers() {
+		obj := doc.Objects[num]
+		if isLayoutObject(obj) {
+			continue
+		}
+		if num > maxNum {
+			maxNum = num
+		}
+		if !obj.HasStream && obj.Gen == 0 {
+			packed = append(packed, num)
+			continue
+		}
+		entries[num] = xrefEntry{1, buf.Len(), obj.Gen}
+		writeIndirectObject(buf, num, obj)
+	}
+
+	next := maxNum + 1
+	for len(packed) > 0 {
+		chunk := packed[:minInt(len(packed), objectsPerStream)]
+		packed = packed[len(chunk):]
+		var index, body bytes.Buffer
+		for i, num := range chunk {
+			fmt.Fprintf(&index, "%d %d ", num, body.Len())
+			writePDFValue(&body, doc.Objects[num].Value)
+			body.WriteByte('\n')
+			entries[num] = xrefEntry{2, next, i}
+		}
+		dict := newPDFDict()
+		dict.Set("Type", pdfNameValue("ObjStm"))
+		dict.Set("N", pdfIntValue(len(chunk)))
+		dict.Set("First", pdfIntValue(index.Len()))
+		dict.Set("Filter", pdfNameValue("FlateDecode"))
+		stm := &pdfObject{Num: next, Value: pdfDictValue(dict), HasStream: true}
+		stm.Stream = deflateStream(append(index.Bytes(), body.Bytes()...))
+		entries[next] = xrefEntry{1, buf.Len(), 0}
+		writeIndirectObject(buf, next, stm)
+		next++
+	}
+
+	// The cross-reference stream lists itself
+	xrefNum, xrefOffset := next, buf.Len()
+	entries[xrefNum] = xrefEntry{1, xrefOffset, 0}
+	rows := make([]byte, 0, (xrefNum+1)*7)
+	for num := 0; num <= xrefNum; num++ {
+		e, ok := entries[num]
+		if !ok {
+			e = xrefEntry{0, 0, 0}
+			if num == 0 {
+				e.b = 65535
+			}
+		}
+		rows = append(rows, byte(e.kind))
+		rows = binary.BigEndian.AppendUint32(rows, uint32(e.a))
+		rows = binary.BigEndian.AppendUint16(rows, uint16(e.b))
+	}
+	dict := doc.newTrailer(xrefNum + 1)
+	dict.Set("Type", pdfNameValue("XRef"))
+	dict.Set("W", pdfValue{Kind: pdfArray, Arr: []pdfValue{pdfIntValue(1), pdfIntValue(4), pdfIntValue(2)}})
+	dict.Set("Filter", pdfNameValue("FlateDecode"))
+	writeIndirectObject(buf, xrefNum, &pdfObject{Num: xrefNum, Value: pdfDictValue(dict), HasStream: true, Stream: deflateStream(rows)})
+	fmt.Fprintf(buf, "startxref\n%d\n%%%%EOF\n", xrefOffset)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+)
+
+// Repeated image sharing. Scanners and report generators store a
+// letterhead, watermark or page background once per page. Image XObjects
+// with the same dictionary and data are stored once and every page's
+// resources point at that copy; soft masks are images too, so images
+// whose masks were shared can then match in turn.
+
+// Rounds of sharing: masks first, then the images that use them
+const imageShareRounds = 3
+
+// Point every use of an image XObject at the first identical copy, over
+// imageShareRounds rounds
+func (doc *pdfDocument) shareRepeatedImages(opts pdfOptions) bool {
+	shared, saved := 0, 0
+	for round := 0; round < imageShareRounds; round++ {
+		var nums []int
+		for _, num := range doc.objectNumbers() {
+			obj := doc.Objects[num]
+			if obj.HasStream && obj.Dict().Name("Subtype") == "Image" && opts.inScope(num) {
+				nums = append(nums, num)
+			}
+		}
+		replaced := map[int]int{}
+		first := map[string]int{}
+		for _, num := range nums {
+			key := objectSignature(doc.Objects[num])
+			if keeper, ok := first[key]; ok {
+				replaced[num] = keeper
+				saved += len(doc.Objects[num].Stream)
+				continue
+			}
+			first[key] = num
+		}
+		if len(replaced) == 0 {
+			break
+		}
+		shared += len(replaced)
+		replaceObjects(doc, replaced)
+	}
+	if shared == 0 {
+		return false
+	}
+	fmt.Printf("[WASM] Shared %d repeated images, %d bytes saved\n", shared, saved)
+	trace(nil, "pdf.images", "shared", "images", shared, "saved", saved)
+	return true
+}
+
+// Hash of an object's serialized value and stream; equal for identical
+// objects. Top-level keys are sorted, so writers that order them
+// differently still match.
+func objectSignature(obj *pdfObject) string {
+	h := sha256.New()
+	v := obj.Value
+	if v.Kind == pdfDictKind && v.Dict != nil {
+		dict := v.Dict.Clone()
+		sort.Strings(dict.Keys)
+		if obj.HasStream {
+			dict.Delete("Length")
+		}
+		v = pdfDictValue(dict)
+	}
+	var buf bytes.Buffer
+	writePDFValue(&buf, v)
+	h.Write(buf.Bytes())
+	if obj.HasStream {
+		h.Write([]byte("stream"))
+		h.Write(obj.Stream)
+	}
+	return string(h.Sum(nil))
+}
+
+// Drop the replaced objects and point every reference to one at its
+// replacement
+func replaceObjects(doc *pdfDocument, replaced map[int]int) {
+	for num := range replaced {
+		delete(doc.Objects, num)
+	}
+	for _, obj := range doc.Objects {
+		obj.Value = rewriteRefs(doc, obj.Value, replaced, 0)
+	}
+}
+
+func rewriteRefs(doc *pdfDocument, v pdfValue, replaced map[int]int, depth int) pdfValue {
+	if depth > 32 {
+		return v
+	}
+	switch v.Kind {
+	case pdfRefKind:
+		if to, ok := replaced[v.Ref.Num]; ok {
+			return pdfRefValue(pdfRef{Num: to, Gen: doc.Objects[to].Gen})
+		}
+	case pdfArray:
+		for i := range v.Arr {
+			v.Arr[i] = rewriteRefs(doc, v.Arr[i], replaced, depth+1)
+		}
+	case pdfDictKind:
+		if v.Dict != nil {
+			for key, item := range v.Dict.Vals {
+				v.Dict.Vals[key] = rewriteRefs(doc, item, replaced, depth+1)
+			}
+		}
+	}
+	return v
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestPDFSharedImages(t *testing.T) {
+	// A letterhead with a soft mask repeated on two pages, its
+	// dictionary keys in another order the second time, and a
+	// different image on a third page
+	gray := func(w, h, seed int) []byte {
+		b := make([]byte, w*h)
+		for i := range b {
+			b[i] = byte(i*seed + i/w)
+		}
+		return b
+	}
+	letterhead, mask, other := gray(40, 20, 3), gray(40, 20, 5), gray(40, 20, 7)
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	buf.WriteString("2 0 obj\n<< /Type /Pages /Kids [3 0 R 4 0 R 5 0 R] /Count 3 >>\nendobj\n")
+	for i, img := range []int{6, 7, 8} {
+		fmt.Fprintf(buf, "%d 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Resources << /XObject << /Im0 %d 0 R >> >> >>\nendobj\n", 3+i, img)
+	}
+	stream := func(num int, dict string, data []byte) {
+		fmt.Fprintf(buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", num, dict, len(data))
+		buf.Write(data)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+	stream(6, "/Type /XObject /Subtype /Image /Width 40 /Height 20 /ColorSpace /DeviceGray /BitsPerComponent 8 /SMask 9 0 R", letterhead)
+	stream(7, "/Subtype /Image /Type /XObject /Height 20 /Width 40 /BitsPerComponent 8 /ColorSpace /DeviceGray /SMask 10 0 R", letterhead)
+	stream(8, "/Type /XObject /Subtype /Image /Width 40 /Height 20 /ColorSpace /DeviceGray /BitsPerComponent 8", other)
+	stream(9, "/Type /XObject /Subtype /Image /Width 40 /Height 20 /ColorSpace /DeviceGray /BitsPerComponent 8", mask)
+	stream(10, "/Type /XObject /Subtype /Image /Width 40 /Height 20 /ColorSpace /DeviceGray /BitsPerComponent 8", mask)
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	data := buf.Bytes()
+
+	out := applyPDFPass(t, (*pdfDocument).shareRepeatedImages, data, defaultPDFOptions())
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Objects[7] != nil || doc.Objects[10] != nil || doc.Objects[8] == nil {
+		t.Fatal("repeated image and mask were not shared, or a different image was")
+	}
+	for page, want := range map[int]int{3: 6, 4: 6, 5: 8} {
+		resources := doc.resolveDict(doc.Objects[page].Dict().Vals["Resources"])
+		xobjects := doc.resolveDict(resources.Vals["XObject"])
+		if v := xobjects.Vals["Im0"]; v.Ref.Num != want {
+			t.Fatalf("page %d shows image %d, want %d", page, v.Ref.Num, want)
+		}
+	}
+	if v := doc.Objects[6].Dict().Vals["SMask"]; v.Ref.Num != 9 {
+		t.Fatal("shared image lost its soft mask")
+	}
+	if a := collectPDFActions(data, fixturePDFResult(data, out)); a.ImagesShared != 2 {
+		t.Fatalf("report counts %d shared images, want 2", a.ImagesShared)
+	}
+	if err := validatePDF(doc, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Font subsetting. Office suites embed whole TrueType fonts, megabytes for
+// a CJK face, of which the document shows a few dozen glyphs. With
+// subsetFonts set, the programs behind CIDFontType2 descendants of Type0
+// fonts with an Identity encoding keep only the glyphs some content
+// stream shows: page content, forms, annotation appearances and tiling
+// patterns, every code mapped to a glyph through /CIDToGIDMap. Glyph IDs
+// stay and unused glyphs are emptied, as subsetFont does for web fonts,
+// so widths, ToUnicode maps and merged subsets stay valid. Left whole are
+// fonts an interactive form lists in its default resources, since filling
+// in a field may need any glyph; simple TrueType fonts, whose codes reach
+// glyphs through the font's own cmap and encoding; and programs whose
+// descriptor pins the glyph set with /CIDSet. Content that cannot be read,
+// or shows text in a font its resources do not name, stops the pass.
+
+// Subset tag: six capital letters and a plus sign
+var pdfSubsetTag = regexp.MustCompile(`^[A-Z]{6}\+`)
+
+// A TrueType program subsetFonts may empty glyphs of
+type subsetProgram struct {
+	descriptors []*pdfDict   // descriptors pointing at it
+	fonts       []*pdfDict   // CIDFontType2 and Type0 dictionaries using it
+	used        map[int]bool // glyph IDs shown
+	whole       bool         // some use of it rules out subsetting
+}
+
+// Empty the glyphs that nothing shows from embedded CID TrueType fonts
+// when opts.SubsetFonts is set, unless the passes before it saved too
+// little to go on
+func (doc *pdfDocument) subsetFonts(opts pdfOptions) bool {
+	if !opts.SubsetFonts || opts.yield.low() {
+		return false
+	}
+	programs := subsetCandidates(doc, opts)
+	if len(programs) == 0 {
+		return false
+	}
+	if err := collectShownGlyphs(doc, programs); err != nil {
+		fmt.Printf("[WASM] Fonts left whole: %v\n", err)
+		return false
+	}
+
+	nums := make([]int, 0, len(programs))
+	for num, p := range programs {
+		if !p.whole {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	subset, saved := 0, 0
+	for _, num := range nums {
+		p := programs[num]
+		obj := doc.Objects[num]
+		program, err := decodeStream(doc, obj)
+		if err != nil {
+			continue
+		}
+		f, err := parseSFNT(program)
+		if err != nil || f.Flavor == sfntCFF {
+			continue
+		}
+		glyphs, err := trueTypeGlyphs(f)
+		if err != nil {
+			continue
+		}
+		roots := make([]int, 0, len(p.used))
+		for g := range p.used {
+			roots = append(roots, g)
+		}
+		sort.Ints(roots)
+		out, kept := keepTrueTypeGlyphs(f, glyphs, roots)
+		if kept == len(glyphs) {
+			continue
+		}
+		encoded := out.encode()
+		stream := deflateStream(encoded)
+		if len(stream) >= len(obj.Stream) {
+			continue
+		}
+		saved += len(obj.Stream) - len(stream)
+		obj.Stream = stream
+		setStreamFilters(obj.Dict(), []string{"FlateDecode"}, []*pdfDict{nil})
+		obj.Dict().Set("Length1", pdfIntValue(len(encoded)))
+		tagSubset(p, roots)
+		subset++
+		trace(nil, "pdf.fonts", "subset", "object", num, "glyphs", kept, "of", len(glyphs))
+	}
+	if subset == 0 {
+		return false
+	}
+	fmt.Printf("[WASM] Subset %d font programs, saving %d bytes\n", subset, saved)
+	return true
+}
+
+// The FontFile2 program behind a font dictionary, simple or Type0; 0 when
+// it has none
+func fontFile2(doc *pdfDocument, font *pdfDict) int {
+	descriptor := doc.resolveDict(font.Vals["FontDescriptor"])
+	if font.Name("Subtype") == "Type0" {
+		descendants := doc.resolve(font.Vals["DescendantFonts"])
+		if len(descendants.Arr) != 1 {
+			return 0
+		}
+		cidFont := doc.resolveDict(descendants.Arr[0])
+		if cidFont == nil {
+			return 0
+		}
+		descriptor = doc.resolveDict(cidFont.Vals["FontDescriptor"])
+	}
+	if descriptor == nil {
+		return 0
+	}
+	v, ok := descriptor.Get("FontFile2")
+	if !ok || v.Kind != pdfRefKind || doc.Objects[v.Ref.Num] == nil || !doc.Objects[v.Ref.Num].HasStream {
+		return 0
+	}
+	return v.Ref.Num
+}
+
+// For a Type0 font whose two-byte codes are CIDs of a CIDFontType2 font,
+// its CID-to-glyph map: nil for Identity; ok is false for any other font
+func cidToGlyphMap(doc *pdfDocument, font *pdfDict) (toGID []byte, ok bool) {
+	if font.Name("Subtype") != "Type0" {
+		return nil, false
+	}
+	if enc := font.Name("Encoding"); enc != "Identity-H" && enc != "Identity-V" {
+		return nil, false
+	}
+	descendants := doc.resolve(font.Vals["DescendantFonts"])
+	if len(descendants.Arr) != 1 {
+		return nil, false
+	}
+	cidFont := doc.resolveDict(descendants.Arr[0])
+	if cidFont == nil || cidFont.Name("Subtype") != "CIDFontType2" {
+		return nil, false
+	}
+	v, set := cidFont.Get("CIDToGIDMap")
+	if !set || doc.resolve(v).Raw == "Identity" {
+		return nil, true
+	}
+	if v.Kind != pdfRefKind || doc.Objects[v.Ref.Num] == nil {
+		return nil, false
+	}
+	data, err := decodeStream(doc, doc.Objects[v.Ref.Num])
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// FontFile2 programs of Type0 fonts that may qualify, by object number
+func subsetCandidates(doc *pdfDocument, opts pdfOptions) map[int]*subsetProgram {
+	programs := map[int]*subsetProgram{}
+	for _, num := range doc.objectNumbers() {
+		obj := doc.Objects[num]
+		font := obj.Dict()
+		if font == nil || obj.HasStream || font.Name("Type") != "Font" || font.Name("Subtype") != "Type0" {
+			continue
+		}
+		prog := fontFile2(doc, font)
+		if prog == 0 {
+			continue
+		}
+		p := programs[prog]
+		if p == nil {
+			p = &subsetProgram{used: map[int]bool{}}
+			programs[prog] = p
+		}
+		cidFont := doc.resolveDict(doc.resolve(font.Vals["DescendantFonts"]).Arr[0])
+		descriptor := doc.resolveDict(cidFont.Vals["FontDescriptor"])
+		_, cidSet := descriptor.Get("CIDSet")
+		if _, ok := cidToGlyphMap(doc, font); !ok || cidSet || !opts.inScope(prog) {
+			p.whole = true
+		}
+		p.fonts = append(p.fonts, font, cidFont)
+		known := false
+		for _, d := range p.descriptors {
+			known = known || d == descriptor
+		}
+		if !known {
+			p.descriptors = append(p.descriptors, descriptor)
+		}
+	}
+
+	// A simple font sharing the program reaches glyphs its own way
+	for _, num := range doc.objectNumbers() {
+		font := doc.Objects[num].Dict()
+		if font != nil && font.Name("Type") == "Font" && font.Name("Subtype") == "TrueType" && programs[fontFile2(doc, font)] != nil {
+			programs[fontFile2(doc, font)].whole = true
+		}
+	}
+
+	// Fields of an interactive form may show any glyph once filled in
+	if catalog := doc.catalog(); catalog != nil {
+		if form := doc.resolveDict(catalog.Vals["AcroForm"]); form != nil {
+			if dr := doc.resolveDict(form.Vals["DR"]); dr != nil {
+				if fonts := doc.resolveDict(dr.Vals["Font"]); fonts != nil {
+					for _, key := range fonts.Keys {
+						if font := doc.resolveDict(fonts.Vals[key]); font != nil && programs[fontFile2(doc, font)] != nil {
+							programs[fontFile2(doc, font)].whole = true
+						}
+					}
+				}
+			}
+		}
+	}
+	return programs
+}
+
+// Add the glyph of every code shown in a candidate program to its used
+// set, marking programs shown through a font that is not a qualifying
+// Type0 font whole. Fails when some content does not decode or shows text
+// in a font it does not name.
+func collectShownGlyphs(doc *pdfDocument, programs map[int]*subsetProgram) error {
+	// What showing text in a font means for subsetting, by font dictionary
+	type shownFont struct {
+		p     *subsetProgram // nil for fonts of other programs
+		toGID []byte
+	}
+	fontsSeen := map[*pdfDict]shownFont{}
+	lookup := func(font *pdfDict) shownFont {
+		if f, ok := fontsSeen[font]; ok {
+			return f
+		}
+		var f shownFont
+		if p := programs[fontFile2(doc, font)]; p != nil {
+			toGID, ok := cidToGlyphMap(doc, font)
+			if ok {
+				f = shownFont{p, toGID}
+			} else {
+				p.whole = true
+			}
+		}
+		fontsSeen[font] = f
+		return f
+	}
+
+	scan := func(obj *pdfObject, resources *pdfDict) error {
+		content, err := decodeStream(doc, obj)
+		if err != nil {
+			return fmt.Errorf("content stream %d does not decode", obj.Num)
+		}
+		var fonts *pdfDict
+		if resources != nil {
+			fonts = doc.resolveDict(resources.Vals["Font"])
+		}
+		var font *pdfDict
+		var failed error
+		show := func(s pdfValue) {
+			if s.Kind != pdfString && s.Kind != pdfHexString || len(s.Str) == 0 {
+				return
+			}
+			if font == nil {
+				failed = fmt.Errorf("content stream %d shows text in a font it does not name", obj.Num)
+				return
+			}
+			f := lookup(font)
+			if f.p == nil {
+				return
+			}
+			for i := 0; i+1 < len(s.Str); i += 2 {
+				cid := int(s.Str[i])<<8 | int(s.Str[i+1])
+				gid := cid
+				if f.toGID != nil {
+					gid = 0
+					if 2*cid+1 < len(f.toGID) {
+						gid = int(f.toGID[2*cid])<<8 | int(f.toGID[2*cid+1])
+					}
+				}
+				f.p.used[gid] = true
+			}
+		}
+		var stack []*pdfDict
+		scanContentOps(content, func(op string, operands []pdfValue) bool {
+			switch op {
+			case "q":
+				stack = append(stack, font)
+			case "Q":
+				// The font is text state, which q and Q save and restore
+				if len(stack) > 0 {
+					font = stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+				}
+			case "Tf":
+				font = nil
+				if len(operands) == 2 && operands[0].Kind == pdfName && fonts != nil {
+					font = doc.resolveDict(fonts.Vals[operands[0].Raw])
+				}
+			case "Tj", "'":
+				if len(operands) >= 1 {
+					show(operands[len(operands)-1])
+				}
+			case "\"":
+				if len(operands) == 3 {
+					show(operands[2])
+				}
+			case "TJ":
+				if len(operands) == 1 {
+					for _, item := range operands[0].Arr {
+						show(item)
+					}
+				}
+			}
+			return failed == nil
+		})
+		return failed
+	}
+
+	for _, num := range doc.pages() {
+		page := doc.Objects[num].Dict()
+		resources, _ := inheritedAttr(doc, page, "Resources")
+		var failed error
+		forEachRef(page.Vals["Contents"], func(ref int) {
+			if obj := doc.Objects[ref]; obj != nil && obj.HasStream && failed == nil {
+				failed = scan(obj, doc.resolveDict(resources))
+			}
+		})
+		if failed != nil {
+			return failed
+		}
+	}
+	// Forms (annotation appearances among them) and tiling patterns carry
+	// their own resources; one without would use whatever draws it
+	for _, num := range doc.objectNumbers() {
+		obj := doc.Objects[num]
+		dict := obj.Dict()
+		if !obj.HasStream || dict == nil {
+			continue
+		}
+		if _, pattern := dict.Get("PatternType"); dict.Name("Subtype") != "Form" && !pattern {
+			continue
+		}
+		resources := doc.resolveDict(dict.Vals["Resources"])
+		if resources == nil {
+			if content, err := decodeStream(doc, obj); err != nil || containsTextOps(content) {
+				return fmt.Errorf("form %d shows text without resources of its own", num)
+			}
+			continue
+		}
+		if err := scan(obj, resources); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Glyphs with outlines in a TrueType program; 0 when it does not parse
+func outlinedGlyphs(doc *pdfDocument, obj *pdfObject) int {
+	program, err := decodeStream(doc, obj)
+	if err != nil {
+		return 0
+	}
+	f, err := parseSFNT(program)
+	if err != nil {
+		return 0
+	}
+	glyphs, err := trueTypeGlyphs(f)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, g := range glyphs {
+		if len(g) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Whether content shows any text
+func containsTextOps(content []byte) bool {
+	found := false
+	scanContentOps(content, func(op string, _ []pdfValue) bool {
+		found = op == "Tj" || op == "TJ" || op == "'" || op == "\""
+		return !found
+	})
+	return found
+}
+
+// Give a subset's font names a tag, as the PDF specification asks of
+// subsets, unless they have one; the tag is derived from the glyphs kept
+func tagSubset(p *subsetProgram, glyphs []int) {
+	h := sha256.New()
+	for _, g := range glyphs {
+		h.Write([]byte{byte(g >> 8), byte(g)})
+	}
+	sum := h.Sum(nil)
+	tag := make([]byte, 0, 7)
+	for _, b := range sum[:6] {
+		tag = append(tag, 'A'+b%26)
+	}
+	tag = append(tag, '+')
+	retag := func(dict *pdfDict, key string) {
+		if name := dict.Name(key); name != "" && !pdfSubsetTag.MatchString(name) {
+			dict.Set(key, pdfNameValue(string(tag)+name))
+		}
+	}
+	for _, font := range p.fonts {
+		retag(font, "BaseFont")
+	}
+	for _, descriptor := range p.descriptors {
+		retag(descriptor, "FontName")
+	}
+}
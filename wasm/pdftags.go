@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Tagged (accessible) PDFs. The structure tree under /StructTreeRoot ties
+// marked-content sequences (BDC/BMC with an MCID) in the content streams
+// to headings, paragraphs, figures and links; screen readers follow it.
+// Only flattening hidden layers edits content streams, and recoding keeps
+// their decoded bytes, so marked content otherwise survives as it is. A
+// few options do degrade tagging: dropping links the structure tree points
+// at, cutting hidden layers (and the marked content in them), stripping
+// the XMP packet that declares PDF/UA conformance, and removing the title
+// a tagged document asks viewers to display. On a tagged input each of
+// them is reported; with preserveTags set they are limited so the tagging
+// stays whole, and every level's output must keep the structure tree and
+// every marked-content sequence, or the chain falls back.
+
+// Bound on structure tree nodes visited
+const maxStructNodes = 1000000
+
+// The tagging of a document, compared between input and output
+type pdfTagging struct {
+	Tagged        bool   // the catalog has a /StructTreeRoot
+	Marked        bool   // /MarkInfo /Marked true
+	Lang          string // the catalog's /Lang
+	Nodes         int    // structure elements and their content references
+	MarkedContent int    // BMC and BDC operators in page and form content
+}
+
+func findTagging(doc *pdfDocument) pdfTagging {
+	var t pdfTagging
+	catalog := doc.catalog()
+	if catalog == nil {
+		return t
+	}
+	if info := doc.resolveDict(catalog.Vals["MarkInfo"]); info != nil {
+		t.Marked = doc.resolve(info.Vals["Marked"]).Raw == "true"
+	}
+	if lang := doc.resolve(catalog.Vals["Lang"]); lang.Kind == pdfString || lang.Kind == pdfHexString {
+		t.Lang = string(lang.Str)
+	}
+	root := doc.resolveDict(catalog.Vals["StructTreeRoot"])
+	if root == nil {
+		return t
+	}
+	t.Tagged = true
+
+	visited := map[*pdfDict]bool{}
+	var walk func(v pdfValue, depth int)
+	walk = func(v pdfValue, depth int) {
+		if depth > 256 || len(visited) >= maxStructNodes {
+			return
+		}
+		v = doc.resolve(v)
+		switch v.Kind {
+		case pdfArray:
+			for _, kid := range v.Arr {
+				walk(kid, depth+1)
+			}
+		case pdfDictKind:
+			if visited[v.Dict] {
+				return
+			}
+			visited[v.Dict] = true
+			t.Nodes++
+			walk(v.Dict.Vals["K"], depth+1)
+		case pdfNumber:
+			t.Nodes++ // a marked-content ID
+		}
+	}
+	walk(root.Vals["K"], 0)
+
+	contents := map[int]bool{}
+	for _, num := range doc.pages() {
+		forEachRef(doc.Objects[num].Dict().Vals["Contents"], func(ref int) { contents[ref] = true })
+	}
+	for _, num := range doc.objectNumbers() {
+		obj := doc.Objects[num]
+		if !obj.HasStream || !contents[num] && obj.Dict().Name("Subtype") != "Form" {
+			continue
+		}
+		data, err := decodeStream(doc, obj)
+		if err != nil {
+			continue
+		}
+		scanContentOps(data, func(op string, _ []pdfValue) bool {
+			if op == "BMC" || op == "BDC" {
+				t.MarkedContent++
+			}
+			return true
+		})
+	}
+	return t
+}
+
+// Options that would degrade the tagging of doc, by name
+func taggingConflicts(doc *pdfDocument, opts pdfOptions) []string {
+	catalog := doc.catalog()
+	if catalog == nil || doc.resolveDict(catalog.Vals["StructTreeRoot"]) == nil {
+		return nil
+	}
+	var conflicts []string
+	if opts.DropNavigation {
+		for _, link := range findNavigation(doc).Links {
+			if _, tagged := link.Get("StructParent"); tagged {
+				conflicts = append(conflicts, "dropNavigation")
+				break
+			}
+		}
+	}
+	if opts.XMP == xmpStrip {
+		if xmp := catalog.Vals["Metadata"]; xmp.Kind == pdfRefKind && doc.Objects[xmp.Ref.Num] != nil {
+			if packet, err := decodeStream(doc, doc.Objects[xmp.Ref.Num]); err == nil && bytes.Contains(packet, []byte("pdfuaid:part")) {
+				conflicts = append(conflicts, "xmp")
+			}
+		}
+	}
+	if opts.FlattenHiddenLayers && len(hiddenLayers(doc)) > 0 {
+		conflicts = append(conflicts, "flattenHiddenLayers")
+	}
+	prefs := doc.resolveDict(catalog.Vals["ViewerPreferences"])
+	if prefs != nil && doc.resolve(prefs.Vals["DisplayDocTitle"]).Raw == "true" && stripsMetadataKey(opts, "Title") {
+		conflicts = append(conflicts, "stripMetadata")
+	}
+	return conflicts
+}
+
+// Whether the metadata pass removes key from the information dictionary
+func stripsMetadataKey(opts pdfOptions, key string) bool {
+	for _, k := range opts.KeepMetadata {
+		if strings.TrimPrefix(k, "/") == key {
+			return false
+		}
+	}
+	for _, k := range opts.StripMetadata {
+		if k == "*" || strings.TrimPrefix(k, "/") == key {
+			return true
+		}
+	}
+	return false
+}
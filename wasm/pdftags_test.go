@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestPDFTagged(t *testing.T) {
+	// A tagged page with a tagged link, PDF/UA XMP and a title the
+	// viewer is asked to show: every aggressive option conflicts,
+	// is reported, and with preserveTags is limited
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:pdfuaid="http://www.aiim.org/pdfua/ns/id/" pdfuaid:part="1"/></rdf:RDF></x:xmpmeta>`)
+	content := []byte("/P <</MCID 0>> BDC BT /F1 12 Tf 10 50 Td (Hello) Tj ET EMC\n")
+	objs := []string{
+		"<< /Type /Catalog /Pages 2 0 R /StructTreeRoot 5 0 R /MarkInfo << /Marked true >> /Lang (en) /ViewerPreferences << /DisplayDocTitle true >> /Metadata 9 0 R /Names << /Dests << /Names [(top) [3 0 R /Fit]] >> >> >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Contents 8 0 R /Annots [7 0 R] /StructParents 0 >>",
+		"<< /Title (Accessible) /Producer (Writer) >>",
+		"<< /Type /StructTreeRoot /K [6 0 R] >>",
+		"<< /Type /StructElem /S /Document /P 5 0 R /K [<< /Type /StructElem /S /P /Pg 3 0 R /K 0 >> << /Type /StructElem /S /Link /K << /Type /OBJR /Obj 7 0 R >> >>] >>",
+		"<< /Type /Annot /Subtype /Link /Rect [0 0 50 20] /Dest (top) /StructParent 1 >>",
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.7\n")
+	for i, obj := range objs {
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	fmt.Fprintf(buf, "8 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+	fmt.Fprintf(buf, "9 0 obj\n<< /Type /Metadata /Subtype /XML /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(xmp), xmp)
+	buf.WriteString("trailer\n<< /Root 1 0 R /Info 4 0 R >>\n%%EOF\n")
+	data := buf.Bytes()
+
+	doc, err := parsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := findTagging(doc)
+	if !tags.Tagged || !tags.Marked || tags.Lang != "en" || tags.Nodes != 5 || tags.MarkedContent != 1 {
+		t.Fatalf("tagging found as %+v", tags)
+	}
+
+	opts := defaultPDFOptions()
+	opts.DropNavigation = true
+	opts.XMP = xmpStrip
+	count := func(res pdfResult, code string) int {
+		n := 0
+		for _, w := range res.Warnings {
+			if w.Code == code {
+				n++
+			}
+		}
+		return n
+	}
+	res, err := runPDFFallbackChain(context.Background(), data, opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(res, "pdf.tagsDegraded"); n != 3 {
+		t.Fatalf("%d degradations reported, want 3", n)
+	}
+
+	opts.PreserveTags = true
+	if res, err = runPDFFallbackChain(context.Background(), data, opts, func(int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(res, "pdf.tagsKept"); n != 3 || res.Level != pdfLevelFull {
+		t.Fatalf("%d limits reported at level %s", n, res.Level)
+	}
+	out, err := parsePDF(res.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, title := pdfInfo(out).Get("Title")
+	_, xmpKept := out.catalog().Get("Metadata")
+	if findTagging(out) != tags || !title || !xmpKept || len(findNavigation(out).Links) != 1 || brokenDestinations(out) != 0 {
+		t.Fatal("tagging degraded under preserveTags")
+	}
+
+	// An output missing a marked-content sequence is rejected
+	opts.keepTags = true
+	baseline := pdfBaselineOf(doc, opts)
+	doc.Objects[8].Stream = []byte("BT /F1 12 Tf 10 50 Td (Hello) Tj ET\n")
+	untagged, err := doc.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.checkBytes(untagged) == nil {
+		t.Fatal("lost marked content passed the check")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Text integrity. None of the passes is meant to change what a page says:
+// images are recompressed, fonts merged and streams recoded, but the
+// strings content streams show stay byte for byte. Each level's output is
+// checked for it like for pages and streams: the text every page shows,
+// through its content and the forms it draws, is taken from input and
+// output and compared, and a level whose text differs on any page fails,
+// so the chain falls back to a gentler one. The comparison is over the
+// shown string bytes rather than Unicode, since the fonts mapping them
+// stay too. Hidden layers flattenHiddenLayers may cut are left out of both
+// sides when that option is set.
+
+// Bound on form XObjects followed per page
+const maxTextForms = 1000
+
+// The text of one page; OK is false when some content stream did not
+// decode, and then the page is not compared
+type pdfPageText struct {
+	Text []byte
+	OK   bool
+}
+
+// A level's output shows different text than the input on Page
+type textChangedError struct {
+	Page   int
+	Detail string
+}
+
+func (e *textChangedError) Error() string {
+	return fmt.Sprintf("text on page %d changed: %s", e.Page, e.Detail)
+}
+
+// Text of every page, in page order. With skipHidden, marked content and
+// XObjects in hidden layers are left out.
+func pdfText(doc *pdfDocument, skipHidden bool) []pdfPageText {
+	var hidden map[int]bool
+	if skipHidden {
+		hidden = hiddenLayers(doc)
+	}
+	pages := doc.pages()
+	out := make([]pdfPageText, len(pages))
+	for i, num := range pages {
+		page := doc.Objects[num].Dict()
+		resources, _ := inheritedAttr(doc, page, "Resources")
+		t := &textCollector{doc: doc, hidden: hidden, ok: true, forms: map[int]bool{}}
+		forEachRef(page.Vals["Contents"], func(ref int) {
+			t.stream(doc.Objects[ref], doc.resolveDict(resources), 0)
+		})
+		out[i] = pdfPageText{Text: t.text.Bytes(), OK: t.ok}
+	}
+	return out
+}
+
+type textCollector struct {
+	doc    *pdfDocument
+	hidden map[int]bool
+	text   bytes.Buffer
+	ok     bool
+	forms  map[int]bool // forms on the current draw path, against cycles
+	drawn  int
+}
+
+// Collect the strings one content stream shows, following forms it draws
+func (t *textCollector) stream(obj *pdfObject, resources *pdfDict, depth int) {
+	if obj == nil || !obj.HasStream {
+		return
+	}
+	content, err := decodeStream(t.doc, obj)
+	if err != nil {
+		t.ok = false
+		return
+	}
+	var properties, xobjects *pdfDict
+	if resources != nil {
+		properties = t.doc.resolveDict(resources.Vals["Properties"])
+		xobjects = t.doc.resolveDict(resources.Vals["XObject"])
+	}
+	inHidden := func(dict *pdfDict, key string) bool {
+		if dict == nil || len(t.hidden) == 0 {
+			return false
+		}
+		v, ok := dict.Get(key)
+		return ok && v.Kind == pdfRefKind && t.hidden[v.Ref.Num]
+	}
+
+	skip := 0 // marked-content depth inside a hidden section
+	scanContentOps(content, func(op string, operands []pdfValue) bool {
+		if skip > 0 {
+			switch op {
+			case "BMC", "BDC":
+				skip++
+			case "EMC":
+				skip--
+			}
+			return true
+		}
+		switch op {
+		case "BDC":
+			if len(operands) == 2 && operands[0].Raw == "OC" && operands[1].Kind == pdfName && inHidden(properties, operands[1].Raw) {
+				skip = 1
+			}
+		case "Tj", "'":
+			t.show(operands, 0)
+		case "\"":
+			t.show(operands, 2)
+		case "TJ":
+			if len(operands) == 1 {
+				t.show(operands[0].Arr, -1)
+			}
+		case "Do":
+			if len(operands) != 1 || operands[0].Kind != pdfName || xobjects == nil {
+				break
+			}
+			ref := xobjects.Vals[operands[0].Raw]
+			form := t.doc.resolveDict(ref)
+			if form == nil || form.Name("Subtype") != "Form" || inHidden(form, "OC") || ref.Kind != pdfRefKind {
+				break
+			}
+			if depth >= 16 || t.forms[ref.Ref.Num] || t.drawn >= maxTextForms {
+				break
+			}
+			t.drawn++
+			t.forms[ref.Ref.Num] = true
+			formResources := t.doc.resolveDict(form.Vals["Resources"])
+			if formResources == nil {
+				formResources = resources
+			}
+			t.stream(t.doc.Objects[ref.Ref.Num], formResources, depth+1)
+			delete(t.forms, ref.Ref.Num)
+		}
+		return true
+	})
+}
+
+// Append the string operand at index i, or every string operand when i
+// is negative, ending each shown run with a newline
+func (t *textCollector) show(operands []pdfValue, i int) {
+	for j, v := range operands {
+		if (i < 0 || j == i) && (v.Kind == pdfString || v.Kind == pdfHexString) {
+			t.text.Write(v.Str)
+		}
+	}
+	t.text.WriteByte('\n')
+}
+
+// Compare the text of output pages with the input's; nil when every page
+// that could be read on both sides shows the same text
+func compareText(before, after []pdfPageText) error {
+	for i := range before {
+		if i >= len(after) || !before[i].OK || !after[i].OK || bytes.Equal(before[i].Text, after[i].Text) {
+			continue
+		}
+		a, b := before[i].Text, after[i].Text
+		at := 0
+		for at < len(a) && at < len(b) && a[at] == b[at] {
+			at++
+		}
+		detail := fmt.Sprintf("%q where %q was expected", textExcerpt(b, at), textExcerpt(a, at))
+		return &textChangedError{Page: i + 1, Detail: detail}
+	}
+	return nil
+}
+
+// The shown run around pos, at most 24 bytes either side
+func textExcerpt(text []byte, pos int) []byte {
+	start := bytes.LastIndexByte(text[:pos], '\n') + 1
+	if start < pos-24 {
+		start = pos - 24
+	}
+	end := pos + 24
+	if end > len(text) {
+		end = len(text)
+	}
+	if nl := bytes.IndexByte(text[pos:end], '\n'); nl >= 0 {
+		end = pos + nl
+	}
+	return text[start:end]
+}
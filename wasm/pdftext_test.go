@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPDFTextIntegrity(t *testing.T) {
+	// Page 2 shows text directly and through a form; a copy whose
+	// form says something else fails the check on that page
+	content := "BT /F1 12 Tf 72 712 Td (Hello) Tj [(Wor) -20 (ld)] TJ <2121> Tj ET\n/Fm1 Do\n"
+	form := "BT /F1 12 Tf 0 0 Td (Footer) Tj ET"
+	build := func(form string) []byte {
+		buf := new(bytes.Buffer)
+		buf.WriteString("%PDF-1.4\n")
+		buf.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+		buf.WriteString("2 0 obj\n<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 /MediaBox [0 0 200 100] >>\nendobj\n")
+		buf.WriteString("3 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\n")
+		buf.WriteString("4 0 obj\n<< /Type /Page /Parent 2 0 R /Contents 5 0 R /Resources << /XObject << /Fm1 6 0 R >> >> >>\nendobj\n")
+		fmt.Fprintf(buf, "5 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+		fmt.Fprintf(buf, "6 0 obj\n<< /Type /XObject /Subtype /Form /BBox [0 0 200 100] /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(form), form)
+		buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+		return buf.Bytes()
+	}
+	data := build(form)
+	doc, err := parsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := pdfText(doc, false)
+	if len(text) != 2 || len(text[0].Text) != 0 || string(text[1].Text) != "Hello\nWorld\n!!\nFooter\n" {
+		t.Fatalf("text extracted as %+v", text)
+	}
+	baseline := pdfBaselineOf(doc, defaultPDFOptions())
+	if err := baseline.checkBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	changed := build("BT /F1 12 Tf 0 0 Td (Fooler) Tj ET")
+	var textErr *textChangedError
+	if err := baseline.checkBytes(changed); !errors.As(err, &textErr) || textErr.Page != 2 || !strings.Contains(err.Error(), `"Fooler"`) {
+		t.Fatalf("changed text checked as %v", err)
+	}
+	res, err := runPDFFallbackChain(context.Background(), data, defaultPDFOptions(), func(int) {})
+	if err != nil || res.Level != pdfLevelFull {
+		t.Fatalf("level %s: %v %v", res.Level, err, res.Attempts)
+	}
+}
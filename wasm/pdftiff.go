@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Options for pdfToTIFF
+type pdfToTIFFOptions struct {
+	DPI         int    `json:"dpi"`
+	Compression string `json:"compression"` // "ccitt", "deflate" or "none"
+	Threshold   int    `json:"threshold"`   // gray level below which CCITT pixels are black
+	// Only image content is drawn. Pages with text, vector graphics or
+	// anything else that would be left out fail the conversion unless
+	// this is set, in which case they are rasterized with a warning.
+	AllowImageOnly bool `json:"allowImageOnly"`
+}
+
+func defaultPDFToTIFFOptions() pdfToTIFFOptions {
+	return pdfToTIFFOptions{DPI: 200, Compression: tiffWriteDeflate, Threshold: 128}
+}
+
+// Rasterize every page and write them as one multi-page TIFF, encoding
+// each page as soon as it is rendered so only one raster is held at a
+// time. Warnings are prefixed with their page number.
+func convertPDFToTIFF(ctx context.Context, data []byte, opts pdfToTIFFOptions, reportProgress func(int)) ([]byte, int, []message, error) {
+	switch opts.Compression {
+	case tiffWriteCCITT, tiffWriteDeflate, tiffWriteNone:
+	default:
+		return nil, 0, nil, fmt.Errorf("unknown compression %q", opts.Compression)
+	}
+	if opts.DPI < 36 || opts.DPI > 600 {
+		return nil, 0, nil, errors.New("dpi must be between 36 and 600")
+	}
+
+	doc, err := ParsePDF(data)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if doc.Encrypted {
+		return nil, 0, nil, errors.New("encrypted PDFs cannot be rasterized")
+	}
+	pageNums := doc.pages()
+	if len(pageNums) == 0 {
+		return nil, 0, nil, errors.New("document has no pages")
+	}
+
+	var warnings []message
+	w := newTIFFWriter(opts.Compression, uint8(opts.Threshold), opts.DPI)
+	for i, num := range pageNums {
+		if err := checkCancelled(ctx); err != nil {
+			return nil, 0, nil, err
+		}
+		img, pageWarnings, err := rasterizePage(doc, num, float64(opts.DPI))
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("page %d: %v", i+1, err)
+		}
+		if len(pageWarnings) > 0 && !opts.AllowImageOnly {
+			return nil, 0, nil, fmt.Errorf("page %d: %s (set allowImageOnly to rasterize image content only)", i+1, pageWarnings[0])
+		}
+		for _, w := range pageWarnings {
+			warnings = append(warnings, newMessage("pdf.pageWarning", "page", i+1, "warning", w))
+		}
+		if err := w.addPage(img); err != nil {
+			return nil, 0, nil, err
+		}
+		reportProgress(10 + (i+1)*85/len(pageNums))
+	}
+	return w.bytes(), len(pageNums), warnings, nil
+}
+
+// pdfToTIFF(data, options?, progress?) rasterizes a PDF into a multi-page
+// TIFF. Options: {dpi, compression: "ccitt" | "deflate" | "none",
+// threshold, allowImageOnly}. Only image content is rendered, which covers
+// scanned documents; pages with text or vector graphics reject the call
+// unless allowImageOnly is set, which renders their images and warns.
+// Resolves with the standard result object plus pageCount and warnings.
+func pdfToTIFF(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] pdfToTIFF called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("pdfToTIFF", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("pdfToTIFF", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := defaultPDFToTIFFOptions()
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+
+	return runAsync("pdfToTIFF", func() (interface{}, error) {
+		j := startJob("pdfToTIFF")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		reportProgress := progressReporter(progressCallback, j)
+
+		out, pageCount, warnings, err := convertPDFToTIFF(j.ctx, inputBytes, opts, reportProgress)
+		if err != nil {
+			return nil, err
+		}
+		reportProgress(100)
+
+		result := newResultObject(inputBytes, out)
+		result.Set("type", "image/tiff")
+		result.Set("pageCount", pageCount)
+		setMessages(result, warnings)
+		return result, nil
+	})
+}
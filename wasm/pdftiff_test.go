@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTIFFWriterAddsPagesInOrder(t *testing.T) {
+	for _, compression := range []string{tiffWriteCCITT, tiffWriteDeflate, tiffWriteNone} {
+		w := newTIFFWriter(compression, 128, 150)
+		for _, width := range []int{40, 24} {
+			if err := w.addPage(fixtureGradient(width, 16)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out := w.bytes()
+		pages, err := readTIFFPages(out)
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if len(pages) != 2 {
+			t.Fatalf("%s: %d pages, want 2", compression, len(pages))
+		}
+		for i, width := range []int{40, 24} {
+			img, err := decodeTIFFPage(out, pages[i])
+			if err != nil {
+				t.Fatalf("%s page %d: %v", compression, i+1, err)
+			}
+			if got := img.Bounds().Dx(); got != width {
+				t.Errorf("%s page %d is %d wide, want %d", compression, i+1, got, width)
+			}
+			if pages[i].XDPI != 150 {
+				t.Errorf("%s page %d at %v dpi, want 150", compression, i+1, pages[i].XDPI)
+			}
+		}
+	}
+}
+
+func TestPDFToTIFFWritesEveryPage(t *testing.T) {
+	pdf := fixturePDF()
+	out, pageCount, warnings, err := convertPDFToTIFF(context.Background(), pdf, defaultPDFToTIFFOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pageCount != 1 || len(warnings) != 0 {
+		t.Errorf("%d pages with warnings %v, want 1 and none", pageCount, warnings)
+	}
+	pages, err := readTIFFPages(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := decodeTIFFPage(out, pages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A 240x180pt page at 200dpi
+	if b := img.Bounds(); b.Dx() != 667 || b.Dy() != 500 {
+		t.Errorf("page rendered at %v", b)
+	}
+}
+
+func TestPDFToTIFFRejectsUndrawnContent(t *testing.T) {
+	pdf := fixtureThreePagePDF(fixturePageStreams())
+	opts := defaultPDFToTIFFOptions()
+	if _, _, _, err := convertPDFToTIFF(context.Background(), pdf, opts, func(int) {}); err == nil {
+		t.Fatal("pages with vector graphics were rasterized without allowImageOnly")
+	}
+
+	opts.AllowImageOnly = true
+	_, pageCount, warnings, err := convertPDFToTIFF(context.Background(), pdf, opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pageCount != 3 || len(warnings) != 3 {
+		t.Errorf("%d pages with %d warnings, want 3 and 3", pageCount, len(warnings))
+	}
+}
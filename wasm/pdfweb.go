@@ -0,0 +1,43 @@
+package main
+
+// The web-optimized preset, what most people asking for a PDF small enough
+// to email or put on a site want. webOptimized fills in:
+//
+//   - maxImageDPI 150, enough for screens and office printers
+//   - imageQuality 75 for the JPEG re-encode
+//   - subsetFonts, which only reaches TrueType CID fonts (CIDFontType2
+//     under Type0); simple TrueType, Type 1 and CFF programs stay whole
+//   - objectStreams, unless compatibility is strict
+//   - stripMetadata "*" and xmp "strip"; keepMetadata still keeps its keys
+//
+// A maxImageDPI or imageQuality given along with it wins. The preset does
+// not linearize for Fast Web View: the rewrite writes no hint tables, and
+// linearization only helps viewers that fetch byte ranges from a server.
+
+// Settings the web-optimized preset fills in
+const (
+	webImageDPI     = 150
+	webImageQuality = 75
+)
+
+// o with the web-optimized preset filled in when o.WebOptimized is set
+func (o pdfOptions) withPreset() pdfOptions {
+	if !o.WebOptimized {
+		return o
+	}
+	if o.MaxImageDPI == 0 {
+		o.MaxImageDPI = webImageDPI
+	}
+	if o.ImageQuality == 0 {
+		o.ImageQuality = webImageQuality
+	}
+	o.SubsetFonts = true
+	if o.Compatibility != pdfCompatStrict {
+		o.ObjectStreams = true
+	}
+	o.StripMetadata = []string{"*"}
+	if o.XMP == xmpKeep {
+		o.XMP = xmpStrip
+	}
+	return o
+}
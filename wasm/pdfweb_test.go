@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestPDFWebPreset(t *testing.T) {
+	// A 600x400 photo drawn 72x48pt wide needs 150x100 pixels at
+	// 150 dpi; the CID font shows only "A", so "B" and "C" are
+	// emptied. The output packs its dictionaries in object streams.
+	photo := fixtureJPEG(fixtureGradient(600, 400))
+	program := fixtureTTF()
+	content := "q 72 0 0 48 10 10 cm /Im1 Do Q BT /F1 12 Tf 10 70 Td <0001> Tj ET"
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.4\n")
+	buf.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	buf.WriteString("2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n")
+	buf.WriteString("3 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Contents 4 0 R /Resources << /XObject << /Im1 5 0 R >> /Font << /F1 6 0 R >> >> >>\nendobj\n")
+	fmt.Fprintf(buf, "4 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+	fmt.Fprintf(buf, "5 0 obj\n<< /Type /XObject /Subtype /Image /Width 600 /Height 400 /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n", len(photo))
+	buf.Write(photo)
+	buf.WriteString("\nendstream\nendobj\n")
+	buf.WriteString("6 0 obj\n<< /Type /Font /Subtype /Type0 /BaseFont /Test /Encoding /Identity-H /DescendantFonts [7 0 R] >>\nendobj\n")
+	buf.WriteString("7 0 obj\n<< /Type /Font /Subtype /CIDFontType2 /BaseFont /Test /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor 8 0 R /CIDToGIDMap /Identity >>\nendobj\n")
+	buf.WriteString("8 0 obj\n<< /Type /FontDescriptor /FontName /Test /Flags 32 /FontFile2 9 0 R >>\nendobj\n")
+	fmt.Fprintf(buf, "9 0 obj\n<< /Length %d /Length1 %d >>\nstream\n", len(program), len(program))
+	buf.Write(program)
+	buf.WriteString("\nendstream\nendobj\n")
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	data := buf.Bytes()
+
+	doc, err := parsePDF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placements := imagePlacements(doc)
+	if p := placements[5]; len(placements) != 1 || p.Width != 72 || p.Height != 48 {
+		t.Fatalf("placements found as %v", placements)
+	}
+	opts := defaultPDFOptions()
+	opts.MaxImageDPI = 150
+	opts.placements = placements
+	if w, h, ok := reencodeSize(5, 600, 400, opts); !ok || w != 150 || h != 100 {
+		t.Fatalf("re-encode size %dx%d", w, h)
+	}
+	opts.MaxImageDPI = 600
+	if _, _, ok := reencodeSize(5, 600, 400, opts); ok {
+		t.Fatal("an image drawn near its resolution was downsampled")
+	}
+
+	opts = defaultPDFOptions()
+	opts.WebOptimized = true
+	opts.MaxImageDPI = 300
+	if preset := opts.withPreset(); preset.MaxImageDPI != 300 || preset.ImageQuality != webImageQuality || !preset.SubsetFonts || !preset.ObjectStreams {
+		t.Fatalf("preset filled in as %+v", preset)
+	}
+	opts.MaxImageDPI = 0
+	strict := opts
+	strict.ObjectStreams = true
+	strict.Compatibility = pdfCompatStrict
+	if strict.validate() == nil {
+		t.Fatal("object streams were accepted under strict compatibility")
+	}
+
+	res, err := runPDFFallbackChain(context.Background(), data, opts, func(int) {})
+	if err != nil || res.Level != pdfLevelFull {
+		t.Fatalf("level %s: %v %v", res.Level, err, res.Attempts)
+	}
+	if !bytes.HasPrefix(res.Data, []byte("%PDF-1.5")) || !bytes.Contains(res.Data, []byte("/ObjStm")) || !bytes.Contains(res.Data, []byte("/XRef")) {
+		t.Fatal("output has no object streams")
+	}
+	out, err := parsePDF(res.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.pages()) != 1 {
+		t.Fatalf("output has %d pages", len(out.pages()))
+	}
+	if w, _ := out.Objects[5].Dict().Vals["Width"].Int(); w != 150 {
+		t.Fatalf("image is %d pixels wide", w)
+	}
+	if n := outlinedGlyphs(out, out.Objects[9]); n != 2 {
+		t.Fatalf("font program keeps %d glyphs", n)
+	}
+	if name := out.Objects[8].Dict().Name("FontName"); !pdfSubsetTag.MatchString(name) {
+		t.Fatalf("subset named %s", name)
+	}
+	if actions := collectPDFActions(data, res); actions.FontsSubset != 1 {
+		t.Fatalf("report counts %d subset fonts", actions.FontsSubset)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Minimal PDF serializer: numbered objects, a classic xref table and trailer
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int // byte offset of each object, index = number-1; 0 = reserved
+}
+
+func newPDFWriter() *pdfWriter {
+	w := &pdfWriter{}
+	// Binary comment marks the file as containing 8-bit data
+	w.buf.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+	return w
+}
+
+// Reserve an object number to be written later with setObject
+func (w *pdfWriter) reserve() int {
+	w.offsets = append(w.offsets, 0)
+	return len(w.offsets)
+}
+
+// Write body as object num (previously obtained from reserve)
+func (w *pdfWriter) setObject(num int, body string) {
+	w.offsets[num-1] = w.buf.Len()
+	fmt.Fprintf(&w.buf, "%d 0 obj\n%s\nendobj\n", num, body)
+}
+
+// Append a new object and return its number
+func (w *pdfWriter) addObject(body string) int {
+	num := w.reserve()
+	w.setObject(num, body)
+	return num
+}
+
+// Append a stream object; dict holds the entries besides /Length
+func (w *pdfWriter) addStream(dict string, data []byte) int {
+	num := w.reserve()
+	w.offsets[num-1] = w.buf.Len()
+	fmt.Fprintf(&w.buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", num, dict, len(data))
+	w.buf.Write(data)
+	w.buf.WriteString("\nendstream\nendobj\n")
+	return num
+}
+
+// Write the xref table and trailer; extra is appended to the trailer dict
+func (w *pdfWriter) finish(root int, extra string) []byte {
+	xrefOffset := w.buf.Len()
+	fmt.Fprintf(&w.buf, "xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)+1)
+	for _, off := range w.offsets {
+		if off == 0 {
+			w.buf.WriteString("0000000000 65535 f \n")
+		} else {
+			fmt.Fprintf(&w.buf, "%010d 00000 n \n", off)
+		}
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d /Root %d 0 R %s>>\nstartxref\n%d\n%%%%EOF\n",
+		len(w.offsets)+1, root, extra, xrefOffset)
+	return w.buf.Bytes()
+}
+
+// An already-encoded raster image to be placed on its own page
+type pdfImagePage struct {
+	Data             []byte  // encoded image stream
+	Filter           string  // e.g. "DCTDecode"; empty for raw samples
+	DecodeParms      string  // optional /DecodeParms dictionary
+	ColorSpace       string  // e.g. "DeviceRGB"
+	BitsPerComponent int     // usually 8, 1 for bilevel scans
+	Width, Height    int     // pixels
+	PageWidth        float64 // points
+	PageHeight       float64 // points
+}
+
+// Build a PDF with one full-bleed image per page
+func imagePagesToPDF(pages []pdfImagePage) []byte {
+	w := newPDFWriter()
+	catalog := w.reserve()
+	pagesObj := w.reserve()
+
+	kids := make([]string, 0, len(pages))
+	for _, p := range pages {
+		dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent %d",
+			p.Width, p.Height, p.ColorSpace, p.BitsPerComponent)
+		if p.Filter != "" {
+			dict += " /Filter /" + p.Filter
+		}
+		if p.DecodeParms != "" {
+			dict += " /DecodeParms " + p.DecodeParms
+		}
+		imageObj := w.addStream(dict, p.Data)
+
+		content := []byte(fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", p.PageWidth, p.PageHeight))
+		contentObj := w.addStream("", content)
+
+		page := w.addObject(fmt.Sprintf(
+			"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+			pagesObj, p.PageWidth, p.PageHeight, imageObj, contentObj))
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+
+	var kidList bytes.Buffer
+	for i, k := range kids {
+		if i > 0 {
+			kidList.WriteByte(' ')
+		}
+		kidList.WriteString(k)
+	}
+	w.setObject(pagesObj, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kidList.String(), len(kids)))
+	w.setObject(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesObj))
+	return w.finish(catalog, "")
+}
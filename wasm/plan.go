@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Size classes used to bucket a batch
+const (
+	planSmall  = "small"  // under 1 MB
+	planMedium = "medium" // under 10 MB
+	planLarge  = "large"
+)
+
+// One input as planBatch sees it
+type plannedFile struct {
+	Name string
+	Type string
+	Size int
+}
+
+// Options for planBatch. Device fields default as in recommendSettings;
+// Concurrency overrides the suggested worker count.
+type planOptions struct {
+	DeviceMemory float64 `json:"deviceMemory"`
+	Cores        int     `json:"cores"`
+	Concurrency  int     `json:"concurrency"`
+}
+
+// Files of one kind and size class
+type planBucket struct {
+	Kind        string `json:"kind"` // pdf, image, text or other
+	SizeClass   string `json:"sizeClass"`
+	Files       []int  `json:"files"` // indices into the input list
+	TotalBytes  int    `json:"totalBytes"`
+	EstimatedMs int64  `json:"estimatedMs"`
+}
+
+// An execution plan. Order runs the longest jobs first, which keeps the
+// workers evenly loaded at the end of the run.
+type batchPlan struct {
+	Order             []int        `json:"order"`
+	Buckets           []planBucket `json:"buckets"`
+	Concurrency       int          `json:"concurrency"`
+	EstimatedMs       int64        `json:"estimatedMs"`
+	PeakMemoryBytes   int64        `json:"peakMemoryBytes"`
+	MemoryBudgetBytes int64        `json:"memoryBudgetBytes"`
+	Warnings          []string     `json:"warnings,omitempty"`
+	Messages          []message    `json:"messages,omitempty"`
+}
+
+func (p *batchPlan) warn(m message) {
+	p.Warnings = append(p.Warnings, m.Text)
+	p.Messages = append(p.Messages, m)
+}
+
+// Kind of pipeline compressBatch picks for a MIME type
+func planKind(mimeType string) string {
+	switch {
+	case strings.Contains(mimeType, "pdf"):
+		return "pdf"
+	case isTextMime(mimeType):
+		return "text"
+	case strings.Contains(mimeType, "image"):
+		return "image"
+	}
+	return "other"
+}
+
+func planSizeClass(size int) string {
+	switch {
+	case size < 1<<20:
+		return planSmall
+	case size < 10<<20:
+		return planMedium
+	}
+	return planLarge
+}
+
+// Bucket files and estimate time and memory for running them on
+// concurrency workers (0 picks a value from the device)
+func planBatchFiles(files []plannedFile, device deviceProfile, concurrency int, speed float64) batchPlan {
+	if device.Cores <= 0 {
+		device.Cores = 2
+	}
+	if device.DeviceMemory <= 0 {
+		device.DeviceMemory = 4
+	}
+	budget := tabMemoryBudget(device.DeviceMemory)
+	plan := batchPlan{MemoryBudgetBytes: int64(budget)}
+
+	durations := make([]int64, len(files))
+	memory := make([]float64, len(files))
+	largest := 0.0
+	buckets := map[[2]string]*planBucket{}
+	for i, f := range files {
+		kind := planKind(f.Type)
+		if kind != "other" {
+			durations[i] = estimateJobMs(f.Size, f.Type, speed)
+		}
+		memory[i] = jobMemory(f.Size, f.Type)
+		if memory[i] > largest {
+			largest = memory[i]
+		}
+		if memory[i] > budget {
+			plan.warn(newMessage("plan.memoryTight", "name", f.Name))
+		}
+
+		key := [2]string{kind, planSizeClass(f.Size)}
+		b := buckets[key]
+		if b == nil {
+			b = &planBucket{Kind: key[0], SizeClass: key[1]}
+			buckets[key] = b
+		}
+		b.Files = append(b.Files, i)
+		b.TotalBytes += f.Size
+		b.EstimatedMs += durations[i]
+	}
+	for _, kind := range []string{"pdf", "image", "text", "other"} {
+		for _, class := range []string{planLarge, planMedium, planSmall} {
+			if b := buckets[[2]string{kind, class}]; b != nil {
+				plan.Buckets = append(plan.Buckets, *b)
+			}
+		}
+	}
+
+	suggested := device.Cores - 1
+	if largest > 0 {
+		if byMemory := int(budget / largest); byMemory < suggested {
+			suggested = byMemory
+		}
+	}
+	if suggested < 1 {
+		suggested = 1
+	}
+	plan.Concurrency = suggested
+	if concurrency > 0 {
+		plan.Concurrency = concurrency
+	}
+	if plan.Concurrency > len(files) && len(files) > 0 {
+		plan.Concurrency = len(files)
+	}
+
+	plan.Order = make([]int, len(files))
+	for i := range plan.Order {
+		plan.Order[i] = i
+	}
+	sort.SliceStable(plan.Order, func(a, b int) bool {
+		ia, ib := plan.Order[a], plan.Order[b]
+		if durations[ia] != durations[ib] {
+			return durations[ia] > durations[ib]
+		}
+		return files[ia].Size > files[ib].Size
+	})
+
+	// Hand each job to the least loaded worker; the busiest one finishes last
+	loads := make([]int64, plan.Concurrency)
+	for _, i := range plan.Order {
+		least := 0
+		for w := range loads {
+			if loads[w] < loads[least] {
+				least = w
+			}
+		}
+		loads[least] += durations[i]
+	}
+	for _, load := range loads {
+		if load > plan.EstimatedMs {
+			plan.EstimatedMs = load
+		}
+	}
+
+	// Worst case: the largest jobs all run at the same time
+	bySize := append([]float64(nil), memory...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(bySize)))
+	peak := 0.0
+	for i := 0; i < plan.Concurrency && i < len(bySize); i++ {
+		peak += bySize[i]
+	}
+	plan.PeakMemoryBytes = int64(peak)
+	if peak > budget && plan.Concurrency > suggested {
+		plan.warn(newMessage("plan.concurrencyHigh", "concurrency", plan.Concurrency, "suggested", suggested))
+	}
+	return plan
+}
+
+// planBatch(files, options?) resolves with an execution plan for files
+// given as [{name, type, size}] or [{name, type, data}], without
+// compressing anything. compressBatch runs files one after another;
+// concurrency is for hosts that spread a batch over several workers.
+// Options: {deviceMemory, cores, concurrency}; device fields default to
+// navigator's values.
+func planBatch(this js.Value, args []js.Value) interface{} {
+	var files []plannedFile
+	var opts planOptions
+	var optsErr error
+	if len(args) < 1 || args[0].Type() != js.TypeObject {
+		optsErr = errors.New("missing files argument")
+	} else {
+		for i := 0; i < args[0].Length(); i++ {
+			f := args[0].Index(i)
+			file := plannedFile{Name: fmt.Sprintf("file-%d", i+1)}
+			if name := f.Get("name"); isSet(name) {
+				file.Name = name.String()
+			}
+			if t := f.Get("type"); isSet(t) {
+				file.Type = t.String()
+			}
+			if size := f.Get("size"); size.Type() == js.TypeNumber {
+				file.Size = size.Int()
+			} else if data := f.Get("data"); isSet(data) {
+				file.Size = data.Length()
+			}
+			files = append(files, file)
+		}
+	}
+	if len(args) > 1 && optsErr == nil {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+
+	device := deviceProfile{DeviceMemory: opts.DeviceMemory, Cores: opts.Cores}
+	if nav := js.Global().Get("navigator"); isSet(nav) {
+		if v := nav.Get("deviceMemory"); device.DeviceMemory == 0 && v.Type() == js.TypeNumber {
+			device.DeviceMemory = v.Float()
+		}
+		if v := nav.Get("hardwareConcurrency"); device.Cores == 0 && v.Type() == js.TypeNumber {
+			device.Cores = v.Int()
+		}
+	}
+
+	return runAsync("planBatch", func() (interface{}, error) {
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		if opts.Concurrency < 0 {
+			return nil, errors.New("concurrency must not be negative")
+		}
+		plan := planBatchFiles(files, device, opts.Concurrency, deviceSpeedMBps())
+		fmt.Printf("[WASM] Planned %d files in %d buckets, concurrency %d, about %d ms\n",
+			len(files), len(plan.Buckets), plan.Concurrency, plan.EstimatedMs)
+		return jsonToJS(plan)
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	files := []plannedFile{
+		{"a.png", "image/png", 200 << 10},
+		{"b.pdf", "application/pdf", 30 << 20},
+		{"c.txt", "text/plain", 5 << 20},
+		{"d.png", "image/png", 4 << 20},
+	}
+	plan := planBatchFiles(files, deviceProfile{DeviceMemory: 8, Cores: 4}, 0, 50)
+	if len(plan.Buckets) != 4 || plan.Buckets[0].Kind != "pdf" || plan.Buckets[0].SizeClass != planLarge {
+		t.Fatalf("unexpected buckets %+v", plan.Buckets)
+	}
+	if plan.Order[0] != 1 || plan.Order[len(plan.Order)-1] != 0 {
+		t.Fatalf("longest job not first: %v", plan.Order)
+	}
+	if plan.Concurrency != 3 || plan.EstimatedMs != estimateJobMs(30<<20, "application/pdf", 50) {
+		t.Fatalf("concurrency %d, estimate %d ms", plan.Concurrency, plan.EstimatedMs)
+	}
+	if serial := planBatchFiles(files, deviceProfile{DeviceMemory: 8, Cores: 4}, 1, 50); serial.EstimatedMs <= plan.EstimatedMs {
+		t.Fatal("one worker is not slower than three")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image/png"
+)
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+
+// A single PNG chunk; Data aliases the source buffer
+type pngChunk struct {
+	Type string
+	Data []byte
+}
+
+// Split a PNG file into its chunks (signature excluded)
+func readPNGChunks(data []byte) ([]pngChunk, error) {
+	if len(data) < 8 || !bytes.Equal(data[:8], pngSignature) {
+		return nil, errors.New("not a PNG file")
+	}
+
+	var chunks []pngChunk
+	i := 8
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		if length < 0 || i+12+length > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		chunkType := string(data[i+4 : i+8])
+		chunks = append(chunks, pngChunk{Type: chunkType, Data: data[i+8 : i+8+length]})
+		i += 12 + length
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return chunks, nil
+}
+
+// CRC of a chunk's type and data
+func pngChunkCRC(chunkType string, data []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	return crc.Sum32()
+}
+
+// Append one chunk (length, type, data, CRC) to buf
+func writePNGChunk(buf *bytes.Buffer, chunkType string, data []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], chunkType)
+	buf.Write(header[:])
+	buf.Write(data)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], pngChunkCRC(chunkType, data))
+	buf.Write(sum[:])
+}
+
+// Split a PNG file into chunks like readPNGChunks, but reject any chunk
+// whose CRC does not match and any layout checkPNGLayout refuses
+func readValidPNGChunks(data []byte) ([]pngChunk, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	i := 8
+	for _, c := range chunks {
+		stored := binary.BigEndian.Uint32(data[i+8+len(c.Data):])
+		if pngChunkCRC(c.Type, c.Data) != stored {
+			return nil, fmt.Errorf("%s chunk at offset %d has a bad CRC", c.Type, i)
+		}
+		i += 12 + len(c.Data)
+	}
+	return chunks, checkPNGLayout(chunks)
+}
+
+// Assemble a PNG file from chunks, computing every CRC. The layout is
+// checked first, so an edit that broke it fails here instead of producing
+// a file decoders reject.
+func writePNGChunks(chunks []pngChunk) ([]byte, error) {
+	if err := checkPNGLayout(chunks); err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(pngSignature)
+	for _, c := range chunks {
+		writePNGChunk(buf, c.Type, c.Data)
+	}
+	return buf.Bytes(), nil
+}
+
+// Ancillary chunks that must precede PLTE, those that sit between PLTE
+// and the image data, and those that only need to precede the image data
+var (
+	pngBeforePLTE = map[string]bool{"cHRM": true, "gAMA": true, "iCCP": true, "sBIT": true, "sRGB": true}
+	pngAfterPLTE  = map[string]bool{"bKGD": true, "hIST": true, "tRNS": true}
+	pngBeforeIDAT = map[string]bool{"pHYs": true, "sPLT": true, "acTL": true}
+)
+
+// Check the chunk order the PNG specification requires: IHDR first, at
+// most one PLTE before the image data, consecutive IDATs, IEND last, and
+// the ancillary chunks that depend on those in their place
+func checkPNGLayout(chunks []pngChunk) error {
+	if len(chunks) == 0 || chunks[0].Type != "IHDR" || len(chunks[0].Data) != 13 {
+		return errors.New("PNG must start with a 13-byte IHDR chunk")
+	}
+	last := len(chunks) - 1
+	if last == 0 || chunks[last].Type != "IEND" || len(chunks[last].Data) != 0 {
+		return errors.New("PNG must end with an empty IEND chunk")
+	}
+	colorType := chunks[0].Data[9]
+
+	seenPLTE, seenIDAT, idatEnded := false, false, false
+	for _, c := range chunks[1:last] {
+		if c.Type == "IDAT" {
+			if idatEnded {
+				return errors.New("IDAT chunks are not consecutive")
+			}
+			seenIDAT = true
+			continue
+		}
+		if seenIDAT {
+			idatEnded = true
+		}
+		switch {
+		case c.Type == "IHDR" || c.Type == "IEND":
+			return fmt.Errorf("misplaced %s chunk", c.Type)
+		case c.Type == "PLTE":
+			if seenPLTE || seenIDAT {
+				return errors.New("PLTE must appear once, before the image data")
+			}
+			if colorType == 0 || colorType == 4 {
+				return errors.New("grayscale PNG has a PLTE chunk")
+			}
+			seenPLTE = true
+		case pngBeforePLTE[c.Type] && (seenPLTE || seenIDAT):
+			return fmt.Errorf("%s must come before PLTE and the image data", c.Type)
+		case pngAfterPLTE[c.Type] && (seenIDAT || colorType == 3 && !seenPLTE):
+			return fmt.Errorf("%s must come between PLTE and the image data", c.Type)
+		case pngBeforeIDAT[c.Type] && seenIDAT:
+			return fmt.Errorf("%s must come before the image data", c.Type)
+		case len(c.Type) == 4 && c.Type[0] >= 'A' && c.Type[0] <= 'Z':
+			return fmt.Errorf("unknown critical chunk %s", c.Type)
+		}
+	}
+	if !seenIDAT {
+		return errors.New("PNG has no image data")
+	}
+	if colorType == 3 && !seenPLTE {
+		return errors.New("palette PNG has no PLTE chunk")
+	}
+	return nil
+}
+
+// Whether the IHDR chunk selects Adam7 interlacing
+func isInterlacedPNG(chunks []pngChunk) bool {
+	return len(chunks) > 0 && chunks[0].Type == "IHDR" && len(chunks[0].Data) == 13 && chunks[0].Data[12] == 1
+}
+
+// Ancillary chunks whose meaning does not depend on the color type or
+// bit depth, and so survive a re-encode of the pixels
+var pngPortableChunks = map[string]bool{
+	"gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true, "pHYs": true,
+	"tEXt": true, "zTXt": true, "iTXt": true, "tIME": true, "eXIf": true,
+}
+
+// Re-encode an interlaced PNG without Adam7, which only helps progressive
+// display and usually costs bytes. The pixels are stored again by the
+// standard encoder; portable ancillary chunks are carried over, while
+// depth-specific ones (sBIT, bKGD, hIST, sPLT) are dropped. Fails unless
+// the new image data is smaller.
+func deinterlacePNG(data []byte, chunks []pngChunk) ([]pngChunk, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(buf, img); err != nil {
+		return nil, err
+	}
+	flat, err := readPNGChunks(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	idatSize := func(cs []pngChunk) int {
+		n := 0
+		for _, c := range cs {
+			if c.Type == "IDAT" {
+				n += len(c.Data) + 12
+			}
+		}
+		return n
+	}
+	if idatSize(flat) >= idatSize(chunks) {
+		return nil, errors.New("not smaller without interlacing")
+	}
+
+	// The old portable chunks keep their side of the image data; the
+	// color space ones have to precede PLTE
+	var before, after []pngChunk
+	seenIDAT := false
+	for _, c := range chunks {
+		if c.Type == "IDAT" {
+			seenIDAT = true
+		}
+		if !pngPortableChunks[c.Type] {
+			continue
+		}
+		if seenIDAT {
+			after = append(after, c)
+		} else {
+			before = append(before, c)
+		}
+	}
+	out := []pngChunk{flat[0]}
+	out = append(out, before...)
+	for _, c := range flat[1:] {
+		if c.Type != "IEND" {
+			out = append(out, c)
+		}
+	}
+	out = append(out, after...)
+	return append(out, pngChunk{Type: "IEND"}), nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// An organization's compression rules, installed once by the host with
+// setCompressionPolicy so every web app embedding the module applies the
+// same limits. The exports listed on setCompressionPolicy enforce it:
+// metadata stripping is applied up front, everything else is checked on
+// the input type and the final output.
+type compressionPolicy struct {
+	Name string `json:"name"`
+
+	// Input types accepted, as MIME types or families ("image/*"); empty
+	// accepts every type
+	AllowedFormats []string `json:"allowedFormats"`
+
+	// Largest acceptable output in bytes, keyed by MIME type, family or
+	// "*"; the most specific key applies
+	MaxOutputBytes map[string]int `json:"maxOutputBytes"`
+
+	// Content outputs must not carry: "javascript", "attachments"
+	Forbid []string `json:"forbid"`
+
+	// Remove document info, XMP, EXIF and text chunks, and verify that
+	// outputs carry none
+	StripMetadata bool `json:"stripMetadata"`
+
+	// "reject" fails the call on any violation; "report" returns the
+	// output and lists violations in result.policyViolations
+	Enforcement string `json:"enforcement"`
+}
+
+// Policy enforcement modes
+const (
+	policyReject = "reject"
+	policyReport = "report"
+)
+
+// Content a policy can forbid
+const (
+	policyJavaScript  = "javascript"
+	policyAttachments = "attachments"
+)
+
+var (
+	policyMu     sync.RWMutex
+	activePolicy *compressionPolicy
+)
+
+// The installed policy, or nil
+func currentPolicy() *compressionPolicy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return activePolicy
+}
+
+func defaultCompressionPolicy() compressionPolicy {
+	return compressionPolicy{Enforcement: policyReject}
+}
+
+func (p compressionPolicy) validate() error {
+	switch p.Enforcement {
+	case policyReject, policyReport:
+	default:
+		return fmt.Errorf("unknown enforcement %q, want reject or report", p.Enforcement)
+	}
+	for _, format := range p.AllowedFormats {
+		if !strings.Contains(format, "/") {
+			return fmt.Errorf("invalid format %q, want a MIME type such as image/jpeg or image/*", format)
+		}
+	}
+	for key, limit := range p.MaxOutputBytes {
+		if key != "*" && !strings.Contains(key, "/") {
+			return fmt.Errorf("invalid maxOutputBytes key %q", key)
+		}
+		if limit <= 0 {
+			return fmt.Errorf("maxOutputBytes[%q] must be positive", key)
+		}
+	}
+	for _, content := range p.Forbid {
+		switch content {
+		case policyJavaScript, policyAttachments:
+		default:
+			return fmt.Errorf("unknown forbidden content %q, want javascript or attachments", content)
+		}
+	}
+	return nil
+}
+
+// How specifically pattern matches mimeType: 3 exact, 2 family, 1 "*",
+// 0 not at all
+func mimePatternScore(pattern, mimeType string) int {
+	switch {
+	case pattern == mimeType:
+		return 3
+	case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")):
+		return 2
+	case pattern == "*" || pattern == "*/*":
+		return 1
+	}
+	return 0
+}
+
+// Type checked against allowedFormats: sniffed from the bytes, or as
+// declared by the caller when the bytes are not recognized
+func policyInputType(data []byte, declared string) string {
+	if sniffed := sniffMimeType(data); sniffed != "application/octet-stream" {
+		return sniffed
+	}
+	return declared
+}
+
+// Violations for an input type the policy does not accept
+func (p *compressionPolicy) checkInput(mimeType string) []message {
+	if p == nil || len(p.AllowedFormats) == 0 {
+		return nil
+	}
+	for _, format := range p.AllowedFormats {
+		if mimePatternScore(format, mimeType) > 0 {
+			return nil
+		}
+	}
+	return []message{newMessage("policy.formatNotAllowed", "type", mimeType)}
+}
+
+// Force the metadata passes the policy requires
+func (p *compressionPolicy) applyPDF(opts pdfOptions) pdfOptions {
+	if p != nil && p.StripMetadata {
+		opts.StripMetadata = []string{"*"}
+		opts.KeepMetadata = nil
+		opts.XMP = xmpStrip
+		opts.keepStripped = true
+	}
+	return opts
+}
+
+func (p *compressionPolicy) applyImage(opts imageOptions) imageOptions {
+	if p != nil && p.StripMetadata {
+		opts.XMP = xmpStrip
+	}
+	return opts
+}
+
+// Remove what the image pipeline leaves in outputs it returns unchanged:
+// EXIF, XMP, IPTC and comments from JPEG, text, time and EXIF chunks from
+// PNG. ICC profiles stay, they affect rendering.
+func (p *compressionPolicy) finishImage(data []byte) []byte {
+	if p == nil || !p.StripMetadata {
+		return data
+	}
+	switch sniffMimeType(data) {
+	case "image/jpeg":
+		segments, _, err := ParseJPEGSegments(data)
+		if err != nil {
+			return data
+		}
+		kept := segments[:0:0]
+		for _, seg := range segments {
+			if seg.Marker == 0xE1 || seg.Marker == 0xED || seg.Marker == 0xFE {
+				continue
+			}
+			kept = append(kept, seg)
+		}
+		if out := writeJPEGSegments(kept); len(kept) < len(segments) && jpegDecodes(out) {
+			return out
+		}
+	case "image/png":
+		chunks, err := ParsePNGChunks(data)
+		if err != nil {
+			return data
+		}
+		var kept []pngChunk
+		for _, c := range chunks {
+			if !pngMetadataChunks[c.Type] && c.Type != "eXIf" {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) < len(chunks) {
+			if out, err := writePNGChunks(kept); err == nil {
+				return out
+			}
+		}
+	}
+	return data
+}
+
+// Violations in a final output. doc is the parsed output when the caller
+// already has it, as compressPDF does; other PDFs are parsed here.
+func (p *compressionPolicy) checkOutput(mimeType string, data []byte, doc *pdfDocument) []message {
+	if p == nil {
+		return nil
+	}
+	var violations []message
+	limit, best := 0, 0
+	for key, n := range p.MaxOutputBytes {
+		if score := mimePatternScore(key, mimeType); score > best {
+			limit, best = n, score
+		}
+	}
+	if best > 0 && len(data) > limit {
+		violations = append(violations, newMessage("policy.outputTooLarge", "type", mimeType, "size", len(data), "limit", limit))
+	}
+
+	var found []string
+	switch sniffMimeType(data) {
+	case "application/pdf":
+		if doc == nil {
+			if parsed, err := ParsePDF(data); err == nil {
+				doc = parsed
+			}
+		}
+		if doc == nil || doc.Encrypted {
+			break
+		}
+		a := collectPDFActions(data, pdfResult{Data: data, Level: pdfLevelPassthrough, Original: doc, Output: doc})
+		for _, content := range p.Forbid {
+			if content == policyJavaScript && a.JavaScript > 0 || content == policyAttachments && a.Attachments > 0 {
+				violations = append(violations, newMessage("policy.forbiddenContent", "content", content))
+			}
+		}
+		if p.StripMetadata {
+			found = pdfMetadataLeft(doc)
+		}
+	case "image/jpeg":
+		if p.StripMetadata {
+			jpegSegments(data, func(marker byte, payload []byte) {
+				switch {
+				case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00")):
+					found = append(found, "EXIF")
+				case marker == 0xE1:
+					found = append(found, "XMP")
+				case marker == 0xED:
+					found = append(found, "IPTC")
+				case marker == 0xFE:
+					found = append(found, "comment")
+				}
+			})
+		}
+	case "image/png":
+		if chunks, err := readPNGChunks(data); err == nil && p.StripMetadata {
+			for _, c := range chunks {
+				if pngMetadataChunks[c.Type] || c.Type == "eXIf" {
+					found = append(found, c.Type)
+				}
+			}
+		}
+	}
+	if len(found) > 0 {
+		violations = append(violations, newMessage("policy.metadataPresent", "metadata", strings.Join(dedupeStrings(found), ", ")))
+	}
+	return violations
+}
+
+// Document info keys and XMP packets left in a PDF. The catalog packet of
+// a PDF/A file is exempt: the XMP pass only minimizes it, as the
+// conformance claim lives there.
+func pdfMetadataLeft(doc *pdfDocument) []string {
+	var found []string
+	for _, key := range pdfInfo(doc).Keys {
+		found = append(found, "/"+key)
+	}
+	for _, num := range doc.objectNumbers() {
+		obj := doc.Objects[num]
+		if !obj.HasStream || obj.Dict().Name("Type") != "Metadata" {
+			continue
+		}
+		if packet, err := decodeStream(doc, obj); err == nil && !bytes.Contains(packet, []byte("pdfaid:part")) {
+			found = append(found, "XMP")
+		}
+	}
+	return found
+}
+
+func dedupeStrings(list []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// The error a rejecting policy fails the call with, or nil
+func (p *compressionPolicy) enforce(violations []message) error {
+	if p == nil || len(violations) == 0 || p.Enforcement == policyReport {
+		return nil
+	}
+	name := p.Name
+	if name == "" {
+		name = "compression policy"
+	}
+	return fmt.Errorf("%s violated: %s", name, strings.Join(messageTexts(violations), "; "))
+}
+
+// Attach report-mode violations to a result object
+func setPolicyViolations(result js.Value, violations []message) {
+	if len(violations) == 0 {
+		return
+	}
+	if v, err := jsonToJS(violations); err == nil {
+		result.Set("policyViolations", v)
+	}
+}
+
+// setCompressionPolicy(policy) installs organization rules for the
+// exports that re-encode images and PDFs (compressImage, compressPDF,
+// compressBatch, compressPastedImage, convertImage, and the entries of
+// recompressZip and convertToZip): {name, allowedFormats,
+// maxOutputBytes: {"image/*": 500000, "*": 5000000}, forbid:
+// ["javascript", "attachments"], stripMetadata, enforcement: "reject" |
+// "report"}. Pass null to remove it. Resolves with the active policy.
+// The pipeline does not remove JavaScript or attachments from PDFs, so
+// forbidding them rejects (or flags) documents that contain them.
+func setCompressionPolicy(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] setCompressionPolicy called with %d arguments\n", len(args))
+
+	var config js.Value
+	if len(args) > 0 {
+		config = args[0]
+	}
+	policy := defaultCompressionPolicy()
+	err := decodeOptions(config, &policy)
+
+	return runAsync("setCompressionPolicy", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		policyMu.Lock()
+		defer policyMu.Unlock()
+		if !isSet(config) {
+			activePolicy = nil
+			fmt.Printf("[WASM] Compression policy removed\n")
+			return js.Null(), nil
+		}
+		if err := policy.validate(); err != nil {
+			return nil, err
+		}
+		if len(policy.AllowedFormats)+len(policy.MaxOutputBytes)+len(policy.Forbid) == 0 && !policy.StripMetadata {
+			return nil, errors.New("policy sets no rules")
+		}
+		activePolicy = &policy
+		fmt.Printf("[WASM] Compression policy %q installed (%s)\n", policy.Name, policy.Enforcement)
+		return jsonToJS(policy)
+	})
+}
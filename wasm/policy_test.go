@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	p := &compressionPolicy{
+		Name:           "acme",
+		AllowedFormats: []string{"image/*", "application/pdf"},
+		MaxOutputBytes: map[string]int{"image/*": 100, "*": 1 << 20},
+		Forbid:         []string{policyJavaScript},
+		StripMetadata:  true,
+		Enforcement:    policyReject,
+	}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.checkInput("video/mp4")) != 1 || len(p.checkInput("image/png")) != 0 {
+		t.Fatal("allowedFormats not applied")
+	}
+
+	photo := fixtureJPEGWithEXIF(fixtureGradient(32, 32), 100)
+	if v := p.checkOutput("image/jpeg", photo, nil); len(v) != 2 || v[1].Code != "policy.metadataPresent" {
+		t.Fatalf("JPEG with EXIF: %v", messageTexts(v))
+	}
+	stripped := p.finishImage(photo)
+	if v := p.checkOutput("image/jpeg", stripped, nil); len(v) != 1 || v[0].Code != "policy.outputTooLarge" {
+		t.Fatalf("stripped JPEG: %v", messageTexts(v))
+	}
+
+	data := []byte("%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog /OpenAction << /S /JavaScript /JS (app.alert(1)) >> >>\nendobj\n" +
+		"3 0 obj\n<< /Producer (Scanner) /Custom (x) >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R /Info 3 0 R >>\n%%EOF\n")
+	out := applyPDFPass(t, (*pdfDocument).removeMetadata, data, p.applyPDF(defaultPDFOptions()))
+	v := p.checkOutput("application/pdf", out, nil)
+	if len(v) != 1 || v[0].Code != "policy.forbiddenContent" {
+		t.Fatalf("PDF: %v", messageTexts(v))
+	}
+	if err := p.enforce(v); err == nil || !strings.HasPrefix(err.Error(), "acme violated: ") {
+		t.Fatalf("reject mode returned %v", err)
+	}
+	p.Enforcement = policyReport
+	if err := p.enforce(v); err != nil {
+		t.Fatal(err)
+	}
+}
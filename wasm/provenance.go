@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"time"
+)
+
+// Reported in provenance records; kept in step with package.json
+const toolVersion = "1.0.0"
+
+// Options for recording how an output was produced
+type provenanceOptions struct {
+	Provenance bool   `json:"provenance"`
+	Preset     string `json:"preset"` // the host's name for the settings used
+
+	// Leave out the timestamp so identical inputs give identical bytes
+	Deterministic bool `json:"deterministic"`
+}
+
+// What support needs to reproduce an output
+type provenanceRecord struct {
+	Tool    string `json:"tool"`
+	Version string `json:"version"`
+	Preset  string `json:"preset,omitempty"`
+	Method  string `json:"method"` // PDF fallback level or image mode
+	Time    string `json:"time,omitempty"`
+}
+
+func (o provenanceOptions) record(method string) provenanceRecord {
+	rec := provenanceRecord{Tool: outputMarker, Version: toolVersion, Preset: o.Preset, Method: method}
+	if !o.Deterministic {
+		rec.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	return rec
+}
+
+// XMP namespace for the record's properties
+const provenanceNS = "urn:filezap:provenance:1"
+
+// The record as an rdf:Description
+func (r provenanceRecord) xmpDescription() string {
+	var b bytes.Buffer
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:fz="` + provenanceNS + `"`)
+	fmt.Fprintf(&b, ` xmp:CreatorTool="%s %s"`, html.EscapeString(r.Tool), html.EscapeString(r.Version))
+	fmt.Fprintf(&b, ` fz:Method="%s"`, html.EscapeString(r.Method))
+	if r.Preset != "" {
+		fmt.Fprintf(&b, ` fz:Preset="%s"`, html.EscapeString(r.Preset))
+	}
+	if r.Time != "" {
+		fmt.Fprintf(&b, ` fz:ProcessedAt="%s"`, r.Time)
+	}
+	b.WriteString("/>")
+	return b.String()
+}
+
+// A complete XMP packet holding only the record
+func (r provenanceRecord) xmpPacket() []byte {
+	return []byte("<?xpacket begin=\"\xEF\xBB\xBF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` + "\n" +
+		r.xmpDescription() + "\n</rdf:RDF></x:xmpmeta>\n<?xpacket end=\"w\"?>")
+}
+
+// Point the catalog's /Metadata at an XMP packet carrying the record and
+// rewrite doc. Existing XMP is kept and the record added to it when it
+// can be read.
+func embedPDFProvenance(doc *pdfDocument, rec provenanceRecord) ([]byte, error) {
+	if doc.Encrypted {
+		return nil, errors.New("encrypted documents cannot be tagged")
+	}
+	catalog := doc.catalog()
+	if catalog == nil {
+		return nil, errors.New("document has no catalog")
+	}
+
+	dict := newPDFDict()
+	dict.Set("Type", pdfNameValue("Metadata"))
+	dict.Set("Subtype", pdfNameValue("XML"))
+	obj := &pdfObject{Value: pdfDictValue(dict), Stream: rec.xmpPacket(), HasStream: true}
+
+	// Rewrite an existing packet in place, uncompressed so it stays
+	// readable by tools that only scan for XMP
+	if v, ok := catalog.Get("Metadata"); ok && v.Kind == pdfRefKind {
+		if old := doc.Objects[v.Ref.Num]; old != nil && old.HasStream {
+			if existing, err := decodeStream(doc, old); err == nil {
+				if end := bytes.LastIndex(existing, []byte("</rdf:RDF>")); end >= 0 {
+					obj.Stream = append(append(append([]byte{}, existing[:end]...), rec.xmpDescription()+"\n"...), existing[end:]...)
+				}
+			}
+			obj.Num, obj.Gen = old.Num, old.Gen
+		}
+	}
+	if obj.Num == 0 {
+		for n := range doc.Objects {
+			if n >= obj.Num {
+				obj.Num = n + 1
+			}
+		}
+	}
+	doc.Objects[obj.Num] = obj
+	catalog.Set("Metadata", pdfRefValue(pdfRef{Num: obj.Num, Gen: obj.Gen}))
+	return doc.serialize()
+}
+
+// Embed the record: a tEXt chunk for PNG, a comment for JPEG. PDFs go
+// through applyPDF; other formats are returned unchanged.
+func embedProvenance(data []byte, rec provenanceRecord) ([]byte, error) {
+	text, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	switch sniffMimeType(data) {
+	case "image/png":
+		return insertPNGText(data, "Provenance", string(text)), nil
+	case "image/jpeg":
+		return insertJPEGComment(data, outputMarker+" provenance "+string(text)), nil
+	}
+	return data, nil
+}
+
+// Embed a record into output when requested and the output is not simply
+// the input handed back. A failure leaves output untagged with a warning.
+func (o provenanceOptions) apply(input, output []byte, method string) ([]byte, []message) {
+	if !o.Provenance || bytes.Equal(input, output) {
+		return output, nil
+	}
+	tagged, err := embedProvenance(output, o.record(method))
+	if err != nil {
+		return output, []message{newMessage("provenance.notEmbedded", "error", err)}
+	}
+	return tagged, nil
+}
+
+// apply for compressPDFData results: the record goes into res.Output, the
+// document the fallback chain parsed, and res.Data is rewritten from it
+func (o provenanceOptions) applyPDF(input []byte, res *pdfResult) []message {
+	if !o.Provenance || res.Output == nil || bytes.Equal(input, res.Data) {
+		return nil
+	}
+	doc := res.Output.clone()
+	tagged, err := embedPDFProvenance(doc, o.record(res.Level))
+	if err != nil {
+		return []message{newMessage("provenance.notEmbedded", "error", err)}
+	}
+	doc.Data = tagged
+	res.Data, res.Output = tagged, doc
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Photoshop files (PSD, and PSB for large documents) end with a flattened
+// composite of every visible layer, stored for applications that cannot
+// read layers. Decoding that composite gives a preview without rendering
+// layers, effects or adjustment layers.
+
+// PSD color modes
+const (
+	psdGrayscale = 1
+	psdIndexed   = 2
+	psdRGB       = 3
+	psdCMYK      = 4
+)
+
+// Color channels per supported mode; further channels are alpha or spot
+// colors
+var psdModeChannels = map[int]int{psdGrayscale: 1, psdIndexed: 1, psdRGB: 3, psdCMYK: 4}
+
+// Image resource carrying the version info block
+const psdResourceVersionInfo = 0x0421
+
+// Guard against headers claiming absurd sizes
+const psdMaxPixels = 1 << 28
+
+// A bounds-checked reader over the file; the first error sticks
+type psdReader struct {
+	data []byte
+	at   int
+	err  error
+}
+
+func (r *psdReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.at+n > len(r.data) {
+		r.err = errors.New("PSD truncated")
+		return nil
+	}
+	b := r.data[r.at : r.at+n]
+	r.at += n
+	return b
+}
+
+func (r *psdReader) u16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *psdReader) u32() int {
+	if b := r.bytes(4); b != nil {
+		return int(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+// PSB widens some section lengths to 64 bits
+func (r *psdReader) length(psb bool) int {
+	if !psb {
+		return r.u32()
+	}
+	if b := r.bytes(8); b != nil {
+		n := binary.BigEndian.Uint64(b)
+		if n > uint64(len(r.data)) {
+			r.err = errors.New("PSD section length out of range")
+			return 0
+		}
+		return int(n)
+	}
+	return 0
+}
+
+// Decode the flattened composite. The first extra channel of an RGB,
+// grayscale or CMYK file is its transparency when the layer count is
+// negative, as Photoshop writes it; other extra channels are ignored.
+func decodePSDComposite(data []byte) (image.Image, error) {
+	r := &psdReader{data: data}
+	if string(r.bytes(4)) != "8BPS" {
+		return nil, errors.New("not a Photoshop file")
+	}
+	version := r.u16()
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("unsupported PSD version %d", version)
+	}
+	psb := version == 2
+	r.bytes(6)
+	channels, height, width := r.u16(), r.u32(), r.u32()
+	depth, mode := r.u16(), r.u16()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if width <= 0 || height <= 0 || width*height > psdMaxPixels || channels < 1 {
+		return nil, fmt.Errorf("invalid PSD dimensions %dx%d", width, height)
+	}
+	if depth != 8 && depth != 16 {
+		return nil, fmt.Errorf("%d-bit PSD composites are not supported", depth)
+	}
+	colors := psdModeChannels[mode]
+	if colors == 0 {
+		return nil, fmt.Errorf("PSD color mode %d is not supported", mode)
+	}
+	if channels < colors {
+		return nil, fmt.Errorf("PSD has %d channels, color mode needs %d", channels, colors)
+	}
+
+	palette := r.bytes(r.u32())
+	if mode == psdIndexed && len(palette) < 768 {
+		return nil, errors.New("indexed PSD without a color table")
+	}
+
+	resources := r.bytes(r.u32())
+	if !psdHasRealMergedData(resources) {
+		return nil, errors.New("PSD was saved without a composite image (Maximize Compatibility off)")
+	}
+
+	layerInfo := r.bytes(r.length(psb))
+	// Layer info length (4 or 8 bytes), then a signed layer count
+	skip := 4
+	if psb {
+		skip = 8
+	}
+	hasAlpha := false
+	if channels > colors && mode != psdIndexed && len(layerInfo) >= skip+2 {
+		hasAlpha = int16(binary.BigEndian.Uint16(layerInfo[skip:])) < 0
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	planes, err := psdImageData(r, channels, width, height, depth, psb)
+	if err != nil {
+		return nil, err
+	}
+	return psdImage(planes, mode, width, height, palette, hasAlpha), nil
+}
+
+// Whether the version info resource says a real composite was saved;
+// files without the resource predate the flag and always have one
+func psdHasRealMergedData(resources []byte) bool {
+	for at := 0; at+12 <= len(resources); {
+		if string(resources[at:at+4]) != "8BIM" {
+			return true
+		}
+		id := binary.BigEndian.Uint16(resources[at+4:])
+		nameLen := int(resources[at+6])
+		at += 6 + (nameLen+2)&^1 // Pascal name padded to even length
+		if at+4 > len(resources) {
+			return true
+		}
+		size := int(binary.BigEndian.Uint32(resources[at:]))
+		at += 4
+		if size < 0 || at+size > len(resources) {
+			return true
+		}
+		if id == psdResourceVersionInfo && size >= 5 {
+			return resources[at+4] != 0
+		}
+		at += (size + 1) &^ 1
+	}
+	return true
+}
+
+// Read every channel of the image data section as 8-bit planes
+func psdImageData(r *psdReader, channels, width, height, depth int, psb bool) ([][]byte, error) {
+	compression := r.u16()
+	bytesPerSample := depth / 8
+	rowBytes := width * bytesPerSample
+	rows := channels * height
+
+	var raw [][]byte // one row per channel and line
+	switch compression {
+	case 0:
+		for i := 0; i < rows; i++ {
+			raw = append(raw, r.bytes(rowBytes))
+		}
+	case 1:
+		counts := make([]int, rows)
+		for i := range counts {
+			if psb {
+				counts[i] = r.u32()
+			} else {
+				counts[i] = r.u16()
+			}
+		}
+		for i := 0; i < rows; i++ {
+			row, err := unpackBits(r.bytes(counts[i]), rowBytes)
+			if err != nil {
+				return nil, fmt.Errorf("PSD row %d: %v", i, err)
+			}
+			raw = append(raw, row)
+		}
+	default:
+		return nil, fmt.Errorf("PSD compression %d is not supported", compression)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	planes := make([][]byte, channels)
+	for c := range planes {
+		plane := make([]byte, width*height)
+		for y := 0; y < height; y++ {
+			row := raw[c*height+y]
+			for x := 0; x < width; x++ {
+				plane[y*width+x] = row[x*bytesPerSample] // high byte of 16-bit samples
+			}
+		}
+		planes[c] = plane
+	}
+	return planes, nil
+}
+
+func psdUnmatte(v, a uint8) uint8 {
+	if a == 0 || a == 0xFF {
+		return v
+	}
+	u := (int(v) - (255 - int(a))) * 255 / int(a)
+	if u < 0 {
+		return 0
+	}
+	if u > 255 {
+		return 255
+	}
+	return uint8(u)
+}
+
+// PackBits as PSD and TIFF use it; the row must come out exactly n bytes
+func unpackBits(src []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(src) && len(out) < n; {
+		h := int(int8(src[i]))
+		i++
+		switch {
+		case h >= 0:
+			if i+h+1 > len(src) {
+				return nil, errors.New("literal run past end of row")
+			}
+			out = append(out, src[i:i+h+1]...)
+			i += h + 1
+		case h != -128:
+			if i >= len(src) {
+				return nil, errors.New("repeat run past end of row")
+			}
+			for k := 0; k < 1-h; k++ {
+				out = append(out, src[i])
+			}
+			i++
+		}
+	}
+	if len(out) != n {
+		return nil, fmt.Errorf("row decoded to %d bytes, want %d", len(out), n)
+	}
+	return out, nil
+}
+
+// Assemble planes into an image. CMYK is stored inverted (255 = no ink)
+// and converted naively, as there is no profile to honor. Transparent
+// composites are matted against white, which is undone here.
+func psdImage(planes [][]byte, mode, width, height int, palette []byte, hasAlpha bool) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	colors := psdModeChannels[mode]
+	for i := 0; i < width*height; i++ {
+		var c color.NRGBA
+		switch mode {
+		case psdGrayscale:
+			g := planes[0][i]
+			c = color.NRGBA{g, g, g, 0xFF}
+		case psdIndexed:
+			p := int(planes[0][i])
+			c = color.NRGBA{palette[p], palette[256+p], palette[512+p], 0xFF}
+		case psdRGB:
+			c = color.NRGBA{planes[0][i], planes[1][i], planes[2][i], 0xFF}
+		case psdCMYK:
+			k := int(planes[3][i])
+			c = color.NRGBA{
+				uint8(int(planes[0][i]) * k / 255),
+				uint8(int(planes[1][i]) * k / 255),
+				uint8(int(planes[2][i]) * k / 255),
+				0xFF,
+			}
+		}
+		if hasAlpha {
+			c.A = planes[colors][i]
+			c.R, c.G, c.B = psdUnmatte(c.R, c.A), psdUnmatte(c.G, c.A), psdUnmatte(c.B, c.A)
+		}
+		copy(img.Pix[i*4:], []byte{c.R, c.G, c.B, c.A})
+	}
+	return img
+}
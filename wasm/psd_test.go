@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+func TestPSD(t *testing.T) {
+	src := fixtureCutout(48, 40)
+	data := fixturePSD(src)
+	img, err := decodePSDComposite(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unmatting loses a little precision at low alpha
+	for _, pt := range []image.Point{{0, 0}, {24, 20}, {47, 39}} {
+		want, got := src.NRGBAAt(pt.X, pt.Y), img.(*image.NRGBA).NRGBAAt(pt.X, pt.Y)
+		if got.A != want.A || (want.A == 0xFF && got != want) {
+			t.Fatalf("pixel %v is %v, want %v", pt, got, want)
+		}
+	}
+	res, err := compressImageData(context.Background(), data, "image/vnd.adobe.photoshop", defaultImageOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mime := sniffMimeType(res.Data); mime != "image/png" && mime != "image/webp" {
+		t.Fatalf("PSD compressed to %s", mime)
+	}
+}
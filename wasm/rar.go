@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+// RAR signatures: 1.5-4.x and 5.0
+var (
+	rar4Signature = []byte("Rar!\x1A\x07\x00")
+	rar5Signature = []byte("Rar!\x1A\x07\x01\x00")
+)
+
+// RAR 5 dictionaries go up to 4 GB; the browser heap does not
+const rarMaxDictionary = 256 << 20
+
+// Members larger than this are not extracted into memory
+const rarMaxEntry = 1 << 30
+
+func isRar(data []byte) bool {
+	return bytes.HasPrefix(data, rar4Signature) || bytes.HasPrefix(data, rar5Signature)
+}
+
+// "rar4" or "rar5", the format version of the archive
+func rarVersion(data []byte) string {
+	if bytes.HasPrefix(data, rar5Signature) {
+		return "rar5"
+	}
+	return "rar4"
+}
+
+func openRar(data []byte) (*rardecode.Reader, error) {
+	r, err := rardecode.NewReader(bytes.NewReader(data), rardecode.MaxDictionarySize(rarMaxDictionary))
+	if err != nil {
+		return nil, rarError(err)
+	}
+	return r, nil
+}
+
+// Friendlier messages for the errors users actually hit
+func rarError(err error) error {
+	switch err {
+	case rardecode.ErrArchiveEncrypted, rardecode.ErrArchivedFileEncrypted:
+		return errors.New("encrypted RAR archives are not supported")
+	case rardecode.ErrMultiVolume:
+		return errors.New("multi-volume RAR archives are not supported; join the parts first")
+	case rardecode.ErrDictionaryTooLarge:
+		return fmt.Errorf("RAR dictionary exceeds the %d MB browser limit", rarMaxDictionary>>20)
+	}
+	return fmt.Errorf("rar: %v", err)
+}
+
+// Walk RAR headers. Solid archives are decoded on the way, since every
+// member depends on the ones before it.
+func listRar(data []byte) (archiveListing, error) {
+	r, err := openRar(data)
+	if err != nil {
+		return archiveListing{}, err
+	}
+	listing := archiveListing{Format: archiveRar, Entries: []archiveEntry{}}
+	method := rarVersion(data)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(listing.Entries) == 0 {
+				return listing, rarError(err)
+			}
+			listing.warn(newMessage("archive.listingStopped", "error", rarError(err)))
+			break
+		}
+		entry := archiveEntry{
+			Name:           hdr.Name,
+			Size:           hdr.UnPackedSize,
+			CompressedSize: hdr.PackedSize,
+			Method:         method,
+			Modified:       formatModTime(hdr.ModificationTime),
+			IsDir:          hdr.IsDir,
+			Encrypted:      hdr.Encrypted,
+		}
+		if hdr.Solid {
+			entry.Method += "-solid"
+		}
+		listing.Entries = append(listing.Entries, entry)
+		listing.TotalSize += entry.Size
+	}
+	return listing, nil
+}
+
+// Extract every member; encrypted or oversized ones are skipped with a
+// warning, a corrupt stream ends extraction there
+func extractRar(data []byte) ([]extractedEntry, []message, error) {
+	r, err := openRar(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []extractedEntry
+	var warnings []message
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(entries) == 0 {
+				return nil, warnings, rarError(err)
+			}
+			warnings = append(warnings, newMessage("archive.extractionStopped", "error", rarError(err)))
+			break
+		}
+		entry := extractedEntry{Name: hdr.Name, Modified: hdr.ModificationTime, IsDir: hdr.IsDir}
+		switch {
+		case hdr.IsDir:
+		case hdr.Encrypted:
+			warnings = append(warnings, newMessage("archive.encrypted", "name", hdr.Name))
+			continue
+		case hdr.UnPackedSize > rarMaxEntry:
+			warnings = append(warnings, newMessage("archive.tooLarge", "name", hdr.Name))
+			continue
+		default:
+			if entry.Data, err = io.ReadAll(r); err != nil {
+				warnings = append(warnings, newMessage("archive.entryFailed", "name", hdr.Name, "error", rarError(err)))
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, warnings, nil
+}
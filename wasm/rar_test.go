@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// RAR 5 variable-length integer, 7 bits per byte, low bits first
+func rar5Vint(v uint64) []byte {
+	var out []byte
+	for v >= 0x80 {
+		out = append(out, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(out, byte(v))
+}
+
+// RAR 5 header block: CRC32 of the size and body, the size, the body
+func rar5Block(body []byte) []byte {
+	block := append(rar5Vint(uint64(len(body))), body...)
+	return append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(block)), block...)
+}
+
+type rarTestFile struct {
+	name  string
+	data  string
+	isDir bool
+	solid bool
+}
+
+// Stored (uncompressed) RAR 5 archive
+func fixtureRar5(files []rarTestFile) []byte {
+	out := append([]byte{}, rar5Signature...)
+	out = append(out, rar5Block([]byte{1, 0, 0})...) // main header, not a volume
+	for _, f := range files {
+		body := []byte{2} // file header
+		if f.isDir {
+			body = append(body, 0, 1, 0) // no data area; directory flag; unpacked size 0
+		} else {
+			body = append(body, 2)                                // data area follows
+			body = append(body, rar5Vint(uint64(len(f.data)))...) // packed size
+			body = append(body, 4)                                // CRC32 present
+			body = append(body, rar5Vint(uint64(len(f.data)))...) // unpacked size
+		}
+		body = append(body, 0x20) // attributes
+		if !f.isDir {
+			body = binary.LittleEndian.AppendUint32(body, crc32.ChecksumIEEE([]byte(f.data)))
+		}
+		compression := uint64(0) // version 0, method 0 (store)
+		if f.solid {
+			compression |= 0x40
+		}
+		body = append(body, rar5Vint(compression)...)
+		body = append(body, 0) // host OS
+		body = append(body, rar5Vint(uint64(len(f.name)))...)
+		body = append(body, f.name...)
+		out = append(out, rar5Block(body)...)
+		out = append(out, f.data...)
+	}
+	return append(out, rar5Block([]byte{5, 0, 0})...) // end of archive
+}
+
+// RAR 1.5-4 header block, whose CRC is the low 16 bits of the CRC32 of
+// everything after it
+func rar4Block(headType byte, flags uint16, fields []byte) []byte {
+	head := []byte{headType}
+	head = binary.LittleEndian.AppendUint16(head, flags)
+	head = binary.LittleEndian.AppendUint16(head, uint16(2+len(head)+2+len(fields)))
+	head = append(head, fields...)
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(crc32.ChecksumIEEE(head))), head...)
+}
+
+// Stored RAR 4 archive of plain files
+func fixtureRar4(files []rarTestFile) []byte {
+	out := append([]byte{}, rar4Signature...)
+	out = append(out, rar4Block(0x73, 0, make([]byte, 6))...)
+	for _, f := range files {
+		var fields []byte
+		fields = binary.LittleEndian.AppendUint32(fields, uint32(len(f.data))) // packed
+		fields = binary.LittleEndian.AppendUint32(fields, uint32(len(f.data))) // unpacked
+		fields = append(fields, 2)                                             // host OS: Windows
+		fields = binary.LittleEndian.AppendUint32(fields, crc32.ChecksumIEEE([]byte(f.data)))
+		fields = binary.LittleEndian.AppendUint32(fields, 0x58A15000) // 2024-05-01 10:00 as a DOS time
+		fields = append(fields, 20, 0x30)                             // version 2.0, stored
+		fields = binary.LittleEndian.AppendUint16(fields, uint16(len(f.name)))
+		fields = binary.LittleEndian.AppendUint32(fields, 0x20)
+		fields = append(fields, f.name...)
+		out = append(out, rar4Block(0x74, 0x8000, fields)...) // 0x8000: data follows the header
+		out = append(out, f.data...)
+	}
+	return append(out, rar4Block(0x7B, 0x4000, nil)...)
+}
+
+func TestRarListsAndExtracts(t *testing.T) {
+	files := []rarTestFile{{name: "a.txt", data: "hello rar"}, {name: "dir", isDir: true}, {name: "dir/b.txt", data: "second file"}}
+	for _, tc := range []struct {
+		method string
+		data   []byte
+		files  []rarTestFile
+	}{
+		{"rar5", fixtureRar5(files), files},
+		{"rar4", fixtureRar4([]rarTestFile{files[0], files[2]}), []rarTestFile{files[0], files[2]}},
+	} {
+		if format := archiveFormat(tc.data); format != archiveRar {
+			t.Fatalf("%s detected as %q", tc.method, format)
+		}
+		listing, err := listArchiveEntries(tc.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.method, err)
+		}
+		if len(listing.Entries) != len(tc.files) {
+			t.Fatalf("%s: listed %+v", tc.method, listing.Entries)
+		}
+		for i, e := range listing.Entries {
+			f := tc.files[i]
+			if e.Name != f.name || e.IsDir != f.isDir || e.Size != int64(len(f.data)) || e.Method != tc.method {
+				t.Errorf("%s entry %d listed as %+v", tc.method, i, e)
+			}
+		}
+		if listing.TotalSize != int64(len("hello rar")+len("second file")) {
+			t.Errorf("%s total size %d", tc.method, listing.TotalSize)
+		}
+
+		entries, warnings, err := extractRar(tc.data)
+		if err != nil || len(warnings) != 0 || len(entries) != len(tc.files) {
+			t.Fatalf("%s: %d entries, warnings %v: %v", tc.method, len(entries), warnings, err)
+		}
+		for i, e := range entries {
+			if e.Name != tc.files[i].name || string(e.Data) != tc.files[i].data {
+				t.Errorf("%s entry %d extracted as %s %q", tc.method, i, e.Name, e.Data)
+			}
+		}
+	}
+}
+
+func TestRarSolidMethod(t *testing.T) {
+	data := fixtureRar5([]rarTestFile{{name: "a.txt", data: "first"}, {name: "b.txt", data: "second", solid: true}})
+	listing, err := listRar(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := listing.Entries[1].Method; m != "rar5-solid" {
+		t.Errorf("solid member listed with method %q", m)
+	}
+}
+
+func TestRarDamage(t *testing.T) {
+	data := fixtureRar5([]rarTestFile{{name: "a.txt", data: "hello rar"}, {name: "b.txt", data: "second file"}})
+
+	// A flipped byte in the first member's data fails its checksum; the
+	// second is still extracted
+	damaged := append([]byte{}, data...)
+	damaged[bytes.Index(damaged, []byte("hello"))] ^= 0xFF
+	entries, warnings, err := extractRar(damaged)
+	if err != nil || len(entries) != 1 || entries[0].Name != "b.txt" {
+		t.Fatalf("extracted %d entries: %v", len(entries), err)
+	}
+	if len(warnings) != 1 || warnings[0].Code != "archive.entryFailed" {
+		t.Errorf("warnings %v", warnings)
+	}
+
+	if _, err := listRar(data[:20]); err == nil {
+		t.Error("a truncated archive listed")
+	}
+	// Cut in the second member's header: the first is still listed
+	listing, err := listRar(data[:bytes.Index(data, []byte("b.txt"))])
+	if err != nil || len(listing.Entries) != 1 {
+		t.Errorf("truncated after the first member listed %d entries: %v", len(listing.Entries), err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/disintegration/imaging"
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Camera RAW files (DNG, CR2, NEF, ARW, PEF, ORF, RW2) are TIFF containers
+// that carry JPEG previews next to the sensor data. Developing the sensor
+// data is out of scope; the largest preview is usually full size and is
+// what the camera itself shows.
+
+// TIFF tags a preview can hide behind
+const (
+	tiffTagCompression    = 259
+	tiffTagStripOffsets   = 273
+	tiffTagOrientation    = 274
+	tiffTagStripCounts    = 279
+	tiffTagSubIFDs        = 330
+	tiffTagJPEGOffset     = 513 // JPEGInterchangeFormat
+	tiffTagJPEGLength     = 514
+	tiffTagExifIFD        = 34665
+	tiffCompressionOldJPG = 6
+	tiffCompressionNewJPG = 7
+)
+
+// Upper bound on IFDs visited, guarding against loops and nesting bombs
+const maxRawIFDs = 64
+
+// An embedded JPEG preview
+type rawPreview struct {
+	Offset, Length int
+	Width, Height  int
+}
+
+// Byte order of a TIFF-based RAW file. ORF and RW2 use their own magic
+// numbers in an otherwise standard header.
+func rawByteOrder(data []byte) (binary.ByteOrder, error) {
+	if len(data) < 8 {
+		return nil, errors.New("RAW header truncated")
+	}
+	switch string(data[:4]) {
+	case "II*\x00", "IIRO", "IIRS", "IIU\x00":
+		return binary.LittleEndian, nil
+	case "MM\x00*":
+		return binary.BigEndian, nil
+	}
+	return nil, errors.New("not a TIFF-based RAW file")
+}
+
+// Walk IFD0's chain and every SubIFD and EXIF IFD below it, collecting
+// JPEG previews that image/jpeg can decode (lossless-JPEG sensor data is
+// skipped) and IFD0's orientation
+func findRawPreviews(data []byte) ([]rawPreview, int, error) {
+	order, err := rawByteOrder(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Values of a SHORT, LONG or IFD entry, inline or out of line
+	values := func(entry []byte) []int {
+		typ, count := order.Uint16(entry[2:]), int(order.Uint32(entry[4:]))
+		size := map[uint16]int{3: 2, 4: 4, 13: 4}[typ]
+		if size == 0 || count <= 0 || count > 1024 {
+			return nil
+		}
+		raw := entry[8:12]
+		if count*size > 4 {
+			off := int(order.Uint32(entry[8:]))
+			if off < 0 || off+count*size > len(data) {
+				return nil
+			}
+			raw = data[off : off+count*size]
+		}
+		out := make([]int, count)
+		for i := range out {
+			if size == 2 {
+				out[i] = int(order.Uint16(raw[i*2:]))
+			} else {
+				out[i] = int(order.Uint32(raw[i*4:]))
+			}
+		}
+		return out
+	}
+
+	var previews []rawPreview
+	orientation := 1
+	candidate := func(off, length int) {
+		if off <= 0 || length <= 2 || off+length > len(data) || data[off] != 0xFF || data[off+1] != 0xD8 {
+			return
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data[off : off+length]))
+		if err != nil {
+			return
+		}
+		previews = append(previews, rawPreview{Offset: off, Length: length, Width: cfg.Width, Height: cfg.Height})
+	}
+
+	seen := map[int]bool{}
+	queue := []int{int(order.Uint32(data[4:8]))}
+	first := true
+	for len(queue) > 0 && len(seen) < maxRawIFDs {
+		offset := queue[0]
+		queue = queue[1:]
+		for offset != 0 && !seen[offset] && len(seen) < maxRawIFDs {
+			seen[offset] = true
+			if offset+2 > len(data) {
+				break
+			}
+			count := int(order.Uint16(data[offset:]))
+			end := offset + 2 + count*12
+			if end+4 > len(data) {
+				break
+			}
+			tags := map[uint16][]int{}
+			for i := 0; i < count; i++ {
+				entry := data[offset+2+i*12:]
+				tag := order.Uint16(entry)
+				switch tag {
+				case tiffTagSubIFDs, tiffTagExifIFD:
+					queue = append(queue, values(entry)...)
+				default:
+					tags[tag] = values(entry)
+				}
+			}
+			if first {
+				if o := tags[tiffTagOrientation]; len(o) == 1 && o[0] >= 1 && o[0] <= 8 {
+					orientation = o[0]
+				}
+				first = false
+			}
+			if off, n := tags[tiffTagJPEGOffset], tags[tiffTagJPEGLength]; len(off) == 1 && len(n) == 1 {
+				candidate(off[0], n[0])
+			}
+			// A single JPEG strip, as CR2 stores its full-size preview
+			if c := tags[tiffTagCompression]; len(c) == 1 && (c[0] == tiffCompressionOldJPG || c[0] == tiffCompressionNewJPG) {
+				if off, n := tags[tiffTagStripOffsets], tags[tiffTagStripCounts]; len(off) == 1 && len(n) == 1 {
+					candidate(off[0], n[0])
+				}
+			}
+			offset = int(order.Uint32(data[end:]))
+		}
+	}
+	if len(previews) == 0 {
+		return nil, orientation, errors.New("no embedded JPEG preview found")
+	}
+	return previews, orientation, nil
+}
+
+// The preview with the most pixels
+func largestRawPreview(previews []rawPreview) rawPreview {
+	best := previews[0]
+	for _, p := range previews[1:] {
+		if p.Width*p.Height > best.Width*best.Height {
+			best = p
+		}
+	}
+	return best
+}
+
+// Rotate or flip img as EXIF orientation o says it should be displayed
+func orientImage(img image.Image, o int) image.Image {
+	switch o {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// Insert a minimal EXIF segment carrying only the orientation right after
+// SOI, so viewers show the preview upright. JPEGs that already carry EXIF
+// are left alone.
+func withJPEGOrientation(data []byte, o int) []byte {
+	if o <= 1 || o > 8 {
+		return data
+	}
+	hasExif := false
+	jpegSegments(data, func(marker byte, payload []byte) {
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			hasExif = true
+		}
+	})
+	if hasExif {
+		return data
+	}
+	// Big-endian TIFF header, one IFD entry (Orientation, SHORT, 1), no next IFD
+	exif := []byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	exif[25] = byte(o)
+	out := make([]byte, 0, len(data)+4+len(exif))
+	out = append(out, 0xFF, 0xD8, 0xFF, 0xE1, byte((2+len(exif))>>8), byte(2+len(exif)))
+	out = append(out, exif...)
+	return append(out, data[2:]...)
+}
+
+// Options for extractRawPreview; image options come from the same object
+type rawPreviewOptions struct {
+	// Run the preview through the image pipeline; otherwise it is returned
+	// byte for byte, plus an orientation tag
+	Compress bool `json:"compress"`
+}
+
+// extractRawPreview(data, options?, progress?) pulls the largest embedded
+// JPEG preview out of a camera RAW file (DNG, CR2, NEF, ARW, PEF, ORF,
+// RW2). Options: {compress} plus any compressImage options; compress runs
+// the preview through the photo pipeline, upright. Resolves with the
+// standard result object plus type, width, height (of the embedded
+// preview), orientation and previewSize.
+func extractRawPreview(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] extractRawPreview called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("extractRawPreview", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("extractRawPreview", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	var opts rawPreviewOptions
+	imgOpts := currentSettings().Image
+	var optsErr error
+	if len(args) > 1 {
+		if optsErr = decodeOptions(args[1], &opts); optsErr == nil {
+			optsErr = decodeOptions(args[1], &imgOpts)
+		}
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+
+	return runAsync("extractRawPreview", func() (interface{}, error) {
+		j := startJob("extractRawPreview")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		reportProgress := progressReporter(progressCallback, j)
+
+		previews, orientation, err := findRawPreviews(inputBytes)
+		if err != nil {
+			return nil, err
+		}
+		p := largestRawPreview(previews)
+		preview := inputBytes[p.Offset : p.Offset+p.Length]
+		fmt.Printf("[WASM] RAW preview %dx%d (%d bytes) of %d found, orientation %d\n",
+			p.Width, p.Height, p.Length, len(previews), orientation)
+
+		out := withJPEGOrientation(preview, orientation)
+		var warnings []message
+		if opts.Compress {
+			imgOpts.orientation = orientation
+			res, err := compressImageData(j.ctx, out, "image/jpeg", imgOpts, reportProgress)
+			if err != nil {
+				return nil, err
+			}
+			out, warnings = res.Data, res.Warnings
+		}
+		reportProgress(100)
+
+		result := newResultObject(inputBytes, out)
+		result.Set("type", sniffMimeType(out))
+		result.Set("width", p.Width)
+		result.Set("height", p.Height)
+		result.Set("orientation", orientation)
+		result.Set("previewSize", p.Length)
+		setMessages(result, warnings)
+		return result, nil
+	})
+}
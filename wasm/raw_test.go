@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"testing"
+)
+
+func TestRAWPreview(t *testing.T) {
+	full := fixtureJPEG(fixtureGradient(64, 32))
+	data := fixtureRAW(6, fixtureJPEG(fixtureGradient(16, 8)), full)
+	previews, orientation, err := findRawPreviews(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := largestRawPreview(previews)
+	if len(previews) != 2 || p.Width != 64 || orientation != 6 {
+		t.Fatalf("found %d previews, largest %dx%d, orientation %d", len(previews), p.Width, p.Height, orientation)
+	}
+	tagged := withJPEGOrientation(data[p.Offset:p.Offset+p.Length], orientation)
+	if !jpegDecodes(tagged) || len(tagged) != len(full)+4+32 {
+		t.Fatal("orientation segment broke the preview")
+	}
+	// Re-encoded previews are turned upright
+	opts := defaultImageOptions()
+	opts.orientation, opts.MinSavings = orientation, 0
+	res, err := compressImageData(context.Background(), tagged, "image/jpeg", opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(res.Data))
+	if err != nil || cfg.Width != 32 || cfg.Height != 64 {
+		t.Fatalf("compressed preview %dx%d (%v), want 32x64", cfg.Width, cfg.Height, err)
+	}
+}
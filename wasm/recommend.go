@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"strings"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Device description passed to recommendSettings; zero values are filled
+// from navigator and the measured encode speed
+type deviceProfile struct {
+	FileSize     int     `json:"fileSize"`
+	Type         string  `json:"type"`
+	DeviceMemory float64 `json:"deviceMemory"` // GB, as navigator.deviceMemory
+	Cores        int     `json:"cores"`
+}
+
+// Suggested settings for one file on one device
+type settingsRecommendation struct {
+	Preset       string       `json:"preset"`
+	Concurrency  int          `json:"concurrency"`
+	ChunkSize    int          `json:"chunkSize"`
+	EstimatedMs  int64        `json:"estimatedMs"`
+	MeasuredMBps float64      `json:"measuredMBps"`
+	Image        imageOptions `json:"image"`
+}
+
+// Device speed tiers
+const (
+	presetFast     = "fast"     // phones and throttled tabs
+	presetBalanced = "balanced" // typical laptops
+	presetQuality  = "quality"  // fast desktops with memory to spare
+)
+
+var (
+	speedOnce     sync.Once
+	measuredSpeed float64 // MB of raw pixels encoded per second
+)
+
+// Time a short JPEG encode loop once per session to estimate device speed
+func deviceSpeedMBps() float64 {
+	speedOnce.Do(func() {
+		img := fixtureGradient(256, 256)
+		rawBytes := 256 * 256 * 4
+		buf := new(bytes.Buffer)
+
+		start := time.Now()
+		encoded := 0
+		for time.Since(start) < 50*time.Millisecond {
+			buf.Reset()
+			jpeg.Encode(buf, img, &jpeg.Options{Quality: 75})
+			encoded += rawBytes
+		}
+		measuredSpeed = float64(encoded) / time.Since(start).Seconds() / (1 << 20)
+		fmt.Printf("[WASM] Measured encode speed: %.1f MB/s\n", measuredSpeed)
+	})
+	return measuredSpeed
+}
+
+// Derive concurrency, chunk size and preset from the device and input
+func recommend(p deviceProfile) settingsRecommendation {
+	if p.Cores <= 0 {
+		p.Cores = 2
+	}
+	if p.DeviceMemory <= 0 {
+		p.DeviceMemory = 4
+	}
+	speed := deviceSpeedMBps()
+
+	concurrency := p.Cores - 1
+	if byMemory := int(tabMemoryBudget(p.DeviceMemory) / jobMemory(p.FileSize, p.Type)); byMemory < concurrency {
+		concurrency = byMemory
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Start from the saved profile; a preset only changes values the
+	// profile leaves at their defaults
+	rec := settingsRecommendation{
+		Concurrency:  concurrency,
+		MeasuredMBps: speed,
+		Image:        currentSettings().Image,
+	}
+	defaults := defaultImageOptions()
+	maxDimension := func(d int) {
+		if rec.Image.MaxDimension == defaults.MaxDimension {
+			rec.Image.MaxDimension = d
+		}
+	}
+
+	switch {
+	case p.DeviceMemory <= 2 || speed < 8:
+		rec.Preset = presetFast
+		rec.ChunkSize = 1 << 20
+		maxDimension(1600)
+	case p.DeviceMemory >= 8 && speed >= 40 && p.Cores >= 8:
+		rec.Preset = presetQuality
+		rec.ChunkSize = 8 << 20
+		maxDimension(4096)
+		if rec.Image.MinSavings == defaults.MinSavings {
+			rec.Image.MinSavings = 0.02
+		}
+	default:
+		rec.Preset = presetBalanced
+		rec.ChunkSize = 4 << 20
+	}
+
+	rec.EstimatedMs = estimateJobMs(p.FileSize, p.Type, speed)
+	return rec
+}
+
+// A tab can realistically use about an eighth of device memory (GB), and
+// a 32-bit WASM heap never more than 2 GB
+func tabMemoryBudget(deviceMemory float64) float64 {
+	budget := deviceMemory * (1 << 30) / 8
+	if budget > 2<<30 {
+		budget = 2 << 30
+	}
+	return budget
+}
+
+// How much larger than the input a job's working set gets: decoded images
+// expand roughly tenfold, PDFs are held in a few full copies during
+// rewriting
+func jobExpansion(mimeType string) float64 {
+	if strings.Contains(mimeType, "image") {
+		return 10
+	}
+	return 3
+}
+
+// Working memory of one job, with a floor for the runtime's own overhead
+func jobMemory(size int, mimeType string) float64 {
+	perJob := float64(size) * jobExpansion(mimeType)
+	if perJob < 16<<20 {
+		perJob = 16 << 20
+	}
+	return perJob
+}
+
+// Rough duration of one job at the measured speed; 0 when unmeasured
+func estimateJobMs(size int, mimeType string, speed float64) int64 {
+	if speed <= 0 {
+		return 0
+	}
+	return int64(float64(size) * jobExpansion(mimeType) / (speed * (1 << 20)) * 1000)
+}
+
+// recommendSettings({fileSize, type, deviceMemory, cores}) resolves with
+// suggested {preset, concurrency, chunkSize, estimatedMs, measuredMBps,
+// image}; missing device fields are read from navigator. image is the
+// saved profile's, with the preset's limits where the profile has none.
+func recommendSettings(this js.Value, args []js.Value) interface{} {
+	var profile deviceProfile
+	var optsErr error
+	if len(args) > 0 {
+		optsErr = decodeOptions(args[0], &profile)
+	}
+
+	if nav := js.Global().Get("navigator"); isSet(nav) {
+		if v := nav.Get("deviceMemory"); profile.DeviceMemory == 0 && v.Type() == js.TypeNumber {
+			profile.DeviceMemory = v.Float()
+		}
+		if v := nav.Get("hardwareConcurrency"); profile.Cores == 0 && v.Type() == js.TypeNumber {
+			profile.Cores = v.Int()
+		}
+	}
+
+	return runAsync("recommendSettings", func() (interface{}, error) {
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		rec := recommend(profile)
+		fmt.Printf("[WASM] Recommended preset %s, concurrency %d\n", rec.Preset, rec.Concurrency)
+		return jsonToJS(rec)
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRecommendStartsFromSavedSettings(t *testing.T) {
+	settingsMu.Lock()
+	saved := settings
+	settings.Image.Mode = modeScreenshot
+	settings.Image.MaxDimension = 1200
+	settingsMu.Unlock()
+	defer func() {
+		settingsMu.Lock()
+		settings = saved
+		settingsMu.Unlock()
+	}()
+
+	// A low-memory device gets the fast preset
+	rec := recommend(deviceProfile{FileSize: 1 << 20, Type: "image/jpeg", DeviceMemory: 1, Cores: 2})
+	if rec.Preset != presetFast {
+		t.Fatalf("preset %s, want %s", rec.Preset, presetFast)
+	}
+	if rec.Image.Mode != modeScreenshot || rec.Image.MaxDimension != 1200 {
+		t.Errorf("saved profile ignored: mode %s, maxDimension %d", rec.Image.Mode, rec.Image.MaxDimension)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Registration. Every function lives on one namespace object,
+// globalThis.FileZap; the flat globals older hosts call (compressPDF,
+// wasmReady, ...) stay as aliases of the same functions. Loading the
+// module a second time in a page replaces the first instance: the new one
+// asks the old one to shut down (cancel its jobs, drop its globals and let
+// its Go program exit) before registering, so nothing is registered twice
+// and no parked runtime is left behind. Hosts that would rather reuse a
+// running instance check FileZap.isReady() before loading.
+
+const namespaceName = "FileZap"
+
+// How long a shut-down instance waits for its cancelled jobs to settle
+// their promises before its Go program exits
+const shutdownGrace = 2 * time.Second
+
+// A function exported to JS
+type export struct {
+	name string
+	fn   func(js.Value, []js.Value) interface{}
+}
+
+var exports = []export{
+	{"compressPDF", compressPDF},
+	{"compressImage", compressImage},
+	{"compressBatch", compressBatch},
+	{"makeContactSheet", makeContactSheet},
+	{"saveSettings", saveSettings},
+	{"loadSettings", loadSettings},
+	{"runSelfTest", runSelfTest},
+	{"recommendSettings", recommendSettings},
+	{"cancelAll", cancelAll},
+	{"tiffToPDF", tiffToPDF},
+	{"pdfToTIFF", pdfToTIFF},
+	{"compressText", compressText},
+	{"minifyAndCompress", minifyAndCompress},
+	{"compressWebAsset", compressWebAsset},
+	{"analyzeCompressibility", analyzeCompressibility},
+	{"listArchive", listArchive},
+	{"recompressZip", recompressZip},
+	{"convertToZip", convertToZip},
+	{"decompressData", decompressData},
+	{"compressData", compressData},
+	{"seekableIndex", seekableIndex},
+	{"decompressRange", decompressRange},
+	{"diffCompress", diffCompress},
+	{"applyPatch", applyPatch},
+	{"createCompressionStream", createCompressionStream},
+	{"createCompressionTransform", createCompressionTransform},
+	{"compressAndUpload", compressAndUpload},
+	{"compressAndDownload", compressAndDownload},
+	{"configureUploadCompression", configureUploadCompression},
+	{"shouldCompressUpload", shouldCompressUpload},
+	{"compressedFetch", compressedFetch},
+	{"compressPastedImage", compressPastedImage},
+	{"encodeBase64", encodeBase64},
+	{"decodeBase64", decodeBase64},
+	{"estimateJpegQuality", estimateJpegQuality},
+	{"planBatch", planBatch},
+	{"cancelJob", cancelJob},
+	{"convertImage", convertImage},
+	{"extractRawPreview", extractRawPreview},
+	{"listHeifImages", listHeifImages},
+	{"extractHeifImages", extractHeifImages},
+	{"optimizeMP4", optimizeMP4},
+	{"subsetFont", subsetFont},
+	{"setCompressionPolicy", setCompressionPolicy},
+	{"setInputAllowlist", setInputAllowlist},
+	{"setThroughputLimits", setThroughputLimits},
+	{"enableTabCoordination", enableTabCoordination},
+	{"init", initModule},
+	{"isReady", isReady},
+	{"getVersion", getVersion},
+	{"enableTrace", enableTrace},
+	{"exportTrace", exportTrace},
+	{"setMetricsCallback", setMetricsCallback},
+	{"verifyRoundTrip", verifyRoundTrip},
+}
+
+// Flat globals set besides the exports, removed again on shutdown
+var legacyGlobals = []string{"wasmReady", "degradedFeatures"}
+
+var (
+	instanceID   = newTabID() // tells this instance apart from one it replaces
+	exportFuncs  = map[string]js.Func{}
+	shutdownOnce sync.Once
+	shutdownCh   = make(chan struct{})
+)
+
+// Shut down a previous instance, then publish the namespace and the flat
+// aliases. Instances built before the namespace existed cannot be shut
+// down; their globals are simply overwritten.
+func registerExports() {
+	global := js.Global()
+	if prev := global.Get(namespaceName); prev.Type() == js.TypeObject {
+		if shutdown := prev.Get("shutdown"); shutdown.Type() == js.TypeFunction {
+			fmt.Printf("[WASM] Replacing instance %s\n", prev.Get("instance").String())
+			shutdown.Invoke()
+		}
+	}
+
+	ns := global.Get("Object").New()
+	for _, e := range exports {
+		f := js.FuncOf(e.fn)
+		exportFuncs[e.name] = f
+		ns.Set(e.name, f)
+		global.Set(e.name, f)
+	}
+	shutdown := js.FuncOf(shutdownModule)
+	exportFuncs["shutdown"] = shutdown
+	ns.Set("shutdown", shutdown)
+	ns.Set("instance", instanceID)
+	global.Set(namespaceName, ns)
+}
+
+// shutdown() cancels every job, leaves tab coordination and removes this
+// instance's globals; its Go program exits once the cancelled jobs have
+// settled. Returns how many jobs were cancelled. Later calls do nothing.
+func shutdownModule(this js.Value, args []js.Value) interface{} {
+	cancelled := 0
+	shutdownOnce.Do(func() {
+		cancelled = cancelAllJobs()
+		tabs.disable()
+
+		// Only globals still pointing at this instance are ours to remove
+		global := js.Global()
+		if ns := global.Get(namespaceName); ns.Type() == js.TypeObject && ns.Get("instance").Equal(js.ValueOf(instanceID)) {
+			global.Delete(namespaceName)
+			for _, name := range legacyGlobals {
+				global.Delete(name)
+			}
+		}
+		for name, f := range exportFuncs {
+			if global.Get(name).Equal(f.Value) {
+				global.Delete(name)
+			}
+		}
+		fmt.Printf("[WASM] Instance %s shutting down, %d jobs cancelled\n", instanceID, cancelled)
+		close(shutdownCh)
+	})
+	return cancelled
+}
+
+// Block until shutdown, give cancelled jobs a moment to reject their
+// promises, then release the callbacks so main can return
+func awaitShutdown() {
+	<-shutdownCh
+	deadline := time.Now().Add(shutdownGrace)
+	for runningJobs() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, f := range exportFuncs {
+		f.Release()
+	}
+}
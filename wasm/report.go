@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported batch report formats
+const (
+	reportCSV  = "csv"
+	reportJSON = "json"
+)
+
+// One row of a batch report
+type batchReportEntry struct {
+	Name             string    `json:"name"`
+	OutputName       string    `json:"outputName,omitempty"`
+	Type             string    `json:"type"`
+	OriginalSize     int       `json:"originalSize"`
+	CompressedSize   int       `json:"compressedSize"`
+	CompressionRatio float64   `json:"compressionRatio"`
+	Strategy         string    `json:"strategy"`
+	Warnings         []string  `json:"warnings"`
+	Messages         []message `json:"messages,omitempty"`
+	PolicyViolations []message `json:"policyViolations,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	DurationMs       int64     `json:"durationMs"`
+}
+
+// Summary document for a whole compressBatch run
+type batchReport struct {
+	GeneratedAt         string             `json:"generatedAt"`
+	Files               []batchReportEntry `json:"files"`
+	TotalOriginalSize   int                `json:"totalOriginalSize"`
+	TotalCompressedSize int                `json:"totalCompressedSize"`
+	TotalSaved          int                `json:"totalSaved"`
+	TotalDurationMs     int64              `json:"totalDurationMs"`
+}
+
+// Add a file's outcome to the running totals
+func (r *batchReport) add(entry batchReportEntry) {
+	if entry.Warnings == nil {
+		entry.Warnings = []string{}
+	}
+	r.Files = append(r.Files, entry)
+	r.TotalOriginalSize += entry.OriginalSize
+	r.TotalCompressedSize += entry.CompressedSize
+	r.TotalSaved = r.TotalOriginalSize - r.TotalCompressedSize
+}
+
+// Serialize the report; returns the document bytes and its MIME type
+func (r *batchReport) encode(format string, started time.Time) ([]byte, string, error) {
+	r.GeneratedAt = time.Now().UTC().Format(time.RFC3339)
+	r.TotalDurationMs = time.Since(started).Milliseconds()
+
+	switch format {
+	case reportJSON:
+		data, err := json.MarshalIndent(r, "", "  ")
+		return data, "application/json", err
+
+	case reportCSV:
+		buf := new(bytes.Buffer)
+		w := csv.NewWriter(buf)
+		w.Write([]string{"name", "type", "originalSize", "compressedSize", "compressionRatio", "savedBytes", "strategy", "warnings", "error", "durationMs"})
+		for _, f := range r.Files {
+			w.Write([]string{
+				csvText(f.Name), csvText(f.Type),
+				strconv.Itoa(f.OriginalSize), strconv.Itoa(f.CompressedSize),
+				strconv.FormatFloat(f.CompressionRatio, 'f', 4, 64),
+				strconv.Itoa(f.OriginalSize - f.CompressedSize),
+				csvText(f.Strategy), csvText(strings.Join(f.Warnings, "; ")), csvText(f.Error),
+				strconv.FormatInt(f.DurationMs, 10),
+			})
+		}
+		ratio := 1.0
+		if r.TotalOriginalSize > 0 {
+			ratio = float64(r.TotalCompressedSize) / float64(r.TotalOriginalSize)
+		}
+		w.Write([]string{
+			"TOTAL", "",
+			strconv.Itoa(r.TotalOriginalSize), strconv.Itoa(r.TotalCompressedSize),
+			strconv.FormatFloat(ratio, 'f', 4, 64),
+			strconv.Itoa(r.TotalSaved),
+			"", "", "",
+			strconv.FormatInt(r.TotalDurationMs, 10),
+		})
+		w.Flush()
+		return buf.Bytes(), "text/csv", w.Error()
+	}
+
+	return nil, "", fmt.Errorf("unknown report format %q", format)
+}
+
+// A text cell spreadsheets will not run as a formula: file names and
+// messages come from users, and one starting with = + - @ (or a tab or
+// carriage return, which some apps skip first) gets a leading quote
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestBatchReportCSVEscapesFormulas(t *testing.T) {
+	r := &batchReport{}
+	for _, name := range []string{"=HYPERLINK(\"http://x\")", "+1.jpg", "-2.jpg", "@sum.png", "\tx.png", "plain.png"} {
+		r.add(batchReportEntry{Name: name, Type: "image/png", Strategy: "passthrough"})
+	}
+	data, mimeType, err := r.encode(reportCSV, time.Now())
+	if err != nil || mimeType != "text/csv" {
+		t.Fatal(mimeType, err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"'=HYPERLINK(\"http://x\")", "'+1.jpg", "'-2.jpg", "'@sum.png", "'\tx.png", "plain.png"}
+	for i, name := range want {
+		if got := rows[i+1][0]; got != name {
+			t.Errorf("row %d name %q, want %q", i+1, got, name)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Machine checks for the module's lossless claims: a rewritten PDF still
+// parses with every page, stream and its text, a lossless image re-encode
+// decodes to the same pixels, a compressed stream decompresses to its
+// input.
+// runSelfTest runs them over fixtures; verifyRoundTrip lets hosts run
+// them over their own files.
+
+// Claims verifyRoundTrip can check
+const (
+	roundTripPDF    = "pdf"    // output reparses with the input's pages, text and intact streams
+	roundTripPixels = "pixels" // output decodes to the input's pixels
+	roundTripBytes  = "bytes"  // output decompresses to the input
+)
+
+// The claim an input/output pair makes when the caller names none
+func detectRoundTripClaim(input, output []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(input, []byte("%PDF")):
+		return roundTripPDF, nil
+	case sniffCompression(output) != "":
+		return roundTripBytes, nil
+	case isLosslessImage(output):
+		return roundTripPixels, nil
+	case sniffMimeType(output) == "image/jpeg" || sniffMimeType(output) == "image/webp":
+		return "", errors.New("output is a lossy image; there is no lossless claim to check")
+	}
+	return "", errors.New("cannot tell which claim to check; pass claim")
+}
+
+// PNG, GIF and VP8L (lossless WebP) outputs
+func isLosslessImage(data []byte) bool {
+	switch sniffMimeType(data) {
+	case "image/png", "image/gif":
+		return true
+	case "image/webp":
+		return len(data) >= 16 && string(data[12:16]) == "VP8L"
+	}
+	return false
+}
+
+// Check output against input for claim (detected when empty). format names
+// the compression of a bytes claim when it has no magic bytes (brotli,
+// raw deflate). Returns the claim checked.
+func checkRoundTrip(input, output []byte, claim, format string) (string, error) {
+	if claim == "" {
+		var err error
+		if claim, err = detectRoundTripClaim(input, output); err != nil {
+			return "", err
+		}
+	}
+	switch claim {
+	case roundTripPDF:
+		original, err := ParsePDF(input)
+		if err != nil {
+			return claim, fmt.Errorf("input does not parse: %v", err)
+		}
+		return claim, pdfBaselineOf(original, defaultPDFOptions()).checkBytes(output)
+	case roundTripPixels:
+		return claim, samePixels(input, output)
+	case roundTripBytes:
+		opts := defaultDecompressOptions()
+		if format != "" {
+			opts.Format = format
+		}
+		res, err := decompressStream(output, opts)
+		if err != nil {
+			return claim, fmt.Errorf("output does not decompress: %v", err)
+		}
+		if !bytes.Equal(res.Data, input) {
+			return claim, fmt.Errorf("output decompresses to %d bytes that differ from the %d input bytes", len(res.Data), len(input))
+		}
+		return claim, nil
+	}
+	return "", fmt.Errorf("unknown claim %q, want pdf, pixels or bytes", claim)
+}
+
+// Whether two encoded images hold the same pixels. Fully transparent
+// pixels match whatever their color, since encoders may zero it.
+func samePixels(a, b []byte) error {
+	imgA, err := decodeStillImage(a)
+	if err != nil {
+		return fmt.Errorf("input does not decode: %v", err)
+	}
+	imgB, err := decodeStillImage(b)
+	if err != nil {
+		return fmt.Errorf("output does not decode: %v", err)
+	}
+	ba, bb := imgA.Bounds(), imgB.Bounds()
+	if ba.Dx() != bb.Dx() || ba.Dy() != bb.Dy() {
+		return fmt.Errorf("output is %dx%d, input %dx%d", bb.Dx(), bb.Dy(), ba.Dx(), ba.Dy())
+	}
+	differing := 0
+	first := image.Point{}
+	for y := 0; y < ba.Dy(); y++ {
+		for x := 0; x < ba.Dx(); x++ {
+			pa := color.NRGBA64Model.Convert(imgA.At(ba.Min.X+x, ba.Min.Y+y)).(color.NRGBA64)
+			pb := color.NRGBA64Model.Convert(imgB.At(bb.Min.X+x, bb.Min.Y+y)).(color.NRGBA64)
+			if pa == pb || pa.A == 0 && pb.A == 0 {
+				continue
+			}
+			if differing == 0 {
+				first = image.Pt(x, y)
+			}
+			differing++
+		}
+	}
+	if differing > 0 {
+		return fmt.Errorf("%d pixels differ, first at (%d, %d)", differing, first.X, first.Y)
+	}
+	return nil
+}
+
+// verifyRoundTrip(input, output, options?) checks a lossless claim about
+// output: "pdf" (it reparses with the input's pages and no newly broken
+// streams), "pixels" (it decodes to the input's pixels) or "bytes" (it
+// decompresses to the input). Options: claim, detected from the data when
+// absent, and format, the compression of a bytes claim without magic
+// bytes such as "brotli". Resolves with {claim, verified, mismatch?}.
+// Images the pipeline rotated by EXIF orientation do not match pixel for
+// pixel by design.
+func verifyRoundTrip(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] verifyRoundTrip called with %d arguments\n", len(args))
+
+	if len(args) < 2 || !isSet(args[0]) || !isSet(args[1]) {
+		return runAsync("verifyRoundTrip", func() (interface{}, error) {
+			return nil, errors.New("missing input or output data")
+		})
+	}
+	release, err := reserveInput(args[0].Length() + args[1].Length())
+	if err != nil {
+		return runAsync("verifyRoundTrip", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	input, output := bytesFromJS(args[0]), bytesFromJS(args[1])
+	var opts struct {
+		Claim  string `json:"claim"`
+		Format string `json:"format"`
+	}
+	var optsErr error
+	if len(args) > 2 {
+		optsErr = decodeOptions(args[2], &opts)
+	}
+
+	return runAsync("verifyRoundTrip", func() (interface{}, error) {
+		j := startJob("verifyRoundTrip")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		claim, err := checkRoundTrip(input, output, opts.Claim, opts.Format)
+		if claim == "" {
+			return nil, err
+		}
+		result := js.Global().Get("Object").New()
+		result.Set("claim", claim)
+		result.Set("verified", err == nil)
+		if err != nil {
+			result.Set("mismatch", err.Error())
+		}
+		fmt.Printf("[WASM] Round trip %s: verified=%v\n", claim, err == nil)
+		return result, nil
+	})
+}
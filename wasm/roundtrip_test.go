@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	screenshot := defaultImageOptions()
+	screenshot.Mode = modeScreenshot
+
+	// Every lossless claim, checked on the pipeline's real output
+	stripes := image.NewNRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			stripes.Set(x, y, []color.NRGBA{{255, 255, 255, 255}, {30, 30, 30, 255}, {0, 120, 215, 255}, {0, 0, 0, 0}}[(x/8+y/16)%4])
+		}
+	}
+	text := bytes.Repeat([]byte("round trip fixture line\n"), 200)
+	type golden struct {
+		name, claim, format string
+		input               []byte
+		compress            func([]byte) ([]byte, error)
+	}
+	cases := []golden{
+		{name: "pdf", claim: roundTripPDF, input: fixturePDF(), compress: func(in []byte) ([]byte, error) {
+			res, err := compressPDFData(context.Background(), in, defaultPDFOptions(), func(int) {})
+			return res.Data, err
+		}},
+		{name: "screenshot", claim: roundTripPixels, input: fixturePNG(stripes), compress: func(in []byte) ([]byte, error) {
+			res, err := compressImageData(context.Background(), in, "image/png", screenshot, func(int) {})
+			return res.Data, err
+		}},
+	}
+	for _, codec := range []string{codecGzip, codecBrotli, codecZstd, codecLZ4} {
+		codec := codec
+		cases = append(cases, golden{name: codec, claim: roundTripBytes, format: codec, input: text, compress: func(in []byte) ([]byte, error) {
+			return compressPayload(in, compressOptions{Algorithm: codec})
+		}})
+	}
+
+	totalIn, totalOut := 0, 0
+	for _, c := range cases {
+		out, err := c.compress(c.input)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if _, err := checkRoundTrip(c.input, out, c.claim, c.format); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		totalIn += len(c.input)
+		totalOut += len(out)
+	}
+
+	// The checks must catch damage, not just pass
+	shifted := image.NewNRGBA(stripes.Rect)
+	copy(shifted.Pix, stripes.Pix)
+	shifted.Pix[0]--
+	if _, err := checkRoundTrip(fixturePNG(stripes), fixturePNG(shifted), "", ""); err == nil {
+		t.Fatal("changed pixel not detected")
+	}
+	gz, _ := compressPayload(text, compressOptions{Algorithm: codecGzip})
+	if _, err := checkRoundTrip(text[1:], gz, "", ""); err == nil {
+		t.Fatal("changed bytes not detected")
+	}
+	if _, err := checkRoundTrip(fixturePDF(), fixturePDF()[:200], "", ""); err == nil {
+		t.Fatal("truncated PDF not detected")
+	}
+}
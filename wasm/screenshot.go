@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"sort"
+)
+
+// Image compression modes
+const (
+	modePhoto      = "photo"      // default JPEG quality ladder
+	modeScreenshot = "screenshot" // lossless/palette PNG, never JPEG
+)
+
+// Text-edge preservation limits for palette quantization: at most this
+// share of high-contrast pixels may drift by more than edgeMaxError
+const (
+	edgeContrast     = 48   // luma step that marks a pixel as an edge
+	edgeMaxError     = 24   // per-channel drift tolerated on an edge pixel
+	edgeMaxBadShare  = 0.01 // fraction of edge pixels allowed to exceed it
+	maxPaletteColors = 256
+)
+
+// Compress a UI screenshot without chroma subsampling: an exact palette
+// PNG when the image has few colors, otherwise a median-cut palette PNG
+// that must pass the text-edge check, falling back to lossless PNG. Under
+// a time budget the quantize-and-check pass is the first thing dropped;
+// the bool result reports that the budget cut the search short. Every
+// encode is also handed to keep.
+func compressScreenshot(img image.Image, inputBytes []byte, budget timeBudget, reportProgress func(int), keep func(imageCandidate)) ([]byte, []message, bool) {
+	var warnings []message
+	timedOut := false
+	pngEncoder := &png.Encoder{CompressionLevel: png.BestCompression}
+	if budget.limited() {
+		pngEncoder.CompressionLevel = png.DefaultCompression
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	best := inputBytes
+	consider := func(label string, data []byte) {
+		fmt.Printf("[WASM] Screenshot %s: %d bytes\n", label, len(data))
+		keep(imageCandidate{Label: label, MimeType: "image/png", Data: data})
+		if len(data) < len(best) {
+			best = data
+		}
+	}
+
+	if palette, exact := exactPalette(img, maxPaletteColors); exact {
+		buf := new(bytes.Buffer)
+		if err := pngEncoder.Encode(buf, quantizeImage(img, palette)); err == nil {
+			consider(fmt.Sprintf("exact %d-color palette", len(palette)), buf.Bytes())
+		}
+		reportProgress(90)
+		return best, warnings, timedOut
+	}
+
+	reportProgress(60)
+
+	// Quantizing, checking edges and encoding take roughly ten JPEG passes
+	if budget.fitsEncode(w, h, 10) {
+		palette := medianCutPalette(img, maxPaletteColors)
+		quantized := quantizeImage(img, palette)
+		if badShare := edgeDamage(img, quantized); badShare <= edgeMaxBadShare {
+			buf := new(bytes.Buffer)
+			if err := pngEncoder.Encode(buf, quantized); err == nil {
+				consider("quantized palette", buf.Bytes())
+			}
+		} else {
+			warnings = append(warnings, newMessage("image.paletteRejected", "percent", percentParam(badShare)))
+		}
+	} else {
+		timedOut = true
+		warnings = append(warnings, newMessage("budget.paletteSkipped"))
+	}
+
+	reportProgress(80)
+
+	if budget.fitsEncode(w, h, 3) {
+		buf := new(bytes.Buffer)
+		if err := pngEncoder.Encode(buf, img); err == nil {
+			consider("lossless", buf.Bytes())
+		}
+	} else {
+		timedOut = true
+		warnings = append(warnings, newMessage("budget.losslessSkipped"))
+	}
+	reportProgress(90)
+	return best, warnings, timedOut
+}
+
+// Collect the image's colors if there are no more than max of them
+func exactPalette(img image.Image, max int) (color.Palette, bool) {
+	seen := make(map[color.NRGBA]struct{}, max+1)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if _, ok := seen[c]; ok {
+				continue
+			}
+			if len(seen) == max {
+				return nil, false
+			}
+			seen[c] = struct{}{}
+		}
+	}
+
+	palette := make(color.Palette, 0, len(seen))
+	for c := range seen {
+		palette = append(palette, c)
+	}
+	return palette, true
+}
+
+// A box of histogram entries for median-cut splitting
+type colorBox struct {
+	colors []color.NRGBA
+	counts []int
+}
+
+// Build an n-color palette by repeatedly splitting the most populous box
+// along its widest channel
+func medianCutPalette(img image.Image, n int) color.Palette {
+	hist := make(map[color.NRGBA]int)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)]++
+		}
+	}
+
+	root := &colorBox{}
+	for c, count := range hist {
+		root.colors = append(root.colors, c)
+		root.counts = append(root.counts, count)
+	}
+	boxes := []*colorBox{root}
+
+	for len(boxes) < n {
+		// Pick the splittable box holding the most pixels
+		target := -1
+		most := 0
+		for i, box := range boxes {
+			if len(box.colors) < 2 {
+				continue
+			}
+			total := 0
+			for _, count := range box.counts {
+				total += count
+			}
+			if total > most {
+				most, target = total, i
+			}
+		}
+		if target < 0 {
+			break
+		}
+
+		lo, hi := boxes[target].split()
+		boxes[target] = lo
+		boxes = append(boxes, hi)
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		palette = append(palette, box.average())
+	}
+	return palette
+}
+
+// Split a box at the pixel-weighted median of its widest channel
+func (box *colorBox) split() (*colorBox, *colorBox) {
+	channel := func(c color.NRGBA, ch int) uint8 {
+		switch ch {
+		case 0:
+			return c.R
+		case 1:
+			return c.G
+		case 2:
+			return c.B
+		}
+		return c.A
+	}
+
+	widest, widestRange := 0, -1
+	for ch := 0; ch < 4; ch++ {
+		min, max := uint8(255), uint8(0)
+		for _, c := range box.colors {
+			v := channel(c, ch)
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if int(max)-int(min) > widestRange {
+			widest, widestRange = ch, int(max)-int(min)
+		}
+	}
+
+	idx := make([]int, len(box.colors))
+	total := 0
+	for i := range idx {
+		idx[i] = i
+		total += box.counts[i]
+	}
+	sort.Slice(idx, func(a, b int) bool {
+		return channel(box.colors[idx[a]], widest) < channel(box.colors[idx[b]], widest)
+	})
+
+	// Cut where half the pixels fall on each side, keeping both halves non-empty
+	cut, running := 1, 0
+	for i, j := range idx {
+		running += box.counts[j]
+		if running*2 >= total {
+			cut = i + 1
+			break
+		}
+	}
+	if cut >= len(idx) {
+		cut = len(idx) - 1
+	}
+
+	lo, hi := &colorBox{}, &colorBox{}
+	for i, j := range idx {
+		target := lo
+		if i >= cut {
+			target = hi
+		}
+		target.colors = append(target.colors, box.colors[j])
+		target.counts = append(target.counts, box.counts[j])
+	}
+	return lo, hi
+}
+
+// Pixel-weighted mean color of a box
+func (box *colorBox) average() color.NRGBA {
+	var r, g, b, a, total int
+	for i, c := range box.colors {
+		n := box.counts[i]
+		r += int(c.R) * n
+		g += int(c.G) * n
+		b += int(c.B) * n
+		a += int(c.A) * n
+		total += n
+	}
+	if total == 0 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{uint8(r / total), uint8(g / total), uint8(b / total), uint8(a / total)}
+}
+
+// Map every pixel to its nearest palette entry, without dithering (dither
+// noise around glyphs costs more bytes and looks worse on text)
+func quantizeImage(img image.Image, palette color.Palette) *image.Paletted {
+	b := img.Bounds()
+	out := image.NewPaletted(b, palette)
+	cache := make(map[color.NRGBA]uint8)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			index, ok := cache[c]
+			if !ok {
+				index = uint8(palette.Index(c))
+				cache[c] = index
+			}
+			out.SetColorIndex(x, y, index)
+		}
+	}
+	return out
+}
+
+// Fraction of high-contrast (text edge) pixels whose quantized color
+// drifted more than edgeMaxError on any channel
+func edgeDamage(orig, quantized image.Image) float64 {
+	b := orig.Bounds()
+	luma := func(c color.NRGBA) int {
+		return (299*int(c.R) + 587*int(c.G) + 114*int(c.B)) / 1000
+	}
+	at := func(img image.Image, x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	}
+	absDiff := func(a, b uint8) int {
+		if a > b {
+			return int(a - b)
+		}
+		return int(b - a)
+	}
+
+	edges, bad := 0, 0
+	for y := b.Min.Y; y < b.Max.Y-1; y++ {
+		for x := b.Min.X; x < b.Max.X-1; x++ {
+			c := at(orig, x, y)
+			l := luma(c)
+			dx := l - luma(at(orig, x+1, y))
+			dy := l - luma(at(orig, x, y+1))
+			if dx < edgeContrast && dx > -edgeContrast && dy < edgeContrast && dy > -edgeContrast {
+				continue
+			}
+			edges++
+			q := at(quantized, x, y)
+			if absDiff(c.R, q.R) > edgeMaxError || absDiff(c.G, q.G) > edgeMaxError ||
+				absDiff(c.B, q.B) > edgeMaxError || absDiff(c.A, q.A) > edgeMaxError {
+				bad++
+			}
+		}
+	}
+	if edges == 0 {
+		return 0
+	}
+	return float64(bad) / float64(edges)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A mock UI: light background, a toolbar and black text-like strokes,
+// with few enough colors for an exact palette
+func fixtureScreenshot(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{245, 245, 245, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, w, 24), image.NewUniform(color.NRGBA{40, 90, 200, 255}), image.Point{}, draw.Src)
+	for y := 40; y+8 < h; y += 16 {
+		for x := 8; x+2 < w-8; x += 6 {
+			draw.Draw(img, image.Rect(x, y, x+2, y+8), image.Black, image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+func runScreenshot(t *testing.T, img image.Image, budget timeBudget) ([]byte, []message, bool, []imageCandidate) {
+	t.Helper()
+	var kept []imageCandidate
+	out, warnings, timedOut := compressScreenshot(img, fixturePNG(img), budget, func(int) {}, func(c imageCandidate) { kept = append(kept, c) })
+	if !bytes.HasPrefix(out, pngSignature) {
+		t.Fatalf("screenshot output is not a PNG")
+	}
+	return out, warnings, timedOut, kept
+}
+
+func TestScreenshotExactPalette(t *testing.T) {
+	img := fixtureScreenshot(200, 120)
+	out, warnings, timedOut, kept := runScreenshot(t, img, timeBudget{})
+	if len(warnings) != 0 || timedOut {
+		t.Errorf("warnings %+v, timed out %v", warnings, timedOut)
+	}
+	if len(kept) != 1 || !strings.HasPrefix(kept[0].Label, "exact") {
+		t.Fatalf("candidates %+v, want only the exact palette", kept)
+	}
+
+	// An exact palette loses nothing
+	decoded, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.(*image.Paletted); !ok {
+		t.Errorf("decoded as %T, want a palette image", decoded)
+	}
+	for y := 0; y < 120; y++ {
+		for x := 0; x < 200; x++ {
+			if color.NRGBAModel.Convert(decoded.At(x, y)) != img.NRGBAAt(x, y) {
+				t.Fatalf("pixel (%d, %d) changed", x, y)
+			}
+		}
+	}
+}
+
+func TestScreenshotQuantizesSmoothImages(t *testing.T) {
+	// A gradient has far more than 256 colors but no text edges to damage
+	img := fixtureGradient(128, 128)
+	if _, exact := exactPalette(img, maxPaletteColors); exact {
+		t.Fatal("gradient fit an exact palette")
+	}
+	_, warnings, _, kept := runScreenshot(t, img, timeBudget{})
+	labels := make([]string, len(kept))
+	for i, c := range kept {
+		labels[i] = c.Label
+	}
+	if len(warnings) != 0 || strings.Join(labels, ",") != "quantized palette,lossless" {
+		t.Errorf("candidates %v, warnings %+v", labels, warnings)
+	}
+}
+
+func TestScreenshotBudgetSkipsEncodes(t *testing.T) {
+	budget := newTimeBudget(1)
+	time.Sleep(2 * time.Millisecond)
+	img := fixtureGradient(64, 64)
+	input := fixturePNG(img)
+	out, warnings, timedOut := compressScreenshot(img, input, budget, func(int) {}, func(imageCandidate) {})
+	if !timedOut || !bytes.Equal(out, input) {
+		t.Errorf("timed out %v, %d -> %d bytes", timedOut, len(input), len(out))
+	}
+	if len(warnings) != 2 || warnings[0].Code != "budget.paletteSkipped" || warnings[1].Code != "budget.losslessSkipped" {
+		t.Errorf("warnings %+v", warnings)
+	}
+}
+
+func TestEdgeDamage(t *testing.T) {
+	img := fixtureScreenshot(64, 64)
+	if d := edgeDamage(img, img); d != 0 {
+		t.Errorf("identical images: %v", d)
+	}
+
+	// Graying out the strokes damages every edge pixel on them
+	gray := image.NewNRGBA(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, image.Point{}, draw.Src)
+	for i := 0; i < len(gray.Pix); i += 4 {
+		if gray.Pix[i] == 0 {
+			gray.Pix[i], gray.Pix[i+1], gray.Pix[i+2] = 128, 128, 128
+		}
+	}
+	if d := edgeDamage(img, gray); d < 0.3 {
+		t.Errorf("grayed text: %v, want most edges damaged", d)
+	}
+}
+
+func TestMedianCutPalette(t *testing.T) {
+	img := fixtureGradient(64, 64)
+	for _, n := range []int{2, 16, 256} {
+		if palette := medianCutPalette(img, n); len(palette) != n {
+			t.Errorf("%d-color palette has %d entries", n, len(palette))
+		}
+	}
+	// Fewer colors than asked for gives one entry per color
+	if palette := medianCutPalette(fixtureScreenshot(64, 64), 256); len(palette) != 3 {
+		t.Errorf("%d entries for a 3-color image", len(palette))
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"runtime"
+	"sync"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Block container written by compressData when blockSize is set. Every
+// block is compressed on its own, so blocks can be encoded in parallel and
+// decoded individually through the index at the end:
+//
+//	header  "FZSK" version:u8 codec:u8 reserved:u16
+//	blocks  compressed block data, back to back
+//	index   per block: compressedSize:u32 size:u32 crc32:u32
+//	footer  indexOffset:u64 blockCount:u32 blockSize:u32
+//	        version:u8 codec:u8 reserved:u16 "FZSK"
+//
+// All integers are little endian; crc32 is IEEE over the uncompressed block.
+// The footer repeats the header fields so a reader holding only the tail
+// of a partial download can locate and decode any block.
+const codecSeekable = "seekable"
+
+const (
+	seekMagic      = "FZSK"
+	seekVersion    = 1
+	seekHeaderLen  = 8
+	seekEntryLen   = 12
+	seekFooterLen  = 24
+	seekMinBlock   = 64 << 10
+	seekMaxBlock   = 64 << 20
+	seekMaxWorkers = 16
+)
+
+// Codec IDs stored in the header
+var seekCodecs = []string{codecStore, codecGzip, codecBrotli, codecZstd, codecLZ4}
+
+func seekCodecID(codec string) (byte, error) {
+	for i, c := range seekCodecs {
+		if c == codec {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%s cannot be used in a block container", codec)
+}
+
+func isSeekable(data []byte) bool {
+	return len(data) >= seekHeaderLen+seekFooterLen && bytes.HasPrefix(data, []byte(seekMagic)) &&
+		bytes.HasSuffix(data, []byte(seekMagic))
+}
+
+// One block of a container, as listed in its index
+type seekBlock struct {
+	Offset         int64  `json:"offset"` // of the compressed block in the container
+	CompressedSize int64  `json:"compressedSize"`
+	Start          int64  `json:"start"` // of the block in the uncompressed data
+	Size           int64  `json:"size"`
+	CRC            uint32 `json:"crc32"` // of the uncompressed block
+}
+
+type seekIndex struct {
+	Codec     string      `json:"codec"`
+	BlockSize int         `json:"blockSize"`
+	TotalSize int64       `json:"totalSize"`
+	Blocks    []seekBlock `json:"blocks"`
+}
+
+// Compress data in independent blocks on up to workers goroutines. Under
+// js/wasm all goroutines share one thread and NumCPU is 1, so the parallel
+// speedup only shows where the runtime has more than one thread.
+func compressBlocks(ctx context.Context, data []byte, opts compressOptions, blockSize, workers int) ([]byte, error) {
+	if blockSize < seekMinBlock || blockSize > seekMaxBlock {
+		return nil, fmt.Errorf("blockSize must be between %d KB and %d MB", seekMinBlock>>10, seekMaxBlock>>20)
+	}
+	codecID, err := seekCodecID(opts.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	workers = minInt(workers, seekMaxWorkers)
+
+	count := (len(data) + blockSize - 1) / blockSize
+	blocks := make([][]byte, count)
+	errs := make([]error, count)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < minInt(workers, count); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if errs[i] = checkCancelled(ctx); errs[i] != nil {
+					continue
+				}
+				block := data[i*blockSize : minInt((i+1)*blockSize, len(data))]
+				blocks[i], errs[i] = compressPayload(block, opts)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %v", i, err)
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString(seekMagic)
+	out.Write([]byte{seekVersion, codecID, 0, 0})
+	for _, b := range blocks {
+		out.Write(b)
+	}
+	indexOffset := out.Len()
+	for i, b := range blocks {
+		raw := data[i*blockSize : minInt((i+1)*blockSize, len(data))]
+		out.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(b))))
+		out.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(raw))))
+		out.Write(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(raw)))
+	}
+	out.Write(binary.LittleEndian.AppendUint64(nil, uint64(indexOffset)))
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(count)))
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(blockSize)))
+	out.Write([]byte{seekVersion, codecID, 0, 0})
+	out.WriteString(seekMagic)
+	return out.Bytes(), nil
+}
+
+// Read the index from the end of a container. tail is the whole container
+// or its last bytes, size the full container length; a tail too short to
+// hold the index is an error naming the bytes needed.
+func readSeekIndex(tail []byte, size int64) (seekIndex, error) {
+	if len(tail) < seekFooterLen || !bytes.HasSuffix(tail, []byte(seekMagic)) || int64(len(tail)) > size {
+		return seekIndex{}, errors.New("not a block container")
+	}
+	footer := tail[len(tail)-seekFooterLen:]
+	if footer[16] != seekVersion {
+		return seekIndex{}, fmt.Errorf("unsupported block container version %d", footer[16])
+	}
+	if int(footer[17]) >= len(seekCodecs) {
+		return seekIndex{}, fmt.Errorf("unknown block codec %d", footer[17])
+	}
+	idx := seekIndex{Codec: seekCodecs[footer[17]], Blocks: []seekBlock{}}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer))
+	count := int64(binary.LittleEndian.Uint32(footer[8:]))
+	idx.BlockSize = int(binary.LittleEndian.Uint32(footer[12:]))
+	indexEnd := size - seekFooterLen
+	if indexOffset < seekHeaderLen || indexOffset > indexEnd || (indexEnd-indexOffset) != count*seekEntryLen {
+		return seekIndex{}, errors.New("corrupt block container index")
+	}
+	base := size - int64(len(tail)) // container offset of tail[0]
+	if base > indexOffset {
+		return seekIndex{}, fmt.Errorf("index incomplete: need the last %d bytes of the container", size-indexOffset)
+	}
+
+	offset := int64(seekHeaderLen)
+	for i := int64(0); i < count; i++ {
+		e := tail[indexOffset-base+i*seekEntryLen:]
+		b := seekBlock{
+			Offset:         offset,
+			CompressedSize: int64(binary.LittleEndian.Uint32(e)),
+			Start:          idx.TotalSize,
+			Size:           int64(binary.LittleEndian.Uint32(e[4:])),
+			CRC:            binary.LittleEndian.Uint32(e[8:]),
+		}
+		offset += b.CompressedSize
+		if offset > indexOffset {
+			return seekIndex{}, errors.New("corrupt block container index")
+		}
+		idx.TotalSize += b.Size
+		idx.Blocks = append(idx.Blocks, b)
+	}
+	return idx, nil
+}
+
+// Decode one block and check it against the index
+func decodeSeekBlock(data []byte, idx seekIndex, b seekBlock) ([]byte, error) {
+	raw := data[b.Offset : b.Offset+b.CompressedSize]
+	var out []byte
+	if idx.Codec == codecStore {
+		out = raw
+	} else {
+		// A zstd block may be a single segment as large as the block itself
+		opts := decompressOptions{Format: idx.Codec, MaxOutput: b.Size, MaxWindow: max(b.Size, zstdDefaultMaxWindow)}
+		res, err := decompressStream(raw, opts)
+		if err != nil {
+			return nil, err
+		}
+		out = res.Data
+	}
+	if int64(len(out)) != b.Size || crc32.ChecksumIEEE(out) != b.CRC {
+		return nil, errors.New("block checksum mismatch")
+	}
+	return out, nil
+}
+
+// Decode every block of a container in order
+func decompressSeekable(data []byte, limit int64) ([]byte, error) {
+	idx, err := readSeekIndex(data, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	if idx.TotalSize > limit {
+		return nil, fmt.Errorf("decompressed size exceeds the %d byte limit", limit)
+	}
+	out := make([]byte, 0, idx.TotalSize)
+	for i, b := range idx.Blocks {
+		block, err := decodeSeekBlock(data, idx, b)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %v", i, err)
+		}
+		out = append(out, block...)
+	}
+	return out, nil
+}
+
+// Decode bytes [offset, offset+length) of a container's content, touching
+// only the blocks that overlap it; a negative length reads to the end.
+// Also returns the number of blocks decoded.
+func decompressSeekableRange(data []byte, idx seekIndex, offset, length int64) ([]byte, int, error) {
+	if offset < 0 || offset > idx.TotalSize {
+		return nil, 0, fmt.Errorf("offset %d is outside the %d byte content", offset, idx.TotalSize)
+	}
+	end := idx.TotalSize
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+
+	out := make([]byte, 0, end-offset)
+	decoded := 0
+	for i, b := range idx.Blocks {
+		if b.Start+b.Size <= offset || b.Start >= end || offset == end {
+			continue
+		}
+		block, err := decodeSeekBlock(data, idx, b)
+		if err != nil {
+			return nil, decoded, fmt.Errorf("block %d: %v", i, err)
+		}
+		out = append(out, block[max(offset-b.Start, 0):min(end-b.Start, b.Size)]...)
+		decoded++
+	}
+	return out, decoded, nil
+}
+
+// Options for seekableIndex and decompressRange
+type seekableOptions struct {
+	// Full container length, when data is only its tail
+	ContainerSize int64 `json:"containerSize"`
+
+	// Content range for decompressRange; length -1 reads to the end
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// seekableIndex(data, options?) reads the index of a block container
+// written by compressData with blockSize. data may be just the tail of a
+// partial download if options.containerSize gives the full length; when the
+// tail is too short the error says how many bytes are needed. Resolves with
+// {codec, blockSize, totalSize, blocks: [{offset, compressedSize, start,
+// size, crc32}]}; a block's bytes decode with decompressData(block,
+// {format: codec}).
+func seekableIndex(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] seekableIndex called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("seekableIndex", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := reserveInput(args[0].Length())
+	if err != nil {
+		return runAsync("seekableIndex", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	var opts seekableOptions
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+
+	return runAsync("seekableIndex", func() (interface{}, error) {
+		j := startJob("seekableIndex")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+
+		size := opts.ContainerSize
+		if size == 0 {
+			size = int64(len(inputBytes))
+		}
+		idx, err := readSeekIndex(inputBytes, size)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Block container: %d %s blocks, %d bytes\n", len(idx.Blocks), idx.Codec, idx.TotalSize)
+		return jsonToJS(idx)
+	})
+}
+
+// decompressRange(data, options?) decodes part of a block container.
+// Options: {offset, length}; length -1 or unset reads to the end. Only the
+// blocks overlapping the range are decompressed. Resolves with {data,
+// offset, length, totalSize, blocksDecoded}.
+func decompressRange(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] decompressRange called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("decompressRange", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("decompressRange", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := seekableOptions{Length: -1}
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+
+	return runAsync("decompressRange", func() (interface{}, error) {
+		j := startJob("decompressRange")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+
+		idx, err := readSeekIndex(inputBytes, int64(len(inputBytes)))
+		if err != nil {
+			return nil, err
+		}
+		out, decoded, err := decompressSeekableRange(inputBytes, idx, opts.Offset, opts.Length)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Range %d+%d decoded from %d of %d blocks\n", opts.Offset, len(out), decoded, len(idx.Blocks))
+
+		result := js.Global().Get("Object").New()
+		result.Set("data", bytesToJS(out))
+		result.Set("offset", opts.Offset)
+		result.Set("length", len(out))
+		result.Set("totalSize", idx.TotalSize)
+		result.Set("blocksDecoded", decoded)
+		return result, nil
+	})
+}
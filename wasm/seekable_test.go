@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// About 600 KB of varied text, so blocks differ and compress
+func fixtureSeekInput() []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < 600<<10; i++ {
+		fmt.Fprintf(&b, "record %d: value %d, checksum %08x\n", i, i*i%9973, uint32(i)*2654435761)
+	}
+	return b.Bytes()
+}
+
+func TestCompressBlocksRoundTrip(t *testing.T) {
+	data := fixtureSeekInput()
+	want := (len(data) + seekMinBlock - 1) / seekMinBlock
+	for _, codec := range seekCodecs {
+		out, err := compressBlocks(context.Background(), data, compressOptions{Algorithm: codec}, seekMinBlock, 4)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if !isSeekable(out) {
+			t.Fatalf("%s: no container magic", codec)
+		}
+		idx, err := readSeekIndex(out, int64(len(out)))
+		if err != nil || idx.Codec != codec || len(idx.Blocks) != want || idx.TotalSize != int64(len(data)) {
+			t.Fatalf("%s: index %s, %d blocks, %d bytes: %v", codec, idx.Codec, len(idx.Blocks), idx.TotalSize, err)
+		}
+		res, err := decompressStream(out, defaultDecompressOptions())
+		if err != nil || res.Format != codecSeekable || !bytes.Equal(res.Data, data) {
+			t.Errorf("%s: decoded %d bytes as %s: %v", codec, len(res.Data), res.Format, err)
+		}
+	}
+}
+
+func TestCompressBlocksRejectsBadInput(t *testing.T) {
+	data := fixtureSeekInput()
+	ctx := context.Background()
+	for _, c := range []struct {
+		opts      compressOptions
+		blockSize int
+	}{
+		{compressOptions{Algorithm: codecZstd}, seekMinBlock - 1},
+		{compressOptions{Algorithm: codecZstd}, seekMaxBlock + 1},
+		{compressOptions{Algorithm: codecAuto}, seekMinBlock},
+		{compressOptions{Algorithm: codecZstd, Level: 30}, seekMinBlock},
+	} {
+		if _, err := compressBlocks(ctx, data, c.opts, c.blockSize, 2); err == nil {
+			t.Errorf("%+v with %d byte blocks accepted", c.opts, c.blockSize)
+		}
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := compressBlocks(cancelled, data, compressOptions{Algorithm: codecGzip}, seekMinBlock, 2); err == nil {
+		t.Error("a cancelled job finished")
+	}
+
+	out, err := compressBlocks(ctx, data, compressOptions{Algorithm: codecStore}, seekMinBlock, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := append([]byte{}, out...)
+	damaged[seekHeaderLen+100] ^= 1
+	if _, err := decompressStream(damaged, defaultDecompressOptions()); err == nil || !strings.Contains(err.Error(), "block 0") {
+		t.Errorf("a changed byte in block 0: %v", err)
+	}
+	if _, err := decompressStream(out, decompressOptions{MaxOutput: 1000}); err == nil {
+		t.Error("content beyond maxOutput was returned")
+	}
+	if _, err := readSeekIndex(out[:len(out)-1], int64(len(out)-1)); err == nil {
+		t.Error("a container without its footer magic was read")
+	}
+}
+
+func TestDecompressSeekableRange(t *testing.T) {
+	data := fixtureSeekInput()
+	out, err := compressBlocks(context.Background(), data, compressOptions{Algorithm: codecZstd}, seekMinBlock, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := readSeekIndex(out, int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(len(data))
+	for _, c := range []struct {
+		offset, length int64
+		blocks         int
+	}{
+		{0, 10, 1},
+		{seekMinBlock - 6, 20, 2}, // across a block boundary
+		{100000, -1, len(idx.Blocks) - 1},
+		{total - 5, 100, 1}, // clipped at the end
+		{total, 5, 0},
+		{5, 0, 0},
+	} {
+		got, decoded, err := decompressSeekableRange(out, idx, c.offset, c.length)
+		end := total
+		if c.length >= 0 && c.offset+c.length < end {
+			end = c.offset + c.length
+		}
+		if err != nil || !bytes.Equal(got, data[c.offset:end]) || decoded != c.blocks {
+			t.Errorf("range %d+%d: %d bytes from %d blocks, want %d blocks: %v", c.offset, c.length, len(got), decoded, c.blocks, err)
+		}
+	}
+	if _, _, err := decompressSeekableRange(out, idx, total+1, 1); err == nil {
+		t.Error("an offset past the end was accepted")
+	}
+}
+
+func TestReadSeekIndexFromTail(t *testing.T) {
+	data := fixtureSeekInput()
+	out, err := compressBlocks(context.Background(), data, compressOptions{Algorithm: codecGzip}, seekMinBlock, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(out))
+	indexLen := (len(data) + seekMinBlock - 1) / seekMinBlock * seekEntryLen
+
+	// Too short a tail names the bytes the index needs
+	_, err = readSeekIndex(out[len(out)-seekFooterLen-1:], size)
+	if need := fmt.Sprintf("need the last %d bytes", indexLen+seekFooterLen); err == nil || !strings.Contains(err.Error(), need) {
+		t.Errorf("short tail: %v, want %q", err, need)
+	}
+
+	// The index from the tail alone locates a block that decodes on its own
+	idx, err := readSeekIndex(out[len(out)-indexLen-seekFooterLen:], size)
+	if err != nil || idx.TotalSize != int64(len(data)) {
+		t.Fatalf("index from the tail: %d bytes: %v", idx.TotalSize, err)
+	}
+	b := idx.Blocks[3]
+	res, err := decompressStream(out[b.Offset:b.Offset+b.CompressedSize], decompressOptions{Format: idx.Codec})
+	if err != nil || !bytes.Equal(res.Data, data[b.Start:b.Start+b.Size]) {
+		t.Errorf("block 3 decoded as %d bytes: %v", len(res.Data), err)
+	}
+}
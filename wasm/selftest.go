@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"runtime"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Smallest valid lossless WebP (1x1 transparent pixel)
+var fixtureWebP = []byte{
+	0x52, 0x49, 0x46, 0x46, 0x1a, 0x00, 0x00, 0x00, 0x57, 0x45, 0x42, 0x50,
+	0x56, 0x50, 0x38, 0x4c, 0x0d, 0x00, 0x00, 0x00, 0x2f, 0x00, 0x00, 0x00,
+	0x10, 0x07, 0x10, 0x11, 0x11, 0x88, 0x88, 0xfe, 0x07, 0x00,
+}
+
+// Outcome of one self-test case
+type selfTestResult struct {
+	Name        string
+	Passed      bool
+	Error       string
+	InputBytes  int
+	OutputBytes int
+	Duration    time.Duration
+}
+
+// A self-test case returns its input and output sizes
+type selfTestCase struct {
+	name string
+	run  func() (int, int, error)
+}
+
+// Smooth RGB gradient that compresses like a photo
+func fixtureGradient(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8((x + y) * 127 / (w + h)), 255})
+		}
+	}
+	return img
+}
+
+// Gradient cut out to a disc with a soft edge, for alpha handling
+func fixtureCutout(w, h int) *image.NRGBA {
+	img := fixtureGradient(w, h)
+	r := float64(minInt(w, h)) / 2
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			d := math.Hypot(float64(x)-float64(w)/2, float64(y)-float64(h)/2)
+			a := math.Max(0, math.Min(1, r-d))
+			img.Pix[img.PixOffset(x, y)+3] = uint8(a * 255)
+		}
+	}
+	return img
+}
+
+// Uncompressed PNG so every pipeline has something to gain
+func fixturePNG(img image.Image) []byte {
+	buf := new(bytes.Buffer)
+	(&png.Encoder{CompressionLevel: png.NoCompression}).Encode(buf, img)
+	return buf.Bytes()
+}
+
+func fixtureJPEG(img image.Image) []byte {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, img, &jpeg.Options{Quality: 100})
+	return buf.Bytes()
+}
+
+// Two-frame APNG assembled from two still PNG encodes
+func fixtureAPNG() []byte {
+	first, _ := readPNGChunks(fixturePNG(fixtureGradient(64, 64)))
+	second, _ := readPNGChunks(fixturePNG(image.NewNRGBA(image.Rect(0, 0, 64, 64))))
+
+	out := new(bytes.Buffer)
+	out.Write(pngSignature)
+	writePNGChunk(out, "IHDR", first[0].Data)
+
+	animControl := make([]byte, 8)
+	binary.BigEndian.PutUint32(animControl, 2)
+	writePNGChunk(out, "acTL", animControl)
+
+	frameControl := func(sequence uint32) []byte {
+		fc := make([]byte, 26)
+		binary.BigEndian.PutUint32(fc[0:], sequence)
+		binary.BigEndian.PutUint32(fc[4:], 64)
+		binary.BigEndian.PutUint32(fc[8:], 64)
+		return fc
+	}
+
+	writePNGChunk(out, "fcTL", frameControl(0))
+	for _, c := range first {
+		if c.Type == "IDAT" {
+			writePNGChunk(out, "IDAT", c.Data)
+		}
+	}
+	writePNGChunk(out, "fcTL", frameControl(1))
+	for _, c := range second {
+		if c.Type == "IDAT" {
+			payload := make([]byte, 4, 4+len(c.Data))
+			binary.BigEndian.PutUint32(payload, 2)
+			writePNGChunk(out, "fdAT", append(payload, c.Data...))
+		}
+	}
+	writePNGChunk(out, "IEND", nil)
+	return out.Bytes()
+}
+
+// Single-page PDF embedding a JPEG
+func fixturePDF() []byte {
+	img := fixtureGradient(320, 240)
+	return imagePagesToPDF([]pdfImagePage{{
+		Data: fixtureJPEG(img), Filter: "DCTDecode", ColorSpace: "DeviceRGB", BitsPerComponent: 8,
+		Width: 320, Height: 240, PageWidth: 240, PageHeight: 180,
+	}})
+}
+
+// Run an image through the regular pipeline and check the output decodes
+func selfTestImage(data []byte, mimeType string, opts imageOptions) (int, int, error) {
+	res, err := compressImageData(context.Background(), data, mimeType, opts, func(int) {})
+	if err != nil {
+		return len(data), 0, err
+	}
+	if _, _, err := image.Decode(bytes.NewReader(res.Data)); err != nil {
+		return len(data), len(res.Data), fmt.Errorf("output does not decode: %v", err)
+	}
+	return len(data), len(res.Data), nil
+}
+
+// Smoke checks that each pipeline runs in this environment on a tiny
+// generated (or embedded) fixture. Regression cases live in the go tests.
+func selfTestCases() []selfTestCase {
+	photo := fixtureGradient(256, 256)
+	screenshot := defaultImageOptions()
+	screenshot.Mode = modeScreenshot
+
+	return []selfTestCase{
+		{"jpeg", func() (int, int, error) {
+			return selfTestImage(fixtureJPEG(photo), "image/jpeg", defaultImageOptions())
+		}},
+		{"png", func() (int, int, error) {
+			return selfTestImage(fixturePNG(photo), "image/png", defaultImageOptions())
+		}},
+		{"png-screenshot", func() (int, int, error) {
+			return selfTestImage(fixturePNG(photo), "image/png", screenshot)
+		}},
+		{"apng", func() (int, int, error) {
+			data := fixtureAPNG()
+			res, err := compressImageData(context.Background(), data, "image/png", defaultImageOptions(), func(int) {})
+			if err != nil {
+				return len(data), 0, err
+			}
+			if !isAnimatedPNG(res.Data) || apngFrameCount(res.Data) != 2 {
+				return len(data), len(res.Data), errors.New("animation lost")
+			}
+			return len(data), len(res.Data), nil
+		}},
+		{"webp", func() (int, int, error) {
+			return selfTestImage(fixtureWebP, "image/webp", defaultImageOptions())
+		}},
+		{"pdf", func() (int, int, error) {
+			data := fixturePDF()
+			res, err := compressPDFData(context.Background(), data, defaultPDFOptions(), func(int) {})
+			if err != nil {
+				return len(data), 0, err
+			}
+			out := res.Data
+			if !bytes.HasPrefix(out, []byte("%PDF")) || !bytes.HasSuffix(bytes.TrimSpace(out), []byte("%%EOF")) {
+				return len(data), len(out), errors.New("output is not a complete PDF")
+			}
+			return len(data), len(out), nil
+		}},
+		{"contact-sheet", func() (int, int, error) {
+			data := fixturePNG(photo)
+			sheet, err := buildContactSheet(context.Background(), []contactSheetInput{{Data: data}, {Data: data}},
+				defaultContactSheetOptions(), func(int) {})
+			if err != nil {
+				return len(data) * 2, 0, err
+			}
+			return len(data) * 2, len(sheet.JPEG), nil
+		}},
+	}
+}
+
+// Run every case and any extra ones, converting panics into failures
+func runSelfTests(extra ...selfTestCase) []selfTestResult {
+	var results []selfTestResult
+	for _, tc := range append(selfTestCases(), extra...) {
+		result := selfTestResult{Name: tc.name}
+		start := time.Now()
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					result.Error = fmt.Sprintf("panic: %v", r)
+				}
+			}()
+			in, out, err := tc.run()
+			result.InputBytes, result.OutputBytes = in, out
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}()
+		result.Duration = time.Since(start)
+		result.Passed = result.Error == ""
+		fmt.Printf("[WASM] Self-test %s: passed=%v (%v)\n", result.Name, result.Passed, result.Duration)
+		results = append(results, result)
+	}
+	return results
+}
+
+// Browser capabilities relevant to the module
+func environmentReport() js.Value {
+	global := js.Global()
+	env := js.Global().Get("Object").New()
+	env.Set("goVersion", runtime.Version())
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	env.Set("heapBytes", mem.HeapAlloc)
+	env.Set("sysBytes", mem.Sys)
+
+	if nav := global.Get("navigator"); isSet(nav) {
+		if v := nav.Get("deviceMemory"); isSet(v) {
+			env.Set("deviceMemoryGB", v)
+		}
+		if v := nav.Get("hardwareConcurrency"); isSet(v) {
+			env.Set("hardwareConcurrency", v)
+		}
+	}
+
+	features := js.Global().Get("Object").New()
+	for _, name := range []string{"SharedArrayBuffer", "OffscreenCanvas", "CompressionStream", "TransformStream", "BroadcastChannel"} {
+		features.Set(name, isSet(global.Get(name)))
+	}
+	features.Set("crossOriginIsolated", global.Get("crossOriginIsolated").Truthy())
+	env.Set("features", features)
+	if v, err := jsonToJS(degradedFeatures); err == nil {
+		env.Set("degradedFeatures", v)
+	}
+	return env
+}
+
+// runSelfTest(options?) checks the module works in this browser: it
+// compresses built-in fixtures through each pipeline and resolves with
+// {passed, durationMs, tests, environment}. options.stress, {concurrency,
+// rounds} (8 and 3 when left out), adds a "stress" test running that
+// many PDF and image compressions in parallel, rounds times, each
+// checked against a sequential run of the same input.
+func runSelfTest(this js.Value, args []js.Value) interface{} {
+	var opts struct {
+		Stress *stressOptions `json:"stress"`
+	}
+	var err error
+	if len(args) > 0 {
+		err = decodeOptions(args[0], &opts)
+	}
+
+	return runAsync("runSelfTest", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		var extra []selfTestCase
+		if opts.Stress != nil {
+			stress := *opts.Stress
+			if stress.Concurrency == 0 {
+				stress.Concurrency = 8
+			}
+			if stress.Rounds == 0 {
+				stress.Rounds = 3
+			}
+			if err := stress.validate(); err != nil {
+				return nil, err
+			}
+			extra = append(extra, selfTestCase{"stress", func() (int, int, error) {
+				return runStress(stress)
+			}})
+		}
+		start := time.Now()
+		results := runSelfTests(extra...)
+
+		passed := true
+		tests := js.Global().Get("Array").New(len(results))
+		for i, r := range results {
+			passed = passed && r.Passed
+			t := js.Global().Get("Object").New()
+			t.Set("name", r.Name)
+			t.Set("passed", r.Passed)
+			if r.Error != "" {
+				t.Set("error", r.Error)
+			}
+			t.Set("inputBytes", r.InputBytes)
+			t.Set("outputBytes", r.OutputBytes)
+			t.Set("durationMs", float64(r.Duration.Microseconds())/1000)
+			if secs := r.Duration.Seconds(); secs > 0 {
+				t.Set("throughputMBps", float64(r.InputBytes)/secs/(1<<20))
+			}
+			tests.SetIndex(i, t)
+		}
+
+		report := js.Global().Get("Object").New()
+		report.Set("passed", passed)
+		report.Set("durationMs", time.Since(start).Milliseconds())
+		report.Set("tests", tests)
+		report.Set("environment", environmentReport())
+		return report, nil
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Request compression set up by configureUploadCompression
+type uploadCompressionConfig struct {
+	// URL prefixes to compress uploads to: absolute ("https://api.example.com/upload")
+	// or paths on the worker's own origin ("/api/files")
+	Endpoints []string `json:"endpoints"`
+	Methods   []string `json:"methods"`
+	Algorithm string   `json:"algorithm"` // gzip, brotli or zstd
+	Level     int      `json:"level"`
+
+	MinSize    int     `json:"minSize"`    // smaller bodies go out as they are
+	MinSavings float64 `json:"minSavings"` // required size reduction, as a fraction
+}
+
+func defaultUploadCompressionConfig() uploadCompressionConfig {
+	return uploadCompressionConfig{
+		Methods:    []string{"POST", "PUT", "PATCH"},
+		Algorithm:  codecGzip,
+		MinSize:    1024,
+		MinSavings: 0.05,
+	}
+}
+
+// Content-Encoding token for each algorithm a server can be expected to
+// decode
+var contentEncodings = map[string]string{
+	codecGzip:   "gzip",
+	codecBrotli: "br",
+	codecZstd:   "zstd",
+}
+
+func (c uploadCompressionConfig) validate() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("endpoints must list at least one URL prefix")
+	}
+	if _, ok := contentEncodings[c.Algorithm]; !ok {
+		return fmt.Errorf("algorithm must be gzip, brotli or zstd, got %q", c.Algorithm)
+	}
+	if err := (compressOptions{Algorithm: c.Algorithm, Level: c.Level}).validate(); err != nil {
+		return err
+	}
+	if c.MinSize < 0 {
+		return errors.New("minSize must not be negative")
+	}
+	if c.MinSavings < 0 || c.MinSavings >= 1 {
+		return errors.New("minSavings must be in [0, 1)")
+	}
+	return nil
+}
+
+var (
+	uploadCompressionMu sync.RWMutex
+	uploadCompression   *uploadCompressionConfig // nil until configured
+
+	// Origins that answered a compressed upload with 415; later uploads to
+	// them go out uncompressed
+	uploadCompressionRefused = map[string]bool{}
+)
+
+// Origin of the worker, for path-only endpoints
+func workerOrigin() string {
+	location := js.Global().Get("location")
+	if !isSet(location) {
+		return ""
+	}
+	return location.Get("origin").String()
+}
+
+// Whether an upload should be compressed under the active configuration
+func matchUpload(method, rawURL string, encoded bool) (uploadCompressionConfig, bool) {
+	uploadCompressionMu.RLock()
+	defer uploadCompressionMu.RUnlock()
+	if uploadCompression == nil || encoded {
+		return uploadCompressionConfig{}, false
+	}
+	cfg := *uploadCompression
+
+	methodOK := false
+	for _, m := range cfg.Methods {
+		if strings.EqualFold(m, method) {
+			methodOK = true
+		}
+	}
+	u, err := url.Parse(rawURL)
+	if !methodOK || err != nil {
+		return cfg, false
+	}
+	origin := u.Scheme + "://" + u.Host
+	if uploadCompressionRefused[origin] {
+		return cfg, false
+	}
+	for _, endpoint := range cfg.Endpoints {
+		if strings.HasPrefix(endpoint, "/") {
+			if origin == workerOrigin() && strings.HasPrefix(u.Path, endpoint) {
+				return cfg, true
+			}
+		} else if strings.HasPrefix(rawURL, endpoint) {
+			return cfg, true
+		}
+	}
+	return cfg, false
+}
+
+func matchRequest(request js.Value) (uploadCompressionConfig, bool) {
+	encoded := request.Get("headers").Call("has", "Content-Encoding").Bool()
+	return matchUpload(request.Get("method").String(), request.Get("url").String(), encoded)
+}
+
+// Copy of request with a new body and Content-Encoding header
+func encodedRequest(request js.Value, body []byte, encoding string) js.Value {
+	headers := js.Global().Get("Headers").New(request.Get("headers"))
+	headers.Call("set", "Content-Encoding", encoding)
+	headers.Call("delete", "Content-Length")
+
+	init := js.Global().Get("Object").New()
+	init.Set("method", request.Get("method"))
+	init.Set("headers", headers)
+	init.Set("body", bytesToJS(body))
+	mode := request.Get("mode").String()
+	if mode == "navigate" { // form posts; a constructed request cannot navigate
+		mode = "same-origin"
+	}
+	init.Set("mode", mode)
+	for _, key := range []string{"credentials", "cache", "redirect", "referrer", "referrerPolicy", "signal"} {
+		if v := request.Get(key); isSet(v) {
+			init.Set(key, v)
+		}
+	}
+	return js.Global().Get("Request").New(request.Get("url"), init)
+}
+
+// configureUploadCompression(config) sets which uploads compressedFetch
+// compresses: {endpoints, methods, algorithm, level, minSize, minSavings}.
+// Pass null to turn compression off. Resolves with the active config.
+//
+// Meant for a Service Worker, so existing upload code gains compression
+// without changes. Browsers only honour fetch listeners added while the
+// worker script first runs, so register the listener there and let it
+// consult the WASM functions once they are loaded:
+//
+//	self.addEventListener("fetch", (e) => {
+//	  if (self.shouldCompressUpload?.(e.request)) e.respondWith(compressedFetch(e.request));
+//	});
+//
+// The server must accept the chosen Content-Encoding on requests. An
+// origin that answers 415 is sent the original body and is not compressed
+// for again.
+func configureUploadCompression(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] configureUploadCompression called with %d arguments\n", len(args))
+
+	var config js.Value
+	if len(args) > 0 {
+		config = args[0]
+	}
+	cfg := defaultUploadCompressionConfig()
+	err := decodeOptions(config, &cfg)
+
+	return runAsync("configureUploadCompression", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		uploadCompressionMu.Lock()
+		defer uploadCompressionMu.Unlock()
+		uploadCompressionRefused = map[string]bool{}
+		if !isSet(config) {
+			uploadCompression = nil
+			fmt.Printf("[WASM] Upload compression off\n")
+			return js.Null(), nil
+		}
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		uploadCompression = &cfg
+		fmt.Printf("[WASM] Upload compression on for %d endpoints (%s)\n", len(cfg.Endpoints), cfg.Algorithm)
+		return jsonToJS(cfg)
+	})
+}
+
+// shouldCompressUpload(request) reports synchronously whether
+// compressedFetch would compress request, so a fetch listener can decide
+// before calling respondWith.
+func shouldCompressUpload(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 || !isSet(args[0]) {
+		return false
+	}
+	_, ok := matchRequest(args[0])
+	return ok
+}
+
+// compressedFetch(request) fetches request with its body compressed when
+// it matches the configuration and resolves with the Response. Bodies
+// below minSize, already compressed formats (JPEG, ZIP, ...) and bodies
+// that shrink by less than minSavings go out unchanged.
+func compressedFetch(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("compressedFetch", func() (interface{}, error) {
+			return nil, errors.New("missing request")
+		})
+	}
+	request := args[0]
+	cfg, ok := matchRequest(request)
+	fetch := js.Global().Get("fetch")
+	if !ok {
+		return fetch.Invoke(request)
+	}
+	// Read a clone so the original can still be sent as is
+	body := request.Call("clone").Call("arrayBuffer")
+
+	return runAsync("compressedFetch", func() (interface{}, error) {
+		j := startJob("compressedFetch")
+		defer j.finish()
+
+		buf, err := awaitJS(body)
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %v", err)
+		}
+		data := bytesFromJS(js.Global().Get("Uint8Array").New(buf))
+		if len(data) < cfg.MinSize || compressedFormat(data) != "" {
+			return awaitJS(fetch.Invoke(request))
+		}
+		out, err := compressPayload(data, compressOptions{Algorithm: cfg.Algorithm, Level: cfg.Level})
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCancelled(j.ctx); err != nil {
+			return nil, err
+		}
+		if float64(len(out)) > float64(len(data))*(1-cfg.MinSavings) {
+			return awaitJS(fetch.Invoke(request))
+		}
+
+		encoding := contentEncodings[cfg.Algorithm]
+		fmt.Printf("[WASM] Upload to %s: %d -> %d bytes (%s)\n", request.Get("url").String(), len(data), len(out), encoding)
+		resp, err := awaitJS(fetch.Invoke(encodedRequest(request, out, encoding)))
+		if err != nil {
+			return nil, err
+		}
+		if resp.Get("status").Int() == 415 {
+			if u, err := url.Parse(request.Get("url").String()); err == nil {
+				uploadCompressionMu.Lock()
+				uploadCompressionRefused[u.Scheme+"://"+u.Host] = true
+				uploadCompressionMu.Unlock()
+			}
+			fmt.Printf("[WASM] Server refused %s uploads, resending uncompressed\n", encoding)
+			return awaitJS(fetch.Invoke(request))
+		}
+		return resp, nil
+	})
+}
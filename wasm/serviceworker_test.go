@@ -0,0 +1,135 @@
+//go:build js
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestUploadCompressionConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		cfg func(*uploadCompressionConfig)
+		ok  bool
+	}{
+		{func(c *uploadCompressionConfig) {}, true},
+		{func(c *uploadCompressionConfig) { c.Algorithm = codecZstd }, true},
+		{func(c *uploadCompressionConfig) { c.Endpoints = nil }, false},
+		{func(c *uploadCompressionConfig) { c.Algorithm = codecLZ4 }, false},
+		{func(c *uploadCompressionConfig) { c.Level = 42 }, false},
+		{func(c *uploadCompressionConfig) { c.MinSize = -1 }, false},
+		{func(c *uploadCompressionConfig) { c.MinSavings = 1 }, false},
+	} {
+		cfg := defaultUploadCompressionConfig()
+		cfg.Endpoints = []string{"https://api.example.com/up"}
+		c.cfg(&cfg)
+		if err := cfg.validate(); (err == nil) != c.ok {
+			t.Errorf("%+v: %v", cfg, err)
+		}
+	}
+}
+
+// A text/plain request with optional extra headers
+func fixtureUploadRequest(rawURL, method, body string, headers map[string]string) js.Value {
+	h := js.Global().Get("Object").New()
+	h.Set("Content-Type", "text/plain")
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+	init := js.Global().Get("Object").New()
+	init.Set("method", method)
+	init.Set("headers", h)
+	if method != "GET" {
+		init.Set("body", bytesToJS([]byte(body)))
+	}
+	return js.Global().Get("Request").New(rawURL, init)
+}
+
+func TestCompressedFetch(t *testing.T) {
+	// A fetch that records what it is sent and answers 415 to compressed
+	// bodies on the "refuse" host
+	var sent []js.Value
+	originalFetch := js.Global().Get("fetch")
+	fakeFetch := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		sent = append(sent, args[0])
+		init := js.Global().Get("Object").New()
+		init.Set("status", 200)
+		if args[0].Get("headers").Call("has", "Content-Encoding").Bool() && strings.Contains(args[0].Get("url").String(), "refuse") {
+			init.Set("status", 415)
+		}
+		return js.Global().Get("Promise").Call("resolve", js.Global().Get("Response").New("ok", init))
+	})
+	js.Global().Set("fetch", fakeFetch)
+	defer func() {
+		js.Global().Set("fetch", originalFetch)
+		fakeFetch.Release()
+		uploadCompression = nil
+	}()
+
+	cfg := js.Global().Get("JSON").Call("parse", `{"endpoints":["https://api.example.com/up","https://refuse.example.com/"],"algorithm":"zstd"}`)
+	if _, err := awaitJS(configureUploadCompression(js.Undefined(), []js.Value{cfg}).(js.Value)); err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Repeat("field=value&", 1000)
+	for _, c := range []struct {
+		name     string
+		request  js.Value
+		match    bool
+		encoding []string // Content-Encoding of each request fetch saw
+	}{
+		{"matching upload", fixtureUploadRequest("https://api.example.com/upload/1", "POST", body, nil), true, []string{"zstd"}},
+		{"other origin", fixtureUploadRequest("https://other.example.com/up", "POST", body, nil), false, []string{""}},
+		{"GET", fixtureUploadRequest("https://api.example.com/up", "GET", "", nil), false, []string{""}},
+		{"already encoded", fixtureUploadRequest("https://api.example.com/up", "POST", body, map[string]string{"Content-Encoding": "gzip"}), false, []string{"gzip"}},
+		{"small body", fixtureUploadRequest("https://api.example.com/up", "POST", "a=b", nil), true, []string{""}},
+		{"JPEG body", fixtureUploadRequest("https://api.example.com/up", "PUT", string(fixtureJPEG(fixtureGradient(64, 64))), nil), true, []string{""}},
+		{"refused", fixtureUploadRequest("https://refuse.example.com/x", "POST", body, nil), true, []string{"zstd", ""}},
+		{"refused before", fixtureUploadRequest("https://refuse.example.com/x", "POST", body, nil), false, []string{""}},
+	} {
+		if got := shouldCompressUpload(js.Undefined(), []js.Value{c.request}).(bool); got != c.match {
+			t.Errorf("%s: shouldCompressUpload %v", c.name, got)
+		}
+		sent = nil
+		resp, err := awaitJS(compressedFetch(js.Undefined(), []js.Value{c.request}).(js.Value))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if resp.Get("status").Int() != 200 || len(sent) != len(c.encoding) {
+			t.Fatalf("%s: status %d after %d fetches", c.name, resp.Get("status").Int(), len(sent))
+		}
+		for i, req := range sent {
+			got := ""
+			if encoding := req.Get("headers").Call("get", "Content-Encoding"); !encoding.IsNull() {
+				got = encoding.String()
+			}
+			if got != c.encoding[i] {
+				t.Errorf("%s fetch %d: Content-Encoding %q, want %q", c.name, i, got, c.encoding[i])
+			}
+			if c.encoding[i] != "zstd" {
+				continue
+			}
+			// The compressed body decodes to the original and keeps its type
+			buf, _ := awaitJS(req.Call("arrayBuffer"))
+			res, err := decompressStream(bytesFromJS(js.Global().Get("Uint8Array").New(buf)), defaultDecompressOptions())
+			if err != nil || !bytes.Equal(res.Data, []byte(body)) || req.Get("headers").Call("get", "Content-Type").String() != "text/plain" {
+				t.Errorf("%s: compressed body: %v", c.name, err)
+			}
+		}
+	}
+
+	// null turns compression off
+	if _, err := awaitJS(configureUploadCompression(js.Undefined(), []js.Value{js.Null()}).(js.Value)); err != nil {
+		t.Fatal(err)
+	}
+	if shouldCompressUpload(js.Undefined(), []js.Value{fixtureUploadRequest("https://api.example.com/up", "POST", body, nil)}).(bool) {
+		t.Error("compression still on after configuring null")
+	}
+	bad := js.Global().Get("JSON").Call("parse", `{"endpoints":[]}`)
+	if _, err := awaitJS(configureUploadCompression(js.Undefined(), []js.Value{bad}).(js.Value)); err == nil {
+		t.Error("empty endpoints accepted")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Bumped whenever the profile layout changes incompatibly
+const settingsVersion = 1
+
+// The user's tuned option profile. Every entry point starts from these
+// values, so per-call options only need to carry overrides.
+type settingsProfile struct {
+	Version      int                 `json:"version"`
+	Image        imageOptions        `json:"image"`
+	Batch        batchOptions        `json:"batch"`
+	ContactSheet contactSheetOptions `json:"contactSheet"`
+	Text         textOptions         `json:"text"`
+	PDF          pdfOptions          `json:"pdf"`
+}
+
+func defaultSettings() settingsProfile {
+	return settingsProfile{
+		Version:      settingsVersion,
+		Image:        defaultImageOptions(),
+		ContactSheet: defaultContactSheetOptions(),
+		Text:         defaultTextOptions(),
+		PDF:          defaultPDFOptions(),
+	}
+}
+
+var (
+	settingsMu sync.RWMutex
+	settings   = defaultSettings()
+)
+
+// Snapshot of the active profile; safe to modify, slices included
+func currentSettings() settingsProfile {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return settings.clone()
+}
+
+// Deep copy of p. Slice fields have to be listed here as they are added;
+// the per-call fields of pdfOptions are never set on a profile.
+func (p settingsProfile) clone() settingsProfile {
+	p.Image.Qualities = append(p.Image.Qualities[:0:0], p.Image.Qualities...)
+	p.PDF.StripMetadata = append(p.PDF.StripMetadata[:0:0], p.PDF.StripMetadata...)
+	p.PDF.KeepMetadata = append(p.PDF.KeepMetadata[:0:0], p.PDF.KeepMetadata...)
+	return p
+}
+
+// Reject values the pipelines cannot work with
+func (p settingsProfile) validate() error {
+	if p.Version > settingsVersion {
+		return fmt.Errorf("settings version %d is newer than supported version %d", p.Version, settingsVersion)
+	}
+	switch p.Image.Mode {
+	case modePhoto, modeScreenshot:
+	default:
+		return fmt.Errorf("unknown image mode %q", p.Image.Mode)
+	}
+	switch p.Image.Animation {
+	case animationOptimize, animationFirstFrame:
+	default:
+		return fmt.Errorf("unknown animation mode %q", p.Image.Animation)
+	}
+	if p.Image.MaxDimension < 0 {
+		return errors.New("image.maxDimension must not be negative")
+	}
+	if p.Image.MinSavings < 0 || p.Image.MinSavings >= 1 {
+		return errors.New("image.minSavings must be in [0, 1)")
+	}
+	if p.Image.MaxMs < 0 {
+		return errors.New("image.maxMs must not be negative")
+	}
+	if err := checkXMPMode(p.Image.XMP); err != nil {
+		return fmt.Errorf("image: %v", err)
+	}
+	if err := checkQualityLadder(p.Image.Qualities); err != nil {
+		return fmt.Errorf("image: %v", err)
+	}
+	if p.Image.TargetSavings < 0 || p.Image.TargetSavings >= 1 {
+		return errors.New("image.targetSavings must be in [0, 1)")
+	}
+	switch p.Batch.Report {
+	case "", reportCSV, reportJSON:
+	default:
+		return fmt.Errorf("unknown report format %q", p.Batch.Report)
+	}
+	if err := checkBatchOutputMode(p.Batch.OutputMode); err != nil {
+		return fmt.Errorf("batch: %v", err)
+	}
+	if p.Batch.NamePattern != "" {
+		if _, err := newOutputNamer(p.Batch.NamePattern, time.Time{}); err != nil {
+			return fmt.Errorf("batch: %v", err)
+		}
+	}
+	if p.ContactSheet.Columns < 1 {
+		return errors.New("contactSheet.columns must be at least 1")
+	}
+	if p.ContactSheet.ThumbSize < 16 || p.ContactSheet.ThumbSize > 2048 {
+		return errors.New("contactSheet.thumbSize must be between 16 and 2048")
+	}
+	if err := p.Text.validate(); err != nil {
+		return fmt.Errorf("text: %v", err)
+	}
+	if err := p.PDF.validate(); err != nil {
+		return fmt.Errorf("pdf: %v", err)
+	}
+	return nil
+}
+
+// Parse a stored profile. Keys missing from older blobs keep their
+// defaults, so profiles saved by earlier versions still load.
+func parseSettings(blob []byte) (settingsProfile, error) {
+	profile := defaultSettings()
+	if err := json.Unmarshal(blob, &profile); err != nil {
+		return profile, fmt.Errorf("invalid settings JSON: %v", err)
+	}
+	if err := profile.validate(); err != nil {
+		return profile, err
+	}
+	profile.Version = settingsVersion
+	return profile, nil
+}
+
+// saveSettings(overrides?) merges optional overrides into the active
+// profile and resolves with it serialized as a JSON string for the host
+// to persist (e.g. in localStorage).
+func saveSettings(this js.Value, args []js.Value) interface{} {
+	var overrides js.Value
+	if len(args) > 0 {
+		overrides = args[0]
+	}
+
+	return runAsync("saveSettings", func() (interface{}, error) {
+		settingsMu.Lock()
+		defer settingsMu.Unlock()
+
+		// Decoding reuses slices, so it must not write into the live profile
+		profile := settings.clone()
+		if err := decodeOptions(overrides, &profile); err != nil {
+			return nil, err
+		}
+		if err := profile.validate(); err != nil {
+			return nil, err
+		}
+		profile.Version = settingsVersion
+
+		blob, err := json.Marshal(profile)
+		if err != nil {
+			return nil, err
+		}
+		settings = profile
+		fmt.Printf("[WASM] Settings saved (%d bytes)\n", len(blob))
+		return string(blob), nil
+	})
+}
+
+// loadSettings(json) installs a previously saved profile and resolves with
+// the normalized JSON. Passing null/undefined restores the defaults.
+func loadSettings(this js.Value, args []js.Value) interface{} {
+	var blob js.Value
+	if len(args) > 0 {
+		blob = args[0]
+	}
+
+	return runAsync("loadSettings", func() (interface{}, error) {
+		profile := defaultSettings()
+		if isSet(blob) {
+			if blob.Type() != js.TypeString {
+				return nil, errors.New("settings must be a JSON string")
+			}
+			var err error
+			if profile, err = parseSettings([]byte(blob.String())); err != nil {
+				return nil, err
+			}
+		}
+
+		normalized, err := json.Marshal(profile)
+		if err != nil {
+			return nil, err
+		}
+
+		settingsMu.Lock()
+		settings = profile
+		settingsMu.Unlock()
+		fmt.Printf("[WASM] Settings loaded\n")
+		return string(normalized), nil
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestCurrentSettingsIsADeepCopy(t *testing.T) {
+	settingsMu.Lock()
+	saved := settings
+	settings.Image.Qualities = []int{90, 80}
+	settings.PDF.StripMetadata = []string{"Producer"}
+	settingsMu.Unlock()
+	defer func() {
+		settingsMu.Lock()
+		settings = saved
+		settingsMu.Unlock()
+	}()
+
+	snapshot := currentSettings()
+	snapshot.PDF.StripMetadata[0] = "changed"
+	snapshot.Image.Qualities[0] = -1
+	if again := currentSettings(); again.PDF.StripMetadata[0] == "changed" || again.Image.Qualities[0] == -1 {
+		t.Error("editing a snapshot changed the active profile")
+	}
+}
+
+func TestSettingsRejectBadThumbSize(t *testing.T) {
+	for _, size := range []int{0, -5, 4096} {
+		p := defaultSettings()
+		p.ContactSheet.ThumbSize = size
+		if p.validate() == nil {
+			t.Errorf("thumbSize %d accepted", size)
+		}
+	}
+	if err := defaultSettings().validate(); err != nil {
+		t.Errorf("defaults rejected: %v", err)
+	}
+}
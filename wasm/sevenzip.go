@@ -0,0 +1,1124 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// 7z signature header magic
+var sevenZipSignature = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}
+
+// 7z header property IDs
+const (
+	szEnd                   = 0x00
+	szHeader                = 0x01
+	szArchiveProperties     = 0x02
+	szAdditionalStreamsInfo = 0x03
+	szMainStreamsInfo       = 0x04
+	szFilesInfo             = 0x05
+	szPackInfo              = 0x06
+	szUnpackInfo            = 0x07
+	szSubStreamsInfo        = 0x08
+	szSize                  = 0x09
+	szCRC                   = 0x0A
+	szFolderID              = 0x0B
+	szCodersUnpackSize      = 0x0C
+	szNumUnpackStream       = 0x0D
+	szEmptyStream           = 0x0E
+	szEmptyFile             = 0x0F
+	szName                  = 0x11
+	szMTime                 = 0x14
+	szWinAttributes         = 0x15
+	szEncodedHeader         = 0x17
+)
+
+// Coder method IDs, hex encoded
+const (
+	szMethodCopy    = "00"
+	szMethodDelta   = "03"
+	szMethodBCJ     = "03030103"
+	szMethodBCJ2    = "0303011b"
+	szMethodPPC     = "03030205"
+	szMethodARM     = "03030501"
+	szMethodARMT    = "03030701"
+	szMethodSPARC   = "03030805"
+	szMethodLZMA    = "030101"
+	szMethodLZMA2   = "21"
+	szMethodDeflate = "040108"
+	szMethodBZip2   = "040202"
+	szMethodAES     = "06f10701"
+)
+
+var szMethodNames = map[string]string{
+	szMethodCopy: "copy", szMethodDelta: "delta", szMethodBCJ: "bcj", szMethodLZMA: "lzma",
+	szMethodLZMA2: "lzma2", szMethodDeflate: "deflate", szMethodBZip2: "bzip2", szMethodAES: "aes",
+	szMethodBCJ2: "bcj2", szMethodPPC: "ppc", szMethodARM: "arm", szMethodARMT: "armt", szMethodSPARC: "sparc",
+	"030401": "ppmd",
+}
+
+// Folders larger than this are not decoded into memory
+const sevenZipMaxUnpack = 1 << 30
+
+type szCoder struct {
+	method        string
+	numIn, numOut int
+	props         []byte
+}
+
+type szBindPair struct{ in, out int }
+
+// A folder is one coder graph producing one solid block of output
+type szFolder struct {
+	coders        []szCoder
+	bindPairs     []szBindPair
+	packedStreams []int    // coder in-streams fed directly by pack streams
+	unpackSizes   []uint64 // per coder out-stream
+	crc           uint32
+	hasCRC        bool
+	firstPack     int // index of the folder's first pack stream
+}
+
+// One file's worth of output inside a folder
+type szStream struct {
+	folder int
+	offset uint64 // within the folder's output
+	size   uint64
+	crc    uint32
+	hasCRC bool
+}
+
+type szStreamsInfo struct {
+	packPos   uint64
+	packSizes []uint64
+	folders   []szFolder
+	streams   []szStream
+}
+
+type szFile struct {
+	name      string
+	isDir     bool
+	hasStream bool
+	stream    int
+	modified  time.Time
+}
+
+type sevenZipArchive struct {
+	data  []byte
+	main  *szStreamsInfo
+	files []szFile
+}
+
+// Bounds-checked reader over header bytes; the first error sticks and
+// later reads return zero values
+type szReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *szReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("7z: "+format, args...)
+	}
+}
+
+func (r *szReader) byte() byte {
+	if r.pos >= len(r.data) {
+		r.fail("truncated header")
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *szReader) bytes(n uint64) []byte {
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail("truncated header")
+		r.pos = len(r.data)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// 7z variable-length integer: leading one bits of the first byte count
+// the extra little-endian bytes
+func (r *szReader) number() uint64 {
+	first := r.byte()
+	mask := byte(0x80)
+	var value uint64
+	for i := 0; i < 8; i++ {
+		if first&mask == 0 {
+			return value | uint64(first&(mask-1))<<(8*i)
+		}
+		value |= uint64(r.byte()) << (8 * i)
+		mask >>= 1
+	}
+	return value
+}
+
+// A count used to size allocations; rejects absurd values
+func (r *szReader) count() int {
+	n := r.number()
+	if n > 1<<24 {
+		r.fail("implausible count %d", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *szReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *szReader) uint64() uint64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *szReader) bitVector(n int) []bool {
+	bits := make([]bool, n)
+	var b byte
+	for i := 0; i < n; i++ {
+		if i%8 == 0 {
+			b = r.byte()
+		}
+		bits[i] = b&(0x80>>(i%8)) != 0
+	}
+	return bits
+}
+
+// Bit vector preceded by an "all defined" flag
+func (r *szReader) optionalBits(n int) []bool {
+	if r.byte() != 0 {
+		bits := make([]bool, n)
+		for i := range bits {
+			bits[i] = true
+		}
+		return bits
+	}
+	return r.bitVector(n)
+}
+
+func (r *szReader) digests(n int) ([]bool, []uint32) {
+	defined := r.optionalBits(n)
+	crcs := make([]uint32, n)
+	for i := range crcs {
+		if defined[i] {
+			crcs[i] = r.uint32()
+		}
+	}
+	return defined, crcs
+}
+
+func (r *szReader) expect(id uint64) {
+	if got := r.number(); got != id && r.err == nil {
+		r.fail("expected property %#x, got %#x", id, got)
+	}
+}
+
+func (r *szReader) readFolder() szFolder {
+	var f szFolder
+	totalIn, totalOut := 0, 0
+	numCoders := r.count()
+	for i := 0; i < numCoders && r.err == nil; i++ {
+		flag := r.byte()
+		if flag&0x80 != 0 {
+			r.fail("alternative coder methods are not supported")
+			break
+		}
+		c := szCoder{method: hex.EncodeToString(r.bytes(uint64(flag & 0x0F))), numIn: 1, numOut: 1}
+		if flag&0x10 != 0 {
+			c.numIn, c.numOut = r.count(), r.count()
+		}
+		if flag&0x20 != 0 {
+			c.props = r.bytes(r.number())
+		}
+		totalIn += c.numIn
+		totalOut += c.numOut
+		f.coders = append(f.coders, c)
+	}
+	if totalOut == 0 {
+		r.fail("folder without coders")
+		return f
+	}
+	for i := 0; i < totalOut-1 && r.err == nil; i++ {
+		f.bindPairs = append(f.bindPairs, szBindPair{in: r.count(), out: r.count()})
+	}
+	numPacked := totalIn - len(f.bindPairs)
+	if numPacked == 1 {
+		for in := 0; in < totalIn; in++ {
+			if f.bindPairForIn(in) < 0 {
+				f.packedStreams = append(f.packedStreams, in)
+				break
+			}
+		}
+	} else {
+		for i := 0; i < numPacked && r.err == nil; i++ {
+			f.packedStreams = append(f.packedStreams, r.count())
+		}
+	}
+	return f
+}
+
+func (f *szFolder) bindPairForIn(in int) int {
+	for i, bp := range f.bindPairs {
+		if bp.in == in {
+			return i
+		}
+	}
+	return -1
+}
+
+// The out-stream no bind pair consumes is the folder's output
+func (f *szFolder) mainOut() int {
+	for out := range f.unpackSizes {
+		bound := false
+		for _, bp := range f.bindPairs {
+			if bp.out == out {
+				bound = true
+			}
+		}
+		if !bound {
+			return out
+		}
+	}
+	return 0
+}
+
+func (f *szFolder) unpackSize() uint64 {
+	if len(f.unpackSizes) == 0 {
+		return 0
+	}
+	return f.unpackSizes[f.mainOut()]
+}
+
+// Method chain such as "bcj+lzma2"
+func (f *szFolder) methodName() string {
+	names := make([]string, len(f.coders))
+	for i, c := range f.coders {
+		name, ok := szMethodNames[c.method]
+		if !ok {
+			name = "method-" + c.method
+		}
+		names[i] = name
+	}
+	return strings.Join(names, "+")
+}
+
+func (f *szFolder) encrypted() bool {
+	for _, c := range f.coders {
+		if c.method == szMethodAES {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *szReader) readStreamsInfo() *szStreamsInfo {
+	s := &szStreamsInfo{}
+	var numSub []int
+	for r.err == nil {
+		switch id := r.number(); id {
+		case szEnd:
+			if numSub == nil {
+				// One stream per folder
+				for i, f := range s.folders {
+					s.streams = append(s.streams, szStream{folder: i, size: f.unpackSize(), crc: f.crc, hasCRC: f.hasCRC})
+				}
+			}
+			return s
+		case szPackInfo:
+			s.packPos = r.number()
+			n := r.count()
+			for r.err == nil {
+				prop := r.number()
+				if prop == szEnd {
+					break
+				}
+				switch prop {
+				case szSize:
+					s.packSizes = make([]uint64, n)
+					for i := range s.packSizes {
+						s.packSizes[i] = r.number()
+					}
+				case szCRC:
+					r.digests(n)
+				default:
+					r.fail("unexpected pack property %#x", prop)
+				}
+			}
+		case szUnpackInfo:
+			r.expect(szFolderID)
+			n := r.count()
+			if r.byte() != 0 {
+				r.fail("external folder definitions are not supported")
+				return s
+			}
+			s.folders = make([]szFolder, n)
+			pack := 0
+			for i := range s.folders {
+				s.folders[i] = r.readFolder()
+				s.folders[i].firstPack = pack
+				pack += len(s.folders[i].packedStreams)
+			}
+			r.expect(szCodersUnpackSize)
+			for i := range s.folders {
+				f := &s.folders[i]
+				outs := 0
+				for _, c := range f.coders {
+					outs += c.numOut
+				}
+				f.unpackSizes = make([]uint64, outs)
+				for j := range f.unpackSizes {
+					f.unpackSizes[j] = r.number()
+				}
+			}
+			prop := r.number()
+			if prop == szCRC {
+				defined, crcs := r.digests(n)
+				for i := range s.folders {
+					s.folders[i].hasCRC, s.folders[i].crc = defined[i], crcs[i]
+				}
+				prop = r.number()
+			}
+			if prop != szEnd {
+				r.fail("unexpected unpack property %#x", prop)
+			}
+		case szSubStreamsInfo:
+			numSub = r.readSubStreams(s)
+		default:
+			r.fail("unexpected streams property %#x", id)
+		}
+	}
+	return s
+}
+
+// Split folders into per-file streams; returns the stream count per folder
+func (r *szReader) readSubStreams(s *szStreamsInfo) []int {
+	numSub := make([]int, len(s.folders))
+	for i := range numSub {
+		numSub[i] = 1
+	}
+	id := r.number()
+	if id == szNumUnpackStream {
+		for i := range numSub {
+			numSub[i] = r.count()
+		}
+		id = r.number()
+	}
+
+	for i, f := range s.folders {
+		if numSub[i] == 0 {
+			continue
+		}
+		var offset uint64
+		for j := 0; j < numSub[i]-1; j++ {
+			if id != szSize {
+				r.fail("missing substream sizes")
+				return numSub
+			}
+			size := r.number()
+			s.streams = append(s.streams, szStream{folder: i, offset: offset, size: size})
+			offset += size
+		}
+		if offset > f.unpackSize() {
+			r.fail("substream sizes exceed folder size")
+			return numSub
+		}
+		last := szStream{folder: i, offset: offset, size: f.unpackSize() - offset}
+		if numSub[i] == 1 {
+			last.crc, last.hasCRC = f.crc, f.hasCRC
+		}
+		s.streams = append(s.streams, last)
+	}
+	if id == szSize {
+		id = r.number()
+	}
+
+	for id != szEnd && r.err == nil {
+		if id != szCRC {
+			r.fail("unexpected substream property %#x", id)
+			break
+		}
+		// Digests cover only streams whose CRC the folder did not give
+		var unknown []int
+		for i := range s.streams {
+			f := s.folders[s.streams[i].folder]
+			if numSub[s.streams[i].folder] != 1 || !f.hasCRC {
+				unknown = append(unknown, i)
+			}
+		}
+		defined, crcs := r.digests(len(unknown))
+		for k, i := range unknown {
+			s.streams[i].hasCRC, s.streams[i].crc = defined[k], crcs[k]
+		}
+		id = r.number()
+	}
+	return numSub
+}
+
+// Convert a Windows FILETIME (100 ns ticks since 1601) to time.Time
+func fileTimeToTime(ft uint64) time.Time {
+	const epochDiff = 116444736000000000
+	if ft < epochDiff {
+		return time.Time{}
+	}
+	ticks := ft - epochDiff
+	return time.Unix(int64(ticks/1e7), int64(ticks%1e7)*100)
+}
+
+func (r *szReader) readFilesInfo() []szFile {
+	n := r.count()
+	files := make([]szFile, n)
+	var emptyStream, emptyFile []bool
+	for r.err == nil {
+		prop := r.number()
+		if prop == szEnd {
+			break
+		}
+		pr := &szReader{data: r.bytes(r.number())}
+		switch prop {
+		case szEmptyStream:
+			emptyStream = pr.bitVector(n)
+		case szEmptyFile:
+			empties := 0
+			for _, e := range emptyStream {
+				if e {
+					empties++
+				}
+			}
+			emptyFile = pr.bitVector(empties)
+		case szName:
+			if pr.byte() != 0 {
+				pr.fail("external file names are not supported")
+				break
+			}
+			for i := 0; i < n && pr.err == nil; i++ {
+				var units []uint16
+				for pr.err == nil {
+					u := uint16(pr.byte()) | uint16(pr.byte())<<8
+					if u == 0 {
+						break
+					}
+					units = append(units, u)
+				}
+				files[i].name = string(utf16.Decode(units))
+			}
+		case szMTime:
+			defined := pr.optionalBits(n)
+			if pr.byte() != 0 {
+				pr.fail("external times are not supported")
+				break
+			}
+			for i := range files {
+				if defined[i] {
+					files[i].modified = fileTimeToTime(pr.uint64())
+				}
+			}
+		case szWinAttributes:
+			defined := pr.optionalBits(n)
+			if pr.byte() != 0 {
+				pr.fail("external attributes are not supported")
+				break
+			}
+			for i := range files {
+				if defined[i] && pr.uint32()&0x10 != 0 { // FILE_ATTRIBUTE_DIRECTORY
+					files[i].isDir = true
+				}
+			}
+		}
+		if pr.err != nil && r.err == nil {
+			r.err = pr.err
+		}
+	}
+
+	stream, empty := 0, 0
+	for i := range files {
+		if emptyStream != nil && emptyStream[i] {
+			// Empty streams are directories unless flagged as empty files
+			if emptyFile == nil || empty >= len(emptyFile) || !emptyFile[empty] {
+				files[i].isDir = true
+			}
+			empty++
+			continue
+		}
+		files[i].hasStream = true
+		files[i].stream = stream
+		stream++
+	}
+	return files
+}
+
+// Parse the signature header and (possibly encoded) archive header
+func parseSevenZip(data []byte) (*sevenZipArchive, error) {
+	if len(data) < 32 || !bytes.HasPrefix(data, sevenZipSignature) {
+		return nil, errors.New("not a 7z archive")
+	}
+	nextOffset := binary.LittleEndian.Uint64(data[12:])
+	nextSize := binary.LittleEndian.Uint64(data[20:])
+	nextCRC := binary.LittleEndian.Uint32(data[28:])
+	if nextOffset > uint64(len(data)-32) || nextSize > uint64(len(data)-32)-nextOffset {
+		return nil, errors.New("7z: header lies outside the file (truncated download?)")
+	}
+	start := 32 + int(nextOffset)
+	header := data[start : start+int(nextSize)]
+	if crc32.ChecksumIEEE(header) != nextCRC {
+		return nil, errors.New("7z: header checksum mismatch")
+	}
+
+	a := &sevenZipArchive{data: data}
+	for depth := 0; depth < 4; depth++ {
+		r := &szReader{data: header}
+		switch id := r.number(); id {
+		case szHeader:
+			a.readHeader(r)
+			if r.err != nil {
+				return nil, r.err
+			}
+			if a.main == nil {
+				a.main = &szStreamsInfo{}
+			}
+			return a, nil
+		case szEncodedHeader:
+			// The real header is itself packed, usually with LZMA
+			s := r.readStreamsInfo()
+			if r.err != nil {
+				return nil, r.err
+			}
+			if len(s.folders) == 0 {
+				return nil, errors.New("7z: encoded header has no folder")
+			}
+			if s.folders[0].encrypted() {
+				return nil, errors.New("7z: archives with encrypted file names are not supported")
+			}
+			var err error
+			if header, err = a.decodeFolder(s, 0); err != nil {
+				return nil, fmt.Errorf("7z header: %v", err)
+			}
+		default:
+			return nil, fmt.Errorf("7z: unexpected header type %#x", id)
+		}
+	}
+	return nil, errors.New("7z: header nesting too deep")
+}
+
+func (a *sevenZipArchive) readHeader(r *szReader) {
+	id := r.number()
+	if id == szArchiveProperties {
+		for r.err == nil {
+			if r.number() == szEnd {
+				break
+			}
+			r.bytes(r.number())
+		}
+		id = r.number()
+	}
+	if id == szAdditionalStreamsInfo {
+		r.readStreamsInfo()
+		id = r.number()
+	}
+	if id == szMainStreamsInfo {
+		a.main = r.readStreamsInfo()
+		id = r.number()
+	}
+	if id == szFilesInfo {
+		a.files = r.readFilesInfo()
+		id = r.number()
+	}
+	if id != szEnd {
+		r.fail("unexpected header property %#x", id)
+	}
+}
+
+// Decode a folder's full output
+func (a *sevenZipArchive) decodeFolder(s *szStreamsInfo, index int) ([]byte, error) {
+	f := &s.folders[index]
+	if f.encrypted() {
+		return nil, errors.New("encrypted 7z archives are not supported")
+	}
+
+	// Locate the folder's pack streams
+	offset := 32 + s.packPos
+	for i := 0; i < f.firstPack; i++ {
+		offset += s.packSizes[i]
+	}
+	packs := make([][]byte, len(f.packedStreams))
+	for i := range packs {
+		pi := f.firstPack + i
+		if pi >= len(s.packSizes) {
+			return nil, errors.New("missing pack stream")
+		}
+		end := offset + s.packSizes[pi]
+		if end > uint64(len(a.data)) {
+			return nil, errors.New("pack stream lies outside the file (truncated download?)")
+		}
+		packs[i] = a.data[offset:end]
+		offset = end
+	}
+
+	out, err := f.decodeOut(f.mainOut(), packs, 0)
+	if err != nil {
+		return nil, err
+	}
+	if f.hasCRC && crc32.ChecksumIEEE(out) != f.crc {
+		return nil, errors.New("checksum mismatch")
+	}
+	return out, nil
+}
+
+// Produce a coder out-stream by decoding its inputs, recursively through
+// bind pairs. Coders have one output; BCJ2 is the only one with several
+// inputs.
+func (f *szFolder) decodeOut(out int, packs [][]byte, depth int) ([]byte, error) {
+	if depth > len(f.coders) {
+		return nil, errors.New("coder graph has a cycle")
+	}
+	coder, firstIn, firstOut := -1, 0, 0
+	for i, c := range f.coders {
+		if out < firstOut+c.numOut {
+			coder = i
+			break
+		}
+		firstIn += c.numIn
+		firstOut += c.numOut
+	}
+	if coder < 0 || out >= len(f.unpackSizes) {
+		return nil, errors.New("invalid coder graph")
+	}
+	c := f.coders[coder]
+	if c.numOut != 1 {
+		return nil, fmt.Errorf("coder %s with %d outputs is not supported", c.method, c.numOut)
+	}
+
+	inputs := make([][]byte, c.numIn)
+	for k := range inputs {
+		in := firstIn + k
+		if bp := f.bindPairForIn(in); bp >= 0 {
+			var err error
+			if inputs[k], err = f.decodeOut(f.bindPairs[bp].out, packs, depth+1); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		found := false
+		for i, packed := range f.packedStreams {
+			if packed == in {
+				inputs[k], found = packs[i], true
+			}
+		}
+		if !found {
+			return nil, errors.New("coder input is not bound")
+		}
+	}
+	return runSevenZipCoder(c, inputs, f.unpackSizes[out])
+}
+
+// Branch-converting filters: each undoes, in place, the absolute
+// addressing of call instructions for one CPU
+var szBranchFilters = map[string]func([]byte){
+	szMethodBCJ:   bcjX86Decode,
+	szMethodARM:   bcjARMDecode,
+	szMethodARMT:  bcjARMThumbDecode,
+	szMethodPPC:   bcjPPCDecode,
+	szMethodSPARC: bcjSPARCDecode,
+}
+
+// Decode one coder's inputs into exactly size bytes
+func runSevenZipCoder(c szCoder, inputs [][]byte, size uint64) ([]byte, error) {
+	if size > sevenZipMaxUnpack {
+		return nil, fmt.Errorf("folder of %d bytes is too large to extract in the browser", size)
+	}
+	if c.method == szMethodBCJ2 {
+		if len(inputs) != 4 {
+			return nil, errors.New("bad BCJ2 stream count")
+		}
+		return bcj2Decode(inputs, int(size))
+	}
+	if len(inputs) != 1 {
+		return nil, fmt.Errorf("coder %s with %d inputs is not supported", c.method, len(inputs))
+	}
+	input := inputs[0]
+	if filter, ok := szBranchFilters[c.method]; ok {
+		out := append([]byte(nil), input...)
+		filter(out)
+		return out, nil
+	}
+
+	var r io.Reader
+	switch c.method {
+	case szMethodCopy:
+		r = bytes.NewReader(input)
+	case szMethodLZMA:
+		if len(c.props) != 5 {
+			return nil, errors.New("bad LZMA properties")
+		}
+		// Rebuild the classic .lzma header: properties, dictionary, size
+		header := make([]byte, 13)
+		copy(header, c.props)
+		binary.LittleEndian.PutUint64(header[5:], size)
+		lr, err := lzma.NewReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader(input)))
+		if err != nil {
+			return nil, err
+		}
+		r = lr
+	case szMethodLZMA2:
+		if len(c.props) != 1 || c.props[0] > 40 {
+			return nil, errors.New("bad LZMA2 properties")
+		}
+		dictCap := 0xFFFFFFFF
+		if p := c.props[0]; p < 40 {
+			dictCap = (2 | int(p&1)) << (p/2 + 11)
+		}
+		// The dictionary never needs to exceed the output
+		if uint64(dictCap) > size {
+			dictCap = int(size)
+		}
+		if dictCap < lzma.MinDictCap {
+			dictCap = lzma.MinDictCap
+		}
+		lr, err := lzma.Reader2Config{DictCap: dictCap}.NewReader2(bytes.NewReader(input))
+		if err != nil {
+			return nil, err
+		}
+		r = lr
+	case szMethodDeflate:
+		r = flate.NewReader(bytes.NewReader(input))
+	case szMethodBZip2:
+		r = bzip2.NewReader(bytes.NewReader(input))
+	case szMethodDelta:
+		dist := 1
+		if len(c.props) == 1 {
+			dist = int(c.props[0]) + 1
+		}
+		out := append([]byte(nil), input...)
+		for i := dist; i < len(out); i++ {
+			out[i] += out[i-dist]
+		}
+		return out, nil
+	case szMethodAES:
+		return nil, errors.New("encrypted 7z archives are not supported")
+	default:
+		name := szMethodNames[c.method]
+		if name == "" {
+			name = "method " + c.method
+		}
+		return nil, fmt.Errorf("7z compression %s is not supported", name)
+	}
+
+	out := make([]byte, size)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, fmt.Errorf("corrupt stream: %v", err)
+	}
+	return out, nil
+}
+
+// Undo the x86 BCJ filter in place (relative CALL/JMP targets were made
+// absolute to help compression)
+func bcjX86Decode(buf []byte) {
+	allowed := [8]bool{true, true, true, false, true, false, false, false}
+	bitNum := [8]uint{0, 1, 2, 2, 3, 3, 3, 3}
+	msByte := func(b byte) bool { return b == 0x00 || b == 0xFF }
+
+	if len(buf) <= 4 {
+		return
+	}
+	size := len(buf) - 4
+	prevPos := -1
+	prevMask := uint32(0)
+	for i := 0; i < size; i++ {
+		if buf[i]&0xFE != 0xE8 {
+			continue
+		}
+		if d := i - prevPos; d > 3 {
+			prevMask = 0
+		} else {
+			prevMask = (prevMask << uint(d-1)) & 7
+			if prevMask != 0 {
+				b := buf[i+4-int(bitNum[prevMask])]
+				if !allowed[prevMask] || msByte(b) {
+					prevPos = i
+					prevMask = prevMask<<1 | 1
+					continue
+				}
+			}
+		}
+		prevPos = i
+		if msByte(buf[i+4]) {
+			src := binary.LittleEndian.Uint32(buf[i+1:])
+			var dest uint32
+			for {
+				dest = src - uint32(i+5)
+				if prevMask == 0 {
+					break
+				}
+				j := bitNum[prevMask] * 8
+				if !msByte(byte(dest >> (24 - j))) {
+					break
+				}
+				src = dest ^ (1<<(32-j) - 1)
+			}
+			dest &= 0x01FFFFFF
+			dest |= -(dest & 0x01000000)
+			binary.LittleEndian.PutUint32(buf[i+1:], dest)
+			i += 4
+		} else {
+			prevMask = prevMask<<1 | 1
+		}
+	}
+}
+
+// ARM BL instructions
+func bcjARMDecode(buf []byte) {
+	for i := 0; i+4 <= len(buf); i += 4 {
+		if buf[i+3] != 0xEB {
+			continue
+		}
+		src := (uint32(buf[i+2])<<16 | uint32(buf[i+1])<<8 | uint32(buf[i])) << 2
+		dest := (src - uint32(i+8)) >> 2
+		buf[i+2], buf[i+1], buf[i] = byte(dest>>16), byte(dest>>8), byte(dest)
+	}
+}
+
+// ARM Thumb BL instruction pairs
+func bcjARMThumbDecode(buf []byte) {
+	for i := 0; i+4 <= len(buf); i += 2 {
+		if buf[i+1]&0xF8 != 0xF0 || buf[i+3]&0xF8 != 0xF8 {
+			continue
+		}
+		src := (uint32(buf[i+1]&7)<<19 | uint32(buf[i])<<11 | uint32(buf[i+3]&7)<<8 | uint32(buf[i+2])) << 1
+		dest := (src - uint32(i+4)) >> 1
+		buf[i+1] = 0xF0 | byte(dest>>19)&7
+		buf[i] = byte(dest >> 11)
+		buf[i+3] = 0xF8 | byte(dest>>8)&7
+		buf[i+2] = byte(dest)
+		i += 2
+	}
+}
+
+// PowerPC "bl" (big-endian)
+func bcjPPCDecode(buf []byte) {
+	for i := 0; i+4 <= len(buf); i += 4 {
+		if buf[i]>>2 != 0x12 || buf[i+3]&3 != 1 {
+			continue
+		}
+		src := uint32(buf[i]&3)<<24 | uint32(buf[i+1])<<16 | uint32(buf[i+2])<<8 | uint32(buf[i+3]&^3)
+		dest := src - uint32(i)
+		buf[i] = 0x48 | byte(dest>>24)&3
+		buf[i+1] = byte(dest >> 16)
+		buf[i+2] = byte(dest >> 8)
+		buf[i+3] = buf[i+3]&3 | byte(dest)&^3
+	}
+}
+
+// SPARC "call" (big-endian)
+func bcjSPARCDecode(buf []byte) {
+	for i := 0; i+4 <= len(buf); i += 4 {
+		if !(buf[i] == 0x40 && buf[i+1]&0xC0 == 0x00) && !(buf[i] == 0x7F && buf[i+1]&0xC0 == 0xC0) {
+			continue
+		}
+		src := binary.BigEndian.Uint32(buf[i:]) << 2
+		dest := (src - uint32(i)) >> 2
+		dest = ((0-(dest>>22)&1)<<22)&0x3FFFFFFF | dest&0x3FFFFF | 0x40000000
+		binary.BigEndian.PutUint32(buf[i:], dest)
+	}
+}
+
+// Undo BCJ2: x86 call and jump targets were split into their own streams
+// (inputs 1 and 2) with a range-coded stream (input 3) saying which
+// E8/E9/Jcc opcodes in the main stream (input 0) were converted
+func bcj2Decode(inputs [][]byte, outSize int) ([]byte, error) {
+	const (
+		topValue   = 1 << 24
+		modelBits  = 11
+		moveBits   = 5
+		modelTotal = 1 << modelBits
+	)
+	main, call, jump, rc := inputs[0], inputs[1], inputs[2], inputs[3]
+	if len(rc) < 5 {
+		return nil, errors.New("BCJ2 range coder stream too short")
+	}
+	var probs [258]uint16
+	for i := range probs {
+		probs[i] = modelTotal >> 1
+	}
+	rangeVal, code := uint32(0xFFFFFFFF), uint32(0)
+	rcPos := 0
+	for ; rcPos < 5; rcPos++ {
+		code = code<<8 | uint32(rc[rcPos])
+	}
+	normalize := func() error {
+		if rangeVal < topValue {
+			if rcPos >= len(rc) {
+				return errors.New("BCJ2 range coder stream truncated")
+			}
+			rangeVal <<= 8
+			code = code<<8 | uint32(rc[rcPos])
+			rcPos++
+		}
+		return nil
+	}
+	isJump := func(b0, b1 byte) bool { return b1&0xFE == 0xE8 || (b0 == 0x0F && b1&0xF0 == 0x80) }
+
+	out := make([]byte, 0, outSize)
+	inPos := 0
+	prevByte := byte(0)
+	for len(out) < outSize {
+		// Copy plain bytes up to and including the next jump opcode
+		found := false
+		for inPos < len(main) && len(out) < outSize {
+			b := main[inPos]
+			inPos++
+			out = append(out, b)
+			if isJump(prevByte, b) {
+				found = true
+				break
+			}
+			prevByte = b
+		}
+		if !found || len(out) == outSize {
+			break
+		}
+
+		// CALLs are modelled per preceding byte
+		b := out[len(out)-1]
+		var prob *uint16
+		switch {
+		case b == 0xE8:
+			prob = &probs[prevByte]
+		case b == 0xE9:
+			prob = &probs[256]
+		default:
+			prob = &probs[257]
+		}
+
+		bound := (rangeVal >> modelBits) * uint32(*prob)
+		if code < bound {
+			// Not converted
+			rangeVal = bound
+			*prob += (modelTotal - *prob) >> moveBits
+			if err := normalize(); err != nil {
+				return nil, err
+			}
+			prevByte = b
+			continue
+		}
+		rangeVal -= bound
+		code -= bound
+		*prob -= *prob >> moveBits
+		if err := normalize(); err != nil {
+			return nil, err
+		}
+
+		var src []byte
+		if b == 0xE8 {
+			if len(call) < 4 {
+				return nil, errors.New("BCJ2 call stream truncated")
+			}
+			src, call = call[:4], call[4:]
+		} else {
+			if len(jump) < 4 {
+				return nil, errors.New("BCJ2 jump stream truncated")
+			}
+			src, jump = jump[:4], jump[4:]
+		}
+		dest := binary.BigEndian.Uint32(src) - uint32(len(out)+4)
+		for k := 0; k < 4 && len(out) < outSize; k++ {
+			out = append(out, byte(dest>>(8*k)))
+		}
+		prevByte = byte(dest >> 24)
+	}
+	if len(out) != outSize {
+		return nil, errors.New("BCJ2 main stream truncated")
+	}
+	return out, nil
+}
+
+// List entries without decoding file data
+func listSevenZip(data []byte) (archiveListing, error) {
+	a, err := parseSevenZip(data)
+	if err != nil {
+		return archiveListing{}, err
+	}
+	listing := archiveListing{Format: archiveSevenZip, Entries: []archiveEntry{}}
+	for _, f := range a.files {
+		entry := archiveEntry{Name: f.name, Modified: formatModTime(f.modified), IsDir: f.isDir, Method: "store"}
+		if f.hasStream && f.stream < len(a.main.streams) {
+			s := a.main.streams[f.stream]
+			folder := &a.main.folders[s.folder]
+			entry.Size = int64(s.size)
+			entry.Method = folder.methodName()
+			entry.Encrypted = folder.encrypted()
+		}
+		listing.Entries = append(listing.Entries, entry)
+		listing.TotalSize += entry.Size
+	}
+	return listing, nil
+}
+
+// Extract every file, decoding each solid folder once. Files whose folder
+// cannot be decoded (unsupported method, corruption) are skipped with a
+// warning so the rest of the archive is still usable.
+func extractSevenZip(data []byte) ([]extractedEntry, []message, error) {
+	a, err := parseSevenZip(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	cachedFolder := -1
+	var folderData []byte
+	var folderErr error
+	var entries []extractedEntry
+	var warnings []message
+	for _, f := range a.files {
+		entry := extractedEntry{Name: f.name, Modified: f.modified, IsDir: f.isDir}
+		if f.hasStream {
+			if f.stream >= len(a.main.streams) {
+				return nil, warnings, fmt.Errorf("7z: %s has no data stream", f.name)
+			}
+			s := a.main.streams[f.stream]
+			if s.folder != cachedFolder {
+				folderData, folderErr = a.decodeFolder(a.main, s.folder)
+				cachedFolder = s.folder
+			}
+			if folderErr != nil {
+				warnings = append(warnings, newMessage("archive.entryFailed", "name", f.name, "error", folderErr))
+				continue
+			}
+			if s.offset+s.size > uint64(len(folderData)) {
+				warnings = append(warnings, newMessage("archive.outsideFolder", "name", f.name))
+				continue
+			}
+			entry.Data = folderData[s.offset : s.offset+s.size]
+			if s.hasCRC && crc32.ChecksumIEEE(entry.Data) != s.crc {
+				warnings = append(warnings, newMessage("archive.checksumMismatch", "name", f.name))
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 && len(warnings) > 0 {
+		return nil, warnings, fmt.Errorf("7z: nothing could be extracted: %s", warnings[0].Text)
+	}
+	return entries, warnings, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// 7z number: the leading one bits of the first byte count the bytes that
+// follow it, little endian, and the rest of the first byte holds the top
+func szTestNumber(v uint64) []byte {
+	for n := 0; n < 8; n++ {
+		if v < 1<<(7*(n+1)) {
+			out := []byte{^byte(0xFF>>n) | byte(v>>(8*n))}
+			for i := 0; i < n; i++ {
+				out = append(out, byte(v>>(8*i)))
+			}
+			return out
+		}
+	}
+	return binary.LittleEndian.AppendUint64([]byte{0xFF}, v)
+}
+
+type szTestFile struct {
+	name string
+	data []byte
+}
+
+// One folder of a fixture archive. coders are coder records as stored
+// (flag, method ID, properties); with two, the first is fed by the
+// second, whose input is the packed stream.
+type szTestFolder struct {
+	coders [][]byte
+	sizes  []uint64 // unpack size of each coder's output
+	packed []byte
+	files  []szTestFile
+}
+
+func (f szTestFolder) unpacked() []byte {
+	var all []byte
+	for _, file := range f.files {
+		all = append(all, file.data...)
+	}
+	return all
+}
+
+func szCopyFolder(files ...szTestFile) szTestFolder {
+	f := szTestFolder{coders: [][]byte{{0x01, 0x00}}, files: files}
+	f.packed = f.unpacked()
+	f.sizes = []uint64{uint64(len(f.packed))}
+	return f
+}
+
+func szLZMAFolder(t *testing.T, files ...szTestFile) szTestFolder {
+	f := szTestFolder{files: files}
+	data := f.unpacked()
+	var buf bytes.Buffer
+	w, err := lzma.WriterConfig{DictCap: 1 << 16, SizeInHeader: true, Size: int64(len(data))}.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The 7z coder keeps the .lzma header's properties and dictionary
+	// size and drops the length
+	stream := buf.Bytes()
+	f.coders = [][]byte{append([]byte{0x23, 0x03, 0x01, 0x01, 5}, stream[:5]...)}
+	f.packed = stream[13:]
+	f.sizes = []uint64{uint64(len(data))}
+	return f
+}
+
+func szLZMA2Stream(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := lzma.Writer2Config{DictCap: 1 << 16}.NewWriter2(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// LZMA2 coder record for a 64KB dictionary
+var szLZMA2Coder = []byte{0x21, 0x21, 1, 8}
+
+func szLZMA2Folder(t *testing.T, files ...szTestFile) szTestFolder {
+	f := szTestFolder{coders: [][]byte{szLZMA2Coder}, files: files}
+	f.packed = szLZMA2Stream(t, f.unpacked())
+	f.sizes = []uint64{uint64(len(f.unpacked()))}
+	return f
+}
+
+func szDeflateFolder(files ...szTestFile) szTestFolder {
+	f := szTestFolder{coders: [][]byte{{0x03, 0x04, 0x01, 0x08}}, files: files}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(f.unpacked())
+	w.Close()
+	f.packed = buf.Bytes()
+	f.sizes = []uint64{uint64(len(f.unpacked()))}
+	return f
+}
+
+// Delta filter over a 4-byte distance, then LZMA2
+func szDeltaLZMA2Folder(t *testing.T, files ...szTestFile) szTestFolder {
+	f := szTestFolder{coders: [][]byte{{0x21, 0x03, 1, 3}, szLZMA2Coder}, files: files}
+	data := f.unpacked()
+	delta := append([]byte{}, data...)
+	for i := len(delta) - 1; i >= 4; i-- {
+		delta[i] -= data[i-4]
+	}
+	f.packed = szLZMA2Stream(t, delta)
+	f.sizes = []uint64{uint64(len(data)), uint64(len(data))}
+	return f
+}
+
+// Streams info for folders whose packed streams start at packPos
+func szTestStreamsInfo(folders []szTestFolder, packPos int, substreams bool) []byte {
+	h := []byte{szPackInfo}
+	h = append(h, szTestNumber(uint64(packPos))...)
+	h = append(h, szTestNumber(uint64(len(folders)))...)
+	h = append(h, szSize)
+	for _, f := range folders {
+		h = append(h, szTestNumber(uint64(len(f.packed)))...)
+	}
+	h = append(h, szEnd, szUnpackInfo, szFolderID)
+	h = append(h, szTestNumber(uint64(len(folders)))...)
+	h = append(h, 0)
+	for _, f := range folders {
+		h = append(h, byte(len(f.coders)))
+		for _, c := range f.coders {
+			h = append(h, c...)
+		}
+		if len(f.coders) == 2 {
+			h = append(h, 0, 1) // coder 0's input is coder 1's output
+		}
+	}
+	h = append(h, szCodersUnpackSize)
+	for _, f := range folders {
+		for _, size := range f.sizes {
+			h = append(h, szTestNumber(size)...)
+		}
+	}
+	h = append(h, szEnd)
+	if substreams {
+		h = append(h, szSubStreamsInfo, szNumUnpackStream)
+		for _, f := range folders {
+			h = append(h, szTestNumber(uint64(len(f.files)))...)
+		}
+		h = append(h, szSize)
+		for _, f := range folders {
+			for _, file := range f.files[:len(f.files)-1] {
+				h = append(h, szTestNumber(uint64(len(file.data)))...)
+			}
+		}
+		h = append(h, szCRC, 1)
+		for _, f := range folders {
+			for _, file := range f.files {
+				h = binary.LittleEndian.AppendUint32(h, crc32.ChecksumIEEE(file.data))
+			}
+		}
+		h = append(h, szEnd)
+	}
+	return append(h, szEnd)
+}
+
+// A 7z archive holding folders, then directories as empty streams. With
+// encodeHeader the header is stored as its own (copy) folder, the way 7-Zip
+// stores it LZMA compressed.
+func fixtureSevenZip(folders []szTestFolder, dirs []string, encodeHeader bool) []byte {
+	var packed []byte
+	for _, f := range folders {
+		packed = append(packed, f.packed...)
+	}
+
+	var names []string
+	for _, f := range folders {
+		for _, file := range f.files {
+			names = append(names, file.name)
+		}
+	}
+	h := []byte{szHeader, szMainStreamsInfo}
+	h = append(h, szTestStreamsInfo(folders, 0, true)...)
+	h = append(h, szFilesInfo)
+	h = append(h, szTestNumber(uint64(len(names)+len(dirs)))...)
+	if len(dirs) > 0 {
+		empty := make([]byte, (len(names)+len(dirs)+7)/8)
+		for i := len(names); i < len(names)+len(dirs); i++ {
+			empty[i/8] |= 0x80 >> (i % 8)
+		}
+		h = append(h, szEmptyStream)
+		h = append(h, szTestNumber(uint64(len(empty)))...)
+		h = append(h, empty...)
+	}
+	nameData := []byte{0}
+	for _, name := range append(names, dirs...) {
+		for _, u := range utf16.Encode([]rune(name)) {
+			nameData = binary.LittleEndian.AppendUint16(nameData, u)
+		}
+		nameData = append(nameData, 0, 0)
+	}
+	h = append(h, szName)
+	h = append(h, szTestNumber(uint64(len(nameData)))...)
+	h = append(h, nameData...)
+	h = append(h, szEnd, szEnd)
+
+	if encodeHeader {
+		headerFolder := szCopyFolder(szTestFile{data: h})
+		packPos := len(packed)
+		packed = append(packed, h...)
+		h = append([]byte{szEncodedHeader}, szTestStreamsInfo([]szTestFolder{headerFolder}, packPos, false)...)
+	}
+
+	start := make([]byte, 32)
+	copy(start, sevenZipSignature)
+	start[7] = 4
+	binary.LittleEndian.PutUint64(start[12:], uint64(len(packed)))
+	binary.LittleEndian.PutUint64(start[20:], uint64(len(h)))
+	binary.LittleEndian.PutUint32(start[28:], crc32.ChecksumIEEE(h))
+	binary.LittleEndian.PutUint32(start[8:], crc32.ChecksumIEEE(start[12:32]))
+	return append(append(start, packed...), h...)
+}
+
+func TestSevenZipExtractsEachMethod(t *testing.T) {
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 200))
+	samples := make([]byte, 4000)
+	for i := range samples {
+		samples[i] = byte(i / 4 * 3) // a ramp per 4-byte channel, which delta flattens
+	}
+	folders := []szTestFolder{
+		szCopyFolder(szTestFile{"a.txt", []byte("hello 7z")}, szTestFile{"docs/b.txt", []byte("second file")}),
+		szLZMAFolder(t, szTestFile{"lzma.txt", text}),
+		szLZMA2Folder(t, szTestFile{"lzma2.txt", text[:3000]}, szTestFile{"tail.txt", text[3000:]}),
+		szDeflateFolder(szTestFile{"deflate.txt", text}),
+		szDeltaLZMA2Folder(t, szTestFile{"samples.raw", samples}),
+	}
+	methods := map[string]string{
+		"a.txt": "copy", "docs/b.txt": "copy", "lzma.txt": "lzma", "lzma2.txt": "lzma2", "tail.txt": "lzma2",
+		"deflate.txt": "deflate", "samples.raw": "delta+lzma2",
+	}
+
+	for _, encodeHeader := range []bool{false, true} {
+		data := fixtureSevenZip(folders, []string{"docs"}, encodeHeader)
+		listing, err := listArchiveEntries(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if listing.Format != archiveSevenZip || len(listing.Entries) != len(methods)+1 {
+			t.Fatalf("listed %s with %d entries", listing.Format, len(listing.Entries))
+		}
+		for _, e := range listing.Entries {
+			if e.Name == "docs" {
+				if !e.IsDir {
+					t.Error("docs not listed as a directory")
+				}
+				continue
+			}
+			if e.Method != methods[e.Name] {
+				t.Errorf("%s listed with method %q, want %q", e.Name, e.Method, methods[e.Name])
+			}
+		}
+
+		entries, warnings, err := extractSevenZip(data)
+		if err != nil || len(warnings) != 0 {
+			t.Fatalf("extract: %v, warnings %v", err, warnings)
+		}
+		want := map[string][]byte{}
+		for _, f := range folders {
+			for _, file := range f.files {
+				want[file.name] = file.data
+			}
+		}
+		for _, e := range entries {
+			if e.IsDir {
+				continue
+			}
+			if !bytes.Equal(e.Data, want[e.Name]) {
+				t.Errorf("%s extracted as %d bytes, want %d", e.Name, len(e.Data), len(want[e.Name]))
+			}
+			delete(want, e.Name)
+		}
+		if len(want) != 0 {
+			t.Errorf("not extracted: %v", want)
+		}
+	}
+}
+
+func TestSevenZipDamage(t *testing.T) {
+	good := szCopyFolder(szTestFile{"good.txt", []byte("intact")})
+	bad := szCopyFolder(szTestFile{"bad.txt", []byte("flipped")})
+	data := fixtureSevenZip([]szTestFolder{good, bad}, nil, false)
+
+	// A flipped byte in one file's data fails only that file
+	damaged := append([]byte{}, data...)
+	damaged[32+len(good.packed)] ^= 0xFF
+	entries, warnings, err := extractSevenZip(damaged)
+	if err != nil || len(entries) != 1 || entries[0].Name != "good.txt" {
+		t.Fatalf("extracted %d entries: %v", len(entries), err)
+	}
+	if len(warnings) != 1 || warnings[0].Code != "archive.checksumMismatch" {
+		t.Errorf("warnings %v", warnings)
+	}
+
+	// An encrypted folder is reported, not decoded
+	aes := szCopyFolder(szTestFile{"secret.txt", []byte("ciphertext")})
+	aes.coders = [][]byte{{0x24, 0x06, 0xf1, 0x07, 0x01, 0}}
+	listing, err := listSevenZip(fixtureSevenZip([]szTestFolder{good, aes}, nil, false))
+	if err != nil || !listing.Entries[1].Encrypted {
+		t.Errorf("encrypted entry listed as %+v: %v", listing.Entries, err)
+	}
+	_, warnings, err = extractSevenZip(fixtureSevenZip([]szTestFolder{good, aes}, nil, false))
+	if err != nil || len(warnings) != 1 || !strings.Contains(warnings[0].Text, "encrypted") {
+		t.Errorf("encrypted entry warned %v: %v", warnings, err)
+	}
+
+	header := append([]byte{}, data...)
+	header[len(header)-2] ^= 0xFF
+	for name, broken := range map[string][]byte{
+		"truncated":  data[:len(data)-5],
+		"bad header": header,
+		"not 7z":     []byte("PK\x03\x04 and then some more bytes to pass 32"),
+	} {
+		if _, err := listSevenZip(broken); err == nil {
+			t.Errorf("%s archive listed", name)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import "bytes"
+
+// Identify common formats from their leading magic bytes; returns
+// "application/octet-stream" when nothing matches
+func sniffMimeType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("%PDF")):
+		return "application/pdf"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, pngSignature):
+		return "image/png"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "image/webp"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "image/tiff"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "image/bmp"
+	case bytes.HasPrefix(data, []byte("8BPS")):
+		return "image/vnd.adobe.photoshop"
+	case bytes.HasPrefix(data, []byte("wOF2")):
+		return "font/woff2"
+	case bytes.HasPrefix(data, []byte("wOFF")):
+		return "font/woff"
+	case bytes.HasPrefix(data, []byte{0, 1, 0, 0}), bytes.HasPrefix(data, []byte("true")):
+		return "font/ttf"
+	case bytes.HasPrefix(data, []byte("OTTO")):
+		return "font/otf"
+	case hasFtypBrand(data, "avif", "avis"):
+		return "image/avif"
+	case hasFtypBrand(data, "heic", "heix", "heim", "heis", "hevc", "hevx"):
+		return "image/heic"
+	case hasFtypBrand(data, "mif1", "msf1"):
+		return "image/heif"
+	case hasFtypBrand(data, "qt  "):
+		return "video/quicktime"
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		return "video/mp4"
+	}
+	return "application/octet-stream"
+}
+
+// Whether an ISO-BMFF file (AVIF, HEIF) lists one of brands as its major
+// or a compatible brand in the leading ftyp box
+func hasFtypBrand(data []byte, brands ...string) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if size < 16 || size > len(data) {
+		return false
+	}
+	for at := 8; at+4 <= size; at += 4 {
+		if at == 12 {
+			continue // minor version
+		}
+		for _, b := range brands {
+			if string(data[at:at+4]) == b {
+				return true
+			}
+		}
+	}
+	return false
+}
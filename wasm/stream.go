@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"pdf-turbo-wasm/internal/js"
+)
+
+const streamCheckpointVersion = 1
+
+// Options for createCompressionStream
+type streamOptions struct {
+	compressOptions
+
+	// Input bytes between checkpoints; 0 disables them. At each checkpoint
+	// the current gzip member, zstd frame or lz4 frame is closed, so brotli
+	// cannot be checkpointed.
+	CheckpointEvery int64 `json:"checkpointEvery"`
+
+	// A checkpoint from an earlier session to continue from
+	Resume *streamCheckpoint `json:"resume"`
+}
+
+// Where a stream can be resumed. Persist it after the output it covers;
+// to resume, truncate the saved output to outputOffset and feed the input
+// again from inputOffset.
+type streamCheckpoint struct {
+	Version      int    `json:"version"`
+	Algorithm    string `json:"algorithm"`
+	Level        int    `json:"level"`
+	WindowSize   int    `json:"windowSize"`
+	InputOffset  int64  `json:"inputOffset"`
+	OutputOffset int64  `json:"outputOffset"`
+	Members      int    `json:"members"`
+}
+
+// Codecs whose members concatenate into one valid stream
+func concatenableCodec(algorithm string) bool {
+	switch algorithm {
+	case codecGzip, codecZstd, codecLZ4, codecStore:
+		return true
+	}
+	return false
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Incremental compressor behind createCompressionStream
+type compressionStream struct {
+	mu    sync.Mutex
+	opts  compressOptions
+	every int64
+
+	out     bytes.Buffer   // compressed bytes not yet handed out
+	w       io.WriteCloser // current member, nil between members
+	members int
+	closed  bool
+
+	admitted bool // the allowlist has passed the first bytes
+
+	inputOffset     int64 // input consumed, including resumed sessions
+	outputOffset    int64 // output handed out, including resumed sessions
+	sinceCheckpoint int64
+}
+
+func newCompressionStream(opts streamOptions) (*compressionStream, error) {
+	if cp := opts.Resume; cp != nil {
+		if cp.Version != streamCheckpointVersion {
+			return nil, fmt.Errorf("unsupported checkpoint version %d", cp.Version)
+		}
+		if cp.InputOffset < 0 || cp.OutputOffset < 0 {
+			return nil, errors.New("invalid checkpoint offsets")
+		}
+		opts.Algorithm, opts.Level, opts.WindowSize = cp.Algorithm, cp.Level, cp.WindowSize
+	}
+	if opts.Algorithm == codecAuto {
+		return nil, errors.New("auto needs the whole input; pick an algorithm for streams")
+	}
+	if opts.BlockSize > 0 {
+		return nil, errors.New("blockSize applies to compressData only")
+	}
+	if opts.EarlyAbort {
+		return nil, errors.New("earlyAbort applies to compressData only")
+	}
+	if err := opts.compressOptions.validate(); err != nil {
+		return nil, err
+	}
+	if (opts.CheckpointEvery > 0 || opts.Resume != nil) && !concatenableCodec(opts.Algorithm) {
+		return nil, fmt.Errorf("%s streams cannot be checkpointed; use gzip, zstd or lz4", opts.Algorithm)
+	}
+
+	s := &compressionStream{opts: opts.compressOptions, every: opts.CheckpointEvery}
+	if cp := opts.Resume; cp != nil {
+		s.inputOffset, s.outputOffset, s.members = cp.InputOffset, cp.OutputOffset, cp.Members
+	}
+	return s, nil
+}
+
+// Start a new member writing into s.out
+func (s *compressionStream) openMember() error {
+	var err error
+	switch s.opts.Algorithm {
+	case codecGzip:
+		level := s.opts.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		s.w, err = gzip.NewWriterLevel(&s.out, level)
+	case codecZstd:
+		s.w, err = zstd.NewWriter(&s.out, zstdEncoderOptions(s.opts.Level, s.opts.WindowSize)...)
+	case codecLZ4:
+		s.w = newLZ4Writer(&s.out)
+	case codecBrotli:
+		level := s.opts.Level
+		if level == 0 {
+			level = 6 // streams favour throughput over the last few percent
+		}
+		s.w = brotli.NewWriterLevel(&s.out, level)
+	default:
+		s.w = nopWriteCloser{&s.out}
+	}
+	return err
+}
+
+func (s *compressionStream) closeMember() error {
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	s.members++
+	return err
+}
+
+func (s *compressionStream) checkpoint() *streamCheckpoint {
+	return &streamCheckpoint{
+		Version:      streamCheckpointVersion,
+		Algorithm:    s.opts.Algorithm,
+		Level:        s.opts.Level,
+		WindowSize:   s.opts.WindowSize,
+		InputOffset:  s.inputOffset,
+		OutputOffset: s.outputOffset + int64(s.out.Len()),
+		Members:      s.members,
+	}
+}
+
+// Hand out the compressed bytes produced so far
+func (s *compressionStream) drain() []byte {
+	data := append([]byte(nil), s.out.Bytes()...)
+	s.outputOffset += int64(len(data))
+	s.out.Reset()
+	return data
+}
+
+// What one write released
+type streamChunk struct {
+	Data         []byte
+	InputOffset  int64
+	OutputOffset int64
+	Checkpoint   *streamCheckpoint // latest passed, if any
+}
+
+// Compress a chunk and release the output produced so far
+func (s *compressionStream) write(p []byte) (streamChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return streamChunk{}, errors.New("stream already finished")
+	}
+	// The allowlist sees a stream's first bytes, as other entry points
+	// see a file's, and a rejected stream takes no more chunks. The
+	// stream counts as one file and holds each chunk while compressing it.
+	if len(p) > 0 {
+		reserve := reserveBytes
+		if !s.admitted {
+			if err := checkInputAllowed(p[:minInt(len(p), sniffPeekBytes)], ""); err != nil {
+				s.closed = true
+				return streamChunk{}, err
+			}
+			reserve = reserveInput
+		}
+		release, err := reserve(len(p))
+		if err != nil {
+			return streamChunk{}, err
+		}
+		defer release()
+		s.admitted = true
+	}
+
+	var cp *streamCheckpoint
+	for len(p) > 0 {
+		if s.w == nil {
+			if err := s.openMember(); err != nil {
+				return streamChunk{}, err
+			}
+		}
+		take := int64(len(p))
+		if s.every > 0 && take > s.every-s.sinceCheckpoint {
+			take = s.every - s.sinceCheckpoint
+		}
+		if _, err := s.w.Write(p[:take]); err != nil {
+			return streamChunk{}, err
+		}
+		p = p[take:]
+		s.inputOffset += take
+		s.sinceCheckpoint += take
+		if s.every > 0 && s.sinceCheckpoint >= s.every {
+			if err := s.closeMember(); err != nil {
+				return streamChunk{}, err
+			}
+			s.sinceCheckpoint = 0
+			cp = s.checkpoint()
+		}
+	}
+	data := s.drain()
+	return streamChunk{Data: data, InputOffset: s.inputOffset, OutputOffset: s.outputOffset, Checkpoint: cp}, nil
+}
+
+// Close the stream and return the remaining output
+func (s *compressionStream) finish() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("stream already finished")
+	}
+	s.closed = true
+	// Empty input still needs one member to be a valid stream
+	if s.w == nil && s.members == 0 {
+		if err := s.openMember(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.closeMember(); err != nil {
+		return nil, err
+	}
+	return s.drain(), nil
+}
+
+// createCompressionStream(options?) starts an incremental compressor for
+// inputs too large to hold in memory. Options: {algorithm, level,
+// windowSize, checkpointEvery, resume}. Resolves with a stream object:
+//
+//	write(chunk)  resolves {data, inputOffset, outputOffset, checkpoint?}
+//	finish()      resolves {data, inputSize, outputSize, members}
+//	abort()       drops the stream
+//
+// data is the compressed output released by that call; append it to the
+// result in order. With checkpointEvery, write resolves with a checkpoint
+// each time that many input bytes have passed; persist it (OPFS,
+// IndexedDB) after the data. After a reload, pass it as resume, truncate
+// the saved output to checkpoint.outputOffset and feed the input again
+// from checkpoint.inputOffset. The output is a multi-member gzip or a
+// multi-frame zstd or lz4 stream that decompressData reads whole.
+func createCompressionStream(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] createCompressionStream called with %d arguments\n", len(args))
+
+	opts := streamOptions{compressOptions: defaultCompressOptions()}
+	var optsErr error
+	if len(args) > 0 {
+		optsErr = decodeOptions(args[0], &opts)
+	}
+
+	return runAsync("createCompressionStream", func() (interface{}, error) {
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		s, err := newCompressionStream(opts)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamObject(s), nil
+	})
+}
+
+// Wrap a stream in a JS object; the methods are released once the stream
+// is finished or aborted
+func newStreamObject(s *compressionStream) js.Value {
+	j := startJob("compressionStream")
+	obj := js.Global().Get("Object").New()
+	var writeFn, finishFn, abortFn js.Func
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			j.finish()
+			writeFn.Release()
+			finishFn.Release()
+			abortFn.Release()
+		})
+	}
+
+	writeFn = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || !isSet(args[0]) {
+			return runAsync("compressionStream.write", func() (interface{}, error) {
+				return nil, errors.New("missing chunk")
+			})
+		}
+		chunk := bytesFromJS(args[0])
+		return runAsync("compressionStream.write", func() (interface{}, error) {
+			if err := checkCancelled(j.ctx); err != nil {
+				return nil, err
+			}
+			c, err := s.write(chunk)
+			if err != nil {
+				return nil, err
+			}
+			result := js.Global().Get("Object").New()
+			result.Set("data", bytesToJS(c.Data))
+			result.Set("inputOffset", c.InputOffset)
+			result.Set("outputOffset", c.OutputOffset)
+			if c.Checkpoint != nil {
+				jsCP, err := jsonToJS(c.Checkpoint)
+				if err != nil {
+					return nil, err
+				}
+				result.Set("checkpoint", jsCP)
+			}
+			return result, nil
+		})
+	})
+	finishFn = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return runAsync("compressionStream.finish", func() (interface{}, error) {
+			defer release()
+			data, err := s.finish()
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("[WASM] Stream finished: %d -> %d bytes, %d members\n", s.inputOffset, s.outputOffset, s.members)
+			result := js.Global().Get("Object").New()
+			result.Set("data", bytesToJS(data))
+			result.Set("inputSize", s.inputOffset)
+			result.Set("outputSize", s.outputOffset)
+			result.Set("members", s.members)
+			return result, nil
+		})
+	})
+	abortFn = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		release()
+		return nil
+	})
+
+	obj.Set("write", writeFn)
+	obj.Set("finish", finishFn)
+	obj.Set("abort", abortFn)
+	return obj
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Feed data through a stream in chunks, returning the output and the
+// checkpoints passed along with the output length at each
+func runStream(t *testing.T, s *compressionStream, data []byte, chunk int) ([]byte, []streamCheckpoint, []int) {
+	t.Helper()
+	var out []byte
+	var checkpoints []streamCheckpoint
+	var saved []int
+	for p := 0; p < len(data); p += chunk {
+		c, err := s.write(data[p:minInt(p+chunk, len(data))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, c.Data...)
+		if c.Checkpoint != nil {
+			checkpoints = append(checkpoints, *c.Checkpoint)
+			saved = append(saved, len(out))
+		}
+	}
+	tail, err := s.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(out, tail...), checkpoints, saved
+}
+
+func TestStreamCheckpoints(t *testing.T) {
+	data := bytes.Repeat([]byte("streamed log line with a counter-free body\n"), 20000)
+	const every = 200000
+	for _, algorithm := range []string{codecGzip, codecZstd, codecLZ4, codecStore} {
+		opts := streamOptions{compressOptions: compressOptions{Algorithm: algorithm}, CheckpointEvery: every}
+		s, err := newCompressionStream(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, checkpoints, saved := runStream(t, s, data, 70000)
+		if len(checkpoints) != len(data)/every {
+			t.Fatalf("%s: %d checkpoints", algorithm, len(checkpoints))
+		}
+		if algorithm != codecStore {
+			res, err := decompressStream(full, decompressOptions{Format: algorithm})
+			if err != nil || !bytes.Equal(res.Data, data) {
+				t.Fatalf("%s: round trip failed: %v", algorithm, err)
+			}
+		} else if !bytes.Equal(full, data) {
+			t.Fatalf("store changed the data")
+		}
+
+		for i, cp := range checkpoints {
+			if cp.InputOffset != int64(i+1)*every || cp.Members != i+1 || cp.OutputOffset > int64(saved[i]) {
+				t.Errorf("%s checkpoint %d: %+v with %d bytes out", algorithm, i, cp, saved[i])
+			}
+		}
+
+		// Resuming from a checkpoint in the middle, after losing the output
+		// written since, gives the same stream as never stopping
+		cp := checkpoints[1]
+		opts.Resume = &cp
+		r, err := newCompressionStream(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, _, _ := runStream(t, r, data[cp.InputOffset:], 70000)
+		resumed := append(append([]byte(nil), full[:cp.OutputOffset]...), rest...)
+		if !bytes.Equal(resumed, full) {
+			t.Errorf("%s: resumed stream differs (%d vs %d bytes)", algorithm, len(resumed), len(full))
+		}
+		if r.members != s.members {
+			t.Errorf("%s: %d members after resuming, %d without", algorithm, r.members, s.members)
+		}
+	}
+}
+
+func TestStreamOptions(t *testing.T) {
+	// Brotli streams work but cannot be checkpointed or resumed
+	data := bytes.Repeat([]byte("brotli stream "), 5000)
+	s, err := newCompressionStream(streamOptions{compressOptions: compressOptions{Algorithm: codecBrotli}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, _ := runStream(t, s, data, 10000)
+	if res, err := decompressStream(out, decompressOptions{Format: codecBrotli}); err != nil || !bytes.Equal(res.Data, data) {
+		t.Errorf("brotli round trip failed: %v", err)
+	}
+
+	cp := streamCheckpoint{Version: streamCheckpointVersion, Algorithm: codecGzip}
+	for name, opts := range map[string]streamOptions{
+		"brotli checkpoints": {compressOptions: compressOptions{Algorithm: codecBrotli}, CheckpointEvery: 5},
+		"auto":               {compressOptions: compressOptions{Algorithm: codecAuto}},
+		"block size":         {compressOptions: compressOptions{Algorithm: codecGzip, BlockSize: 1 << 20}},
+		"future checkpoint":  {Resume: &streamCheckpoint{Version: streamCheckpointVersion + 1, Algorithm: codecGzip}},
+		"negative offset":    {Resume: &streamCheckpoint{Version: streamCheckpointVersion, Algorithm: codecGzip, InputOffset: -1}},
+		"brotli checkpoint":  {Resume: &streamCheckpoint{Version: streamCheckpointVersion, Algorithm: codecBrotli}},
+	} {
+		if _, err := newCompressionStream(opts); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	if _, err := newCompressionStream(streamOptions{Resume: &cp}); err != nil {
+		t.Errorf("valid checkpoint: %v", err)
+	}
+
+	// An empty stream is still one valid member, and a finished stream
+	// takes no more input
+	s, _ = newCompressionStream(streamOptions{compressOptions: compressOptions{Algorithm: codecGzip}})
+	out, _, _ = runStream(t, s, nil, 1)
+	if res, err := decompressStream(out, defaultDecompressOptions()); err != nil || len(res.Data) != 0 || res.Members != 1 {
+		t.Errorf("empty stream: %+v, %v", res, err)
+	}
+	if _, err := s.write([]byte("late")); err == nil {
+		t.Error("write after finish accepted")
+	}
+	if _, err := s.finish(); err == nil {
+		t.Error("second finish accepted")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Stress mode. Runs the PDF and image pipelines on many goroutines at
+// once, each call under its own job with its own progress reporter, as
+// concurrent compressPDF/compressImage calls do, and checks every output
+// against a sequential run of the same input. Cross-talk between calls
+// through shared buffers or options shows up as a mismatched output.
+
+type stressOptions struct {
+	Concurrency int `json:"concurrency"` // calls in flight at once
+	Rounds      int `json:"rounds"`      // times each batch of calls is repeated
+}
+
+func (o stressOptions) validate() error {
+	if o.Concurrency < 1 || o.Concurrency > 64 {
+		return errors.New("stress concurrency must be between 1 and 64")
+	}
+	if o.Rounds < 1 || o.Rounds > 100 {
+		return errors.New("stress rounds must be between 1 and 100")
+	}
+	return nil
+}
+
+// One kind of call exercised by the stress run
+type stressCall struct {
+	name  string
+	input []byte
+	run   func(ctx context.Context, input []byte, progress func(int)) ([]byte, error)
+}
+
+func stressCalls() []stressCall {
+	image := func(mimeType string, opts imageOptions) func(context.Context, []byte, func(int)) ([]byte, error) {
+		return func(ctx context.Context, input []byte, progress func(int)) ([]byte, error) {
+			res, err := compressImageData(ctx, input, mimeType, opts, progress)
+			return res.Data, err
+		}
+	}
+	screenshot := defaultImageOptions()
+	screenshot.Mode = modeScreenshot
+	return []stressCall{
+		{"pdf", fixturePDF(), func(ctx context.Context, input []byte, progress func(int)) ([]byte, error) {
+			res, err := compressPDFData(ctx, input, defaultPDFOptions(), progress)
+			return res.Data, err
+		}},
+		{"jpeg", fixtureJPEG(fixtureGradient(128, 96)), image("image/jpeg", defaultImageOptions())},
+		{"png", fixturePNG(fixtureCutout(96, 64)), image("image/png", defaultImageOptions())},
+		{"screenshot", fixturePNG(fixtureGradient(64, 48)), image("image/png", screenshot)},
+	}
+}
+
+// Run Rounds x Concurrency calls, Concurrency at a time, and compare each
+// with the sequential reference output. Returns the bytes in and out.
+func runStress(opts stressOptions) (int, int, error) {
+	if err := opts.validate(); err != nil {
+		return 0, 0, err
+	}
+	calls := stressCalls()
+	reference := make([][]byte, len(calls))
+	for i, c := range calls {
+		j := startJob("stress")
+		out, err := c.run(j.ctx, append([]byte(nil), c.input...), func(int) {})
+		j.finish()
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s reference run: %v", c.name, err)
+		}
+		reference[i] = out
+	}
+
+	in, out := 0, 0
+	for round := 0; round < opts.Rounds; round++ {
+		errs := make([]error, opts.Concurrency)
+		sizes := make([][2]int, opts.Concurrency)
+		var wg sync.WaitGroup
+		for g := 0; g < opts.Concurrency; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				k := (g + round) % len(calls)
+				c := calls[k]
+				j := startJob("stress")
+				defer j.finish()
+
+				// Progress goes through the same filter as a JS callback
+				reports := 0
+				progress := monotonicProgress(j, func(int) { reports++ })
+				data, err := c.run(j.ctx, append([]byte(nil), c.input...), progress)
+				switch {
+				case err != nil:
+					errs[g] = fmt.Errorf("%s call %d: %v", c.name, g, err)
+				case !bytes.Equal(data, reference[k]):
+					errs[g] = fmt.Errorf("%s call %d: %d-byte output differs from the %d-byte sequential output", c.name, g, len(data), len(reference[k]))
+				case reports == 0:
+					errs[g] = fmt.Errorf("%s call %d: no progress reported", c.name, g)
+				}
+				sizes[g] = [2]int{len(c.input), len(data)}
+			}(g)
+		}
+		wg.Wait()
+		for g, err := range errs {
+			if err != nil {
+				return in, out, err
+			}
+			in += sizes[g][0]
+			out += sizes[g][1]
+		}
+	}
+	return in, out, nil
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConcurrentCalls(t *testing.T) {
+	if _, _, err := runStress(stressOptions{Concurrency: 4, Rounds: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
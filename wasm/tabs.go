@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Coordination between tabs running the module. Every tab that enables it
+// joins a BroadcastChannel and takes part in a small lease protocol over
+// one shared slot for heavy work: batches and ZIP recompression wait for
+// the slot, so two tabs never run them at once. Messages are
+//
+//	{type: "claim", tab, at}   a tab wants the slot
+//	{type: "held", tab, at}    a tab has it; repeated as a heartbeat
+//	{type: "release", tab}     a tab is done
+//
+// A holder that stops sending heartbeats (a closed or crashed tab) loses
+// the slot once its lease runs out.
+
+// Default channel name and lease
+const (
+	defaultTabChannel = "pdf-turbo-wasm"
+	defaultTabLeaseMs = 5000
+)
+
+// How long a claimer listens for objections before taking the slot, and
+// how often a waiting job looks again
+const (
+	tabClaimSettle = 100 * time.Millisecond
+	tabPollDelay   = 100 * time.Millisecond
+)
+
+type tabOptions struct {
+	Channel string   `json:"channel"`
+	LeaseMs int      `json:"leaseMs"`
+	OnEvent js.Value `json:"-"` // called with {type, tab, heldBy}
+}
+
+func (o tabOptions) validate() error {
+	if o.Channel == "" {
+		return errors.New("channel must not be empty")
+	}
+	if o.LeaseMs < 500 {
+		return fmt.Errorf("leaseMs %d is too short, want at least 500", o.LeaseMs)
+	}
+	return nil
+}
+
+// What this tab knows about another tab
+type remoteTab struct {
+	At      int64 // claim time, milliseconds since the epoch
+	Held    bool
+	Expires time.Time
+}
+
+// State of this tab's coordination; nil channel when disabled
+type tabCoordinator struct {
+	mu       sync.Mutex
+	id       string
+	opts     tabOptions
+	channel  js.Value
+	onMsg    js.Func
+	remotes  map[string]remoteTab
+	claimAt  int64 // our pending or held claim, 0 when none
+	holding  bool
+	holders  int // local jobs sharing the held slot
+	stopBeat chan struct{}
+}
+
+var tabs = &tabCoordinator{id: newTabID(), remotes: map[string]remoteTab{}}
+
+func newTabID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (c *tabCoordinator) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channel.Truthy()
+}
+
+// Join a channel, leaving the previous one if any
+func (c *tabCoordinator) enable(opts tabOptions) error {
+	ctor := js.Global().Get("BroadcastChannel")
+	if ctor.IsUndefined() {
+		return errors.New("BroadcastChannel is not available")
+	}
+	c.disable()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opts = opts
+	c.remotes = map[string]remoteTab{}
+	c.channel = ctor.New(opts.Channel)
+	c.onMsg = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			c.receive(args[0].Get("data"))
+		}
+		return nil
+	})
+	c.channel.Set("onmessage", c.onMsg)
+	return nil
+}
+
+// Leave the channel. A held slot is released first so waiting tabs do not
+// sit out the lease.
+func (c *tabCoordinator) disable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.channel.Truthy() {
+		return
+	}
+	if c.holding || c.claimAt != 0 {
+		c.post("release", 0)
+	}
+	c.stopHeartbeat()
+	c.holding, c.holders, c.claimAt = false, 0, 0
+	c.channel.Call("close")
+	c.onMsg.Release()
+	c.channel = js.Undefined()
+}
+
+// Post a message; c.mu must be held
+func (c *tabCoordinator) post(kind string, at int64) {
+	msg := js.Global().Get("Object").New()
+	msg.Set("type", kind)
+	msg.Set("tab", c.id)
+	if at != 0 {
+		msg.Set("at", at)
+	}
+	c.channel.Call("postMessage", msg)
+}
+
+// Tell the host what happened; called without c.mu so onEvent may call
+// back into the module
+func (c *tabCoordinator) notify(kind, heldBy string) {
+	if !isSet(c.opts.OnEvent) {
+		return
+	}
+	event := js.Global().Get("Object").New()
+	event.Set("type", kind)
+	event.Set("tab", c.id)
+	if heldBy != "" {
+		event.Set("heldBy", heldBy)
+	}
+	c.opts.OnEvent.Invoke(event)
+}
+
+func (c *tabCoordinator) receive(data js.Value) {
+	if data.Type() != js.TypeObject || data.Get("tab").Type() != js.TypeString {
+		return
+	}
+	tab := data.Get("tab").String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tab == c.id {
+		return
+	}
+	lease := time.Duration(c.opts.LeaseMs) * time.Millisecond
+	switch data.Get("type").String() {
+	case "claim", "held":
+		at := int64(0)
+		if data.Get("at").Type() == js.TypeNumber {
+			at = int64(data.Get("at").Float())
+		}
+		c.remotes[tab] = remoteTab{At: at, Held: data.Get("type").String() == "held", Expires: time.Now().Add(lease)}
+		// Answer claims at once so the claimer backs off within its
+		// settle time rather than at our next heartbeat
+		if c.holding && data.Get("type").String() == "claim" {
+			c.post("held", c.claimAt)
+		}
+	case "release":
+		delete(c.remotes, tab)
+	}
+}
+
+// The tab that has or wins the slot over our claim, or ""; c.mu must be
+// held. Holders win over claimers; between claimers the earlier claim
+// wins, then the smaller tab ID.
+func (c *tabCoordinator) rival() string {
+	now := time.Now()
+	winner := ""
+	for tab, r := range c.remotes {
+		if now.After(r.Expires) {
+			delete(c.remotes, tab)
+			continue
+		}
+		if r.Held {
+			return tab
+		}
+		if c.claimAt != 0 && (r.At < c.claimAt || r.At == c.claimAt && tab < c.id) {
+			winner = tab
+		}
+	}
+	return winner
+}
+
+// Wait for the shared slot on behalf of a job. Returns a release to call
+// when the heavy work is done; without coordination it returns at once.
+// Jobs of the same tab share the slot.
+func (c *tabCoordinator) acquire(j *job) (func(), error) {
+	if !c.enabled() {
+		return func() {}, nil
+	}
+	waitStart := time.Now()
+	announced := false
+	for {
+		if err := checkCancelled(j.ctx); err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		if !c.channel.Truthy() {
+			c.mu.Unlock()
+			return func() {}, nil
+		}
+		if c.holding {
+			c.holders++
+			c.mu.Unlock()
+			return c.releaser(), nil
+		}
+		if c.claimAt != 0 {
+			// Another job of this tab is claiming; see how that went
+			c.mu.Unlock()
+			time.Sleep(tabPollDelay)
+			continue
+		}
+		if rival := c.rival(); rival != "" {
+			if !announced {
+				fmt.Printf("[WASM] %s job %d waiting for tab %s\n", j.kind, j.id, rival)
+				announced = true
+				c.mu.Unlock()
+				c.notify("waiting", rival)
+			} else {
+				c.mu.Unlock()
+			}
+			time.Sleep(tabPollDelay)
+			continue
+		}
+		c.claimAt = time.Now().UnixMilli()
+		c.post("claim", c.claimAt)
+		c.mu.Unlock()
+
+		time.Sleep(tabClaimSettle)
+
+		c.mu.Lock()
+		if !c.channel.Truthy() {
+			c.mu.Unlock()
+			return func() {}, nil
+		}
+		if c.holding {
+			// Another job of this tab won the slot meanwhile
+			c.holders++
+			c.mu.Unlock()
+			return c.releaser(), nil
+		}
+		if rival := c.rival(); rival != "" {
+			c.post("release", 0)
+			c.claimAt = 0
+			c.mu.Unlock()
+			continue
+		}
+		c.holding, c.holders = true, 1
+		c.post("held", c.claimAt)
+		c.startHeartbeat()
+		fmt.Printf("[WASM] Tab %s holds the heavy work slot (waited %d ms)\n", c.id, time.Since(waitStart).Milliseconds())
+		c.mu.Unlock()
+		c.notify("acquired", "")
+		return c.releaser(), nil
+	}
+}
+
+// A release for one holder; the slot goes once the last one is done
+func (c *tabCoordinator) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			if !c.holding {
+				c.mu.Unlock()
+				return
+			}
+			if c.holders--; c.holders > 0 {
+				c.mu.Unlock()
+				return
+			}
+			c.holding, c.claimAt = false, 0
+			c.stopHeartbeat()
+			c.post("release", 0)
+			c.mu.Unlock()
+			c.notify("released", "")
+		})
+	}
+}
+
+// Repeat "held" three times per lease; c.mu must be held
+func (c *tabCoordinator) startHeartbeat() {
+	stop := make(chan struct{})
+	c.stopBeat = stop
+	interval := time.Duration(c.opts.LeaseMs) * time.Millisecond / 3
+	at := c.claimAt
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.mu.Lock()
+				if c.holding && c.channel.Truthy() {
+					c.post("held", at)
+				}
+				c.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// c.mu must be held
+func (c *tabCoordinator) stopHeartbeat() {
+	if c.stopBeat != nil {
+		close(c.stopBeat)
+		c.stopBeat = nil
+	}
+}
+
+// enableTabCoordination(options?) makes compressBatch and recompressZip
+// wait while another tab on the same channel runs either, so a user with
+// the tool open in several tabs runs one heavy job at a time. Options:
+// channel (default "pdf-turbo-wasm"), leaseMs (default 5000: how long a
+// silent tab keeps the slot) and onEvent, called with {type: "waiting" |
+// "acquired" | "released", tab, heldBy?}. Pass null to leave the channel.
+// Resolves with {tab, channel}, or null when disabled.
+func enableTabCoordination(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] enableTabCoordination called with %d arguments\n", len(args))
+
+	opts := tabOptions{Channel: defaultTabChannel, LeaseMs: defaultTabLeaseMs}
+	disable := len(args) > 0 && args[0].IsNull()
+	var err error
+	if len(args) > 0 && isSet(args[0]) {
+		err = decodeOptions(args[0], &opts)
+		opts.OnEvent = args[0].Get("onEvent")
+	}
+
+	return runAsync("enableTabCoordination", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		if disable {
+			tabs.disable()
+			fmt.Printf("[WASM] Tab coordination disabled\n")
+			return js.Null(), nil
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		if err := tabs.enable(opts); err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Tab %s joined channel %q\n", tabs.id, opts.Channel)
+		return js.ValueOf(map[string]interface{}{"tab": tabs.id, "channel": opts.Channel}), nil
+	})
+}
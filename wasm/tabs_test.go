@@ -0,0 +1,39 @@
+//go:build js
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestTabCoordination(t *testing.T) {
+	c := &tabCoordinator{id: "b", opts: tabOptions{LeaseMs: defaultTabLeaseMs}, remotes: map[string]remoteTab{}}
+	msg := func(kind, tab string, at int64) js.Value {
+		v := js.Global().Get("Object").New()
+		v.Set("type", kind)
+		v.Set("tab", tab)
+		v.Set("at", at)
+		return v
+	}
+	c.claimAt = 100
+	c.receive(msg("claim", "c", 100))
+	if rival := c.rival(); rival != "" {
+		t.Fatalf("tie with a larger tab ID lost to %s", rival)
+	}
+	c.receive(msg("claim", "a", 100))
+	if rival := c.rival(); rival != "a" {
+		t.Fatalf("tie with a smaller tab ID: rival %q", rival)
+	}
+	c.receive(msg("release", "a", 0))
+	c.receive(msg("held", "d", 200))
+	if rival := c.rival(); rival != "d" {
+		t.Fatalf("later holder: rival %q", rival)
+	}
+	c.remotes["d"] = remoteTab{Held: true, Expires: time.Now().Add(-time.Second)}
+	if rival := c.rival(); rival != "" || len(c.remotes) != 1 {
+		t.Fatalf("expired holder: rival %q", rival)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Source encodings recognized by the text pipeline
+const (
+	encodingAuto        = "auto"
+	encodingUTF8        = "utf-8"
+	encodingUTF16LE     = "utf-16le"
+	encodingUTF16BE     = "utf-16be"
+	encodingWindows1252 = "windows-1252"
+)
+
+// Line ending normalization targets
+const (
+	lineEndingsLF   = "lf"
+	lineEndingsCRLF = "crlf"
+	lineEndingsKeep = "keep"
+)
+
+// Output codecs for text
+const (
+	codecGzip   = "gzip"
+	codecBrotli = "brotli"
+)
+
+// Text pipeline options
+type textOptions struct {
+	// Source encoding; "auto" detects it from the BOM and content
+	Encoding string `json:"encoding"`
+
+	// Re-encode the text as UTF-8 (without BOM) before compressing
+	ToUTF8 bool `json:"toUTF8"`
+
+	// "lf", "crlf" or "keep"
+	LineEndings string `json:"lineEndings"`
+
+	// "gzip" or "brotli"
+	Codec string `json:"codec"`
+
+	// Codec level (gzip 0-9, brotli 0-11); 0 picks 9 for either codec,
+	// brotli's 10-11 being several times slower for a few percent
+	Level int `json:"level"`
+}
+
+func defaultTextOptions() textOptions {
+	return textOptions{Encoding: encodingAuto, ToUTF8: true, LineEndings: lineEndingsLF, Codec: codecGzip}
+}
+
+func (o textOptions) validate() error {
+	switch o.Encoding {
+	case encodingAuto, encodingUTF8, encodingUTF16LE, encodingUTF16BE, encodingWindows1252:
+	default:
+		return fmt.Errorf("unknown text encoding %q", o.Encoding)
+	}
+	switch o.LineEndings {
+	case lineEndingsLF, lineEndingsCRLF, lineEndingsKeep:
+	default:
+		return fmt.Errorf("unknown line ending mode %q", o.LineEndings)
+	}
+	switch o.Codec {
+	case codecGzip:
+		if o.Level < 0 || o.Level > 9 {
+			return errors.New("gzip level must be between 0 and 9")
+		}
+	case codecBrotli:
+		if o.Level < 0 || o.Level > 11 {
+			return errors.New("brotli level must be between 0 and 11")
+		}
+	default:
+		return fmt.Errorf("unknown codec %q", o.Codec)
+	}
+	return nil
+}
+
+// Outcome of the text pipeline
+type textResult struct {
+	Data            []byte
+	Encoding        string // detected (or given) source encoding
+	Converted       bool   // the text was re-encoded as UTF-8
+	ContentEncoding string // codec applied to Data
+	Warnings        []message
+}
+
+// MIME types handled by the text pipeline: text/*, the +json and +xml
+// suffixes and a list of exact types. Substrings would also catch Office
+// documents (application/vnd.openxmlformats-...), which are ZIP files.
+func isTextMime(mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = strings.TrimSpace(mimeType[:i])
+	}
+	if strings.HasPrefix(mimeType, "text/") || strings.HasSuffix(mimeType, "+json") || strings.HasSuffix(mimeType, "+xml") {
+		return true
+	}
+	switch mimeType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript",
+		"application/csv", "application/yaml", "application/x-yaml", "application/x-ndjson", "application/x-log":
+		return true
+	}
+	return false
+}
+
+// Detect the encoding from a BOM, UTF-16 zero-byte patterns or UTF-8
+// validity, falling back to Windows-1252. Returns the BOM length.
+func detectTextEncoding(data []byte) (string, int) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return encodingUTF8, 3
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return encodingUTF16LE, 2
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return encodingUTF16BE, 2
+	}
+
+	// ASCII-heavy UTF-16 has a zero in every other byte
+	sample := data[:minInt(len(data), 4096)]
+	if len(sample) >= 4 {
+		evenZeros, oddZeros := 0, 0
+		for i, c := range sample {
+			if c == 0 {
+				if i%2 == 0 {
+					evenZeros++
+				} else {
+					oddZeros++
+				}
+			}
+		}
+		half := len(sample) / 2
+		switch {
+		case oddZeros > half*3/10 && evenZeros <= half/20:
+			return encodingUTF16LE, 0
+		case evenZeros > half*3/10 && oddZeros <= half/20:
+			return encodingUTF16BE, 0
+		}
+	}
+
+	if utf8.Valid(data) {
+		return encodingUTF8, 0
+	}
+	return encodingWindows1252, 0
+}
+
+// Windows-1252 code points for 0x80-0x9F; the rest matches Latin-1
+var windows1252High = [32]rune{
+	0x20AC, 0xFFFD, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0xFFFD, 0x017D, 0xFFFD,
+	0xFFFD, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0xFFFD, 0x017E, 0x0178,
+}
+
+// Re-encode text (BOM already removed) as UTF-8
+func textToUTF8(data []byte, encoding string) ([]byte, []message) {
+	var warnings []message
+	switch encoding {
+	case encodingUTF16LE, encodingUTF16BE:
+		if len(data)%2 == 1 {
+			warnings = append(warnings, newMessage("text.oddTrailingByte"))
+			data = data[:len(data)-1]
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			if encoding == encodingUTF16LE {
+				units[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+			} else {
+				units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+			}
+		}
+		return []byte(string(utf16.Decode(units))), warnings
+	case encodingWindows1252:
+		var buf bytes.Buffer
+		buf.Grow(len(data) + len(data)/8)
+		for _, c := range data {
+			switch {
+			case c < 0x80:
+				buf.WriteByte(c)
+			case c < 0xA0:
+				buf.WriteRune(windows1252High[c-0x80])
+			default:
+				buf.WriteRune(rune(c))
+			}
+		}
+		return buf.Bytes(), warnings
+	}
+	if !utf8.Valid(data) {
+		warnings = append(warnings, newMessage("text.invalidUTF8"))
+		return bytes.ToValidUTF8(data, []byte("\uFFFD")), warnings
+	}
+	return data, warnings
+}
+
+// Convert CRLF and lone CR to LF, then optionally LF to CRLF
+func normalizeLineEndings(data []byte, mode string) []byte {
+	if mode == lineEndingsKeep {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c == '\r' {
+			if i+1 < len(data) && data[i+1] == '\n' {
+				i++
+			}
+			c = '\n'
+		}
+		if c == '\n' && mode == lineEndingsCRLF {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// Compress data with the chosen codec; name is stored in the gzip header
+func compressWithCodec(data []byte, codec string, level int, name string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch codec {
+	case codecGzip:
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		zw.Name = name
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	case codecBrotli:
+		if level == 0 {
+			level = 9 // 10-11 are several times slower for a few percent
+		}
+		bw := brotli.NewWriterLevel(&buf, level)
+		if _, err := bw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := bw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+	return buf.Bytes(), nil
+}
+
+// Detect, normalize and compress a text file
+func compressTextData(data []byte, name string, opts textOptions, reportProgress func(int)) (textResult, error) {
+	if err := opts.validate(); err != nil {
+		return textResult{}, err
+	}
+
+	res := textResult{Encoding: opts.Encoding, ContentEncoding: opts.Codec}
+	bomLen := 0
+	detected, detectedBOM := detectTextEncoding(data)
+	if opts.Encoding == encodingAuto {
+		res.Encoding, bomLen = detected, detectedBOM
+	} else if detected == opts.Encoding {
+		bomLen = detectedBOM
+	}
+	fmt.Printf("[WASM] Text encoding: %s (BOM %d bytes)\n", res.Encoding, bomLen)
+	reportProgress(20)
+
+	text := data
+	if opts.ToUTF8 {
+		var warnings []message
+		text, warnings = textToUTF8(data[bomLen:], res.Encoding)
+		res.Warnings = append(res.Warnings, warnings...)
+		res.Converted = res.Encoding != encodingUTF8 || bomLen > 0
+	}
+
+	// Line endings can only be rewritten byte-wise in ASCII-compatible text
+	utf16Source := res.Encoding == encodingUTF16LE || res.Encoding == encodingUTF16BE
+	if opts.LineEndings != lineEndingsKeep && utf16Source && !opts.ToUTF8 {
+		res.Warnings = append(res.Warnings, newMessage("text.lineEndingsKept"))
+	} else {
+		text = normalizeLineEndings(text, opts.LineEndings)
+	}
+	reportProgress(40)
+
+	out, err := compressWithCodec(text, opts.Codec, opts.Level, name)
+	if err != nil {
+		return res, err
+	}
+	res.Data = out
+	fmt.Printf("[WASM] Text %s: %d -> %d bytes\n", opts.Codec, len(data), len(out))
+	reportProgress(90)
+	return res, nil
+}
+
+// compressText(data, options?, progress?) normalizes a text file
+// (encoding, line endings) and compresses it with gzip or brotli.
+// Resolves with the standard result object plus encoding, converted and
+// contentEncoding.
+func compressText(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] compressText called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("compressText", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "text/plain", args[0].Length())
+	if err != nil {
+		return runAsync("compressText", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := currentSettings().Text
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+
+	return runAsync("compressText", func() (interface{}, error) {
+		j := startJob("text")
+		defer j.finish()
+		defer release()
+		m := newMetrics("text", inputBytes)
+		defer m.send(j.ctx)
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		reportProgress := progressReporter(progressCallback, j)
+
+		res, err := compressTextData(inputBytes, "", opts, reportProgress)
+		if err != nil {
+			m.failed(err)
+			return nil, err
+		}
+		m.succeeded(res.Data, "text-"+res.ContentEncoding, res.Warnings)
+		reportProgress(100)
+
+		result := newResultObject(inputBytes, res.Data)
+		result.Set("encoding", res.Encoding)
+		result.Set("converted", res.Converted)
+		result.Set("contentEncoding", res.ContentEncoding)
+		setMessages(result, res.Warnings)
+		return result, nil
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encode s as UTF-16 with a BOM when bom is set
+func fixtureUTF16(s string, bigEndian, bom bool) []byte {
+	var out []byte
+	if bom {
+		if bigEndian {
+			out = append(out, 0xFE, 0xFF)
+		} else {
+			out = append(out, 0xFF, 0xFE)
+		}
+	}
+	for _, r := range s {
+		if bigEndian {
+			out = append(out, byte(r>>8), byte(r))
+		} else {
+			out = append(out, byte(r), byte(r>>8))
+		}
+	}
+	return out
+}
+
+func decompressText(t *testing.T, data []byte, codec string) []byte {
+	t.Helper()
+	var r io.Reader
+	switch codec {
+	case codecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case codecBrotli:
+		r = brotli.NewReader(bytes.NewReader(data))
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func TestDetectTextEncoding(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		data     []byte
+		encoding string
+		bom      int
+	}{
+		{"UTF-8 BOM", []byte("\xEF\xBB\xBFhello"), encodingUTF8, 3},
+		{"UTF-16LE BOM", fixtureUTF16("hello", false, true), encodingUTF16LE, 2},
+		{"UTF-16BE BOM", fixtureUTF16("hello", true, true), encodingUTF16BE, 2},
+		{"UTF-16LE bare", fixtureUTF16("plain ascii text", false, false), encodingUTF16LE, 0},
+		{"UTF-16BE bare", fixtureUTF16("plain ascii text", true, false), encodingUTF16BE, 0},
+		{"UTF-8", []byte("café au lait"), encodingUTF8, 0},
+		{"Windows-1252", []byte("caf\xe9 \x93quoted\x94"), encodingWindows1252, 0},
+		{"empty", nil, encodingUTF8, 0},
+	} {
+		encoding, bom := detectTextEncoding(c.data)
+		if encoding != c.encoding || bom != c.bom {
+			t.Errorf("%s: %s with %d-byte BOM, want %s with %d", c.name, encoding, bom, c.encoding, c.bom)
+		}
+	}
+}
+
+func TestTextToUTF8(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		data     []byte
+		encoding string
+		want     string
+		warning  string
+	}{
+		{"UTF-16LE", fixtureUTF16("héllo €", false, false), encodingUTF16LE, "héllo €", ""},
+		{"UTF-16BE", fixtureUTF16("héllo €", true, false), encodingUTF16BE, "héllo €", ""},
+		{"UTF-16 odd length", append(fixtureUTF16("ab", false, false), 'c'), encodingUTF16LE, "ab", "text.oddTrailingByte"},
+		{"Windows-1252", []byte("caf\xe9 \x80 \x93q\x94"), encodingWindows1252, "café € “q”", ""},
+		{"Windows-1252 undefined", []byte("\x81"), encodingWindows1252, "�", ""},
+		{"invalid UTF-8", []byte("ok\xff"), encodingUTF8, "ok�", "text.invalidUTF8"},
+	} {
+		out, warnings := textToUTF8(c.data, c.encoding)
+		if string(out) != c.want {
+			t.Errorf("%s: %q, want %q", c.name, out, c.want)
+		}
+		if c.warning == "" && len(warnings) > 0 || c.warning != "" && (len(warnings) != 1 || warnings[0].Code != c.warning) {
+			t.Errorf("%s: warnings %+v, want %q", c.name, warnings, c.warning)
+		}
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	in := []byte("a\r\nb\rc\nd\r\n\r\n")
+	for mode, want := range map[string]string{
+		lineEndingsLF:   "a\nb\nc\nd\n\n",
+		lineEndingsCRLF: "a\r\nb\r\nc\r\nd\r\n\r\n",
+		lineEndingsKeep: string(in),
+	} {
+		if out := normalizeLineEndings(in, mode); string(out) != want {
+			t.Errorf("%s: %q, want %q", mode, out, want)
+		}
+	}
+}
+
+func TestCompressTextData(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		data      []byte
+		opts      func(*textOptions)
+		want      string
+		encoding  string
+		converted bool
+		warning   string
+	}{
+		{"CSV", []byte("a,b\r\nc,d\r\n"), nil, "a,b\nc,d\n", encodingUTF8, false, ""},
+		{"UTF-16 with BOM", fixtureUTF16("héllo\r\nworld\r\n", false, true), nil, "héllo\nworld\n", encodingUTF16LE, true, ""},
+		{"Windows-1252", []byte("caf\xe9\r\n"), nil, "café\n", encodingWindows1252, true, ""},
+		{"UTF-8 BOM dropped", []byte("\xEF\xBB\xBFx\n"), nil, "x\n", encodingUTF8, true, ""},
+		{"CRLF", []byte("a\nb\n"), func(o *textOptions) { o.LineEndings = lineEndingsCRLF }, "a\r\nb\r\n", encodingUTF8, false, ""},
+		{"kept as UTF-16", fixtureUTF16("a\r\n", false, true), func(o *textOptions) { o.ToUTF8 = false },
+			string(fixtureUTF16("a\r\n", false, true)), encodingUTF16LE, false, "text.lineEndingsKept"},
+		{"forced encoding", []byte("caf\xe9"), func(o *textOptions) { o.Encoding = encodingWindows1252 }, "café", encodingWindows1252, true, ""},
+	} {
+		for _, codec := range []string{codecGzip, codecBrotli} {
+			opts := defaultTextOptions()
+			opts.Codec = codec
+			if c.opts != nil {
+				c.opts(&opts)
+			}
+			res, err := compressTextData(c.data, "data.txt", opts, func(int) {})
+			if err != nil {
+				t.Fatalf("%s/%s: %v", c.name, codec, err)
+			}
+			if plain := decompressText(t, res.Data, codec); string(plain) != c.want {
+				t.Errorf("%s/%s: %q, want %q", c.name, codec, plain, c.want)
+			}
+			if res.Encoding != c.encoding || res.Converted != c.converted || res.ContentEncoding != codec {
+				t.Errorf("%s/%s: encoding %s, converted %v, content encoding %s", c.name, codec, res.Encoding, res.Converted, res.ContentEncoding)
+			}
+			if c.warning != "" && (len(res.Warnings) != 1 || res.Warnings[0].Code != c.warning) {
+				t.Errorf("%s/%s: warnings %+v, want %s", c.name, codec, res.Warnings, c.warning)
+			}
+		}
+	}
+
+	// The gzip header carries the file name
+	res, _ := compressTextData([]byte("x"), "notes.txt", defaultTextOptions(), func(int) {})
+	if zr, err := gzip.NewReader(bytes.NewReader(res.Data)); err != nil || zr.Name != "notes.txt" {
+		t.Errorf("gzip header name %q: %v", zr.Name, err)
+	}
+}
+
+func TestTextOptionsValidate(t *testing.T) {
+	for _, c := range []struct {
+		opts func(*textOptions)
+		ok   bool
+	}{
+		{func(o *textOptions) {}, true},
+		{func(o *textOptions) { o.Level = 0 }, true},
+		{func(o *textOptions) { o.Level = 9 }, true},
+		{func(o *textOptions) { o.Level = 10 }, false},
+		{func(o *textOptions) { o.Level = -1 }, false},
+		{func(o *textOptions) { o.Codec, o.Level = codecBrotli, 11 }, true},
+		{func(o *textOptions) { o.Codec, o.Level = codecBrotli, 12 }, false},
+		{func(o *textOptions) { o.Codec = "zstd" }, false},
+		{func(o *textOptions) { o.Encoding = "latin-9" }, false},
+		{func(o *textOptions) { o.LineEndings = "cr" }, false},
+	} {
+		opts := defaultTextOptions()
+		c.opts(&opts)
+		if err := opts.validate(); (err == nil) != c.ok {
+			t.Errorf("%+v: %v", opts, err)
+		}
+	}
+	opts := defaultTextOptions()
+	opts.Level = 10
+	if err := opts.validate(); err == nil || err.Error() != "gzip level must be between 0 and 9" {
+		t.Errorf("gzip level 10: %v", err)
+	}
+}
+
+func TestIsTextMime(t *testing.T) {
+	for mime, want := range map[string]bool{
+		"text/plain": true, "TEXT/CSV": true, "application/json": true, "application/xml": true,
+		"application/javascript": true, "application/x-ndjson": true, "image/svg+xml": true,
+		"application/ld+json": true, "text/plain; charset=utf-8": true,
+		"image/png": false, "application/pdf": false, "": false, "application/zip": false,
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   false,
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         false,
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation": false,
+		"application/vnd.ms-excel.sheet.macroEnabled.12":                            false,
+	} {
+		if isTextMime(mime) != want {
+			t.Errorf("%q: %v", mime, !want)
+		}
+	}
+}
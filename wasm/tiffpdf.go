@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"golang.org/x/image/tiff"
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Per-page encodings for tiffToPDF
+const (
+	tiffCompressionAuto  = "auto"  // CCITT G4 for bilevel pages, JPEG otherwise
+	tiffCompressionCCITT = "ccitt" // threshold every page to bilevel
+	tiffCompressionJPEG  = "jpeg"  // JPEG every page
+)
+
+// Options for tiffToPDF
+type tiffToPDFOptions struct {
+	Compression string `json:"compression"`
+	Quality     int    `json:"quality"`   // JPEG quality
+	Threshold   int    `json:"threshold"` // gray level below which forced-CCITT pixels are black
+}
+
+func defaultTIFFToPDFOptions() tiffToPDFOptions {
+	return tiffToPDFOptions{Compression: tiffCompressionAuto, Quality: 75, Threshold: 128}
+}
+
+// One image file directory of a multi-page TIFF
+type tiffPage struct {
+	IFDOffset  uint32
+	XDPI, YDPI float64
+}
+
+// Upper bound on pages, guarding against IFD chains that loop
+const maxTIFFPages = 10000
+
+// Walk the IFD chain, collecting each page's offset and resolution
+func readTIFFPages(data []byte) ([]tiffPage, error) {
+	if len(data) < 8 {
+		return nil, errors.New("TIFF header truncated")
+	}
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	case "II+\x00", "MM\x00+":
+		return nil, errors.New("BigTIFF is not supported")
+	default:
+		return nil, errors.New("not a TIFF file")
+	}
+
+	rational := func(off uint32) float64 {
+		if int(off)+8 > len(data) {
+			return 0
+		}
+		num, den := order.Uint32(data[off:]), order.Uint32(data[off+4:])
+		if den == 0 {
+			return 0
+		}
+		return float64(num) / float64(den)
+	}
+
+	var pages []tiffPage
+	seen := map[uint32]bool{}
+	offset := order.Uint32(data[4:8])
+	for offset != 0 && !seen[offset] && len(pages) < maxTIFFPages {
+		seen[offset] = true
+		if int(offset)+2 > len(data) {
+			return pages, fmt.Errorf("IFD offset %d out of range", offset)
+		}
+		count := int(order.Uint16(data[offset:]))
+		end := int(offset) + 2 + count*12
+		if end+4 > len(data) {
+			return pages, fmt.Errorf("IFD at %d truncated", offset)
+		}
+
+		page := tiffPage{IFDOffset: offset}
+		unit := 2 // inches
+		for i := 0; i < count; i++ {
+			entry := data[int(offset)+2+i*12:]
+			tag, value := order.Uint16(entry), order.Uint32(entry[8:])
+			switch tag {
+			case 282:
+				page.XDPI = rational(value)
+			case 283:
+				page.YDPI = rational(value)
+			case 296:
+				unit = int(order.Uint16(entry[8:]))
+			}
+		}
+		if unit == 3 { // centimeters
+			page.XDPI *= 2.54
+			page.YDPI *= 2.54
+		}
+		if page.XDPI <= 0 || unit == 1 {
+			page.XDPI = 72
+		}
+		if page.YDPI <= 0 || unit == 1 {
+			page.YDPI = page.XDPI
+		}
+
+		pages = append(pages, page)
+		offset = order.Uint32(data[end:])
+	}
+	return pages, nil
+}
+
+// io.ReaderAt over a TIFF file whose header points at a different IFD,
+// so the single-page decoder in x/image/tiff can read any page
+type tiffHeaderOverlay struct {
+	data   []byte
+	header [8]byte
+}
+
+func (o *tiffHeaderOverlay) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(o.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, o.data[off:])
+	for i := int64(0); i < int64(n) && off+i < 8; i++ {
+		p[i] = o.header[off+i]
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Decode one page of a multi-page TIFF
+func decodeTIFFPage(data []byte, page tiffPage) (image.Image, error) {
+	o := &tiffHeaderOverlay{data: data}
+	copy(o.header[:], data[:8])
+	if o.header[0] == 'I' {
+		binary.LittleEndian.PutUint32(o.header[4:], page.IFDOffset)
+	} else {
+		binary.BigEndian.PutUint32(o.header[4:], page.IFDOffset)
+	}
+	return tiff.Decode(io.NewSectionReader(o, 0, int64(len(data))))
+}
+
+// Encode one decoded page as a PDF image XObject
+func tiffPageToPDFImage(img image.Image, page tiffPage, opts tiffToPDFOptions) (pdfImagePage, error) {
+	b := img.Bounds()
+	p := pdfImagePage{
+		Width:      b.Dx(),
+		Height:     b.Dy(),
+		PageWidth:  float64(b.Dx()) * 72 / page.XDPI,
+		PageHeight: float64(b.Dy()) * 72 / page.YDPI,
+	}
+
+	if opts.Compression == tiffCompressionCCITT || (opts.Compression == tiffCompressionAuto && isBilevel(img)) {
+		p.Data = encodeCCITTG4(toBilevel(img, uint8(opts.Threshold)))
+		p.Filter = "CCITTFaxDecode"
+		p.DecodeParms = fmt.Sprintf("<< /K -1 /Columns %d /Rows %d >>", p.Width, p.Height)
+		p.ColorSpace = "DeviceGray"
+		p.BitsPerComponent = 1
+		return p, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: opts.Quality}); err != nil {
+		return p, err
+	}
+	p.Data = buf.Bytes()
+	p.Filter = "DCTDecode"
+	p.ColorSpace = "DeviceRGB"
+	if _, gray := img.(*image.Gray); gray {
+		p.ColorSpace = "DeviceGray"
+	}
+	p.BitsPerComponent = 8
+	return p, nil
+}
+
+// Convert every page of a TIFF into a one-image-per-page PDF
+func convertTIFFToPDF(ctx context.Context, data []byte, opts tiffToPDFOptions, reportProgress func(int)) ([]byte, int, error) {
+	switch opts.Compression {
+	case tiffCompressionAuto, tiffCompressionCCITT, tiffCompressionJPEG:
+	default:
+		return nil, 0, fmt.Errorf("unknown compression %q", opts.Compression)
+	}
+	if opts.Quality < 1 || opts.Quality > 100 {
+		return nil, 0, errors.New("quality must be between 1 and 100")
+	}
+
+	pages, err := readTIFFPages(data)
+	if err != nil && len(pages) == 0 {
+		return nil, 0, err
+	}
+	if err != nil {
+		fmt.Printf("[WASM] TIFF IFD chain damaged after %d pages: %v\n", len(pages), err)
+	}
+	if len(pages) == 0 {
+		return nil, 0, errors.New("TIFF has no pages")
+	}
+
+	pdfPages := make([]pdfImagePage, 0, len(pages))
+	for i, page := range pages {
+		if err := checkCancelled(ctx); err != nil {
+			return nil, 0, err
+		}
+		img, err := decodeTIFFPage(data, page)
+		if err != nil {
+			return nil, 0, fmt.Errorf("page %d: %v", i+1, err)
+		}
+		p, err := tiffPageToPDFImage(img, page, opts)
+		if err != nil {
+			return nil, 0, fmt.Errorf("page %d: %v", i+1, err)
+		}
+		fmt.Printf("[WASM] TIFF page %d: %dx%d %s, %d bytes\n", i+1, p.Width, p.Height, p.Filter, len(p.Data))
+		pdfPages = append(pdfPages, p)
+		reportProgress(10 + (i+1)*80/len(pages))
+	}
+
+	return imagePagesToPDF(pdfPages), len(pdfPages), nil
+}
+
+// tiffToPDF(data, options?, progress?) converts a (multi-page) TIFF scan
+// into a PDF with one page per TIFF page. Options: {compression: "auto" |
+// "ccitt" | "jpeg", quality, threshold}. Resolves with the standard result
+// object plus pageCount.
+func tiffToPDF(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] tiffToPDF called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("tiffToPDF", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("tiffToPDF", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := defaultTIFFToPDFOptions()
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+
+	return runAsync("tiffToPDF", func() (interface{}, error) {
+		j := startJob("tiffToPDF")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		reportProgress := progressReporter(progressCallback, j)
+
+		out, pageCount, err := convertTIFFToPDF(j.ctx, inputBytes, opts, reportProgress)
+		if err != nil {
+			return nil, err
+		}
+		reportProgress(100)
+
+		result := newResultObject(inputBytes, out)
+		result.Set("type", "application/pdf")
+		result.Set("pageCount", pageCount)
+		return result, nil
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// Two-page little-endian TIFF at 300 dpi, uncompressed: a 200x100 1-bit
+// checkerboard of 10-pixel squares (WhiteIsZero, so a set bit is black)
+// and a 200x100 8-bit gray ramp
+func fixtureTIFF() []byte {
+	const w, h = 200, 100
+	le := binary.LittleEndian
+	checker := make([]byte, (w+7)/8*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/10+y/10)%2 == 0 {
+				checker[y*((w+7)/8)+x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	ramp := make([]byte, w*h)
+	for i := range ramp {
+		ramp[i] = byte(i % 251)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("II*\x00\x00\x00\x00\x00") // first IFD offset patched below
+	checkerAt := buf.Len()
+	buf.Write(checker)
+	rampAt := buf.Len()
+	buf.Write(ramp)
+	resolutionAt := buf.Len()
+	binary.Write(&buf, le, [2]uint32{300, 1})
+
+	ifd := func(bits, photometric, strip, stripLen int) int {
+		at := buf.Len()
+		entries := [][4]uint32{
+			{256, 3, 1, w}, {257, 3, 1, h}, {258, 3, 1, uint32(bits)}, {259, 3, 1, 1},
+			{262, 3, 1, uint32(photometric)}, {273, 4, 1, uint32(strip)}, {277, 3, 1, 1},
+			{278, 3, 1, h}, {279, 4, 1, uint32(stripLen)}, {282, 5, 1, uint32(resolutionAt)},
+			{283, 5, 1, uint32(resolutionAt)}, {296, 3, 1, 2},
+		}
+		binary.Write(&buf, le, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&buf, le, [2]uint16{uint16(e[0]), uint16(e[1])})
+			binary.Write(&buf, le, [2]uint32{e[2], e[3]})
+		}
+		binary.Write(&buf, le, uint32(0))
+		return at
+	}
+	first := ifd(1, 0, checkerAt, len(checker))
+	second := ifd(8, 1, rampAt, len(ramp))
+	out := buf.Bytes()
+	le.PutUint32(out[4:], uint32(first))
+	le.PutUint32(out[second-4:], uint32(second)) // first IFD's next pointer
+	return out
+}
+
+func TestReadTIFFPages(t *testing.T) {
+	data := fixtureTIFF()
+	pages, err := readTIFFPages(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 || pages[0].XDPI != 300 || pages[1].YDPI != 300 {
+		t.Fatalf("pages %+v", pages)
+	}
+
+	// An IFD chain that loops back stops at the first repeat; one that
+	// points past the end keeps the pages before it and reports the damage
+	looped := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(looped[len(looped)-4:], pages[0].IFDOffset)
+	if pages, err := readTIFFPages(looped); err != nil || len(pages) != 2 {
+		t.Errorf("looped chain gave %d pages and %v", len(pages), err)
+	}
+	binary.LittleEndian.PutUint32(looped[len(looped)-4:], uint32(len(looped)))
+	if pages, err := readTIFFPages(looped); err == nil || len(pages) != 2 {
+		t.Errorf("chain out of range gave %d pages and %v", len(pages), err)
+	}
+	for _, bad := range [][]byte{data[:6], []byte("II+\x00\x08\x00\x00\x00"), []byte("GIF89a\x00\x00")} {
+		if _, err := readTIFFPages(bad); err == nil {
+			t.Errorf("%q read as a TIFF", bad)
+		}
+	}
+}
+
+func TestTIFFToPDF(t *testing.T) {
+	for _, tc := range []struct {
+		compression string
+		filters     []string
+	}{
+		{tiffCompressionAuto, []string{"CCITTFaxDecode", "DCTDecode"}},
+		{tiffCompressionCCITT, []string{"CCITTFaxDecode", "CCITTFaxDecode"}},
+		{tiffCompressionJPEG, []string{"DCTDecode", "DCTDecode"}},
+	} {
+		opts := defaultTIFFToPDFOptions()
+		opts.Compression = tc.compression
+		out, pageCount, err := convertTIFFToPDF(context.Background(), fixtureTIFF(), opts, func(int) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := ParsePDF(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validatePDF(doc, 2, 0); err != nil || pageCount != 2 {
+			t.Fatalf("%s: %d pages: %v", tc.compression, pageCount, err)
+		}
+		for i, num := range doc.pages() {
+			page := doc.Objects[num].Dict()
+			// 200x100 pixels at 300 dpi
+			box := mustGet(t, page, "MediaBox")
+			if w, _ := box.Arr[2].Float(); w != 48 {
+				t.Errorf("%s page %d is %vpt wide, want 48", tc.compression, i+1, w)
+			}
+			if h, _ := box.Arr[3].Float(); h != 24 {
+				t.Errorf("%s page %d is %vpt high, want 24", tc.compression, i+1, h)
+			}
+			resources := doc.resolveDict(mustGet(t, page, "Resources"))
+			xobjects := doc.resolveDict(mustGet(t, resources, "XObject"))
+			image := doc.Objects[mustGet(t, xobjects, xobjects.Keys[0]).Ref.Num]
+			if filter := image.Dict().Name("Filter"); filter != tc.filters[i] {
+				t.Errorf("%s page %d stored with %s, want %s", tc.compression, i+1, filter, tc.filters[i])
+			}
+			if tc.compression == tiffCompressionAuto && i == 0 {
+				black := decodeG4(t, image.Stream, 200, 100)
+				for _, p := range [][2]int{{5, 5}, {15, 5}, {15, 15}, {195, 95}} {
+					if want := (p[0]/10+p[1]/10)%2 == 0; black[p[1]*200+p[0]] != want {
+						t.Errorf("checkerboard pixel %v black=%v", p, !want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTIFFToPDFRejectsBadOptions(t *testing.T) {
+	opts := defaultTIFFToPDFOptions()
+	opts.Compression = "lzw"
+	if _, _, err := convertTIFFToPDF(context.Background(), fixtureTIFF(), opts, func(int) {}); err == nil {
+		t.Error("unknown compression accepted")
+	}
+	opts = defaultTIFFToPDFOptions()
+	opts.Quality = 0
+	if _, _, err := convertTIFFToPDF(context.Background(), fixtureTIFF(), opts, func(int) {}); err == nil {
+		t.Error("quality 0 accepted")
+	}
+}
+
+func mustGet(t *testing.T, dict *pdfDict, key string) pdfValue {
+	t.Helper()
+	v, ok := dict.Get(key)
+	if !ok {
+		t.Fatalf("no /%s in %v", key, dict.Keys)
+	}
+	return v
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"sort"
+)
+
+// TIFF page encodings for pdfToTIFF
+const (
+	tiffWriteCCITT   = "ccitt"   // bilevel, Group 4 (fax and records systems)
+	tiffWriteDeflate = "deflate" // lossless gray or RGB
+	tiffWriteNone    = "none"    // uncompressed gray or RGB
+)
+
+// One IFD entry; values longer than four bytes are stored out of line
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte // little-endian value bytes
+}
+
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+func tiffShortEntry(tag uint16, vals ...uint16) tiffEntry {
+	data := make([]byte, 2*len(vals))
+	for i, v := range vals {
+		binary.LittleEndian.PutUint16(data[2*i:], v)
+	}
+	return tiffEntry{tag, tiffShort, uint32(len(vals)), data}
+}
+
+func tiffLongEntry(tag uint16, v uint32) tiffEntry {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, v)
+	return tiffEntry{tag, tiffLong, 1, data}
+}
+
+func tiffRationalEntry(tag uint16, num, den uint32) tiffEntry {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data, num)
+	binary.LittleEndian.PutUint32(data[4:], den)
+	return tiffEntry{tag, tiffRational, 1, data}
+}
+
+// Whether every pixel has equal RGB channels
+func isGrayNRGBA(img *image.NRGBA) bool {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		if img.Pix[i] != img.Pix[i+1] || img.Pix[i] != img.Pix[i+2] {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode a page's strip and the tags describing it
+func encodeTIFFPage(img *image.NRGBA, compression string, threshold uint8) ([]byte, []tiffEntry, error) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	entries := []tiffEntry{
+		tiffLongEntry(256, uint32(w)),
+		tiffLongEntry(257, uint32(h)),
+		tiffLongEntry(278, uint32(h)), // RowsPerStrip: one strip
+	}
+
+	if compression == tiffWriteCCITT {
+		entries = append(entries,
+			tiffShortEntry(258, 1),
+			tiffShortEntry(259, 4), // CCITT T.6
+			tiffShortEntry(262, 0), // WhiteIsZero, as fax readers expect
+			tiffShortEntry(277, 1),
+			tiffLongEntry(293, 0), // T6Options
+		)
+		return encodeCCITTG4(toBilevel(img, threshold)), entries, nil
+	}
+
+	var raw []byte
+	if isGrayNRGBA(img) {
+		raw = make([]byte, 0, w*h)
+		for i := 0; i < len(img.Pix); i += 4 {
+			raw = append(raw, img.Pix[i])
+		}
+		entries = append(entries,
+			tiffShortEntry(258, 8),
+			tiffShortEntry(262, 1), // BlackIsZero
+			tiffShortEntry(277, 1),
+		)
+	} else {
+		raw = make([]byte, 0, w*h*3)
+		for i := 0; i < len(img.Pix); i += 4 {
+			raw = append(raw, img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		}
+		entries = append(entries,
+			tiffShortEntry(258, 8, 8, 8),
+			tiffShortEntry(262, 2), // RGB
+			tiffShortEntry(277, 3),
+			tiffShortEntry(284, 1), // PlanarConfiguration: chunky
+		)
+	}
+
+	switch compression {
+	case tiffWriteNone:
+		entries = append(entries, tiffShortEntry(259, 1))
+		return raw, entries, nil
+	case tiffWriteDeflate:
+		var buf bytes.Buffer
+		zw, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+		zw.Write(raw)
+		zw.Close()
+		entries = append(entries, tiffShortEntry(259, 8)) // Adobe Deflate
+		return buf.Bytes(), entries, nil
+	}
+	return nil, nil, fmt.Errorf("unknown TIFF compression %q", compression)
+}
+
+// A little-endian multi-page TIFF built one page at a time, one strip per
+// page, so a caller can release each page as soon as it is added
+type tiffWriter struct {
+	buf         bytes.Buffer
+	nextPtr     int // where the offset of the next IFD is patched in
+	compression string
+	threshold   uint8
+	dpi         int
+}
+
+func newTIFFWriter(compression string, threshold uint8, dpi int) *tiffWriter {
+	w := &tiffWriter{nextPtr: 4, compression: compression, threshold: threshold, dpi: dpi}
+	w.buf.WriteString("II*\x00\x00\x00\x00\x00")
+	return w
+}
+
+func (w *tiffWriter) pad() {
+	if w.buf.Len()%2 == 1 {
+		w.buf.WriteByte(0)
+	}
+}
+
+// Encode img and append it as the next page
+func (w *tiffWriter) addPage(img *image.NRGBA) error {
+	strip, entries, err := encodeTIFFPage(img, w.compression, w.threshold)
+	if err != nil {
+		return err
+	}
+	buf := &w.buf
+	stripOffset := buf.Len()
+	buf.Write(strip)
+	w.pad()
+
+	entries = append(entries,
+		tiffLongEntry(273, uint32(stripOffset)),
+		tiffLongEntry(279, uint32(len(strip))),
+		tiffRationalEntry(282, uint32(w.dpi), 1),
+		tiffRationalEntry(283, uint32(w.dpi), 1),
+		tiffShortEntry(296, 2), // inches
+	)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	// Out-of-line values go before the IFD
+	valueOffsets := make([]int, len(entries))
+	for i, e := range entries {
+		if len(e.data) > 4 {
+			valueOffsets[i] = buf.Len()
+			buf.Write(e.data)
+			w.pad()
+		}
+	}
+
+	ifdOffset := buf.Len()
+	binary.LittleEndian.PutUint32(buf.Bytes()[w.nextPtr:], uint32(ifdOffset))
+	binary.Write(buf, binary.LittleEndian, uint16(len(entries)))
+	for i, e := range entries {
+		var entry [12]byte
+		binary.LittleEndian.PutUint16(entry[0:], e.tag)
+		binary.LittleEndian.PutUint16(entry[2:], e.typ)
+		binary.LittleEndian.PutUint32(entry[4:], e.count)
+		if len(e.data) > 4 {
+			binary.LittleEndian.PutUint32(entry[8:], uint32(valueOffsets[i]))
+		} else {
+			copy(entry[8:], e.data)
+		}
+		buf.Write(entry[:])
+	}
+	w.nextPtr = buf.Len()
+	buf.Write([]byte{0, 0, 0, 0})
+	return nil
+}
+
+// The finished file; no pages may be added afterwards
+func (w *tiffWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Structured trace of pipeline decisions for bug reports. While enabled,
+// passes record what they looked at and what they chose (offsets
+// resynchronized on, objects rewritten, candidates encoded, levels tried)
+// with timings; exportTrace hands the lot back as one JSON file. Disabled,
+// a trace call costs one mutex check.
+
+// Default and largest number of events kept; older ones are dropped first
+const (
+	defaultTraceEvents = 10000
+	maxTraceEvents     = 200000
+)
+
+// One recorded decision
+type traceEvent struct {
+	T     float64                `json:"t"` // ms since enableTrace
+	Job   int64                  `json:"job,omitempty"`
+	Pass  string                 `json:"pass"`
+	Event string                 `json:"event"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+var tracer struct {
+	mu      sync.Mutex
+	on      bool
+	started time.Time
+	max     int
+	events  []traceEvent
+	dropped int
+}
+
+// Record an event; kv are key/value pairs as for newMessage. ctx, when
+// given, attributes the event to its job.
+func trace(ctx context.Context, pass, event string, kv ...interface{}) {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if !tracer.on {
+		return
+	}
+	e := traceEvent{
+		T:     float64(time.Since(tracer.started).Microseconds()) / 1000,
+		Pass:  pass,
+		Event: event,
+	}
+	if ctx != nil {
+		if j, ok := ctx.Value(jobKey{}).(*job); ok {
+			e.Job = j.id
+		}
+	}
+	if len(kv) > 0 {
+		e.Data = make(map[string]interface{}, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			value := kv[i+1]
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			e.Data[fmt.Sprint(kv[i])] = value
+		}
+	}
+	if len(tracer.events) >= tracer.max {
+		tracer.events = tracer.events[1:]
+		tracer.dropped++
+	}
+	tracer.events = append(tracer.events, e)
+}
+
+// Milliseconds since start, for trace timings
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+type traceOptions struct {
+	MaxEvents int `json:"maxEvents"`
+}
+
+func (o traceOptions) validate() error {
+	if o.MaxEvents < 1 || o.MaxEvents > maxTraceEvents {
+		return fmt.Errorf("maxEvents must be between 1 and %d", maxTraceEvents)
+	}
+	return nil
+}
+
+// The trace file: build identity, then the events in order
+type traceFile struct {
+	Build   versionInfo  `json:"build"`
+	Started string       `json:"started"`
+	Events  []traceEvent `json:"events"`
+	Dropped int          `json:"dropped"`
+}
+
+// enableTrace(options?) starts recording a fresh trace of at most
+// maxEvents (default 10000) events, dropping the oldest beyond that.
+// Calling it again restarts the trace.
+func enableTrace(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] enableTrace called with %d arguments\n", len(args))
+
+	opts := traceOptions{MaxEvents: defaultTraceEvents}
+	var err error
+	if len(args) > 0 {
+		err = decodeOptions(args[0], &opts)
+	}
+
+	return runAsync("enableTrace", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		tracer.mu.Lock()
+		defer tracer.mu.Unlock()
+		tracer.on, tracer.started, tracer.max = true, time.Now(), opts.MaxEvents
+		tracer.events, tracer.dropped = nil, 0
+		return true, nil
+	})
+}
+
+// exportTrace(options?) returns the trace so far as {data, type, name,
+// events, dropped}: data is a JSON file (type application/json) to
+// offer as a download under name. Options: stop, to also end recording.
+func exportTrace(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] exportTrace called with %d arguments\n", len(args))
+
+	var opts struct {
+		Stop bool `json:"stop"`
+	}
+	var err error
+	if len(args) > 0 {
+		err = decodeOptions(args[0], &opts)
+	}
+
+	return runAsync("exportTrace", func() (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		tracer.mu.Lock()
+		if tracer.started.IsZero() {
+			tracer.mu.Unlock()
+			return nil, errors.New("no trace recorded; call enableTrace first")
+		}
+		file := traceFile{
+			Started: tracer.started.UTC().Format(time.RFC3339Nano),
+			Events:  append([]traceEvent{}, tracer.events...),
+			Dropped: tracer.dropped,
+		}
+		started := tracer.started
+		if opts.Stop {
+			tracer.on = false
+		}
+		tracer.mu.Unlock()
+
+		file.Build = currentVersionInfo()
+		data, err := json.MarshalIndent(file, "", " ")
+		if err != nil {
+			return nil, err
+		}
+		result := js.Global().Get("Object").New()
+		result.Set("data", bytesToJS(data))
+		result.Set("type", "application/json")
+		result.Set("name", "pdf-turbo-trace-"+started.UTC().Format("20060102-150405")+".json")
+		result.Set("events", len(file.Events))
+		result.Set("dropped", file.Dropped)
+		return result, nil
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	tracer.mu.Lock()
+	wasOn, oldStarted, oldMax, oldEvents, oldDropped := tracer.on, tracer.started, tracer.max, tracer.events, tracer.dropped
+	tracer.on, tracer.started, tracer.max, tracer.events, tracer.dropped = true, time.Now(), 4, nil, 0
+	tracer.mu.Unlock()
+	defer func() {
+		tracer.mu.Lock()
+		tracer.on, tracer.started, tracer.max, tracer.events, tracer.dropped = wasOn, oldStarted, oldMax, oldEvents, oldDropped
+		tracer.mu.Unlock()
+	}()
+
+	data := fixtureJPEG(fixtureGradient(64, 64))
+	_, err := compressImageData(context.Background(), data, "image/jpeg", defaultImageOptions(), func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer.mu.Lock()
+	events, dropped := tracer.events, tracer.dropped
+	tracer.mu.Unlock()
+	// The ring keeps the last events, ending with the choice
+	if len(events) != 4 || dropped == 0 || events[3].Event != "best" || events[3].Data["size"] == nil {
+		t.Fatalf("trace kept %d events, dropped %d: %+v", len(events), dropped, events)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Queue sizes for a compression transform: compressed bytes on the
+// readable side, chunks on the writable side (chunks may be strings).
+// Writers wait once these fill, so a fast source cannot run ahead of a
+// slow upload.
+const (
+	transformReadableHighWater = 1 << 20
+	transformWritableHighWater = 4
+)
+
+// Bytes of a stream chunk: Uint8Array and other views, ArrayBuffer or
+// string (UTF-8)
+func chunkBytesFromJS(v js.Value) ([]byte, error) {
+	switch {
+	case v.Type() == js.TypeString:
+		return []byte(v.String()), nil
+	case v.InstanceOf(js.Global().Get("Uint8Array")):
+		return bytesFromJS(v), nil
+	case v.InstanceOf(js.Global().Get("ArrayBuffer")):
+		return bytesFromJS(js.Global().Get("Uint8Array").New(v)), nil
+	case js.Global().Get("ArrayBuffer").Call("isView", v).Bool():
+		return bytesFromJS(js.Global().Get("Uint8Array").New(v.Get("buffer"), v.Get("byteOffset"), v.Get("byteLength"))), nil
+	}
+	return nil, fmt.Errorf("stream chunks must be bytes or strings, got %s", v.Type().String())
+}
+
+// createCompressionTransform(options?, onProgress?) returns a WHATWG
+// TransformStream that compresses whatever is piped through it:
+//
+//	file.stream().pipeThrough(createCompressionTransform({algorithm: "zstd"}))
+//
+// Options are those of createCompressionStream. The transform queues at
+// most 4 input chunks and 1 MB of output, so pipes apply backpressure end
+// to end. onProgress, if given, is called with {inputOffset, outputOffset,
+// checkpoint?} after every chunk. Invalid options error the stream on
+// first use.
+func createCompressionTransform(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] createCompressionTransform called with %d arguments\n", len(args))
+
+	opts := streamOptions{compressOptions: defaultCompressOptions()}
+	var err error
+	if len(args) > 0 {
+		err = decodeOptions(args[0], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 1 {
+		progressCallback = args[1]
+	}
+	var s *compressionStream
+	if err == nil {
+		s, err = newCompressionStream(opts)
+	}
+
+	j := startJob("compressionTransform")
+	var startFn, transformFn, flushFn, cancelFn js.Func
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			j.finish()
+			startFn.Release()
+			transformFn.Release()
+			flushFn.Release()
+			cancelFn.Release()
+		})
+	}
+
+	startFn = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if err != nil {
+			startErr := err
+			release()
+			return runAsync("createCompressionTransform", func() (interface{}, error) {
+				return nil, startErr
+			})
+		}
+		return nil
+	})
+	transformFn = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		chunk, chunkErr := chunkBytesFromJS(args[0])
+		controller := args[1]
+		return runAsync("compressionTransform", func() (interface{}, error) {
+			if chunkErr != nil {
+				return nil, chunkErr
+			}
+			if err := checkCancelled(j.ctx); err != nil {
+				return nil, err
+			}
+			c, err := s.write(chunk)
+			if err != nil {
+				return nil, err
+			}
+			if len(c.Data) > 0 {
+				controller.Call("enqueue", bytesToJS(c.Data))
+			}
+			if isSet(progressCallback) {
+				progress := js.Global().Get("Object").New()
+				progress.Set("inputOffset", c.InputOffset)
+				progress.Set("outputOffset", c.OutputOffset)
+				if c.Checkpoint != nil {
+					if jsCP, err := jsonToJS(c.Checkpoint); err == nil {
+						progress.Set("checkpoint", jsCP)
+					}
+				}
+				progressCallback.Invoke(progress)
+			}
+			return nil, nil
+		})
+	})
+	flushFn = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		controller := args[0]
+		return runAsync("compressionTransform", func() (interface{}, error) {
+			defer release()
+			data, err := s.finish()
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > 0 {
+				controller.Call("enqueue", bytesToJS(data))
+			}
+			fmt.Printf("[WASM] Transform finished: %d -> %d bytes\n", s.inputOffset, s.outputOffset)
+			return nil, nil
+		})
+	})
+	cancelFn = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if s != nil {
+			s.mu.Lock()
+			s.closed = true
+			s.mu.Unlock()
+		}
+		release()
+		return nil
+	})
+
+	transformer := js.Global().Get("Object").New()
+	transformer.Set("start", startFn)
+	transformer.Set("transform", transformFn)
+	transformer.Set("flush", flushFn)
+	transformer.Set("cancel", cancelFn) // streams that support it call this on abort
+
+	strategy := func(kind string, highWater int) js.Value {
+		init := js.Global().Get("Object").New()
+		init.Set("highWaterMark", highWater)
+		return js.Global().Get(kind).New(init)
+	}
+	if js.Global().Get("TransformStream").IsUndefined() {
+		release()
+		return runAsync("createCompressionTransform", func() (interface{}, error) {
+			return nil, errors.New("TransformStream is not available in this environment")
+		})
+	}
+	return js.Global().Get("TransformStream").New(transformer,
+		strategy("CountQueuingStrategy", transformWritableHighWater),
+		strategy("ByteLengthQueuingStrategy", transformReadableHighWater))
+}
@@ -0,0 +1,111 @@
+//go:build js
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestChunkBytesFromJS(t *testing.T) {
+	data := []byte("chunk\x00\xff")
+	view := bytesToJS(append([]byte("xx"), data...))
+	for name, v := range map[string]js.Value{
+		"Uint8Array":  bytesToJS(data),
+		"ArrayBuffer": bytesToJS(data).Get("buffer"),
+		"DataView":    js.Global().Get("DataView").New(view.Get("buffer"), 2, len(data)),
+	} {
+		if got, err := chunkBytesFromJS(v); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: %q, %v", name, got, err)
+		}
+	}
+	if got, err := chunkBytesFromJS(js.ValueOf("héllo")); err != nil || string(got) != "héllo" {
+		t.Errorf("string: %q, %v", got, err)
+	}
+	if _, err := chunkBytesFromJS(js.ValueOf(42)); err == nil {
+		t.Error("number accepted")
+	}
+}
+
+func TestCompressionTransform(t *testing.T) {
+	data := bytes.Repeat([]byte("piped through a transform stream\n"), 10000)
+	opts, _ := jsonToJS(map[string]interface{}{"algorithm": "gzip", "checkpointEvery": 100000})
+	var progress []js.Value
+	onProgress := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		progress = append(progress, args[0])
+		return nil
+	})
+	defer onProgress.Release()
+
+	ts := createCompressionTransform(js.Undefined(), []js.Value{opts, onProgress.Value}).(js.Value)
+	writer := ts.Get("writable").Call("getWriter")
+	reader := ts.Get("readable").Call("getReader")
+	if size := writer.Get("desiredSize").Int(); size != transformWritableHighWater {
+		t.Errorf("writable high water mark %d", size)
+	}
+
+	var out []byte
+	done := make(chan error, 1)
+	go func() {
+		for {
+			v, err := awaitJS(reader.Call("read"))
+			if err != nil || v.Get("done").Bool() {
+				done <- err
+				return
+			}
+			out = append(out, bytesFromJS(v.Get("value"))...)
+		}
+	}()
+	for p := 0; p < len(data); p += 30000 {
+		if _, err := awaitJS(writer.Call("write", bytesToJS(data[p:minInt(p+30000, len(data))]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := awaitJS(writer.Call("write", "tail string")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := awaitJS(writer.Call("close")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := decompressStream(out, defaultDecompressOptions())
+	want := append(data, "tail string"...)
+	if err != nil || !bytes.Equal(res.Data, want) {
+		t.Fatalf("round trip failed: %v", err)
+	}
+	if res.Members != len(want)/100000+1 {
+		t.Errorf("%d gzip members", res.Members)
+	}
+
+	// One progress call per chunk, with a checkpoint every 100000 bytes
+	checkpoints := 0
+	for _, p := range progress {
+		if isSet(p.Get("checkpoint")) {
+			checkpoints++
+		}
+	}
+	last := progress[len(progress)-1]
+	if len(progress) != (len(data)+29999)/30000+1 || checkpoints != len(data)/100000 || last.Get("inputOffset").Int() != len(want) {
+		t.Errorf("%d progress calls, %d checkpoints, last at %d", len(progress), checkpoints, last.Get("inputOffset").Int())
+	}
+}
+
+func TestCompressionTransformErrors(t *testing.T) {
+	// Invalid options error the stream on first use
+	bad, _ := jsonToJS(map[string]interface{}{"algorithm": "brotli", "checkpointEvery": 5})
+	ts := createCompressionTransform(js.Undefined(), []js.Value{bad}).(js.Value)
+	if _, err := awaitJS(ts.Get("writable").Call("getWriter").Call("write", "x")); err == nil {
+		t.Error("checkpointed brotli transform accepted a write")
+	}
+
+	// So does a chunk that is not bytes
+	ts = createCompressionTransform(js.Undefined(), nil).(js.Value)
+	if _, err := awaitJS(ts.Get("writable").Call("getWriter").Call("write", 42)); err == nil {
+		t.Error("number chunk accepted")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+)
+
+// Whether any pixel of img is less than fully opaque
+func hasTransparency(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Compress a photo with transparency. JPEG has no alpha channel, so the
+// candidates are a palette PNG (exact when the image has few colors,
+// median-cut otherwise) and a lossless WebP; the smaller wins. Returns nil
+// when neither could be produced in the time budget. Every encode is also
+// handed to keep.
+func compressTransparentImage(img image.Image, budget timeBudget, reportProgress func(int), keep func(imageCandidate)) ([]byte, []message, bool) {
+	var warnings []message
+	timedOut := false
+	pngEncoder := &png.Encoder{CompressionLevel: png.BestCompression}
+	if budget.limited() {
+		pngEncoder.CompressionLevel = png.DefaultCompression
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	var best []byte
+	consider := func(label, mimeType string, data []byte) {
+		fmt.Printf("[WASM] Transparent %s: %d bytes\n", label, len(data))
+		keep(imageCandidate{Label: label, MimeType: mimeType, Data: data})
+		if best == nil || len(data) < len(best) {
+			best = data
+		}
+	}
+
+	if budget.fitsEncode(w, h, 10) {
+		palette, exact := exactPalette(img, maxPaletteColors)
+		label := fmt.Sprintf("exact %d-color palette", len(palette))
+		if !exact {
+			palette = medianCutPalette(img, maxPaletteColors)
+			label = "quantized palette"
+		}
+		buf := new(bytes.Buffer)
+		if err := pngEncoder.Encode(buf, quantizeImage(img, palette)); err == nil {
+			consider(label, "image/png", buf.Bytes())
+		}
+	} else {
+		timedOut = true
+		warnings = append(warnings, newMessage("budget.palettePNGSkipped"))
+	}
+
+	reportProgress(75)
+
+	if budget.fitsEncode(w, h, 6) {
+		if data, err := encodeWebPLossless(img); err == nil {
+			consider("lossless webp", "image/webp", data)
+		} else {
+			warnings = append(warnings, newMessage("image.webpLosslessFailed", "error", err))
+		}
+	} else {
+		timedOut = true
+		warnings = append(warnings, newMessage("budget.losslessWebPSkipped"))
+	}
+	reportProgress(90)
+	return best, warnings, timedOut
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestCompressTransparentImage(t *testing.T) {
+	// A photo cutout: too many colors for an exact palette
+	cutout := fixtureCutout(160, 120)
+	var kept []imageCandidate
+	out, warnings, timedOut := compressTransparentImage(cutout, timeBudget{}, func(int) {}, func(c imageCandidate) { kept = append(kept, c) })
+	if timedOut || len(warnings) != 0 || len(kept) != 2 {
+		t.Fatalf("timed out %v, warnings %+v, %d candidates", timedOut, warnings, len(kept))
+	}
+	for _, c := range kept {
+		if len(c.Data) < len(out) || sniffMimeType(c.Data) != c.MimeType {
+			t.Errorf("%s: %d bytes as %s, chosen %d", c.Label, len(c.Data), sniffMimeType(c.Data), len(out))
+		}
+	}
+	img, err := decodeStillImage(out)
+	if err != nil || !hasTransparency(img) {
+		t.Fatalf("output lost its alpha: %v", err)
+	}
+
+	// Few colors give an exact palette, pixel for pixel
+	icon := fixtureNRGBA(64, 64, func(x, y int) color.NRGBA {
+		if (x/8+y/8)%2 == 0 {
+			return color.NRGBA{200, 30, 30, 255}
+		}
+		return color.NRGBA{0, 0, 0, 0}
+	})
+	kept = nil
+	out, _, _ = compressTransparentImage(icon, timeBudget{}, func(int) {}, func(c imageCandidate) { kept = append(kept, c) })
+	if kept[0].Label != "exact 2-color palette" {
+		t.Errorf("palette candidate %q", kept[0].Label)
+	}
+	if err := samePixels(fixturePNG(icon), out); err != nil {
+		t.Error(err)
+	}
+
+	// With no time left nothing is encoded, and each skip is reported
+	expired := timeBudget{deadline: time.Now().Add(-time.Second)}
+	out, warnings, timedOut = compressTransparentImage(cutout, expired, func(int) {}, func(imageCandidate) {})
+	if out != nil || !timedOut || len(warnings) != 2 {
+		t.Errorf("expired budget: %d bytes, timed out %v, warnings %+v", len(out), timedOut, warnings)
+	}
+}
+
+func TestPhotoWithAlphaSkipsJPEG(t *testing.T) {
+	opts := defaultImageOptions()
+	opts.Alternatives = true
+	res, err := compressImageData(context.Background(), fixturePNG(fixtureCutout(256, 256)), "image/png", opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range append(res.Alternatives, imageCandidate{Label: "output", Data: res.Data}) {
+		if sniffMimeType(c.Data) == "image/jpeg" {
+			t.Errorf("%s is a JPEG", c.Label)
+		}
+	}
+	img, err := decodeStillImage(res.Data)
+	if err != nil || !hasTransparency(img) {
+		t.Fatalf("transparency lost: %v", err)
+	}
+}
+
+func TestHasTransparency(t *testing.T) {
+	opaque := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 255
+	}
+	half := image.NewNRGBA(opaque.Rect)
+	copy(half.Pix, opaque.Pix)
+	half.Pix[3] = 254
+	for name, c := range map[string]struct {
+		img  image.Image
+		want bool
+	}{
+		"opaque": {opaque, false}, "one pixel": {half, true},
+		"gray": {image.NewGray(opaque.Rect), false}, "cutout": {fixtureCutout(32, 32), true},
+	} {
+		if got := hasTransparency(c.img); got != c.want {
+			t.Errorf("%s: %v", name, got)
+		}
+	}
+}
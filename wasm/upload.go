@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Defaults for compressAndUpload
+const (
+	uploadDefaultChunkSize  = 1 << 20
+	uploadMinChunkSize      = 16 << 10
+	uploadDefaultMaxRetries = 3
+	uploadDefaultRetryDelay = 500 // ms, doubled after every failed attempt
+)
+
+// Options for compressAndUpload
+type uploadOptions struct {
+	streamOptions
+
+	ChunkSize  int   `json:"chunkSize"`  // compressed bytes per sink call
+	MaxRetries int   `json:"maxRetries"` // attempts per chunk after the first
+	RetryDelay int   `json:"retryDelay"` // ms before the first retry
+	TotalSize  int64 `json:"totalSize"`  // input size, if the source cannot tell
+}
+
+func defaultUploadOptions() uploadOptions {
+	return uploadOptions{
+		streamOptions: streamOptions{compressOptions: defaultCompressOptions()},
+		ChunkSize:     uploadDefaultChunkSize,
+		MaxRetries:    uploadDefaultMaxRetries,
+		RetryDelay:    uploadDefaultRetryDelay,
+	}
+}
+
+// Pulls input chunks from a JS source; returns nil at the end
+type chunkReader func() ([]byte, error)
+
+// Read from a Uint8Array, ArrayBuffer, Blob/File or ReadableStream. Also
+// returns the input size when it is known up front, else -1.
+func newChunkReader(source js.Value) (chunkReader, int64, error) {
+	if blob := js.Global().Get("Blob"); !blob.IsUndefined() && source.InstanceOf(blob) {
+		size := int64(source.Get("size").Int())
+		read, _, err := newChunkReader(source.Call("stream"))
+		return read, size, err
+	}
+	if rs := js.Global().Get("ReadableStream"); !rs.IsUndefined() && source.InstanceOf(rs) {
+		reader := source.Call("getReader")
+		finished := false
+		return func() ([]byte, error) {
+			for !finished {
+				res, err := awaitJS(reader.Call("read"))
+				if err != nil {
+					return nil, err
+				}
+				if res.Get("done").Bool() {
+					finished = true
+					break
+				}
+				chunk, err := chunkBytesFromJS(res.Get("value"))
+				if err != nil || len(chunk) > 0 {
+					return chunk, err
+				}
+			}
+			return nil, nil
+		}, -1, nil
+	}
+
+	data, err := chunkBytesFromJS(source)
+	if err != nil {
+		return nil, 0, errors.New("source must be bytes, a Blob or a ReadableStream")
+	}
+	return func() ([]byte, error) {
+		// Feed large buffers in pieces so progress keeps moving
+		n := minInt(len(data), uploadDefaultChunkSize)
+		chunk := data[:n]
+		data = data[n:]
+		if n == 0 {
+			return nil, nil
+		}
+		return chunk, nil
+	}, int64(len(data)), nil
+}
+
+// Fused progress for one upload
+type uploadProgress struct {
+	Phase           string  `json:"phase"` // "uploading", "retrying" or "done"
+	InputBytes      int64   `json:"inputBytes"`
+	TotalBytes      int64   `json:"totalBytes,omitempty"`
+	CompressedBytes int64   `json:"compressedBytes"`
+	UploadedBytes   int64   `json:"uploadedBytes"`
+	Chunks          int     `json:"chunks"`
+	Retries         int     `json:"retries"`
+	Fraction        float64 `json:"fraction"`
+}
+
+// Weigh compression and upload equally: the uploaded share is measured
+// against the output the whole input is expected to produce
+func (p *uploadProgress) update() {
+	if p.Phase == "done" {
+		p.Fraction = 1
+		return
+	}
+	if p.TotalBytes <= 0 || p.InputBytes == 0 {
+		p.Fraction = 0
+		return
+	}
+	read := float64(p.InputBytes) / float64(p.TotalBytes)
+	expected := float64(p.CompressedBytes) / read
+	sent := 0.0
+	if expected > 0 {
+		sent = float64(p.UploadedBytes) / expected
+	}
+	p.Fraction = (minFloat(read, 1) + minFloat(sent, 1)) / 2
+	if p.Fraction > 0.99 {
+		p.Fraction = 0.99
+	}
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Hands compressed chunks to the caller's sink, retrying failures
+type uploadSink struct {
+	ctx        context.Context
+	sink       js.Value
+	maxRetries int
+	retryDelay time.Duration
+	report     func()
+	progress   *uploadProgress
+	last       js.Value // what the sink resolved with for the final chunk
+}
+
+func (u *uploadSink) send(chunk []byte, final bool) error {
+	delay := u.retryDelay
+	for attempt := 0; ; attempt++ {
+		if err := checkCancelled(u.ctx); err != nil {
+			return err
+		}
+		info := js.Global().Get("Object").New()
+		info.Set("index", u.progress.Chunks)
+		info.Set("offset", u.progress.UploadedBytes)
+		info.Set("final", final)
+		info.Set("attempt", attempt)
+
+		result, err := callAwait(func() js.Value { return u.sink.Invoke(bytesToJS(chunk), info) })
+		if err == nil {
+			u.last = result
+			u.progress.Chunks++
+			u.progress.UploadedBytes += int64(len(chunk))
+			u.progress.Phase = "uploading"
+			u.report()
+			return nil
+		}
+		if attempt >= u.maxRetries {
+			return fmt.Errorf("chunk %d failed after %d attempts: %v", u.progress.Chunks, attempt+1, err)
+		}
+		fmt.Printf("[WASM] Upload chunk %d failed (%v), retrying in %v\n", u.progress.Chunks, err, delay)
+		u.progress.Retries++
+		u.progress.Phase = "retrying"
+		u.report()
+		select {
+		case <-time.After(delay):
+		case <-u.ctx.Done():
+			return errCancelled
+		}
+		delay *= 2
+	}
+}
+
+// compressAndUpload(source, sink, options?, onProgress?) compresses source
+// (bytes, a Blob/File or a ReadableStream) and hands the output to sink in
+// chunks as it is produced:
+//
+//	sink(chunk, {index, offset, final, attempt}) -> Promise
+//
+// The next chunk waits for the previous one, so a slow upload throttles
+// compression. A rejected or throwing sink call is retried with the same
+// chunk up to maxRetries times, waiting retryDelay ms and doubling it each
+// time. Options are those of createCompressionStream plus {chunkSize,
+// maxRetries, retryDelay, totalSize}. onProgress receives {phase,
+// inputBytes, totalBytes, compressedBytes, uploadedBytes, chunks, retries,
+// fraction}, fraction covering compression and upload together. Resolves
+// with the standard result object minus data, plus algorithm, chunks,
+// retries and response (what sink resolved with for the final chunk).
+func compressAndUpload(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] compressAndUpload called with %d arguments\n", len(args))
+
+	if len(args) < 2 || !isSet(args[0]) || args[1].Type() != js.TypeFunction {
+		return runAsync("compressAndUpload", func() (interface{}, error) {
+			return nil, errors.New("expected a source and a sink function")
+		})
+	}
+	source, sink := args[0], args[1]
+	opts := defaultUploadOptions()
+	var optsErr error
+	if len(args) > 2 {
+		optsErr = decodeOptions(args[2], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 3 {
+		progressCallback = args[3]
+	}
+
+	return runAsync("compressAndUpload", func() (interface{}, error) {
+		j := startJob("compressAndUpload")
+		defer j.finish()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		if opts.ChunkSize < uploadMinChunkSize {
+			return nil, fmt.Errorf("chunkSize must be at least %d bytes", uploadMinChunkSize)
+		}
+		if opts.MaxRetries < 0 || opts.RetryDelay < 0 {
+			return nil, errors.New("maxRetries and retryDelay cannot be negative")
+		}
+		s, err := newCompressionStream(opts.streamOptions)
+		if err != nil {
+			return nil, err
+		}
+		read, size, err := newChunkReader(source)
+		if err != nil {
+			return nil, err
+		}
+
+		progress := &uploadProgress{Phase: "uploading", TotalBytes: opts.TotalSize}
+		if size >= 0 {
+			progress.TotalBytes = size
+		}
+		report := func() {
+			if isSet(progressCallback) {
+				progress.update()
+				if p, err := jsonToJS(progress); err == nil {
+					progressCallback.Invoke(p)
+				}
+			}
+		}
+		u := &uploadSink{
+			ctx:        j.ctx,
+			sink:       sink,
+			maxRetries: opts.MaxRetries,
+			retryDelay: time.Duration(opts.RetryDelay) * time.Millisecond,
+			report:     report,
+			progress:   progress,
+		}
+
+		// Send whole chunks, holding back at least one byte so the last
+		// call can be marked final
+		var pending []byte
+		sendFull := func() error {
+			for len(pending) > opts.ChunkSize {
+				if err := u.send(pending[:opts.ChunkSize], false); err != nil {
+					return err
+				}
+				pending = pending[opts.ChunkSize:]
+			}
+			return nil
+		}
+		for {
+			chunk, err := read()
+			if err != nil {
+				return nil, fmt.Errorf("reading source: %v", err)
+			}
+			if chunk == nil {
+				break
+			}
+			c, err := s.write(chunk)
+			if err != nil {
+				return nil, err
+			}
+			progress.InputBytes = c.InputOffset
+			progress.CompressedBytes = c.OutputOffset
+			pending = append(pending, c.Data...)
+			if err := sendFull(); err != nil {
+				return nil, err
+			}
+			report()
+		}
+
+		tail, err := s.finish()
+		if err != nil {
+			return nil, err
+		}
+		progress.CompressedBytes = s.outputOffset
+		pending = append(pending, tail...)
+		if err := sendFull(); err != nil {
+			return nil, err
+		}
+		if err := u.send(pending, true); err != nil {
+			return nil, err
+		}
+		progress.Phase = "done"
+		report()
+		fmt.Printf("[WASM] Uploaded %d -> %d bytes in %d chunks, %d retries\n", s.inputOffset, s.outputOffset, progress.Chunks, progress.Retries)
+
+		result := js.Global().Get("Object").New()
+		result.Set("originalSize", s.inputOffset)
+		result.Set("compressedSize", s.outputOffset)
+		ratio := 1.0
+		if s.inputOffset > 0 {
+			ratio = float64(s.outputOffset) / float64(s.inputOffset)
+		}
+		result.Set("compressionRatio", ratio)
+		result.Set("algorithm", s.opts.Algorithm)
+		result.Set("chunks", progress.Chunks)
+		result.Set("retries", progress.Retries)
+		result.Set("response", u.last)
+		return result, nil
+	})
+}
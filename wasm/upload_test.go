@@ -0,0 +1,135 @@
+//go:build js
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+func TestUploadProgressFraction(t *testing.T) {
+	for _, c := range []struct {
+		p    uploadProgress
+		want float64
+	}{
+		{uploadProgress{Phase: "uploading"}, 0},
+		{uploadProgress{Phase: "uploading", TotalBytes: 100}, 0},
+		// Half read, compressed 4:1, and half of that sent
+		{uploadProgress{Phase: "uploading", TotalBytes: 100, InputBytes: 50, CompressedBytes: 12, UploadedBytes: 6}, 0.375},
+		{uploadProgress{Phase: "uploading", TotalBytes: 100, InputBytes: 100, CompressedBytes: 25, UploadedBytes: 25}, 0.99},
+		{uploadProgress{Phase: "done"}, 1},
+	} {
+		c.p.update()
+		if c.p.Fraction != c.want {
+			t.Errorf("%+v: fraction %v, want %v", c.p, c.p.Fraction, c.want)
+		}
+	}
+}
+
+func TestCompressAndUpload(t *testing.T) {
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i*i>>7 ^ i>>3)
+	}
+
+	// The sink keeps what it gets and fails its second call once
+	var got []byte
+	var infos []js.Value
+	calls := 0
+	sink := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		calls++
+		if calls == 2 {
+			return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New("network down"))
+		}
+		got = append(got, bytesFromJS(args[0])...)
+		infos = append(infos, args[1])
+		return js.ValueOf(fmt.Sprintf("ok-%d", args[1].Get("index").Int()))
+	})
+	defer sink.Release()
+	var fractions []float64
+	onProgress := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		fractions = append(fractions, args[0].Get("fraction").Float())
+		return nil
+	})
+	defer onProgress.Release()
+
+	opts, _ := jsonToJS(map[string]interface{}{"chunkSize": 16384, "retryDelay": 1, "level": 1})
+	res, err := awaitJS(compressAndUpload(js.Undefined(), []js.Value{bytesToJS(data), sink.Value, opts, onProgress.Value}).(js.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || !bytes.Equal(plain, data) {
+		t.Fatalf("uploaded bytes do not decompress to the input: %v", err)
+	}
+
+	chunks := res.Get("chunks").Int()
+	if res.Get("retries").Int() != 1 || chunks != len(infos) || res.Get("compressedSize").Int() != len(got) ||
+		res.Get("response").String() != fmt.Sprintf("ok-%d", chunks-1) {
+		t.Errorf("result: %s", js.Global().Get("JSON").Call("stringify", res).String())
+	}
+	offset := 0
+	for i, info := range infos {
+		if info.Get("index").Int() != i || info.Get("offset").Int() != offset || info.Get("final").Bool() != (i == chunks-1) {
+			t.Errorf("chunk %d: %s", i, js.Global().Get("JSON").Call("stringify", info).String())
+		}
+		if i == 1 && info.Get("attempt").Int() != 1 {
+			t.Errorf("retried chunk sent as attempt %d", info.Get("attempt").Int())
+		}
+		offset += 16384
+	}
+	for i := 1; i < len(fractions); i++ {
+		if fractions[i] < fractions[i-1] {
+			t.Fatalf("progress went back: %v", fractions)
+		}
+	}
+	if len(fractions) == 0 || fractions[len(fractions)-1] != 1 {
+		t.Errorf("progress ended at %v", fractions)
+	}
+
+	// A Blob source reports its size up front
+	got, infos, calls = nil, nil, 0
+	blob := js.Global().Get("Blob").New(js.Global().Get("Array").New(bytesToJS(data)))
+	if _, err := awaitJS(compressAndUpload(js.Undefined(), []js.Value{blob, sink.Value}).(js.Value)); err != nil {
+		t.Fatal(err)
+	}
+	zr, _ = gzip.NewReader(bytes.NewReader(got))
+	if plain, _ := io.ReadAll(zr); !bytes.Equal(plain, data) {
+		t.Error("Blob upload does not decompress to the input")
+	}
+}
+
+func TestCompressAndUploadErrors(t *testing.T) {
+	// A sink that always throws gives up after maxRetries
+	attempts := 0
+	thrower := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		attempts++
+		return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New("boom"))
+	})
+	defer thrower.Release()
+	opts, _ := jsonToJS(map[string]interface{}{"retryDelay": 1, "maxRetries": 2})
+	_, err := awaitJS(compressAndUpload(js.Undefined(), []js.Value{bytesToJS([]byte("data")), thrower.Value, opts}).(js.Value))
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") || attempts != 3 {
+		t.Errorf("%d attempts: %v", attempts, err)
+	}
+
+	for name, args := range map[string][]js.Value{
+		"no sink":         {bytesToJS([]byte("data"))},
+		"small chunks":    {bytesToJS([]byte("data")), thrower.Value, js.Global().Get("JSON").Call("parse", `{"chunkSize":1024}`)},
+		"negative retry":  {bytesToJS([]byte("data")), thrower.Value, js.Global().Get("JSON").Call("parse", `{"maxRetries":-1}`)},
+		"number as input": {js.ValueOf(42), thrower.Value},
+	} {
+		if _, err := awaitJS(compressAndUpload(js.Undefined(), args).(js.Value)); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
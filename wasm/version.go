@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Semantic version of the module, kept in step with package.json. Bump
+// the minor version when adding a function, option or feature, the major
+// version when removing or changing one. Release builds may override it
+// with -ldflags "-X main.moduleVersion=1.2.3".
+var moduleVersion = "1.0.0"
+
+// Commit the module was built from, for builds outside a git checkout
+// (-ldflags "-X main.buildHash=..."); otherwise read from the VCS stamp
+var buildHash = ""
+
+// Capabilities hosts can gate on, sorted. A feature is listed once every
+// function and option it needs is in the build.
+var moduleFeatures = []string{
+	"allowlist",
+	"archive",
+	"avif-decode",
+	"batch",
+	"brotli",
+	"contact-sheet",
+	"delta",
+	"font-subset",
+	"gzip",
+	"heif",
+	"image",
+	"lz4",
+	"mp4-optimize",
+	"paste",
+	"pdf",
+	"pdf-report",
+	"pdf-tiff",
+	"policy",
+	"raw-preview",
+	"seekable",
+	"service-worker",
+	"streams",
+	"tab-coordination",
+	"text",
+	"throughput-limits",
+	"upload",
+	"warmup",
+	"web-assets",
+	"webp-decode",
+	"woff2",
+	"zstd",
+}
+
+// Build identity for bug reports
+type versionInfo struct {
+	Version   string   `json:"version"`
+	GoVersion string   `json:"goVersion"`
+	BuildHash string   `json:"buildHash,omitempty"`
+	BuildTime string   `json:"buildTime,omitempty"`
+	Modified  bool     `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	Tags      []string `json:"tags,omitempty"`
+	Features  []string `json:"features"`
+}
+
+func currentVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:   moduleVersion,
+		GoVersion: runtime.Version(),
+		BuildHash: buildHash,
+		Features:  moduleFeatures,
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, s := range build.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if info.BuildHash == "" {
+				info.BuildHash = s.Value
+			}
+		case "vcs.time":
+			info.BuildTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		case "-tags":
+			info.Tags = strings.Split(s.Value, ",")
+		}
+	}
+	return info
+}
+
+// Whether a version string is at least min; both are MAJOR.MINOR.PATCH,
+// anything after a "-" or "+" is ignored
+func versionAtLeast(version, min string) bool {
+	parse := func(v string) [3]int {
+		var parts [3]int
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		fmt.Sscanf(v, "%d.%d.%d", &parts[0], &parts[1], &parts[2])
+		return parts
+	}
+	a, b := parse(version), parse(min)
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return true
+}
+
+// getVersion(min?) returns {version, goVersion, buildHash, buildTime,
+// modified, tags, features} synchronously, for bug reports and feature
+// checks such as getVersion().features.includes("woff2"). Given a
+// minimum version, it also sets satisfies: whether this build is at least
+// that version.
+func getVersion(this js.Value, args []js.Value) interface{} {
+	info := currentVersionInfo()
+	result, err := jsonToJS(info)
+	if err != nil {
+		return js.Null()
+	}
+	if len(args) > 0 && args[0].Type() == js.TypeString {
+		result.Set("satisfies", versionAtLeast(info.Version, args[0].String()))
+	}
+	return result
+}
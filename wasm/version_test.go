@@ -0,0 +1,19 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	info := currentVersionInfo()
+	if !versionAtLeast(info.Version, "1.0.0") || info.GoVersion == "" {
+		t.Fatalf("version info %+v", info)
+	}
+	if !versionAtLeast("1.10.0-rc.1", "1.9.3") || versionAtLeast("1.2.0", "1.10.0") {
+		t.Fatal("versions compared as strings")
+	}
+	if !sort.StringsAreSorted(moduleFeatures) {
+		t.Fatal("feature list is not sorted")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Warm-up. The first call into a pipeline pays for work later calls do
+// not: the browser compiling the code it reaches, the heap growing to
+// working size, the device speed measurement and the encoders' tables.
+// init runs each pipeline once on a tiny fixture so hosts can pay that
+// during idle time instead of on the user's first file.
+
+// Pipelines init can warm
+const (
+	warmImage = "image"
+	warmPDF   = "pdf"
+	warmData  = "data"
+)
+
+var warmKinds = []string{warmImage, warmPDF, warmData}
+
+type initOptions struct {
+	Preload []string `json:"preload"` // kinds to warm; all when absent
+}
+
+func (o initOptions) validate() error {
+	for _, kind := range o.Preload {
+		if _, ok := warmers[kind]; !ok {
+			return fmt.Errorf("unknown preload %q, want image, pdf or data", kind)
+		}
+	}
+	return nil
+}
+
+// Each warmer runs a pipeline end to end on inputs small enough to take
+// milliseconds once compiled
+var warmers = map[string]func(ctx context.Context) error{
+	warmImage: func(ctx context.Context) error {
+		deviceSpeedMBps()
+		img := fixtureGradient(64, 64)
+		for _, in := range []struct {
+			data     []byte
+			mimeType string
+		}{{fixtureJPEG(img), "image/jpeg"}, {fixturePNG(fixtureCutout(64, 64)), "image/png"}} {
+			if _, err := compressImageData(ctx, in.data, in.mimeType, defaultImageOptions(), func(int) {}); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	warmPDF: func(ctx context.Context) error {
+		_, err := compressPDFData(ctx, fixturePDF(), defaultPDFOptions(), func(int) {})
+		return err
+	},
+	warmData: func(ctx context.Context) error {
+		data := []byte(fmt.Sprintf("%0512d", 0))
+		for _, codec := range []string{codecGzip, codecBrotli, codecZstd, codecLZ4} {
+			if _, err := compressPayload(data, compressOptions{Algorithm: codec}); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var (
+	warmMu     sync.Mutex
+	warmed     = map[string]time.Duration{} // kind -> time its warm-up took
+	moduleUp   bool                         // set once main registered every function
+	warmOnceMu sync.Mutex                   // serializes warm-ups so a kind runs once
+)
+
+// Warm one kind unless it already is; returns how long it took
+func warmUp(ctx context.Context, kind string) (time.Duration, error) {
+	warmOnceMu.Lock()
+	defer warmOnceMu.Unlock()
+	warmMu.Lock()
+	took, done := warmed[kind]
+	warmMu.Unlock()
+	if done {
+		return took, nil
+	}
+
+	start := time.Now()
+	if err := warmers[kind](ctx); err != nil {
+		return 0, fmt.Errorf("warming %s: %v", kind, err)
+	}
+	took = time.Since(start)
+	warmMu.Lock()
+	warmed[kind] = took
+	warmMu.Unlock()
+	fmt.Printf("[WASM] Warmed %s pipeline in %d ms\n", kind, took.Milliseconds())
+	return took, nil
+}
+
+// init(options?) warms the pipelines listed in preload ("image", "pdf",
+// "data"; all by default) in the background lane, so a file the user
+// drops meanwhile is not held up. Kinds already warm are skipped.
+// Resolves with {warmed: {kind: ms}}, the time each warm-up took.
+func initModule(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] init called with %d arguments\n", len(args))
+
+	opts := initOptions{Preload: warmKinds}
+	var err error
+	if len(args) > 0 {
+		err = decodeOptions(args[0], &opts)
+	}
+
+	return runAsync("init", func() (interface{}, error) {
+		j := startJobInLane("warmup", laneBackground)
+		defer j.finish()
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		times := map[string]interface{}{}
+		for _, kind := range opts.Preload {
+			if err := checkCancelled(j.ctx); err != nil {
+				return nil, err
+			}
+			took, err := warmUp(j.ctx, kind)
+			if err != nil {
+				return nil, err
+			}
+			times[kind] = took.Milliseconds()
+		}
+		result := js.Global().Get("Object").New()
+		result.Set("warmed", js.ValueOf(times))
+		return result, nil
+	})
+}
+
+// isReady(kind?) reports synchronously whether the module has registered
+// its functions or, given a kind, whether init has warmed that pipeline.
+// It replaces the wasmReady global, which stays for older hosts.
+func isReady(this js.Value, args []js.Value) interface{} {
+	warmMu.Lock()
+	defer warmMu.Unlock()
+	if len(args) > 0 && args[0].Type() == js.TypeString {
+		_, ok := warmed[args[0].String()]
+		return moduleUp && ok
+	}
+	return moduleUp
+}
+
+// Mark the module ready; called by main after registration
+func setModuleReady() {
+	warmMu.Lock()
+	moduleUp = true
+	warmMu.Unlock()
+}
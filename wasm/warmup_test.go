@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	if err := (initOptions{Preload: []string{"video"}}).validate(); err == nil {
+		t.Fatal("unknown preload accepted")
+	}
+	first, err := warmUp(context.Background(), warmData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := warmUp(context.Background(), warmData); err != nil || again != first {
+		t.Fatalf("second warm-up ran again (%v, %v)", again, err)
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// Web asset kinds handled on top of the markup/JSON minifiers
+const (
+	assetJS  = "js"
+	assetCSS = "css"
+)
+
+// Options for compressWebAsset
+type webAssetOptions struct {
+	// Strip comments and whitespace before compressing
+	Minify bool `json:"minify"`
+
+	// Leave files that reference a source map byte-identical, since
+	// minifying would shift every mapped line and column
+	PreserveSourceMaps bool `json:"preserveSourceMaps"`
+
+	GzipLevel   int `json:"gzipLevel"`   // 0 = best
+	BrotliLevel int `json:"brotliLevel"` // 0 = 9
+}
+
+func defaultWebAssetOptions() webAssetOptions {
+	return webAssetOptions{Minify: true, PreserveSourceMaps: true}
+}
+
+// Bundlers already emit minified output; lines this long mean there is
+// nothing left to strip
+const minifiedLineLength = 500
+
+// Map a short name, extension or MIME type onto an asset kind; markup and
+// JSON fall through to the generic minifier
+func webAssetKind(t string) (string, error) {
+	t = strings.ToLower(strings.TrimSpace(t))
+	t = strings.TrimPrefix(t, ".")
+	switch t {
+	case "js", "mjs", "cjs", "text/javascript", "application/javascript", "application/x-javascript":
+		return assetJS, nil
+	case "css", "text/css":
+		return assetCSS, nil
+	case "svg":
+		return minifyXML, nil
+	case "htm", "xhtml":
+		return minifyHTML, nil
+	}
+	return minifyKind(t)
+}
+
+// Newlines and source map comments, found in one pass over the asset
+var webAssetMarkerSet = newPatternSet([][]byte{
+	[]byte("\n"), []byte("# sourceMappingURL="), []byte("@ sourceMappingURL="),
+})
+
+// What buildWebAsset needs to know before minifying
+type webAssetMarkers struct {
+	size      int
+	lines     int
+	sourceMap bool // references an external or inline source map
+}
+
+func scanWebAsset(data []byte) webAssetMarkers {
+	m := webAssetMarkers{size: len(data), lines: 1}
+	webAssetMarkerSet.scan(data, func(p, at int) bool {
+		if p == 0 {
+			m.lines++
+		} else {
+			m.sourceMap = true
+		}
+		return true
+	})
+	return m
+}
+
+// Whether the text looks like bundler output already
+func (m webAssetMarkers) looksMinified() bool {
+	return m.size > minifiedLineLength && m.size/m.lines > minifiedLineLength
+}
+
+func isJSIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Keywords after which a slash starts a regular expression
+var jsRegexKeywords = map[string]bool{
+	"return": true, "typeof": true, "case": true, "do": true, "else": true, "in": true,
+	"instanceof": true, "new": true, "delete": true, "void": true, "throw": true,
+	"yield": true, "await": true,
+}
+
+// Whitespace- and comment-stripping JS minifier. It never renames or
+// rewrites tokens: newlines are kept wherever a run of whitespace held
+// one, so automatic semicolon insertion behaves exactly as before.
+// License (/*!) and source map comments are kept.
+func minifyJS(src []byte) ([]byte, error) {
+	out := make([]byte, 0, len(src))
+	var braces []int // template nesting: brace depth at each ${
+	depth := 0
+	lastWord := ""     // previous identifier/keyword token
+	lastSig := byte(0) // previous significant output byte
+	pendingSpace := byte(0)
+
+	emit := func(b ...byte) {
+		if pendingSpace != 0 && len(out) > 0 && len(b) > 0 {
+			prev, next := out[len(out)-1], b[0]
+			// Line breaks next to these never change how statements end
+			asiSafe := strings.IndexByte("{;,([", prev) >= 0 || strings.IndexByte("});,]", next) >= 0
+			if pendingSpace == '\n' && !asiSafe {
+				out = append(out, '\n')
+			} else if (isJSIdentByte(prev) && isJSIdentByte(next)) ||
+				(prev == '+' && next == '+') || (prev == '-' && next == '-') ||
+				(prev == '/' && next == '/') || (prev == '.' && next >= '0' && next <= '9') ||
+				(prev >= '0' && prev <= '9' && next == '.') {
+				out = append(out, ' ')
+			}
+		}
+		pendingSpace = 0
+		out = append(out, b...)
+		if len(b) > 0 {
+			lastSig = b[len(b)-1]
+		}
+	}
+
+	// Scan a template literal body from i (just after ` or }); returns
+	// the index after the closing backtick or after ${
+	scanTemplate := func(i int) (int, bool, error) {
+		for i < len(src) {
+			switch src[i] {
+			case '\\':
+				i += 2
+				continue
+			case '`':
+				return i + 1, false, nil
+			case '$':
+				if i+1 < len(src) && src[i+1] == '{' {
+					return i + 2, true, nil
+				}
+			}
+			i++
+		}
+		return i, false, errors.New("unterminated template literal")
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			if c == '\n' || c == '\r' {
+				pendingSpace = '\n'
+			} else if pendingSpace == 0 {
+				pendingSpace = ' '
+			}
+			i++
+
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			end := bytes.IndexAny(src[i:], "\r\n")
+			if end < 0 {
+				end = len(src) - i
+			}
+			comment := src[i : i+end]
+			if bytes.Contains(comment, []byte("sourceMappingURL=")) || bytes.Contains(comment, []byte("sourceURL=")) {
+				// Tools only look for these on a line of their own
+				if len(out) > 0 && out[len(out)-1] != '\n' {
+					out = append(out, '\n')
+				}
+				out = append(append(out, comment...), '\n')
+				pendingSpace = 0
+			}
+			i += end
+
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			comment := src[i : i+end+4]
+			if bytes.HasPrefix(comment, []byte("/*!")) || bytes.Contains(comment, []byte("@license")) {
+				emit(comment...)
+			} else if bytes.ContainsAny(comment, "\r\n") {
+				pendingSpace = '\n' // a multi-line comment counts as a line break
+			} else if pendingSpace == 0 {
+				pendingSpace = ' '
+			}
+			i += len(comment)
+
+		case c == '/' && (lastSig == 0 || strings.IndexByte("(,=:[!&|?{};+-*%<>~^", lastSig) >= 0 || jsRegexKeywords[lastWord]):
+			// Regular expression literal
+			j, inClass := i+1, false
+			for ; j < len(src); j++ {
+				if src[j] == '\\' {
+					j++
+					continue
+				}
+				if src[j] == '\n' {
+					return nil, errors.New("unterminated regular expression")
+				}
+				if src[j] == '[' {
+					inClass = true
+				} else if src[j] == ']' {
+					inClass = false
+				} else if src[j] == '/' && !inClass {
+					break
+				}
+			}
+			j++
+			for j < len(src) && isJSIdentByte(src[j]) {
+				j++
+			}
+			if j > len(src) {
+				return nil, errors.New("unterminated regular expression")
+			}
+			emit(src[i:j]...)
+			lastWord = ""
+			i = j
+
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				} else if src[j] == '\n' {
+					return nil, errors.New("unterminated string")
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, errors.New("unterminated string")
+			}
+			emit(src[i : j+1]...)
+			lastWord = ""
+			i = j + 1
+
+		case c == '`':
+			j, open, err := scanTemplate(i + 1)
+			if err != nil {
+				return nil, err
+			}
+			emit(src[i:j]...)
+			if open {
+				braces = append(braces, depth)
+				depth++
+				lastSig = '{'
+			}
+			lastWord = ""
+			i = j
+
+		case c == '}' && len(braces) > 0 && depth-1 == braces[len(braces)-1]:
+			// End of a ${...} substitution: continue the template
+			braces = braces[:len(braces)-1]
+			depth--
+			j, open, err := scanTemplate(i + 1)
+			if err != nil {
+				return nil, err
+			}
+			emit(src[i:j]...)
+			if open {
+				braces = append(braces, depth)
+				depth++
+				lastSig = '{'
+			}
+			lastWord = ""
+			i = j
+
+		case isJSIdentByte(c):
+			j := i
+			for j < len(src) && isJSIdentByte(src[j]) {
+				j++
+			}
+			// Numbers like 1.5e-3 include the sign of their exponent
+			if c >= '0' && c <= '9' {
+				for j < len(src) && (isJSIdentByte(src[j]) || src[j] == '.' ||
+					((src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E'))) {
+					j++
+				}
+			}
+			emit(src[i:j]...)
+			lastWord = string(src[i:j])
+			i = j
+
+		default:
+			if c == '{' {
+				depth++
+			} else if c == '}' {
+				depth--
+			}
+			emit(c)
+			lastWord = ""
+			i++
+		}
+	}
+	return out, nil
+}
+
+// Comment- and whitespace-stripping CSS minifier. Strings and url()
+// contents are copied verbatim; spaces are only removed around { } ; ,
+// and the last semicolon of a block, where they can never matter.
+func minifyCSS(src []byte) ([]byte, error) {
+	out := make([]byte, 0, len(src))
+	pendingSpace := false
+	const tight = "{};,"
+
+	emit := func(b ...byte) {
+		if pendingSpace && len(out) > 0 && strings.IndexByte(tight, out[len(out)-1]) < 0 && strings.IndexByte(tight, b[0]) < 0 {
+			out = append(out, ' ')
+		}
+		pendingSpace = false
+		out = append(out, b...)
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			pendingSpace = true
+			i++
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			comment := src[i : i+end+4]
+			if bytes.HasPrefix(comment, []byte("/*!")) || bytes.Contains(comment, []byte("sourceMappingURL=")) {
+				emit(comment...)
+			} else {
+				pendingSpace = true
+			}
+			i += len(comment)
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, errors.New("unterminated string")
+			}
+			emit(src[i : j+1]...)
+			i = j + 1
+		case (c == 'u' || c == 'U') && i+4 <= len(src) && strings.EqualFold(string(src[i:i+4]), "url("):
+			end := bytes.IndexByte(src[i:], ')')
+			if end < 0 {
+				return nil, errors.New("unterminated url()")
+			}
+			emit(src[i : i+end+1]...)
+			i += end + 1
+		case c == '}':
+			if len(out) > 0 && out[len(out)-1] == ';' {
+				out = out[:len(out)-1]
+			}
+			pendingSpace = false
+			emit(c)
+			i++
+		default:
+			emit(c)
+			i++
+		}
+	}
+	return out, nil
+}
+
+// Minified asset plus its precompressed variants
+type webAssetResult struct {
+	Data     []byte
+	Gzip     []byte
+	Brotli   []byte
+	Minified bool
+	Warnings []message
+}
+
+// Minify (when safe) and produce gzip and brotli variants
+func buildWebAsset(data []byte, kind string, opts webAssetOptions) (webAssetResult, error) {
+	res := webAssetResult{Data: data}
+	encoding, bomLen := detectTextEncoding(data)
+	text, warnings := textToUTF8(data[bomLen:], encoding)
+	res.Warnings = append(res.Warnings, warnings...)
+
+	markers := scanWebAsset(text)
+	switch {
+	case !opts.Minify:
+	case opts.PreserveSourceMaps && markers.sourceMap:
+		res.Warnings = append(res.Warnings, newMessage("asset.sourceMap"))
+	case markers.looksMinified():
+		res.Warnings = append(res.Warnings, newMessage("asset.bundled"))
+	default:
+		var minified []byte
+		var err error
+		switch kind {
+		case assetJS:
+			minified, err = minifyJS(text)
+		case assetCSS:
+			minified, err = minifyCSS(text)
+		default:
+			minified, err = minify(text, kind)
+		}
+		if err != nil {
+			// Leave unparseable assets alone rather than risk breaking them
+			res.Warnings = append(res.Warnings, newMessage("asset.minifyFailed", "error", err))
+		} else if len(minified) < len(data) {
+			res.Data = minified
+			res.Minified = true
+		}
+	}
+
+	var err error
+	if res.Gzip, err = compressWithCodec(res.Data, codecGzip, opts.GzipLevel, ""); err != nil {
+		return res, err
+	}
+	if res.Brotli, err = compressWithCodec(res.Data, codecBrotli, opts.BrotliLevel, ""); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// compressWebAsset(data, type, options?) prepares a static asset for
+// deployment: JS/CSS (and HTML, SVG, JSON) is minified with safe comment
+// and whitespace removal, then gzip and brotli variants are produced in
+// one pass. type is an extension ("js", ".css") or MIME type. Options:
+// {minify, preserveSourceMaps, gzipLevel, brotliLevel}. Resolves with
+// {data, gzip, brotli, originalSize, minifiedSize, gzipSize, brotliSize,
+// minified, warnings}.
+func compressWebAsset(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] compressWebAsset called with %d arguments\n", len(args))
+
+	if len(args) < 2 || !isSet(args[0]) || args[1].Type() != js.TypeString {
+		return runAsync("compressWebAsset", func() (interface{}, error) {
+			return nil, errors.New("missing required arguments (data, type)")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), declaredInputType(args[1].String()), args[0].Length())
+	if err != nil {
+		return runAsync("compressWebAsset", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	typeName := args[1].String()
+	opts := defaultWebAssetOptions()
+	var optsErr error
+	if len(args) > 2 {
+		optsErr = decodeOptions(args[2], &opts)
+	}
+
+	return runAsync("compressWebAsset", func() (interface{}, error) {
+		j := startJob("webAsset")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		if opts.GzipLevel < 0 || opts.GzipLevel > 9 || opts.BrotliLevel < 0 || opts.BrotliLevel > 11 {
+			return nil, errors.New("gzipLevel must be 0-9 and brotliLevel 0-11")
+		}
+		kind, err := webAssetKind(typeName)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := buildWebAsset(inputBytes, kind, opts)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("[WASM] Web asset %s: %d -> %d (gzip %d, brotli %d)\n",
+			kind, len(inputBytes), len(res.Data), len(res.Gzip), len(res.Brotli))
+
+		result := js.Global().Get("Object").New()
+		result.Set("data", bytesToJS(res.Data))
+		result.Set("gzip", bytesToJS(res.Gzip))
+		result.Set("brotli", bytesToJS(res.Brotli))
+		result.Set("originalSize", len(inputBytes))
+		result.Set("minifiedSize", len(res.Data))
+		result.Set("gzipSize", len(res.Gzip))
+		result.Set("brotliSize", len(res.Brotli))
+		result.Set("minified", res.Minified)
+		setMessages(result, res.Warnings)
+		return result, nil
+	})
+}
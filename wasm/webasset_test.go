@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMinifyJS(t *testing.T) {
+	for _, c := range []struct {
+		name, in, want string
+	}{
+		{"comments", "/*! lic */\n// hi\nvar a = 1 + +b;", "/*! lic */\nvar a=1+ +b;"},
+		{"template literal", "let s = `x ${ {a: 1}.a }  y`; /* c */ f()", "let s=`x ${{a:1}.a}  y`;f()"},
+		{"regex after return", "if (a) {\n  return /ab+c/gi.test(\"a // b\")\n}", "if(a){return/ab+c/gi.test(\"a // b\")}"},
+		{"regex class with slash", "r = /[/]  x/.test(y)", "r=/[/]  x/.test(y)"},
+		{"regex after typeof", "var r = typeof /x/", "var r=typeof/x/"},
+		{"division", "let z = 1 .toString(), q = a / 2 / 3", "let z=1 .toString(),q=a/2/3"},
+		{"division after comment", "x = y /* c */ / 2", "x=y/2"},
+		{"newline kept for ASI", "x = a\n++b", "x=a\n++b"},
+		{"unary operators", "a = b - -c; d = e + ++f; g = h- --i", "a=b- -c;d=e+ ++f;g=h- --i"},
+		{"string", `var s = 'it\'s  //not a comment'`, `var s='it\'s  //not a comment'`},
+		{"source map comment", "f(a)\n//# sourceMappingURL=a.map\n", "f(a)\n//# sourceMappingURL=a.map\n"},
+	} {
+		out, err := minifyJS([]byte(c.in))
+		if err != nil || string(out) != c.want {
+			t.Errorf("%s: %q, %v; want %q", c.name, out, err, c.want)
+		}
+	}
+	for _, in := range []string{"a = 1 /* open", "s = 'open"} {
+		if _, err := minifyJS([]byte(in)); err == nil {
+			t.Errorf("%q accepted", in)
+		}
+	}
+}
+
+func TestMinifyCSS(t *testing.T) {
+	for _, c := range []struct {
+		name, in, want string
+	}{
+		{"rules", "/* x */ a  >  b , c { color : red ; background: url( a b.png ) ;}",
+			"a > b,c{color : red;background: url( a b.png )}"},
+		{"media query", "@media (max-width: 10px) { .x { margin: 0 auto; } }", "@media (max-width: 10px){.x{margin: 0 auto}}"},
+		{"string", `a { content: "  ;}  "; }`, `a{content: "  ;}  "}`},
+		{"license comment", "/*! keep */ a{b:c}", "/*! keep */ a{b:c}"},
+	} {
+		out, err := minifyCSS([]byte(c.in))
+		if err != nil || string(out) != c.want {
+			t.Errorf("%s: %q, %v; want %q", c.name, out, err, c.want)
+		}
+	}
+	for _, in := range []string{"a { content: 'x", "/* open", "a { b: url(x"} {
+		if _, err := minifyCSS([]byte(in)); err == nil {
+			t.Errorf("%q accepted", in)
+		}
+	}
+}
+
+func TestBuildWebAsset(t *testing.T) {
+	src := []byte(strings.Repeat("// helper\nfunction add (a, b) {\n    return a + b;\n}\n", 20))
+	res, err := buildWebAsset(src, assetJS, defaultWebAssetOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Minified || len(res.Data) >= len(src) || len(res.Warnings) != 0 {
+		t.Fatalf("minified %v, %d -> %d bytes, warnings %+v", res.Minified, len(src), len(res.Data), res.Warnings)
+	}
+	if plain := decompressText(t, res.Gzip, codecGzip); !bytes.Equal(plain, res.Data) {
+		t.Error("gzip variant does not match the minified asset")
+	}
+	if plain := decompressText(t, res.Brotli, codecBrotli); !bytes.Equal(plain, res.Data) {
+		t.Error("brotli variant does not match the minified asset")
+	}
+
+	// Cases that leave the asset byte-identical, and the warning each gives
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		kind    string
+		opts    func(*webAssetOptions)
+		warning string
+	}{
+		{"minify off", src, assetJS, func(o *webAssetOptions) { o.Minify = false }, ""},
+		{"source map", append(append([]byte(nil), src...), "//# sourceMappingURL=app.js.map\n"...), assetJS, nil, "asset.sourceMap"},
+		{"bundled", bytes.Repeat([]byte("var a=1;"), 200), assetJS, nil, "asset.bundled"},
+		{"unparseable", []byte("a {\n  content: 'never closed;\n}\n"), assetCSS, nil, "asset.minifyFailed"},
+	} {
+		opts := defaultWebAssetOptions()
+		if c.opts != nil {
+			c.opts(&opts)
+		}
+		res, err := buildWebAsset(c.data, c.kind, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if res.Minified || !bytes.Equal(res.Data, c.data) {
+			t.Errorf("%s: asset changed", c.name)
+		}
+		if c.warning == "" && len(res.Warnings) != 0 || c.warning != "" && (len(res.Warnings) != 1 || res.Warnings[0].Code != c.warning) {
+			t.Errorf("%s: warnings %+v, want %q", c.name, res.Warnings, c.warning)
+		}
+	}
+
+	// Source maps only hold minification back when asked to
+	opts := defaultWebAssetOptions()
+	opts.PreserveSourceMaps = false
+	mapped := append(append([]byte(nil), src...), "//# sourceMappingURL=app.js.map\n"...)
+	if res, _ := buildWebAsset(mapped, assetJS, opts); !res.Minified {
+		t.Error("preserveSourceMaps false still skipped minification")
+	}
+}
+
+func TestWebAssetKind(t *testing.T) {
+	for in, want := range map[string]string{
+		"js": assetJS, ".mjs": assetJS, "application/javascript": assetJS,
+		"CSS": assetCSS, "text/css": assetCSS,
+		"svg": minifyXML, "htm": minifyHTML, "html": minifyHTML, "application/json": minifyJSON,
+	} {
+		if kind, err := webAssetKind(in); kind != want || err != nil {
+			t.Errorf("%q: %q, %v", in, kind, err)
+		}
+	}
+	if _, err := webAssetKind("wasm"); err == nil {
+		t.Error("wasm accepted")
+	}
+}
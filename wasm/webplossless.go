@@ -0,0 +1,603 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// Lossless WebP (VP8L) encoding: the subtract-green and predictor
+// transforms, LZ77 backward references and one set of length-limited
+// prefix codes for the whole image. Color caches, color indexing and meta
+// prefix codes are left out; they win a few percent more at several times
+// the code.
+
+const (
+	vp8lPredictorBits = 4 // predictor modes are chosen per 16x16 block
+	vp8lMaxSize       = 1 << 14
+	vp8lMaxMatch      = 4096
+	vp8lMinMatch      = 3
+	vp8lMaxDistance   = 1<<20 - 120
+	vp8lHashBits      = 16
+	vp8lChainDepth    = 32
+)
+
+// Order in which code length code lengths are written
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// The 120 short distance codes as (dy << 4 | 8 - dx): codes 1 to 120 name
+// pixels near the current one, larger codes are plain distances plus 120
+var vp8lDistanceMap = [120]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// LSB-first bit writer
+type vp8lBitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *vp8lBitWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *vp8lBitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
+
+// Huffman code lengths no longer than limit. Rare symbols are counted as
+// more frequent until the tree is shallow enough.
+func vp8lCodeLengths(freq []int, limit int) []uint8 {
+	lengths := make([]uint8, len(freq))
+	var syms []int
+	for s, f := range freq {
+		if f > 0 {
+			syms = append(syms, s)
+		}
+	}
+	if len(syms) == 1 {
+		lengths[syms[0]] = 1
+	}
+	if len(syms) < 2 {
+		return lengths
+	}
+
+	type node struct{ weight, sym, a, b int }
+	for floor := 1; ; floor *= 2 {
+		nodes := make([]node, 0, 2*len(syms))
+		for _, s := range syms {
+			nodes = append(nodes, node{weight: maxInt(freq[s], floor), sym: s, a: -1, b: -1})
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+		// Two-queue merge: leaves sorted, internal nodes created in
+		// weight order after them
+		leaves := len(nodes)
+		li, qi := 0, leaves
+		pick := func() int {
+			if li < leaves && (qi >= len(nodes) || nodes[li].weight <= nodes[qi].weight) {
+				li++
+				return li - 1
+			}
+			qi++
+			return qi - 1
+		}
+		for k := 1; k < leaves; k++ {
+			a := pick()
+			b := pick()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, sym: -1, a: a, b: b})
+		}
+
+		depth := make([]int, len(nodes))
+		for k := len(nodes) - 1; k >= leaves; k-- {
+			depth[nodes[k].a] = depth[k] + 1
+			depth[nodes[k].b] = depth[k] + 1
+		}
+		deepest := 0
+		for k := 0; k < leaves; k++ {
+			deepest = maxInt(deepest, depth[k])
+		}
+		if deepest <= limit {
+			for k := 0; k < leaves; k++ {
+				lengths[nodes[k].sym] = uint8(depth[k])
+			}
+			return lengths
+		}
+	}
+}
+
+// A prefix code ready for writing symbols
+type vp8lPrefixCode struct {
+	codes []uint16 // bit-reversed for the LSB-first writer
+	bits  []uint8  // 0 for every symbol of a single-symbol code
+}
+
+func (c *vp8lPrefixCode) put(w *vp8lBitWriter, sym int) {
+	w.write(uint32(c.codes[sym]), uint(c.bits[sym]))
+}
+
+// Canonical codes for the given lengths. Decoders read no bits at all for
+// a code with a single symbol.
+func newVP8LPrefixCode(lengths []uint8) *vp8lPrefixCode {
+	c := &vp8lPrefixCode{codes: make([]uint16, len(lengths)), bits: make([]uint8, len(lengths))}
+	var count [16]int
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used < 2 {
+		return c
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c.codes[s] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+		c.bits[s] = l
+		next[l]++
+	}
+	return c
+}
+
+// Write the prefix code for a symbol histogram and return it
+func writeVP8LPrefixCode(w *vp8lBitWriter, freq []int) *vp8lPrefixCode {
+	var syms []int
+	for s, f := range freq {
+		if f > 0 {
+			syms = append(syms, s)
+		}
+	}
+
+	// One or two 8-bit symbols fit the simple form
+	if len(syms) <= 2 && (len(syms) == 0 || syms[len(syms)-1] < 256) {
+		if len(syms) == 0 {
+			syms = []int{0}
+		}
+		w.write(1, 1)
+		w.write(uint32(len(syms)-1), 1)
+		if syms[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(syms[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(syms[0]), 8)
+		}
+		c := &vp8lPrefixCode{codes: make([]uint16, len(freq)), bits: make([]uint8, len(freq))}
+		if len(syms) == 2 {
+			w.write(uint32(syms[1]), 8)
+			c.bits[syms[0]], c.bits[syms[1]] = 1, 1
+			c.codes[syms[1]] = 1
+		}
+		return c
+	}
+
+	lengths := vp8lCodeLengths(freq, 15)
+
+	// Run-length code the lengths: 16 repeats the previous length 3-6
+	// times, 17 and 18 write 3-10 and 11-138 zeros
+	type rle struct{ sym, extra, extraBits int }
+	var tokens []rle
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run >= 3 {
+				if run >= 11 {
+					n := minInt(run, 138)
+					tokens = append(tokens, rle{18, n - 11, 7})
+					run -= n
+				} else {
+					tokens = append(tokens, rle{17, run - 3, 3})
+					run = 0
+				}
+			}
+		} else {
+			tokens = append(tokens, rle{int(l), 0, 0})
+			run--
+			for run >= 3 {
+				n := minInt(run, 6)
+				tokens = append(tokens, rle{16, n - 3, 2})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, rle{int(l), 0, 0})
+		}
+	}
+
+	clFreq := make([]int, len(vp8lCodeLengthOrder))
+	for _, t := range tokens {
+		clFreq[t.sym]++
+	}
+	clLengths := vp8lCodeLengths(clFreq, 7)
+	n := 4
+	for i, sym := range vp8lCodeLengthOrder {
+		if clLengths[sym] > 0 {
+			n = maxInt(n, i+1)
+		}
+	}
+	w.write(0, 1)
+	w.write(uint32(n-4), 4)
+	for _, sym := range vp8lCodeLengthOrder[:n] {
+		w.write(uint32(clLengths[sym]), 3)
+	}
+	w.write(0, 1) // every symbol's length follows
+	clCode := newVP8LPrefixCode(clLengths)
+	for _, t := range tokens {
+		clCode.put(w, t.sym)
+		w.write(uint32(t.extra), uint(t.extraBits))
+	}
+	return newVP8LPrefixCode(lengths)
+}
+
+// Prefix coding of an LZ77 length or distance code: a symbol plus extra bits
+func vp8lPrefix(v int) (sym int, extraBits uint, extra int) {
+	n := v - 1
+	if n < 4 {
+		return n, 0, 0
+	}
+	h := bits.Len(uint(n)) - 1
+	return 2*h + (n>>(h-1))&1, uint(h - 1), n & (1<<(h-1) - 1)
+}
+
+// A literal pixel, or a backward reference when length is set
+type vp8lToken struct {
+	argb   uint32
+	length int
+	dist   int // distance code
+}
+
+// Greedy LZ77 over the pixels. The left neighbour and the pixel above
+// are tried before the hash chain: they are the matches worth most and
+// have the shortest distance codes.
+func vp8lBackwardRefs(argb []uint32, width int) []vp8lToken {
+	distCodes := make(map[int]int, len(vp8lDistanceMap))
+	for i, b := range vp8lDistanceMap {
+		d := int(b>>4)*width + 8 - int(b&0xf)
+		if _, ok := distCodes[d]; d >= 1 && !ok {
+			distCodes[d] = i + 1
+		}
+	}
+
+	head := make([]int32, 1<<vp8lHashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(argb))
+	hash := func(i int) uint32 {
+		return (argb[i]*0x1e35a7bd ^ argb[i+1]*0x9e3779b1) >> (32 - vp8lHashBits)
+	}
+	insert := func(i int) {
+		if i+1 < len(argb) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	var tokens []vp8lToken
+	for i := 0; i < len(argb); {
+		bestLen, bestDist := 0, 0
+		limit := minInt(vp8lMaxMatch, len(argb)-i)
+		try := func(j int) {
+			if j < 0 || i-j > vp8lMaxDistance {
+				return
+			}
+			n := 0
+			for n < limit && argb[i+n] == argb[j+n] {
+				n++
+			}
+			if n > bestLen {
+				bestLen, bestDist = n, i-j
+			}
+		}
+		try(i - 1)
+		try(i - width)
+		if i+1 < len(argb) {
+			for j, depth := head[hash(i)], 0; j >= 0 && depth < vp8lChainDepth && bestLen < limit; j, depth = prev[j], depth+1 {
+				try(int(j))
+			}
+		}
+
+		if bestLen >= vp8lMinMatch {
+			code, ok := distCodes[bestDist]
+			if !ok {
+				code = bestDist + 120
+			}
+			tokens = append(tokens, vp8lToken{length: bestLen, dist: code})
+			for k := 0; k < bestLen; k++ {
+				insert(i + k)
+			}
+			i += bestLen
+			continue
+		}
+		tokens = append(tokens, vp8lToken{argb: argb[i]})
+		insert(i)
+		i++
+	}
+	return tokens
+}
+
+// Entropy-coded image data: prefix codes followed by the pixels. Only the
+// main image has the meta prefix code bit.
+func writeVP8LImageData(w *vp8lBitWriter, argb []uint32, width int, main bool) {
+	w.write(0, 1) // no color cache
+	if main {
+		w.write(0, 1) // one set of prefix codes for the whole image
+	}
+
+	tokens := vp8lBackwardRefs(argb, width)
+	green := make([]int, 256+24)
+	red := make([]int, 256)
+	blue := make([]int, 256)
+	alpha := make([]int, 256)
+	dist := make([]int, 40)
+	for _, t := range tokens {
+		if t.length == 0 {
+			alpha[t.argb>>24]++
+			red[t.argb>>16&0xff]++
+			green[t.argb>>8&0xff]++
+			blue[t.argb&0xff]++
+			continue
+		}
+		sym, _, _ := vp8lPrefix(t.length)
+		green[256+sym]++
+		sym, _, _ = vp8lPrefix(t.dist)
+		dist[sym]++
+	}
+
+	greenCode := writeVP8LPrefixCode(w, green)
+	redCode := writeVP8LPrefixCode(w, red)
+	blueCode := writeVP8LPrefixCode(w, blue)
+	alphaCode := writeVP8LPrefixCode(w, alpha)
+	distCode := writeVP8LPrefixCode(w, dist)
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			greenCode.put(w, int(t.argb>>8&0xff))
+			redCode.put(w, int(t.argb>>16&0xff))
+			blueCode.put(w, int(t.argb&0xff))
+			alphaCode.put(w, int(t.argb>>24))
+			continue
+		}
+		sym, n, extra := vp8lPrefix(t.length)
+		greenCode.put(w, 256+sym)
+		w.write(uint32(extra), n)
+		sym, n, extra = vp8lPrefix(t.dist)
+		distCode.put(w, sym)
+		w.write(uint32(extra), n)
+	}
+}
+
+// Per-channel arithmetic on packed ARGB pixels
+
+func vp8lSub(a, b uint32) uint32 {
+	ag := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	rb := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return ag&0xff00ff00 | rb&0x00ff00ff
+}
+
+func vp8lAverage2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+func vp8lSelect(l, t, tl uint32) uint32 {
+	pl, pt := 0, 0
+	for shift := 0; shift < 32; shift += 8 {
+		lc, tc, tlc := int(l>>shift&0xff), int(t>>shift&0xff), int(tl>>shift&0xff)
+		pl += absInt(tc - tlc)
+		pt += absInt(lc - tlc)
+	}
+	if pl < pt {
+		return l
+	}
+	return t
+}
+
+func vp8lClamp(v int) uint32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint32(v)
+}
+
+func vp8lClampAddSubtractFull(a, b, c uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(a>>shift&0xff) + int(b>>shift&0xff) - int(c>>shift&0xff)
+		out |= vp8lClamp(v) << shift
+	}
+	return out
+}
+
+func vp8lClampAddSubtractHalf(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		ac := int(a >> shift & 0xff)
+		out |= vp8lClamp(ac+(ac-int(b>>shift&0xff))/2) << shift
+	}
+	return out
+}
+
+// Prediction of a pixel from its neighbours under one of the 14 modes
+func vp8lPredict(mode int, l, t, tr, tl uint32) uint32 {
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return vp8lAverage2(vp8lAverage2(l, tr), t)
+	case 6:
+		return vp8lAverage2(l, tl)
+	case 7:
+		return vp8lAverage2(l, t)
+	case 8:
+		return vp8lAverage2(tl, t)
+	case 9:
+		return vp8lAverage2(t, tr)
+	case 10:
+		return vp8lAverage2(vp8lAverage2(l, tl), vp8lAverage2(t, tr))
+	case 11:
+		return vp8lSelect(l, t, tl)
+	case 12:
+		return vp8lClampAddSubtractFull(l, t, tl)
+	}
+	return vp8lClampAddSubtractHalf(vp8lAverage2(l, t), tl)
+}
+
+// Replace pixels by their prediction residuals, choosing for each block the
+// mode with the smallest residuals. Returns the residuals and the block
+// modes as a sub-image (mode in the green channel).
+func vp8lPredictorTransform(argb []uint32, width, height int) ([]uint32, []uint32, int) {
+	const block = 1 << vp8lPredictorBits
+	tilesW := (width + block - 1) / block
+	tilesH := (height + block - 1) / block
+	modes := make([]uint32, tilesW*tilesH)
+
+	// The first row and column have fixed predictors
+	residual := func(mode, x, y int) uint32 {
+		i := y*width + x
+		switch {
+		case y == 0 && x == 0:
+			return vp8lSub(argb[i], 0xff000000)
+		case y == 0:
+			return vp8lSub(argb[i], argb[i-1])
+		case x == 0:
+			return vp8lSub(argb[i], argb[i-width])
+		}
+		return vp8lSub(argb[i], vp8lPredict(mode, argb[i-1], argb[i-width], argb[i-width+1], argb[i-width-1]))
+	}
+	cost := func(r uint32) int {
+		c := 0
+		for shift := 0; shift < 32; shift += 8 {
+			v := int(r >> shift & 0xff)
+			c += minInt(v, 256-v)
+		}
+		return c
+	}
+
+	out := make([]uint32, len(argb))
+	for ty := 0; ty < tilesH; ty++ {
+		for tx := 0; tx < tilesW; tx++ {
+			x0, y0 := tx*block, ty*block
+			x1, y1 := minInt(x0+block, width), minInt(y0+block, height)
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				c := 0
+				for y := maxInt(y0, 1); y < y1; y++ {
+					for x := maxInt(x0, 1); x < x1; x++ {
+						c += cost(residual(mode, x, y))
+					}
+				}
+				if bestCost < 0 || c < bestCost {
+					best, bestCost = mode, c
+				}
+			}
+			modes[ty*tilesW+tx] = 0xff000000 | uint32(best)<<8
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					out[y*width+x] = residual(best, x, y)
+				}
+			}
+		}
+	}
+	return out, modes, tilesW
+}
+
+// Encode img as a lossless WebP. Fully transparent pixels have their
+// hidden color cleared, which no viewer shows but which lets them compress
+// like any other run.
+func encodeWebPLossless(img image.Image) ([]byte, error) {
+	src := imaging.Clone(img)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if width == 0 || height == 0 || width > vp8lMaxSize || height > vp8lMaxSize {
+		return nil, fmt.Errorf("%dx%d is outside the WebP size limit", width, height)
+	}
+
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for i := range argb {
+		p := src.Pix[4*i : 4*i+4]
+		if p[3] != 255 {
+			hasAlpha = true
+		}
+		if p[3] == 0 {
+			continue
+		}
+		// Subtract green: red and blue are stored relative to green
+		argb[i] = uint32(p[3])<<24 | uint32(p[0]-p[1])<<16 | uint32(p[1])<<8 | uint32(p[2]-p[1])
+	}
+
+	w := &vp8lBitWriter{}
+	w.write(0x2f, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	if hasAlpha {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+	w.write(0, 3) // version
+
+	w.write(1, 1)
+	w.write(2, 2) // subtract green
+
+	residuals, modes, tilesW := vp8lPredictorTransform(argb, width, height)
+	w.write(1, 1)
+	w.write(0, 2) // predictor
+	w.write(vp8lPredictorBits-2, 3)
+	writeVP8LImageData(w, modes, tilesW, false)
+
+	w.write(0, 1) // no more transforms
+	writeVP8LImageData(w, residuals, width, true)
+
+	return writeWebP([]webpChunk{{FourCC: "VP8L", Data: w.bytes()}}), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func fixtureNRGBA(w, h int, pixel func(x, y int) color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, pixel(x, y))
+		}
+	}
+	return img
+}
+
+func TestConvertWebP(t *testing.T) {
+	data, err := encodeWebPLossless(fixtureCutout(96, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultConvertOptions()
+	opts.MaxDimension = 48
+	out, bounds, err := convertImageData(data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sniffMimeType(out) != "image/jpeg" || bounds.Dx() != 48 || bounds.Dy() != 32 {
+		t.Fatalf("got %s %dx%d, want image/jpeg 48x32", sniffMimeType(out), bounds.Dx(), bounds.Dy())
+	}
+	// ftyp: size, "ftyp", major brand, minor version, compatible brands
+	avif := []byte("\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1avif")
+	if sniffMimeType(avif) != "image/avif" {
+		t.Fatal("AVIF ftyp not recognized")
+	}
+}
+
+func TestWebPLosslessRoundTrip(t *testing.T) {
+	seed := uint32(1)
+	noise := func() uint8 { seed = seed*1664525 + 1013904223; return uint8(seed >> 24) }
+	for name, img := range map[string]*image.NRGBA{
+		"1x1":  fixtureNRGBA(1, 1, func(x, y int) color.NRGBA { return color.NRGBA{1, 2, 3, 4} }),
+		"flat": fixtureNRGBA(40, 30, func(x, y int) color.NRGBA { return color.NRGBA{9, 9, 9, 255} }),
+		"gradient": fixtureNRGBA(117, 61, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 2), uint8(y * 4), uint8(x + y), uint8(255 - x)}
+		}),
+		"noise": fixtureNRGBA(33, 47, func(x, y int) color.NRGBA { return color.NRGBA{noise(), noise(), noise(), noise()} }),
+		"cutout": fixtureNRGBA(300, 200, func(x, y int) color.NRGBA {
+			if dx, dy := x-150, y-100; dx*dx+dy*dy > 80*80 {
+				return color.NRGBA{noise(), noise(), 0, 0} // hidden color may be dropped
+			}
+			return color.NRGBA{uint8(x), uint8(y), uint8(x ^ y), 255}
+		}),
+		"tall": fixtureNRGBA(2, 500, func(x, y int) color.NRGBA { return color.NRGBA{uint8(y % 7), uint8(y % 5), 0, 255} }),
+	} {
+		data, err := encodeWebPLossless(img)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if sniffMimeType(data) != "image/webp" {
+			t.Fatalf("%s: output sniffed as %s", name, sniffMimeType(data))
+		}
+		decoded, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if decoded.Bounds() != img.Bounds() {
+			t.Fatalf("%s: %v, want %v", name, decoded.Bounds(), img.Bounds())
+		}
+		for y := 0; y < img.Bounds().Dy(); y++ {
+			for x := 0; x < img.Bounds().Dx(); x++ {
+				want := img.NRGBAAt(x, y)
+				got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+				if got != want && (want.A != 0 || got.A != 0) {
+					t.Fatalf("%s (%d,%d): %v, want %v", name, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestVP8LCodeLengths(t *testing.T) {
+	// Fibonacci frequencies make the deepest possible Huffman tree
+	freq := make([]int, 30)
+	a, b := 1, 1
+	for i := range freq {
+		freq[i] = a
+		a, b = b, a+b
+	}
+	for _, limit := range []int{15, 7} {
+		lengths := vp8lCodeLengths(freq, limit)
+		kraft := 0.0
+		for s, l := range lengths {
+			if l == 0 || int(l) > limit {
+				t.Fatalf("limit %d: symbol %d has length %d", limit, s, l)
+			}
+			kraft += 1 / float64(int(1)<<l)
+		}
+		if kraft > 1 {
+			t.Errorf("limit %d: Kraft sum %v", limit, kraft)
+		}
+	}
+
+	if l := vp8lCodeLengths([]int{0, 5, 0}, 15); l[1] != 1 || l[0] != 0 || l[2] != 0 {
+		t.Errorf("single symbol: %v", l)
+	}
+	if l := vp8lCodeLengths([]int{0, 0}, 15); l[0] != 0 || l[1] != 0 {
+		t.Errorf("no symbols: %v", l)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// What to do with XMP packets. They often carry tens of KB of thumbnails,
+// edit history and padding that no viewer needs.
+const (
+	xmpKeep     = "keep"
+	xmpMinimize = "minimize" // drop thumbnails, document ancestors and padding
+	xmpStrip    = "strip"    // remove the packets entirely
+)
+
+func checkXMPMode(mode string) error {
+	switch mode {
+	case "", xmpKeep, xmpMinimize, xmpStrip:
+		return nil
+	}
+	return fmt.Errorf("unknown XMP mode %q", mode)
+}
+
+// Where XMP lives in JPEG (APP1 segments) and PNG (an iTXt chunk)
+var (
+	xmpJPEGNamespace = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpJPEGExtension = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+const xmpPNGKeyword = "XML:com.adobe.xmp"
+
+var (
+	xmpBulkyElements = regexp.MustCompile(`(?s)<xmp:Thumbnails\b.*?</xmp:Thumbnails>|<photoshop:DocumentAncestors\b.*?</photoshop:DocumentAncestors>`)
+	xmpSpaceBetween  = regexp.MustCompile(`>\s+<`)
+)
+
+// Drop embedded thumbnails, Photoshop's document ancestor list and the
+// whitespace between elements, which includes the padding writers leave
+// for in-place edits
+func minimizeXMP(packet []byte) []byte {
+	out := xmpBulkyElements.ReplaceAll(packet, nil)
+	return xmpSpaceBetween.ReplaceAll(out, []byte("><"))
+}
+
+// Apply an XMP mode to a JPEG or PNG file. Returns data unchanged for
+// other formats, when nothing changed or when the edited file would not be
+// valid, along with the number of bytes saved.
+func applyXMPMode(data []byte, mode string) ([]byte, int) {
+	if mode != xmpMinimize && mode != xmpStrip {
+		return data, 0
+	}
+	var out []byte
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		out = jpegXMP(data, mode)
+	case bytes.HasPrefix(data, pngSignature):
+		out = pngXMP(data, mode)
+	}
+	if out == nil || len(out) >= len(data) {
+		return data, 0
+	}
+	fmt.Printf("[WASM] XMP %s: %d -> %d bytes\n", mode, len(data), len(out))
+	return out, len(data) - len(out)
+}
+
+// Extended XMP segments only make sense next to the main packet, so strip
+// removes both; minimize leaves them as they are
+func jpegXMP(data []byte, mode string) []byte {
+	segments, _, err := ParseJPEGSegments(data)
+	if err != nil {
+		return nil
+	}
+	kept := make([]jpegSegment, 0, len(segments))
+	changed := false
+	for _, seg := range segments {
+		if seg.Marker == 0xE1 {
+			switch {
+			case bytes.HasPrefix(seg.Payload, xmpJPEGNamespace):
+				changed = true
+				if mode == xmpStrip {
+					continue
+				}
+				packet := minimizeXMP(seg.Payload[len(xmpJPEGNamespace):])
+				seg.Payload = append(append([]byte(nil), xmpJPEGNamespace...), packet...)
+			case bytes.HasPrefix(seg.Payload, xmpJPEGExtension) && mode == xmpStrip:
+				changed = true
+				continue
+			}
+		}
+		kept = append(kept, seg)
+	}
+	if !changed {
+		return nil
+	}
+	out := writeJPEGSegments(kept)
+	if !jpegDecodes(out) {
+		return nil
+	}
+	return out
+}
+
+// Compressed iTXt packets are left alone by minimize
+func pngXMP(data []byte, mode string) []byte {
+	chunks, err := ParsePNGChunks(data)
+	if err != nil {
+		return nil
+	}
+	kept := make([]pngChunk, 0, len(chunks))
+	changed := false
+	for _, c := range chunks {
+		if c.Type == "iTXt" && bytes.HasPrefix(c.Data, []byte(xmpPNGKeyword+"\x00")) {
+			if mode == xmpStrip {
+				changed = true
+				continue
+			}
+			// keyword NUL, compression flag and method, language NUL,
+			// translated keyword NUL, then the text
+			header := len(xmpPNGKeyword) + 3
+			lang := bytes.IndexByte(c.Data[minInt(header, len(c.Data)):], 0)
+			if header <= len(c.Data) && c.Data[header-2] == 0 && lang >= 0 {
+				translated := bytes.IndexByte(c.Data[header+lang+1:], 0)
+				if translated >= 0 {
+					textStart := header + lang + 1 + translated + 1
+					packet := minimizeXMP(c.Data[textStart:])
+					c.Data = append(append([]byte(nil), c.Data[:textStart]...), packet...)
+					changed = true
+				}
+			}
+		}
+		kept = append(kept, c)
+	}
+	if !changed {
+		return nil
+	}
+	out, err := writePNGChunks(kept)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// Minimize or remove /Metadata streams as opts.XMP says. The catalog's
+// packet of a PDF/A file (or a PDF/UA one while tags are kept) declares
+// its conformance, so strip only minimizes that one.
+func (doc *pdfDocument) reduceXMPMetadata(opts pdfOptions) bool {
+	if opts.XMP != xmpMinimize && opts.XMP != xmpStrip {
+		return false
+	}
+
+	catalogXMP := -1
+	if v, ok := doc.catalog().Get("Metadata"); ok && v.Kind == pdfRefKind {
+		catalogXMP = v.Ref.Num
+	}
+
+	found, before, after := 0, 0, 0
+	removed := map[int]bool{}
+	for _, num := range doc.objectNumbers() {
+		obj := doc.Objects[num]
+		if !obj.HasStream || obj.Dict().Name("Type") != "Metadata" {
+			continue
+		}
+		packet, err := decodeStream(doc, obj)
+		if err != nil {
+			continue
+		}
+		found++
+		before += len(obj.Stream)
+
+		pdfA := num == catalogXMP && bytes.Contains(packet, []byte("pdfaid:part"))
+		pdfUA := num == catalogXMP && opts.keepTags && bytes.Contains(packet, []byte("pdfuaid:part"))
+		if opts.XMP == xmpStrip && !pdfA && !pdfUA {
+			removed[num] = true
+			continue
+		}
+		if minimized := minimizeXMP(packet); len(minimized) < len(obj.Stream) {
+			// Stored unfiltered, as PDF/A requires for metadata
+			obj.Stream = minimized
+			obj.Dict().Delete("Filter")
+			obj.Dict().Delete("DecodeParms")
+		}
+		after += len(obj.Stream)
+	}
+	fmt.Printf("[WASM] Found %d XMP packets: %d -> %d bytes\n", found, before, after)
+	if before == after {
+		return false
+	}
+
+	// Drop references to removed packets along with the objects
+	for num := range removed {
+		delete(doc.Objects, num)
+	}
+	for _, obj := range doc.Objects {
+		if dict := obj.Dict(); dict != nil {
+			if v, ok := dict.Get("Metadata"); ok && v.Kind == pdfRefKind && removed[v.Ref.Num] {
+				dict.Delete("Metadata")
+			}
+		}
+	}
+	return true
+}
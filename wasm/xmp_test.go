@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestXMP(t *testing.T) {
+	photo := fixtureGradient(256, 256)
+
+	packet := fixtureXMPPacket()
+	jpegData := fixtureJPEG(photo)
+	payload := append(append([]byte(nil), xmpJPEGNamespace...), packet...)
+	app1 := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	jpegData = append(app1, jpegData[2:]...)
+
+	minimized, saved := applyXMPMode(jpegData, xmpMinimize)
+	if saved == 0 || !jpegDecodes(minimized) || !bytes.Contains(minimized, []byte("Report")) {
+		t.Fatal("JPEG XMP not minimized")
+	}
+	if stripped, _ := applyXMPMode(jpegData, xmpStrip); bytes.Contains(stripped, xmpJPEGNamespace) {
+		t.Fatal("JPEG XMP not stripped")
+	}
+
+	data := fixtureStreamPDF([]string{"/Type /Metadata /Subtype /XML"}, [][]byte{packet})
+	opts := defaultPDFOptions()
+	opts.XMP = xmpStrip
+	out := applyPDFPass(t, (*pdfDocument).reduceXMPMetadata, data, opts)
+	doc, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.Objects[2]; ok {
+		t.Fatal("PDF XMP stream not removed")
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"pdf-turbo-wasm/internal/js"
+)
+
+// What recompressZip did with an entry
+const (
+	zipEntryRecompressed = "recompressed"
+	zipEntryKept         = "kept"        // re-encoding did not help
+	zipEntryExcluded     = "excluded"    // filtered out by include/exclude
+	zipEntryUnsupported  = "unsupported" // not an image or PDF
+	zipEntryFailed       = "failed"
+)
+
+// Options for recompressZip
+type zipRecompressOptions struct {
+	// Globs matched against entry paths; "**" crosses directories and a
+	// pattern without "/" matches the file name alone. Empty include
+	// selects everything.
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+
+	// Image option overrides keyed by "image" or a file extension
+	// ("png", "jpg"); the extension wins
+	PerTypeOptions map[string]json.RawMessage `json:"perTypeOptions"`
+
+	// The installed policy, applied to every entry re-encoded
+	policy *compressionPolicy
+}
+
+type zipEntryResult struct {
+	Name           string    `json:"name"`
+	Action         string    `json:"action"`
+	OriginalSize   int64     `json:"originalSize"`   // stored bytes before
+	CompressedSize int64     `json:"compressedSize"` // stored bytes after
+	Warnings       []string  `json:"warnings,omitempty"`
+	Messages       []message `json:"messages,omitempty"`
+	Error          string    `json:"error,omitempty"`
+
+	// Report-mode policy violations of the bytes stored for the entry
+	PolicyViolations []message `json:"policyViolations,omitempty"`
+}
+
+// Translate a glob into an anchored regular expression
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					sb.WriteString("(?:.*/)?") // "**/" also matches no directory
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in glob %q", pattern)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// Compiled include/exclude lists
+type globFilter struct {
+	include, exclude []*regexp.Regexp
+	includeBase      []bool // pattern has no "/" and matches the base name
+	excludeBase      []bool
+}
+
+func newGlobFilter(include, exclude []string) (*globFilter, error) {
+	f := &globFilter{}
+	for _, p := range include {
+		re, err := globRegexp(p)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, re)
+		f.includeBase = append(f.includeBase, !strings.Contains(p, "/"))
+	}
+	for _, p := range exclude {
+		re, err := globRegexp(p)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, re)
+		f.excludeBase = append(f.excludeBase, !strings.Contains(p, "/"))
+	}
+	return f, nil
+}
+
+func globAny(res []*regexp.Regexp, base []bool, name string) bool {
+	for i, re := range res {
+		target := name
+		if base[i] {
+			target = path.Base(name)
+		}
+		if re.MatchString(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an entry path passes the filter
+func (f *globFilter) match(name string) bool {
+	if len(f.include) > 0 && !globAny(f.include, f.includeBase, name) {
+		return false
+	}
+	return !globAny(f.exclude, f.excludeBase, name)
+}
+
+// Image options for an entry: settings, then "image", then the extension
+func (o zipRecompressOptions) imageOptionsFor(name string) (imageOptions, error) {
+	opts := currentSettings().Image
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	for _, key := range []string{"image", ext} {
+		raw, ok := o.PerTypeOptions[key]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(raw, &opts); err != nil {
+			return opts, fmt.Errorf("perTypeOptions.%s: %v", key, err)
+		}
+	}
+	return opts, nil
+}
+
+// Drop the ZIP64 extra field (tag 0x0001); its sizes are stale once the
+// entry is rewritten, and the writer adds a fresh one when needed
+func stripZip64Extra(extra []byte) []byte {
+	var out []byte
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		if tag != 0x0001 {
+			out = append(out, extra[:4+size]...)
+		}
+		extra = extra[4+size:]
+	}
+	return out
+}
+
+// Copy an entry's compressed bytes unchanged
+func copyZipEntryRaw(zw *zip.Writer, f *zip.File) error {
+	r, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	hdr := f.FileHeader
+	w, err := zw.CreateRaw(&hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// What re-encoding one entry gave
+type zipEntryOutput struct {
+	action     string // zipEntryRecompressed, zipEntryKept or zipEntryUnsupported
+	data       []byte // the new bytes, when recompressed
+	warnings   []message
+	violations []message // the policy's, for the bytes that will be stored
+}
+
+// Re-encode one image or PDF entry under the policy, as compressImage and
+// compressPDF would. The entry is kept when that does not make it
+// smaller, unless the policy strips metadata the original still carries.
+// A panic fails only this entry.
+func recompressZipEntry(j *job, f *zip.File, opts zipRecompressOptions) (res zipEntryOutput, err error) {
+	defer recoverFile(f.Name, &err)
+	rc, err := f.Open()
+	if err != nil {
+		return res, err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return res, err
+	}
+
+	noProgress := func(int) {}
+	policy := opts.policy
+	mimeType := sniffMimeType(data)
+	var out []byte
+	switch {
+	case mimeType == "application/pdf":
+		pdfRes, err := compressPDFData(j.ctx, data, policy.applyPDF(currentSettings().PDF), noProgress)
+		if err != nil {
+			return res, err
+		}
+		out, res.warnings = pdfRes.Data, pdfRes.Warnings
+	case strings.HasPrefix(mimeType, "image/"):
+		imgOpts, err := opts.imageOptionsFor(f.Name)
+		if err != nil {
+			return res, err
+		}
+		imgRes, err := compressImageData(j.ctx, data, mimeType, policy.applyImage(imgOpts), noProgress)
+		if err != nil {
+			return res, err
+		}
+		out, res.warnings = policy.finishImage(imgRes.Data), imgRes.Warnings
+		// Keep the entry's format; a PNG named .png must stay a PNG
+		if sniffMimeType(out) != mimeType {
+			out = nil
+			res.warnings = append(res.warnings, newMessage("image.formatChanged"))
+		}
+	default:
+		res.action = zipEntryUnsupported
+		return res, nil
+	}
+
+	stripped := policy != nil && policy.StripMetadata && out != nil && !bytes.Equal(out, data)
+	if out == nil || uint64(len(out)) >= f.CompressedSize64 && !stripped {
+		res.action, out = zipEntryKept, data
+	} else {
+		res.action, res.data = zipEntryRecompressed, out
+	}
+	res.violations = append(policy.checkInput(mimeType), policy.checkOutput(mimeType, out, nil)...)
+	return res, nil
+}
+
+// Rewrite a ZIP, re-encoding selected image and PDF entries and copying
+// everything else byte for byte
+func recompressZipData(j *job, data []byte, opts zipRecompressOptions, reportProgress func(int)) ([]byte, []zipEntryResult, error) {
+	filter, err := newGlobFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ZIP: %v", err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if err := zw.SetComment(zr.Comment); err != nil {
+		return nil, nil, err
+	}
+	entries := make([]zipEntryResult, 0, len(zr.File))
+
+	for i, f := range zr.File {
+		if err := checkCancelled(j.ctx); err != nil {
+			return nil, nil, err
+		}
+		entry := zipEntryResult{
+			Name:           f.Name,
+			OriginalSize:   int64(f.CompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+		}
+
+		var out []byte
+		switch {
+		case f.FileInfo().IsDir() || f.Flags&0x1 != 0:
+			entry.Action = zipEntryUnsupported
+		case !filter.match(f.Name):
+			entry.Action = zipEntryExcluded
+		default:
+			res, err := recompressZipEntry(j, f, opts)
+			switch {
+			case err == errCancelled:
+				return nil, nil, err
+			case err != nil:
+				entry.Action = zipEntryFailed
+				entry.Error = err.Error()
+			default:
+				// A rejecting policy fails the whole call, as it does
+				// compressImage's
+				if err := opts.policy.enforce(res.violations); err != nil {
+					return nil, nil, fmt.Errorf("%s: %v", f.Name, err)
+				}
+				entry.Action, out = res.action, res.data
+				entry.Messages, entry.PolicyViolations = res.warnings, res.violations
+				entry.Warnings = messageTexts(entry.Messages)
+			}
+		}
+
+		if out == nil {
+			if err := copyZipEntryRaw(zw, f); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", f.Name, err)
+			}
+		} else {
+			// Images are already entropy coded; PDFs still have deflatable structure
+			hdr := f.FileHeader
+			hdr.Extra = stripZip64Extra(hdr.Extra)
+			hdr.Method = zip.Store
+			if sniffMimeType(out) == "application/pdf" {
+				hdr.Method = zip.Deflate
+			}
+			w, err := zw.CreateHeader(&hdr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", f.Name, err)
+			}
+			if _, err := w.Write(out); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", f.Name, err)
+			}
+		}
+		entries = append(entries, entry)
+		reportProgress((i + 1) * 95 / len(zr.File))
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	// Recompressed entry sizes are only known once the writer is done
+	written, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err == nil && len(written.File) == len(entries) {
+		for i, f := range written.File {
+			entries[i].CompressedSize = int64(f.CompressedSize64)
+		}
+	}
+	return buf.Bytes(), entries, nil
+}
+
+// recompressZip(data, options?, progress?) re-encodes the image and PDF
+// entries of a ZIP that match the include/exclude globs and copies every
+// other entry untouched. Options: {include, exclude, perTypeOptions}.
+// Resolves with the standard result object plus entries, one
+// {name, action, originalSize, compressedSize, warnings, messages,
+// error} per member.
+func recompressZip(this js.Value, args []js.Value) interface{} {
+	fmt.Printf("[WASM] recompressZip called with %d arguments\n", len(args))
+
+	if len(args) < 1 || !isSet(args[0]) {
+		return runAsync("recompressZip", func() (interface{}, error) {
+			return nil, errors.New("missing input data")
+		})
+	}
+
+	release, err := admitInput(peekJS(args[0], sniffPeekBytes), "", args[0].Length())
+	if err != nil {
+		return runAsync("recompressZip", func() (interface{}, error) {
+			return nil, err
+		})
+	}
+	inputBytes := bytesFromJS(args[0])
+	opts := zipRecompressOptions{policy: currentPolicy()}
+	var optsErr error
+	if len(args) > 1 {
+		optsErr = decodeOptions(args[1], &opts)
+	}
+	var progressCallback js.Value
+	if len(args) > 2 {
+		progressCallback = args[2]
+	}
+
+	return runAsync("recompressZip", func() (interface{}, error) {
+		j := startJob("recompressZip")
+		defer j.finish()
+		defer release()
+		if optsErr != nil {
+			return nil, optsErr
+		}
+		releaseSlot, err := tabs.acquire(j)
+		if err != nil {
+			return nil, err
+		}
+		defer releaseSlot()
+		reportProgress := progressReporter(progressCallback, j)
+
+		out, entries, err := recompressZipData(j, inputBytes, opts, reportProgress)
+		if err != nil {
+			return nil, err
+		}
+		reportProgress(100)
+		fmt.Printf("[WASM] ZIP recompressed: %d -> %d bytes, %d entries\n", len(inputBytes), len(out), len(entries))
+
+		result := newResultObject(inputBytes, out)
+		if jsEntries, err := jsonToJS(entries); err == nil {
+			result.Set("entries", jsEntries)
+		}
+		return result, nil
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"image/png"
+	"io"
+	"testing"
+)
+
+// Uncompressed PNG of a mock screenshot; screenshot mode always shrinks it
+func fixtureStoredPNG() []byte {
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	enc.Encode(&buf, fixtureScreenshot(160, 96))
+	return buf.Bytes()
+}
+
+func fixtureRecompressZip() []byte {
+	shot := fixtureStoredPNG()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.SetComment("bundle")
+	for _, f := range []struct {
+		name   string
+		method uint16
+		data   []byte
+	}{
+		{"shots/ui.png", zip.Store, shot},
+		{"notes.txt", zip.Deflate, bytes.Repeat([]byte("release notes\n"), 200)},
+		{"skip/ui.png", zip.Store, shot},
+		{"empty/", zip.Store, nil},
+	} {
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method, Modified: fixtureArchiveTime})
+		w.Write(f.data)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func readZipEntry(t *testing.T, f *zip.File) []byte {
+	t.Helper()
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatalf("%s: %v", f.Name, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc) // fails with zip.ErrChecksum on a bad CRC
+	if err != nil {
+		t.Fatalf("%s: %v", f.Name, err)
+	}
+	return data
+}
+
+func rawZipEntry(t *testing.T, f *zip.File) []byte {
+	t.Helper()
+	r, err := f.OpenRaw()
+	if err != nil {
+		t.Fatalf("%s: %v", f.Name, err)
+	}
+	data, _ := io.ReadAll(r)
+	return data
+}
+
+func TestRecompressZip(t *testing.T) {
+	in := fixtureRecompressZip()
+	j := startJob("zip")
+	defer j.finish()
+	opts := zipRecompressOptions{
+		Exclude:        []string{"skip/**"},
+		PerTypeOptions: map[string]json.RawMessage{"png": json.RawMessage(`{"mode":"screenshot"}`)},
+	}
+	out, entries, err := recompressZipData(j, in, opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"shots/ui.png": zipEntryRecompressed,
+		"notes.txt":    zipEntryUnsupported,
+		"skip/ui.png":  zipEntryExcluded,
+		"empty/":       zipEntryUnsupported,
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries: %+v", len(entries), entries)
+	}
+	for _, e := range entries {
+		if e.Action != want[e.Name] || e.Error != "" {
+			t.Errorf("%s: %s %q, want %s", e.Name, e.Action, e.Error, want[e.Name])
+		}
+	}
+
+	orig, _ := zip.NewReader(bytes.NewReader(in), int64(len(in)))
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatalf("output is not a ZIP: %v", err)
+	}
+	if zr.Comment != "bundle" || len(zr.File) != len(orig.File) {
+		t.Fatalf("comment %q, %d entries", zr.Comment, len(zr.File))
+	}
+	for i, f := range zr.File {
+		o := orig.File[i]
+		if f.Name != o.Name || !f.Modified.Equal(o.Modified) {
+			t.Errorf("entry %d: %s %v, want %s %v", i, f.Name, f.Modified, o.Name, o.Modified)
+		}
+		data := readZipEntry(t, f)
+		if entries[i].CompressedSize != int64(f.CompressedSize64) || entries[i].OriginalSize != int64(o.CompressedSize64) {
+			t.Errorf("%s: sizes %d -> %d, entry reports %d -> %d", f.Name, o.CompressedSize64, f.CompressedSize64, entries[i].OriginalSize, entries[i].CompressedSize)
+		}
+
+		if entries[i].Action != zipEntryRecompressed {
+			// Copied entries keep their method, CRC and compressed bytes
+			if f.Method != o.Method || f.CRC32 != o.CRC32 || !bytes.Equal(rawZipEntry(t, f), rawZipEntry(t, o)) {
+				t.Errorf("%s: not copied byte for byte", f.Name)
+			}
+			continue
+		}
+
+		// Re-encoded images are stored, with a CRC of the new bytes and
+		// the same pixels
+		if f.Method != zip.Store || f.CRC32 != crc32.ChecksumIEEE(data) || f.CompressedSize64 >= o.CompressedSize64 {
+			t.Errorf("%s: method %d, crc %08x, %d -> %d bytes", f.Name, f.Method, f.CRC32, o.CompressedSize64, f.CompressedSize64)
+		}
+		if !bytes.HasPrefix(data, pngSignature) {
+			t.Errorf("%s: no longer a PNG", f.Name)
+		}
+		if err := samePixels(readZipEntry(t, o), data); err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+	}
+
+	// A recompressed ZIP goes through again with nothing left to gain
+	again, entries, err := recompressZipData(j, out, opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Action != zipEntryKept {
+		t.Errorf("second pass: %s %s, want kept", entries[0].Name, entries[0].Action)
+	}
+	if !bytes.Equal(again, out) {
+		t.Error("second pass changed the archive")
+	}
+
+	if _, _, err := recompressZipData(j, in[:len(in)/2], opts, func(int) {}); err == nil {
+		t.Error("truncated ZIP accepted")
+	}
+	if _, _, err := recompressZipData(j, in, zipRecompressOptions{Include: []string{"[a"}}, func(int) {}); err == nil {
+		t.Error("bad glob accepted")
+	}
+}
+
+func TestRecompressZipPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "photo.jpg", Method: zip.Store, Modified: fixtureArchiveTime})
+	w.Write(fixtureJPEGWithEXIF(fixtureGradient(64, 64), 2000))
+	zw.Close()
+	in := buf.Bytes()
+	j := startJob("zip")
+	defer j.finish()
+
+	// Re-encoding does not pay here, but the policy still strips the EXIF
+	// and flags the output size
+	policy := &compressionPolicy{StripMetadata: true, MaxOutputBytes: map[string]int{"image/*": 100}, Enforcement: policyReport}
+	opts := zipRecompressOptions{
+		PerTypeOptions: map[string]json.RawMessage{"image": json.RawMessage(`{"minSavings":0.95}`)},
+		policy:         policy,
+	}
+	out, entries, err := recompressZipData(j, in, opts, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entries[0]
+	if e.Action != zipEntryRecompressed || len(e.PolicyViolations) != 1 || e.PolicyViolations[0].Code != "policy.outputTooLarge" {
+		t.Fatalf("report mode: %s, violations %v", e.Action, messageTexts(e.PolicyViolations))
+	}
+	zr, _ := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if v := policy.checkOutput("image/jpeg", readZipEntry(t, zr.File[0]), nil); len(v) != 1 {
+		t.Errorf("stored entry: %v", messageTexts(v))
+	}
+
+	// A rejecting policy fails the call
+	policy.Enforcement = policyReject
+	if _, _, err := recompressZipData(j, in, opts, func(int) {}); err == nil {
+		t.Error("violation accepted under reject")
+	}
+	policy.AllowedFormats = []string{"application/pdf"}
+	policy.MaxOutputBytes = nil
+	if _, _, err := recompressZipData(j, in, opts, func(int) {}); err == nil {
+		t.Error("disallowed entry type accepted under reject")
+	}
+}
+
+func TestGlobFilter(t *testing.T) {
+	for _, c := range []struct {
+		include, exclude []string
+		name             string
+		want             bool
+	}{
+		{nil, nil, "a/b.png", true},
+		{[]string{"*.png"}, nil, "deep/dir/b.png", true}, // no "/": base name
+		{[]string{"*.png"}, nil, "b.jpg", false},
+		{[]string{"img/*.png"}, nil, "img/sub/b.png", false},
+		{[]string{"img/**/*.png"}, nil, "img/b.png", true},
+		{[]string{"img/**/*.png"}, nil, "img/sub/deep/b.png", true},
+		{[]string{"?.png"}, nil, "ab.png", false},
+		{[]string{"[!x]*.pdf"}, nil, "a.pdf", true},
+		{[]string{"[!x]*.pdf"}, nil, "x.pdf", false},
+		{[]string{"*.png"}, []string{"thumbs/**"}, "thumbs/b.png", false},
+		{nil, []string{"*.min.png"}, "a/b.min.png", false},
+		{nil, []string{"a.png"}, "a+png", true}, // dots are literal
+	} {
+		f, err := newGlobFilter(c.include, c.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.match(c.name); got != c.want {
+			t.Errorf("include %q exclude %q: %s matched %v", c.include, c.exclude, c.name, got)
+		}
+	}
+	if _, err := globRegexp("a[b"); err == nil {
+		t.Error("unterminated class accepted")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const codecZstd = "zstd"
+
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+// Largest zstd window accepted when decompressing unless the caller raises
+// it. Covers every standard level (19 uses 8 MB) while keeping a mobile
+// Safari tab well clear of its memory ceiling; --long and --ultra frames
+// ask for up to 128 MB or more.
+const zstdDefaultMaxWindow = 32 << 20
+
+// Upper bound for a caller-supplied window; wasm32 cannot address more
+const zstdMaxWindowLimit = 1 << 30
+
+// Window the first frame asks for; a single-segment frame is decoded
+// whole, so its content size is the window
+func zstdFrameWindow(data []byte) (uint64, error) {
+	var h zstd.Header
+	if err := h.Decode(data); err != nil {
+		return 0, fmt.Errorf("invalid zstd header: %v", err)
+	}
+	if h.SingleSegment {
+		return h.FrameContentSize, nil
+	}
+	return h.WindowSize, nil
+}
+
+func zstdWindowError(need, limit uint64) error {
+	if need == 0 {
+		return fmt.Errorf("zstd stream needs a window above the %d MB limit; raise maxWindow if the device can afford it", limit>>20)
+	}
+	// Round the need up so a window just over the limit does not read as
+	// equal to it
+	return fmt.Errorf("zstd stream needs a %d MB window, above the %d MB limit; raise maxWindow if the device can afford it", (need+1<<20-1)>>20, limit>>20)
+}
+
+// Stream-decode a zstd input, refusing frames whose window exceeds
+// maxWindow and output beyond limit
+func decompressZstd(data []byte, maxWindow, limit int64) ([]byte, error) {
+	if maxWindow <= 0 {
+		maxWindow = zstdDefaultMaxWindow
+	}
+	if maxWindow < zstd.MinWindowSize || maxWindow > zstdMaxWindowLimit {
+		return nil, fmt.Errorf("maxWindow must be between %d bytes and %d MB", zstd.MinWindowSize, zstdMaxWindowLimit>>20)
+	}
+
+	// Check up front so the common failure has a precise message
+	need, err := zstdFrameWindow(data)
+	if err != nil {
+		return nil, err
+	}
+	if need > uint64(maxWindow) {
+		return nil, zstdWindowError(need, uint64(maxWindow))
+	}
+
+	zr, err := zstd.NewReader(bytes.NewReader(data),
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderLowmem(true),
+		zstd.WithDecoderMaxWindow(uint64(maxWindow)),
+		zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var out bytes.Buffer
+	if err := copyLimited(&out, zr, limit); err != nil {
+		switch {
+		case errors.Is(err, zstd.ErrWindowSizeExceeded):
+			return nil, zstdWindowError(0, uint64(maxWindow))
+		case errors.Is(err, zstd.ErrDecoderSizeExceeded) && int64(out.Len()) >= limit:
+			return nil, fmt.Errorf("decompressed size exceeds the %d byte limit", limit)
+		case errors.Is(err, zstd.ErrDecoderSizeExceeded):
+			// A later frame with a larger window
+			return nil, zstdWindowError(0, uint64(maxWindow))
+		}
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Encoder options for a standard level (1-22, 0 for the default) and an
+// optional window size, a power of two; smaller windows cost ratio but
+// bound what the decoder must allocate
+func zstdEncoderOptions(level, window int) []zstd.EOption {
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	if window != 0 {
+		// Multi-segment frames keep the window bound even for small inputs
+		opts = append(opts, zstd.WithWindowSize(window), zstd.WithLowerEncoderMem(true), zstd.WithSingleSegment(false))
+	}
+	return opts
+}
+
+// Compress a whole buffer with zstd
+func compressZstd(data []byte, level, window int) ([]byte, error) {
+	zw, err := zstd.NewWriter(nil, zstdEncoderOptions(level, window)...)
+	if err != nil {
+		return nil, err
+	}
+	defer zw.Close()
+	return zw.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+}
+
+// Check zstd compression settings against what browsers can decode
+func validateZstdSettings(level, window int) error {
+	if level < 0 || level > 22 {
+		return errors.New("zstd level must be between 1 and 22")
+	}
+	if window != 0 && (window < zstd.MinWindowSize || window > zstdMaxWindowLimit || window&(window-1) != 0) {
+		return fmt.Errorf("zstd windowSize must be a power of two between %d bytes and %d MB", zstd.MinWindowSize, zstdMaxWindowLimit>>20)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestZstdRoundTripAtEachLevel(t *testing.T) {
+	data := bytes.Repeat([]byte("zstd level round trip fixture\n"), 2000)
+	for _, level := range []int{0, 1, 3, 9, 19, 22} {
+		out, err := compressPayload(data, compressOptions{Algorithm: codecZstd, Level: level})
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if !bytes.HasPrefix(out, zstdMagic) || len(out) >= len(data)/10 {
+			t.Errorf("level %d wrote %d bytes", level, len(out))
+		}
+		res, err := decompressStream(out, defaultDecompressOptions())
+		if err != nil || res.Format != codecZstd || !bytes.Equal(res.Data, data) {
+			t.Errorf("level %d decoded %d bytes as %s: %v", level, len(res.Data), res.Format, err)
+		}
+	}
+}
+
+func TestZstdWindowLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("a window is declared in the frame header\n"), 3<<20/41)
+
+	// Without a window the input is a single segment, so the decoder needs
+	// all 3 MB of it at once; a lower limit is refused with the size needed
+	whole, err := compressPayload(data, compressOptions{Algorithm: codecZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decompressStream(whole, decompressOptions{MaxWindow: 2 << 20})
+	if err == nil || !strings.Contains(err.Error(), "needs a 3 MB window, above the 2 MB limit") {
+		t.Errorf("3 MB frame under a 2 MB limit: %v", err)
+	}
+	res, err := decompressStream(whole, defaultDecompressOptions())
+	if err != nil || !bytes.Equal(res.Data, data) {
+		t.Errorf("3 MB frame under the default limit: %v", err)
+	}
+
+	// A 1 MB window is written into the header and decodes within 1 MB
+	small, err := compressPayload(data, compressOptions{Algorithm: codecZstd, WindowSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if need, err := zstdFrameWindow(small); err != nil || need != 1<<20 {
+		t.Errorf("1 MB window frame declares %d: %v", need, err)
+	}
+	res, err = decompressStream(small, decompressOptions{MaxWindow: 1 << 20})
+	if err != nil || !bytes.Equal(res.Data, data) {
+		t.Errorf("decoding within a 1 MB window: %v", err)
+	}
+
+	if _, err := decompressStream(small, decompressOptions{MaxWindow: 100}); err == nil {
+		t.Error("a 100 byte maxWindow was accepted")
+	}
+	if _, err := decompressStream(small, decompressOptions{MaxOutput: 1000}); err == nil {
+		t.Error("output beyond maxOutput was returned")
+	}
+	if _, err := decompressStream(small[:3], decompressOptions{Format: codecZstd}); err == nil {
+		t.Error("a cut frame header was accepted")
+	}
+}
+
+func TestZstdRejectsBadSettings(t *testing.T) {
+	for _, opts := range []compressOptions{
+		{Algorithm: codecZstd, Level: 23},
+		{Algorithm: codecZstd, Level: -1},
+		{Algorithm: codecZstd, WindowSize: 3 << 20},
+		{Algorithm: codecZstd, WindowSize: 512},
+		{Algorithm: codecZstd, WindowSize: 2 << 30},
+		{Algorithm: codecGzip, WindowSize: 1 << 20},
+	} {
+		if _, err := compressPayload([]byte("data"), opts); err == nil {
+			t.Errorf("%+v accepted", opts)
+		}
+	}
+}